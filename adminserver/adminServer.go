@@ -0,0 +1,999 @@
+package adminserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"igor/attrstats"
+	"igor/config"
+	"igor/core"
+	"igor/httphandler"
+	"igor/instrumentation"
+	"igor/ippool"
+	radiusClient "igor/radiusclient"
+	"igor/router"
+	"igor/sessionserver"
+	"igor/wiretrace"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Http server for querying metrics and performing administrative operations.
+// Access is controlled by the tokens and roles specified in the configuration
+type AdminServer struct {
+	// Holds the configuration instance for this server
+	ci *config.PolicyConfigurationManager
+
+	// The http server
+	server *http.Server
+
+	// Used for disconnecting sessions. Set with SetSessionStore
+	sessionsMutex sync.RWMutex
+	sessionStore  *sessionserver.RadiusSessionStore
+	packetSender  sessionserver.PacketSender
+
+	// Used for querying the attribute statistics. Set with SetAttributeStats
+	statsMutex     sync.RWMutex
+	attributeStats *attrstats.Analyzer
+
+	// Used for querying the utilization of the IP pools. Set with SetPoolManager
+	poolsMutex  sync.RWMutex
+	poolManager *ippool.PoolManager
+
+	// Used for operating on the diameter peers, radius servers and outstanding requests.
+	// Set with SetDiameterRouter, SetRadiusRouter and SetRadiusClientSocket or SetRadiusClient
+	routersMutex   sync.RWMutex
+	diameterRouter *router.DiameterRouter
+	radiusRouter   *router.RadiusRouter
+	radiusClient   radiusRequestsReporter
+}
+
+// Reports the radius requests sent and not yet answered. Implemented by the RadiusClientSocket and the RadiusClient
+type radiusRequestsReporter interface {
+	OutstandingRequests(timeout time.Duration) ([]radiusClient.OutstandingRequest, error)
+}
+
+// Item in the responses to metric queries
+type DiameterMetricItem struct {
+	Key   instrumentation.PeerDiameterMetricKey
+	Value uint64
+}
+
+type RadiusMetricItem struct {
+	Key   instrumentation.RadiusMetricKey
+	Value uint64
+}
+
+// Response to the session usage queries
+type SessionUsageItem struct {
+	Id          string
+	StartTime   time.Time
+	LastUpdated time.Time
+	Usage       sessionserver.SessionUsage
+}
+
+type SessionUsageResponse struct {
+	Sessions []SessionUsageItem
+	Total    sessionserver.SessionUsage
+}
+
+type CDRMetricItem struct {
+	Key   instrumentation.CDRMetricKey
+	Value uint64
+}
+
+// Items in the responses to duration queries
+type DiameterDurationItem struct {
+	Key   instrumentation.PeerDiameterMetricKey
+	Value instrumentation.DurationSummary
+}
+
+type RadiusDurationItem struct {
+	Key   instrumentation.RadiusMetricKey
+	Value instrumentation.DurationSummary
+}
+
+type HttpHandlerDurationItem struct {
+	Key   instrumentation.HttpHandlerMetricKey
+	Value instrumentation.DurationSummary
+}
+
+type SessionQueryDurationItem struct {
+	Key   instrumentation.SessionQueryMetricKey
+	Value instrumentation.DurationSummary
+}
+
+// Item in the responses to disconnect requests
+type DisconnectResult struct {
+	SessionId string
+	Error     string `json:",omitempty"`
+}
+
+// Creates a new AdminServer object and starts listening
+func NewAdminServer(instanceName string) *AdminServer {
+	ci := config.GetPolicyConfigInstance(instanceName)
+	as := AdminServer{ci: ci}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/diameterMetrics", as.withRole(httphandler.ROLE_READONLY, getDiameterMetricsHandler))
+	mux.HandleFunc("/radiusMetrics", as.withRole(httphandler.ROLE_READONLY, getRadiusMetricsHandler))
+	mux.HandleFunc("/cdrMetrics", as.withRole(httphandler.ROLE_READONLY, getCDRMetricsHandler))
+	mux.HandleFunc("/diameterMetrics/durations", as.withRole(httphandler.ROLE_READONLY, getDiameterDurationsHandler))
+	mux.HandleFunc("/radiusMetrics/durations", as.withRole(httphandler.ROLE_READONLY, getRadiusDurationsHandler))
+	mux.HandleFunc("/httpHandlerMetrics/durations", as.withRole(httphandler.ROLE_READONLY, getHttpHandlerDurationsHandler))
+	mux.HandleFunc("/sessionMetrics/durations", as.withRole(httphandler.ROLE_READONLY, getSessionQueryDurationsHandler))
+	mux.HandleFunc("/runtimeMetrics", as.withRole(httphandler.ROLE_READONLY, getRuntimeMetricsHandler))
+	mux.HandleFunc("/attributeStats", as.withRole(httphandler.ROLE_READONLY, as.attributeStatsHandler))
+	mux.HandleFunc("/ipPools", as.withRole(httphandler.ROLE_READONLY, as.ipPoolsHandler))
+	mux.HandleFunc("/ipPools/leases", as.withRole(httphandler.ROLE_READONLY, as.ipPoolLeasesHandler))
+	mux.HandleFunc("/peers", as.withRole(httphandler.ROLE_READONLY, as.peersHandler))
+	mux.HandleFunc("/peers/egressQueues", as.withRole(httphandler.ROLE_READONLY, getEgressQueuesHandler))
+	mux.HandleFunc("/peers/clockSkew", as.withRole(httphandler.ROLE_READONLY, getPeerClockSkewHandler))
+	mux.HandleFunc("/peers/outstanding", as.withRole(httphandler.ROLE_READONLY, as.peerOutstandingRequestsHandler))
+	mux.HandleFunc("/peers/disconnect", as.withRole(httphandler.ROLE_OPERATOR, as.peerDisconnectHandler))
+	mux.HandleFunc("/radiusServers", as.withRole(httphandler.ROLE_READONLY, as.radiusServersHandler))
+	mux.HandleFunc("/radiusServers/quarantine", as.withRole(httphandler.ROLE_OPERATOR, as.radiusServerQuarantineHandler))
+	mux.HandleFunc("/radiusServers/transitions", as.withRole(httphandler.ROLE_READONLY, as.radiusServerTransitionsHandler))
+	mux.HandleFunc("/radiusClient/outstanding", as.withRole(httphandler.ROLE_READONLY, as.radiusOutstandingRequestsHandler))
+	mux.HandleFunc("/logLevel", as.withRole(httphandler.ROLE_OPERATOR, logLevelHandler))
+	mux.HandleFunc("/trace", as.withRole(httphandler.ROLE_OPERATOR, as.traceHandler))
+	mux.HandleFunc("/radiusClients/clockSkew", as.withRole(httphandler.ROLE_READONLY, getRadiusClientClockSkewHandler))
+	mux.HandleFunc("/reload", as.withRole(httphandler.ROLE_OPERATOR, as.reloadHandler))
+	mux.HandleFunc("/disconnect", as.withRole(httphandler.ROLE_OPERATOR, as.disconnectHandler))
+	mux.HandleFunc("/sessions", as.withRole(httphandler.ROLE_READONLY, as.sessionsHandler))
+	mux.HandleFunc("/sessions/replicate", as.withRole(httphandler.ROLE_ADMIN, as.sessionReplicateHandler))
+	mux.HandleFunc("/sessions/snapshot", as.withRole(httphandler.ROLE_OPERATOR, as.sessionSnapshotHandler))
+	mux.HandleFunc("/sessions/usage", as.withRole(httphandler.ROLE_READONLY, as.sessionUsageHandler))
+	mux.HandleFunc("/sessions/export", as.withRole(httphandler.ROLE_OPERATOR, as.sessionExportHandler))
+	mux.HandleFunc("/sessions/import", as.withRole(httphandler.ROLE_ADMIN, as.sessionImportHandler))
+
+	if ci.AdminServerConf().PrometheusEnabled {
+		if registry, err := newPrometheusRegistry(); err != nil {
+			config.GetLogger().Errorf("could not register the prometheus metrics: %s", err)
+		} else {
+			mux.HandleFunc("/metrics", as.withRole(httphandler.ROLE_READONLY, prometheusHandler(registry).ServeHTTP))
+		}
+	}
+
+	as.server = &http.Server{Handler: mux}
+
+	go as.Run()
+	return &as
+}
+
+// Executes the AdminServer. This function blocks. Should be executed
+// in a goroutine.
+func (as *AdminServer) Run() {
+
+	logger := config.GetLogger()
+
+	asc := as.ci.AdminServerConf()
+	listener, err := httphandler.NewListener(asc.BindAddress, asc.BindPort, asc.UnixSocketPath, asc.UnixSocketPermissions)
+	if err != nil {
+		logger.Errorf("could not create admin server listener: %s", err)
+		return
+	}
+
+	logger.Infof("admin server listening in %s", listener.Addr())
+	if err := as.server.ServeTLS(listener, "/home/francisco/cert.pem", "/home/francisco/key.pem"); err != http.ErrServerClosed {
+		logger.Errorf("admin server error %s", err)
+	}
+}
+
+// Stops the AdminServer
+func (as *AdminServer) Close() {
+	as.server.Shutdown(context.Background())
+}
+
+// Creates the registry with the igor metrics and those of the go runtime and the process
+func newPrometheusRegistry() (*prometheus.Registry, error) {
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(collectors.NewGoCollector()); err != nil {
+		return nil, err
+	}
+	if err := registry.Register(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{})); err != nil {
+		return nil, err
+	}
+	if err := instrumentation.MS.RegisterPrometheus(registry); err != nil {
+		return nil, err
+	}
+	return registry, nil
+}
+
+// Serves the metrics in the registry. The OpenMetrics format is used if accepted by the scraper, since
+// otherwise the exemplars with the trace identifiers are not exported
+func prometheusHandler(registry *prometheus.Registry) http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: true})
+}
+
+// Sets the session store and the sender to use for disconnecting sessions. If the snapshot file
+// is configured and exists, the sessions in it are imported into the store
+func (as *AdminServer) SetSessionStore(store *sessionserver.RadiusSessionStore, sender sessionserver.PacketSender) {
+	as.sessionsMutex.Lock()
+	defer as.sessionsMutex.Unlock()
+	as.sessionStore = store
+	as.packetSender = sender
+
+	if fileName := as.ci.AdminServerConf().SessionSnapshotFile; fileName != "" && store != nil {
+		n, err := store.LoadSnapshotFile(fileName)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			config.GetLogger().Errorf("could not import session snapshot from %s: %s", fileName, err)
+		default:
+			config.GetLogger().Infof("imported %d sessions from %s", n, fileName)
+		}
+	}
+}
+
+// Returns the session store, or nil if not set
+func (as *AdminServer) getSessionStore() *sessionserver.RadiusSessionStore {
+	as.sessionsMutex.RLock()
+	defer as.sessionsMutex.RUnlock()
+	return as.sessionStore
+}
+
+// Sets the analyzer to use for the attribute statistics queries
+func (as *AdminServer) SetAttributeStats(analyzer *attrstats.Analyzer) {
+	as.statsMutex.Lock()
+	defer as.statsMutex.Unlock()
+	as.attributeStats = analyzer
+}
+
+// Sets the manager of the IP pools whose utilization is reported
+func (as *AdminServer) SetPoolManager(poolManager *ippool.PoolManager) {
+	as.poolsMutex.Lock()
+	defer as.poolsMutex.Unlock()
+	as.poolManager = poolManager
+}
+
+// Sets the diameter router whose peers are operated
+func (as *AdminServer) SetDiameterRouter(diameterRouter *router.DiameterRouter) {
+	as.routersMutex.Lock()
+	defer as.routersMutex.Unlock()
+	as.diameterRouter = diameterRouter
+}
+
+// Sets the radius router whose servers are operated
+func (as *AdminServer) SetRadiusRouter(radiusRouter *router.RadiusRouter) {
+	as.routersMutex.Lock()
+	defer as.routersMutex.Unlock()
+	as.radiusRouter = radiusRouter
+}
+
+// Sets the radius client socket whose outstanding requests are reported
+func (as *AdminServer) SetRadiusClientSocket(rcs *radiusClient.RadiusClientSocket) {
+	as.routersMutex.Lock()
+	defer as.routersMutex.Unlock()
+	as.radiusClient = rcs
+}
+
+// Sets the pool of radius client sockets whose outstanding requests are reported
+func (as *AdminServer) SetRadiusClient(rc *radiusClient.RadiusClient) {
+	as.routersMutex.Lock()
+	defer as.routersMutex.Unlock()
+	as.radiusClient = rc
+}
+
+// Helper to enforce the roles using the current access tokens configuration
+func (as *AdminServer) withRole(required httphandler.Role, next http.HandlerFunc) http.HandlerFunc {
+	return httphandler.WithRole(required, func() map[string]string {
+		return as.ci.AdminServerConf().AccessTokens
+	}, next)
+}
+
+// Reloads the policy configuration
+func (as *AdminServer) reloadHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := as.ci.Update(); err != nil {
+		config.GetLogger().Errorf("error reloading configuration %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	config.GetLogger().Info("configuration reloaded")
+	w.WriteHeader(http.StatusOK)
+}
+
+// Disconnects the session specified in the "sessionId" parameter, or all the sessions of the
+// "userName" parameter, using the disconnect template for the vendor of the NAS
+func (as *AdminServer) disconnectHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	as.sessionsMutex.RLock()
+	store, sender := as.sessionStore, as.packetSender
+	as.sessionsMutex.RUnlock()
+	if store == nil || sender == nil {
+		http.Error(w, "no session store", http.StatusServiceUnavailable)
+		return
+	}
+
+	var sessions []sessionserver.RadiusSession
+	if sessionId := req.URL.Query().Get("sessionId"); sessionId != "" {
+		if session, found := store.GetWithContext(req.Context(), sessionId); found {
+			sessions = append(sessions, session)
+		}
+	} else if userName := req.URL.Query().Get("userName"); userName != "" {
+		sessions = store.FindByIndexWithContext(req.Context(), sessionserver.USER_NAME_INDEX, userName)
+	} else {
+		http.Error(w, "sessionId or userName must be specified", http.StatusBadRequest)
+		return
+	}
+	if len(sessions) == 0 {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	results := make([]DisconnectResult, 0, len(sessions))
+	for _, session := range sessions {
+		result := DisconnectResult{SessionId: session.Id}
+		if err := sessionserver.Disconnect(as.ci, session, sender); err != nil {
+			config.GetLogger().Errorf("admin disconnect error %s", err)
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	writeJSON(w, results)
+}
+
+// Returns the requests sent to each diameter peer and not yet answered
+func (as *AdminServer) peerOutstandingRequestsHandler(w http.ResponseWriter, req *http.Request) {
+	as.routersMutex.RLock()
+	diameterRouter := as.diameterRouter
+	as.routersMutex.RUnlock()
+	if diameterRouter == nil {
+		http.Error(w, "no diameter router", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, diameterRouter.OutstandingRequests())
+}
+
+// Forces the disconnection of the peer specified in the "diameterHost" parameter
+func (as *AdminServer) peerDisconnectHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	as.routersMutex.RLock()
+	diameterRouter := as.diameterRouter
+	as.routersMutex.RUnlock()
+	if diameterRouter == nil {
+		http.Error(w, "no diameter router", http.StatusServiceUnavailable)
+		return
+	}
+
+	diameterHost := req.URL.Query().Get("diameterHost")
+	if diameterHost == "" {
+		http.Error(w, "diameterHost must be specified", http.StatusBadRequest)
+		return
+	}
+	if err := diameterRouter.DisconnectPeer(diameterHost); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	config.GetLogger().Infof("admin disconnection of peer %s", diameterHost)
+	w.WriteHeader(http.StatusOK)
+}
+
+// Returns the status of the radius servers
+func (as *AdminServer) radiusServersHandler(w http.ResponseWriter, req *http.Request) {
+	as.routersMutex.RLock()
+	radiusRouter := as.radiusRouter
+	as.routersMutex.RUnlock()
+	if radiusRouter == nil {
+		http.Error(w, "no radius router", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, radiusRouter.ServersTable())
+}
+
+// Returns the last transitions of the radius servers between states, oldest first
+func (as *AdminServer) radiusServerTransitionsHandler(w http.ResponseWriter, req *http.Request) {
+	as.routersMutex.RLock()
+	radiusRouter := as.radiusRouter
+	as.routersMutex.RUnlock()
+	if radiusRouter == nil {
+		http.Error(w, "no radius router", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, radiusRouter.ServerTransitions())
+}
+
+// Puts the radius server specified in the "server" parameter in quarantine, for the number of
+// seconds in the "seconds" parameter or, if not specified, the time in its configuration
+func (as *AdminServer) radiusServerQuarantineHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	as.routersMutex.RLock()
+	radiusRouter := as.radiusRouter
+	as.routersMutex.RUnlock()
+	if radiusRouter == nil {
+		http.Error(w, "no radius router", http.StatusServiceUnavailable)
+		return
+	}
+
+	serverName := req.URL.Query().Get("server")
+	if serverName == "" {
+		http.Error(w, "server must be specified", http.StatusBadRequest)
+		return
+	}
+	var duration time.Duration
+	if param := req.URL.Query().Get("seconds"); param != "" {
+		seconds, err := strconv.Atoi(param)
+		if err != nil || seconds <= 0 {
+			http.Error(w, "bad seconds parameter", http.StatusBadRequest)
+			return
+		}
+		duration = time.Duration(seconds) * time.Second
+	}
+	if err := radiusRouter.QuarantineServer(serverName, duration); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	config.GetLogger().Infof("admin quarantine of radius server %s", serverName)
+	w.WriteHeader(http.StatusOK)
+}
+
+// Returns the radius requests sent and not yet answered
+func (as *AdminServer) radiusOutstandingRequestsHandler(w http.ResponseWriter, req *http.Request) {
+	as.routersMutex.RLock()
+	rcs := as.radiusClient
+	as.routersMutex.RUnlock()
+	if rcs == nil {
+		http.Error(w, "no radius client", http.StatusServiceUnavailable)
+		return
+	}
+
+	requests, err := rcs.OutstandingRequests(router.OUTSTANDING_REQUESTS_QUERY_MILLIS * time.Millisecond)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, requests)
+}
+
+// Result of the log level operations
+type LogLevelResult struct {
+	Level string
+
+	// Levels of the subsystems in use or configured
+	Subsystems map[string]string
+}
+
+// Returns the log levels or, if a POST with the "level" parameter, changes the global one or, if the "subsystem"
+// parameter is also specified, that of the subsystem. An empty level makes the subsystem follow the global level again
+func logLevelHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost {
+		level := req.URL.Query().Get("level")
+		if subsystem := req.URL.Query().Get("subsystem"); subsystem != "" {
+			if err := config.SetSubsystemLogLevel(subsystem, level); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			config.GetLogger().Infof("log level of %s set to %q", subsystem, level)
+		} else {
+			if err := config.SetLogLevel(level); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			config.GetLogger().Infof("log level set to %s", level)
+		}
+	}
+	writeJSON(w, LogLevelResult{Level: config.GetLogLevel(), Subsystems: config.GetSubsystemLogLevels()})
+}
+
+// Returns the status of the wire trace or, if a POST, starts or stops it, depending on the "action" parameter.
+// The trace is started with the "file" (in the configured trace directory), "format", "peer", "command", "userName",
+// "rotateBytes" and "maxFiles" parameters, all optional
+func (as *AdminServer) traceHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeJSON(w, wiretrace.GetStatus())
+		return
+	}
+
+	query := req.URL.Query()
+	switch query.Get("action") {
+	case "start":
+		traceDirectory := as.ci.AdminServerConf().TraceDirectory
+		if traceDirectory == "" {
+			http.Error(w, "trace directory not configured", http.StatusServiceUnavailable)
+			return
+		}
+		options := wiretrace.Options{
+			Filter: wiretrace.Filter{
+				Peer:     query.Get("peer"),
+				Command:  query.Get("command"),
+				UserName: query.Get("userName"),
+			},
+			Format: query.Get("format"),
+		}
+
+		// The file is always in the trace directory
+		fileName := filepath.Base(query.Get("file"))
+		if fileName == "." || fileName == "/" {
+			fileName = "igor-trace"
+		}
+		options.Path = filepath.Join(traceDirectory, fileName)
+
+		var err error
+		if param := query.Get("rotateBytes"); param != "" {
+			if options.RotateBytes, err = strconv.ParseInt(param, 10, 64); err != nil {
+				http.Error(w, "bad rotateBytes parameter", http.StatusBadRequest)
+				return
+			}
+		}
+		if param := query.Get("maxFiles"); param != "" {
+			if options.MaxFiles, err = strconv.Atoi(param); err != nil {
+				http.Error(w, "bad maxFiles parameter", http.StatusBadRequest)
+				return
+			}
+		}
+		if err := wiretrace.Start(options); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		config.GetLogger().Infof("wire trace started in %s", options.Path)
+		writeJSON(w, wiretrace.GetStatus())
+
+	case "stop":
+		status, err := wiretrace.Stop()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		config.GetLogger().Infof("wire trace stopped after %d messages", status.Messages)
+		writeJSON(w, status)
+
+	default:
+		http.Error(w, "action must be start or stop", http.StatusBadRequest)
+	}
+}
+
+// Result of the session snapshot and import operations
+type SessionSnapshotResult struct {
+	Sessions int
+}
+
+// Writes the snapshot of the session store to the configured file
+func (as *AdminServer) sessionSnapshotHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	store := as.getSessionStore()
+	fileName := as.ci.AdminServerConf().SessionSnapshotFile
+	if store == nil || fileName == "" {
+		http.Error(w, "no session store or snapshot file", http.StatusServiceUnavailable)
+		return
+	}
+
+	n, err := store.SaveSnapshotFile(fileName)
+	if err != nil {
+		config.GetLogger().Errorf("error writing session snapshot %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	config.GetLogger().Infof("written %d sessions to %s", n, fileName)
+	writeJSON(w, SessionSnapshotResult{Sessions: n})
+}
+
+// Returns the snapshot of the session store, in JSON or, if so specified in the Accept header, CBOR
+func (as *AdminServer) sessionExportHandler(w http.ResponseWriter, req *http.Request) {
+	store := as.getSessionStore()
+	if store == nil {
+		http.Error(w, "no session store", http.StatusServiceUnavailable)
+		return
+	}
+
+	// The binary format is only available for diameter messages
+	contentType, err := core.ParseContentType(req.Header.Get("Accept"))
+	if err != nil || contentType == core.CONTENT_TYPE_BINARY {
+		contentType = core.CONTENT_TYPE_JSON
+	}
+	w.Header().Set("Content-Type", contentType)
+	if _, err := store.WriteSnapshot(w, contentType); err != nil {
+		config.GetLogger().Errorf("error exporting sessions %s", err)
+	}
+}
+
+// Returns the most frequent values of the specified attribute, or of all the analyzed attributes,
+// in the window. The number of values may be specified with the "top" parameter
+func (as *AdminServer) attributeStatsHandler(w http.ResponseWriter, req *http.Request) {
+	as.statsMutex.RLock()
+	analyzer := as.attributeStats
+	as.statsMutex.RUnlock()
+	if analyzer == nil {
+		http.Error(w, "no attribute statistics", http.StatusServiceUnavailable)
+		return
+	}
+
+	var top int
+	if topParam := req.URL.Query().Get("top"); topParam != "" {
+		var err error
+		if top, err = strconv.Atoi(topParam); err != nil {
+			http.Error(w, "bad top parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	attributes := analyzer.Attributes()
+	if attribute := req.URL.Query().Get("attribute"); attribute != "" {
+		attributes = []string{attribute}
+	}
+
+	stats := make([]attrstats.AttributeStats, 0, len(attributes))
+	for _, attribute := range attributes {
+		stats = append(stats, analyzer.Stats(attribute, top))
+	}
+	writeJSON(w, stats)
+}
+
+// Returns the pool manager, or nil if not set
+func (as *AdminServer) getPoolManager() *ippool.PoolManager {
+	as.poolsMutex.RLock()
+	defer as.poolsMutex.RUnlock()
+	return as.poolManager
+}
+
+// Returns the utilization of the IP pools
+func (as *AdminServer) ipPoolsHandler(w http.ResponseWriter, req *http.Request) {
+	poolManager := as.getPoolManager()
+	if poolManager == nil {
+		http.Error(w, "no IP pools", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, poolManager.Utilization())
+}
+
+// Returns the leases of the IP pool specified in the "pool" parameter
+func (as *AdminServer) ipPoolLeasesHandler(w http.ResponseWriter, req *http.Request) {
+	poolManager := as.getPoolManager()
+	if poolManager == nil {
+		http.Error(w, "no IP pools", http.StatusServiceUnavailable)
+		return
+	}
+
+	leases, err := poolManager.Leases(req.URL.Query().Get("pool"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, leases)
+}
+
+// Returns the session specified in the "sessionId" parameter, or the sessions with the "value" parameter
+// in the index specified in the "index" parameter, such as "Framed-IP-Address" or "NAS-IP-Address/NAS-Port"
+func (as *AdminServer) sessionsHandler(w http.ResponseWriter, req *http.Request) {
+	store := as.getSessionStore()
+	if store == nil {
+		http.Error(w, "no session store", http.StatusServiceUnavailable)
+		return
+	}
+
+	sessions := make([]sessionserver.RadiusSession, 0)
+	if sessionId := req.URL.Query().Get("sessionId"); sessionId != "" {
+		if session, found := store.GetWithContext(req.Context(), sessionId); found {
+			sessions = append(sessions, session)
+		}
+	} else if index := req.URL.Query().Get("index"); index != "" {
+		sessions = store.FindByIndexWithContext(req.Context(), index, req.URL.Query().Get("value"))
+	} else {
+		http.Error(w, "sessionId or index must be specified", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, sessions)
+}
+
+// Returns the usage of the session specified in the "sessionId" parameter, or of all the sessions
+// of the "userName" parameter, and the total
+func (as *AdminServer) sessionUsageHandler(w http.ResponseWriter, req *http.Request) {
+	store := as.getSessionStore()
+	if store == nil {
+		http.Error(w, "no session store", http.StatusServiceUnavailable)
+		return
+	}
+
+	var sessions []sessionserver.RadiusSession
+	if sessionId := req.URL.Query().Get("sessionId"); sessionId != "" {
+		if session, found := store.GetWithContext(req.Context(), sessionId); found {
+			sessions = append(sessions, session)
+		}
+	} else if userName := req.URL.Query().Get("userName"); userName != "" {
+		sessions = store.FindByIndexWithContext(req.Context(), sessionserver.USER_NAME_INDEX, userName)
+	} else {
+		http.Error(w, "sessionId or userName must be specified", http.StatusBadRequest)
+		return
+	}
+
+	response := SessionUsageResponse{Sessions: make([]SessionUsageItem, 0, len(sessions))}
+	for _, session := range sessions {
+		response.Sessions = append(response.Sessions, SessionUsageItem{
+			Id:          session.Id,
+			StartTime:   session.StartTime,
+			LastUpdated: session.LastUpdated,
+			Usage:       session.Usage,
+		})
+		response.Total = response.Total.Add(session.Usage)
+	}
+	writeJSON(w, response)
+}
+
+// Imports the snapshot in the body of the request into the session store. The format is
+// specified in the Content-Type
+func (as *AdminServer) sessionImportHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	contentType, err := core.ParseContentType(req.Header.Get("Content-Type"))
+	if err == nil && contentType == core.CONTENT_TYPE_BINARY {
+		err = fmt.Errorf("%s: %w", contentType, core.ErrUnsupportedContentType)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	store := as.getSessionStore()
+	if store == nil {
+		http.Error(w, "no session store", http.StatusServiceUnavailable)
+		return
+	}
+
+	n, err := store.ReadSnapshot(req.Body, contentType)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	config.GetLogger().Infof("imported %d sessions", n)
+	writeJSON(w, SessionSnapshotResult{Sessions: n})
+}
+
+// Applies the session updates sent by the replicator of the peer instance
+func (as *AdminServer) sessionReplicateHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	contentType, err := core.ParseContentType(req.Header.Get("Content-Type"))
+	if err == nil && contentType == core.CONTENT_TYPE_BINARY {
+		err = fmt.Errorf("%s: %w", contentType, core.ErrUnsupportedContentType)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	store := as.getSessionStore()
+	if store == nil {
+		http.Error(w, "no session store", http.StatusServiceUnavailable)
+		return
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, "could not read session updates: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var updates []sessionserver.SessionUpdate
+	if err := core.Unmarshal(contentType, body, &updates); err != nil {
+		http.Error(w, "bad session updates: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, SessionSnapshotResult{Sessions: store.ApplyUpdates(updates)})
+}
+
+// Returns the diameter metric specified in the "name" parameter, with the filter specified
+// in the rest of parameters and aggregated by the comma separated labels in the "agg" parameter
+func getDiameterMetricsHandler(w http.ResponseWriter, req *http.Request) {
+	name, filter, aggLabels := parseQuery(req)
+
+	items := make([]DiameterMetricItem, 0)
+	for k, v := range instrumentation.MS.DiameterQuery(name, filter, aggLabels) {
+		items = append(items, DiameterMetricItem{Key: k, Value: v})
+	}
+	writeJSON(w, items)
+}
+
+// Same as above for radius metrics
+func getRadiusMetricsHandler(w http.ResponseWriter, req *http.Request) {
+	name, filter, aggLabels := parseQuery(req)
+
+	items := make([]RadiusMetricItem, 0)
+	for k, v := range instrumentation.MS.RadiusQuery(name, filter, aggLabels) {
+		items = append(items, RadiusMetricItem{Key: k, Value: v})
+	}
+	writeJSON(w, items)
+}
+
+// Same as above for CDR pipeline metrics
+func getCDRMetricsHandler(w http.ResponseWriter, req *http.Request) {
+	name, filter, aggLabels := parseQuery(req)
+
+	items := make([]CDRMetricItem, 0)
+	for k, v := range instrumentation.MS.CDRQuery(name, filter, aggLabels) {
+		items = append(items, CDRMetricItem{Key: k, Value: v})
+	}
+	writeJSON(w, items)
+}
+
+// Returns the histograms of the diameter duration metric specified in the "name" parameter, with the
+// filter and aggregation as above, and the percentiles in the comma separated "percentiles" parameter
+func getDiameterDurationsHandler(w http.ResponseWriter, req *http.Request) {
+	name, filter, aggLabels := parseQuery(req)
+	percentiles, err := parsePercentiles(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	items := make([]DiameterDurationItem, 0)
+	for k, v := range instrumentation.MS.DiameterDurationQuery(name, filter, aggLabels) {
+		items = append(items, DiameterDurationItem{Key: k, Value: v.Summary(percentiles)})
+	}
+	writeJSON(w, items)
+}
+
+// Same as above for radius durations
+func getRadiusDurationsHandler(w http.ResponseWriter, req *http.Request) {
+	name, filter, aggLabels := parseQuery(req)
+	percentiles, err := parsePercentiles(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	items := make([]RadiusDurationItem, 0)
+	for k, v := range instrumentation.MS.RadiusDurationQuery(name, filter, aggLabels) {
+		items = append(items, RadiusDurationItem{Key: k, Value: v.Summary(percentiles)})
+	}
+	writeJSON(w, items)
+}
+
+// Same as above for the durations of the http handler invocations
+func getHttpHandlerDurationsHandler(w http.ResponseWriter, req *http.Request) {
+	name, filter, aggLabels := parseQuery(req)
+	percentiles, err := parsePercentiles(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	items := make([]HttpHandlerDurationItem, 0)
+	for k, v := range instrumentation.MS.HttpHandlerDurationQuery(name, filter, aggLabels) {
+		items = append(items, HttpHandlerDurationItem{Key: k, Value: v.Summary(percentiles)})
+	}
+	writeJSON(w, items)
+}
+
+// Same as above for the durations of the queries to the session store
+func getSessionQueryDurationsHandler(w http.ResponseWriter, req *http.Request) {
+	name, filter, aggLabels := parseQuery(req)
+	percentiles, err := parsePercentiles(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	items := make([]SessionQueryDurationItem, 0)
+	for k, v := range instrumentation.MS.SessionQueryDurationQuery(name, filter, aggLabels) {
+		items = append(items, SessionQueryDurationItem{Key: k, Value: v.Summary(percentiles)})
+	}
+	writeJSON(w, items)
+}
+
+// Returns the goroutines, memory, GC, CPU and file descriptors of the process
+func getRuntimeMetricsHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, instrumentation.GetRuntimeMetrics())
+}
+
+// Returns the diameter peers tables, by configuration instance. If the diameter router is set, its
+// entries include the live data reported by each peer that is up
+func (as *AdminServer) peersHandler(w http.ResponseWriter, req *http.Request) {
+	as.routersMutex.RLock()
+	diameterRouter := as.diameterRouter
+	as.routersMutex.RUnlock()
+	if diameterRouter == nil {
+		writeJSON(w, instrumentation.MS.PeersTableQuery())
+		return
+	}
+	writeJSON(w, map[string][]router.DiameterPeerDetail{diameterRouter.InstanceName(): diameterRouter.PeersDetail()})
+}
+
+// Returns the number of messages waiting to be written to each diameter peer
+func getEgressQueuesHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, instrumentation.MS.EgressQueueDepthQuery())
+}
+
+// Returns the last measured skew of the clock of each diameter peer, in milliseconds
+func getPeerClockSkewHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, skewMillis(instrumentation.MS.PeerClockSkewQuery()))
+}
+
+// Returns the last measured skew of the clock of each radius client, in milliseconds
+func getRadiusClientClockSkewHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, skewMillis(instrumentation.MS.RadiusClientClockSkewQuery()))
+}
+
+func skewMillis(skews map[string]time.Duration) map[string]int64 {
+	millis := make(map[string]int64, len(skews))
+	for name, skew := range skews {
+		millis[name] = skew.Milliseconds()
+	}
+	return millis
+}
+
+// Extracts the metric name, filter and aggregation labels from the query parameters
+func parseQuery(req *http.Request) (string, map[string]string, []string) {
+	var aggLabels []string
+	var filter map[string]string
+
+	for param, values := range req.URL.Query() {
+		switch param {
+		case "name", "percentiles":
+		case "agg":
+			aggLabels = strings.Split(values[0], ",")
+		default:
+			if filter == nil {
+				filter = make(map[string]string)
+			}
+			filter[param] = values[0]
+		}
+	}
+
+	return req.URL.Query().Get("name"), filter, aggLabels
+}
+
+// Extracts the comma separated list of percentiles, or returns the default ones if not specified
+func parsePercentiles(req *http.Request) ([]float64, error) {
+	param := req.URL.Query().Get("percentiles")
+	if param == "" {
+		return instrumentation.DEFAULT_PERCENTILES, nil
+	}
+
+	var percentiles []float64
+	for _, item := range strings.Split(param, ",") {
+		percentile, err := strconv.ParseFloat(item, 64)
+		if err != nil || percentile < 0 || percentile > 100 {
+			return nil, errors.New("bad percentile " + item)
+		}
+		percentiles = append(percentiles, percentile)
+	}
+	return percentiles, nil
+}
+
+// Serializes the object and writes it as response
+func writeJSON(w http.ResponseWriter, obj interface{}) {
+	jResponse, err := json.Marshal(obj)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jResponse)
+}
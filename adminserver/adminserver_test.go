@@ -0,0 +1,465 @@
+package adminserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"igor/config"
+	"igor/diamcodec"
+	"igor/instrumentation"
+	"igor/ippool"
+	"igor/radiuscodec"
+	"igor/router"
+	"igor/sessionserver"
+	"igor/telemetry"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var httpClient = http.Client{
+	Timeout:   2 * time.Second,
+	Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+}
+
+func TestMain(m *testing.M) {
+
+	// Initialize the Config Object
+	config.InitPolicyConfigInstance("resources/searchRules.json", "testServer", true)
+
+	// Execute the tests and exit
+	os.Exit(m.Run())
+}
+
+// Sends the request with the specified token and returns the status code and body
+func doRequest(t *testing.T, method string, path string, token string) (int, []byte) {
+	return doRequestWithBody(t, method, path, token, nil)
+}
+
+// Same as above, with the specified body
+func doRequestWithBody(t *testing.T, method string, path string, token string, body []byte) (int, []byte) {
+	req, _ := http.NewRequest(method, "https://127.0.0.1:9090"+path, bytes.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		t.Fatalf("error sending request %s", err)
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, respBody
+}
+
+func TestAccessControl(t *testing.T) {
+
+	as := NewAdminServer("testServer")
+	defer as.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	instrumentation.MS.ResetMetrics()
+	diameterRequest, _ := diamcodec.NewDiameterRequest("TestApplication", "TestRequest")
+	instrumentation.PushPeerDiameterRequestReceived("testServer", "testPeer", diameterRequest)
+	time.Sleep(100 * time.Millisecond)
+
+	// Missing and unknown tokens
+	if code, _ := doRequest(t, "GET", "/diameterMetrics?name=DiameterRequestsReceived", ""); code != http.StatusUnauthorized {
+		t.Errorf("expected unauthorized but got %d", code)
+	}
+	if code, _ := doRequest(t, "GET", "/diameterMetrics?name=DiameterRequestsReceived", "badToken"); code != http.StatusUnauthorized {
+		t.Errorf("expected unauthorized but got %d", code)
+	}
+
+	// Read only access to metrics
+	code, body := doRequest(t, "GET", "/diameterMetrics?name=DiameterRequestsReceived&agg=Peer&Peer=testPeer", "monitoringToken")
+	if code != http.StatusOK {
+		t.Fatalf("expected ok but got %d", code)
+	}
+	var items []DiameterMetricItem
+	if err := json.Unmarshal(body, &items); err != nil {
+		t.Fatalf("could not unmarshal response %s", err)
+	}
+	if len(items) != 1 || items[0].Value != 1 || items[0].Key.Peer != "testPeer" {
+		t.Errorf("bad metrics response %v", items)
+	}
+
+	// Process metrics
+	code, body = doRequest(t, "GET", "/runtimeMetrics", "monitoringToken")
+	var runtimeMetrics instrumentation.RuntimeMetrics
+	if code != http.StatusOK {
+		t.Fatalf("expected ok but got %d", code)
+	}
+	if err := json.Unmarshal(body, &runtimeMetrics); err != nil {
+		t.Fatalf("could not unmarshal response %s", err)
+	}
+	if runtimeMetrics.Goroutines == 0 || runtimeMetrics.HeapAlloc == 0 || runtimeMetrics.SubsystemGoroutines["adminserver"] == 0 {
+		t.Errorf("bad runtime metrics %v", runtimeMetrics)
+	}
+
+	// Durations
+	instrumentation.PushPeerDiameterHandlerDuration(context.Background(), "testServer", "testPeer", diameterRequest, 7*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	code, body = doRequest(t, "GET", "/diameterMetrics/durations?name=DiameterHandlerDuration&agg=Peer&percentiles=50,99", "monitoringToken")
+	if code != http.StatusOK {
+		t.Fatalf("expected ok but got %d", code)
+	}
+	var durations []DiameterDurationItem
+	if err := json.Unmarshal(body, &durations); err != nil {
+		t.Fatalf("could not unmarshal response %s", err)
+	}
+	if len(durations) != 1 || durations[0].Value.Count != 1 || durations[0].Value.Percentiles["p99"] == 0 {
+		t.Errorf("bad durations response %v", durations)
+	}
+	if code, _ := doRequest(t, "GET", "/diameterMetrics/durations?name=DiameterHandlerDuration&percentiles=101", "monitoringToken"); code != http.StatusBadRequest {
+		t.Errorf("expected bad request but got %d", code)
+	}
+
+	// Prometheus exposition
+	if code, _ := doRequest(t, "GET", "/metrics", ""); code != http.StatusUnauthorized {
+		t.Errorf("expected unauthorized but got %d", code)
+	}
+	code, body = doRequest(t, "GET", "/metrics", "monitoringToken")
+	if code != http.StatusOK {
+		t.Fatalf("expected ok but got %d", code)
+	}
+	if !strings.Contains(string(body), "# TYPE igor_diameter_requests_received_total counter") || !strings.Contains(string(body), `peer="testPeer"`) || !strings.Contains(string(body), "go_goroutines") {
+		t.Errorf("bad prometheus metrics %s", body)
+	}
+
+	// Reload requires operator
+	if code, _ := doRequest(t, "POST", "/reload", "monitoringToken"); code != http.StatusForbidden {
+		t.Errorf("expected forbidden but got %d", code)
+	}
+	if code, _ := doRequest(t, "POST", "/reload", "operatorToken"); code != http.StatusOK {
+		t.Errorf("expected ok but got %d", code)
+	}
+	if code, _ := doRequest(t, "POST", "/reload", "adminToken"); code != http.StatusOK {
+		t.Errorf("expected ok but got %d", code)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+
+	as := NewAdminServer("testServer")
+	defer as.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// No session store yet
+	if code, _ := doRequest(t, "POST", "/disconnect?sessionId=session-1", "operatorToken"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected service unavailable but got %d", code)
+	}
+
+	store := sessionserver.NewRadiusSessionStore("", []string{sessionserver.USER_NAME_INDEX})
+	packet := radiuscodec.NewRadiusRequest(radiuscodec.ACCOUNTING_REQUEST)
+	packet.Add("Acct-Status-Type", 1)
+	packet.Add("Acct-Session-Id", "session-1")
+	packet.Add("User-Name", "user@igor")
+	packet.Add("NAS-IP-Address", "127.0.0.1")
+	packet.Add("NAS-Port", 1)
+	packet.Add("Framed-IP-Address", "10.0.0.1")
+	store.PushAccounting(packet)
+
+	var sentTo string
+	as.SetSessionStore(store, func(endpoint string, packet *radiuscodec.RadiusPacket, secret string) (*radiuscodec.RadiusPacket, error) {
+		sentTo = endpoint
+		response := radiuscodec.NewRadiusResponse(packet, true)
+		response.Code = radiuscodec.COA_ACK
+		return response, nil
+	})
+
+	if code, _ := doRequest(t, "POST", "/disconnect?userName=user@igor", "monitoringToken"); code != http.StatusForbidden {
+		t.Errorf("expected forbidden but got %d", code)
+	}
+	if code, _ := doRequest(t, "POST", "/disconnect?sessionId=unknown", "operatorToken"); code != http.StatusNotFound {
+		t.Errorf("expected not found but got %d", code)
+	}
+	code, body := doRequest(t, "POST", "/disconnect?userName=user@igor", "operatorToken")
+	if code != http.StatusOK {
+		t.Fatalf("expected ok but got %d", code)
+	}
+	var results []DisconnectResult
+	if err := json.Unmarshal(body, &results); err != nil {
+		t.Fatalf("could not unmarshal response %s", err)
+	}
+	if len(results) != 1 || results[0].SessionId != "session-1" || results[0].Error != "" {
+		t.Errorf("bad disconnect response %v", results)
+	}
+	if sentTo != "127.0.0.1:3800" {
+		t.Errorf("disconnect sent to %s", sentTo)
+	}
+}
+
+func TestOperations(t *testing.T) {
+
+	as := NewAdminServer("testServer")
+	defer as.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// Log level
+	if code, _ := doRequest(t, "POST", "/logLevel?level=info", "monitoringToken"); code != http.StatusForbidden {
+		t.Errorf("expected forbidden but got %d", code)
+	}
+	if code, _ := doRequest(t, "POST", "/logLevel?level=verbose", "operatorToken"); code != http.StatusBadRequest {
+		t.Errorf("expected bad request but got %d", code)
+	}
+	previousLevel := config.GetLogLevel()
+	code, body := doRequest(t, "POST", "/logLevel?level=warn", "operatorToken")
+	if code != http.StatusOK || !strings.Contains(string(body), `"Level":"warn"`) || config.GetLogLevel() != "warn" {
+		t.Errorf("log level not changed: %d %s", code, body)
+	}
+	config.SetLogLevel(previousLevel)
+	code, body = doRequest(t, "POST", "/logLevel?level=error&subsystem=diampeer", "operatorToken")
+	if code != http.StatusOK || !strings.Contains(string(body), `"diampeer":"error"`) {
+		t.Errorf("subsystem log level not changed: %d %s", code, body)
+	}
+	config.SetSubsystemLogLevel("diampeer", "")
+
+	// No routers yet
+	if code, _ := doRequest(t, "POST", "/peers/disconnect?diameterHost=client.igorclient", "operatorToken"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected service unavailable but got %d", code)
+	}
+	if code, _ := doRequest(t, "GET", "/radiusClient/outstanding", "monitoringToken"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected service unavailable but got %d", code)
+	}
+
+	// Radius servers quarantine
+	as.SetRadiusRouter(router.NewRadiusRouter("testServer"))
+	if code, _ := doRequest(t, "POST", "/radiusServers/quarantine?server=unknown", "operatorToken"); code != http.StatusNotFound {
+		t.Errorf("expected not found but got %d", code)
+	}
+	if code, _ := doRequest(t, "POST", "/radiusServers/quarantine?server=igor-superserver&seconds=30", "operatorToken"); code != http.StatusOK {
+		t.Errorf("expected ok but got %d", code)
+	}
+	code, body = doRequest(t, "GET", "/radiusServers", "monitoringToken")
+	if code != http.StatusOK {
+		t.Fatalf("expected ok but got %d", code)
+	}
+	var servers []router.RadiusServerWithStatus
+	json.Unmarshal(body, &servers)
+	for _, server := range servers {
+		if server.IsAvailable == (server.ServerName == "igor-superserver") {
+			t.Errorf("bad availability of %s", server.ServerName)
+		}
+		if server.ServerName == "igor-superserver" && time.Until(server.UnavailableUntil) < 20*time.Second {
+			t.Errorf("bad quarantine time %s", server.UnavailableUntil)
+		}
+	}
+	if len(servers) != 4 {
+		t.Errorf("expected four radius servers but got %v", servers)
+	}
+	code, body = doRequest(t, "GET", "/radiusServers/transitions", "monitoringToken")
+	if code != http.StatusOK {
+		t.Fatalf("expected ok but got %d", code)
+	}
+	var transitions []router.RadiusServerTransition
+	json.Unmarshal(body, &transitions)
+	if len(transitions) != 1 || transitions[0].ServerName != "igor-superserver" || transitions[0].To != router.RADIUS_SERVER_QUARANTINE {
+		t.Errorf("bad transitions %v", transitions)
+	}
+}
+
+// Helper to build a session store with the specified sessions
+func sessionStoreWith(sessionIds ...string) *sessionserver.RadiusSessionStore {
+	store := sessionserver.NewRadiusSessionStore("", []string{sessionserver.USER_NAME_INDEX})
+	for _, sessionId := range sessionIds {
+		packet := radiuscodec.NewRadiusRequest(radiuscodec.ACCOUNTING_REQUEST)
+		packet.Add("Acct-Status-Type", 1)
+		packet.Add("Acct-Session-Id", sessionId)
+		packet.Add("User-Name", "user@igor")
+		store.PushAccounting(packet)
+	}
+	return store
+}
+
+func TestSessionSnapshot(t *testing.T) {
+
+	as := NewAdminServer("testServer")
+	defer as.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	snapshotFile := config.GetPolicyConfig().AdminServerConf().SessionSnapshotFile
+	os.Remove(snapshotFile)
+	defer os.Remove(snapshotFile)
+
+	as.SetSessionStore(sessionStoreWith("session-1"), nil)
+
+	// Snapshot to file
+	if code, _ := doRequest(t, "POST", "/sessions/snapshot", "monitoringToken"); code != http.StatusForbidden {
+		t.Errorf("expected forbidden but got %d", code)
+	}
+	code, body := doRequest(t, "POST", "/sessions/snapshot", "operatorToken")
+	var result SessionSnapshotResult
+	if code != http.StatusOK || json.Unmarshal(body, &result) != nil || result.Sessions != 1 {
+		t.Errorf("bad snapshot response %d %s", code, body)
+	}
+
+	// Export
+	code, body = doRequest(t, "GET", "/sessions/export", "operatorToken")
+	var snapshot sessionserver.SessionSnapshot
+	if err := json.Unmarshal(body, &snapshot); err != nil || code != http.StatusOK {
+		t.Fatalf("bad export response %d %s", code, body)
+	}
+	if len(snapshot.Sessions) != 1 || snapshot.Sessions[0].Packet.GetStringAVP("User-Name") != "user@igor" {
+		t.Errorf("bad exported sessions %v", snapshot.Sessions)
+	}
+
+	// The snapshot file is imported when the store is set
+	store := sessionStoreWith()
+	as.SetSessionStore(store, nil)
+	if _, found := store.Get("session-1"); !found {
+		t.Errorf("session not imported from snapshot file")
+	}
+
+	// Import. Requires admin
+	_, body = doRequest(t, "GET", "/sessions/export", "operatorToken")
+	os.Remove(snapshotFile)
+	store = sessionStoreWith("session-2")
+	as.SetSessionStore(store, nil)
+	if code, _ := doRequestWithBody(t, "POST", "/sessions/import", "operatorToken", body); code != http.StatusForbidden {
+		t.Errorf("expected forbidden but got %d", code)
+	}
+	if code, _ := doRequestWithBody(t, "POST", "/sessions/import", "adminToken", []byte("not json")); code != http.StatusBadRequest {
+		t.Errorf("expected bad request but got %d", code)
+	}
+	code, body = doRequestWithBody(t, "POST", "/sessions/import", "adminToken", body)
+	if code != http.StatusOK || json.Unmarshal(body, &result) != nil || result.Sessions != 1 {
+		t.Errorf("bad import response %d %s", code, body)
+	}
+	if store.Len() != 2 {
+		t.Errorf("expected 2 sessions after import but got %d", store.Len())
+	}
+}
+
+func TestSessionReplication(t *testing.T) {
+
+	as := NewAdminServer("testServer")
+	defer as.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	peerStore := sessionStoreWith()
+	as.SetSessionStore(peerStore, nil)
+
+	// The store of the active instance replicates to this one
+	store := sessionStoreWith()
+	replicator, err := sessionserver.NewReplicator("https://127.0.0.1:9090/sessions/replicate", "adminToken", "cbor", 0)
+	if err != nil {
+		t.Fatalf("could not create replicator %s", err)
+	}
+	store.SetReplicator(replicator)
+	packet := radiuscodec.NewRadiusRequest(radiuscodec.ACCOUNTING_REQUEST)
+	packet.Add("Acct-Status-Type", 1)
+	packet.Add("Acct-Session-Id", "session-1")
+	packet.Add("User-Name", "user@igor")
+	store.PushAccounting(packet)
+	replicator.Close()
+
+	if _, found := peerStore.Get("session-1"); !found {
+		t.Fatalf("session not replicated")
+	}
+
+	// Query
+	if code, _ := doRequest(t, "GET", "/sessions", "monitoringToken"); code != http.StatusBadRequest {
+		t.Errorf("expected bad request but got %d", code)
+	}
+	code, body := doRequest(t, "GET", "/sessions?index=User-Name&value=user@igor", "monitoringToken")
+	var sessions []sessionserver.RadiusSession
+	if code != http.StatusOK || json.Unmarshal(body, &sessions) != nil || len(sessions) != 1 || sessions[0].Id != "session-1" {
+		t.Errorf("bad sessions query response %d %s", code, body)
+	}
+	if code, _ := doRequestWithBody(t, "POST", "/sessions/replicate", "operatorToken", []byte("[]")); code != http.StatusForbidden {
+		t.Errorf("expected forbidden but got %d", code)
+	}
+}
+
+func TestIPPools(t *testing.T) {
+
+	as := AdminServer{}
+	recorder := httptest.NewRecorder()
+	as.ipPoolsHandler(recorder, httptest.NewRequest("GET", "/ipPools", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected service unavailable but got %d", recorder.Code)
+	}
+
+	poolManager, _ := ippool.NewPoolManager(config.IPPoolsConfig{"pool": {Ranges: []string{"10.0.0.0/30"}}})
+	poolManager.Allocate("pool", "user@igor", "session-1")
+	as.SetPoolManager(poolManager)
+
+	recorder = httptest.NewRecorder()
+	as.ipPoolsHandler(recorder, httptest.NewRequest("GET", "/ipPools", nil))
+	var utilization []ippool.PoolUtilization
+	if json.Unmarshal(recorder.Body.Bytes(), &utilization) != nil || len(utilization) != 1 || utilization[0].Active != 1 || utilization[0].Utilization != 50 {
+		t.Errorf("bad utilization response %s", recorder.Body)
+	}
+
+	recorder = httptest.NewRecorder()
+	as.ipPoolLeasesHandler(recorder, httptest.NewRequest("GET", "/ipPools/leases?pool=pool", nil))
+	var leases []ippool.Lease
+	if json.Unmarshal(recorder.Body.Bytes(), &leases) != nil || len(leases) != 1 || leases[0].Address != "10.0.0.1" {
+		t.Errorf("bad leases response %s", recorder.Body)
+	}
+
+	recorder = httptest.NewRecorder()
+	as.ipPoolLeasesHandler(recorder, httptest.NewRequest("GET", "/ipPools/leases?pool=none", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("expected not found but got %d", recorder.Code)
+	}
+}
+
+func TestPrometheusExemplars(t *testing.T) {
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSampler(sdktrace.AlwaysSample())))
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	instrumentation.MS.ResetMetrics()
+	ctx, span := telemetry.StartServerSpan(context.Background(), "handle TestRequest")
+	instrumentation.PushHttpHandlerDuration(ctx, "testServer", "", 3*time.Millisecond)
+	diameterRequest, _ := diamcodec.NewDiameterRequest("TestApplication", "TestRequest")
+	instrumentation.PushPeerDiameterRequestDuration(ctx, instrumentation.PeerDiameterMetricFromMessage("testServer", "testPeer", diameterRequest), 3*time.Millisecond)
+	instrumentation.PushPeerDiameterHandlerDuration(ctx, "testServer", "testPeer", diameterRequest, 3*time.Millisecond)
+	instrumentation.PushRadiusClientRequestDuration(ctx, "testServer", "127.0.0.1:1812", "1", 3*time.Millisecond)
+	instrumentation.PushSessionQueryDuration(ctx, "testServer", "Get", 3*time.Millisecond)
+	instrumentation.PushSubscriberQueryDuration(ctx, "testServer", "found", 3*time.Millisecond)
+	span.End()
+	time.Sleep(100 * time.Millisecond)
+
+	registry, err := newPrometheusRegistry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(prometheusHandler(registry))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error scraping metrics %s", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/openmetrics-text") {
+		t.Errorf("metrics not in OpenMetrics format %s", resp.Header.Get("Content-Type"))
+	}
+	exemplar := `trace_id="` + span.SpanContext().TraceID().String() + `"`
+	for _, histogram := range []string{"http_handler", "diameter_request", "diameter_handler", "radius_client", "session_query", "subscriber_query"} {
+		found := false
+		for _, line := range strings.Split(string(body), "\n") {
+			if strings.HasPrefix(line, "igor_"+histogram+"_duration_seconds_bucket") && strings.Contains(line, exemplar) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("exemplar %s not found for %s in metrics %s", exemplar, histogram, body)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package attrpolicy
+
+import (
+	"encoding/json"
+	"fmt"
+	"igor/config"
+	"igor/diamcodec"
+	"igor/diamdict"
+	"igor/diampeer"
+	"igor/radiuscodec"
+	"igor/radiusdict"
+	"igor/radiusserver"
+	"os"
+	"sync"
+)
+
+// Helpers for handlers to generate the responses by evaluating the rules of the policies defined in the
+// attributePolicies.json configuration object, so that simple AAA policies may be expressed as configuration.
+//
+// The rules of the policy are evaluated in order. The actions of the rules whose conditions are met are
+// executed, also in order, until one of them is "accept", "reject" or "handler". The attributes specified
+// in the "addAttribute" actions executed until then are added to the response.
+//
+// The "handler" actions invoke handlers compiled in and registered by name, typically in the init function
+// of the package that implements them
+
+var handlersMutex sync.RWMutex
+var radiusHandlers = make(map[string]radiusserver.RadiusPacketHandler)
+var diameterHandlers = make(map[string]diampeer.MessageHandler)
+
+// Registers a radius handler to be invoked from the policies. Panics if the name is already used
+func RegisterRadiusHandler(name string, handler radiusserver.RadiusPacketHandler) {
+	handlersMutex.Lock()
+	defer handlersMutex.Unlock()
+
+	if handler == nil {
+		panic("nil radius handler " + name)
+	}
+	if _, found := radiusHandlers[name]; found {
+		panic("radius handler " + name + " already registered")
+	}
+	radiusHandlers[name] = handler
+}
+
+// Registers a diameter handler to be invoked from the policies. Panics if the name is already used
+func RegisterDiameterHandler(name string, handler diampeer.MessageHandler) {
+	handlersMutex.Lock()
+	defer handlersMutex.Unlock()
+
+	if handler == nil {
+		panic("nil diameter handler " + name)
+	}
+	if _, found := diameterHandlers[name]; found {
+		panic("diameter handler " + name + " already registered")
+	}
+	diameterHandlers[name] = handler
+}
+
+// Generates the response to the radius request using the specified policy
+func EvaluateRadius(ci *config.PolicyConfigurationManager, policyName string, request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+
+	rules, found := ci.AttributePoliciesConf()[policyName]
+	if !found {
+		return nil, fmt.Errorf("attribute policy %s not found", policyName)
+	}
+
+	avpValue := func(avpName string) (string, bool) {
+		avp, err := request.GetAVP(avpName)
+		if err != nil {
+			return "", false
+		}
+		return avp.GetString(), true
+	}
+
+	avps := make([]*radiuscodec.RadiusAVP, 0)
+	for i := range rules {
+		if !rules[i].Matches(avpValue) {
+			continue
+		}
+		for _, action := range rules[i].Actions {
+			var response *radiuscodec.RadiusPacket
+			switch action.Type {
+			case "addAttribute":
+				avp, err := newRadiusAVP(request.Dict(), action.Attribute, expand(action.Value, avpValue))
+				if err != nil {
+					return nil, fmt.Errorf("attribute policy %s rule %s: %w", policyName, rules[i].Name, err)
+				}
+				avps = append(avps, avp)
+				continue
+			case "accept":
+				response = radiuscodec.NewRadiusResponse(request, true)
+			case "reject":
+				response = radiuscodec.NewRadiusResponse(request, false)
+			case "handler":
+				handlersMutex.RLock()
+				handler, found := radiusHandlers[action.Handler]
+				handlersMutex.RUnlock()
+				if !found {
+					return nil, fmt.Errorf("attribute policy %s rule %s: radius handler %s not registered", policyName, rules[i].Name, action.Handler)
+				}
+				var err error
+				if response, err = handler(request); err != nil {
+					return nil, fmt.Errorf("attribute policy %s rule %s: %w", policyName, rules[i].Name, err)
+				}
+			}
+			for _, avp := range avps {
+				response.AddAVP(avp)
+			}
+			return response, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no decision in attribute policy %s", policyName)
+}
+
+// Generates the answer to the diameter request using the specified policy. The answers generated by the
+// "accept" and "reject" actions include the Origin and the echoed AVPs of the request
+func EvaluateDiameter(ci *config.PolicyConfigurationManager, policyName string, request *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, error) {
+
+	rules, found := ci.AttributePoliciesConf()[policyName]
+	if !found {
+		return nil, fmt.Errorf("attribute policy %s not found", policyName)
+	}
+
+	avpValue := func(avpName string) (string, bool) {
+		avp, err := request.GetAVPFromPath(avpName)
+		if err != nil {
+			return "", false
+		}
+		return avp.GetString(), true
+	}
+
+	avps := make([]*diamcodec.DiameterAVP, 0)
+	for i := range rules {
+		if !rules[i].Matches(avpValue) {
+			continue
+		}
+		for _, action := range rules[i].Actions {
+			var answer *diamcodec.DiameterMessage
+			switch action.Type {
+			case "addAttribute":
+				avp, err := newDiameterAVP(request.Dict(), action.Attribute, expand(action.Value, avpValue))
+				if err != nil {
+					return nil, fmt.Errorf("attribute policy %s rule %s: %w", policyName, rules[i].Name, err)
+				}
+				avps = append(avps, avp)
+				continue
+			case "accept":
+				answer = diamcodec.NewDiameterAnswer(request, diamcodec.CopyEchoedAVPs()).AddOriginAVPs(ci).SetSuccess()
+			case "reject":
+				resultCode := action.ResultCode
+				if resultCode == 0 {
+					resultCode = diamcodec.DIAMETER_AUTHORIZATION_REJECTED
+				}
+				answer = diamcodec.NewDiameterAnswer(request, diamcodec.CopyEchoedAVPs()).AddOriginAVPs(ci).SetResultCode(resultCode)
+			case "handler":
+				handlersMutex.RLock()
+				handler, found := diameterHandlers[action.Handler]
+				handlersMutex.RUnlock()
+				if !found {
+					return nil, fmt.Errorf("attribute policy %s rule %s: diameter handler %s not registered", policyName, rules[i].Name, action.Handler)
+				}
+				var err error
+				if answer, err = handler(request); err != nil {
+					return nil, fmt.Errorf("attribute policy %s rule %s: %w", policyName, rules[i].Name, err)
+				}
+			}
+			for _, avp := range avps {
+				answer.AddAVP(avp)
+			}
+			return answer, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no decision in attribute policy %s", policyName)
+}
+
+// Replaces the ${name} references with the values of the attributes of the request, or the empty
+// string if not present
+func expand(value string, avpValue config.AVPValueFunc) string {
+	return os.Expand(value, func(name string) string {
+		v, _ := avpValue(name)
+		return v
+	})
+}
+
+// Builds the radius attribute from the value in the configuration. Integer attributes may be specified
+// by number or by the name of the value in the dictionary
+func newRadiusAVP(dict *radiusdict.RadiusDict, name string, value string) (*radiuscodec.RadiusAVP, error) {
+	dictItem, _ := dict.GetFromName(name)
+	switch dictItem.RadiusType {
+	case radiusdict.Integer, radiusdict.Integer64:
+		if enumValue, found := dictItem.EnumValues[value]; found {
+			return radiuscodec.NewAVPWithDict(dict, name, enumValue)
+		}
+		return radiuscodec.NewAVPWithDict(dict, name, json.Number(value))
+	default:
+		return radiuscodec.NewAVPWithDict(dict, name, value)
+	}
+}
+
+// Builds the diameter attribute from the value in the configuration. Enumerated attributes may be
+// specified by number or by the name of the value in the dictionary
+func newDiameterAVP(dict *diamdict.DiameterDict, name string, value string) (*diamcodec.DiameterAVP, error) {
+	dictItem, _ := dict.GetFromName(name)
+	switch dictItem.DiameterType {
+	case diamdict.Integer32, diamdict.Integer64, diamdict.Unsigned32, diamdict.Unsigned64, diamdict.Float32, diamdict.Float64:
+		return diamcodec.NewAVPWithDict(dict, name, json.Number(value))
+	case diamdict.Enumerated:
+		if _, found := dictItem.EnumValues[value]; found {
+			return diamcodec.NewAVPWithDict(dict, name, value)
+		}
+		return diamcodec.NewAVPWithDict(dict, name, json.Number(value))
+	default:
+		return diamcodec.NewAVPWithDict(dict, name, value)
+	}
+}
@@ -0,0 +1,110 @@
+package attrpolicy
+
+import (
+	"igor/config"
+	"igor/diamcodec"
+	"igor/radiuscodec"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+
+	// Initialize the Config Object
+	config.InitPolicyConfigInstance("resources/searchRules.json", "testServer", true)
+
+	RegisterRadiusHandler("testExternal", func(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+		return radiuscodec.NewRadiusResponse(request, true).Add("Reply-Message", "external"), nil
+	})
+	RegisterDiameterHandler("testExternal", func(request *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, error) {
+		return diamcodec.NewDiameterAnswer(request).SetError(diamcodec.DIAMETER_UNABLE_TO_COMPLY, "external"), nil
+	})
+
+	// Execute the tests and exit
+	os.Exit(m.Run())
+}
+
+func TestRadiusPolicy(t *testing.T) {
+
+	ci := config.GetPolicyConfig()
+
+	newRequest := func(userName string, nasIdentifier string) *radiuscodec.RadiusPacket {
+		request := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+		request.Add("User-Name", userName)
+		request.Add("NAS-Identifier", nasIdentifier)
+		return request
+	}
+
+	response, err := EvaluateRadius(ci, "radiusAccess", newRequest("blocked@igor", "bras"))
+	if err != nil {
+		t.Fatalf("error evaluating policy: %s", err)
+	}
+	if response.Code != radiuscodec.ACCESS_REJECT || response.GetStringAVP("Reply-Message") != "user blocked@igor is blocked" {
+		t.Errorf("bad response for blocked user %s", response)
+	}
+
+	// Attributes of non final rules are accumulated
+	response, err = EvaluateRadius(ci, "radiusAccess", newRequest("user@igor", "bras-premium"))
+	if err != nil {
+		t.Fatalf("error evaluating policy: %s", err)
+	}
+	if response.Code != radiuscodec.ACCESS_ACCEPT || response.GetIntAVP("Session-Timeout") != 7200 || response.GetStringAVP("Service-Type") != "Framed" || response.GetStringAVP("Class") != "user@igor" {
+		t.Errorf("bad response for premium user %s", response)
+	}
+
+	response, err = EvaluateRadius(ci, "radiusAccess", newRequest("external@igor", "bras"))
+	if err != nil {
+		t.Fatalf("error evaluating policy: %s", err)
+	}
+	if response.Code != radiuscodec.ACCESS_ACCEPT || response.GetStringAVP("Reply-Message") != "external" || response.GetStringAVP("Class") != "" {
+		t.Errorf("bad response from external handler %s", response)
+	}
+
+	// Errors
+	if _, err := EvaluateRadius(ci, "undecided", newRequest("user@igor", "bras")); err == nil {
+		t.Error("no error when no rule decides")
+	}
+	if _, err := EvaluateRadius(ci, "nonExisting", newRequest("user@igor", "bras")); err == nil {
+		t.Error("no error for non existing policy")
+	}
+}
+
+func TestDiameterPolicy(t *testing.T) {
+
+	ci := config.GetPolicyConfig()
+
+	newRequest := func(userName string) *diamcodec.DiameterMessage {
+		request, _ := diamcodec.NewDiameterRequest("TestApplication", "TestRequest")
+		request.Add("Session-Id", "session-1")
+		request.Add("User-Name", userName)
+		return request
+	}
+
+	answer, err := EvaluateDiameter(ci, "diameterAccess", newRequest("user@igor"))
+	if err != nil {
+		t.Fatalf("error evaluating policy: %s", err)
+	}
+	if answer.GetResultCode() != diamcodec.DIAMETER_SUCCESS || answer.GetIntAVP("Session-Timeout") != 3600 || answer.GetStringAVP("Class") != "user@igor" || answer.GetStringAVP("Session-Id") != "session-1" {
+		t.Errorf("bad answer for user %s", answer)
+	}
+
+	answer, err = EvaluateDiameter(ci, "diameterAccess", newRequest("blocked@igor"))
+	if err != nil {
+		t.Fatalf("error evaluating policy: %s", err)
+	}
+	if answer.GetResultCode() != diamcodec.DIAMETER_AUTHENTICATION_REJECTED {
+		t.Errorf("bad answer for blocked user %s", answer)
+	}
+
+	answer, err = EvaluateDiameter(ci, "diameterAccess", newRequest("external@igor"))
+	if err != nil {
+		t.Fatalf("error evaluating policy: %s", err)
+	}
+	if answer.GetResultCode() != diamcodec.DIAMETER_UNABLE_TO_COMPLY || answer.GetStringAVP("Error-Message") != "external" {
+		t.Errorf("bad answer from external handler %s", answer)
+	}
+
+	if _, err := EvaluateDiameter(ci, "undecided", newRequest("user@igor")); err == nil {
+		t.Error("no error when no rule decides")
+	}
+}
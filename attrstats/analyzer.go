@@ -0,0 +1,253 @@
+package attrstats
+
+import (
+	"igor/config"
+	"igor/diamcodec"
+	"igor/radiuscodec"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counts the values of the attributes specified in the configuration in a sample of the messages,
+// to find the most frequent ones over a sliding window without exporting every packet. The window
+// is divided in buckets, and the oldest one is discarded when a new one is started
+
+// Defaults for the values not specified in the configuration
+const (
+	DEFAULT_WINDOW_SECONDS = 3600
+	DEFAULT_BUCKET_SECONDS = 60
+	DEFAULT_MAX_VALUES     = 10000
+)
+
+// Number of values returned when not specified in the query
+const DEFAULT_TOP = 10
+
+// Frequency of a value
+type ValueCount struct {
+	Value string
+	Count uint64
+}
+
+// Statistics of an attribute in the window
+type AttributeStats struct {
+	Attribute string
+
+	// Start of the oldest bucket in the window
+	From time.Time
+
+	// Number of messages analyzed
+	Samples uint64
+
+	// Number of different values. If Other is not zero, this is a lower bound
+	Distinct int
+
+	// Occurrences of the values that could not be kept because the maximum was reached
+	Other uint64
+
+	// Most frequent values, in decreasing order
+	Top []ValueCount
+}
+
+type bucket struct {
+	start   time.Time
+	samples uint64
+
+	// Counts by attribute key and value
+	counts map[string]map[string]uint64
+	other  map[string]uint64
+}
+
+type Analyzer struct {
+	sync.Mutex
+
+	ci *config.PolicyConfigurationManager
+
+	// Number of messages seen, for the sampling
+	seen uint64
+
+	// Newest last
+	buckets []*bucket
+}
+
+// Creates an Analyzer that uses the current attribute statistics configuration
+func NewAnalyzer(ci *config.PolicyConfigurationManager) *Analyzer {
+	return &Analyzer{ci: ci}
+}
+
+// Counts the values in the radius request and its response, if the exchange is selected for sampling.
+// The response may be nil
+func (a *Analyzer) SampleRadius(request *radiuscodec.RadiusPacket, response *radiuscodec.RadiusPacket) {
+	var getters []func(string) string
+	for _, packet := range []*radiuscodec.RadiusPacket{request, response} {
+		if packet != nil {
+			getters = append(getters, packet.GetStringAVP)
+		}
+	}
+	a.sample(getters, time.Now())
+}
+
+// Counts the values in the diameter request and its answer, if the exchange is selected for sampling.
+// The answer may be nil
+func (a *Analyzer) SampleDiameter(request *diamcodec.DiameterMessage, answer *diamcodec.DiameterMessage) {
+	var getters []func(string) string
+	for _, message := range []*diamcodec.DiameterMessage{request, answer} {
+		if message != nil {
+			getters = append(getters, message.GetStringAVP)
+		}
+	}
+	a.sample(getters, time.Now())
+}
+
+// Takes the values of the configured attributes of one exchange, using the getters of each message
+// in order. The exchange counts as a single sample, and each attribute is counted once, with the
+// first value found
+func (a *Analyzer) sample(getters []func(string) string, now time.Time) {
+	if a == nil || len(getters) == 0 {
+		return
+	}
+	if a == nil {
+		return
+	}
+	conf := a.ci.AttributeStatsConf()
+	if len(conf.Attributes) == 0 {
+		return
+	}
+	if conf.SampleRate > 1 && atomic.AddUint64(&a.seen, 1)%uint64(conf.SampleRate) != 0 {
+		return
+	}
+
+	maxValues := conf.MaxValues
+	if maxValues <= 0 {
+		maxValues = DEFAULT_MAX_VALUES
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	b := a.currentBucket(conf, now)
+	b.samples++
+	for _, item := range conf.Attributes {
+		var value string
+		for _, getter := range getters {
+			if value = getter(item.Name); value != "" {
+				break
+			}
+		}
+		if value == "" {
+			continue
+		}
+		if item.Realm {
+			if i := strings.LastIndex(value, "@"); i >= 0 {
+				value = value[i+1:]
+			} else {
+				value = ""
+			}
+		}
+
+		key := item.Key()
+		counts, found := b.counts[key]
+		if !found {
+			counts = make(map[string]uint64)
+			b.counts[key] = counts
+		}
+		if _, found := counts[value]; !found && len(counts) >= maxValues {
+			b.other[key]++
+			continue
+		}
+		counts[value]++
+	}
+}
+
+// Returns the bucket for the current time, starting a new one and discarding the old ones if
+// necessary. Must be called with the lock held
+func (a *Analyzer) currentBucket(conf config.AttributeStatsConfig, now time.Time) *bucket {
+	bucketDuration := time.Duration(conf.BucketSeconds) * time.Second
+	if bucketDuration <= 0 {
+		bucketDuration = DEFAULT_BUCKET_SECONDS * time.Second
+	}
+
+	if n := len(a.buckets); n > 0 && now.Before(a.buckets[n-1].start.Add(bucketDuration)) {
+		return a.buckets[n-1]
+	}
+
+	a.purge(conf, now)
+	b := &bucket{
+		start:  now.Truncate(bucketDuration),
+		counts: make(map[string]map[string]uint64),
+		other:  make(map[string]uint64),
+	}
+	a.buckets = append(a.buckets, b)
+	return b
+}
+
+// Discards the buckets that started before the window. Must be called with the lock held
+func (a *Analyzer) purge(conf config.AttributeStatsConfig, now time.Time) {
+	window := time.Duration(conf.WindowSeconds) * time.Second
+	if window <= 0 {
+		window = DEFAULT_WINDOW_SECONDS * time.Second
+	}
+
+	oldest := now.Add(-window)
+	i := 0
+	for i < len(a.buckets) && a.buckets[i].start.Before(oldest) {
+		i++
+	}
+	a.buckets = a.buckets[i:]
+}
+
+// Returns the names of the attributes being analyzed, as used in the queries
+func (a *Analyzer) Attributes() []string {
+	var attributes []string
+	for _, item := range a.ci.AttributeStatsConf().Attributes {
+		attributes = append(attributes, item.Key())
+	}
+	return attributes
+}
+
+// Returns the statistics of the attribute in the window, with the specified number of most
+// frequent values, or DEFAULT_TOP if zero
+func (a *Analyzer) Stats(attribute string, top int) AttributeStats {
+	return a.stats(attribute, top, time.Now())
+}
+
+func (a *Analyzer) stats(attribute string, top int, now time.Time) AttributeStats {
+	if top <= 0 {
+		top = DEFAULT_TOP
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	a.purge(a.ci.AttributeStatsConf(), now)
+
+	stats := AttributeStats{Attribute: attribute, Top: make([]ValueCount, 0)}
+	counts := make(map[string]uint64)
+	for _, b := range a.buckets {
+		if stats.From.IsZero() {
+			stats.From = b.start
+		}
+		stats.Samples += b.samples
+		stats.Other += b.other[attribute]
+		for value, count := range b.counts[attribute] {
+			counts[value] += count
+		}
+	}
+
+	stats.Distinct = len(counts)
+	for value, count := range counts {
+		stats.Top = append(stats.Top, ValueCount{Value: value, Count: count})
+	}
+	sort.Slice(stats.Top, func(i, j int) bool {
+		if stats.Top[i].Count != stats.Top[j].Count {
+			return stats.Top[i].Count > stats.Top[j].Count
+		}
+		return stats.Top[i].Value < stats.Top[j].Value
+	})
+	if len(stats.Top) > top {
+		stats.Top = stats.Top[:top]
+	}
+	return stats
+}
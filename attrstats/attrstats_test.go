@@ -0,0 +1,89 @@
+package attrstats
+
+import (
+	"igor/config"
+	"igor/radiuscodec"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+
+	// Initialize the Config Object
+	config.InitPolicyConfigInstance("resources/searchRules.json", "testServer", true)
+
+	// Execute the tests and exit
+	os.Exit(m.Run())
+}
+
+func TestAttributeStats(t *testing.T) {
+
+	a := NewAnalyzer(config.GetPolicyConfig())
+
+	for _, userName := range []string{"a@igor", "b@igor", "c@other", "noRealm"} {
+		request := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+		request.Add("User-Name", userName)
+		request.Add("NAS-IP-Address", "127.0.0.1")
+		a.SampleRadius(request, nil)
+	}
+
+	realms := a.Stats("User-Name:realm", 1)
+	if realms.Samples != 4 || len(realms.Top) != 1 || realms.Top[0] != (ValueCount{Value: "igor", Count: 2}) {
+		t.Errorf("bad realm statistics %+v", realms)
+	}
+
+	// The maximum number of values in the configuration is 2
+	if realms.Distinct != 2 || realms.Other != 1 {
+		t.Errorf("bad number of distinct values %+v", realms)
+	}
+
+	nases := a.Stats("NAS-IP-Address", 0)
+	if len(nases.Top) != 1 || nases.Top[0].Count != 4 {
+		t.Errorf("bad NAS statistics %+v", nases)
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+
+	a := NewAnalyzer(config.GetPolicyConfig())
+	getter := func(name string) string {
+		if name == "Result-Code" {
+			return "2001"
+		}
+		return ""
+	}
+
+	// The window in the configuration is 60 seconds, with 10 second buckets
+	start := time.Now()
+	a.sample([]func(string) string{getter}, start)
+	a.sample([]func(string) string{getter}, start.Add(30*time.Second))
+	if stats := a.stats("Result-Code", 0, start.Add(40*time.Second)); len(stats.Top) != 1 || stats.Top[0].Count != 2 {
+		t.Errorf("bad statistics inside the window %+v", stats)
+	}
+	if stats := a.stats("Result-Code", 0, start.Add(80*time.Second)); len(stats.Top) != 1 || stats.Top[0].Count != 1 {
+		t.Errorf("bad statistics after the first bucket expired %+v", stats)
+	}
+}
+
+func TestSampleExchange(t *testing.T) {
+
+	a := NewAnalyzer(config.GetPolicyConfig())
+
+	request := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+	request.Add("User-Name", "a@igor")
+	response := radiuscodec.NewRadiusResponse(request, true)
+	response.Add("NAS-IP-Address", "127.0.0.1")
+	response.Add("User-Name", "b@other")
+	a.SampleRadius(request, response)
+
+	// One sample per exchange, with the attributes of both packets and the request taking precedence
+	realms := a.Stats("User-Name:realm", 0)
+	if realms.Samples != 1 || len(realms.Top) != 1 || realms.Top[0] != (ValueCount{Value: "igor", Count: 1}) {
+		t.Errorf("bad realm statistics %+v", realms)
+	}
+	nases := a.Stats("NAS-IP-Address", 0)
+	if nases.Samples != 1 || len(nases.Top) != 1 || nases.Top[0].Count != 1 {
+		t.Errorf("bad NAS statistics %+v", nases)
+	}
+}
@@ -0,0 +1,105 @@
+package authevents
+
+import (
+	"igor/config"
+	"igor/radiuscodec"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+
+	// Initialize the Config Object
+	config.InitPolicyConfigInstance("resources/searchRules.json", "testServer", true)
+
+	// Execute the tests and exit
+	os.Exit(m.Run())
+}
+
+// Helper to process an authentication of the user from the NAS
+func authenticate(n *Notifier, userName string, nasIPAddress string, accepted bool) []AuthEvent {
+	request := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+	request.Add("User-Name", userName)
+	request.Add("NAS-IP-Address", nasIPAddress)
+	return n.Process(request, radiuscodec.NewRadiusResponse(request, accepted))
+}
+
+func TestAuthEvents(t *testing.T) {
+
+	n := NewNotifier(config.GetPolicyConfig())
+
+	if events := authenticate(n, "user@igor", "127.0.0.1", true); len(events) != 1 || events[0].Type != FIRST_LOGIN {
+		t.Errorf("bad events for first login %v", events)
+	}
+	if events := authenticate(n, "user@igor", "127.0.0.1", true); len(events) != 0 {
+		t.Errorf("bad events for second login %v", events)
+	}
+	if events := authenticate(n, "user@igor", "127.0.0.2", true); len(events) != 1 || events[0].Type != NEW_NAS {
+		t.Errorf("bad events for login from new NAS %v", events)
+	}
+
+	// The threshold in the configuration is 3
+	for i := 0; i < 2; i++ {
+		if events := authenticate(n, "user@igor", "127.0.0.1", false); len(events) != 0 {
+			t.Errorf("bad events for failure %d %v", i, events)
+		}
+	}
+	if events := authenticate(n, "user@igor", "127.0.0.1", false); len(events) != 1 || events[0].Type != REPEATED_FAILURES || events[0].Failures != 3 {
+		t.Errorf("bad events for repeated failures %v", events)
+	}
+	if events := authenticate(n, "user@igor", "127.0.0.1", false); len(events) != 0 {
+		t.Errorf("repeated failures notified again %v", events)
+	}
+
+	// The least recently seen users are forgotten when the maximum is reached
+	conf := config.AuthNotificationsConfig{MaxUsers: 2}
+	event := AuthEvent{UserName: "other@igor"}
+	n.updateHistory(conf, event, "127.0.0.1", true, time.Now())
+	authenticate(n, "user@igor", "127.0.0.1", true)
+	event.UserName = "third@igor"
+	n.updateHistory(conf, event, "127.0.0.1", true, time.Now())
+	if _, found := n.users["other@igor"]; found || len(n.users) != 2 || n.order.Len() != 2 {
+		t.Errorf("least recently seen user not forgotten %v", n.users)
+	}
+
+	// And the users not seen for some time
+	event.UserName = "late@igor"
+	n.updateHistory(conf, event, "127.0.0.1", true, time.Now().Add(time.Duration(DEFAULT_FORGET_AFTER_HOURS+1)*time.Hour))
+	if _, found := n.users["late@igor"]; !found || len(n.users) != 1 {
+		t.Errorf("inactive users not forgotten %v", n.users)
+	}
+}
+
+func TestHooks(t *testing.T) {
+
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		received <- req
+		bodies <- body
+	}))
+	defer server.Close()
+
+	n := NewNotifier(config.GetPolicyConfig())
+	event := AuthEvent{Type: NEW_NAS, Timestamp: time.Now(), UserName: "user@igor", NASIPAddress: "127.0.0.2"}
+
+	// Templated payload
+	go n.send(config.AuthNotificationHook{Type: "http", URL: server.URL + "/notify", Template: `{"user": "{{.UserName}}", "event": "{{.Type}}"}`}, event)
+	req, body := <-received, <-bodies
+	if req.URL.Path != "/notify" || string(body) != `{"user": "user@igor", "event": "newNAS"}` {
+		t.Errorf("bad http notification to %s: %s", req.URL.Path, body)
+	}
+
+	// Kafka hooks are not sent without a producer
+	n.send(config.AuthNotificationHook{Type: "kafka", URL: server.URL, Topic: "authEvents"}, event)
+	select {
+	case req := <-received:
+		t.Errorf("kafka notification sent over http to %s", req.URL.Path)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,292 @@
+package authevents
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"igor/config"
+	"igor/kafkaproducer"
+	"igor/radiuscodec"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// Detection of notable authentication events, which are sent to the hooks in the configuration, so
+// that external systems may react to them without custom handler code. The history of each user is
+// kept in memory, so all the users are new after a restart. The users not seen for some time, or the
+// least recently seen if the maximum number is reached, are forgotten
+
+// Types of events
+const (
+	// First Access-Accept for the user
+	FIRST_LOGIN = "firstLogin"
+
+	// Access-Accept for the user from a NAS not used before
+	NEW_NAS = "newNAS"
+
+	// Number of Access-Rejects for the user in the window reached the threshold
+	REPEATED_FAILURES = "repeatedFailures"
+)
+
+// Defaults for the values not specified in the configuration
+const (
+	DEFAULT_FAILURE_THRESHOLD      = 3
+	DEFAULT_FAILURE_WINDOW_SECONDS = 300
+	DEFAULT_FORGET_AFTER_HOURS     = 720
+	DEFAULT_MAX_USERS              = 100000
+)
+
+// Timeout for sending the notifications
+const HOOK_TIMEOUT_SECONDS = 5
+
+// Sent to the hooks, as JSON or as the parameter of the template
+type AuthEvent struct {
+	Type             string
+	Timestamp        time.Time
+	UserName         string
+	NASIPAddress     string
+	NASIdentifier    string
+	CallingStationId string
+
+	// Number of Access-Rejects in the window, for the repeatedFailures event
+	Failures int
+}
+
+// What is known about a user
+type userHistory struct {
+	userName string
+	nases    map[string]struct{}
+	failures []time.Time
+	lastSeen time.Time
+
+	// Position in the list of users
+	element *list.Element
+}
+
+// Keeps the history of the users and sends the notifications
+type Notifier struct {
+	sync.Mutex
+
+	ci    *config.PolicyConfigurationManager
+	users map[string]*userHistory
+
+	// Histories of the users, the least recently seen first
+	order *list.List
+
+	// Compiled templates, by source
+	templates map[string]*template.Template
+
+	// Publishes the events of the kafka hooks. Stores a *kafkaproducer.Producer
+	kafkaProducer atomic.Value
+}
+
+var hookClient = http.Client{Timeout: HOOK_TIMEOUT_SECONDS * time.Second}
+
+// Creates a Notifier that uses the current authentication notifications configuration
+func NewNotifier(ci *config.PolicyConfigurationManager) *Notifier {
+	return &Notifier{
+		ci:        ci,
+		users:     make(map[string]*userHistory),
+		order:     list.New(),
+		templates: make(map[string]*template.Template),
+	}
+}
+
+// Sets the producer used for the hooks of type "kafka"
+func (n *Notifier) SetKafkaProducer(producer *kafkaproducer.Producer) {
+	n.kafkaProducer.Store(producer)
+}
+
+// To be invoked with each Access-Request and its response. Updates the history of the user and
+// sends the events generated, if any, to the hooks. Returns the events
+func (n *Notifier) Process(request *radiuscodec.RadiusPacket, response *radiuscodec.RadiusPacket) []AuthEvent {
+	if request == nil || response == nil || request.Code != radiuscodec.ACCESS_REQUEST {
+		return nil
+	}
+	userName := request.GetStringAVP("User-Name")
+	if userName == "" {
+		return nil
+	}
+
+	conf := n.ci.AuthNotificationsConf()
+	now := time.Now()
+	event := AuthEvent{
+		Timestamp:        now,
+		UserName:         userName,
+		NASIPAddress:     request.GetStringAVP("NAS-IP-Address"),
+		NASIdentifier:    request.GetStringAVP("NAS-Identifier"),
+		CallingStationId: request.GetStringAVP("Calling-Station-Id"),
+	}
+	nas := event.NASIPAddress
+	if nas == "" {
+		nas = event.NASIdentifier
+	}
+
+	events := n.updateHistory(conf, event, nas, response.Code == radiuscodec.ACCESS_ACCEPT, now)
+	for _, e := range events {
+		for _, hook := range conf.Hooks {
+			if isSubscribed(hook, e.Type) {
+				go n.send(hook, e)
+			}
+		}
+	}
+	return events
+}
+
+// Updates the history of the user with the result of the authentication and returns the events generated
+func (n *Notifier) updateHistory(conf config.AuthNotificationsConfig, event AuthEvent, nas string, accepted bool, now time.Time) []AuthEvent {
+	n.Lock()
+	defer n.Unlock()
+
+	var events []AuthEvent
+	history, found := n.users[event.UserName]
+	if found {
+		n.order.MoveToBack(history.element)
+	} else {
+		history = &userHistory{userName: event.UserName, nases: make(map[string]struct{})}
+		history.element = n.order.PushBack(history)
+		n.users[event.UserName] = history
+	}
+	history.lastSeen = now
+	n.purge(conf, now)
+
+	if accepted {
+		history.failures = nil
+		if len(history.nases) == 0 {
+			event.Type = FIRST_LOGIN
+			events = append(events, event)
+		} else if _, known := history.nases[nas]; !known {
+			event.Type = NEW_NAS
+			events = append(events, event)
+		}
+		history.nases[nas] = struct{}{}
+		return events
+	}
+
+	threshold := conf.FailureThreshold
+	if threshold <= 0 {
+		threshold = DEFAULT_FAILURE_THRESHOLD
+	}
+	windowSeconds := conf.FailureWindowSeconds
+	if windowSeconds <= 0 {
+		windowSeconds = DEFAULT_FAILURE_WINDOW_SECONDS
+	}
+	windowStart := now.Add(-time.Duration(windowSeconds) * time.Second)
+
+	failures := history.failures[:0]
+	for _, t := range history.failures {
+		if t.After(windowStart) {
+			failures = append(failures, t)
+		}
+	}
+	history.failures = append(failures, now)
+
+	if len(history.failures) >= threshold {
+		event.Type = REPEATED_FAILURES
+		event.Failures = len(history.failures)
+		events = append(events, event)
+
+		// Notify again only if the threshold is reached again
+		history.failures = nil
+	}
+	return events
+}
+
+// Forgets the users without recent activity and, if there are too many, the least recently seen ones.
+// Must be called with the lock held
+func (n *Notifier) purge(conf config.AuthNotificationsConfig, now time.Time) {
+	forgetAfterHours := conf.ForgetAfterHours
+	if forgetAfterHours <= 0 {
+		forgetAfterHours = DEFAULT_FORGET_AFTER_HOURS
+	}
+	maxUsers := conf.MaxUsers
+	if maxUsers <= 0 {
+		maxUsers = DEFAULT_MAX_USERS
+	}
+	oldest := now.Add(-time.Duration(forgetAfterHours) * time.Hour)
+	for element := n.order.Front(); element != nil; element = n.order.Front() {
+		history := element.Value.(*userHistory)
+		if n.order.Len() <= maxUsers && !history.lastSeen.Before(oldest) {
+			break
+		}
+		n.order.Remove(element)
+		delete(n.users, history.userName)
+	}
+}
+
+// Returns true if the hook is to receive the events of the specified type
+func isSubscribed(hook config.AuthNotificationHook, eventType string) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+	for _, e := range hook.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Generates the payload for the event, using the template of the hook if specified
+func (n *Notifier) payload(hook config.AuthNotificationHook, event AuthEvent) ([]byte, error) {
+	if hook.Template == "" {
+		return json.Marshal(event)
+	}
+
+	n.Lock()
+	tmpl, found := n.templates[hook.Template]
+	if !found {
+		var err error
+		if tmpl, err = template.New("authEvent").Parse(hook.Template); err != nil {
+			n.Unlock()
+			return nil, fmt.Errorf("bad template: %w", err)
+		}
+		n.templates[hook.Template] = tmpl
+	}
+	n.Unlock()
+
+	var buffer bytes.Buffer
+	if err := tmpl.Execute(&buffer, event); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Sends the event to the hook
+func (n *Notifier) send(hook config.AuthNotificationHook, event AuthEvent) {
+	payload, err := n.payload(hook, event)
+	if err != nil {
+		config.GetLogger().Errorf("could not generate payload for %s event: %s", event.Type, err)
+		return
+	}
+
+	switch hook.Type {
+	case "http", "":
+	case "kafka":
+		producer, _ := n.kafkaProducer.Load().(*kafkaproducer.Producer)
+		if producer == nil {
+			config.GetLogger().Errorf("no kafka producer to notify %s event to topic %s", event.Type, hook.Topic)
+			return
+		}
+		producer.PublishValue(hook.Topic, event.UserName, payload)
+		return
+	default:
+		config.GetLogger().Errorf("unknown authentication notification hook type %s", hook.Type)
+		return
+	}
+
+	resp, err := hookClient.Post(hook.URL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		config.GetLogger().Errorf("could not notify %s event to %s: %s", event.Type, hook.URL, err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		config.GetLogger().Errorf("%s event notification to %s returned status %d", event.Type, hook.URL, resp.StatusCode)
+	}
+}
@@ -0,0 +1,87 @@
+package bandwidthpolicy
+
+import (
+	"fmt"
+	"igor/config"
+	"igor/radiuscodec"
+	"igor/radiusdict"
+	"os"
+	"strconv"
+)
+
+// Helpers for handlers to generate the rate limiting attributes of a subscriber plan,
+// in the format required by each type of NAS, as specified in the bandwidthPolicies.json
+// configuration object
+
+// Returns the attributes for the specified plan and NAS vendor
+func GetAttributes(ci *config.PolicyConfigurationManager, planName string, vendor string) ([]*radiuscodec.RadiusAVP, error) {
+
+	policies := ci.BandwidthPoliciesConf()
+
+	plan, found := policies.Plans[planName]
+	if !found {
+		return nil, fmt.Errorf("bandwidth plan %s not found", planName)
+	}
+
+	templates, found := policies.VendorTemplates[vendor]
+	if !found {
+		return nil, fmt.Errorf("no bandwidth attributes defined for vendor %s", vendor)
+	}
+
+	avps := make([]*radiuscodec.RadiusAVP, 0, len(templates))
+	for _, template := range templates {
+		avp, err := newAVPFromTemplate(ci.RadiusDict(), template, planName, plan)
+		if err != nil {
+			return nil, fmt.Errorf("plan %s for vendor %s: %w", planName, vendor, err)
+		}
+		avps = append(avps, avp)
+	}
+
+	return avps, nil
+}
+
+// Adds to the packet the attributes for the specified plan and NAS vendor
+func AddAttributes(ci *config.PolicyConfigurationManager, packet *radiuscodec.RadiusPacket, planName string, vendor string) error {
+	avps, err := GetAttributes(ci, planName, vendor)
+	if err != nil {
+		return err
+	}
+	for _, avp := range avps {
+		packet.AddAVP(avp)
+	}
+	return nil
+}
+
+// Builds the attribute replacing the references to the values of the plan
+func newAVPFromTemplate(dict *radiusdict.RadiusDict, template config.BandwidthAttributeTemplate, planName string, plan config.BandwidthPlan) (*radiuscodec.RadiusAVP, error) {
+
+	value := os.Expand(template.Value, func(name string) string {
+		switch name {
+		case "plan":
+			return planName
+		case "downlinkKbps":
+			return strconv.Itoa(plan.DownlinkKbps)
+		case "uplinkKbps":
+			return strconv.Itoa(plan.UplinkKbps)
+		case "downlinkBps":
+			return strconv.Itoa(plan.DownlinkKbps * 1000)
+		case "uplinkBps":
+			return strconv.Itoa(plan.UplinkKbps * 1000)
+		default:
+			return plan.Parameters[name]
+		}
+	})
+
+	// Integer attributes must be created from numbers
+	dictItem, _ := dict.GetFromName(template.Attribute)
+	switch dictItem.RadiusType {
+	case radiusdict.Integer, radiusdict.Integer64:
+		intValue, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s as integer for %s", value, template.Attribute)
+		}
+		return radiuscodec.NewAVPWithDict(dict, template.Attribute, intValue)
+	default:
+		return radiuscodec.NewAVPWithDict(dict, template.Attribute, value)
+	}
+}
@@ -0,0 +1,54 @@
+package bandwidthpolicy
+
+import (
+	"igor/config"
+	"igor/radiuscodec"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+
+	// Initialize the Config Object
+	config.InitPolicyConfigInstance("resources/searchRules.json", "testServer", true)
+
+	// Execute the tests and exit
+	os.Exit(m.Run())
+}
+
+func TestBandwidthAttributes(t *testing.T) {
+
+	ci := config.GetPolicyConfig()
+
+	packet := radiuscodec.NewRadiusResponse(radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST), true)
+	if err := AddAttributes(ci, packet, "basic", "mikrotik"); err != nil {
+		t.Fatalf("error adding attributes %s", err)
+	}
+	if rateLimit := packet.GetStringAVP("Mikrotik-Rate-Limit"); rateLimit != "1000k/10000k" {
+		t.Errorf("bad Mikrotik-Rate-Limit %s", rateLimit)
+	}
+
+	avps, err := GetAttributes(ci, "premium", "cisco")
+	if err != nil {
+		t.Fatalf("error getting attributes %s", err)
+	}
+	if len(avps) != 2 || avps[0].GetString() != "ip:sub-qos-policy-in=PREMIUM-IN" || avps[1].GetString() != "ip:sub-qos-policy-out=PREMIUM-OUT" {
+		t.Errorf("bad cisco attributes %v", avps)
+	}
+
+	avps, err = GetAttributes(ci, "premium", "huawei")
+	if err != nil {
+		t.Fatalf("error getting attributes %s", err)
+	}
+	if len(avps) != 2 || avps[0].GetInt() != 20000000 || avps[1].GetInt() != 100000000 {
+		t.Errorf("bad huawei attributes %v", avps)
+	}
+
+	// Errors
+	if _, err := GetAttributes(ci, "nonExisting", "cisco"); err == nil {
+		t.Errorf("attributes returned for non existing plan")
+	}
+	if _, err := GetAttributes(ci, "basic", "nonExisting"); err == nil {
+		t.Errorf("attributes returned for non existing vendor")
+	}
+}
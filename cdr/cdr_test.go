@@ -0,0 +1,479 @@
+package cdr
+
+import (
+	"bufio"
+	"errors"
+	"igor/config"
+	"igor/diamcodec"
+	"igor/instrumentation"
+	"igor/radiuscodec"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+
+	// Initialize the Config Object
+	config.InitPolicyConfigInstance("resources/searchRules.json", "testServer", true)
+
+	// Execute the tests and exit
+	os.Exit(m.Run())
+}
+
+// Keeps the CDR written in memory
+type memoryWriter struct {
+	sync.Mutex
+	cdrs []*CDR
+
+	// If not nil, writes wait until closed
+	gate chan struct{}
+}
+
+func (mw *memoryWriter) Write(cdr *CDR) error {
+	if mw.gate != nil {
+		<-mw.gate
+	}
+	mw.Lock()
+	defer mw.Unlock()
+	mw.cdrs = append(mw.cdrs, cdr)
+	return nil
+}
+
+func (mw *memoryWriter) Close() error {
+	return nil
+}
+
+// Created by each test
+var testWriter *memoryWriter
+var blockingWriter *memoryWriter
+
+func init() {
+	RegisterStage("test-enrich", func(params map[string]string) (Stage, error) {
+		return func(cdr *CDR) (bool, error) {
+			cdr.Attributes["Enriched"] = []string{params["value"]}
+			return true, nil
+		}, nil
+	})
+	RegisterWriter("test-memory", func(params map[string]string) (Writer, error) { return testWriter, nil })
+	RegisterWriter("test-blocking", func(params map[string]string) (Writer, error) { return blockingWriter, nil })
+}
+
+// Helper to build accounting packets
+func accountingRequest(sessionId string, sessionTime int) *radiuscodec.RadiusPacket {
+	packet := radiuscodec.NewRadiusRequest(radiuscodec.ACCOUNTING_REQUEST)
+	packet.Add("Acct-Status-Type", 3)
+	packet.Add("Acct-Session-Id", sessionId)
+	packet.Add("Acct-Session-Time", sessionTime)
+	packet.Add("User-Name", "user@igor")
+	return packet
+}
+
+func TestPipelineConfig(t *testing.T) {
+	conf := config.GetPolicyConfig().CDRPipelineConf()
+	if len(conf.Stages) != 2 || conf.Stages[1].Type != "dedup" || conf.Stages[1].Params["windowSeconds"] != "60" {
+		t.Errorf("bad pipeline stages %v", conf.Stages)
+	}
+	if len(conf.Writers) != 1 || conf.Writers[0].StageName() != "localFile" || conf.Stages[0].StageName() != "decode" {
+		t.Errorf("bad pipeline writers %v", conf.Writers)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+
+	testWriter = &memoryWriter{}
+	fileName := filepath.Join(t.TempDir(), "cdr.txt")
+	pipeline, err := NewPipeline("", config.CDRPipelineConfig{
+		Stages: []config.CDRStageConfig{
+			{Type: "decode", Workers: 2},
+			{Type: "dedup"},
+			{Type: "test-enrich", Params: map[string]string{"value": "yes"}},
+		},
+		Writers: []config.CDRStageConfig{
+			{Type: "file", Params: map[string]string{"path": fileName}},
+			{Type: "test-memory", Name: "memory", Workers: 4},
+		},
+	})
+	if err != nil {
+		t.Fatalf("could not create pipeline %s", err)
+	}
+
+	instrumentation.MS.ResetMetrics()
+
+	// The third packet is a retransmission of the first one
+	for _, packet := range []*radiuscodec.RadiusPacket{accountingRequest("session-1", 60), accountingRequest("session-2", 60), accountingRequest("session-1", 60)} {
+		if err := pipeline.Submit(packet); err != nil {
+			t.Fatalf("submit error %s", err)
+		}
+		// Make sure that the duplicate is detected in order
+		time.Sleep(20 * time.Millisecond)
+	}
+	pipeline.Close()
+
+	if err := pipeline.Submit(accountingRequest("session-3", 0)); !errors.Is(err, ErrPipelineClosed) {
+		t.Errorf("expected pipeline closed but got %v", err)
+	}
+
+	if len(testWriter.cdrs) != 2 {
+		t.Fatalf("expected 2 CDR written but got %d", len(testWriter.cdrs))
+	}
+	for _, cdr := range testWriter.cdrs {
+		if cdr.Attributes["Enriched"][0] != "yes" || cdr.Attributes["User-Name"][0] != "user@igor" {
+			t.Errorf("bad attributes in CDR %v", cdr.Attributes)
+		}
+	}
+
+	file, _ := os.Open(fileName)
+	defer file.Close()
+	lines := 0
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+		lines++
+	}
+	if lines != 2 {
+		t.Errorf("expected 2 lines in file but got %d", lines)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if dropped := instrumentation.MS.CDRQuery("CDRDropped", map[string]string{"Stage": "dedup"}, []string{"Stage"}); dropped[instrumentation.CDRMetricKey{Stage: "dedup"}] != 1 {
+		t.Errorf("bad dropped metric %v", dropped)
+	}
+	if processed := instrumentation.MS.CDRQuery("CDRProcessed", nil, []string{"Stage"}); processed[instrumentation.CDRMetricKey{Stage: "memory"}] != 2 {
+		t.Errorf("bad processed metric %v", processed)
+	}
+}
+
+// Helper to build accounting packets for the correlation tests
+func correlationRequest(statusType int, sessionId string, sessionTime int, inputOctets int) *radiuscodec.RadiusPacket {
+	packet := radiuscodec.NewRadiusRequest(radiuscodec.ACCOUNTING_REQUEST)
+	packet.Add("NAS-IP-Address", "127.0.0.1")
+	packet.Add("Acct-Status-Type", statusType)
+	if sessionId != "" {
+		packet.Add("Acct-Session-Id", sessionId)
+		packet.Add("Acct-Session-Time", sessionTime)
+		packet.Add("Acct-Input-Octets", inputOctets)
+	}
+	return packet
+}
+
+func TestCorrelation(t *testing.T) {
+
+	testWriter = &memoryWriter{}
+	pipeline, err := NewPipeline("", config.CDRPipelineConfig{
+		Stages:  []config.CDRStageConfig{{Type: "decode"}, {Type: "correlate"}},
+		Writers: []config.CDRStageConfig{{Type: "test-memory"}},
+	})
+	if err != nil {
+		t.Fatalf("could not create pipeline %s", err)
+	}
+
+	multiSession := func(packet *radiuscodec.RadiusPacket) *radiuscodec.RadiusPacket {
+		return packet.Add("Acct-Multi-Session-Id", "multi")
+	}
+	packets := []*radiuscodec.RadiusPacket{
+		correlationRequest(1, "session-1", 0, 0),
+		correlationRequest(3, "session-1", 60, 1000),
+		correlationRequest(3, "session-1", 60, 1000),
+		correlationRequest(2, "session-1", 120, 3000),
+		correlationRequest(3, "session-1", 90, 2000),
+		multiSession(correlationRequest(1, "session-2", 0, 0)),
+		multiSession(correlationRequest(1, "session-3", 0, 0)),
+		multiSession(correlationRequest(2, "session-2", 30, 100)),
+		multiSession(correlationRequest(2, "session-3", 60, 200)),
+		correlationRequest(1, "session-4", 0, 0),
+		correlationRequest(7, "", 0, 0),
+	}
+	for _, packet := range packets {
+		if err := pipeline.Submit(packet); err != nil {
+			t.Fatalf("submit error %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	pipeline.Close()
+
+	if len(testWriter.cdrs) != 4 {
+		t.Fatalf("expected 4 CDR written but got %d", len(testWriter.cdrs))
+	}
+
+	single := testWriter.cdrs[0].Attributes
+	if single["Acct-Status-Type"][0] != "Stop" || single[SESSION_INPUT_OCTETS][0] != "3000" || single[SESSION_TIME][0] != "120" ||
+		single[SESSION_RECORDS][0] != "3" || single[SESSION_CLOSURE][0] != CLOSURE_STOP {
+		t.Errorf("bad consolidated record %v", single)
+	}
+
+	multi := testWriter.cdrs[1].Attributes
+	if len(multi["Acct-Session-Id"]) != 2 || multi[SESSION_INPUT_OCTETS][0] != "300" || multi[SESSION_RECORDS][0] != "4" {
+		t.Errorf("bad consolidated record of multiple sessions %v", multi)
+	}
+
+	// The session open is closed before the Accounting-On is passed
+	restarted := testWriter.cdrs[2].Attributes
+	if restarted["Acct-Session-Id"][0] != "session-4" || restarted[SESSION_CLOSURE][0] != CLOSURE_NAS_RESTART {
+		t.Errorf("bad record of session closed by restart %v", restarted)
+	}
+	if testWriter.cdrs[3].Attributes["Acct-Status-Type"][0] != "Accounting-on" {
+		t.Errorf("Accounting-On not passed %v", testWriter.cdrs[3].Attributes)
+	}
+}
+
+func TestCorrelationTimeout(t *testing.T) {
+
+	c := newCorrelator(time.Minute, time.Hour)
+	var emitted []*CDR
+	c.Start(func(cdr *CDR) { emitted = append(emitted, cdr) })
+	defer c.Stop()
+
+	process := func(packet *radiuscodec.RadiusPacket, received time.Time) bool {
+		cdr := &CDR{Packet: packet, Received: received}
+		if _, err := decodeStage(cdr); err != nil {
+			t.Fatalf("decode error %s", err)
+		}
+		passed, err := c.Process(cdr)
+		if err != nil {
+			t.Fatalf("correlation error %s", err)
+		}
+		return passed
+	}
+
+	now := time.Now()
+	interim := correlationRequest(3, "session-1", 600, 100)
+	interim.Add("Acct-Input-Gigawords", 1)
+	if process(interim, now.Add(-2*time.Minute)) {
+		t.Error("interim passed")
+	}
+
+	closed := c.closeTimedOut(now)
+	if len(closed) != 1 {
+		t.Fatalf("expected 1 session timed out but got %d", len(closed))
+	}
+	record := closed[0].Attributes
+	start := now.Add(-12 * time.Minute).Format(SESSION_TIME_LAYOUT)
+	if record[SESSION_CLOSURE][0] != CLOSURE_TIMEOUT || record[SESSION_INPUT_OCTETS][0] != "4294967396" || record[SESSION_START][0] != start {
+		t.Errorf("bad synthesized record %v", record)
+	}
+
+	// The Stop arriving late is filtered out
+	if process(correlationRequest(2, "session-1", 700, 200), now) {
+		t.Error("stop of closed session passed")
+	}
+	if len(c.closeTimedOut(now.Add(time.Hour))) != 0 {
+		t.Error("closed session timed out again")
+	}
+}
+
+func TestBackpressure(t *testing.T) {
+
+	blockingWriter = &memoryWriter{gate: make(chan struct{})}
+	pipeline, err := NewPipeline("", config.CDRPipelineConfig{
+		Stages:  []config.CDRStageConfig{{Type: "decode", QueueSize: 1}},
+		Writers: []config.CDRStageConfig{{Type: "test-blocking", QueueSize: 1}},
+	})
+	if err != nil {
+		t.Fatalf("could not create pipeline %s", err)
+	}
+
+	// One CDR blocked in the writer, one in the writer queue, one blocked in the decode stage
+	// and one in the decode queue
+	var submitted int
+	for submitted = 0; submitted < 10; submitted++ {
+		if err := pipeline.Submit(accountingRequest("session", submitted)); err != nil {
+			if !errors.Is(err, ErrPipelineFull) {
+				t.Fatalf("expected pipeline full but got %s", err)
+			}
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if submitted != 4 {
+		t.Errorf("expected 4 CDR accepted but got %d", submitted)
+	}
+
+	close(blockingWriter.gate)
+	pipeline.Close()
+	if len(blockingWriter.cdrs) != submitted {
+		t.Errorf("expected %d CDR written but got %d", submitted, len(blockingWriter.cdrs))
+	}
+}
+
+func TestEnrich(t *testing.T) {
+
+	testWriter = &memoryWriter{}
+	pipeline, err := NewPipeline("", config.CDRPipelineConfig{
+		Stages:  []config.CDRStageConfig{{Type: "decode"}, {Type: "enrich"}},
+		Writers: []config.CDRStageConfig{{Type: "test-memory"}},
+	})
+	if err != nil {
+		t.Fatalf("could not create pipeline %s", err)
+	}
+
+	// Diameter accounting request from the partner
+	request, _ := diamcodec.NewDiameterRequest("Base", "Accounting")
+	request.Add("Session-Id", "diameter-session")
+	request.Add("Origin-Host", "dra.partner1.com")
+	request.Add("Origin-Realm", "partner1.com")
+	if err := pipeline.SubmitDiameter(request); err != nil {
+		t.Fatalf("submit error %s", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// Radius accounting requests for a user of the partner and for a local user
+	partnerPacket := radiuscodec.NewRadiusRequest(radiuscodec.ACCOUNTING_REQUEST)
+	partnerPacket.Add("Acct-Status-Type", 3)
+	partnerPacket.Add("Acct-Session-Id", "session-1")
+	partnerPacket.Add("User-Name", "user@partner1.com")
+	for _, packet := range []*radiuscodec.RadiusPacket{partnerPacket, accountingRequest("session-2", 60)} {
+		if err := pipeline.Submit(packet); err != nil {
+			t.Fatalf("submit error %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	pipeline.Close()
+
+	if len(testWriter.cdrs) != 3 {
+		t.Fatalf("expected 3 CDR written but got %d", len(testWriter.cdrs))
+	}
+	if tags := testWriter.cdrs[0].Attributes["partnerCode"]; len(tags) != 1 || tags[0] != "P1" {
+		t.Errorf("billing tags not added to diameter CDR %v", testWriter.cdrs[0].Attributes)
+	}
+	if tags := testWriter.cdrs[1].Attributes["partnerCode"]; len(tags) != 1 || tags[0] != "P1" {
+		t.Errorf("billing tags not added to radius CDR %v", testWriter.cdrs[1].Attributes)
+	}
+	if _, found := testWriter.cdrs[2].Attributes["partnerCode"]; found {
+		t.Errorf("billing tags added to CDR not from partner %v", testWriter.cdrs[2].Attributes)
+	}
+
+	if _, err := newEnrichStage(map[string]string{"instance": "nonExisting"}); err == nil {
+		t.Error("enrich stage created for non existing configuration instance")
+	}
+}
+
+func TestBadPipeline(t *testing.T) {
+	if _, err := NewPipeline("", config.CDRPipelineConfig{}); err == nil {
+		t.Errorf("pipeline without writers created")
+	}
+	if _, err := NewPipeline("", config.CDRPipelineConfig{Writers: []config.CDRStageConfig{{Type: "unknown"}}}); err == nil {
+		t.Errorf("pipeline with unknown writer created")
+	}
+	if _, err := NewPipeline("", config.CDRPipelineConfig{
+		Stages:  []config.CDRStageConfig{{Type: "dedup", Params: map[string]string{"windowSeconds": "bad"}}},
+		Writers: []config.CDRStageConfig{{Type: "test-memory"}},
+	}); err == nil {
+		t.Errorf("pipeline with bad dedup parameters created")
+	}
+}
+
+func TestFormats(t *testing.T) {
+	cdr := CDR{
+		Packet:     accountingRequest("session-1", 60),
+		Received:   time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC),
+		Attributes: map[string][]string{"User-Name": {"user@igor"}, "Acct-Session-Time": {"60"}, "Class": {"a", "b,c"}},
+	}
+
+	formatter, _, _ := newFormatter(map[string]string{"format": "csv", "attributes": "User-Name,Class,Missing,Acct-Session-Time"})
+	if record, _ := formatter(&cdr); string(record) != "user@igor,\"a;b,c\",,60\n" {
+		t.Errorf("bad csv record %q", record)
+	}
+
+	formatter, _, _ = newFormatter(map[string]string{"format": "livingston"})
+	expected := "Fri Mar  4 05:06:07 2022\n\tAcct-Session-Time = 60\n\tClass = \"a\"\n\tClass = \"b,c\"\n\tUser-Name = \"user@igor\"\n\n"
+	if record, _ := formatter(&cdr); string(record) != expected {
+		t.Errorf("bad livingston record %q", record)
+	}
+
+	formatter, contentType, _ := newFormatter(map[string]string{})
+	if record, _ := formatter(&cdr); contentType != "application/json" || !strings.Contains(string(record), `"Code":4`) {
+		t.Errorf("bad json record %s", record)
+	}
+
+	if _, _, err := newFormatter(map[string]string{"format": "csv"}); err == nil {
+		t.Error("csv format without attributes accepted")
+	}
+	if _, _, err := newFormatter(map[string]string{"format": "xml"}); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
+
+func TestFileRotation(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "cdr.csv")
+	writer, err := newFileWriter(map[string]string{"path": fileName, "format": "csv", "attributes": "Acct-Session-Id", "rotateBytes": "25"})
+	if err != nil {
+		t.Fatalf("could not create file writer %s", err)
+	}
+
+	// Each record is 10 bytes long. Two of them fit in each file
+	for i := 0; i < 5; i++ {
+		if err := writer.Write(&CDR{Attributes: map[string][]string{"Acct-Session-Id": {"session-" + string(rune('0'+i))}}}); err != nil {
+			t.Fatalf("write error %s", err)
+		}
+	}
+	writer.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "cdr.csv*"))
+	if len(files) != 3 {
+		t.Fatalf("expected 3 files but got %v", files)
+	}
+	if contents, _ := os.ReadFile(fileName); string(contents) != "session-4\n" {
+		t.Errorf("bad contents of current file %q", contents)
+	}
+
+	if _, err := newFileWriter(map[string]string{"path": fileName, "rotateSeconds": "0"}); err == nil {
+		t.Error("file writer with bad rotateSeconds created")
+	}
+}
+
+func TestHTTPWriter(t *testing.T) {
+	var mutex sync.Mutex
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mutex.Lock()
+		received = append(received, r.Header.Get("Content-Type")+" "+string(body))
+		mutex.Unlock()
+	}))
+	defer server.Close()
+
+	pipeline, err := NewPipeline("", config.CDRPipelineConfig{
+		Writers: []config.CDRStageConfig{{Type: "http", Params: map[string]string{"url": server.URL, "format": "csv", "attributes": "Session-Id,Accounting-Record-Type"}}},
+	})
+	if err != nil {
+		t.Fatalf("could not create pipeline %s", err)
+	}
+
+	// Diameter accounting request
+	request, _ := diamcodec.NewDiameterRequest("Base", "Accounting")
+	request.Add("Session-Id", "diameter-session")
+	request.Add("Accounting-Record-Type", 2)
+	if err := pipeline.SubmitDiameter(request); err != nil {
+		t.Fatalf("submit error %s", err)
+	}
+	pipeline.Close()
+
+	if len(received) != 1 || received[0] != "text/csv diameter-session,START_RECORD\n" {
+		t.Errorf("bad records received %v", received)
+	}
+
+	if _, err := newKafkaWriter(map[string]string{"topic": "cdr"}); err == nil {
+		t.Error("kafka writer without brokers created")
+	}
+}
+
+func TestWrite(t *testing.T) {
+	testWriter = &memoryWriter{}
+	pipeline, _ := NewPipeline("", config.CDRPipelineConfig{Writers: []config.CDRStageConfig{{Type: "test-memory"}}})
+	SetDefaultPipeline(pipeline)
+	defer SetDefaultPipeline(nil)
+
+	if err := Write(accountingRequest("session-1", 60)); err != nil {
+		t.Fatalf("write error %s", err)
+	}
+	pipeline.Close()
+	if len(testWriter.cdrs) != 1 || testWriter.cdrs[0].Attributes["Acct-Session-Id"][0] != "session-1" {
+		t.Errorf("CDR not written")
+	}
+}
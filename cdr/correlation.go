@@ -0,0 +1,420 @@
+package cdr
+
+import (
+	"errors"
+	"igor/core"
+	"igor/radiuscodec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Correlation of the radius accounting records of the same session. The "correlate" stage keeps the Start
+// and Interim-Update records of each session and, when the Stop is received, passes instead a single
+// consolidated record to the next stage. The sessions of the same NAS whose records carry the same
+// Acct-Multi-Session-Id are consolidated together, when all of them have stopped.
+//
+// The sessions without records during "timeoutSeconds" (DEFAULT_CORRELATION_TIMEOUT_SECONDS by default)
+// are assumed to have lost the Stop, and are closed with a synthesized record. So are the sessions of a NAS
+// that sends Accounting-On or Accounting-Off, which are passed unchanged. The retransmitted and out of
+// order records, and those of sessions closed less than "closedSeconds" ago, are filtered out. Diameter
+// records and radius records without Acct-Session-Id are passed unchanged.
+//
+// The consolidated record has the attributes of all the records, with the values of the last one, and
+//
+//   - Acct-Status-Type set to Stop, and Acct-Session-Id with the identifiers of all the sessions
+//   - the usage of the sessions added up, in the same attributes as the usage stage of the session store,
+//     with the octets including the gigawords
+//   - the start and stop times of the session, the number of records received and the reason for closing
+//
+// It must be placed after the decode stage. If the stage has several workers, the records of the same
+// session may be processed out of order
+
+// Defaults for the correlation stage
+const (
+	DEFAULT_CORRELATION_TIMEOUT_SECONDS = 7200
+	DEFAULT_CORRELATION_CLOSED_SECONDS  = 600
+)
+
+// Names of the attributes added to the consolidated records
+const (
+	SESSION_INPUT_OCTETS   = "Session-Input-Octets"
+	SESSION_OUTPUT_OCTETS  = "Session-Output-Octets"
+	SESSION_INPUT_PACKETS  = "Session-Input-Packets"
+	SESSION_OUTPUT_PACKETS = "Session-Output-Packets"
+	SESSION_TIME           = "Session-Time"
+	SESSION_START          = "Session-Start"
+	SESSION_STOP           = "Session-Stop"
+	SESSION_RECORDS        = "Session-Records"
+	SESSION_CLOSURE        = "Session-Closure"
+)
+
+// Values of the SESSION_CLOSURE attribute
+const (
+	CLOSURE_STOP        = "Stop"
+	CLOSURE_TIMEOUT     = "Timeout"
+	CLOSURE_NAS_RESTART = "NAS-Restart"
+)
+
+// Layout of the start and stop times of the consolidated records
+const SESSION_TIME_LAYOUT = time.RFC3339
+
+// Counters tracked for each session, with the name of the attribute in the consolidated record, and the
+// attributes in the accounting packets with the lower 32 bits and the gigawords, if any
+var correlatedCounters = []struct {
+	name          string
+	attribute     string
+	gigawordsName string
+}{
+	{SESSION_INPUT_OCTETS, "Acct-Input-Octets", "Acct-Input-Gigawords"},
+	{SESSION_OUTPUT_OCTETS, "Acct-Output-Octets", "Acct-Output-Gigawords"},
+	{SESSION_INPUT_PACKETS, "Acct-Input-Packets", ""},
+	{SESSION_OUTPUT_PACKETS, "Acct-Output-Packets", ""},
+}
+
+// Records received for an Acct-Session-Id
+type correlatedSession struct {
+	// Estimated from the reception time and the Acct-Session-Time of the first record
+	start time.Time
+
+	// Last Acct-Session-Time received
+	sessionTime int64
+
+	// Values of the correlatedCounters
+	counters []uint64
+
+	records int
+	stopped bool
+}
+
+// Sessions consolidated in a single record
+type sessionGroup struct {
+	// NAS-IP-Address, NAS-IPv6-Address or NAS-Identifier of the sessions
+	nas string
+
+	// Sessions by Acct-Session-Id, and their identifiers in order of arrival
+	sessions   map[string]*correlatedSession
+	sessionIds []string
+
+	// Attributes of the records received, with the latest values
+	attributes map[string][]string
+
+	// The packet of the last record received
+	lastPacket *radiuscodec.RadiusPacket
+	lastSeen   time.Time
+}
+
+// Builds the consolidated record
+func (g *sessionGroup) record(closure string, received time.Time) *CDR {
+	attributes := make(map[string][]string, len(g.attributes)+len(correlatedCounters)+5)
+	for name, values := range g.attributes {
+		attributes[name] = values
+	}
+	attributes["Acct-Status-Type"] = []string{"Stop"}
+	attributes["Acct-Session-Id"] = g.sessionIds
+
+	var start, stop time.Time
+	var records int
+	totals := make([]uint64, len(correlatedCounters))
+	for _, session := range g.sessions {
+		if start.IsZero() || session.start.Before(start) {
+			start = session.start
+		}
+		if end := session.start.Add(time.Duration(session.sessionTime) * time.Second); end.After(stop) {
+			stop = end
+		}
+		for i := range totals {
+			totals[i] += session.counters[i]
+		}
+		records += session.records
+	}
+	for i, counter := range correlatedCounters {
+		attributes[counter.name] = []string{strconv.FormatUint(totals[i], 10)}
+	}
+	attributes[SESSION_TIME] = []string{strconv.FormatInt(int64(stop.Sub(start)/time.Second), 10)}
+	attributes[SESSION_START] = []string{start.Format(SESSION_TIME_LAYOUT)}
+	attributes[SESSION_STOP] = []string{stop.Format(SESSION_TIME_LAYOUT)}
+	attributes[SESSION_RECORDS] = []string{strconv.Itoa(records)}
+	attributes[SESSION_CLOSURE] = []string{closure}
+
+	return &CDR{Packet: g.lastPacket, Received: received, Attributes: attributes}
+}
+
+// Keeps the sessions being correlated. Implements EmitterStage
+type correlator struct {
+	sync.Mutex
+
+	timeout   time.Duration
+	closedTTL time.Duration
+
+	// Groups by key, and key of the group of each NAS and Acct-Session-Id
+	groups  map[string]*sessionGroup
+	members map[string]string
+
+	// Time when the sessions were closed, by NAS and Acct-Session-Id
+	closed    map[string]time.Time
+	lastPurge time.Time
+
+	emit func(cdr *CDR)
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newCorrelator(timeout time.Duration, closedTTL time.Duration) *correlator {
+	return &correlator{
+		timeout:   timeout,
+		closedTTL: closedTTL,
+		groups:    make(map[string]*sessionGroup),
+		members:   make(map[string]string),
+		closed:    make(map[string]time.Time),
+		lastPurge: time.Now(),
+		done:      make(chan struct{}),
+	}
+}
+
+func newCorrelationStage(params map[string]string) (EmitterStage, error) {
+	timeoutSeconds, err := positiveIntParam(params, "timeoutSeconds")
+	if err != nil {
+		return nil, err
+	}
+	if timeoutSeconds == 0 {
+		timeoutSeconds = DEFAULT_CORRELATION_TIMEOUT_SECONDS
+	}
+	closedSeconds, err := positiveIntParam(params, "closedSeconds")
+	if err != nil {
+		return nil, err
+	}
+	if closedSeconds == 0 {
+		closedSeconds = DEFAULT_CORRELATION_CLOSED_SECONDS
+	}
+	return newCorrelator(time.Duration(timeoutSeconds)*time.Second, time.Duration(closedSeconds)*time.Second), nil
+}
+
+// Looks for timed out sessions periodically
+func (c *correlator) Start(emit func(cdr *CDR)) {
+	c.emit = emit
+
+	interval := c.timeout / 4
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case now := <-ticker.C:
+				for _, cdr := range c.closeTimedOut(now) {
+					c.emit(cdr)
+				}
+			}
+		}
+	}()
+}
+
+// The sessions still open are discarded
+func (c *correlator) Stop() {
+	close(c.done)
+	c.wg.Wait()
+}
+
+func (c *correlator) Process(cdr *CDR) (bool, error) {
+	if cdr.Packet == nil {
+		return true, nil
+	}
+	if cdr.Attributes == nil {
+		return false, errors.New("correlate stage without decoded attributes")
+	}
+
+	nas := firstValue(cdr.Attributes, "NAS-IP-Address")
+	if nas == "" {
+		nas = firstValue(cdr.Attributes, "NAS-IPv6-Address")
+	}
+	if nas == "" {
+		nas = firstValue(cdr.Attributes, "NAS-Identifier")
+	}
+
+	statusType := firstValue(cdr.Attributes, "Acct-Status-Type")
+	if strings.EqualFold(statusType, "Accounting-On") || strings.EqualFold(statusType, "Accounting-Off") {
+		for _, closed := range c.closeNAS(nas, cdr.Received) {
+			c.emit(closed)
+		}
+		return true, nil
+	}
+
+	sessionId := firstValue(cdr.Attributes, "Acct-Session-Id")
+	if sessionId == "" || (statusType != "Start" && statusType != "Interim-Update" && statusType != "Stop") {
+		return true, nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	return c.add(nas, sessionId, statusType, cdr), nil
+}
+
+// Adds the record to its session. Returns true if the group of the session is closed, in which case the
+// CDR is replaced by the consolidated record
+func (c *correlator) add(nas string, sessionId string, statusType string, cdr *CDR) bool {
+	memberKey := nas + "/" + sessionId
+	if closedAt, found := c.closed[memberKey]; found && cdr.Received.Sub(closedAt) <= c.closedTTL {
+		return false
+	}
+
+	groupKey, found := c.members[memberKey]
+	if !found {
+		groupKey = "S/" + memberKey
+		if multiSessionId := firstValue(cdr.Attributes, "Acct-Multi-Session-Id"); multiSessionId != "" {
+			groupKey = "M/" + nas + "/" + multiSessionId
+		}
+		c.members[memberKey] = groupKey
+	}
+	group, found := c.groups[groupKey]
+	if !found {
+		group = &sessionGroup{nas: nas, sessions: make(map[string]*correlatedSession), attributes: make(map[string][]string)}
+		c.groups[groupKey] = group
+	}
+
+	sessionTime := cdr.Packet.GetIntAVP("Acct-Session-Time")
+	session, found := group.sessions[sessionId]
+	if !found {
+		session = &correlatedSession{
+			start:       cdr.Received.Add(-time.Duration(sessionTime) * time.Second),
+			sessionTime: sessionTime,
+			counters:    make([]uint64, len(correlatedCounters)),
+		}
+		group.sessions[sessionId] = session
+		group.sessionIds = append(group.sessionIds, sessionId)
+	} else {
+		// Retransmissions and records arriving late
+		if session.stopped || statusType == "Start" {
+			return false
+		}
+		if statusType == "Interim-Update" && sessionTime <= session.sessionTime {
+			return false
+		}
+		if sessionTime > session.sessionTime {
+			session.sessionTime = sessionTime
+		}
+	}
+
+	for i, counter := range correlatedCounters {
+		session.counters[i] = UpdateCounter(session.counters[i], cdr.Packet, counter.attribute, counter.gigawordsName)
+	}
+	for name, values := range cdr.Attributes {
+		group.attributes[name] = values
+	}
+	session.records++
+	group.lastPacket = cdr.Packet
+	group.lastSeen = cdr.Received
+
+	if statusType != "Stop" {
+		return false
+	}
+	session.stopped = true
+	for _, s := range group.sessions {
+		if !s.stopped {
+			return false
+		}
+	}
+
+	consolidated := c.closeGroup(groupKey, group, CLOSURE_STOP, cdr.Received)
+	cdr.Attributes = consolidated.Attributes
+	return true
+}
+
+// Removes the group and returns its consolidated record. To be invoked with the lock held
+func (c *correlator) closeGroup(groupKey string, group *sessionGroup, closure string, now time.Time) *CDR {
+	delete(c.groups, groupKey)
+	for _, sessionId := range group.sessionIds {
+		memberKey := group.nas + "/" + sessionId
+		delete(c.members, memberKey)
+		c.closed[memberKey] = now
+	}
+	return group.record(closure, now)
+}
+
+// Closes the sessions without records since the timeout, and forgets those closed long ago
+func (c *correlator) closeTimedOut(now time.Time) []*CDR {
+	c.Lock()
+	defer c.Unlock()
+
+	var cdrs []*CDR
+	for _, key := range c.sortedGroupKeys() {
+		if group := c.groups[key]; now.Sub(group.lastSeen) > c.timeout {
+			cdrs = append(cdrs, c.closeGroup(key, group, CLOSURE_TIMEOUT, now))
+		}
+	}
+
+	if now.Sub(c.lastPurge) > c.closedTTL {
+		for key, closedAt := range c.closed {
+			if now.Sub(closedAt) > c.closedTTL {
+				delete(c.closed, key)
+			}
+		}
+		c.lastPurge = now
+	}
+	return cdrs
+}
+
+// Closes the sessions of the NAS, which has restarted
+func (c *correlator) closeNAS(nas string, now time.Time) []*CDR {
+	c.Lock()
+	defer c.Unlock()
+
+	var cdrs []*CDR
+	for _, key := range c.sortedGroupKeys() {
+		if c.groups[key].nas == nas {
+			cdrs = append(cdrs, c.closeGroup(key, c.groups[key], CLOSURE_NAS_RESTART, now))
+		}
+	}
+	return cdrs
+}
+
+// So that the synthesized records are emitted in a predictable order
+func (c *correlator) sortedGroupKeys() []string {
+	keys := make([]string, 0, len(c.groups))
+	for key := range c.groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Returns the new value of a counter, given the previous one. The value in the packet is the lower 32 bits,
+// and the gigawords attribute, if specified and present, has the higher ones. A lower value is ignored,
+// unless it is a roll over, since it is assumed to be due to packets received out of order
+func UpdateCounter(previous uint64, packet *radiuscodec.RadiusPacket, name string, gigawordsName string) uint64 {
+	avp, err := packet.GetAVP(name)
+	if err != nil {
+		return previous
+	}
+
+	var delta uint64
+	var reset bool
+	if _, err := packet.GetAVP(gigawordsName); gigawordsName != "" && err == nil {
+		delta, _, reset = core.CounterDelta(previous, core.CombineGigawords(avp.GetInt(), packet.GetIntAVP(gigawordsName)), 64)
+	} else {
+		delta, _, reset = core.CounterDelta(previous&0xFFFFFFFF, uint64(uint32(avp.GetInt())), 32)
+	}
+
+	if reset {
+		return previous
+	}
+	return previous + delta
+}
+
+// Returns the first value of the attribute, or the empty string
+func firstValue(attributes map[string][]string, name string) string {
+	if values := attributes[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
@@ -0,0 +1,112 @@
+package cdr
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Serialization of the CDR by the writers. The format is specified in the "format" parameter of the writer
+//
+//   - "json" (default): one JSON object per line, with the reception time, the radius code or diameter
+//     command and the attributes
+//   - "csv": one line per CDR, with the values of the attributes in the "attributes" parameter, comma
+//     separated. The attributes with multiple values have them separated by MULTIVALUE_SEPARATOR
+//   - "livingston": as in the detail files of the Livingston radius server. The reception time, followed
+//     by one line per attribute value, indented with a tab, and an empty line
+type Formatter func(cdr *CDR) ([]byte, error)
+
+// Separator of the values of the same attribute in the CSV format
+const MULTIVALUE_SEPARATOR = ";"
+
+// Layout of the reception time in the livingston format
+const LIVINGSTON_TIME_LAYOUT = "Mon Jan _2 15:04:05 2006"
+
+// Contents of each line in the json format
+type jsonRecord struct {
+	Received   time.Time
+	Code       byte   `json:",omitempty"`
+	Command    string `json:",omitempty"`
+	Attributes map[string][]string
+}
+
+// Returns the formatter specified in the parameters of the writer, and the MIME type of the output
+func newFormatter(params map[string]string) (Formatter, string, error) {
+	switch params["format"] {
+	case "", "json":
+		return jsonFormatter, "application/json", nil
+
+	case "csv":
+		if params["attributes"] == "" {
+			return nil, "", fmt.Errorf("attributes not specified for csv format")
+		}
+		return newCSVFormatter(strings.Split(params["attributes"], ",")), "text/csv", nil
+
+	case "livingston":
+		return livingstonFormatter, "text/plain", nil
+
+	default:
+		return nil, "", fmt.Errorf("unknown CDR format %q", params["format"])
+	}
+}
+
+func jsonFormatter(cdr *CDR) ([]byte, error) {
+	record := jsonRecord{
+		Received:   cdr.Received,
+		Attributes: cdr.Attributes,
+	}
+	if cdr.Packet != nil {
+		record.Code = cdr.Packet.Code
+	} else if cdr.Message != nil {
+		record.Command = cdr.Message.CommandName
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+func newCSVFormatter(attributeNames []string) Formatter {
+	return func(cdr *CDR) ([]byte, error) {
+		fields := make([]string, len(attributeNames))
+		for i, attributeName := range attributeNames {
+			fields[i] = strings.Join(cdr.Attributes[attributeName], MULTIVALUE_SEPARATOR)
+		}
+
+		var buffer bytes.Buffer
+		w := csv.NewWriter(&buffer)
+		w.Write(fields)
+		w.Flush()
+		return buffer.Bytes(), w.Error()
+	}
+}
+
+func livingstonFormatter(cdr *CDR) ([]byte, error) {
+	names := make([]string, 0, len(cdr.Attributes))
+	for name := range cdr.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buffer bytes.Buffer
+	buffer.WriteString(cdr.Received.Format(LIVINGSTON_TIME_LAYOUT))
+	buffer.WriteString("\n")
+	for _, name := range names {
+		for _, value := range cdr.Attributes[name] {
+			// Numbers are not quoted
+			if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+				value = strconv.Quote(value)
+			}
+			fmt.Fprintf(&buffer, "\t%s = %s\n", name, value)
+		}
+	}
+	buffer.WriteString("\n")
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,326 @@
+package cdr
+
+import (
+	"errors"
+	"fmt"
+	"igor/config"
+	"igor/diamcodec"
+	"igor/instrumentation"
+	"igor/radiuscodec"
+	"sync"
+	"time"
+)
+
+// Asynchronous processing of accounting packets. The packets are submitted without blocking and go
+// through the configured stages (typically decode, dedup, correlate, enrich and transform) in order, and then to
+// all the writers. Each stage and writer has its own bounded queue and pool of workers. A slow writer
+// fills its queue and then blocks the previous stage, and so on, until the first queue is full and
+// the packets are rejected. The radius server then does not answer and the NAS retransmits later
+
+// Returned when the first queue of the pipeline is full
+var ErrPipelineFull = errors.New("CDR pipeline full")
+
+// Returned when a packet is submitted to a closed pipeline
+var ErrPipelineClosed = errors.New("CDR pipeline closed")
+
+// An accounting record going through the pipeline
+type CDR struct {
+	// The radius accounting packet
+	Packet *radiuscodec.RadiusPacket
+
+	// The diameter accounting request, if Packet is nil
+	Message *diamcodec.DiameterMessage
+
+	// Reception time
+	Received time.Time
+
+	// Attribute name to values. Filled by the decode stage and possibly modified by the next ones.
+	// The same CDR is passed to all the writers, which must not modify it
+	Attributes map[string][]string
+}
+
+// Returns the value of the attribute in the radius packet or diameter message
+func (cdr *CDR) getStringAttribute(name string) string {
+	if cdr.Packet != nil {
+		return cdr.Packet.GetStringAVP(name)
+	}
+	if cdr.Message != nil {
+		return cdr.Message.GetStringAVP(name)
+	}
+	return ""
+}
+
+// Queue and workers for a stage or writer
+type stageRunner struct {
+	name    string
+	queue   chan *CDR
+	workers int
+	process Stage
+
+	// Configuration instance of the pipeline, to label the metrics
+	instanceName string
+
+	// Set if the stage also produces CDR
+	emitter EmitterStage
+
+	// Invoked with the CDR processed successfully
+	next func(cdr *CDR)
+
+	wg sync.WaitGroup
+}
+
+// Takes CDR from the queue until it is closed
+func (r *stageRunner) work() {
+	defer r.wg.Done()
+
+	for cdr := range r.queue {
+		ok, err := r.process(cdr)
+		if err != nil {
+			config.GetLogger().Errorf("CDR stage %s error: %s", r.name, err)
+			instrumentation.PushCDRError(r.instanceName, r.name)
+			continue
+		}
+		if !ok {
+			instrumentation.PushCDRDropped(r.instanceName, r.name)
+			continue
+		}
+		instrumentation.PushCDRProcessed(r.instanceName, r.name)
+		if r.next != nil {
+			r.next(cdr)
+		}
+	}
+}
+
+// Starts the emitter, if any, and the workers
+func (r *stageRunner) start() {
+	if r.emitter != nil {
+		r.emitter.Start(r.next)
+	}
+	for i := 0; i < r.workers; i++ {
+		r.wg.Add(1)
+		go r.work()
+	}
+}
+
+// Creates the runner for the specified configuration, still not started
+func newStageRunner(instanceName string, conf config.CDRStageConfig, process Stage) *stageRunner {
+	workers := conf.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	queueSize := conf.QueueSize
+	if queueSize <= 0 {
+		queueSize = config.DEFAULT_CDR_QUEUE_SIZE
+	}
+	return &stageRunner{
+		name:         conf.StageName(),
+		queue:        make(chan *CDR, queueSize),
+		workers:      workers,
+		process:      process,
+		instanceName: instanceName,
+	}
+}
+
+// Set of stages and writers. Safe for concurrent use
+type Pipeline struct {
+	sync.RWMutex
+	closed bool
+
+	stages  []*stageRunner
+	writers []*stageRunner
+
+	// Implementations of the writers, to be closed
+	writerImpls []Writer
+}
+
+// Creates the pipeline as specified in the configuration and starts the workers. If there are
+// no stages, a decode stage with the default settings is used. At least one writer is required.
+// The metrics of the pipeline are labeled with the name of the configuration instance
+func NewPipeline(instanceName string, conf config.CDRPipelineConfig) (*Pipeline, error) {
+	if len(conf.Writers) == 0 {
+		return nil, errors.New("no writers in CDR pipeline")
+	}
+	stagesConf := conf.Stages
+	if len(stagesConf) == 0 {
+		stagesConf = []config.CDRStageConfig{{Type: "decode"}}
+	}
+
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	p := Pipeline{}
+	for _, stageConf := range stagesConf {
+		if emitterFactory, found := emitterStageFactories[stageConf.Type]; found {
+			emitter, err := emitterFactory(stageConf.Params)
+			if err != nil {
+				return nil, fmt.Errorf("could not create CDR stage %s: %w", stageConf.StageName(), err)
+			}
+			runner := newStageRunner(instanceName, stageConf, emitter.Process)
+			runner.emitter = emitter
+			p.stages = append(p.stages, runner)
+			continue
+		}
+		factory, found := stageFactories[stageConf.Type]
+		if !found {
+			return nil, fmt.Errorf("CDR stage %s not registered", stageConf.Type)
+		}
+		stage, err := factory(stageConf.Params)
+		if err != nil {
+			return nil, fmt.Errorf("could not create CDR stage %s: %w", stageConf.StageName(), err)
+		}
+		p.stages = append(p.stages, newStageRunner(instanceName, stageConf, stage))
+	}
+	for _, writerConf := range conf.Writers {
+		factory, found := writerFactories[writerConf.Type]
+		if !found {
+			p.closeWriterImpls()
+			return nil, fmt.Errorf("CDR writer %s not registered", writerConf.Type)
+		}
+		writer, err := factory(writerConf.Params)
+		if err != nil {
+			p.closeWriterImpls()
+			return nil, fmt.Errorf("could not create CDR writer %s: %w", writerConf.StageName(), err)
+		}
+		p.writerImpls = append(p.writerImpls, writer)
+		p.writers = append(p.writers, newStageRunner(instanceName, writerConf, func(cdr *CDR) (bool, error) {
+			return true, writer.Write(cdr)
+		}))
+	}
+
+	// Link the stages. Pushing to the next queue blocks if full
+	for i := 0; i < len(p.stages)-1; i++ {
+		nextQueue := p.stages[i+1].queue
+		p.stages[i].next = func(cdr *CDR) { nextQueue <- cdr }
+	}
+	p.stages[len(p.stages)-1].next = func(cdr *CDR) {
+		for _, writer := range p.writers {
+			writer.queue <- cdr
+		}
+	}
+
+	for _, runner := range p.runners() {
+		runner.start()
+	}
+
+	return &p, nil
+}
+
+// Queues the accounting packet for processing. Does not block. Returns ErrPipelineFull if
+// there is no room in the first queue. The packet is copied, since it may be released to the pool
+// before being processed
+func (p *Pipeline) Submit(packet *radiuscodec.RadiusPacket) error {
+	return p.submit(&CDR{Packet: packet.Copy(), Received: time.Now()})
+}
+
+// Queues the diameter accounting request for processing, as in Submit
+func (p *Pipeline) SubmitDiameter(message *diamcodec.DiameterMessage) error {
+	return p.submit(&CDR{Message: message, Received: time.Now()})
+}
+
+func (p *Pipeline) submit(cdr *CDR) error {
+	p.RLock()
+	defer p.RUnlock()
+
+	if p.closed {
+		return ErrPipelineClosed
+	}
+
+	first := p.stages[0]
+	select {
+	case first.queue <- cdr:
+		return nil
+	default:
+		instrumentation.PushCDRQueueFull(first.instanceName, first.name)
+		return ErrPipelineFull
+	}
+}
+
+// Returns the number of CDR waiting in the queue of each stage and writer
+func (p *Pipeline) QueueLengths() map[string]int {
+	lengths := make(map[string]int)
+	for _, runner := range p.runners() {
+		lengths[runner.name] = len(runner.queue)
+	}
+	return lengths
+}
+
+// Stops accepting packets, waits until the CDR already submitted have been written and closes
+// the writers
+func (p *Pipeline) Close() {
+	p.Lock()
+	if p.closed {
+		p.Unlock()
+		return
+	}
+	p.closed = true
+	p.Unlock()
+
+	// When the workers and the emitter of a stage finish, nothing more will be pushed to the next one
+	for _, runner := range p.runners() {
+		close(runner.queue)
+		runner.wg.Wait()
+		if runner.emitter != nil {
+			runner.emitter.Stop()
+		}
+	}
+	p.closeWriterImpls()
+}
+
+// Returns the stages followed by the writers
+func (p *Pipeline) runners() []*stageRunner {
+	runners := make([]*stageRunner, 0, len(p.stages)+len(p.writers))
+	runners = append(runners, p.stages...)
+	return append(runners, p.writers...)
+}
+
+func (p *Pipeline) closeWriterImpls() {
+	for _, writer := range p.writerImpls {
+		if err := writer.Close(); err != nil {
+			config.GetLogger().Errorf("error closing CDR writer: %s", err)
+		}
+	}
+}
+
+// Pipeline used by Write and WriteDiameter
+var defaultPipeline *Pipeline
+var defaultPipelineMutex sync.Mutex
+
+// Sets the pipeline used by Write and WriteDiameter, instead of the one created from the configuration
+func SetDefaultPipeline(p *Pipeline) {
+	defaultPipelineMutex.Lock()
+	defer defaultPipelineMutex.Unlock()
+	defaultPipeline = p
+}
+
+// Returns the default pipeline, creating it with the configuration of the policy instance if not yet set
+func getDefaultPipeline() (*Pipeline, error) {
+	defaultPipelineMutex.Lock()
+	defer defaultPipelineMutex.Unlock()
+
+	if defaultPipeline == nil {
+		p, err := NewPipeline(config.GetPolicyConfig().InstanceName(), config.GetPolicyConfig().CDRPipelineConf())
+		if err != nil {
+			return nil, err
+		}
+		defaultPipeline = p
+	}
+	return defaultPipeline, nil
+}
+
+// Submits the radius accounting packet to the default pipeline. To be used by the handlers
+func Write(packet *radiuscodec.RadiusPacket) error {
+	p, err := getDefaultPipeline()
+	if err != nil {
+		return err
+	}
+	return p.Submit(packet)
+}
+
+// Submits the diameter accounting request to the default pipeline. To be used by the handlers
+func WriteDiameter(message *diamcodec.DiameterMessage) error {
+	p, err := getDefaultPipeline()
+	if err != nil {
+		return err
+	}
+	return p.SubmitDiameter(message)
+}
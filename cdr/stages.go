@@ -0,0 +1,226 @@
+package cdr
+
+import (
+	"errors"
+	"fmt"
+	"igor/config"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Processes the CDR, possibly modifying it. Returns false if the CDR is to be filtered out.
+// Must be safe for concurrent use, since it is executed by all the workers of the stage
+type Stage func(cdr *CDR) (bool, error)
+
+// Creates a Stage with the parameters in the configuration
+type StageFactory func(params map[string]string) (Stage, error)
+
+// Stage that also produces CDR by itself, such as the closures of the sessions that time out
+type EmitterStage interface {
+	// Processes the CDR, as a Stage
+	Process(cdr *CDR) (bool, error)
+
+	// Invoked when the pipeline is started. The CDR produced are passed to emit, which sends them to
+	// the next stage and may block
+	Start(emit func(cdr *CDR))
+
+	// Invoked when the pipeline is closed, after the last CDR has been processed. No more CDR may be
+	// emitted when it returns
+	Stop()
+}
+
+// Creates an EmitterStage with the parameters in the configuration
+type EmitterStageFactory func(params map[string]string) (EmitterStage, error)
+
+// Final destination of the CDR. Must be safe for concurrent use
+type Writer interface {
+	Write(cdr *CDR) error
+
+	// Invoked when the pipeline is closed, after all the CDR have been written
+	Close() error
+}
+
+// Creates a Writer with the parameters in the configuration
+type WriterFactory func(params map[string]string) (Writer, error)
+
+var registryMutex sync.RWMutex
+var stageFactories = make(map[string]StageFactory)
+var emitterStageFactories = make(map[string]EmitterStageFactory)
+var writerFactories = make(map[string]WriterFactory)
+
+// Registers a stage type, to be referenced in the configuration. Panics if the name is already used
+func RegisterStage(name string, factory StageFactory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if factory == nil {
+		panic("nil CDR stage " + name)
+	}
+	if isStageRegistered(name) {
+		panic("CDR stage " + name + " already registered")
+	}
+	stageFactories[name] = factory
+}
+
+// Registers a stage type that produces CDR, as in RegisterStage
+func RegisterEmitterStage(name string, factory EmitterStageFactory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if factory == nil {
+		panic("nil CDR stage " + name)
+	}
+	if isStageRegistered(name) {
+		panic("CDR stage " + name + " already registered")
+	}
+	emitterStageFactories[name] = factory
+}
+
+// Stages of both kinds share the names. To be invoked with the registry locked
+func isStageRegistered(name string) bool {
+	_, found := stageFactories[name]
+	_, emitterFound := emitterStageFactories[name]
+	return found || emitterFound
+}
+
+// Registers a writer type, to be referenced in the configuration. Panics if the name is already used
+func RegisterWriter(name string, factory WriterFactory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if factory == nil {
+		panic("nil CDR writer " + name)
+	}
+	if _, found := writerFactories[name]; found {
+		panic("CDR writer " + name + " already registered")
+	}
+	writerFactories[name] = factory
+}
+
+func init() {
+	RegisterStage("decode", func(params map[string]string) (Stage, error) { return decodeStage, nil })
+	RegisterStage("dedup", newDedupStage)
+	RegisterEmitterStage("correlate", newCorrelationStage)
+	RegisterStage("enrich", newEnrichStage)
+}
+
+// Fills the attributes of the CDR with the contents of the radius packet or diameter message
+func decodeStage(cdr *CDR) (bool, error) {
+	cdr.Attributes = make(map[string][]string)
+	switch {
+	case cdr.Packet != nil:
+		for _, avp := range cdr.Packet.AVPs {
+			cdr.Attributes[avp.Name] = append(cdr.Attributes[avp.Name], avp.GetString())
+		}
+	case cdr.Message != nil:
+		for _, avp := range cdr.Message.AVPs {
+			cdr.Attributes[avp.Name] = append(cdr.Attributes[avp.Name], avp.GetString())
+		}
+	default:
+		return false, errors.New("CDR without packet")
+	}
+	return true, nil
+}
+
+// Attributes used by default to identify duplicated accounting packets
+const DEFAULT_DEDUP_ATTRIBUTES = "NAS-IP-Address,Acct-Session-Id,Acct-Status-Type,Acct-Session-Time"
+
+// Filters out the CDR whose values of the specified attributes have already been seen in the
+// last windowSeconds (60 by default), such as the retransmissions of the NAS
+func newDedupStage(params map[string]string) (Stage, error) {
+	window := 60 * time.Second
+	if w, found := params["windowSeconds"]; found {
+		seconds, err := strconv.Atoi(w)
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("bad windowSeconds %q", w)
+		}
+		window = time.Duration(seconds) * time.Second
+	}
+	attributesParam := DEFAULT_DEDUP_ATTRIBUTES
+	if a, found := params["attributes"]; found {
+		attributesParam = a
+	}
+	attributeNames := strings.Split(attributesParam, ",")
+
+	var mutex sync.Mutex
+	seen := make(map[string]time.Time)
+	lastPurge := time.Now()
+
+	return func(cdr *CDR) (bool, error) {
+		var sb strings.Builder
+		for _, attributeName := range attributeNames {
+			sb.WriteString(attributeName)
+			sb.WriteString("=")
+			sb.WriteString(cdr.getStringAttribute(attributeName))
+			sb.WriteString("/")
+		}
+		key := sb.String()
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		now := time.Now()
+		if now.Sub(lastPurge) > window {
+			for k, t := range seen {
+				if now.Sub(t) > window {
+					delete(seen, k)
+				}
+			}
+			lastPurge = now
+		}
+
+		if t, found := seen[key]; found && now.Sub(t) <= window {
+			return false, nil
+		}
+		seen[key] = now
+		return true, nil
+	}, nil
+}
+
+// Adds to the CDR the billing tags of the roaming partner that sent the request, as attributes. The partners
+// are those of the configuration instance in the "instance" parameter, or of the default one, and are taken
+// on each CDR, so that reloads of the configuration are applied. Diameter partners are identified by the
+// Origin-Realm and Origin-Host, and radius partners by the realm of the User-Name and the NAS-Identifier
+func newEnrichStage(params map[string]string) (Stage, error) {
+	var ci *config.PolicyConfigurationManager
+	if instanceName, found := params["instance"]; found {
+		var ciFound bool
+		if ci, ciFound = config.FindPolicyConfigInstance(instanceName); !ciFound {
+			return nil, fmt.Errorf("configuration instance %q not found", instanceName)
+		}
+	} else {
+		if !config.HasPolicyConfig() {
+			return nil, errors.New("configuration not initialized")
+		}
+		ci = config.GetPolicyConfig()
+	}
+
+	return func(cdr *CDR) (bool, error) {
+		var realm, peer string
+		switch {
+		case cdr.Message != nil:
+			realm = cdr.Message.GetStringAVP("Origin-Realm")
+			peer = cdr.Message.GetStringAVP("Origin-Host")
+		case cdr.Packet != nil:
+			realms := ci.RadiusRealmsConf()
+			realm = realms.ParseUserName(cdr.Packet.GetStringAVP("User-Name")).Realm
+			peer = cdr.Packet.GetStringAVP("NAS-Identifier")
+		default:
+			return false, errors.New("CDR without packet")
+		}
+
+		partner, found := ci.RoamingPartnersConf().FindRoamingPartner(realm, peer)
+		if !found || len(partner.BillingTags) == 0 {
+			return true, nil
+		}
+		if cdr.Attributes == nil {
+			cdr.Attributes = make(map[string][]string)
+		}
+		for tag, value := range partner.BillingTags {
+			cdr.Attributes[tag] = []string{value}
+		}
+		return true, nil
+	}, nil
+}
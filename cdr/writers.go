@@ -0,0 +1,273 @@
+package cdr
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Writers included. All of them serialize the CDR in the format specified in the parameters
+//
+//   - "file": appends to the file in the "path" parameter. If "rotateBytes" or "rotateSeconds" are
+//     specified, the file is renamed with a timestamp suffix when it reaches that size or age, and a new
+//     one is created
+//   - "http": posts each CDR to the "url" parameter, with a timeout of "timeoutMillis"
+//   - "kafka": publishes each CDR to the "topic" in the "brokers" (comma separated), using as key the value
+//     of the attribute in the "key" parameter (Acct-Session-Id by default), so that the CDR of the same
+//     session go to the same partition
+
+func init() {
+	RegisterWriter("file", newFileWriter)
+	RegisterWriter("http", newHTTPWriter)
+	RegisterWriter("kafka", newKafkaWriter)
+}
+
+// Defaults for the writers
+const (
+	DEFAULT_HTTP_WRITER_TIMEOUT_MILLIS = 5000
+	DEFAULT_KAFKA_KEY_ATTRIBUTE        = "Acct-Session-Id"
+)
+
+// Layout of the suffix of the rotated files
+const ROTATION_SUFFIX_LAYOUT = "20060102T150405"
+
+// Returns the value of the parameter as a positive integer, or zero if not specified
+func positiveIntParam(params map[string]string, name string) (int64, error) {
+	p, found := params[name]
+	if !found {
+		return 0, nil
+	}
+	value, err := strconv.ParseInt(p, 10, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("bad %s %q", name, p)
+	}
+	return value, nil
+}
+
+// Writes the CDR to a local file, with rotation
+type fileWriter struct {
+	sync.Mutex
+	path   string
+	format Formatter
+
+	// Rotation thresholds. Zero if not used
+	rotateBytes int64
+	rotateAge   time.Duration
+
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func newFileWriter(params map[string]string) (Writer, error) {
+	path := params["path"]
+	if path == "" {
+		return nil, errors.New("path not specified for file writer")
+	}
+	format, _, err := newFormatter(params)
+	if err != nil {
+		return nil, err
+	}
+	rotateBytes, err := positiveIntParam(params, "rotateBytes")
+	if err != nil {
+		return nil, err
+	}
+	rotateSeconds, err := positiveIntParam(params, "rotateSeconds")
+	if err != nil {
+		return nil, err
+	}
+
+	fw := fileWriter{
+		path:        path,
+		format:      format,
+		rotateBytes: rotateBytes,
+		rotateAge:   time.Duration(rotateSeconds) * time.Second,
+	}
+	if err := fw.open(); err != nil {
+		return nil, err
+	}
+	return &fw, nil
+}
+
+// Opens the file for appending
+func (fw *fileWriter) open() error {
+	file, err := os.OpenFile(fw.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	fw.file = file
+	fw.size = info.Size()
+	fw.openedAt = time.Now()
+	return nil
+}
+
+// Renames the current file with the timestamp suffix, adding a sequence number if already used, and opens a new one
+func (fw *fileWriter) rotate() error {
+	if err := fw.file.Close(); err != nil {
+		return err
+	}
+
+	rotatedPath := fw.path + "." + time.Now().Format(ROTATION_SUFFIX_LAYOUT)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotatedPath); os.IsNotExist(err) {
+			break
+		}
+		rotatedPath = fmt.Sprintf("%s.%s.%d", fw.path, time.Now().Format(ROTATION_SUFFIX_LAYOUT), i)
+	}
+	if err := os.Rename(fw.path, rotatedPath); err != nil {
+		return err
+	}
+
+	return fw.open()
+}
+
+func (fw *fileWriter) Write(cdr *CDR) error {
+	record, err := fw.format(cdr)
+	if err != nil {
+		return err
+	}
+
+	fw.Lock()
+	defer fw.Unlock()
+
+	if fw.size > 0 && ((fw.rotateBytes > 0 && fw.size+int64(len(record)) > fw.rotateBytes) ||
+		(fw.rotateAge > 0 && time.Since(fw.openedAt) >= fw.rotateAge)) {
+		if err := fw.rotate(); err != nil {
+			return fmt.Errorf("could not rotate %s: %w", fw.path, err)
+		}
+	}
+
+	n, err := fw.file.Write(record)
+	fw.size += int64(n)
+	return err
+}
+
+func (fw *fileWriter) Close() error {
+	fw.Lock()
+	defer fw.Unlock()
+	return fw.file.Close()
+}
+
+// Posts the CDR to an HTTP endpoint
+type httpWriter struct {
+	url         string
+	format      Formatter
+	contentType string
+	client      http.Client
+}
+
+func newHTTPWriter(params map[string]string) (Writer, error) {
+	url := params["url"]
+	if url == "" {
+		return nil, errors.New("url not specified for http writer")
+	}
+	format, contentType, err := newFormatter(params)
+	if err != nil {
+		return nil, err
+	}
+	timeoutMillis, err := positiveIntParam(params, "timeoutMillis")
+	if err != nil {
+		return nil, err
+	}
+	if timeoutMillis == 0 {
+		timeoutMillis = DEFAULT_HTTP_WRITER_TIMEOUT_MILLIS
+	}
+
+	return &httpWriter{
+		url:         url,
+		format:      format,
+		contentType: contentType,
+		client: http.Client{
+			Timeout:   time.Duration(timeoutMillis) * time.Millisecond,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		},
+	}, nil
+}
+
+func (hw *httpWriter) Write(cdr *CDR) error {
+	record, err := hw.format(cdr)
+	if err != nil {
+		return err
+	}
+
+	resp, err := hw.client.Post(hw.url, hw.contentType, bytes.NewReader(record))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned status %d", hw.url, resp.StatusCode)
+	}
+	return nil
+}
+
+func (hw *httpWriter) Close() error {
+	hw.client.CloseIdleConnections()
+	return nil
+}
+
+// Publishes the CDR to a Kafka topic
+type kafkaWriter struct {
+	keyAttribute string
+	format       Formatter
+	writer       *kafka.Writer
+}
+
+func newKafkaWriter(params map[string]string) (Writer, error) {
+	if params["brokers"] == "" || params["topic"] == "" {
+		return nil, errors.New("brokers and topic must be specified for kafka writer")
+	}
+	format, _, err := newFormatter(params)
+	if err != nil {
+		return nil, err
+	}
+	keyAttribute := params["key"]
+	if keyAttribute == "" {
+		keyAttribute = DEFAULT_KAFKA_KEY_ATTRIBUTE
+	}
+
+	return &kafkaWriter{
+		keyAttribute: keyAttribute,
+		format:       format,
+		writer: &kafka.Writer{
+			Addr:     kafka.TCP(strings.Split(params["brokers"], ",")...),
+			Topic:    params["topic"],
+			Balancer: &kafka.Hash{},
+			// Writes are synchronous, so that errors are reported. Do not wait for more messages in the batch
+			BatchTimeout: 10 * time.Millisecond,
+		},
+	}, nil
+}
+
+func (kw *kafkaWriter) Write(cdr *CDR) error {
+	record, err := kw.format(cdr)
+	if err != nil {
+		return err
+	}
+
+	var key []byte
+	if values := cdr.Attributes[kw.keyAttribute]; len(values) > 0 {
+		key = []byte(values[0])
+	}
+	return kw.writer.WriteMessages(context.Background(), kafka.Message{Key: key, Value: record})
+}
+
+func (kw *kafkaWriter) Close() error {
+	return kw.writer.Close()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"igor/config"
+	"igor/conformance"
+	"os"
+	"time"
+)
+
+// Runs the conformance checks against a remote diameter peer and/or radius server and writes
+// the report to the standard output. Exits with status 1 if any check failed
+func main() {
+
+	bootPtr := flag.String("boot", "resources/searchRules.json", "File or http URL with Configuration Search Rules")
+	instancePtr := flag.String("instance", "", "Name of instance, used for the dictionaries and the diameter identity")
+	diameterPtr := flag.String("diameter", "", "IPAddress:Port of the diameter peer to check")
+	watchdogPtr := flag.Int("watchdog", 0, "If not zero, seconds to wait for a DWR from the diameter peer")
+	radiusPtr := flag.String("radius", "", "IPAddress:Port of the radius server to check")
+	secretPtr := flag.String("secret", "secret", "Radius shared secret")
+	userPtr := flag.String("user", "igorconform", "User-Name for the radius requests")
+	passwordPtr := flag.String("password", "igorconform", "User-Password for the radius requests")
+	timeoutPtr := flag.Int("timeout", 2000, "Milliseconds to wait for each answer")
+	jsonPtr := flag.Bool("json", false, "Write the report as JSON")
+
+	flag.Parse()
+
+	if *diameterPtr == "" && *radiusPtr == "" {
+		fmt.Fprintln(os.Stderr, "at least one of -diameter or -radius must be specified")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ci := config.InitPolicyConfigInstance(*bootPtr, *instancePtr, true)
+	timeout := time.Duration(*timeoutPtr) * time.Millisecond
+
+	var reports []conformance.Report
+	if *diameterPtr != "" {
+		target := conformance.DiameterTarget{
+			Address:          *diameterPtr,
+			OriginHost:       ci.DiameterServerConf().DiameterHost,
+			OriginRealm:      ci.DiameterServerConf().DiameterRealm,
+			Timeout:          timeout,
+			WatchdogInterval: time.Duration(*watchdogPtr) * time.Second,
+		}
+		reports = append(reports, conformance.Run("diameter", *diameterPtr, conformance.DiameterChecks(target)))
+	}
+	if *radiusPtr != "" {
+		target := conformance.RadiusTarget{
+			Address:  *radiusPtr,
+			Secret:   *secretPtr,
+			Timeout:  timeout,
+			UserName: *userPtr,
+			Password: *passwordPtr,
+		}
+		reports = append(reports, conformance.Run("radius", *radiusPtr, conformance.RadiusChecks(target)))
+	}
+
+	failures := 0
+	for _, report := range reports {
+		var err error
+		if *jsonPtr {
+			err = report.WriteJSON(os.Stdout)
+		} else {
+			err = report.WriteText(os.Stdout)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not write report: %s\n", err)
+			os.Exit(2)
+		}
+		failures += report.Failures()
+	}
+
+	if failures > 0 {
+		os.Exit(1)
+	}
+}
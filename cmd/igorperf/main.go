@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"igor/config"
+	"igor/diameterclient"
+	"igor/perf"
+	radiusClient "igor/radiusclient"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Generates a mix of radius and diameter traffic against a radius server and/or diameter peer and writes
+// the report to the standard output. The generation is stopped early with Ctrl-C. Exits with status 1 if any
+// request failed
+func main() {
+
+	bootPtr := flag.String("boot", "resources/searchRules.json", "File or http URL with Configuration Search Rules")
+	instancePtr := flag.String("instance", "", "Name of instance, used for the dictionaries and the diameter identity")
+	radiusPtr := flag.String("radius", "", "IPAddress:Port of the radius server for the access requests")
+	radiusAcctPtr := flag.String("radiusacct", "", "IPAddress:Port of the radius server for the accounting requests, if different")
+	secretPtr := flag.String("secret", "secret", "Radius shared secret")
+	diameterPtr := flag.String("diameter", "", "IPAddress:Port of the diameter peer")
+	diameterHostPtr := flag.String("diameterhost", "", "Diameter-Host of the diameter peer")
+	realmPtr := flag.String("realm", "", "Destination-Realm of the diameter requests. If empty, the realm of the diameter peer")
+	userPtr := flag.String("user", "igorperf", "Prefix of the User-Name of the requests")
+	passwordPtr := flag.String("password", "igorperf", "User-Password for the radius requests")
+	accessPtr := flag.Int("access", 1, "Weight of Access-Requests in the mix")
+	accountingPtr := flag.Int("accounting", 1, "Weight of Accounting-Requests in the mix")
+	ccrPtr := flag.Int("ccr", 1, "Weight of Credit-Control-Requests in the mix")
+	ratePtr := flag.Float64("rate", 100, "Requests per second")
+	rampUpPtr := flag.Int("rampup", 0, "Seconds for reaching the rate, included in the duration")
+	durationPtr := flag.Int("duration", 10, "Seconds of traffic generation")
+	concurrencyPtr := flag.Int("concurrency", perf.DEFAULT_CONCURRENCY, "Maximum number of outstanding requests")
+	timeoutPtr := flag.Int("timeout", 2000, "Milliseconds to wait for each answer")
+	jsonPtr := flag.Bool("json", false, "Write the report as JSON")
+
+	flag.Parse()
+
+	if *diameterPtr == "" && *radiusPtr == "" {
+		fmt.Fprintln(os.Stderr, "at least one of -diameter or -radius must be specified")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *diameterPtr != "" && *diameterHostPtr == "" {
+		fmt.Fprintln(os.Stderr, "-diameterhost must be specified for the diameter peer")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ci := config.InitPolicyConfigInstance(*bootPtr, *instancePtr, true)
+	timeout := time.Duration(*timeoutPtr) * time.Millisecond
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	var scenarios []perf.Scenario
+	if *radiusPtr != "" {
+		client, err := radiusClient.NewClient(ci, radiusClient.ClientOptions{Timeout: timeout})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not create radius client: %s\n", err)
+			os.Exit(2)
+		}
+		defer client.Close()
+
+		target := perf.RadiusTarget{
+			Client:             client,
+			Endpoint:           *radiusPtr,
+			AccountingEndpoint: *radiusAcctPtr,
+			Secret:             *secretPtr,
+			UserPrefix:         *userPtr,
+			Password:           *passwordPtr,
+		}
+		scenarios = append(scenarios, target.AccessRequestScenario(*accessPtr), target.AccountingScenario(*accountingPtr))
+	}
+	if *diameterPtr != "" {
+		peer, err := peerConfig(*diameterPtr, *diameterHostPtr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "bad diameter peer: %s\n", err)
+			os.Exit(2)
+		}
+		client, err := diameterclient.NewClient(*instancePtr, diameterclient.ClientOptions{Peers: []config.DiameterPeer{peer}, Timeout: timeout})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not create diameter client: %s\n", err)
+			os.Exit(2)
+		}
+		defer client.Close()
+
+		waitCtx, waitCancel := context.WithTimeout(ctx, 10*time.Second)
+		err = client.WaitForPeers(waitCtx)
+		waitCancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "diameter peer not engaged: %s\n", err)
+			os.Exit(2)
+		}
+
+		realm := *realmPtr
+		if realm == "" {
+			realm = realmOf(peer.DiameterHost)
+		}
+		target := perf.DiameterTarget{
+			Client:           client,
+			CI:               ci,
+			DestinationRealm: realm,
+			UserPrefix:       *userPtr,
+		}
+		scenarios = append(scenarios, target.CreditControlScenario(*ccrPtr))
+	}
+
+	options := perf.Options{
+		Rate:        *ratePtr,
+		RampUp:      time.Duration(*rampUpPtr) * time.Second,
+		Duration:    time.Duration(*durationPtr) * time.Second,
+		Concurrency: *concurrencyPtr,
+		Timeout:     timeout,
+	}
+	report, err := perf.Run(ctx, options, scenarios)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not generate traffic: %s\n", err)
+		os.Exit(2)
+	}
+
+	if *jsonPtr {
+		err = report.WriteJSON(os.Stdout)
+	} else {
+		err = report.WriteText(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not write report: %s\n", err)
+		os.Exit(2)
+	}
+
+	if report.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// Returns the configuration of the diameter peer to connect to
+func peerConfig(address string, diameterHost string) (config.DiameterPeer, error) {
+	ipAddress, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return config.DiameterPeer{}, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return config.DiameterPeer{}, err
+	}
+	return config.DiameterPeer{
+		DiameterHost:           diameterHost,
+		IPAddress:              ipAddress,
+		Port:                   port,
+		ConnectionPolicy:       "active",
+		WatchdogIntervalMillis: 30000,
+		OriginNetwork:          "0.0.0.0/0",
+	}, nil
+}
+
+// Returns the realm of the Diameter-Host, which is the part after the first dot
+func realmOf(diameterHost string) string {
+	if i := strings.Index(diameterHost, "."); i >= 0 {
+		return diameterHost[i+1:]
+	}
+	return diameterHost
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"igor/config"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Manages the encrypted secrets files. Reads the JSON object with the names and values of the secrets from
+// the standard input and writes the encrypted file to the standard output, or the reverse with -decrypt.
+// The master key is taken from the environment variable specified, and may be generated with -genkey
+func main() {
+
+	keyVariablePtr := flag.String("key", config.DEFAULT_SECRETS_KEY_VARIABLE, "Environment variable with the base64 encoded master key")
+	decryptPtr := flag.Bool("decrypt", false, "Decrypt the secrets file instead of encrypting")
+	genKeyPtr := flag.Bool("genkey", false, "Write a new random master key, base64 encoded")
+
+	flag.Parse()
+
+	if *genKeyPtr {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			fail("could not generate key: %s", err)
+		}
+		fmt.Println(base64.StdEncoding.EncodeToString(key))
+		return
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(os.Getenv(*keyVariablePtr)))
+	if err != nil || len(key) == 0 {
+		fail("environment variable %s does not contain a base64 encoded key", *keyVariablePtr)
+	}
+
+	input, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		fail("could not read input: %s", err)
+	}
+
+	if *decryptPtr {
+		secrets, err := config.DecryptSecrets(input, key)
+		if err != nil {
+			fail("%s", err)
+		}
+		output, _ := json.MarshalIndent(secrets, "", "  ")
+		fmt.Println(string(output))
+		return
+	}
+
+	var secrets map[string]string
+	if err := json.Unmarshal(input, &secrets); err != nil {
+		fail("input is not a JSON object with string values: %s", err)
+	}
+	encrypted, err := config.EncryptSecrets(secrets, key)
+	if err != nil {
+		fail("%s", err)
+	}
+	fmt.Println(string(encrypted))
+}
+
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(2)
+}
@@ -60,6 +60,9 @@ type ConfigurationManager struct {
 	// inFlight contains a map of object names to Once objects that will retrieve the object
 	// from the remote and store in cache.
 	inFlight sync.Map
+
+	// Watcher of the mounted Kubernetes ConfigMaps and Secrets, if any
+	volumeWatcher *volumeWatcher
 }
 
 // Creates and initializes a ConfigurationManager
@@ -76,6 +79,11 @@ func NewConfigurationManager(bootstrapFile string, instanceName string) Configur
 	return cm
 }
 
+// Returns the name of the instance whose configuration is managed
+func (c *ConfigurationManager) InstanceName() string {
+	return c.instanceName
+}
+
 // Reads the bootstrap file and fills the search rules for the Configuration Manager
 // To be called upon instantiation
 func (c *ConfigurationManager) fillSearchRules(bootstrapFile string) {
@@ -203,6 +211,9 @@ func (c *ConfigurationManager) readConfigObject(objectName string) (ConfigObject
 		objectLocation = base + c.instanceName + "/" + innerName
 		object, err := c.readResource(objectLocation)
 		if err == nil {
+			if object, err = c.resolveSecrets(objectName, object); err != nil {
+				return configObject, err
+			}
 			return newConfigObjectFromBytes(object), nil
 		}
 	}
@@ -211,16 +222,26 @@ func (c *ConfigurationManager) readConfigObject(objectName string) (ConfigObject
 	objectLocation = base + innerName
 	object, err := c.readResource(objectLocation)
 	if err == nil {
-		configObject = newConfigObjectFromBytes(object)
+		if object, err = c.resolveSecrets(objectName, object); err == nil {
+			configObject = newConfigObjectFromBytes(object)
+		}
 	}
 
 	return configObject, err
 }
 
 // Reads the configuration item from the specified location, which may be
-// a file or an http url
+// a file, an http url, a mounted Kubernetes volume or an environment variable
 func (c *ConfigurationManager) readResource(location string) ([]byte, error) {
 
+	if strings.HasPrefix(location, KUBERNETES_PREFIX) {
+		return readKubernetesResource(location)
+	}
+
+	if strings.HasPrefix(location, ENVIRONMENT_PREFIX) {
+		return readEnvironmentResource(location)
+	}
+
 	if strings.HasPrefix(location, "http") {
 
 		// Location is a http URL
@@ -1,10 +1,20 @@
 package config
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"sync"
 	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
 )
 
 func httpServer() {
@@ -91,12 +101,53 @@ func TestDiamConfig(t *testing.T) {
 		t.Fatal(`Rule not found for {"realm": "igorsuperserver", "applicationId": "*", "peers": ["superserver.igorsuperserver"], "policy": "fixed"}`)
 	}
 	// Using the helper function
-	rule, _ := rr.FindDiameterRoute("igorsuperserver", "Sp", false)
+	rule, _ := rr.FindDiameterRoute("igorsuperserver", "Sp", false, nil)
 	if rule.Realm != "igorsuperserver" || rule.ApplicationId != "*" {
 		t.Fatal(`Rule not found for realm "igorsuperserver" and applicaton "Sp"`)
 	}
 }
 
+func TestDiameterRouteAVPConditions(t *testing.T) {
+	var rr DiameterRoutingRules
+	for i, conditions := range [][]string{{"Subscription-Id.Subscription-Id-Data matches ^34", "3GPP-SGSN-MCC-MNC == 21401"}, {"3GPP-SGSN-MCC-MNC != 21401"}, nil} {
+		rule := DiameterRoutingRule{Realm: "*", ApplicationId: "Gx", Peers: []string{string(rune('a' + i))}}
+		for _, condition := range conditions {
+			c, err := parseAVPCondition(condition)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rule.conditions = append(rule.conditions, c)
+		}
+		rr = append(rr, rule)
+	}
+
+	avpValues := func(values map[string]string) AVPValueFunc {
+		return func(avpName string) (string, bool) {
+			value, found := values[avpName]
+			return value, found
+		}
+	}
+	expected := map[string]map[string]string{
+		"a": {"Subscription-Id.Subscription-Id-Data": "34600000001", "3GPP-SGSN-MCC-MNC": "21401"},
+		"b": {"Subscription-Id.Subscription-Id-Data": "34600000001", "3GPP-SGSN-MCC-MNC": "21407"},
+		"c": {"Subscription-Id.Subscription-Id-Data": "33600000001"},
+	}
+	for peer, values := range expected {
+		if rule, err := rr.FindDiameterRoute("igor", "Gx", false, avpValues(values)); err != nil || rule.Peers[0] != peer {
+			t.Errorf("bad route for %v: %v %v", values, rule.Peers, err)
+		}
+	}
+	if rule, _ := rr.FindDiameterRoute("igor", "Gx", false, nil); rule.Peers[0] != "c" {
+		t.Errorf("rule with conditions applied without AVPs")
+	}
+
+	for _, bad := range []string{"Session-Id", "Session-Id = 1", "Session-Id matches ("} {
+		if _, err := parseAVPCondition(bad); err == nil {
+			t.Errorf("bad condition %q was parsed", bad)
+		}
+	}
+}
+
 func TestRadiusConfig(t *testing.T) {
 	// Radius Server Configuration
 	dsc := GetPolicyConfig().RadiusServerConf()
@@ -129,6 +180,65 @@ func TestRadiusConfig(t *testing.T) {
 	}
 }
 
+func TestRoamingPartnersConfig(t *testing.T) {
+	rp := GetPolicyConfig().RoamingPartnersConf()
+
+	partner, found := rp.FindRoamingPartner("partner1.com", "")
+	if !found {
+		t.Fatal("partner not found for realm partner1.com")
+	}
+	if partner.RateLimit != 100 || partner.BillingTags["partnerCode"] != "P1" {
+		t.Errorf("unexpected partner configuration %v", partner)
+	}
+	if _, found := rp.FindRoamingPartner("other.com", "dra.partner1.com"); !found {
+		t.Error("partner not found for peer dra.partner1.com")
+	}
+	if _, found := rp.FindRoamingPartner("other.com", "other.host"); found {
+		t.Error("found partner for unknown realm and peer")
+	}
+	if !partner.IsApplicationAllowed("Gx") || partner.IsApplicationAllowed("Gy") {
+		t.Error("allowed applications not as expected")
+	}
+}
+
+func TestRadiusRealms(t *testing.T) {
+	rr := RadiusRealms{
+		SuffixDelimiters: "@%",
+		PrefixDelimiters: "/",
+		Realms: []RadiusRealm{
+			{Name: "*.example.com", ServerGroup: "wildcard"},
+			{Name: "*.sub.example.com", ServerGroup: "longest"},
+			{Name: "exact.sub.example.com", ServerGroup: "exact"},
+			{Name: "NULL", ServerGroup: "null"},
+			{Name: "DEFAULT", ServerGroup: "default"},
+		},
+	}
+
+	userName := rr.ParseUserName("user@host%realm.com")
+	if userName.User != "user@host" || userName.Realm != "realm.com" || userName.WithRealm("other.com") != "user@host%other.com" {
+		t.Errorf("bad suffix realm %v", userName)
+	}
+	userName = rr.ParseUserName("realm.com/user/x")
+	if userName.User != "user/x" || userName.Realm != "realm.com" || !userName.IsPrefix || userName.WithRealm("") != "user/x" {
+		t.Errorf("bad prefix realm %v", userName)
+	}
+	if userName = rr.ParseUserName("user"); userName.Realm != "" || userName.WithRealm("other.com") != "user" {
+		t.Errorf("bad User-Name without realm %v", userName)
+	}
+
+	for realm, serverGroup := range map[string]string{
+		"Exact.Sub.Example.com": "exact",
+		"other.sub.example.com": "longest",
+		"a.example.com":         "wildcard",
+		"example.com":           "default",
+		"":                      "null",
+	} {
+		if r, found := rr.FindRealm(realm); !found || r.ServerGroup != serverGroup {
+			t.Errorf("realm %s found %s instead of %s", realm, r.ServerGroup, serverGroup)
+		}
+	}
+}
+
 func TestHandlerConfig(t *testing.T) {
 	hc := GetHandlerConfig().HandlerConf()
 	if hc.BindAddress != "0.0.0.0" {
@@ -145,6 +255,97 @@ func TestHandlerConfig(t *testing.T) {
 	}
 }
 
+func TestTraceBuffer(t *testing.T) {
+
+	// Disabled
+	var disabled *TraceBuffer = NewTraceBuffer(TraceConfig{}, "disabled")
+	if disabled != nil {
+		t.Fatal("trace buffer created with tracing disabled")
+	}
+	disabled.Tracef("event")
+	if disabled.Finish(errors.New("error")) {
+		t.Error("disabled trace written")
+	}
+
+	// Written only on error
+	onError := NewTraceBuffer(TraceConfig{OnError: true}, "request %d", 1)
+	onError.Tracef("event %d", 1)
+	if onError.Finish(nil) {
+		t.Error("trace written without error")
+	}
+	onError = NewTraceBuffer(TraceConfig{OnError: true}, "request %d", 2)
+	for i := 0; i < MAX_TRACE_ENTRIES+10; i++ {
+		onError.Tracef("event %d", i)
+	}
+	if !onError.Finish(errors.New("error")) {
+		t.Error("trace not written on error")
+	}
+	if onError.discarded != 10 {
+		t.Errorf("discarded %d events", onError.discarded)
+	}
+
+	// Written if slow
+	slow := NewTraceBuffer(TraceConfig{LatencyThresholdMillis: 50}, "slow request")
+	time.Sleep(60 * time.Millisecond)
+	if !slow.Finish(nil) {
+		t.Error("trace of slow request not written")
+	}
+
+	// Sampled
+	var written int
+	for i := 0; i < 10; i++ {
+		if NewTraceBuffer(TraceConfig{SampleEvery: 5}, "sampled request").Finish(nil) {
+			written++
+		}
+	}
+	if written != 2 {
+		t.Errorf("%d sampled traces written", written)
+	}
+
+	// Not created for the requests that are not sampled, if only sampling is enabled
+	var created int
+	for i := 0; i < 10; i++ {
+		if NewTraceBuffer(TraceConfig{SampleEvery: 5}, "sampled request") != nil {
+			created++
+		}
+	}
+	if created != 2 {
+		t.Errorf("%d trace buffers created for sampled requests", created)
+	}
+}
+
+func TestSubsystemLogLevels(t *testing.T) {
+	previousLevel := GetLogLevel()
+	defer SetLogLevel(previousLevel)
+
+	debugEnabled := func(subsystem string) bool {
+		return GetSubsystemLogger(subsystem).Desugar().Core().Enabled(zapcore.DebugLevel)
+	}
+
+	// The level of diampeer is configured in logging.json, and router follows the global level
+	if GetSubsystemLogLevels()[SUBSYSTEM_DIAMPEER] != "debug" {
+		t.Errorf("level of diampeer not taken from configuration: %v", GetSubsystemLogLevels())
+	}
+	if err := SetLogLevel("warn"); err != nil {
+		t.Fatal(err)
+	}
+	if !debugEnabled(SUBSYSTEM_DIAMPEER) || debugEnabled(SUBSYSTEM_ROUTER) || GetLogger().Desugar().Core().Enabled(zapcore.InfoLevel) {
+		t.Errorf("bad levels after changing the global one: %v", GetSubsystemLogLevels())
+	}
+
+	// Changed at runtime
+	if err := SetSubsystemLogLevel(SUBSYSTEM_ROUTER, "debug"); err != nil || !debugEnabled(SUBSYSTEM_ROUTER) {
+		t.Errorf("router level not changed")
+	}
+	if err := SetSubsystemLogLevel(SUBSYSTEM_ROUTER, "verbose"); err == nil {
+		t.Errorf("bad level accepted")
+	}
+	SetSubsystemLogLevel(SUBSYSTEM_ROUTER, "")
+	if debugEnabled(SUBSYSTEM_ROUTER) || GetSubsystemLogLevels()[SUBSYSTEM_ROUTER] != "warn" {
+		t.Errorf("router does not follow again the global level")
+	}
+}
+
 // Retrieval of some JSON configuration file
 func TestConfigFile(t *testing.T) {
 
@@ -157,3 +358,231 @@ func TestConfigFile(t *testing.T) {
 		t.Fatal("\"test\" property was not set to \"content\"")
 	}
 }
+
+// Writes the contents of a ConfigMap volume as Kubernetes does, replacing the "..data" symlink
+func writeKubernetesVolume(t *testing.T, dir string, version string, files map[string]string) {
+	dataDir := filepath.Join(dir, ".."+version)
+	if err := os.Mkdir(dataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dataDir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Symlink(filepath.Join("..data", name), filepath.Join(dir, name))
+	}
+	if err := os.Symlink(".."+version, filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKubernetesVolume(t *testing.T) {
+	dir := t.TempDir()
+	writeKubernetesVolume(t, dir, "v1", map[string]string{"kube.json": `{"version": 1}`})
+
+	cm := ConfigurationManager{
+		sRules: searchRules{{NameRegex: "(.*)", Regex: regexp.MustCompile("(.*)"), Base: KUBERNETES_PREFIX + dir + "/"}},
+	}
+	obj, err := cm.GetConfigObjectAsText("kube.json", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(obj) != `{"version": 1}` {
+		t.Fatalf("read %s", obj)
+	}
+
+	changed := make(chan struct{}, 1)
+	if err := cm.WatchKubernetesVolumes(func() { changed <- struct{}{} }); err != nil {
+		t.Fatal(err)
+	}
+	defer cm.StopWatchingKubernetesVolumes()
+
+	writeKubernetesVolume(t, dir, "v2", map[string]string{"kube.json": `{"version": 2}`})
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("change not detected")
+	}
+
+	// The cached object was invalidated
+	obj, err = cm.GetConfigObjectAsText("kube.json", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(obj) != `{"version": 2}` {
+		t.Fatalf("read %s after change", obj)
+	}
+}
+
+func TestEnvironmentVariables(t *testing.T) {
+	t.Setenv("IGORTEST_ENVINSTANCE_ENV_JSON", `{"origin": "instance"}`)
+	t.Setenv("IGORTEST_ENV_JSON", `{"origin": "general"}`)
+	t.Setenv("IGORTEST_ENCODED_JSON", "base64:"+base64.StdEncoding.EncodeToString([]byte(`{"origin": "encoded"}`)))
+	t.Setenv("IGORTEST_BAD_JSON", "base64:not base64")
+
+	cm := ConfigurationManager{
+		instanceName: "envInstance",
+		sRules:       searchRules{{NameRegex: "(.*)", Regex: regexp.MustCompile("(.*)"), Base: ENVIRONMENT_PREFIX + "IGORTEST_"}},
+	}
+	for objectName, expected := range map[string]string{"env.json": "instance", "encoded.json": "encoded"} {
+		obj, err := cm.GetConfigObjectAsJson(objectName, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if origin := obj.(map[string]interface{})["origin"]; origin != expected {
+			t.Errorf("%s read from %s", objectName, origin)
+		}
+	}
+
+	// Without instance
+	cm.instanceName = ""
+	obj, err := cm.GetConfigObjectAsJson("env.json", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if origin := obj.(map[string]interface{})["origin"]; origin != "general" {
+		t.Errorf("env.json read from %s", origin)
+	}
+
+	if _, err := cm.GetConfigObject("bad.json", false); err == nil {
+		t.Error("bad base64 value accepted")
+	}
+	if _, err := cm.GetConfigObject("undefined.json", false); err == nil {
+		t.Error("undefined variable accepted")
+	}
+}
+
+func TestSecrets(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	encrypted, err := EncryptSecrets(map[string]string{"radius": `se"cret`}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/secret/data/igor" || req.Header.Get("X-Vault-Token") != "vaulttoken" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"data": {"data": {"db": "dbpassword"}}}`))
+	}))
+	defer vault.Close()
+
+	aws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue" || !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"Name": "igor", "SecretString": "{\"api\": \"apikey\"}"}`))
+	}))
+	defer aws.Close()
+
+	t.Setenv("IGORSECRETS_KEY", base64.StdEncoding.EncodeToString(key))
+	t.Setenv("IGORSECRETS_ENCRYPTED", string(encrypted))
+	t.Setenv("IGORSECRETS_VAULT_TOKEN", "vaulttoken")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secretkey")
+	t.Setenv("IGORSECRETS_SECRETS_JSON", `{"providers": [
+		{"type": "file", "path": "env:IGORSECRETS_ENCRYPTED", "keyVariable": "IGORSECRETS_KEY"},
+		{"type": "vault", "address": "`+vault.URL+`", "tokenVariable": "IGORSECRETS_VAULT_TOKEN", "secretPath": "igor"},
+		{"type": "aws", "region": "eu-west-1", "secretId": "igor", "endpoint": "`+aws.URL+`"}
+	]}`)
+	t.Setenv("IGORSECRETS_SERVERS_JSON", `{"secret": "${secret:radius}", "password": "${secret:db}", "apiKey": "${secret:api}"}`)
+	t.Setenv("IGORSECRETS_UNDEFINED_JSON", `{"secret": "${secret:undefined}"}`)
+
+	cm := ConfigurationManager{
+		sRules: searchRules{{NameRegex: "(.*)", Regex: regexp.MustCompile("(.*)"), Base: ENVIRONMENT_PREFIX + "IGORSECRETS_"}},
+	}
+	obj, err := cm.GetConfigObjectAsJson("servers.json", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := obj.(map[string]interface{})
+	if servers["secret"] != `se"cret` || servers["password"] != "dbpassword" || servers["apiKey"] != "apikey" {
+		t.Errorf("bad secrets resolution %v", servers)
+	}
+
+	if _, err := cm.GetConfigObject("undefined.json", false); err == nil {
+		t.Error("undefined secret resolved")
+	}
+
+	// Bad master key
+	t.Setenv("IGORSECRETS_KEY", base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	cm.InvalidateConfigObject("servers.json")
+	if _, err := cm.GetConfigObject("servers.json", false); err == nil {
+		t.Error("secrets file decrypted with bad key")
+	}
+}
+
+func TestInstanceDictionaries(t *testing.T) {
+	ci := InitPolicyConfigInstance("resources/searchRules.json", "testServer", false)
+	if ci.DiameterDict() == GetDDict() || ci.RadiusDict() == GetRDict() {
+		t.Errorf("the instance shares the global dictionaries")
+	}
+	if _, ok := ci.DiameterDict().GetApplicationByName("Gx"); !ok {
+		t.Errorf("the diameter dictionary of the instance was not loaded")
+	}
+	if _, err := ci.DiameterDict().GetFromName("3GPP-Reporting-Reason"); err != nil {
+		t.Errorf("the diameter bundle of the instance was not loaded")
+	}
+	if _, err := ci.RadiusDict().GetFromName("WFA-HotSpot2-AP-Version"); err != nil {
+		t.Errorf("the radius bundle of the instance was not loaded")
+	}
+	if GetPolicyConfig().DiameterDict() != GetDDict() {
+		t.Errorf("the default instance does not use the global diameter dictionary")
+	}
+}
+
+// To be run with -race, since the configuration is reloaded while being read
+func TestConcurrentReload(t *testing.T) {
+	pc := GetPolicyConfig()
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if len(pc.RadiusClientsConf()) == 0 || len(pc.RoutingRulesConf()) == 0 || len(pc.PeersConf()) == 0 {
+					t.Error("empty configuration read during reload")
+					return
+				}
+				pc.RadiusServerConf()
+				pc.RoamingPartnersConf().FindRoamingPartner("partner1.com", "")
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := pc.Update(); err != nil {
+			t.Errorf("reload error %s", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	// A failed reload does not modify the configuration in use
+	clients := len(pc.RadiusClientsConf())
+	err := pc.update(func(s *policySnapshot) error {
+		s.currentRadiusClients = nil
+		return nil
+	}, func(s *policySnapshot) error {
+		return errors.New("bad configuration")
+	})
+	if err == nil {
+		t.Error("failed reload did not return an error")
+	}
+	if len(pc.RadiusClientsConf()) != clients {
+		t.Error("configuration modified by failed reload")
+	}
+}
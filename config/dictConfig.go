@@ -1,33 +1,78 @@
 package config
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"igor/diamdict"
 	"igor/radiusdict"
 )
 
 // This global variable has to be initialized using SetupDictionaries
+// Used as the default for the codecs, and for the configuration instances without dictionaries of their own
 var diameterDict *diamdict.DiameterDict
 var radiusDict *radiusdict.RadiusDict
 
+// The dictionary bundles shipped with igor to be added to the dictionaries of the instance. Only the
+// ones needed should be specified, to keep the memory down
+type DictionaryBundlesConfig struct {
+	// Names of the diameter bundles, such as "3gpp"
+	Diameter []string
+
+	// Names of the radius bundles, such as "cisco", "huawei", "juniper", "nokia" or "wfa"
+	Radius []string
+}
+
 // Loads the Radius and Diameter dictionaries
 func initDictionaries(cm *ConfigurationManager) {
 
-	// Load dictionaries
+	dDict, rDict, err := loadDictionaries(cm)
+	if err != nil {
+		panic(err.Error())
+	}
+	diameterDict = dDict
+	radiusDict = rDict
+}
+
+// Reads the Radius and Diameter dictionaries using the search rules of the configuration manager
+func loadDictionaries(cm *ConfigurationManager) (*diamdict.DiameterDict, *radiusdict.RadiusDict, error) {
 
 	// Diameter
 	diamDictJSON, err := cm.GetConfigObjectAsText("diameterDictionary.json", false)
 	if err != nil {
-		panic("Could not read diameterDictionary.json")
+		return nil, nil, errors.New("Could not read diameterDictionary.json")
 	}
-	diameterDict = diamdict.NewDictionaryFromJSON([]byte(diamDictJSON))
 
 	// Radius
 	radiusDictJSON, err := cm.GetConfigObjectAsText("radiusDictionary.json", false)
 	if err != nil {
-		panic("Could not read radiusDictionary.json")
+		return nil, nil, errors.New("Could not read radiusDictionary.json")
+	}
+
+	dDict := diamdict.NewDictionaryFromJSON([]byte(diamDictJSON))
+	rDict := radiusdict.NewDictionaryFromJSON([]byte(radiusDictJSON))
+
+	// Bundles
+	bundlesJSON, err := cm.GetConfigObjectAsText("dictionaryBundles.json", false)
+	if err != nil {
+		return nil, nil, errors.New("Could not read dictionaryBundles.json")
+	}
+	var bundles DictionaryBundlesConfig
+	if err := json.Unmarshal(bundlesJSON, &bundles); err != nil {
+		return nil, nil, fmt.Errorf("bad dictionaryBundles.json: %w", err)
+	}
+	for _, bundleName := range bundles.Diameter {
+		if err := dDict.AddBundle(bundleName); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, bundleName := range bundles.Radius {
+		if err := rDict.AddBundle(bundleName); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	radiusDict = radiusdict.NewDictionaryFromJSON([]byte(radiusDictJSON))
+	return dDict, rDict, nil
 }
 
 // Used globally to get access to the diameter dictionary
@@ -44,3 +89,19 @@ func GetRDict() *radiusdict.RadiusDict {
 	}
 	return radiusDict
 }
+
+// Returns the diameter dictionary of the instance, or the global one if it does not have its own
+func (c *PolicyConfigurationManager) DiameterDict() *diamdict.DiameterDict {
+	if c.diameterDict != nil {
+		return c.diameterDict
+	}
+	return GetDDict()
+}
+
+// Returns the radius dictionary of the instance, or the global one if it does not have its own
+func (c *PolicyConfigurationManager) RadiusDict() *radiusdict.RadiusDict {
+	if c.radiusDict != nil {
+		return c.radiusDict
+	}
+	return GetRDict()
+}
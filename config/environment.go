@@ -0,0 +1,55 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Configuration objects in environment variables. The base of the search rule is the prefix of the
+// variable names with the "env:" prefix, such as "env:IGOR_". The name of the variable is the prefix
+// followed by the name of the object, and by the instance name before it if so located, in uppercase
+// and with the characters other than letters and digits replaced by underscores. For instance, the
+// radiusServer.json object of the instance "server" is looked for in IGOR_SERVER_RADIUSSERVER_JSON and
+// then in IGOR_RADIUSSERVER_JSON. The value is the contents of the object, or its base64 encoding
+// preceded by "base64:"
+
+// Prefix of the search rule bases for environment variables
+const ENVIRONMENT_PREFIX = "env:"
+
+// Prefix of the values of the environment variables that are base64 encoded
+const ENVIRONMENT_BASE64_PREFIX = "base64:"
+
+// Reads the configuration object from the environment variable
+func readEnvironmentResource(location string) ([]byte, error) {
+	variable := environmentVariableName(strings.TrimPrefix(location, ENVIRONMENT_PREFIX))
+	value, found := os.LookupEnv(variable)
+	if !found {
+		return nil, fmt.Errorf("environment variable %s not defined", variable)
+	}
+
+	if strings.HasPrefix(value, ENVIRONMENT_BASE64_PREFIX) {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, ENVIRONMENT_BASE64_PREFIX))
+		if err != nil {
+			return nil, fmt.Errorf("bad base64 value of environment variable %s: %w", variable, err)
+		}
+		return decoded, nil
+	}
+	return []byte(value), nil
+}
+
+// Returns the name of the environment variable for the location, in uppercase and with the characters
+// other than letters and digits replaced by underscores
+func environmentVariableName(location string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		default:
+			return '_'
+		}
+	}, location)
+}
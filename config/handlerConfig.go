@@ -38,6 +38,17 @@ func InitHandlerConfigInstance(bootstrapFile string, instanceName string, isDefa
 	// Load handler configuraton
 	handlerConfig.UpdateHandlerConfig()
 
+	// Reload when the mounted ConfigMaps or Secrets change
+	if werr := handlerConfig.CM.WatchKubernetesVolumes(func() {
+		if cerr := handlerConfig.UpdateHandlerConfig(); cerr != nil {
+			GetLogger().Errorf("error reloading handler configuration %s", cerr)
+		} else {
+			GetLogger().Info("handler configuration reloaded after change in kubernetes volumes")
+		}
+	}); werr != nil {
+		panic(werr)
+	}
+
 	return &handlerConfig
 }
 
@@ -58,6 +69,11 @@ func GetHandlerConfig() *HandlerConfigurationManager {
 	return handlerConfigs[0]
 }
 
+// Returns the name of the instance, used to label the metrics it generates
+func (c *HandlerConfigurationManager) InstanceName() string {
+	return c.CM.InstanceName()
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 
 type HandlerConfig struct {
@@ -65,6 +81,35 @@ type HandlerConfig struct {
 	BindPort        int
 	RouterIPAddress string
 	RouterPort      int
+
+	// If specified, the handler listens on this unix socket instead of on the TCP address. The
+	// permissions are written in octal, such as "0660", which is the default
+	UnixSocketPath        string
+	UnixSocketPermissions string
+
+	// If not zero, the handler also serves the gRPC service in this port, in BindAddress. Uses TLS
+	// only if CertFile is specified
+	GrpcBindPort int
+
+	// Certificate and key of the handler. If not specified, default locations are used
+	CertFile string
+	KeyFile  string
+
+	// If specified, the clients must present a certificate signed by one of the CAs in this file (mutual TLS)
+	ClientCAFile string
+
+	// If any of these is not empty, the requests must carry one of the tokens in the Authorization header,
+	// as a bearer token, or one of the keys in the X-API-Key header. Otherwise, they are rejected
+	BearerTokens []string
+	APIKeys      []string
+
+	// If specified, name of the configuration object with the JavaScript script that handles the diameter
+	// requests, instead of the handler function passed to NewHttpHandler. See the scripthandler package
+	DiameterScript string
+
+	// Seconds between checks of changes in the script, which is reloaded if modified. If zero, a default
+	// value is used
+	ScriptReloadSeconds int
 }
 
 // Retrieves the handler configuration
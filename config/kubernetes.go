@@ -0,0 +1,160 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Configuration objects in Kubernetes ConfigMaps and Secrets mounted as volumes. The base of the
+// search rule is the mount directory with the "kubernetes:" prefix, such as "kubernetes:/etc/igor/".
+// Kubernetes updates the volumes by replacing the "..data" symlink to the directory with the
+// contents, which is detected here to reload the configuration automatically. The files written
+// directly in the directory, as when it is not a Kubernetes volume, also trigger the reload
+
+// Prefix of the search rule bases for mounted ConfigMaps and Secrets
+const KUBERNETES_PREFIX = "kubernetes:"
+
+// Time to wait after a change in the volumes before reloading, so that the updates of several
+// ConfigMaps and Secrets generate a single reload
+const KUBERNETES_RELOAD_DELAY_MILLIS = 500
+
+// Name of the symlink to the current contents of a mounted ConfigMap or Secret
+const kubernetesDataLink = "..data"
+
+// Reads the configuration object from the mounted volume
+func readKubernetesResource(location string) ([]byte, error) {
+	return ioutil.ReadFile(strings.TrimPrefix(location, KUBERNETES_PREFIX))
+}
+
+// Watches the mounted ConfigMaps and Secrets
+type volumeWatcher struct {
+	watcher *fsnotify.Watcher
+
+	// Used to aggregate the changes
+	timerMutex  sync.Mutex
+	reloadTimer *time.Timer
+}
+
+// Creates a watcher for the specified directories, which invokes the onChange function when
+// their contents are updated
+func newVolumeWatcher(dirs []string, onChange func()) (*volumeWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+
+	vw := volumeWatcher{watcher: watcher}
+	go vw.eventLoop(onChange)
+	return &vw, nil
+}
+
+// Processes the filesystem events until the watcher is closed
+func (vw *volumeWatcher) eventLoop(onChange func()) {
+	for {
+		select {
+		case event, ok := <-vw.watcher.Events:
+			if !ok {
+				return
+			}
+			// Ignore the temporary files and directories created by Kubernetes during the update
+			name := filepath.Base(event.Name)
+			if name != kubernetesDataLink && strings.HasPrefix(name, "..") {
+				continue
+			}
+			if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Remove|fsnotify.Rename) == 0 {
+				continue
+			}
+
+			vw.timerMutex.Lock()
+			if vw.reloadTimer != nil {
+				vw.reloadTimer.Stop()
+			}
+			vw.reloadTimer = time.AfterFunc(KUBERNETES_RELOAD_DELAY_MILLIS*time.Millisecond, onChange)
+			vw.timerMutex.Unlock()
+
+		case err, ok := <-vw.watcher.Errors:
+			if !ok {
+				return
+			}
+			if logger := GetLogger(); logger != nil {
+				logger.Errorf("error watching configuration volumes: %v", err)
+			}
+		}
+	}
+}
+
+// Stops watching
+func (vw *volumeWatcher) close() {
+	vw.watcher.Close()
+
+	vw.timerMutex.Lock()
+	defer vw.timerMutex.Unlock()
+	if vw.reloadTimer != nil {
+		vw.reloadTimer.Stop()
+	}
+}
+
+// Returns the mounted directories referenced in the search rules, including the ones for the
+// instance, if they exist
+func (c *ConfigurationManager) kubernetesDirs() []string {
+	var dirs []string
+	for _, rule := range c.sRules {
+		if !strings.HasPrefix(rule.Base, KUBERNETES_PREFIX) {
+			continue
+		}
+		base := strings.TrimPrefix(rule.Base, KUBERNETES_PREFIX)
+		candidates := []string{base}
+		if c.instanceName != "" {
+			candidates = append(candidates, base+c.instanceName+"/")
+		}
+		for _, dir := range candidates {
+			if fileInfo, err := os.Stat(dir); err == nil && fileInfo.IsDir() {
+				dirs = append(dirs, filepath.Clean(dir))
+			}
+		}
+	}
+	return dirs
+}
+
+// Invokes the onChange function when the mounted ConfigMaps or Secrets in the search rules are
+// updated. Does nothing if there are none
+func (c *ConfigurationManager) WatchKubernetesVolumes(onChange func()) error {
+	dirs := c.kubernetesDirs()
+	if len(dirs) == 0 {
+		return nil
+	}
+
+	// The cached objects are outdated after the change
+	vw, err := newVolumeWatcher(dirs, func() {
+		c.objectCache.Range(func(key, value interface{}) bool {
+			c.objectCache.Delete(key)
+			return true
+		})
+		onChange()
+	})
+	if err != nil {
+		return err
+	}
+	c.volumeWatcher = vw
+	return nil
+}
+
+// Stops watching the mounted ConfigMaps and Secrets
+func (c *ConfigurationManager) StopWatchingKubernetesVolumes() {
+	if c.volumeWatcher != nil {
+		c.volumeWatcher.close()
+		c.volumeWatcher = nil
+	}
+}
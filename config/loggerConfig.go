@@ -3,13 +3,70 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"sync"
 
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Names of the subsystems with their own log level
+const (
+	SUBSYSTEM_DIAMPEER     = "diampeer"
+	SUBSYSTEM_RADIUSSERVER = "radiusserver"
+	SUBSYSTEM_ROUTER       = "router"
+	SUBSYSTEM_HANDLERS     = "handlers"
 )
 
 // Must be initialized with a call to SetupLogger
 var ilogger *zap.SugaredLogger
 
+// Level of the logger, that may be changed at runtime
+var logLevel zap.AtomicLevel
+
+// Logger that writes the entries of all levels, from which the global and subsystem loggers are derived
+var baseLogger *zap.Logger
+
+// Loggers of the subsystems, with their levels. The subsystems without a level specified in logging.json
+// or set with SetSubsystemLogLevel follow the global level
+var subsystemsMutex sync.Mutex
+var subsystemLoggers = make(map[string]*zap.SugaredLogger)
+var subsystemLevels = make(map[string]zap.AtomicLevel)
+var subsystemOwnLevel = make(map[string]bool)
+
+// Contents of logging.json
+type LoggingConfig struct {
+	// Level of each subsystem, overriding the global one
+	Subsystems map[string]string
+}
+
+// Filters the entries with the specified level, on top of a core that accepts all levels
+type levelFilterCore struct {
+	zapcore.Core
+	level zap.AtomicLevel
+}
+
+func (c *levelFilterCore) Enabled(level zapcore.Level) bool {
+	return c.level.Enabled(level)
+}
+
+func (c *levelFilterCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !c.level.Enabled(entry.Level) {
+		return checked
+	}
+	return c.Core.Check(entry, checked)
+}
+
+func (c *levelFilterCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelFilterCore{Core: c.Core.With(fields), level: c.level}
+}
+
+// Returns a logger derived from the base one that writes only the entries enabled in the level
+func newFilteredLogger(level zap.AtomicLevel) *zap.SugaredLogger {
+	return baseLogger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return &levelFilterCore{Core: core, level: level}
+	})).Sugar()
+}
+
 // https://pkg.go.dev/go.uber.org/zap
 // Returns a configured instance of zap logger
 func initLogger(cm *ConfigurationManager) {
@@ -17,7 +74,7 @@ func initLogger(cm *ConfigurationManager) {
 	defaultLogConfig := `{
 		"level": "debug",
 		"development": true,
-		"encoding": "console",
+		"encoding": "json",
 		"outputPaths": ["stdout"],
 		"errorOutputPaths": ["stderr"],
 		"disableCaller": false,
@@ -45,15 +102,120 @@ func initLogger(cm *ConfigurationManager) {
 		panic(err)
 	}
 
+	// The level of the configuration is applied by the derived loggers
+	logLevel = cfg.Level
+	cfg.Level = zap.NewAtomicLevelAt(zapcore.DebugLevel)
+
 	logger, logError := cfg.Build()
 	if logError != nil {
 		panic(logError)
 	}
 
-	ilogger = logger.Sugar()
+	baseLogger = logger
+	ilogger = newFilteredLogger(logLevel)
+
+	// Retrieve the levels of the subsystems
+	var loggingConfig LoggingConfig
+	if jLoggingConfig, err := cm.GetConfigObjectAsText("logging.json", false); err == nil {
+		if err := json.Unmarshal(jLoggingConfig, &loggingConfig); err != nil {
+			panic(fmt.Sprintf("bad logging.json: %s", err))
+		}
+	}
+
+	subsystemsMutex.Lock()
+	defer subsystemsMutex.Unlock()
+	subsystemLoggers = make(map[string]*zap.SugaredLogger)
+	subsystemLevels = make(map[string]zap.AtomicLevel)
+	subsystemOwnLevel = make(map[string]bool)
+	for subsystem, level := range loggingConfig.Subsystems {
+		atomicLevel := zap.NewAtomicLevel()
+		if err := atomicLevel.UnmarshalText([]byte(level)); err != nil {
+			panic(fmt.Sprintf("bad level for subsystem %s in logging.json: %s", subsystem, err))
+		}
+		subsystemLevels[subsystem] = atomicLevel
+		subsystemOwnLevel[subsystem] = true
+	}
 }
 
 // Used globally to get access to the logger
 func GetLogger() *zap.SugaredLogger {
 	return ilogger
 }
+
+// Returns the logger for the specified subsystem, which writes the entries enabled in its level
+func GetSubsystemLogger(subsystem string) *zap.SugaredLogger {
+	subsystemsMutex.Lock()
+	defer subsystemsMutex.Unlock()
+
+	if logger, found := subsystemLoggers[subsystem]; found {
+		return logger
+	}
+	logger := newFilteredLogger(getSubsystemLevel(subsystem)).With("subsystem", subsystem)
+	subsystemLoggers[subsystem] = logger
+	return logger
+}
+
+// Returns the level of the subsystem, creating it with the global level if it does not exist.
+// Must be called with the lock held
+func getSubsystemLevel(subsystem string) zap.AtomicLevel {
+	level, found := subsystemLevels[subsystem]
+	if !found {
+		level = zap.NewAtomicLevelAt(logLevel.Level())
+		subsystemLevels[subsystem] = level
+	}
+	return level
+}
+
+// Returns the current level of the logger
+func GetLogLevel() string {
+	return logLevel.String()
+}
+
+// Changes the level of the logger and of the subsystems that do not have their own. The level is one
+// of debug, info, warn, error, dpanic, panic or fatal
+func SetLogLevel(level string) error {
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return err
+	}
+
+	subsystemsMutex.Lock()
+	defer subsystemsMutex.Unlock()
+	for subsystem, subsystemLevel := range subsystemLevels {
+		if !subsystemOwnLevel[subsystem] {
+			subsystemLevel.SetLevel(logLevel.Level())
+		}
+	}
+	return nil
+}
+
+// Returns the current levels of the subsystems in use or configured
+func GetSubsystemLogLevels() map[string]string {
+	subsystemsMutex.Lock()
+	defer subsystemsMutex.Unlock()
+
+	levels := make(map[string]string)
+	for subsystem, level := range subsystemLevels {
+		levels[subsystem] = level.String()
+	}
+	return levels
+}
+
+// Changes the level of the subsystem. If the level is empty, the subsystem follows again the global level
+func SetSubsystemLogLevel(subsystem string, level string) error {
+	subsystemsMutex.Lock()
+	defer subsystemsMutex.Unlock()
+
+	if level == "" {
+		subsystemOwnLevel[subsystem] = false
+		getSubsystemLevel(subsystem).SetLevel(logLevel.Level())
+		return nil
+	}
+
+	var newLevel zapcore.Level
+	if err := newLevel.UnmarshalText([]byte(level)); err != nil {
+		return err
+	}
+	getSubsystemLevel(subsystem).SetLevel(newLevel)
+	subsystemOwnLevel[subsystem] = true
+	return nil
+}
@@ -0,0 +1,473 @@
+package config
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Secrets referenced in the configuration objects as "${secret:name}", which are replaced by their values,
+// escaped as JSON strings, when the objects are read. The values are taken from the first of the providers
+// declared in the secrets.json object that has the secret. The supported providers are
+//
+//   - "file": JSON object with the names and values of the secrets, encrypted with AES-256-GCM using a
+//     master key taken from an environment variable, and stored in base64. See EncryptSecrets
+//   - "vault": HashiCorp Vault KV version 2 secrets engine, where each secret is a key of the path
+//   - "aws": AWS Secrets Manager secret whose value is a JSON object with the names and values of the secrets
+
+// Name of the configuration object with the declaration of the secrets providers
+const SECRETS_OBJECT_NAME = "secrets.json"
+
+// Environment variables used by default for the master key of the encrypted file and the Vault token
+const DEFAULT_SECRETS_KEY_VARIABLE = "IGOR_SECRETS_KEY"
+const DEFAULT_VAULT_TOKEN_VARIABLE = "VAULT_TOKEN"
+
+// Timeout for the requests to Vault and AWS Secrets Manager
+const SECRETS_PROVIDER_TIMEOUT_SECONDS = 10
+
+// Returned, possibly wrapped, when the provider does not have the secret
+var ErrSecretNotFound = errors.New("secret not found")
+
+// Matches the references to secrets
+var secretReferenceRegex = regexp.MustCompile(`\$\{secret:([^}]+)\}`)
+
+// Declaration of the secrets providers, tried in order
+type SecretsConfig struct {
+	Providers []SecretsProviderConfig
+}
+
+type SecretsProviderConfig struct {
+	// "file", "vault" or "aws"
+	Type string
+
+	// For the "file" provider, location of the encrypted file, as for the configuration objects, and
+	// environment variable with the base64 encoded 32 bytes master key
+	Path        string
+	KeyVariable string
+
+	// For the "vault" provider, base URL of the server, environment variable with the token, mount point of
+	// the secrets engine ("secret" if not specified) and path of the secrets
+	Address       string
+	TokenVariable string
+	Mount         string
+	SecretPath    string
+
+	// For the "aws" provider, region and identifier of the secret. The credentials are taken from the
+	// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables. The Endpoint
+	// is only specified to use other than the regional one
+	Region   string
+	SecretId string
+	Endpoint string
+}
+
+// Source of secrets
+type SecretsProvider interface {
+	// Returns the value of the secret, or an error wrapping ErrSecretNotFound if it does not exist
+	GetSecret(name string) (string, error)
+}
+
+// Replaces the references to secrets in the configuration object. The secrets object itself may not
+// contain references
+func (c *ConfigurationManager) resolveSecrets(objectName string, object []byte) ([]byte, error) {
+	if objectName == SECRETS_OBJECT_NAME || !secretReferenceRegex.Match(object) {
+		return object, nil
+	}
+
+	providers, err := c.secretsProviders()
+	if err != nil {
+		return nil, err
+	}
+
+	var resolveErr error
+	resolved := secretReferenceRegex.ReplaceAllFunc(object, func(reference []byte) []byte {
+		name := string(secretReferenceRegex.FindSubmatch(reference)[1])
+		value, err := getSecret(providers, name)
+		if err != nil {
+			if resolveErr == nil {
+				resolveErr = fmt.Errorf("could not resolve secret %s in %s: %w", name, objectName, err)
+			}
+			return reference
+		}
+		// Escape as JSON string, without the quotes
+		escaped, _ := json.Marshal(value)
+		return escaped[1 : len(escaped)-1]
+	})
+	if resolveErr != nil {
+		return nil, resolveErr
+	}
+	return resolved, nil
+}
+
+// Returns the value of the secret from the first provider that has it
+func getSecret(providers []SecretsProvider, name string) (string, error) {
+	for _, provider := range providers {
+		value, err := provider.GetSecret(name)
+		if err == nil {
+			return value, nil
+		}
+		if !errors.Is(err, ErrSecretNotFound) {
+			return "", err
+		}
+	}
+	return "", ErrSecretNotFound
+}
+
+// Builds the providers declared in the secrets object
+func (c *ConfigurationManager) secretsProviders() ([]SecretsProvider, error) {
+	raw, err := c.GetConfigObjectAsText(SECRETS_OBJECT_NAME, false)
+	if err != nil {
+		return nil, fmt.Errorf("no secrets providers: %w", err)
+	}
+	var secretsConfig SecretsConfig
+	if err := json.Unmarshal(raw, &secretsConfig); err != nil {
+		return nil, fmt.Errorf("bad secrets providers declaration: %w", err)
+	}
+
+	providers := make([]SecretsProvider, 0, len(secretsConfig.Providers))
+	for _, providerConfig := range secretsConfig.Providers {
+		switch providerConfig.Type {
+		case "file":
+			providers = append(providers, &fileSecretsProvider{cm: c, config: providerConfig})
+		case "vault":
+			providers = append(providers, &vaultSecretsProvider{config: providerConfig, client: secretsHttpClient()})
+		case "aws":
+			providers = append(providers, &awsSecretsProvider{config: providerConfig, client: secretsHttpClient()})
+		default:
+			return nil, fmt.Errorf("unknown secrets provider type %s", providerConfig.Type)
+		}
+	}
+	return providers, nil
+}
+
+func secretsHttpClient() *http.Client {
+	return &http.Client{Timeout: SECRETS_PROVIDER_TIMEOUT_SECONDS * time.Second}
+}
+
+// Returns the value of the environment variable, or of the default one if not specified
+func lookupVariable(variable string, defaultVariable string) (string, error) {
+	if variable == "" {
+		variable = defaultVariable
+	}
+	value, found := os.LookupEnv(variable)
+	if !found {
+		return "", fmt.Errorf("environment variable %s not defined", variable)
+	}
+	return value, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Encrypted file
+///////////////////////////////////////////////////////////////////////////////
+
+type fileSecretsProvider struct {
+	cm     *ConfigurationManager
+	config SecretsProviderConfig
+
+	// Decrypted contents of the file, read on first use
+	secrets map[string]string
+}
+
+func (p *fileSecretsProvider) GetSecret(name string) (string, error) {
+	if p.secrets == nil {
+		key, err := p.masterKey()
+		if err != nil {
+			return "", err
+		}
+		encrypted, err := p.cm.readResource(p.config.Path)
+		if err != nil {
+			return "", fmt.Errorf("could not read secrets file: %w", err)
+		}
+		if p.secrets, err = DecryptSecrets(encrypted, key); err != nil {
+			return "", err
+		}
+	}
+
+	value, found := p.secrets[name]
+	if !found {
+		return "", fmt.Errorf("%s in file %s: %w", name, p.config.Path, ErrSecretNotFound)
+	}
+	return value, nil
+}
+
+func (p *fileSecretsProvider) masterKey() ([]byte, error) {
+	encodedKey, err := lookupVariable(p.config.KeyVariable, DEFAULT_SECRETS_KEY_VARIABLE)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(encodedKey))
+}
+
+// Encrypts the secrets with AES-256-GCM using the 32 bytes key, and returns the nonce followed by the
+// ciphertext, encoded in base64, which is the format of the secrets file
+func EncryptSecrets(secrets map[string]string, key []byte) ([]byte, error) {
+	plaintext, err := json.Marshal(secrets)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newSecretsCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, nil)
+
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(sealed)))
+	base64.StdEncoding.Encode(encoded, sealed)
+	return encoded, nil
+}
+
+// Decrypts the contents of a secrets file generated with EncryptSecrets
+func DecryptSecrets(encrypted []byte, key []byte) (map[string]string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(encrypted)))
+	if err != nil {
+		return nil, fmt.Errorf("bad encoding of secrets file: %w", err)
+	}
+	aead, err := newSecretsCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("secrets file too short")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt secrets file: %w", err)
+	}
+
+	var secrets map[string]string
+	if err := json.Unmarshal(plaintext, &secrets); err != nil {
+		return nil, fmt.Errorf("bad contents of secrets file: %w", err)
+	}
+	return secrets, nil
+}
+
+func newSecretsCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("master key must have 32 bytes, but has %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// HashiCorp Vault
+///////////////////////////////////////////////////////////////////////////////
+
+type vaultSecretsProvider struct {
+	config SecretsProviderConfig
+	client *http.Client
+
+	// Contents of the path, read on first use
+	secrets map[string]interface{}
+}
+
+func (p *vaultSecretsProvider) GetSecret(name string) (string, error) {
+	if p.secrets == nil {
+		if err := p.readSecrets(); err != nil {
+			return "", err
+		}
+	}
+
+	value, found := p.secrets[name]
+	if !found {
+		return "", fmt.Errorf("%s in vault path %s: %w", name, p.config.SecretPath, ErrSecretNotFound)
+	}
+	if stringValue, isString := value.(string); isString {
+		return stringValue, nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+func (p *vaultSecretsProvider) readSecrets() error {
+	token, err := lookupVariable(p.config.TokenVariable, DEFAULT_VAULT_TOKEN_VARIABLE)
+	if err != nil {
+		return err
+	}
+	mount := p.config.Mount
+	if mount == "" {
+		mount = "secret"
+	}
+
+	url := fmt.Sprintf("%s/v1/%s/data/%s", strings.TrimSuffix(p.config.Address, "/"), mount, strings.TrimPrefix(p.config.SecretPath, "/"))
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not get secrets from vault: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("vault answered with status %d", resp.StatusCode)
+	}
+
+	var kvResponse struct {
+		Data struct {
+			Data map[string]interface{}
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&kvResponse); err != nil {
+		return fmt.Errorf("bad response from vault: %w", err)
+	}
+	p.secrets = kvResponse.Data.Data
+	if p.secrets == nil {
+		p.secrets = make(map[string]interface{})
+	}
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// AWS Secrets Manager
+///////////////////////////////////////////////////////////////////////////////
+
+type awsSecretsProvider struct {
+	config SecretsProviderConfig
+	client *http.Client
+
+	// Contents of the secret, read on first use
+	secrets map[string]interface{}
+}
+
+func (p *awsSecretsProvider) GetSecret(name string) (string, error) {
+	if p.secrets == nil {
+		if err := p.readSecrets(); err != nil {
+			return "", err
+		}
+	}
+
+	value, found := p.secrets[name]
+	if !found {
+		return "", fmt.Errorf("%s in aws secret %s: %w", name, p.config.SecretId, ErrSecretNotFound)
+	}
+	if stringValue, isString := value.(string); isString {
+		return stringValue, nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+func (p *awsSecretsProvider) readSecrets() error {
+	accessKey, err := lookupVariable("AWS_ACCESS_KEY_ID", "")
+	if err != nil {
+		return err
+	}
+	secretKey, err := lookupVariable("AWS_SECRET_ACCESS_KEY", "")
+	if err != nil {
+		return err
+	}
+
+	endpoint := p.config.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://secretsmanager.%s.amazonaws.com", p.config.Region)
+	}
+	body, _ := json.Marshal(map[string]string{"SecretId": p.config.SecretId})
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(endpoint, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if sessionToken := os.Getenv("AWS_SESSION_TOKEN"); sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+	signAWSRequest(req, body, accessKey, secretKey, p.config.Region, "secretsmanager", time.Now())
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not get secrets from aws: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("aws answered with status %d: %s", resp.StatusCode, message)
+	}
+
+	var secretValue struct {
+		SecretString string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secretValue); err != nil {
+		return fmt.Errorf("bad response from aws: %w", err)
+	}
+	if err := json.Unmarshal([]byte(secretValue.SecretString), &p.secrets); err != nil {
+		return fmt.Errorf("aws secret %s is not a JSON object: %w", p.config.SecretId, err)
+	}
+	return nil
+}
+
+// Adds the AWS Signature Version 4 headers to the request, which has no query string
+func signAWSRequest(req *http.Request, body []byte, accessKey string, secretKey string, region string, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Headers to sign, in alphabetical order
+	signedHeaderNames := []string{"content-type", "host", "x-amz-content-sha256", "x-amz-date"}
+	if req.Header.Get("X-Amz-Security-Token") != "" {
+		signedHeaderNames = append(signedHeaderNames, "x-amz-security-token")
+	}
+	signedHeaderNames = append(signedHeaderNames, "x-amz-target")
+
+	var canonicalHeaders strings.Builder
+	for _, name := range signedHeaderNames {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signedHeaders := strings.Join(signedHeaderNames, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{req.Method, path, "", canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+secretKey), date)
+	for _, item := range []string{region, service, "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, item)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,138 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Maximum number of events kept in a TraceBuffer. The rest are counted but discarded
+const MAX_TRACE_ENTRIES = 100
+
+// Specifies when the trace of a request is written to the log
+type TraceConfig struct {
+	// Write the trace of the requests that end in error
+	OnError bool
+
+	// Write the trace of the requests that take longer than this. Zero to disable
+	LatencyThresholdMillis int
+
+	// Write the trace of one in every SampleEvery requests. Zero to disable
+	SampleEvery int
+}
+
+// Returns true if traces may be written in any case
+func (tc TraceConfig) IsEnabled() bool {
+	return tc.OnError || tc.LatencyThresholdMillis > 0 || tc.SampleEvery > 0
+}
+
+// Used for sampling
+var traceCounter uint64
+
+type traceEntry struct {
+	elapsed time.Duration
+	format  string
+	args    []interface{}
+}
+
+// Accumulates the debug events of a request, which are only written to the log when the
+// request finishes, if it ends in error, is too slow or is sampled, as specified in the
+// TraceConfig. The events are formatted only if written.
+//
+// All methods may be invoked on a nil TraceBuffer, doing nothing
+type TraceBuffer struct {
+	sync.Mutex
+
+	nameFormat string
+	nameArgs   []interface{}
+	conf       TraceConfig
+	start      time.Time
+	number     uint64
+
+	entries   []traceEntry
+	discarded int
+}
+
+// Creates a TraceBuffer for a request, whose name is specified as a format string and arguments.
+// Returns nil if the trace of the request would never be written, either because tracing is not enabled
+// in the configuration or because only sampling is and the request is not sampled
+func NewTraceBuffer(conf TraceConfig, nameFormat string, nameArgs ...interface{}) *TraceBuffer {
+	if !conf.IsEnabled() {
+		return nil
+	}
+	number := atomic.AddUint64(&traceCounter, 1)
+	isSampled := conf.SampleEvery > 0 && number%uint64(conf.SampleEvery) == 0
+	if !conf.OnError && conf.LatencyThresholdMillis <= 0 && !isSampled {
+		return nil
+	}
+	return &TraceBuffer{
+		nameFormat: nameFormat,
+		nameArgs:   nameArgs,
+		conf:       conf,
+		start:      time.Now(),
+		number:     number,
+		entries:    make([]traceEntry, 0, 8),
+	}
+}
+
+// Adds an event to the trace. The arguments are formatted only if the trace is written
+func (tb *TraceBuffer) Tracef(format string, args ...interface{}) {
+	if tb == nil {
+		return
+	}
+	tb.Lock()
+	defer tb.Unlock()
+
+	if len(tb.entries) >= MAX_TRACE_ENTRIES {
+		tb.discarded++
+		return
+	}
+	tb.entries = append(tb.entries, traceEntry{elapsed: time.Since(tb.start), format: format, args: args})
+}
+
+// Signals the end of the request, writing the trace to the log if the request ended in error,
+// took longer than the threshold or is sampled. Returns true if the trace was written
+func (tb *TraceBuffer) Finish(err error) bool {
+	if tb == nil {
+		return false
+	}
+	tb.Lock()
+	defer tb.Unlock()
+
+	elapsed := time.Since(tb.start)
+	isSlow := tb.conf.LatencyThresholdMillis > 0 && elapsed > time.Duration(tb.conf.LatencyThresholdMillis)*time.Millisecond
+	isSampled := tb.conf.SampleEvery > 0 && tb.number%uint64(tb.conf.SampleEvery) == 0
+
+	switch {
+	case err != nil && tb.conf.OnError:
+		GetLogger().Warnf("trace of %s ended with error %s after %s\n%s", tb.name(), err, elapsed, tb.format())
+	case isSlow:
+		GetLogger().Warnf("trace of %s took %s\n%s", tb.name(), elapsed, tb.format())
+	case isSampled:
+		GetLogger().Infof("trace of %s took %s\n%s", tb.name(), elapsed, tb.format())
+	default:
+		return false
+	}
+	return true
+}
+
+// Generates the name of the request
+func (tb *TraceBuffer) name() string {
+	return fmt.Sprintf(tb.nameFormat, tb.nameArgs...)
+}
+
+// Generates the text of the events
+func (tb *TraceBuffer) format() string {
+	var sb strings.Builder
+	for _, entry := range tb.entries {
+		sb.WriteString(fmt.Sprintf("  +%s ", entry.elapsed))
+		sb.WriteString(fmt.Sprintf(entry.format, entry.args...))
+		sb.WriteString("\n")
+	}
+	if tb.discarded > 0 {
+		sb.WriteString(fmt.Sprintf("  ... %d more events discarded\n", tb.discarded))
+	}
+	return sb.String()
+}
@@ -0,0 +1,105 @@
+package conformance
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Battery of protocol conformance checks to be run against remote diameter peers and radius
+// servers, using the igor codecs. Each check sends crafted messages, some of them deliberately
+// malformed, and verifies the reaction of the remote party against the RFC
+
+// A conformance check
+type Check struct {
+	Name string
+
+	// Section of the RFC that specifies the behaviour
+	Reference string
+
+	// Returns nil if the remote party behaved as specified
+	Run func() error
+}
+
+// Result of a check
+type Result struct {
+	Name      string
+	Reference string
+	Passed    bool
+	Detail    string `json:",omitempty"`
+	Duration  time.Duration
+}
+
+// Results of a battery of checks against a target
+type Report struct {
+	Protocol string
+	Target   string
+	Started  time.Time
+	Results  []Result
+}
+
+// Executes the checks in sequence. A panic in a check, for instance when decoding a bad message
+// received, is reported as a failure
+func Run(protocol string, target string, checks []Check) Report {
+	report := Report{Protocol: protocol, Target: target, Started: time.Now(), Results: make([]Result, 0, len(checks))}
+	for _, check := range checks {
+		report.Results = append(report.Results, runCheck(check))
+	}
+	return report
+}
+
+func runCheck(check Check) (result Result) {
+	result = Result{Name: check.Name, Reference: check.Reference}
+	start := time.Now()
+	defer func() {
+		result.Duration = time.Since(start)
+		if r := recover(); r != nil {
+			result.Passed = false
+			result.Detail = fmt.Sprintf("panic: %v", r)
+		}
+	}()
+
+	if err := check.Run(); err != nil {
+		result.Detail = err.Error()
+	} else {
+		result.Passed = true
+	}
+	return result
+}
+
+// Returns the number of checks that failed
+func (r Report) Failures() int {
+	failures := 0
+	for _, result := range r.Results {
+		if !result.Passed {
+			failures++
+		}
+	}
+	return failures
+}
+
+// Writes the report in human readable form
+func (r Report) WriteText(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "%s conformance of %s (%s)\n", r.Protocol, r.Target, r.Started.Format(time.RFC3339)); err != nil {
+		return err
+	}
+	for _, result := range r.Results {
+		status := "PASS"
+		if !result.Passed {
+			status = "FAIL"
+		}
+		if _, err := fmt.Fprintf(w, "  %s  %-55s %-22s %s\n", status, result.Name, result.Reference, result.Detail); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d checks, %d failed\n", len(r.Results), r.Failures())
+	return err
+}
+
+// Writes the report as JSON
+func (r Report) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
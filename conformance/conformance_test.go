@@ -0,0 +1,80 @@
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"igor/config"
+	"igor/radiuscodec"
+	"igor/radiusserver"
+	"igor/router"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+
+	// Initialize the Config Object
+	config.InitPolicyConfigInstance("resources/searchRules.json", "testServer", true)
+
+	// Execute the tests and exit
+	os.Exit(m.Run())
+}
+
+func TestRadiusConformance(t *testing.T) {
+
+	ci := config.GetPolicyConfigInstance("testServer")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	radiusserver.NewRadiusServer(ctx, ci, "127.0.0.1", 1812, func(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+		return radiuscodec.NewRadiusResponse(request, true), nil
+	})
+	time.Sleep(100 * time.Millisecond)
+
+	target := RadiusTarget{Address: "127.0.0.1:1812", Secret: "secret", Timeout: 300 * time.Millisecond, UserName: "user@igor", Password: "password"}
+	report := Run("radius", target.Address, RadiusChecks(target))
+	for _, result := range report.Results {
+		t.Logf("%s: %t %s", result.Name, result.Passed, result.Detail)
+	}
+
+	for _, name := range []string{"Access-Request is answered", "Octets beyond Length are ignored", "Unknown attribute is ignored", "Accounting-Request with bad authenticator is discarded"} {
+		if !passed(report, name) {
+			t.Errorf("%s failed", name)
+		}
+	}
+
+	var text bytes.Buffer
+	if err := report.WriteText(&text); err != nil || !strings.Contains(text.String(), "PASS  Access-Request is answered") {
+		t.Errorf("bad text report %s", text.String())
+	}
+}
+
+func TestDiameterConformance(t *testing.T) {
+
+	r := router.NewRouter("testServer")
+	defer r.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	target := DiameterTarget{Address: "127.0.0.1:3868", OriginHost: "client.igorclient", OriginRealm: "igorclient", Timeout: 500 * time.Millisecond}
+	report := Run("diameter", target.Address, DiameterChecks(target))
+	for _, result := range report.Results {
+		t.Logf("%s: %t %s", result.Name, result.Passed, result.Detail)
+	}
+
+	for _, name := range []string{"CER is answered with successful CEA", "DWR is answered with DWA"} {
+		if !passed(report, name) {
+			t.Errorf("%s failed", name)
+		}
+	}
+}
+
+// Returns true if the check with the specified name passed
+func passed(report Report, name string) bool {
+	for _, result := range report.Results {
+		if result.Name == name {
+			return result.Passed
+		}
+	}
+	return false
+}
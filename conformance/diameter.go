@@ -0,0 +1,348 @@
+package conformance
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"igor/diamcodec"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// Diameter peer to be checked
+type DiameterTarget struct {
+	// IPAddress:Port
+	Address string
+
+	// Identity used in the connection
+	OriginHost  string
+	OriginRealm string
+
+	// Time to wait for an answer. When no answer is expected, the check waits this time
+	Timeout time.Duration
+
+	// If not zero, checks that the peer sends a DWR when the connection is idle for this time (Tw)
+	WatchdogInterval time.Duration
+}
+
+// Code of a non vendor specific AVP not defined, to check the treatment of unknown mandatory AVPs
+const UNKNOWN_DIAMETER_AVP_CODE = 0xFFFFF0
+
+// Returns the diameter checks for the target
+func DiameterChecks(target DiameterTarget) []Check {
+	checks := []Check{
+		{Name: "CER is answered with successful CEA", Reference: "RFC 6733 5.3", Run: target.checkCER},
+		{Name: "DWR is answered with DWA", Reference: "RFC 6733 5.5", Run: target.checkDWR},
+		{Name: "Unknown mandatory AVP is rejected with 5001", Reference: "RFC 6733 7.1.5", Run: target.checkUnknownMandatoryAVP},
+		{Name: "Unsupported version is rejected", Reference: "RFC 6733 7.1.5", Run: target.checkUnsupportedVersion},
+		{Name: "Invalid message length is rejected", Reference: "RFC 6733 7.1.5", Run: target.checkInvalidLength},
+		{Name: "DPR is answered with DPA", Reference: "RFC 6733 5.4", Run: target.checkDPR},
+	}
+	if target.WatchdogInterval > 0 {
+		checks = append(checks, Check{Name: "DWR is sent when the connection is idle", Reference: "RFC 3539 3.4.1", Run: target.checkWatchdog})
+	}
+	return checks
+}
+
+// Connection to the peer
+type diameterConn struct {
+	net.Conn
+	target DiameterTarget
+}
+
+// Opens a connection and performs the capabilities exchange, returning the CEA
+func (t DiameterTarget) connect() (*diameterConn, *diamcodec.DiameterMessage, error) {
+	conn, err := net.DialTimeout("tcp", t.Address, t.Timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	dc := &diameterConn{Conn: conn, target: t}
+
+	cer, err := t.request("Capabilities-Exchange")
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if host, _, err := net.SplitHostPort(conn.LocalAddr().String()); err == nil {
+		cer.Add("Host-IP-Address", host)
+	}
+	cer.Add("Vendor-Id", 0)
+	cer.Add("Product-Name", "igorconform")
+	cer.Add("Auth-Application-Id", "Relay")
+	cer.Add("Acct-Application-Id", "Relay")
+
+	cea, err := dc.exchange(cer)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("capabilities exchange: %w", err)
+	}
+	return dc, cea, nil
+}
+
+// Creates a base protocol request
+func (t DiameterTarget) request(commandName string) (*diamcodec.DiameterMessage, error) {
+	request, err := diamcodec.NewDiameterRequest("Base", commandName)
+	if err != nil {
+		return nil, err
+	}
+	request.Add("Origin-Host", t.OriginHost)
+	request.Add("Origin-Realm", t.OriginRealm)
+	return request, nil
+}
+
+// Sends the request and returns the answer
+func (dc *diameterConn) exchange(request *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, error) {
+	requestBytes, err := request.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return dc.exchangeBytes(requestBytes)
+}
+
+// Sends the serialized request and returns the answer
+func (dc *diameterConn) exchangeBytes(requestBytes []byte) (*diamcodec.DiameterMessage, error) {
+	if _, err := dc.Write(requestBytes); err != nil {
+		return nil, err
+	}
+	return dc.readAnswer(time.Now().Add(dc.target.Timeout))
+}
+
+// Reads messages until an answer is received, answering the watchdogs sent by the peer meanwhile
+func (dc *diameterConn) readAnswer(deadline time.Time) (*diamcodec.DiameterMessage, error) {
+	for {
+		message, err := dc.read(deadline)
+		if err != nil {
+			return nil, err
+		}
+		if !message.IsRequest {
+			return message, nil
+		}
+		if message.CommandName == "Device-Watchdog" {
+			if err := dc.answerWatchdog(message); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// Reads a message. The header is read first, so that the codec is given exactly the bytes of the message
+func (dc *diameterConn) read(deadline time.Time) (*diamcodec.DiameterMessage, error) {
+	dc.SetReadDeadline(deadline)
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(dc, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header) & 0xFFFFFF
+	if length < 20 {
+		return nil, fmt.Errorf("received message with length %d", length)
+	}
+	messageBytes := make([]byte, length)
+	copy(messageBytes, header)
+	if _, err := io.ReadFull(dc, messageBytes[4:]); err != nil {
+		return nil, err
+	}
+	message, _, err := diamcodec.DiameterMessageFromBytes(messageBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+func (dc *diameterConn) answerWatchdog(dwr *diamcodec.DiameterMessage) error {
+	dwa := diamcodec.NewDiameterAnswer(dwr)
+	dwa.Add("Origin-Host", dc.target.OriginHost)
+	dwa.Add("Origin-Realm", dc.target.OriginRealm)
+	dwa.Add("Result-Code", diamcodec.DIAMETER_SUCCESS)
+	dwaBytes, err := dwa.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = dc.Write(dwaBytes)
+	return err
+}
+
+// Returns true if the error means that the peer closed the connection
+func isClosed(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && !opErr.Timeout()
+}
+
+// Verifies the Result-Code of the answer
+func expectResultCode(answer *diamcodec.DiameterMessage, resultCodes ...int64) error {
+	resultCode := answer.GetResultCode()
+	for _, expected := range resultCodes {
+		if resultCode == expected {
+			return nil
+		}
+	}
+	return fmt.Errorf("unexpected Result-Code %d", resultCode)
+}
+
+// Returns the serialized DWR
+func (t DiameterTarget) dwrBytes() ([]byte, error) {
+	dwr, err := t.request("Device-Watchdog")
+	if err != nil {
+		return nil, err
+	}
+	return dwr.MarshalBinary()
+}
+
+// Expects that the serialized request is rejected with one of the result codes or the connection closed
+func (t DiameterTarget) expectRejected(modify func([]byte) []byte, resultCodes ...int64) error {
+	dc, _, err := t.connect()
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+
+	requestBytes, err := t.dwrBytes()
+	if err != nil {
+		return err
+	}
+	answer, err := dc.exchangeBytes(modify(requestBytes))
+	if err != nil {
+		if isClosed(err) {
+			return nil
+		}
+		return err
+	}
+	return expectResultCode(answer, resultCodes...)
+}
+
+func (t DiameterTarget) checkCER() error {
+	dc, cea, err := t.connect()
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+
+	if err := expectResultCode(cea, diamcodec.DIAMETER_SUCCESS); err != nil {
+		return err
+	}
+	for _, name := range []string{"Origin-Host", "Origin-Realm", "Host-IP-Address", "Vendor-Id", "Product-Name"} {
+		if _, err := cea.GetAVP(name); err != nil {
+			return fmt.Errorf("%s missing in CEA", name)
+		}
+	}
+	return nil
+}
+
+func (t DiameterTarget) checkDWR() error {
+	dc, _, err := t.connect()
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+
+	dwr, err := t.request("Device-Watchdog")
+	if err != nil {
+		return err
+	}
+	dwa, err := dc.exchange(dwr)
+	if err != nil {
+		return err
+	}
+	if dwa.HopByHopId != dwr.HopByHopId || dwa.E2EId != dwr.E2EId {
+		return errors.New("identifiers of the answer do not match the request")
+	}
+	return expectResultCode(dwa, diamcodec.DIAMETER_SUCCESS)
+}
+
+func (t DiameterTarget) checkUnknownMandatoryAVP() error {
+	dc, _, err := t.connect()
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+
+	requestBytes, err := t.dwrBytes()
+	if err != nil {
+		return err
+	}
+	// AVP with the mandatory bit set and 4 octets of data
+	avp := make([]byte, 12)
+	binary.BigEndian.PutUint32(avp[0:4], UNKNOWN_DIAMETER_AVP_CODE)
+	binary.BigEndian.PutUint32(avp[4:8], 12)
+	avp[4] = 0x40
+	requestBytes = setLength(append(requestBytes, avp...))
+
+	answer, err := dc.exchangeBytes(requestBytes)
+	if err != nil {
+		return err
+	}
+	if err := expectResultCode(answer, diamcodec.DIAMETER_AVP_UNSUPPORTED); err != nil {
+		return err
+	}
+	if _, err := answer.GetAVP("Failed-AVP"); err != nil {
+		return errors.New("Failed-AVP missing in answer")
+	}
+	return nil
+}
+
+func (t DiameterTarget) checkUnsupportedVersion() error {
+	return t.expectRejected(func(b []byte) []byte {
+		b[0] = 2
+		return b
+	}, diamcodec.DIAMETER_UNSUPPORTED_VERSION)
+}
+
+func (t DiameterTarget) checkInvalidLength() error {
+	// Length not multiple of 4
+	return t.expectRejected(func(b []byte) []byte {
+		return setLength(append(b, 0, 0))
+	}, diamcodec.DIAMETER_INVALID_MESSAGE_LENGTH, diamcodec.DIAMETER_INVALID_HDR_BITS)
+}
+
+func (t DiameterTarget) checkDPR() error {
+	dc, _, err := t.connect()
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+
+	dpr, err := t.request("Disconnect-Peer")
+	if err != nil {
+		return err
+	}
+	dpr.Add("Disconnect-Cause", "DoNotWantToTalkToYou")
+	dpa, err := dc.exchange(dpr)
+	if err != nil {
+		return err
+	}
+	return expectResultCode(dpa, diamcodec.DIAMETER_SUCCESS)
+}
+
+func (t DiameterTarget) checkWatchdog() error {
+	dc, _, err := t.connect()
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+
+	// Tw may be jittered up to 2 seconds
+	deadline := time.Now().Add(t.WatchdogInterval + 2*time.Second + t.Timeout)
+	for {
+		message, err := dc.read(deadline)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return fmt.Errorf("no DWR received in %s", t.WatchdogInterval)
+		}
+		if err != nil {
+			return err
+		}
+		if message.IsRequest && message.CommandName == "Device-Watchdog" {
+			return dc.answerWatchdog(message)
+		}
+	}
+}
+
+// Updates the length in the header of the serialized message
+func setLength(b []byte) []byte {
+	length := uint32(len(b))
+	b[1], b[2], b[3] = byte(length>>16), byte(length>>8), byte(length)
+	return b
+}
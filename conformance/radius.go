@@ -0,0 +1,195 @@
+package conformance
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"igor/radiuscodec"
+	"net"
+	"os"
+	"time"
+)
+
+// Radius server to be checked
+type RadiusTarget struct {
+	// IPAddress:Port
+	Address string
+	Secret  string
+
+	// Time to wait for a response. When no response is expected, the check waits this time
+	Timeout time.Duration
+
+	// Used in the requests
+	UserName string
+	Password string
+}
+
+// Unassigned attribute type, to check that unknown attributes are ignored
+const UNKNOWN_RADIUS_ATTRIBUTE = 250
+
+// Returns the radius checks for the target
+func RadiusChecks(target RadiusTarget) []Check {
+	return []Check{
+		{Name: "Access-Request is answered", Reference: "RFC 2865 4.1", Run: target.checkAccessRequest},
+		{Name: "Duplicate request gets the same response", Reference: "RFC 5080 2.2.2", Run: target.checkDuplicate},
+		{Name: "Octets beyond Length are ignored", Reference: "RFC 2865 3", Run: target.checkPadding},
+		{Name: "Packet shorter than Length is discarded", Reference: "RFC 2865 3", Run: target.checkTruncated},
+		{Name: "Length below minimum is discarded", Reference: "RFC 2865 3", Run: target.checkBelowMinimum},
+		{Name: "Unknown attribute is ignored", Reference: "RFC 2865 5", Run: target.checkUnknownAttribute},
+		{Name: "Accounting-Request with bad authenticator is discarded", Reference: "RFC 2866 3", Run: target.checkBadAccountingAuthenticator},
+	}
+}
+
+// Returns the serialized Access-Request
+func (t RadiusTarget) accessRequest(id byte) ([]byte, error) {
+	request := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+	request.Add("User-Name", t.UserName)
+	request.Add("User-Password", []byte(t.Password))
+	request.Add("NAS-IP-Address", "127.0.0.1")
+	return request.ToBytes(t.Secret, id)
+}
+
+// Sends the packets and waits for a response
+func (t RadiusTarget) exchange(packets ...[]byte) ([]byte, error) {
+	conn, err := net.Dial("udp", t.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	for _, packet := range packets {
+		if _, err := conn.Write(packet); err != nil {
+			return nil, err
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(t.Timeout))
+	buffer := make([]byte, 4096)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		return nil, err
+	}
+	return buffer[:n], nil
+}
+
+// Verifies that the response matches the request
+func (t RadiusTarget) validateResponse(request []byte, response []byte) error {
+	if len(response) < 20 {
+		return fmt.Errorf("response too short: %d octets", len(response))
+	}
+	if response[1] != request[1] {
+		return fmt.Errorf("identifier %d does not match the request %d", response[1], request[1])
+	}
+	var authenticator [16]byte
+	copy(authenticator[:], request[4:20])
+	if !radiuscodec.ValidateResponseAuthenticator(response, authenticator, t.Secret) {
+		return errors.New("bad response authenticator")
+	}
+	return nil
+}
+
+// Expects that the packet is not answered
+func (t RadiusTarget) expectDiscarded(packet []byte) error {
+	response, err := t.exchange(packet)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("answered with code %d", response[0])
+}
+
+func (t RadiusTarget) checkAccessRequest() error {
+	request, err := t.accessRequest(1)
+	if err != nil {
+		return err
+	}
+	response, err := t.exchange(request)
+	if err != nil {
+		return err
+	}
+	switch response[0] {
+	case radiuscodec.ACCESS_ACCEPT, radiuscodec.ACCESS_REJECT, radiuscodec.ACCESS_CHALLENGE:
+	default:
+		return fmt.Errorf("unexpected response code %d", response[0])
+	}
+	return t.validateResponse(request, response)
+}
+
+func (t RadiusTarget) checkDuplicate() error {
+	request, err := t.accessRequest(2)
+	if err != nil {
+		return err
+	}
+	first, err := t.exchange(request)
+	if err != nil {
+		return fmt.Errorf("original request: %w", err)
+	}
+	second, err := t.exchange(request)
+	if err != nil {
+		return fmt.Errorf("duplicate request: %w", err)
+	}
+	if !bytes.Equal(first, second) {
+		return errors.New("the responses are different")
+	}
+	return nil
+}
+
+func (t RadiusTarget) checkPadding() error {
+	request, err := t.accessRequest(3)
+	if err != nil {
+		return err
+	}
+	response, err := t.exchange(append(request, 0, 0, 0, 0))
+	if err != nil {
+		return err
+	}
+	return t.validateResponse(request, response)
+}
+
+func (t RadiusTarget) checkTruncated() error {
+	request, err := t.accessRequest(4)
+	if err != nil {
+		return err
+	}
+	return t.expectDiscarded(request[:len(request)-2])
+}
+
+func (t RadiusTarget) checkBelowMinimum() error {
+	request, err := t.accessRequest(5)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint16(request[2:4], 19)
+	return t.expectDiscarded(request)
+}
+
+func (t RadiusTarget) checkUnknownAttribute() error {
+	request, err := t.accessRequest(6)
+	if err != nil {
+		return err
+	}
+	// The authenticator of an Access-Request does not depend on the attributes
+	request = append(request, UNKNOWN_RADIUS_ATTRIBUTE, 6, 0, 0, 0, 1)
+	binary.BigEndian.PutUint16(request[2:4], uint16(len(request)))
+	response, err := t.exchange(request)
+	if err != nil {
+		return err
+	}
+	return t.validateResponse(request, response)
+}
+
+func (t RadiusTarget) checkBadAccountingAuthenticator() error {
+	request := radiuscodec.NewRadiusRequest(radiuscodec.ACCOUNTING_REQUEST)
+	request.Add("User-Name", t.UserName)
+	request.Add("Acct-Status-Type", "Start")
+	request.Add("Acct-Session-Id", "igorconform")
+	packet, err := request.ToBytes(t.Secret, 7)
+	if err != nil {
+		return err
+	}
+	packet[4] ^= 0xFF
+	return t.expectDiscarded(packet)
+}
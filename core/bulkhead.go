@@ -0,0 +1,126 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Limits the number of concurrent invocations of a handler, so that a slow or blocked one does not
+// exhaust the resources shared with the rest. The invocations above the maximum wait in a queue of
+// limited length, and are rejected if the queue is full or the timeout expires while waiting
+type Bulkhead struct {
+	maxConcurrency int
+	queueLength    int
+	timeout        time.Duration
+
+	slots chan struct{}
+	queue chan struct{}
+}
+
+// Creates a bulkhead. The timeout, if not zero, limits the time spent in the bulkhead, both waiting in
+// the queue and executing
+func NewBulkhead(maxConcurrency int, queueLength int, timeout time.Duration) *Bulkhead {
+	return &Bulkhead{
+		maxConcurrency: maxConcurrency,
+		queueLength:    queueLength,
+		timeout:        timeout,
+		slots:          make(chan struct{}, maxConcurrency),
+		queue:          make(chan struct{}, queueLength),
+	}
+}
+
+// Executes the function if there is a free slot before the deadline, which is shortened to the timeout of
+// the bulkhead. Returns ErrBulkheadFull if the function was not executed and ErrTimeout if it did not
+// finish before the deadline, in which case it keeps its slot until it finishes. A nil bulkhead executes
+// the function without limits
+func (b *Bulkhead) Execute(deadline time.Time, f func() error) error {
+	if b == nil {
+		return f()
+	}
+
+	if b.timeout > 0 {
+		if limit := time.Now().Add(b.timeout); deadline.IsZero() || limit.Before(deadline) {
+			deadline = limit
+		}
+	}
+
+	var timeoutChan <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeoutChan = timer.C
+	}
+
+	if err := b.acquire(timeoutChan); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() { <-b.slots }()
+		done <- f()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-timeoutChan:
+		return fmt.Errorf("%w: handler did not finish in time", ErrTimeout)
+	}
+}
+
+// Takes a slot, waiting in the queue if there is room and none is free
+func (b *Bulkhead) acquire(timeoutChan <-chan time.Time) error {
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	select {
+	case b.queue <- struct{}{}:
+	default:
+		return fmt.Errorf("%w: %d requests executing and %d waiting", ErrBulkheadFull, b.maxConcurrency, b.queueLength)
+	}
+	defer func() { <-b.queue }()
+
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	case <-timeoutChan:
+		return fmt.Errorf("%w: timeout waiting in queue", ErrBulkheadFull)
+	}
+}
+
+// Set of bulkheads, one per handler name, created on demand
+type Bulkheads struct {
+	sync.Mutex
+	bulkheads map[string]*Bulkhead
+}
+
+// Returns the bulkhead for the handler with the specified parameters, creating it if it does not exist
+// or the parameters have changed. Returns nil, meaning no limits, if maxConcurrency is not positive
+func (bs *Bulkheads) Get(name string, maxConcurrency int, queueLength int, timeout time.Duration) *Bulkhead {
+	if maxConcurrency <= 0 {
+		return nil
+	}
+	if queueLength < 0 {
+		queueLength = 0
+	}
+
+	bs.Lock()
+	defer bs.Unlock()
+
+	if bs.bulkheads == nil {
+		bs.bulkheads = make(map[string]*Bulkhead)
+	}
+	if b, found := bs.bulkheads[name]; found && b.maxConcurrency == maxConcurrency && b.queueLength == queueLength && b.timeout == timeout {
+		return b
+	}
+
+	// The invocations in progress in the old bulkhead, if any, finish there
+	b := NewBulkhead(maxConcurrency, queueLength, timeout)
+	bs.bulkheads[name] = b
+	return b
+}
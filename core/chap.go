@@ -0,0 +1,210 @@
+package core
+
+import (
+	"bytes"
+	"crypto/des"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+	"unicode/utf16"
+)
+
+// Verification of the CHAP (RFC 1994), MS-CHAP (RFC 2433) and MS-CHAPv2 (RFC 2759) credentials sent
+// in radius Access-Requests. The functions take the values of the attributes defined in RFC 2865 and
+// RFC 2548, so that they may be used from any handler. The passwords may be stored in cleartext or,
+// for MS-CHAP, as the NT hash, which is obtained from the cleartext with NTPasswordHash. The MPPE keys
+// are derived as specified in RFC 3079
+
+// Sizes of the attribute values
+const (
+	CHAP_PASSWORD_LEN     = 1 + 16
+	MSCHAP_RESPONSE_LEN   = 1 + 1 + 24 + 24
+	MSCHAP2_RESPONSE_LEN  = 1 + 1 + 16 + 8 + 24
+	MSCHAP_CHALLENGE_LEN  = 8
+	MSCHAP2_CHALLENGE_LEN = 16
+)
+
+// Flag in the MS-CHAP-Response signalling that the NT-Response is to be used
+const MSCHAP_USE_NT_RESPONSE = 1
+
+var (
+	magic1     = []byte("This is the MPPE Master Key")
+	magic2     = []byte("On the client side, this is the send key; on the server side, it is the receive key.")
+	magic3     = []byte("On the client side, this is the receive key; on the server side, it is the send key.")
+	signMagic1 = []byte("Magic server to client signing constant")
+	signMagic2 = []byte("Pad to make it do more than one iteration")
+)
+
+// Checks the value of the CHAP-Password attribute, made of the CHAP identifier and the response. The
+// challenge is the value of the CHAP-Challenge attribute or, if not present, the request authenticator
+func ValidateCHAPPassword(chapPassword []byte, challenge []byte, password string) bool {
+	if len(chapPassword) != CHAP_PASSWORD_LEN {
+		return false
+	}
+
+	hasher := md5.New()
+	hasher.Write(chapPassword[0:1])
+	hasher.Write([]byte(password))
+	hasher.Write(challenge)
+	return subtle.ConstantTimeCompare(hasher.Sum(nil), chapPassword[1:]) == 1
+}
+
+// Returns the MD4 of the password in UTF-16LE
+func NTPasswordHash(password string) []byte {
+	var unicodePassword []byte
+	for _, r := range utf16.Encode([]rune(password)) {
+		unicodePassword = append(unicodePassword, byte(r), byte(r>>8))
+	}
+	hash := md4Sum(unicodePassword)
+	return hash[:]
+}
+
+// Checks the value of the MS-CHAP-Response attribute against the MS-CHAP-Challenge. Only the NT-Response
+// is supported, since the LAN Manager one is obsolete
+func ValidateMSCHAPResponse(challenge []byte, response []byte, passwordHash []byte) bool {
+	if len(challenge) != MSCHAP_CHALLENGE_LEN || len(response) != MSCHAP_RESPONSE_LEN {
+		return false
+	}
+	if response[1]&MSCHAP_USE_NT_RESPONSE == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare(challengeResponse(challenge, passwordHash), response[26:50]) == 1
+}
+
+// Returns the NT-Response that the peer generates, given the challenges
+func MSCHAPv2NTResponse(authenticatorChallenge []byte, peerChallenge []byte, userName string, passwordHash []byte) []byte {
+	return challengeResponse(challengeHash(peerChallenge, authenticatorChallenge, userName), passwordHash)
+}
+
+// Outcome of a successful MS-CHAPv2 authentication
+type MSCHAPv2Result struct {
+	// The "S=" string that proves to the peer that the server knows the password
+	AuthenticatorResponse string
+
+	// MPPE keys, from the point of view of the server
+	SendKey []byte
+	RecvKey []byte
+}
+
+// Checks the NT-Response sent by the peer. If valid, returns the authenticator response and the keys
+func VerifyMSCHAPv2(authenticatorChallenge []byte, peerChallenge []byte, ntResponse []byte, userName string, passwordHash []byte) (MSCHAPv2Result, bool) {
+	hash := challengeHash(peerChallenge, authenticatorChallenge, userName)
+	if subtle.ConstantTimeCompare(challengeResponse(hash, passwordHash), ntResponse) != 1 {
+		return MSCHAPv2Result{}, false
+	}
+
+	masterKey := masterKey(passwordHash, ntResponse)
+	return MSCHAPv2Result{
+		AuthenticatorResponse: authenticatorResponse(passwordHash, ntResponse, hash),
+		SendKey:               asymmetricStartKey(masterKey, magic3),
+		RecvKey:               asymmetricStartKey(masterKey, magic2),
+	}, true
+}
+
+// Values of the attributes to send in the Access-Accept after a successful MS-CHAPv2 authentication
+type MSCHAPv2Attributes struct {
+	// MS-CHAP2-Success
+	Success []byte
+
+	// MS-MPPE-Send-Key and MS-MPPE-Recv-Key, with the length of the key prepended. The salt and
+	// the encryption are added by the radius codec
+	SendKey []byte
+	RecvKey []byte
+}
+
+// Checks the value of the MS-CHAP2-Response attribute against the MS-CHAP-Challenge and, if valid, returns
+// the values of the attributes to send in the Access-Accept. The user name is the value of User-Name
+func ValidateMSCHAPv2Response(challenge []byte, response []byte, userName string, passwordHash []byte) (MSCHAPv2Attributes, bool) {
+	if len(challenge) != MSCHAP2_CHALLENGE_LEN || len(response) != MSCHAP2_RESPONSE_LEN {
+		return MSCHAPv2Attributes{}, false
+	}
+
+	result, ok := VerifyMSCHAPv2(challenge, response[2:18], response[26:50], userName, passwordHash)
+	if !ok {
+		return MSCHAPv2Attributes{}, false
+	}
+
+	return MSCHAPv2Attributes{
+		Success: append([]byte{response[0]}, []byte(result.AuthenticatorResponse)...),
+		SendKey: append([]byte{byte(len(result.SendKey))}, result.SendKey...),
+		RecvKey: append([]byte{byte(len(result.RecvKey))}, result.RecvKey...),
+	}, true
+}
+
+// First 8 octets of the SHA1 of the challenges and the user name, without the domain
+func challengeHash(peerChallenge []byte, authenticatorChallenge []byte, userName string) []byte {
+	if i := strings.LastIndex(userName, "\\"); i >= 0 {
+		userName = userName[i+1:]
+	}
+
+	hasher := sha1.New()
+	hasher.Write(peerChallenge)
+	hasher.Write(authenticatorChallenge)
+	hasher.Write([]byte(userName))
+	return hasher.Sum(nil)[:8]
+}
+
+// Encrypts the challenge with DES, using each 7 octets of the zero padded password hash as key
+func challengeResponse(challenge []byte, passwordHash []byte) []byte {
+	zPasswordHash := make([]byte, 21)
+	copy(zPasswordHash, passwordHash)
+
+	response := make([]byte, 24)
+	for i := 0; i < 3; i++ {
+		block, _ := des.NewCipher(desKey(zPasswordHash[7*i : 7*i+7]))
+		block.Encrypt(response[8*i:], challenge)
+	}
+	return response
+}
+
+// Expands the 7 octets to a DES key of 8, inserting the (ignored) parity bits
+func desKey(key7 []byte) []byte {
+	key := make([]byte, 8)
+	key[0] = key7[0]
+	key[1] = key7[0]<<7 | key7[1]>>1
+	key[2] = key7[1]<<6 | key7[2]>>2
+	key[3] = key7[2]<<5 | key7[3]>>3
+	key[4] = key7[3]<<4 | key7[4]>>4
+	key[5] = key7[4]<<3 | key7[5]>>5
+	key[6] = key7[5]<<2 | key7[6]>>6
+	key[7] = key7[6] << 1
+	return key
+}
+
+func authenticatorResponse(passwordHash []byte, ntResponse []byte, challengeHash []byte) string {
+	passwordHashHash := md4Sum(passwordHash)
+
+	hasher := sha1.New()
+	hasher.Write(passwordHashHash[:])
+	hasher.Write(ntResponse)
+	hasher.Write(signMagic1)
+	digest := hasher.Sum(nil)
+
+	hasher = sha1.New()
+	hasher.Write(digest)
+	hasher.Write(challengeHash)
+	hasher.Write(signMagic2)
+	return "S=" + strings.ToUpper(hex.EncodeToString(hasher.Sum(nil)))
+}
+
+func masterKey(passwordHash []byte, ntResponse []byte) []byte {
+	passwordHashHash := md4Sum(passwordHash)
+
+	hasher := sha1.New()
+	hasher.Write(passwordHashHash[:])
+	hasher.Write(ntResponse)
+	hasher.Write(magic1)
+	return hasher.Sum(nil)[:16]
+}
+
+// Derives the 16 octets session key from the master key
+func asymmetricStartKey(masterKey []byte, magic []byte) []byte {
+	hasher := sha1.New()
+	hasher.Write(masterKey)
+	hasher.Write(bytes.Repeat([]byte{0x00}, 40))
+	hasher.Write(magic)
+	hasher.Write(bytes.Repeat([]byte{0xf2}, 40))
+	return hasher.Sum(nil)[:16]
+}
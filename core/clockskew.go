@@ -0,0 +1,32 @@
+package core
+
+import (
+	"time"
+)
+
+// Tolerated difference between the clock of a peer or radius client and the local one, if not
+// specified in the configuration. The timestamps in radius have a resolution of one second
+const DEFAULT_CLOCK_SKEW_TOLERANCE_MILLIS = 5000
+
+// Returns the difference between the clock of the peer and the local one, using the timestamp
+// reported by the peer for an event that happened the specified delay before the message was
+// received. Positive if the clock of the peer is ahead
+func ClockSkew(timestamp time.Time, received time.Time, delay time.Duration) time.Duration {
+	return timestamp.Sub(received.Add(-delay))
+}
+
+// Returns the duration to add to the timestamps sent by the peer to correct the skew, which is
+// zero if the correction is not enabled or the skew is within the tolerance
+func ClockSkewCorrection(skew time.Duration, toleranceMillis int, correct bool) time.Duration {
+	if !correct {
+		return 0
+	}
+	if toleranceMillis <= 0 {
+		toleranceMillis = DEFAULT_CLOCK_SKEW_TOLERANCE_MILLIS
+	}
+	tolerance := time.Duration(toleranceMillis) * time.Millisecond
+	if skew <= tolerance && skew >= -tolerance {
+		return 0
+	}
+	return -skew
+}
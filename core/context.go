@@ -0,0 +1,108 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The handlers receive a context.Context that carries the deadline of the request, is cancelled when the
+// requester gives up, and holds the trace metadata. The context is propagated to the http handlers using
+// the headers below
+
+// Name of the http header with the identifier of the trace the request belongs to
+const TRACE_ID_HEADER = "X-Igor-Trace-Id"
+
+// Name of the http header with the milliseconds left until the deadline of the request
+const TIMEOUT_HEADER = "X-Igor-Timeout-Millis"
+
+type contextKey int
+
+const traceIdKey contextKey = 0
+const instanceNameKey contextKey = 1
+
+// Returns a copy of the context with the specified trace identifier
+func WithTraceId(ctx context.Context, traceId string) context.Context {
+	return context.WithValue(ctx, traceIdKey, traceId)
+}
+
+// Returns the trace identifier stored in the context, or the empty string if there is none
+func TraceId(ctx context.Context) string {
+	if traceId, ok := ctx.Value(traceIdKey).(string); ok {
+		return traceId
+	}
+	return ""
+}
+
+// Returns a copy of the context with the name of the configuration instance handling the request,
+// used to label the metrics generated while processing it
+func WithInstanceName(ctx context.Context, instanceName string) context.Context {
+	return context.WithValue(ctx, instanceNameKey, instanceName)
+}
+
+// Returns the name of the configuration instance stored in the context, or the empty string if there is none
+func InstanceName(ctx context.Context) string {
+	if instanceName, ok := ctx.Value(instanceNameKey).(string); ok {
+		return instanceName
+	}
+	return ""
+}
+
+// Generates a random trace identifier, as 32 hex characters
+func NewTraceId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Returns the context with the trace identifier, generating a new one if the context did not have it
+func EnsureTraceId(ctx context.Context) context.Context {
+	if TraceId(ctx) != "" {
+		return ctx
+	}
+	return WithTraceId(ctx, NewTraceId())
+}
+
+// Returns the error to report when the context is done before the request is answered, which wraps
+// ErrTimeout if the deadline was exceeded
+func ContextError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("deadline exceeded: %w", ErrTimeout)
+	}
+	return fmt.Errorf("request cancelled: %w", ctx.Err())
+}
+
+// Returns the earliest of the deadline and that of the context, if any
+func EarliestDeadline(ctx context.Context, deadline time.Time) time.Time {
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		return ctxDeadline
+	}
+	return deadline
+}
+
+// Sets the headers that propagate the trace identifier and the deadline of the context
+func SetContextHeaders(ctx context.Context, header http.Header) {
+	if traceId := TraceId(ctx); traceId != "" {
+		header.Set(TRACE_ID_HEADER, traceId)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		header.Set(TIMEOUT_HEADER, strconv.FormatInt(time.Until(deadline).Milliseconds(), 10))
+	}
+}
+
+// Derives from the parent a context with the trace identifier and the deadline in the headers, if present.
+// The cancel function must always be invoked
+func ContextFromHeaders(parent context.Context, header http.Header) (context.Context, context.CancelFunc) {
+	ctx := parent
+	if traceId := header.Get(TRACE_ID_HEADER); traceId != "" {
+		ctx = WithTraceId(ctx, traceId)
+	}
+	if timeoutMillis, err := strconv.ParseInt(header.Get(TIMEOUT_HEADER), 10, 64); err == nil {
+		return context.WithTimeout(ctx, time.Duration(timeoutMillis)*time.Millisecond)
+	}
+	return context.WithCancel(ctx)
+}
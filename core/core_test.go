@@ -0,0 +1,267 @@
+package core
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestErrorClass(t *testing.T) {
+
+	wrapped := fmt.Errorf("request not sent: %w", ErrRouteNotFound)
+	if !errors.Is(wrapped, ErrRouteNotFound) || ErrorClass(wrapped) != "RouteNotFound" {
+		t.Errorf("bad class for wrapped error %s", ErrorClass(wrapped))
+	}
+	if ErrorClass(fmt.Errorf("outer: %w", fmt.Errorf("inner: %w", ErrTimeout))) != "Timeout" {
+		t.Errorf("bad class for doubly wrapped error")
+	}
+	if ErrorClass(errors.New("unknown")) != "Other" {
+		t.Errorf("bad class for unknown error")
+	}
+	if ErrorClass(nil) != "" {
+		t.Errorf("bad class for nil error")
+	}
+}
+
+func TestClockSkewCorrection(t *testing.T) {
+	received := time.Now()
+	skew := ClockSkew(received.Add(50*time.Second), received, 10*time.Second)
+	if skew != time.Minute {
+		t.Errorf("skew was %s", skew)
+	}
+	if correction := ClockSkewCorrection(skew, 0, true); correction != -time.Minute {
+		t.Errorf("correction was %s", correction)
+	}
+	if correction := ClockSkewCorrection(skew, 120000, true); correction != 0 {
+		t.Errorf("skew within tolerance corrected by %s", correction)
+	}
+	if correction := ClockSkewCorrection(skew, 0, false); correction != 0 {
+		t.Errorf("skew corrected by %s when not enabled", correction)
+	}
+}
+
+func TestCounters(t *testing.T) {
+	if v := CombineGigawords(100, 2); v != 2<<32+100 {
+		t.Errorf("combined value was %d", v)
+	}
+	if v := CombineGigawords(4294967295, 0); v != 4294967295 {
+		t.Errorf("combined value was %d", v)
+	}
+
+	if delta, rolledOver, reset := CounterDelta(100, 300, 32); delta != 200 || rolledOver || reset {
+		t.Errorf("bad increment %d %t %t", delta, rolledOver, reset)
+	}
+	if delta, rolledOver, reset := CounterDelta(4294967000, 100, 32); delta != 396 || !rolledOver || reset {
+		t.Errorf("bad roll over %d %t %t", delta, rolledOver, reset)
+	}
+	if delta, rolledOver, reset := CounterDelta(1000000, 100, 32); delta != 100 || rolledOver || !reset {
+		t.Errorf("bad reset %d %t %t", delta, rolledOver, reset)
+	}
+	if delta, rolledOver, reset := CounterDelta(1<<63+10, 5, 64); delta != 1<<63-5 || !rolledOver || reset {
+		t.Errorf("bad 64 bit roll over %d %t %t", delta, rolledOver, reset)
+	}
+}
+
+func TestBulkhead(t *testing.T) {
+
+	var bulkheads Bulkheads
+	if bulkheads.Get("unlimited", 0, 10, time.Second) != nil {
+		t.Errorf("bulkhead created without max concurrency")
+	}
+	b := bulkheads.Get("handler", 1, 1, 200*time.Millisecond)
+	if bulkheads.Get("handler", 1, 1, 200*time.Millisecond) != b {
+		t.Errorf("bulkhead not reused")
+	}
+
+	// Occupy the only slot and the only place in the queue
+	release := make(chan struct{})
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			results <- b.Execute(time.Time{}, func() error { <-release; return nil })
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if err := b.Execute(time.Time{}, func() error { return nil }); !errors.Is(err, ErrBulkheadFull) {
+		t.Errorf("expected bulkhead full but got %v", err)
+	}
+
+	// The one executing times out, the one in the queue is rejected
+	for i := 0; i < 2; i++ {
+		if err := <-results; !errors.Is(err, ErrTimeout) && !errors.Is(err, ErrBulkheadFull) {
+			t.Errorf("bad result %v", err)
+		}
+	}
+
+	// Once the blocked function finishes, the slot is available again
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+	if err := b.Execute(time.Time{}, func() error { return errors.New("handler error") }); err == nil || err.Error() != "handler error" {
+		t.Errorf("bad result after release %v", err)
+	}
+}
+
+func fromHex(s string) []byte {
+	b, _ := hex.DecodeString(s)
+	return b
+}
+
+func TestMD4(t *testing.T) {
+	vectors := map[string]string{
+		"":               "31d6cfe0d16ae931b73c59d7e0c089c0",
+		"abc":            "a448017aaf21d8525fc10ae87aa6729d",
+		"message digest": "d9130a8164549fe818874806e1c7014b",
+		"12345678901234567890123456789012345678901234567890123456789012345678901234567890": "e33b4ddc9c38f2199c3e7b164fcc0536",
+	}
+	for input, expected := range vectors {
+		if sum := md4Sum([]byte(input)); hex.EncodeToString(sum[:]) != expected {
+			t.Errorf("bad md4 of %q: %x", input, sum)
+		}
+	}
+}
+
+func TestCHAPPassword(t *testing.T) {
+	challenge := fromHex("0102030405060708090A0B0C0D0E0F10")
+	hasher := md5.New()
+	hasher.Write([]byte{7})
+	hasher.Write([]byte("secretPassword"))
+	hasher.Write(challenge)
+	chapPassword := append([]byte{7}, hasher.Sum(nil)...)
+
+	if !ValidateCHAPPassword(chapPassword, challenge, "secretPassword") {
+		t.Error("good CHAP password not validated")
+	}
+	if ValidateCHAPPassword(chapPassword, challenge, "badPassword") {
+		t.Error("bad CHAP password validated")
+	}
+	if ValidateCHAPPassword(chapPassword[:10], challenge, "secretPassword") {
+		t.Error("short CHAP password validated")
+	}
+}
+
+// Test vectors of RFC 2433, appendix B.2
+func TestMSCHAP(t *testing.T) {
+	passwordHash := NTPasswordHash("MyPw")
+	if !bytes.Equal(passwordHash, fromHex("FC156AF7EDCD6C0EDDE3337D427F4EAC")) {
+		t.Errorf("bad password hash %X", passwordHash)
+	}
+
+	challenge := fromHex("102DB5DF085D3041")
+	response := append([]byte{1, MSCHAP_USE_NT_RESPONSE}, make([]byte, 24)...)
+	response = append(response, fromHex("4E9D3C8F9CFD385D5BF4D3246791956CA4C351AB409A3D61")...)
+	if !ValidateMSCHAPResponse(challenge, response, passwordHash) {
+		t.Error("good MS-CHAP response not validated")
+	}
+	if ValidateMSCHAPResponse(challenge, response, NTPasswordHash("badPassword")) {
+		t.Error("bad MS-CHAP response validated")
+	}
+}
+
+// Test vectors of RFC 2759, section 9.2 and RFC 3079, section 3.5.3
+func TestMSCHAPv2(t *testing.T) {
+	authenticatorChallenge := fromHex("5B5D7C7D7B3F2F3E3C2C602132262628")
+	peerChallenge := fromHex("21402324255E262A28295F2B3A337C7E")
+
+	if hash := challengeHash(peerChallenge, authenticatorChallenge, "User"); !bytes.Equal(hash, fromHex("D02E4386BCE91226")) {
+		t.Errorf("bad challenge hash %X", hash)
+	}
+	passwordHash := NTPasswordHash("clientPass")
+	if !bytes.Equal(passwordHash, fromHex("44EBBA8D5312B8D611474411F56989AE")) {
+		t.Errorf("bad password hash %X", passwordHash)
+	}
+	ntResponse := MSCHAPv2NTResponse(authenticatorChallenge, peerChallenge, "DOMAIN\\User", passwordHash)
+	if !bytes.Equal(ntResponse, fromHex("82309ECD8D708B5EA08FAA3981CD83544233114A3D85D6DF")) {
+		t.Errorf("bad NT-Response %X", ntResponse)
+	}
+
+	// Attributes of the Access-Request
+	response := append([]byte{9, 0}, peerChallenge...)
+	response = append(response, make([]byte, 8)...)
+	response = append(response, ntResponse...)
+	if _, ok := ValidateMSCHAPv2Response(authenticatorChallenge, response, "User", NTPasswordHash("badPassword")); ok {
+		t.Error("bad MS-CHAPv2 response validated")
+	}
+	attributes, ok := ValidateMSCHAPv2Response(authenticatorChallenge, response, "User", passwordHash)
+	if !ok {
+		t.Fatal("good MS-CHAPv2 response not validated")
+	}
+	if string(attributes.Success) != "\x09S=407A5589115FD0D6209F510FE9C04566932CDA56" {
+		t.Errorf("bad MS-CHAP2-Success %q", attributes.Success)
+	}
+
+	// The vector is the send key of the server
+	if !bytes.Equal(attributes.SendKey, append([]byte{16}, fromHex("8B7CDC149B993A1BA118CB153F56DCCB")...)) {
+		t.Errorf("bad send key %X", attributes.SendKey)
+	}
+	if len(attributes.RecvKey) != 17 || attributes.RecvKey[0] != 16 {
+		t.Errorf("bad receive key %X", attributes.RecvKey)
+	}
+}
+
+func TestDuplicateCache(t *testing.T) {
+
+	cache := NewDuplicateCache(200*time.Millisecond, 2)
+	invocations := 0
+	handler := func() (interface{}, error) {
+		invocations++
+		return invocations, nil
+	}
+
+	if answer, isDuplicate, _ := cache.Execute("a", true, handler); isDuplicate || answer != 1 {
+		t.Errorf("first request %t, %v", isDuplicate, answer)
+	}
+	if answer, isDuplicate, _ := cache.Execute("a", true, handler); !isDuplicate || answer != 1 {
+		t.Errorf("duplicate request %t, %v", isDuplicate, answer)
+	}
+
+	// Without lookup, the handler is invoked and the answer replaced
+	if answer, isDuplicate, _ := cache.Execute("a", false, handler); isDuplicate || answer != 2 {
+		t.Errorf("request without lookup %t, %v", isDuplicate, answer)
+	}
+	if answer, _, _ := cache.Execute("a", true, handler); answer != 2 {
+		t.Errorf("replaced answer not returned %v", answer)
+	}
+
+	// The answers to failed requests are not kept
+	if _, _, err := cache.Execute("b", true, func() (interface{}, error) { return nil, ErrTimeout }); err == nil {
+		t.Errorf("error not returned")
+	}
+	if _, isDuplicate, _ := cache.Execute("b", true, handler); isDuplicate {
+		t.Errorf("failed request treated as duplicate")
+	}
+
+	// Size limit. The oldest entry is removed
+	cache.Execute("c", true, handler)
+	if cache.Len() != 2 {
+		t.Errorf("cache has %d entries", cache.Len())
+	}
+	if _, isDuplicate, _ := cache.Execute("a", true, handler); isDuplicate {
+		t.Errorf("oldest entry not removed")
+	}
+
+	// Expiration
+	time.Sleep(250 * time.Millisecond)
+	if cache.Len() != 0 {
+		t.Errorf("%d entries not expired", cache.Len())
+	}
+
+	// Retransmissions received while the original is being handled wait for its answer
+	gate := make(chan struct{})
+	go cache.Execute("d", true, func() (interface{}, error) {
+		<-gate
+		return "slow", nil
+	})
+	time.Sleep(20 * time.Millisecond)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(gate)
+	}()
+	if answer, isDuplicate, _ := cache.Execute("d", true, handler); !isDuplicate || answer != "slow" {
+		t.Errorf("concurrent duplicate %t, %v", isDuplicate, answer)
+	}
+}
@@ -0,0 +1,32 @@
+package core
+
+// Helpers for the volume counters in accounting messages. In radius, the octets are reported as 32 bit
+// values plus, optionally, the number of times the counter has wrapped in the Gigawords attributes. In
+// diameter they are 64 bit values. In both cases the counters are cumulative since the start of the
+// session, but may roll over or be reset if the NAS restarts
+
+// Returns the 64 bit value of a counter reported as the lower 32 bits and the gigawords
+func CombineGigawords(octets int64, gigawords int64) uint64 {
+	return uint64(uint32(gigawords))<<32 + uint64(uint32(octets))
+}
+
+// Returns the increment of a counter with the specified number of bits from the previous value to
+// the current one. A lower current value is interpreted as a roll over if the previous value was in
+// the upper half of the range of the counter and the current one is in the lower half, and as a reset,
+// in which case the counter started again from zero, otherwise
+func CounterDelta(previous uint64, current uint64, bits uint) (delta uint64, rolledOver bool, reset bool) {
+	if current >= previous {
+		return current - previous, false, false
+	}
+
+	if bits < 64 {
+		half := uint64(1) << (bits - 1)
+		if previous >= half && current < half {
+			return (uint64(1) << bits) - previous + current, true, false
+		}
+	} else if previous >= 1<<63 && current < 1<<63 {
+		return current - previous, true, false
+	}
+
+	return current, false, true
+}
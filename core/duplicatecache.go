@@ -0,0 +1,112 @@
+package core
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Maximum number of entries in a duplicate cache, if not specified
+const DEFAULT_DUPLICATE_CACHE_ENTRIES = 10000
+
+// Keeps the answers to the requests received, by a key that identifies the request, so that the
+// retransmissions are sent the same answer without being handled again. The retransmissions that
+// arrive while the original request is being handled wait for its answer. The entries expire after
+// a fixed time, and the oldest ones are removed when the maximum number is reached
+type DuplicateCache struct {
+	sync.Mutex
+
+	expiration time.Duration
+	maxEntries int
+
+	entries map[string]*duplicateEntry
+
+	// Entries in order of insertion, which is also the order of expiration
+	order *list.List
+}
+
+// Request being handled or already answered
+type duplicateEntry struct {
+	key     string
+	expires time.Time
+
+	// Closed when the handler returns
+	done chan struct{}
+
+	answer interface{}
+	err    error
+}
+
+// Creates a duplicate cache. If maxEntries is zero, a default value is used
+func NewDuplicateCache(expiration time.Duration, maxEntries int) *DuplicateCache {
+	if maxEntries <= 0 {
+		maxEntries = DEFAULT_DUPLICATE_CACHE_ENTRIES
+	}
+	return &DuplicateCache{
+		expiration: expiration,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*duplicateEntry),
+		order:      list.New(),
+	}
+}
+
+// Invokes the handler, unless lookup is true and there is a non expired entry for the key, in which case
+// the answer in that entry is returned, after waiting for it if the handler is still executing. The boolean
+// is true if the answer is that of a previous request. The answers are stored only if the handler does not
+// return an error, so that the retransmissions of requests that failed are handled again
+func (c *DuplicateCache) Execute(key string, lookup bool, handler func() (interface{}, error)) (interface{}, bool, error) {
+	now := time.Now()
+
+	c.Lock()
+	c.purge(now)
+	if entry, found := c.entries[key]; found && lookup {
+		c.Unlock()
+		<-entry.done
+		return entry.answer, true, entry.err
+	}
+	entry := &duplicateEntry{key: key, expires: now.Add(c.expiration), done: make(chan struct{})}
+	c.entries[key] = entry
+	c.order.PushBack(entry)
+	c.purge(now)
+	c.Unlock()
+
+	answer, err := handler()
+
+	entry.answer, entry.err = answer, err
+	if err != nil {
+		c.Lock()
+		if c.entries[key] == entry {
+			delete(c.entries, key)
+		}
+		c.Unlock()
+	}
+	close(entry.done)
+
+	return answer, false, err
+}
+
+// Returns the number of entries in the cache, including those being handled
+func (c *DuplicateCache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+
+	c.purge(time.Now())
+	return len(c.entries)
+}
+
+// Removes the expired entries and, if the maximum size has been exceeded, the oldest ones. Must be called
+// with the lock held
+func (c *DuplicateCache) purge(now time.Time) {
+	for front := c.order.Front(); front != nil; front = c.order.Front() {
+		entry := front.Value.(*duplicateEntry)
+		if len(c.entries) <= c.maxEntries && entry.expires.After(now) {
+			return
+		}
+		c.order.Remove(front)
+
+		// The key may have been reused by a newer entry
+		if c.entries[entry.key] == entry {
+			delete(c.entries, entry.key)
+		}
+	}
+}
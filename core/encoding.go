@@ -0,0 +1,182 @@
+package core
+
+import (
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Serialization formats for the payloads exchanged over http, such as the requests to the http
+// handlers and the session snapshots. JSON is the default. CBOR is more compact and cheaper to
+// generate and parse. The binary format, only available for the diameter messages, is the native
+// wire encoding wrapped in an envelope with metadata, and is the cheapest when forwarding between
+// igor instances
+
+const (
+	CONTENT_TYPE_JSON   = "application/json"
+	CONTENT_TYPE_CBOR   = "application/cbor"
+	CONTENT_TYPE_BINARY = "application/vnd.igor.binary"
+)
+
+// Version of the envelope of the binary format, which is written after the magic bytes
+const BINARY_ENVELOPE_VERSION = 1
+
+var binaryEnvelopeMagic = [2]byte{'I', 'G'}
+
+// Optionally implemented by the objects serialized in the binary format, to carry in the envelope
+// the data that is not part of the wire encoding
+type BinaryMetadataCarrier interface {
+	BinaryMetadata() map[string]string
+	SetBinaryMetadata(metadata map[string]string)
+}
+
+// Returned when the payload is not in one of the supported formats
+var ErrUnsupportedContentType = errors.New("unsupported content type")
+
+// Maps are decoded with string keys, as with JSON, so that the same code may process both
+var cborDecMode, _ = cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]interface{}(nil))}.DecMode()
+
+// Times are encoded with nanosecond precision, as with JSON, so that the timestamps used to order the
+// updates of the sessions are not truncated
+var cborEncMode, _ = cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+
+// Returns the content type for the encoding specified in the configuration, which may be
+// "json", "cbor", "binary" or empty, meaning json
+func ContentTypeFor(encoding string) (string, error) {
+	switch encoding {
+	case "json", "":
+		return CONTENT_TYPE_JSON, nil
+	case "cbor":
+		return CONTENT_TYPE_CBOR, nil
+	case "binary":
+		return CONTENT_TYPE_BINARY, nil
+	default:
+		return "", fmt.Errorf("encoding %s: %w", encoding, ErrUnsupportedContentType)
+	}
+}
+
+// Returns the supported content type corresponding to the value of a Content-Type or
+// Accept header, ignoring the parameters. An empty value means json
+func ParseContentType(headerValue string) (string, error) {
+	if headerValue == "" {
+		return CONTENT_TYPE_JSON, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(headerValue)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", headerValue, ErrUnsupportedContentType)
+	}
+	switch mediaType {
+	case CONTENT_TYPE_JSON, CONTENT_TYPE_CBOR, CONTENT_TYPE_BINARY:
+		return mediaType, nil
+	default:
+		return "", fmt.Errorf("%s: %w", mediaType, ErrUnsupportedContentType)
+	}
+}
+
+// Serializes the object in the specified format
+func Marshal(contentType string, v interface{}) ([]byte, error) {
+	switch contentType {
+	case CONTENT_TYPE_JSON:
+		return json.Marshal(v)
+	case CONTENT_TYPE_CBOR:
+		return cborEncMode.Marshal(v)
+	case CONTENT_TYPE_BINARY:
+		return marshalBinaryEnvelope(v)
+	default:
+		return nil, fmt.Errorf("%s: %w", contentType, ErrUnsupportedContentType)
+	}
+}
+
+// Parses the data in the specified format
+func Unmarshal(contentType string, data []byte, v interface{}) error {
+	switch contentType {
+	case CONTENT_TYPE_JSON:
+		return json.Unmarshal(data, v)
+	case CONTENT_TYPE_CBOR:
+		return cborDecMode.Unmarshal(data, v)
+	case CONTENT_TYPE_BINARY:
+		return unmarshalBinaryEnvelope(data, v)
+	default:
+		return fmt.Errorf("%s: %w", contentType, ErrUnsupportedContentType)
+	}
+}
+
+// The binary envelope is made of the magic bytes, the version, the number of metadata entries (one byte),
+// each one with the length of the key (one byte), the key, the length of the value (two bytes) and the
+// value, followed by the wire encoding of the object
+func marshalBinaryEnvelope(v interface{}) ([]byte, error) {
+	marshaler, ok := v.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("%T does not support %s: %w", v, CONTENT_TYPE_BINARY, ErrUnsupportedContentType)
+	}
+
+	var metadata map[string]string
+	if carrier, ok := v.(BinaryMetadataCarrier); ok {
+		metadata = carrier.BinaryMetadata()
+	}
+	if len(metadata) > 255 {
+		return nil, fmt.Errorf("too many metadata entries %d", len(metadata))
+	}
+
+	b := append(make([]byte, 0, 64), binaryEnvelopeMagic[0], binaryEnvelopeMagic[1], BINARY_ENVELOPE_VERSION, byte(len(metadata)))
+	for key, value := range metadata {
+		if len(key) > 255 || len(value) > 65535 {
+			return nil, fmt.Errorf("metadata entry %s too long", key)
+		}
+		b = append(b, byte(len(key)))
+		b = append(b, key...)
+		b = append(b, byte(len(value)>>8), byte(len(value)))
+		b = append(b, value...)
+	}
+
+	payload, err := marshaler.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append(b, payload...), nil
+}
+
+func unmarshalBinaryEnvelope(data []byte, v interface{}) error {
+	unmarshaler, ok := v.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return fmt.Errorf("%T does not support %s: %w", v, CONTENT_TYPE_BINARY, ErrUnsupportedContentType)
+	}
+
+	if len(data) < 4 || data[0] != binaryEnvelopeMagic[0] || data[1] != binaryEnvelopeMagic[1] {
+		return fmt.Errorf("bad binary envelope: %w", ErrMalformed)
+	}
+	if data[2] != BINARY_ENVELOPE_VERSION {
+		return fmt.Errorf("unsupported binary envelope version %d: %w", data[2], ErrMalformed)
+	}
+
+	metadata := make(map[string]string, data[3])
+	pos := 4
+	for i := 0; i < int(data[3]); i++ {
+		if pos >= len(data) || pos+1+int(data[pos])+2 > len(data) {
+			return fmt.Errorf("truncated binary envelope metadata: %w", ErrMalformed)
+		}
+		key := string(data[pos+1 : pos+1+int(data[pos])])
+		pos += 1 + len(key)
+		valueLen := int(binary.BigEndian.Uint16(data[pos:]))
+		pos += 2
+		if pos+valueLen > len(data) {
+			return fmt.Errorf("truncated binary envelope metadata: %w", ErrMalformed)
+		}
+		metadata[key] = string(data[pos : pos+valueLen])
+		pos += valueLen
+	}
+
+	if err := unmarshaler.UnmarshalBinary(data[pos:]); err != nil {
+		return err
+	}
+	if carrier, ok := v.(BinaryMetadataCarrier); ok {
+		carrier.SetBinaryMetadata(metadata)
+	}
+	return nil
+}
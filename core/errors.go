@@ -0,0 +1,53 @@
+package core
+
+import "errors"
+
+// Classes of errors returned by the router, peers, clients and handlers. The errors returned
+// by those modules wrap one of these, so that users may check the class with errors.Is
+var (
+	// The answer was not received in time, or there was no time left to send the request
+	ErrTimeout = errors.New("timeout")
+
+	// There is no peer or server in a state that allows sending the request
+	ErrNoPeerAvailable = errors.New("no peer available")
+
+	// There is no route for the request
+	ErrRouteNotFound = errors.New("route not found")
+
+	// The handler of the request failed or could not be invoked
+	ErrHandlerFailure = errors.New("handler failure")
+
+	// The message could not be decoded
+	ErrMalformed = errors.New("malformed message")
+
+	// The handler has reached its maximum concurrency and queue length
+	ErrBulkheadFull = errors.New("bulkhead full")
+
+	// The request exceeds the rate allowed
+	ErrRateLimited = errors.New("rate limit exceeded")
+)
+
+// Returns the name of the class of the error, to be used as label in metrics and logs.
+// Empty if the error is nil, and "Other" if it does not belong to any of the known classes
+func ErrorClass(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrTimeout):
+		return "Timeout"
+	case errors.Is(err, ErrNoPeerAvailable):
+		return "NoPeerAvailable"
+	case errors.Is(err, ErrRouteNotFound):
+		return "RouteNotFound"
+	case errors.Is(err, ErrHandlerFailure):
+		return "HandlerFailure"
+	case errors.Is(err, ErrMalformed):
+		return "Malformed"
+	case errors.Is(err, ErrBulkheadFull):
+		return "BulkheadFull"
+	case errors.Is(err, ErrRateLimited):
+		return "RateLimited"
+	default:
+		return "Other"
+	}
+}
@@ -0,0 +1,36 @@
+package core
+
+import "time"
+
+// Simple token bucket. Filled at a rate of "rate" tokens per second, up to "rate" tokens.
+// Not thread safe
+type TokenBucket struct {
+	rate       int
+	tokens     float64
+	lastRefill time.Time
+}
+
+// Creates a full token bucket
+func NewTokenBucket(rate int, now time.Time) *TokenBucket {
+	return &TokenBucket{rate: rate, tokens: float64(rate), lastRefill: now}
+}
+
+// Returns the number of tokens per second
+func (tb *TokenBucket) Rate() int {
+	return tb.rate
+}
+
+// Tries to take one token from the bucket
+func (tb *TokenBucket) Take(now time.Time) bool {
+	tb.tokens += now.Sub(tb.lastRefill).Seconds() * float64(tb.rate)
+	if tb.tokens > float64(tb.rate) {
+		tb.tokens = float64(tb.rate)
+	}
+	tb.lastRefill = now
+
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
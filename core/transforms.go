@@ -0,0 +1,38 @@
+package core
+
+import (
+	"sync"
+)
+
+// Registry of custom message transformations. They are compiled in and registered by name, typically in
+// the init function of the package that implements them, and then selected for each deployment in the
+// ingress and egress lists of the transforms.json configuration object.
+//
+// The transformations are functions that modify the message in place, such as
+// func(*diamcodec.DiameterMessage) error for the diameter router. The type is checked when applied
+
+var transformsMutex sync.RWMutex
+var transforms = make(map[string]interface{})
+
+// Registers a transformation with the specified name. Panics if the name is already used
+func RegisterTransform(name string, transform interface{}) {
+	transformsMutex.Lock()
+	defer transformsMutex.Unlock()
+
+	if transform == nil {
+		panic("nil transform " + name)
+	}
+	if _, found := transforms[name]; found {
+		panic("transform " + name + " already registered")
+	}
+	transforms[name] = transform
+}
+
+// Returns the transformation registered with the specified name
+func GetTransform(name string) (interface{}, bool) {
+	transformsMutex.RLock()
+	defer transformsMutex.RUnlock()
+
+	transform, found := transforms[name]
+	return transform, found
+}
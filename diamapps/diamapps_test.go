@@ -0,0 +1,482 @@
+package diamapps
+
+import (
+	"bytes"
+	"errors"
+	"igor/config"
+	"igor/diamcodec"
+	"igor/milenage"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+
+	// Initialize the Config Object
+	config.InitPolicyConfigInstance("resources/searchRules.json", "testServer", true)
+
+	// Execute the tests and exit
+	os.Exit(m.Run())
+}
+
+func TestRfSession(t *testing.T) {
+
+	session := NewRfSession(config.GetPolicyConfig(), "igorsuperserver")
+
+	if _, err := session.NewACR(INTERIM_RECORD); !errors.Is(err, ErrInvalidRecordSequence) {
+		t.Errorf("interim record allowed before start")
+	}
+
+	start, err := session.NewACR(START_RECORD)
+	if err != nil {
+		t.Fatalf("could not generate start record %s", err)
+	}
+	if start.GetIntAVP("Accounting-Record-Number") != 0 || start.GetStringAVP("Accounting-Record-Type") != "START_RECORD" {
+		t.Errorf("bad start record %s", start)
+	}
+	if start.GetStringAVP("Session-Id") != session.SessionId || start.GetStringAVP("Destination-Realm") != "igorsuperserver" {
+		t.Errorf("bad start record %s", start)
+	}
+
+	// Answer sets the interim interval
+	aca := diamcodec.NewDiameterAnswer(start)
+	aca.Add("Session-Id", session.SessionId)
+	aca.Add("Result-Code", diamcodec.DIAMETER_SUCCESS)
+	aca.Add("Acct-Interim-Interval", 60)
+	if err := session.ProcessACA(aca); err != nil {
+		t.Errorf("error processing answer %s", err)
+	}
+	if session.InterimInterval != 60*time.Second {
+		t.Errorf("bad interim interval %s", session.InterimInterval)
+	}
+	if session.IsInterimDue(time.Now()) || !session.IsInterimDue(time.Now().Add(61*time.Second)) {
+		t.Errorf("bad interim due time")
+	}
+
+	interim, _ := session.NewACR(INTERIM_RECORD)
+	stop, _ := session.NewACR(STOP_RECORD)
+	if interim.GetIntAVP("Accounting-Record-Number") != 1 || stop.GetIntAVP("Accounting-Record-Number") != 2 {
+		t.Errorf("bad record numbers")
+	}
+	if _, err := session.NewACR(INTERIM_RECORD); !errors.Is(err, ErrInvalidRecordSequence) {
+		t.Errorf("interim record allowed after stop")
+	}
+	if !session.NextInterimTime().IsZero() {
+		t.Errorf("interim time after stop")
+	}
+}
+
+func TestACRBuffer(t *testing.T) {
+
+	buffer := NewACRBuffer(2)
+	session := NewRfSession(config.GetPolicyConfig(), "igorsuperserver")
+	start, _ := session.NewACR(START_RECORD)
+	stop, _ := session.NewACR(STOP_RECORD)
+
+	buffer.Store(start)
+	buffer.Store(stop)
+	if err := buffer.Store(stop); !errors.Is(err, ErrBufferFull) {
+		t.Errorf("expected buffer full")
+	}
+
+	// Failure in the second record
+	failSend := func(acr *diamcodec.DiameterMessage) error {
+		if acr.GetStringAVP("Accounting-Record-Type") == "STOP_RECORD" {
+			return errors.New("cdf unreachable")
+		}
+		return nil
+	}
+	if sent, err := buffer.Flush(failSend); sent != 1 || err == nil || buffer.Len() != 1 {
+		t.Errorf("bad flush result %d %s %d", sent, err, buffer.Len())
+	}
+
+	if sent, err := buffer.Flush(func(acr *diamcodec.DiameterMessage) error { return nil }); sent != 1 || err != nil || buffer.Len() != 0 {
+		t.Errorf("bad flush result %d %s %d", sent, err, buffer.Len())
+	}
+	if !start.IsRetransmission || !stop.IsRetransmission {
+		t.Errorf("T flag not set in buffered records")
+	}
+}
+
+func TestShCxRequests(t *testing.T) {
+
+	ci := config.GetPolicyConfig()
+
+	udr, err := NewUDR(ci, "ims.igor", "sip:user@ims.igor", DR_REPOSITORY_DATA, DR_IMS_USER_STATE)
+	if err != nil {
+		t.Fatalf("error building UDR %s", err)
+	}
+	if udr.ApplicationId != 16777217 || udr.CommandCode != 306 {
+		t.Errorf("bad UDR header %d %d", udr.ApplicationId, udr.CommandCode)
+	}
+	if udr.GetStringAVP("3GPP-User-Identity.3GPP-Public-Identity") != "sip:user@ims.igor" {
+		t.Errorf("bad User-Identity in %s", udr)
+	}
+	if udr.GetIntAVP("Vendor-Specific-Application-Id.Vendor-Id") != VENDOR_3GPP || udr.GetIntAVP("Vendor-Specific-Application-Id.Auth-Application-Id") != 16777217 {
+		t.Errorf("bad Vendor-Specific-Application-Id in %s", udr)
+	}
+	if len(udr.GetAllAVP("3GPP-Data-Reference")) != 2 {
+		t.Errorf("bad Data-Reference in %s", udr)
+	}
+
+	sar, err := NewSAR(ci, "ims.igor", "user@ims.igor", "sip:user@ims.igor", "sip:scscf.ims.igor", SAT_REGISTRATION)
+	if err != nil {
+		t.Fatalf("error building SAR %s", err)
+	}
+	if sar.CommandCode != 301 || sar.GetStringAVP("3GPP-Server-Assignment-Type") != "REGISTRATION" {
+		t.Errorf("bad SAR %s", sar)
+	}
+
+	mar, err := NewMAR(ci, "ims.igor", "user@ims.igor", "sip:user@ims.igor", "sip:scscf.ims.igor", "Digest-AKAv1-MD5", 1)
+	if err != nil {
+		t.Fatalf("error building MAR %s", err)
+	}
+	if mar.CommandCode != 303 || mar.GetStringAVP("3GPP-SIP-Auth-Data-Item.3GPP-SIP-Authentication-Scheme") != "Digest-AKAv1-MD5" {
+		t.Errorf("bad MAR %s", mar)
+	}
+
+	// Serialization roundtrip
+	b, err := mar.MarshalBinary()
+	if err != nil {
+		t.Fatalf("error serializing MAR %s", err)
+	}
+	if _, _, err := diamcodec.DiameterMessageFromBytes(b); err != nil {
+		t.Errorf("error parsing MAR %s", err)
+	}
+
+	// Experimental result
+	answer := diamcodec.NewDiameterAnswer(sar)
+	experimentalResult, _ := diamcodec.NewAVP("Experimental-Result", nil)
+	vendorId, _ := diamcodec.NewAVP("Vendor-Id", VENDOR_3GPP)
+	resultCode, _ := diamcodec.NewAVP("Experimental-Result-Code", 5001)
+	experimentalResult.AddAVP(*vendorId).AddAVP(*resultCode)
+	answer.AddAVP(experimentalResult)
+	if GetIMSResultCode(answer) != 5001 {
+		t.Errorf("bad experimental result code %d", GetIMSResultCode(answer))
+	}
+}
+
+func TestUserDataDocuments(t *testing.T) {
+
+	userState := 1
+	shData := ShData{
+		PublicIdentifiers: &PublicIdentifiers{IMSPublicIdentity: []string{"sip:user@ims.igor"}},
+		RepositoryData:    []RepositoryData{{ServiceIndication: "igorService", SequenceNumber: 3, ServiceData: &ServiceData{Content: "<value>1</value>"}}},
+		ShIMSData:         &ShIMSData{SCSCFName: "sip:scscf.ims.igor", IMSUserState: &userState},
+	}
+
+	pur, err := NewPUR(config.GetPolicyConfig(), "ims.igor", "sip:user@ims.igor", DR_REPOSITORY_DATA, &shData)
+	if err != nil {
+		t.Fatalf("error building PUR %s", err)
+	}
+	parsed, err := GetShData(pur)
+	if err != nil {
+		t.Fatalf("error parsing Sh-Data %s", err)
+	}
+	if parsed.PublicIdentifiers.IMSPublicIdentity[0] != "sip:user@ims.igor" || parsed.RepositoryData[0].SequenceNumber != 3 ||
+		parsed.RepositoryData[0].ServiceData.Content != "<value>1</value>" || *parsed.ShIMSData.IMSUserState != 1 {
+		t.Errorf("bad parsed Sh-Data %+v", parsed)
+	}
+
+	subscription, err := ParseIMSSubscription([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<IMSSubscription><PrivateID>user@ims.igor</PrivateID><ServiceProfile><PublicIdentity><Identity>sip:user@ims.igor</Identity></PublicIdentity>
+<InitialFilterCriteria><Priority>0</Priority></InitialFilterCriteria></ServiceProfile></IMSSubscription>`))
+	if err != nil {
+		t.Fatalf("error parsing IMSSubscription %s", err)
+	}
+	if subscription.PrivateID != "user@ims.igor" || subscription.ServiceProfile[0].PublicIdentity[0].Identity != "sip:user@ims.igor" ||
+		subscription.ServiceProfile[0].InitialFilterCriteria[0].Content != "<Priority>0</Priority>" {
+		t.Errorf("bad parsed IMSSubscription %+v", subscription)
+	}
+}
+
+func TestGySession(t *testing.T) {
+
+	ci := config.GetPolicyConfig()
+	session := NewGySession(ci, "igorsuperserver", SubscriptionId{Type: SUBSCRIPTION_ID_E164, Data: "34600000000"})
+
+	if _, err := session.NewCCRUpdate(); !errors.Is(err, ErrInvalidRequestSequence) {
+		t.Errorf("update request allowed before initial")
+	}
+
+	ccri, err := session.NewCCRInitial(MultipleServicesCreditControl{RatingGroup: 100, Requested: &ServiceUnit{}})
+	if err != nil {
+		t.Fatalf("could not generate initial request %s", err)
+	}
+	if ccri.GetStringAVP("CC-Request-Type") != "Initial" || ccri.GetIntAVP("CC-Request-Number") != 0 {
+		t.Errorf("bad initial request %s", ccri)
+	}
+	if v := ccri.GetStringAVP("Subscription-Id.Subscription-Id-Data"); v != "34600000000" {
+		t.Errorf("bad Subscription-Id-Data %s", v)
+	}
+
+	// The server side parses the request and grants quota
+	ccr, err := ParseCCR(ccri)
+	if err != nil {
+		t.Fatalf("could not parse request %s", err)
+	}
+	if len(ccr.Services) != 1 || ccr.Services[0].RatingGroup != 100 || ccr.Services[0].Requested == nil || len(ccr.SubscriptionIds) != 1 {
+		t.Fatalf("bad parsed request %v", ccr)
+	}
+	granted := CreditControlAnswer{
+		ResultCode: diamcodec.DIAMETER_SUCCESS,
+		Services: []MultipleServicesCreditControl{{
+			RatingGroup:     100,
+			Granted:         &ServiceUnit{TotalOctets: 1000000, Time: 3600},
+			ValidityTime:    600,
+			ResultCode:      diamcodec.DIAMETER_SUCCESS,
+			HasFinalUnit:    true,
+			FinalUnitAction: FINAL_UNIT_TERMINATE,
+		}},
+	}
+	answer, err := granted.ToDiameter(ci, ccri)
+	if err != nil {
+		t.Fatalf("could not build answer %s", err)
+	}
+
+	// Serialize and decode, as received from the network
+	var buffer bytes.Buffer
+	answer.WriteTo(&buffer)
+	decoded, _, _ := diamcodec.DiameterMessageFromBytes(buffer.Bytes())
+	cca, err := session.ProcessCCA(&decoded)
+	if err != nil {
+		t.Fatalf("error processing answer %s", err)
+	}
+	if cca.RequestType != CC_INITIAL_REQUEST || len(cca.Services) != 1 {
+		t.Fatalf("bad parsed answer %v", cca)
+	}
+	if service := cca.Services[0]; service.Granted.TotalOctets != 1000000 || service.Granted.Time != 3600 || service.ValidityTime != 600 || !service.HasFinalUnit || service.FinalUnitAction != FINAL_UNIT_TERMINATE {
+		t.Errorf("bad granted service %v", service)
+	}
+
+	ccru, _ := session.NewCCRUpdate(MultipleServicesCreditControl{RatingGroup: 100, Used: &ServiceUnit{InputOctets: 1000, OutputOctets: 2000, TotalOctets: 1<<63 + 1}, Requested: &ServiceUnit{}})
+	ccrt, _ := session.NewCCRTermination(1, MultipleServicesCreditControl{RatingGroup: 100, Used: &ServiceUnit{InputOctets: 500}})
+	if ccru.GetIntAVP("CC-Request-Number") != 1 || ccrt.GetIntAVP("CC-Request-Number") != 2 || ccrt.GetStringAVP("CC-Request-Type") != "Termination" {
+		t.Errorf("bad request numbers or types")
+	}
+	if v := ccru.GetStringAVP("Multiple-Services-Credit-Control.Used-Service-Unit.CC-Output-Octets"); v != "2000" {
+		t.Errorf("bad used octets %s", v)
+	}
+	if parsed, err := ParseCCR(ccru); err != nil || parsed.Services[0].Used.TotalOctets != 1<<63+1 {
+		t.Errorf("bad parsed used octets %v %v", parsed, err)
+	}
+	if _, err := session.NewCCRUpdate(); !errors.Is(err, ErrInvalidRequestSequence) {
+		t.Errorf("update request allowed after termination")
+	}
+
+	// Validation against the dictionary
+	answer.Add("CC-Request-Number", 5)
+	if _, err := ParseCCA(answer); err == nil {
+		t.Errorf("answer with duplicated CC-Request-Number accepted")
+	}
+	answer.DeleteAllAVP("CC-Request-Number")
+	if _, err := ParseCCA(answer); err == nil {
+		t.Errorf("answer without CC-Request-Number accepted")
+	}
+}
+
+// Answers the Re-Auth requests as a PCEF would
+type pcefRouter struct {
+	resultCode int64
+}
+
+func (r *pcefRouter) RouteDiameterRequest(request *diamcodec.DiameterMessage, timeout time.Duration) (*diamcodec.DiameterMessage, error) {
+	decision := GetPolicyDecision(request)
+	report := PolicyReport{}
+	for _, install := range decision.Install {
+		for _, definition := range install.Definitions {
+			report.RuleReports = append(report.RuleReports, ChargingRuleReport{Names: []string{definition.Name}, Status: PCC_RULE_ACTIVE})
+		}
+	}
+	return NewGxRAA(config.GetPolicyConfig(), request, r.resultCode, &report)
+}
+
+func TestGxPolicy(t *testing.T) {
+
+	ci := config.GetPolicyConfig()
+
+	// Request from the PCEF, with usage report
+	ccr, _ := diamcodec.NewDiameterRequest("Gx", "Credit-Control")
+	ccr.Add("Session-Id", "gx-session-1")
+	ccr.AddOriginAVPs(ci)
+	ccr.Add("Destination-Realm", "igorsuperserver")
+	ccr.Add("Destination-Host", "superserver.igorsuperserver")
+	ccr.Add("Auth-Application-Id", ccr.ApplicationId)
+	ccr.Add("CC-Request-Type", CC_UPDATE_REQUEST)
+	ccr.Add("CC-Request-Number", 1)
+	(&PolicyReport{
+		EventTriggers:   []int{EVENT_TRIGGER_USAGE_REPORT},
+		UsageMonitoring: []UsageMonitoringInformation{{MonitoringKey: "mk-1", Used: &ServiceUnit{TotalOctets: 5000}, Level: USAGE_MONITORING_SESSION_LEVEL}},
+	}).AddTo(ccr)
+	if err := ccr.Validate(); err != nil {
+		t.Fatalf("invalid request %s", err)
+	}
+
+	report := GetPolicyReport(ccr)
+	if len(report.EventTriggers) != 1 || report.EventTriggers[0] != EVENT_TRIGGER_USAGE_REPORT || len(report.UsageMonitoring) != 1 {
+		t.Fatalf("bad report %v", report)
+	}
+	if umi := report.UsageMonitoring[0]; umi.MonitoringKey != "mk-1" || umi.Used.TotalOctets != 5000 || umi.Level != USAGE_MONITORING_SESSION_LEVEL {
+		t.Errorf("bad usage monitoring information %v", umi)
+	}
+
+	// Answer from the PCRF
+	activationTime := time.Now().Add(time.Hour).Truncate(time.Second)
+	decision := PolicyDecision{
+		EventTriggers: []int{EVENT_TRIGGER_USAGE_REPORT, EVENT_TRIGGER_RAT_CHANGE},
+		Install: []ChargingRuleInstall{{
+			Definitions: []ChargingRuleDefinition{{
+				Name:             "rule-1",
+				RatingGroup:      100,
+				Precedence:       10,
+				MonitoringKey:    "mk-1",
+				FlowDescriptions: []string{"permit out ip from any to any", "permit in ip from any to any"},
+			}},
+			BaseNames:      []string{"base-1"},
+			ActivationTime: activationTime,
+		}},
+		Remove:          []ChargingRuleRemove{{Names: []string{"rule-0"}}},
+		UsageMonitoring: []UsageMonitoringInformation{{MonitoringKey: "mk-1", Granted: &ServiceUnit{TotalOctets: 10000}, Level: USAGE_MONITORING_PCC_RULE_LEVEL, ReportRequired: true}},
+	}
+	answer, err := NewGxCCA(ci, ccr, diamcodec.DIAMETER_SUCCESS, &decision)
+	if err != nil {
+		t.Fatalf("could not build answer %s", err)
+	}
+	if _, err := answer.GetAVP("3GPP-Usage-Monitoring-Information.3GPP-Usage-Monitoring-Level"); err == nil {
+		t.Errorf("default Usage-Monitoring-Level included")
+	}
+
+	// Serialize and decode, as received from the network
+	var buffer bytes.Buffer
+	answer.WriteTo(&buffer)
+	decoded, _, _ := diamcodec.DiameterMessageFromBytes(buffer.Bytes())
+	received := GetPolicyDecision(&decoded)
+	if len(received.EventTriggers) != 2 || len(received.Install) != 1 || len(received.Remove) != 1 || received.Remove[0].Names[0] != "rule-0" {
+		t.Fatalf("bad decision %v", received)
+	}
+	install := received.Install[0]
+	if !install.ActivationTime.Equal(activationTime) || len(install.BaseNames) != 1 || install.BaseNames[0] != "base-1" || len(install.Definitions) != 1 {
+		t.Fatalf("bad charging rule install %v", install)
+	}
+	if definition := install.Definitions[0]; definition.Name != "rule-1" || definition.RatingGroup != 100 || definition.Precedence != 10 || definition.MonitoringKey != "mk-1" || len(definition.FlowDescriptions) != 2 {
+		t.Errorf("bad charging rule definition %v", definition)
+	}
+	if umi := received.UsageMonitoring[0]; umi.Granted.TotalOctets != 10000 || umi.Level != USAGE_MONITORING_PCC_RULE_LEVEL || !umi.ReportRequired {
+		t.Errorf("bad usage monitoring information %v", umi)
+	}
+
+	// Re-Auth
+	rar, err := NewGxRAR(ci, "gx-session-1", "client.igorclient", "igorclient", &decision)
+	if err != nil {
+		t.Fatalf("could not build re-auth request %s", err)
+	}
+	if rar.GetStringAVP("Re-Auth-Request-Type") != "AUTHORIZE_ONLY" || rar.GetStringAVP("Destination-Host") != "client.igorclient" {
+		t.Errorf("bad re-auth request %s", rar)
+	}
+	raaReport, err := SendGxRAR(&pcefRouter{resultCode: diamcodec.DIAMETER_SUCCESS}, ci, "gx-session-1", "client.igorclient", "igorclient", &decision, time.Second)
+	if err != nil {
+		t.Fatalf("re-auth error %s", err)
+	}
+	if len(raaReport.RuleReports) != 1 || raaReport.RuleReports[0].Names[0] != "rule-1" || raaReport.RuleReports[0].Status != PCC_RULE_ACTIVE {
+		t.Errorf("bad re-auth report %v", raaReport)
+	}
+	if _, err := SendGxRAR(&pcefRouter{resultCode: DIAMETER_USER_UNKNOWN}, ci, "gx-session-1", "client.igorclient", "igorclient", &decision, time.Second); err == nil {
+		t.Errorf("unsuccessful re-auth answer accepted")
+	}
+}
+
+func TestS6a(t *testing.T) {
+
+	ci := config.GetPolicyConfig()
+	plmnId := []byte{0x21, 0xf3, 0x54}
+	subscriber := HSSSubscriber{
+		IMSI: "214010000000001",
+		K:    []byte{0x46, 0x5b, 0x5c, 0xe8, 0xb1, 0x99, 0xb4, 0x9f, 0xaa, 0x5f, 0x0a, 0x2e, 0xe2, 0x38, 0xa6, 0xbc},
+		OPc:  []byte{0xcd, 0x63, 0xcb, 0x71, 0x95, 0x4a, 0x9f, 0x4e, 0x48, 0xa5, 0x99, 0x4e, 0x37, 0xa0, 0x2b, 0xaf},
+		AMF:  []byte{0x80, 0x00},
+		SQN:  100,
+	}
+
+	air, err := NewAIR(ci, "igorsuperserver", subscriber.IMSI, plmnId, 2, nil)
+	if err != nil {
+		t.Fatalf("could not build AIR %s", err)
+	}
+	if err := air.Validate(); err != nil {
+		t.Fatalf("invalid AIR %s", err)
+	}
+	aia, err := subscriber.AnswerAIR(ci, air)
+	if err != nil {
+		t.Fatalf("could not answer AIR %s", err)
+	}
+
+	// Serialize and decode, as received from the network
+	var buffer bytes.Buffer
+	aia.WriteTo(&buffer)
+	decoded, _, _ := diamcodec.DiameterMessageFromBytes(buffer.Bytes())
+	vectors := GetEUTRANVectors(&decoded)
+	if GetIMSResultCode(&decoded) != diamcodec.DIAMETER_SUCCESS || len(vectors) != 2 || subscriber.SQN != 102 {
+		t.Fatalf("bad AIA %s", decoded)
+	}
+
+	// Check the vector as the USIM would
+	m, _ := milenage.New(subscriber.K, subscriber.OPc)
+	res, _, _, ak := m.F2345(vectors[1].RAND)
+	sqn := append([]byte(nil), vectors[1].AUTN[0:6]...)
+	for i := range sqn {
+		sqn[i] ^= ak[i]
+	}
+	macA, _ := m.F1(vectors[1].RAND, sqn, subscriber.AMF)
+	if milenage.SQNValue(sqn) != 102 || !bytes.Equal(macA, vectors[1].AUTN[8:]) || !bytes.Equal(res, vectors[1].XRES) || len(vectors[1].KASME) != 32 {
+		t.Errorf("bad vector %v", vectors[1])
+	}
+
+	// Resynchronization to the SQN in the USIM
+	auts := milenage.SQNBytes(500)
+	akStar := m.F5Star(vectors[0].RAND)
+	for i := range auts {
+		auts[i] ^= akStar[i]
+	}
+	_, macS := m.F1(vectors[0].RAND, milenage.SQNBytes(500), []byte{0, 0})
+	air, _ = NewAIR(ci, "igorsuperserver", subscriber.IMSI, plmnId, 1, append(append(append([]byte(nil), vectors[0].RAND...), auts...), macS...))
+	if aia, err = subscriber.AnswerAIR(ci, air); err != nil || len(GetEUTRANVectors(aia)) != 1 || subscriber.SQN != 501 {
+		t.Errorf("bad resynchronization %d %v", subscriber.SQN, err)
+	}
+
+	// Unknown user
+	air, _ = NewAIR(ci, "igorsuperserver", "214010000000002", plmnId, 1, nil)
+	aia, _ = subscriber.AnswerAIR(ci, air)
+	if GetIMSResultCode(aia) != DIAMETER_ERROR_USER_UNKNOWN || GetEUTRANVectors(aia) != nil {
+		t.Errorf("bad answer for unknown user %s", aia)
+	}
+
+	// Update location
+	ulr, err := NewULR(ci, "igorsuperserver", subscriber.IMSI, plmnId, RAT_TYPE_EUTRAN, ULR_S6A_S6D_INDICATOR|ULR_INITIAL_ATTACH_INDICATOR)
+	if err != nil {
+		t.Fatalf("could not build ULR %s", err)
+	}
+	if err := ulr.Validate(); err != nil || ulr.GetIntAVP("3GPP-ULR-Flags") != 34 {
+		t.Fatalf("bad ULR %s %v", ulr, err)
+	}
+	subscriptionData := SubscriptionData{
+		MSISDN:                   "34600000001",
+		AMBRUplink:               50000000,
+		AMBRDownlink:             100000000,
+		DefaultContextIdentifier: 1,
+		APNs:                     []APNConfiguration{{ContextIdentifier: 1, ServiceSelection: "internet", PDNType: PDN_TYPE_IPV4V6}},
+	}
+	ula, err := NewULA(ci, ulr, diamcodec.DIAMETER_SUCCESS, ULA_SEPARATION_INDICATION, &subscriptionData)
+	if err != nil {
+		t.Fatalf("could not build ULA %s", err)
+	}
+	buffer.Reset()
+	ula.WriteTo(&buffer)
+	decoded, _, _ = diamcodec.DiameterMessageFromBytes(buffer.Bytes())
+	received := GetSubscriptionData(&decoded)
+	if received == nil || received.MSISDN != "34600000001" || received.AMBRDownlink != 100000000 || len(received.APNs) != 1 {
+		t.Fatalf("bad subscription data %v", received)
+	}
+	if apn := received.APNs[0]; apn.ServiceSelection != "internet" || apn.PDNType != PDN_TYPE_IPV4V6 || apn.ContextIdentifier != 1 {
+		t.Errorf("bad APN configuration %v", apn)
+	}
+}
@@ -0,0 +1,467 @@
+package diamapps
+
+import (
+	"fmt"
+	"igor/config"
+	"igor/diamcodec"
+	"time"
+)
+
+// Helpers for the Gx interface between PCRF and PCEF, as specified in 3GPP TS 29.212. The policy decisions
+// sent by the PCRF in the Credit-Control answers and Re-Auth requests, and the reports sent by the PCEF in
+// the Credit-Control requests and Re-Auth answers, are represented as Go structures, so that the handlers
+// do not need to deal with the grouped AVPs
+
+// Some values of Event-Trigger
+const (
+	EVENT_TRIGGER_SGSN_CHANGE          = 0
+	EVENT_TRIGGER_QOS_CHANGE           = 1
+	EVENT_TRIGGER_RAT_CHANGE           = 2
+	EVENT_TRIGGER_PLMN_CHANGE          = 4
+	EVENT_TRIGGER_LOSS_OF_BEARER       = 5
+	EVENT_TRIGGER_RECOVERY_OF_BEARER   = 6
+	EVENT_TRIGGER_IP_CAN_CHANGE        = 7
+	EVENT_TRIGGER_USER_LOCATION_CHANGE = 13
+	EVENT_TRIGGER_NO_EVENT_TRIGGERS    = 14
+	EVENT_TRIGGER_OUT_OF_CREDIT        = 15
+	EVENT_TRIGGER_REVALIDATION_TIMEOUT = 17
+	EVENT_TRIGGER_USAGE_REPORT         = 33
+)
+
+// Values of Usage-Monitoring-Level
+const (
+	USAGE_MONITORING_SESSION_LEVEL  = 0
+	USAGE_MONITORING_PCC_RULE_LEVEL = 1
+	USAGE_MONITORING_ADC_RULE_LEVEL = 2
+)
+
+// Values of PCC-Rule-Status
+const (
+	PCC_RULE_ACTIVE               = 0
+	PCC_RULE_INACTIVE             = 1
+	PCC_RULE_TEMPORARILY_INACTIVE = 2
+)
+
+// Values of Re-Auth-Request-Type
+const (
+	RE_AUTH_AUTHORIZE_ONLY         = 0
+	RE_AUTH_AUTHORIZE_AUTHENTICATE = 1
+)
+
+// Contents of a Charging-Rule-Definition AVP. The zero values are not included. The Charging-Rule-Name
+// and Monitoring-Key, in this and the other structures, are OctetString AVPs that are treated as text
+type ChargingRuleDefinition struct {
+	Name string
+
+	ServiceIdentifier uint32
+	RatingGroup       uint32
+	Precedence        uint32
+	MonitoringKey     string
+
+	// Each one is sent in a Flow-Information AVP
+	FlowDescriptions []string
+}
+
+// Contents of a Charging-Rule-Install AVP, with the rules defined in the PCRF and the names of the rules
+// predefined in the PCEF. The zero times are not included
+type ChargingRuleInstall struct {
+	Definitions []ChargingRuleDefinition
+	Names       []string
+	BaseNames   []string
+
+	ActivationTime   time.Time
+	DeactivationTime time.Time
+}
+
+// Contents of a Charging-Rule-Remove AVP
+type ChargingRuleRemove struct {
+	Names     []string
+	BaseNames []string
+}
+
+// Contents of a Charging-Rule-Report AVP, sent by the PCEF to notify the status of the rules
+type ChargingRuleReport struct {
+	Names     []string
+	BaseNames []string
+	Status    int
+
+	// Rule-Failure-Code. Zero if not present
+	FailureCode int
+}
+
+// Contents of a Usage-Monitoring-Information AVP. The PCRF sends the granted units and the PCEF reports the
+// used ones. A nil unit is not included
+type UsageMonitoringInformation struct {
+	MonitoringKey string
+
+	Granted *ServiceUnit
+	Used    *ServiceUnit
+
+	// USAGE_MONITORING_PCC_RULE_LEVEL, which is the default, is not included
+	Level int
+
+	// If true, the PCRF requests the PCEF to report the usage
+	ReportRequired bool
+}
+
+// Policy sent by the PCRF in a Credit-Control answer or in a Re-Auth request
+type PolicyDecision struct {
+	EventTriggers   []int
+	Install         []ChargingRuleInstall
+	Remove          []ChargingRuleRemove
+	UsageMonitoring []UsageMonitoringInformation
+}
+
+// Information sent by the PCEF in a Credit-Control request or in a Re-Auth answer
+type PolicyReport struct {
+	EventTriggers   []int
+	RuleReports     []ChargingRuleReport
+	UsageMonitoring []UsageMonitoringInformation
+}
+
+// Sends the diameter request to a peer and waits for the answer. Implemented by router.DiameterRouter
+type DiameterRequestRouter interface {
+	RouteDiameterRequest(request *diamcodec.DiameterMessage, timeout time.Duration) (*diamcodec.DiameterMessage, error)
+}
+
+// Adds the AVPs of the policy to the message
+func (pd *PolicyDecision) AddTo(message *diamcodec.DiameterMessage) {
+	for _, eventTrigger := range pd.EventTriggers {
+		message.Add("3GPP-Event-Trigger", eventTrigger)
+	}
+	for i := range pd.Remove {
+		message.AddAVP(pd.Remove[i].ToAVP())
+	}
+	for i := range pd.Install {
+		message.AddAVP(pd.Install[i].ToAVP())
+	}
+	for i := range pd.UsageMonitoring {
+		message.AddAVP(pd.UsageMonitoring[i].ToAVP())
+	}
+}
+
+// Returns the policy in the Credit-Control answer or Re-Auth request
+func GetPolicyDecision(message *diamcodec.DiameterMessage) *PolicyDecision {
+	pd := PolicyDecision{}
+	for _, avp := range message.GetAllAVP("3GPP-Event-Trigger") {
+		pd.EventTriggers = append(pd.EventTriggers, int(avp.GetInt()))
+	}
+	for _, avp := range message.GetAllAVP("3GPP-Charging-Rule-Remove") {
+		pd.Remove = append(pd.Remove, ChargingRuleRemoveFromAVP(&avp))
+	}
+	for _, avp := range message.GetAllAVP("3GPP-Charging-Rule-Install") {
+		pd.Install = append(pd.Install, ChargingRuleInstallFromAVP(&avp))
+	}
+	for _, avp := range message.GetAllAVP("3GPP-Usage-Monitoring-Information") {
+		pd.UsageMonitoring = append(pd.UsageMonitoring, UsageMonitoringInformationFromAVP(&avp))
+	}
+	return &pd
+}
+
+// Adds the AVPs of the report to the message
+func (pr *PolicyReport) AddTo(message *diamcodec.DiameterMessage) {
+	for _, eventTrigger := range pr.EventTriggers {
+		message.Add("3GPP-Event-Trigger", eventTrigger)
+	}
+	for i := range pr.RuleReports {
+		message.AddAVP(pr.RuleReports[i].ToAVP())
+	}
+	for i := range pr.UsageMonitoring {
+		message.AddAVP(pr.UsageMonitoring[i].ToAVP())
+	}
+}
+
+// Returns the report in the Credit-Control request or Re-Auth answer
+func GetPolicyReport(message *diamcodec.DiameterMessage) *PolicyReport {
+	pr := PolicyReport{}
+	for _, avp := range message.GetAllAVP("3GPP-Event-Trigger") {
+		pr.EventTriggers = append(pr.EventTriggers, int(avp.GetInt()))
+	}
+	for _, avp := range message.GetAllAVP("3GPP-Charging-Rule-Report") {
+		pr.RuleReports = append(pr.RuleReports, ChargingRuleReportFromAVP(&avp))
+	}
+	for _, avp := range message.GetAllAVP("3GPP-Usage-Monitoring-Information") {
+		pr.UsageMonitoring = append(pr.UsageMonitoring, UsageMonitoringInformationFromAVP(&avp))
+	}
+	return &pr
+}
+
+// Builds the Gx Credit-Control answer to the request, with the specified policy, which may be nil.
+// The answer is validated against the dictionary
+func NewGxCCA(ci *config.PolicyConfigurationManager, request *diamcodec.DiameterMessage, resultCode int64, decision *PolicyDecision) (*diamcodec.DiameterMessage, error) {
+	if request.CommandName != "Credit-Control" || request.ApplicationName != "Gx" || !request.IsRequest {
+		return nil, fmt.Errorf("%s %s is not a Gx Credit-Control request", request.ApplicationName, request.CommandName)
+	}
+
+	answer := diamcodec.NewDiameterAnswer(request)
+	answer.Add("Session-Id", request.GetStringAVP("Session-Id"))
+	answer.Add("Result-Code", resultCode)
+	answer.AddOriginAVPs(ci)
+	answer.Add("Auth-Application-Id", request.ApplicationId)
+	answer.Add("CC-Request-Type", request.GetIntAVP("CC-Request-Type"))
+	answer.Add("CC-Request-Number", request.GetIntAVP("CC-Request-Number"))
+	if decision != nil {
+		decision.AddTo(answer)
+	}
+
+	if err := answer.Validate(); err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
+
+// Builds a Gx Re-Auth request for the session, to push the policy to the PCEF, which is addressed by the
+// Origin-Host and Origin-Realm it sent in the Credit-Control requests. The request is validated against the
+// dictionary
+func NewGxRAR(ci *config.PolicyConfigurationManager, sessionId string, destinationHost string, destinationRealm string, decision *PolicyDecision) (*diamcodec.DiameterMessage, error) {
+	request, err := diamcodec.NewDiameterRequest("Gx", "Re-Auth")
+	if err != nil {
+		return nil, err
+	}
+
+	request.Add("Session-Id", sessionId)
+	request.Add("Auth-Application-Id", request.ApplicationId)
+	request.AddOriginAVPs(ci)
+	request.Add("Destination-Realm", destinationRealm)
+	request.Add("Destination-Host", destinationHost)
+	request.Add("Re-Auth-Request-Type", RE_AUTH_AUTHORIZE_ONLY)
+	if decision != nil {
+		decision.AddTo(request)
+	}
+
+	if err := request.Validate(); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// Builds the Gx Re-Auth answer to the request, with the report of the rules, which may be nil. The answer is
+// validated against the dictionary
+func NewGxRAA(ci *config.PolicyConfigurationManager, request *diamcodec.DiameterMessage, resultCode int64, report *PolicyReport) (*diamcodec.DiameterMessage, error) {
+	answer := diamcodec.NewDiameterAnswer(request)
+	answer.Add("Session-Id", request.GetStringAVP("Session-Id"))
+	answer.AddOriginAVPs(ci)
+	answer.Add("Result-Code", resultCode)
+	if report != nil {
+		report.AddTo(answer)
+	}
+
+	if err := answer.Validate(); err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
+
+// Sends a Re-Auth request with the policy to the PCEF of the session and returns the report in the answer.
+// An error is returned if the answer is not received, is invalid or is not successful, in which case the
+// report is also returned if available
+func SendGxRAR(r DiameterRequestRouter, ci *config.PolicyConfigurationManager, sessionId string, destinationHost string, destinationRealm string, decision *PolicyDecision, timeout time.Duration) (*PolicyReport, error) {
+	request, err := NewGxRAR(ci, sessionId, destinationHost, destinationRealm, decision)
+	if err != nil {
+		return nil, err
+	}
+
+	answer, err := r.RouteDiameterRequest(request, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("re-auth request for session %s: %w", sessionId, err)
+	}
+	if err := answer.Validate(); err != nil {
+		return nil, err
+	}
+
+	report := GetPolicyReport(answer)
+	if resultCode := answer.GetResultCode(); resultCode != diamcodec.DIAMETER_SUCCESS {
+		return report, fmt.Errorf("re-auth answer for session %s with Result-Code %d", sessionId, resultCode)
+	}
+	return report, nil
+}
+
+// Builds the Charging-Rule-Definition AVP
+func (crd *ChargingRuleDefinition) ToAVP() *diamcodec.DiameterAVP {
+	avp, _ := diamcodec.NewAVP("3GPP-Charging-Rule-Definition", nil)
+	avp.Add("3GPP-Charging-Rule-Name", []byte(crd.Name))
+	if crd.ServiceIdentifier != 0 {
+		avp.Add("Service-Identifier", crd.ServiceIdentifier)
+	}
+	if crd.RatingGroup != 0 {
+		avp.Add("Rating-Group", crd.RatingGroup)
+	}
+	for _, flowDescription := range crd.FlowDescriptions {
+		flowInformation, _ := diamcodec.NewAVP("3GPP-Flow-Information", nil)
+		flowInformation.Add("3GPP-Flow-Description", flowDescription)
+		avp.AddAVP(*flowInformation)
+	}
+	if crd.Precedence != 0 {
+		avp.Add("3GPP-Precedence", crd.Precedence)
+	}
+	if crd.MonitoringKey != "" {
+		avp.Add("3GPP-Monitoring-Key", []byte(crd.MonitoringKey))
+	}
+	return avp
+}
+
+// Returns the contents of the Charging-Rule-Definition AVP
+func ChargingRuleDefinitionFromAVP(avp *diamcodec.DiameterAVP) ChargingRuleDefinition {
+	crd := ChargingRuleDefinition{}
+	for _, inner := range avp.Value.([]diamcodec.DiameterAVP) {
+		switch inner.Name {
+		case "3GPP-Charging-Rule-Name":
+			crd.Name = string(inner.GetOctets())
+		case "Service-Identifier":
+			crd.ServiceIdentifier = uint32(inner.GetInt())
+		case "Rating-Group":
+			crd.RatingGroup = uint32(inner.GetInt())
+		case "3GPP-Flow-Information":
+			if flowDescription, err := inner.GetAVP("3GPP-Flow-Description"); err == nil {
+				crd.FlowDescriptions = append(crd.FlowDescriptions, flowDescription.GetString())
+			}
+		case "3GPP-Precedence":
+			crd.Precedence = uint32(inner.GetInt())
+		case "3GPP-Monitoring-Key":
+			crd.MonitoringKey = string(inner.GetOctets())
+		}
+	}
+	return crd
+}
+
+// Builds the Charging-Rule-Install AVP
+func (cri *ChargingRuleInstall) ToAVP() *diamcodec.DiameterAVP {
+	avp, _ := diamcodec.NewAVP("3GPP-Charging-Rule-Install", nil)
+	for i := range cri.Definitions {
+		avp.AddAVP(*cri.Definitions[i].ToAVP())
+	}
+	for _, name := range cri.Names {
+		avp.Add("3GPP-Charging-Rule-Name", []byte(name))
+	}
+	for _, baseName := range cri.BaseNames {
+		avp.Add("3GPP-Charging-Rule-Base-Name", baseName)
+	}
+	if !cri.ActivationTime.IsZero() {
+		avp.Add("3GPP-Rule-Activation-Time", cri.ActivationTime)
+	}
+	if !cri.DeactivationTime.IsZero() {
+		avp.Add("3GPP-Rule-Deactivation-Time", cri.DeactivationTime)
+	}
+	return avp
+}
+
+// Returns the contents of the Charging-Rule-Install AVP
+func ChargingRuleInstallFromAVP(avp *diamcodec.DiameterAVP) ChargingRuleInstall {
+	cri := ChargingRuleInstall{}
+	for _, inner := range avp.Value.([]diamcodec.DiameterAVP) {
+		switch inner.Name {
+		case "3GPP-Charging-Rule-Definition":
+			cri.Definitions = append(cri.Definitions, ChargingRuleDefinitionFromAVP(&inner))
+		case "3GPP-Charging-Rule-Name":
+			cri.Names = append(cri.Names, string(inner.GetOctets()))
+		case "3GPP-Charging-Rule-Base-Name":
+			cri.BaseNames = append(cri.BaseNames, inner.GetString())
+		case "3GPP-Rule-Activation-Time":
+			cri.ActivationTime = inner.GetDate()
+		case "3GPP-Rule-Deactivation-Time":
+			cri.DeactivationTime = inner.GetDate()
+		}
+	}
+	return cri
+}
+
+// Builds the Charging-Rule-Remove AVP
+func (crr *ChargingRuleRemove) ToAVP() *diamcodec.DiameterAVP {
+	avp, _ := diamcodec.NewAVP("3GPP-Charging-Rule-Remove", nil)
+	for _, name := range crr.Names {
+		avp.Add("3GPP-Charging-Rule-Name", []byte(name))
+	}
+	for _, baseName := range crr.BaseNames {
+		avp.Add("3GPP-Charging-Rule-Base-Name", baseName)
+	}
+	return avp
+}
+
+// Returns the contents of the Charging-Rule-Remove AVP
+func ChargingRuleRemoveFromAVP(avp *diamcodec.DiameterAVP) ChargingRuleRemove {
+	crr := ChargingRuleRemove{}
+	for _, inner := range avp.Value.([]diamcodec.DiameterAVP) {
+		switch inner.Name {
+		case "3GPP-Charging-Rule-Name":
+			crr.Names = append(crr.Names, string(inner.GetOctets()))
+		case "3GPP-Charging-Rule-Base-Name":
+			crr.BaseNames = append(crr.BaseNames, inner.GetString())
+		}
+	}
+	return crr
+}
+
+// Builds the Charging-Rule-Report AVP
+func (crr *ChargingRuleReport) ToAVP() *diamcodec.DiameterAVP {
+	avp, _ := diamcodec.NewAVP("3GPP-Charging-Rule-Report", nil)
+	for _, name := range crr.Names {
+		avp.Add("3GPP-Charging-Rule-Name", []byte(name))
+	}
+	for _, baseName := range crr.BaseNames {
+		avp.Add("3GPP-Charging-Rule-Base-Name", baseName)
+	}
+	avp.Add("3GPP-PCC-Rule-Status", crr.Status)
+	if crr.FailureCode != 0 {
+		avp.Add("3GPP-Rule-Failure-Code", crr.FailureCode)
+	}
+	return avp
+}
+
+// Returns the contents of the Charging-Rule-Report AVP
+func ChargingRuleReportFromAVP(avp *diamcodec.DiameterAVP) ChargingRuleReport {
+	crr := ChargingRuleReport{}
+	for _, inner := range avp.Value.([]diamcodec.DiameterAVP) {
+		switch inner.Name {
+		case "3GPP-Charging-Rule-Name":
+			crr.Names = append(crr.Names, string(inner.GetOctets()))
+		case "3GPP-Charging-Rule-Base-Name":
+			crr.BaseNames = append(crr.BaseNames, inner.GetString())
+		case "3GPP-PCC-Rule-Status":
+			crr.Status = int(inner.GetInt())
+		case "3GPP-Rule-Failure-Code":
+			crr.FailureCode = int(inner.GetInt())
+		}
+	}
+	return crr
+}
+
+// Builds the Usage-Monitoring-Information AVP
+func (umi *UsageMonitoringInformation) ToAVP() *diamcodec.DiameterAVP {
+	avp, _ := diamcodec.NewAVP("3GPP-Usage-Monitoring-Information", nil)
+	if umi.MonitoringKey != "" {
+		avp.Add("3GPP-Monitoring-Key", []byte(umi.MonitoringKey))
+	}
+	if umi.Granted != nil {
+		avp.AddAVP(*umi.Granted.toAVP("Granted-Service-Unit"))
+	}
+	if umi.Used != nil {
+		avp.AddAVP(*umi.Used.toAVP("Used-Service-Unit"))
+	}
+	if umi.Level != USAGE_MONITORING_PCC_RULE_LEVEL {
+		avp.Add("3GPP-Usage-Monitoring-Level", umi.Level)
+	}
+	if umi.ReportRequired {
+		avp.Add("3GPP-Usage-Monitoring-Report", 0)
+	}
+	return avp
+}
+
+// Returns the contents of the Usage-Monitoring-Information AVP
+func UsageMonitoringInformationFromAVP(avp *diamcodec.DiameterAVP) UsageMonitoringInformation {
+	umi := UsageMonitoringInformation{Level: USAGE_MONITORING_PCC_RULE_LEVEL}
+	for _, inner := range avp.Value.([]diamcodec.DiameterAVP) {
+		switch inner.Name {
+		case "3GPP-Monitoring-Key":
+			umi.MonitoringKey = string(inner.GetOctets())
+		case "Granted-Service-Unit":
+			umi.Granted = serviceUnitFromAVP(&inner)
+		case "Used-Service-Unit":
+			umi.Used = serviceUnitFromAVP(&inner)
+		case "3GPP-Usage-Monitoring-Level":
+			umi.Level = int(inner.GetInt())
+		case "3GPP-Usage-Monitoring-Report":
+			umi.ReportRequired = true
+		}
+	}
+	return umi
+}
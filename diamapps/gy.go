@@ -0,0 +1,437 @@
+package diamapps
+
+import (
+	"errors"
+	"fmt"
+	"igor/config"
+	"igor/diamcodec"
+)
+
+// Helpers for Gy online charging, as specified in 3GPP TS 32.299, which uses the Diameter Credit-Control
+// application (RFC 4006). The Credit-Control requests and answers are represented as Go structures, which
+// are converted to and from diameter messages, validated against the dictionary
+
+// Values of CC-Request-Type
+const (
+	CC_INITIAL_REQUEST     = 1
+	CC_UPDATE_REQUEST      = 2
+	CC_TERMINATION_REQUEST = 3
+	CC_EVENT_REQUEST       = 4
+)
+
+// Values of Subscription-Id-Type
+const (
+	SUBSCRIPTION_ID_E164    = 0
+	SUBSCRIPTION_ID_IMSI    = 1
+	SUBSCRIPTION_ID_SIP_URI = 2
+	SUBSCRIPTION_ID_NAI     = 3
+	SUBSCRIPTION_ID_PRIVATE = 4
+)
+
+// Values of Final-Unit-Action
+const (
+	FINAL_UNIT_TERMINATE       = 0
+	FINAL_UNIT_REDIRECT        = 1
+	FINAL_UNIT_RESTRICT_ACCESS = 2
+)
+
+// Result-Codes specific of Credit-Control
+const (
+	DIAMETER_CREDIT_CONTROL_NOT_APPLICABLE = 4011
+	DIAMETER_CREDIT_LIMIT_REACHED          = 4012
+	DIAMETER_USER_UNKNOWN                  = 5030
+	DIAMETER_RATING_FAILED                 = 5031
+)
+
+// Service-Context-Id of Gy (3GPP TS 32.251, PS domain)
+const GY_SERVICE_CONTEXT_ID = "32251@3gpp.org"
+
+// Returned when the CCR to generate is not valid in the current state of the session
+var ErrInvalidRequestSequence = errors.New("invalid credit control request sequence")
+
+// Identity of the subscriber
+type SubscriptionId struct {
+	Type int
+	Data string
+}
+
+// Amount of service, as used in the Requested-Service-Unit, Granted-Service-Unit and Used-Service-Unit.
+// The units with zero values are not included in the AVP
+type ServiceUnit struct {
+	// CC-Time, in seconds
+	Time         uint32
+	TotalOctets  uint64
+	InputOctets  uint64
+	OutputOctets uint64
+}
+
+// Contents of a Multiple-Services-Credit-Control AVP. The zero values and nil units are not included
+type MultipleServicesCreditControl struct {
+	RatingGroup       uint32
+	ServiceIdentifier uint32
+
+	Requested *ServiceUnit
+	Granted   *ServiceUnit
+	Used      *ServiceUnit
+
+	// In seconds
+	ValidityTime uint32
+
+	ResultCode int64
+
+	// Final-Unit-Action in the Final-Unit-Indication, if HasFinalUnit is true
+	HasFinalUnit    bool
+	FinalUnitAction int
+}
+
+// Credit-Control-Request
+type CreditControlRequest struct {
+	SessionId        string
+	DestinationRealm string
+	DestinationHost  string
+
+	RequestType   int
+	RequestNumber uint32
+
+	// If empty, GY_SERVICE_CONTEXT_ID is used
+	ServiceContextId string
+
+	UserName        string
+	SubscriptionIds []SubscriptionId
+
+	// Only for termination requests, if not zero
+	TerminationCause int
+
+	Services []MultipleServicesCreditControl
+}
+
+// Credit-Control-Answer
+type CreditControlAnswer struct {
+	SessionId     string
+	ResultCode    int64
+	RequestType   int
+	RequestNumber uint32
+
+	// In seconds
+	ValidityTime uint32
+
+	Services []MultipleServicesCreditControl
+}
+
+// Builds the Credit-Control diameter request, which is validated against the dictionary
+func (ccr *CreditControlRequest) ToDiameter(ci *config.PolicyConfigurationManager) (*diamcodec.DiameterMessage, error) {
+	request, err := diamcodec.NewDiameterRequest("Credit-Control", "Credit-Control")
+	if err != nil {
+		return nil, err
+	}
+
+	serviceContextId := ccr.ServiceContextId
+	if serviceContextId == "" {
+		serviceContextId = GY_SERVICE_CONTEXT_ID
+	}
+
+	request.Add("Session-Id", ccr.SessionId)
+	request.AddOriginAVPs(ci)
+	request.Add("Destination-Realm", ccr.DestinationRealm)
+	if ccr.DestinationHost != "" {
+		request.Add("Destination-Host", ccr.DestinationHost)
+	}
+	request.Add("Auth-Application-Id", request.ApplicationId)
+	request.Add("Service-Context-Id", serviceContextId)
+	request.Add("CC-Request-Type", ccr.RequestType)
+	request.Add("CC-Request-Number", ccr.RequestNumber)
+	if ccr.UserName != "" {
+		request.Add("User-Name", ccr.UserName)
+	}
+	for _, subscriptionId := range ccr.SubscriptionIds {
+		avp, _ := diamcodec.NewAVP("Subscription-Id", nil)
+		avp.Add("Subscription-Id-Type", subscriptionId.Type)
+		avp.Add("Subscription-Id-Data", subscriptionId.Data)
+		request.AddAVP(avp)
+	}
+	if ccr.TerminationCause != 0 {
+		request.Add("Termination-Cause", ccr.TerminationCause)
+	}
+	if len(ccr.Services) > 0 {
+		request.Add("Multiple-Services-Indicator", 1)
+	}
+	for i := range ccr.Services {
+		request.AddAVP(ccr.Services[i].toAVP())
+	}
+
+	if err := request.Validate(); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// Builds the Credit-Control diameter answer to the request, which is validated against the dictionary.
+// The Session-Id, CC-Request-Type and CC-Request-Number are taken from the request
+func (cca *CreditControlAnswer) ToDiameter(ci *config.PolicyConfigurationManager, request *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, error) {
+	answer := diamcodec.NewDiameterAnswer(request)
+	answer.Add("Session-Id", request.GetStringAVP("Session-Id"))
+	answer.Add("Result-Code", cca.ResultCode)
+	answer.AddOriginAVPs(ci)
+	answer.Add("Auth-Application-Id", request.ApplicationId)
+	answer.Add("CC-Request-Type", request.GetIntAVP("CC-Request-Type"))
+	answer.Add("CC-Request-Number", request.GetIntAVP("CC-Request-Number"))
+	if cca.ValidityTime != 0 {
+		answer.Add("Validity-Time", cca.ValidityTime)
+	}
+	for i := range cca.Services {
+		answer.AddAVP(cca.Services[i].toAVP())
+	}
+
+	if err := answer.Validate(); err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
+
+// Validates the Credit-Control request against the dictionary and returns its contents
+func ParseCCR(request *diamcodec.DiameterMessage) (*CreditControlRequest, error) {
+	if request.CommandName != "Credit-Control" || !request.IsRequest {
+		return nil, fmt.Errorf("%s is not a Credit-Control request", request.CommandName)
+	}
+	if err := request.Validate(); err != nil {
+		return nil, err
+	}
+
+	ccr := CreditControlRequest{
+		SessionId:        request.GetStringAVP("Session-Id"),
+		DestinationRealm: request.GetStringAVP("Destination-Realm"),
+		DestinationHost:  request.GetStringAVP("Destination-Host"),
+		RequestType:      int(request.GetIntAVP("CC-Request-Type")),
+		RequestNumber:    uint32(request.GetIntAVP("CC-Request-Number")),
+		ServiceContextId: request.GetStringAVP("Service-Context-Id"),
+		UserName:         request.GetStringAVP("User-Name"),
+		TerminationCause: int(request.GetIntAVP("Termination-Cause")),
+	}
+	for _, avp := range request.GetAllAVP("Subscription-Id") {
+		typeAVP, _ := avp.GetAVP("Subscription-Id-Type")
+		dataAVP, _ := avp.GetAVP("Subscription-Id-Data")
+		ccr.SubscriptionIds = append(ccr.SubscriptionIds, SubscriptionId{Type: int(typeAVP.GetInt()), Data: dataAVP.GetString()})
+	}
+	for _, avp := range request.GetAllAVP("Multiple-Services-Credit-Control") {
+		ccr.Services = append(ccr.Services, msccFromAVP(&avp))
+	}
+	return &ccr, nil
+}
+
+// Validates the Credit-Control answer against the dictionary and returns its contents
+func ParseCCA(answer *diamcodec.DiameterMessage) (*CreditControlAnswer, error) {
+	if answer.CommandName != "Credit-Control" || answer.IsRequest {
+		return nil, fmt.Errorf("%s is not a Credit-Control answer", answer.CommandName)
+	}
+	if err := answer.Validate(); err != nil {
+		return nil, err
+	}
+
+	cca := CreditControlAnswer{
+		SessionId:     answer.GetStringAVP("Session-Id"),
+		ResultCode:    answer.GetResultCode(),
+		RequestType:   int(answer.GetIntAVP("CC-Request-Type")),
+		RequestNumber: uint32(answer.GetIntAVP("CC-Request-Number")),
+		ValidityTime:  uint32(answer.GetIntAVP("Validity-Time")),
+	}
+	for _, avp := range answer.GetAllAVP("Multiple-Services-Credit-Control") {
+		cca.Services = append(cca.Services, msccFromAVP(&avp))
+	}
+	return &cca, nil
+}
+
+// Builds the Multiple-Services-Credit-Control AVP
+func (mscc *MultipleServicesCreditControl) toAVP() *diamcodec.DiameterAVP {
+	avp, _ := diamcodec.NewAVP("Multiple-Services-Credit-Control", nil)
+	if mscc.Granted != nil {
+		avp.AddAVP(*mscc.Granted.toAVP("Granted-Service-Unit"))
+	}
+	if mscc.Requested != nil {
+		avp.AddAVP(*mscc.Requested.toAVP("Requested-Service-Unit"))
+	}
+	if mscc.Used != nil {
+		avp.AddAVP(*mscc.Used.toAVP("Used-Service-Unit"))
+	}
+	if mscc.ServiceIdentifier != 0 {
+		avp.Add("Service-Identifier", mscc.ServiceIdentifier)
+	}
+	if mscc.RatingGroup != 0 {
+		avp.Add("Rating-Group", mscc.RatingGroup)
+	}
+	if mscc.ValidityTime != 0 {
+		avp.Add("Validity-Time", mscc.ValidityTime)
+	}
+	if mscc.ResultCode != 0 {
+		avp.Add("Result-Code", mscc.ResultCode)
+	}
+	if mscc.HasFinalUnit {
+		fui, _ := diamcodec.NewAVP("Final-Unit-Indication", nil)
+		fui.Add("Final-Unit-Action", mscc.FinalUnitAction)
+		avp.AddAVP(*fui)
+	}
+	return avp
+}
+
+// Returns the contents of the Multiple-Services-Credit-Control AVP
+func msccFromAVP(avp *diamcodec.DiameterAVP) MultipleServicesCreditControl {
+	mscc := MultipleServicesCreditControl{}
+	for _, inner := range avp.Value.([]diamcodec.DiameterAVP) {
+		switch inner.Name {
+		case "Granted-Service-Unit":
+			mscc.Granted = serviceUnitFromAVP(&inner)
+		case "Requested-Service-Unit":
+			mscc.Requested = serviceUnitFromAVP(&inner)
+		case "Used-Service-Unit":
+			mscc.Used = serviceUnitFromAVP(&inner)
+		case "Service-Identifier":
+			mscc.ServiceIdentifier = uint32(inner.GetInt())
+		case "Rating-Group":
+			mscc.RatingGroup = uint32(inner.GetInt())
+		case "Validity-Time":
+			mscc.ValidityTime = uint32(inner.GetInt())
+		case "Result-Code":
+			mscc.ResultCode = inner.GetInt()
+		case "Final-Unit-Indication":
+			mscc.HasFinalUnit = true
+			if action, err := inner.GetAVP("Final-Unit-Action"); err == nil {
+				mscc.FinalUnitAction = int(action.GetInt())
+			}
+		}
+	}
+	return mscc
+}
+
+// Builds the Requested, Granted or Used-Service-Unit AVP
+func (su *ServiceUnit) toAVP(name string) *diamcodec.DiameterAVP {
+	avp, _ := diamcodec.NewAVP(name, nil)
+	if su.Time != 0 {
+		avp.Add("CC-Time", su.Time)
+	}
+	if su.TotalOctets != 0 {
+		avp.Add("CC-Total-Octets", su.TotalOctets)
+	}
+	if su.InputOctets != 0 {
+		avp.Add("CC-Input-Octets", su.InputOctets)
+	}
+	if su.OutputOctets != 0 {
+		avp.Add("CC-Output-Octets", su.OutputOctets)
+	}
+	return avp
+}
+
+// Returns the contents of the Requested, Granted or Used-Service-Unit AVP
+func serviceUnitFromAVP(avp *diamcodec.DiameterAVP) *ServiceUnit {
+	su := ServiceUnit{}
+	for _, inner := range avp.Value.([]diamcodec.DiameterAVP) {
+		switch inner.Name {
+		case "CC-Time":
+			su.Time = uint32(inner.GetInt())
+		case "CC-Total-Octets":
+			su.TotalOctets = inner.GetUint()
+		case "CC-Input-Octets":
+			su.InputOctets = inner.GetUint()
+		case "CC-Output-Octets":
+			su.OutputOctets = inner.GetUint()
+		}
+	}
+	return &su
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// Keeps the state of a credit control session in the CTF side: Session-Id and CC-Request-Number.
+// Not safe for concurrent use
+type GySession struct {
+	// Configuration instance, to get the Origin-Host and Origin-Realm
+	ci *config.PolicyConfigurationManager
+
+	SessionId        string
+	DestinationRealm string
+
+	// Optional. Typically set to the Origin-Host of the first answer
+	DestinationHost string
+
+	SubscriptionIds []SubscriptionId
+
+	// CC-Request-Number to use in the next request
+	nextRequestNumber uint32
+
+	// Status of the session
+	isStarted    bool
+	isTerminated bool
+}
+
+// Creates a new credit control session for the subscriber towards the specified realm
+func NewGySession(ci *config.PolicyConfigurationManager, destinationRealm string, subscriptionIds ...SubscriptionId) *GySession {
+	return &GySession{
+		ci:               ci,
+		SessionId:        diamcodec.NewSessionId(ci.DiameterServerConf().DiameterHost),
+		DestinationRealm: destinationRealm,
+		SubscriptionIds:  subscriptionIds,
+	}
+}
+
+// Builds the CCR-I, to request quota for the services
+func (s *GySession) NewCCRInitial(services ...MultipleServicesCreditControl) (*diamcodec.DiameterMessage, error) {
+	return s.newCCR(CC_INITIAL_REQUEST, 0, services)
+}
+
+// Builds a CCR-U, to report the usage and request more quota for the services
+func (s *GySession) NewCCRUpdate(services ...MultipleServicesCreditControl) (*diamcodec.DiameterMessage, error) {
+	return s.newCCR(CC_UPDATE_REQUEST, 0, services)
+}
+
+// Builds the CCR-T, to report the final usage of the services
+func (s *GySession) NewCCRTermination(terminationCause int, services ...MultipleServicesCreditControl) (*diamcodec.DiameterMessage, error) {
+	return s.newCCR(CC_TERMINATION_REQUEST, terminationCause, services)
+}
+
+// Builds the next CCR of the session. The initial request must be the first one, and no requests are
+// allowed after the termination one
+func (s *GySession) newCCR(requestType int, terminationCause int, services []MultipleServicesCreditControl) (*diamcodec.DiameterMessage, error) {
+	if s.isTerminated || (requestType == CC_INITIAL_REQUEST) == s.isStarted {
+		return nil, fmt.Errorf("request type %d in session %s: %w", requestType, s.SessionId, ErrInvalidRequestSequence)
+	}
+
+	ccr := CreditControlRequest{
+		SessionId:        s.SessionId,
+		DestinationRealm: s.DestinationRealm,
+		DestinationHost:  s.DestinationHost,
+		RequestType:      requestType,
+		RequestNumber:    s.nextRequestNumber,
+		SubscriptionIds:  s.SubscriptionIds,
+		TerminationCause: terminationCause,
+		Services:         services,
+	}
+	request, err := ccr.ToDiameter(s.ci)
+	if err != nil {
+		return nil, err
+	}
+
+	// Update the state
+	s.nextRequestNumber++
+	s.isStarted = true
+	if requestType == CC_TERMINATION_REQUEST {
+		s.isTerminated = true
+	}
+
+	return request, nil
+}
+
+// Processes the answer to a CCR of this session. Returns its contents, and an error if it is invalid,
+// does not belong to this session or is not successful
+func (s *GySession) ProcessCCA(answer *diamcodec.DiameterMessage) (*CreditControlAnswer, error) {
+	cca, err := ParseCCA(answer)
+	if err != nil {
+		return nil, err
+	}
+
+	if cca.SessionId != s.SessionId {
+		return cca, fmt.Errorf("answer for session %s received in session %s", cca.SessionId, s.SessionId)
+	}
+	if cca.ResultCode != diamcodec.DIAMETER_SUCCESS {
+		return cca, fmt.Errorf("credit control answer for session %s with Result-Code %d", s.SessionId, cca.ResultCode)
+	}
+
+	return cca, nil
+}
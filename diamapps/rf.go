@@ -0,0 +1,197 @@
+package diamapps
+
+import (
+	"errors"
+	"fmt"
+	"igor/config"
+	"igor/diamcodec"
+	"sync"
+	"time"
+)
+
+// Helpers for Rf offline charging, as specified in 3GPP TS 32.299, which uses the
+// Diameter base Accounting application
+
+// Values of Accounting-Record-Type
+const (
+	EVENT_RECORD   = 1
+	START_RECORD   = 2
+	INTERIM_RECORD = 3
+	STOP_RECORD    = 4
+)
+
+// Returned when the ACR to generate is not valid in the current state of the session
+var ErrInvalidRecordSequence = errors.New("invalid accounting record sequence")
+
+// Returned when there is no space to store the ACR
+var ErrBufferFull = errors.New("accounting records buffer full")
+
+// Keeps the state of an accounting session in the CTF (Charging Trigger Function) side:
+// Session-Id, Accounting-Record-Number and Acct-Interim-Interval.
+// Not safe for concurrent use
+type RfSession struct {
+	// Configuration instance, to get the Origin-Host and Origin-Realm
+	ci *config.PolicyConfigurationManager
+
+	SessionId        string
+	DestinationRealm string
+
+	// Interval for sending INTERIM_RECORDs. Set from the Acct-Interim-Interval received
+	// in the answers. Zero means that no interim records are to be sent
+	InterimInterval time.Duration
+
+	// Accounting-Record-Number to use in the next record
+	nextRecordNumber uint32
+
+	// Status of the session
+	isStarted bool
+	isStopped bool
+
+	// Time of the last record generated
+	lastRecordTime time.Time
+}
+
+// Creates a new accounting session towards the specified realm
+func NewRfSession(ci *config.PolicyConfigurationManager, destinationRealm string) *RfSession {
+	return &RfSession{
+		ci:               ci,
+		SessionId:        diamcodec.NewSessionId(ci.DiameterServerConf().DiameterHost),
+		DestinationRealm: destinationRealm,
+	}
+}
+
+// Builds the next ACR of the session, with the specified Accounting-Record-Type.
+// START_RECORD and EVENT_RECORD are only allowed as the first record, and have number 0.
+// INTERIM_RECORD and STOP_RECORD require a previous START_RECORD, and get consecutive numbers
+func (s *RfSession) NewACR(recordType int) (*diamcodec.DiameterMessage, error) {
+
+	switch recordType {
+	case START_RECORD, EVENT_RECORD:
+		if s.isStarted || s.isStopped {
+			return nil, fmt.Errorf("record type %d in session %s: %w", recordType, s.SessionId, ErrInvalidRecordSequence)
+		}
+	case INTERIM_RECORD, STOP_RECORD:
+		if !s.isStarted || s.isStopped {
+			return nil, fmt.Errorf("record type %d in session %s: %w", recordType, s.SessionId, ErrInvalidRecordSequence)
+		}
+	default:
+		return nil, fmt.Errorf("unknown record type %d", recordType)
+	}
+
+	acr, err := diamcodec.NewDiameterRequest("Accounting", "Accounting")
+	if err != nil {
+		return nil, err
+	}
+	acr.Add("Session-Id", s.SessionId)
+	acr.AddOriginAVPs(s.ci)
+	acr.Add("Destination-Realm", s.DestinationRealm)
+	acr.Add("Accounting-Record-Type", recordType)
+	acr.Add("Accounting-Record-Number", s.nextRecordNumber)
+	acr.Add("Acct-Application-Id", acr.ApplicationId)
+	acr.Add("Event-Timestamp", time.Now())
+
+	// Update the state
+	s.nextRecordNumber++
+	s.lastRecordTime = time.Now()
+	switch recordType {
+	case START_RECORD:
+		s.isStarted = true
+	case EVENT_RECORD, STOP_RECORD:
+		s.isStopped = true
+	}
+
+	return acr, nil
+}
+
+// Processes the answer to an ACR of this session. Updates the interim interval if
+// the Acct-Interim-Interval AVP is present, and returns an error if the answer is not
+// successful
+func (s *RfSession) ProcessACA(aca *diamcodec.DiameterMessage) error {
+
+	if sessionId := aca.GetStringAVP("Session-Id"); sessionId != s.SessionId {
+		return fmt.Errorf("answer for session %s received in session %s", sessionId, s.SessionId)
+	}
+
+	if interimAVP, err := aca.GetAVP("Acct-Interim-Interval"); err == nil {
+		s.InterimInterval = time.Duration(interimAVP.GetInt()) * time.Second
+	}
+
+	if resultCode := aca.GetResultCode(); resultCode != diamcodec.DIAMETER_SUCCESS {
+		return fmt.Errorf("accounting answer for session %s with Result-Code %d", s.SessionId, resultCode)
+	}
+
+	return nil
+}
+
+// Returns the time at which the next INTERIM_RECORD should be sent, or the zero time
+// if the session is not started or no interim records are to be sent
+func (s *RfSession) NextInterimTime() time.Time {
+	if !s.isStarted || s.isStopped || s.InterimInterval == 0 {
+		return time.Time{}
+	}
+	return s.lastRecordTime.Add(s.InterimInterval)
+}
+
+// Returns true if an INTERIM_RECORD should be sent
+func (s *RfSession) IsInterimDue(now time.Time) bool {
+	next := s.NextInterimTime()
+	return !next.IsZero() && !now.Before(next)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// Stores the ACRs that could not be delivered to the CDF, to be sent later in order,
+// with the T flag set, as specified for the GRANT_AND_STORE value of Accounting-Realtime-Required.
+// Safe for concurrent use
+type ACRBuffer struct {
+	sync.Mutex
+
+	// Maximum number of records to store
+	maxSize int
+
+	records []*diamcodec.DiameterMessage
+}
+
+// Creates a buffer for up to maxSize records
+func NewACRBuffer(maxSize int) *ACRBuffer {
+	return &ACRBuffer{maxSize: maxSize, records: make([]*diamcodec.DiameterMessage, 0)}
+}
+
+// Stores a record. Returns ErrBufferFull if there is no space for it
+func (b *ACRBuffer) Store(acr *diamcodec.DiameterMessage) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.records) >= b.maxSize {
+		return ErrBufferFull
+	}
+	b.records = append(b.records, acr)
+	return nil
+}
+
+// Returns the number of stored records
+func (b *ACRBuffer) Len() int {
+	b.Lock()
+	defer b.Unlock()
+	return len(b.records)
+}
+
+// Sends the stored records in order, marked as potentially retransmitted, using the
+// specified function. Stops at the first error, keeping the records not sent. Returns
+// the number of records sent
+func (b *ACRBuffer) Flush(send func(acr *diamcodec.DiameterMessage) error) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	for i, acr := range b.records {
+		acr.IsRetransmission = true
+		if err := send(acr); err != nil {
+			b.records = b.records[i:]
+			return i, err
+		}
+	}
+
+	sent := len(b.records)
+	b.records = make([]*diamcodec.DiameterMessage, 0)
+	return sent, nil
+}
@@ -0,0 +1,399 @@
+package diamapps
+
+import (
+	"fmt"
+	"igor/config"
+	"igor/diamcodec"
+	"igor/milenage"
+	"strings"
+)
+
+// Helpers for the S6a interface between MME and HSS (3GPP TS 29.272), to build and parse the
+// Authentication-Information and Update-Location messages. The E-UTRAN authentication vectors are
+// generated with MILENAGE, so that igor may be used as a test HSS
+
+// Values of ULR-Flags
+const (
+	ULR_SINGLE_REGISTRATION_INDICATION = 1 << 0
+	ULR_S6A_S6D_INDICATOR              = 1 << 1
+	ULR_SKIP_SUBSCRIBER_DATA           = 1 << 2
+	ULR_INITIAL_ATTACH_INDICATOR       = 1 << 5
+)
+
+// Values of ULA-Flags
+const ULA_SEPARATION_INDICATION = 1 << 0
+
+// RAT-Type of E-UTRAN, as in 3GPP TS 29.212. Sent in the 3GPP-3G-RAT-Type AVP of the dictionary, which
+// has the same code
+const RAT_TYPE_EUTRAN = 1004
+
+// Values of Subscriber-Status
+const (
+	SUBSCRIBER_STATUS_SERVICE_GRANTED             = 0
+	SUBSCRIBER_STATUS_OPERATOR_DETERMINED_BARRING = 1
+)
+
+// Values of PDN-Type
+const (
+	PDN_TYPE_IPV4   = 0
+	PDN_TYPE_IPV6   = 1
+	PDN_TYPE_IPV4V6 = 2
+)
+
+// Experimental-Result-Codes of S6a, sent in the Experimental-Result AVP
+const (
+	DIAMETER_AUTHENTICATION_DATA_UNAVAILABLE = 4181
+	DIAMETER_ERROR_USER_UNKNOWN              = 5001
+	DIAMETER_ERROR_ROAMING_NOT_ALLOWED       = 5004
+	DIAMETER_ERROR_UNKNOWN_EPS_SUBSCRIPTION  = 5420
+	DIAMETER_ERROR_RAT_NOT_ALLOWED           = 5421
+)
+
+// Contents of an Authentication-Information-Request
+type AuthenticationInformationRequest struct {
+	// IMSI
+	UserName      string
+	VisitedPLMNId []byte
+
+	NumberOfVectors uint32
+
+	// RAND and AUTS, sent by the MME after a synchronization failure. Empty if not present
+	ResynchronizationInfo []byte
+}
+
+// Subscription data sent in the Update-Location-Answer. Only the most common elements are represented
+type SubscriptionData struct {
+	// Digits, TBCD encoded in the AVP
+	MSISDN string
+
+	SubscriberStatus  int
+	NetworkAccessMode int
+
+	// AMBR, in bits per second. Not included if zero
+	AMBRUplink   uint32
+	AMBRDownlink uint32
+
+	DefaultContextIdentifier uint32
+	APNs                     []APNConfiguration
+}
+
+// Contents of an APN-Configuration
+type APNConfiguration struct {
+	ContextIdentifier uint32
+	ServiceSelection  string
+	PDNType           int
+}
+
+// Builds a S6a Authentication-Information-Request for the E-UTRAN vectors of the subscriber. The
+// resynchronization info is the concatenation of RAND and AUTS, and may be nil
+func NewAIR(ci *config.PolicyConfigurationManager, destinationRealm string, imsi string, visitedPLMNId []byte, numberOfVectors int, resynchronizationInfo []byte) (*diamcodec.DiameterMessage, error) {
+	request, err := newIMSRequest(ci, "S6a", "Authentication-Information", destinationRealm)
+	if err != nil {
+		return nil, err
+	}
+	request.Add("User-Name", imsi)
+	request.Add("3GPP-Visited-PLMN-Id", visitedPLMNId)
+
+	authInfo, _ := diamcodec.NewAVP("3GPP-Requested-EUTRAN-Authentication-Info", nil)
+	authInfo.Add("3GPP-Number-Of-Requested-Vectors", numberOfVectors)
+	authInfo.Add("3GPP-Immediate-Response-Preferred", 0)
+	if len(resynchronizationInfo) > 0 {
+		authInfo.Add("3GPP-Re-Synchronization-Info", resynchronizationInfo)
+	}
+	request.AddAVP(authInfo)
+	return request, nil
+}
+
+// Builds a S6a Update-Location-Request, with the specified ULR-Flags
+func NewULR(ci *config.PolicyConfigurationManager, destinationRealm string, imsi string, visitedPLMNId []byte, ratType int, flags uint32) (*diamcodec.DiameterMessage, error) {
+	request, err := newIMSRequest(ci, "S6a", "Update-Location", destinationRealm)
+	if err != nil {
+		return nil, err
+	}
+	request.Add("User-Name", imsi)
+	request.Add("3GPP-3G-RAT-Type", ratType)
+	request.Add("3GPP-ULR-Flags", flags)
+	request.Add("3GPP-Visited-PLMN-Id", visitedPLMNId)
+	return request, nil
+}
+
+// Validates the Authentication-Information-Request against the dictionary and returns its contents
+func ParseAIR(request *diamcodec.DiameterMessage) (*AuthenticationInformationRequest, error) {
+	if request.CommandName != "Authentication-Information" || !request.IsRequest {
+		return nil, fmt.Errorf("%s is not an Authentication-Information request", request.CommandName)
+	}
+	if err := request.Validate(); err != nil {
+		return nil, err
+	}
+
+	air := AuthenticationInformationRequest{UserName: request.GetStringAVP("User-Name")}
+	if plmn, err := request.GetAVP("3GPP-Visited-PLMN-Id"); err == nil {
+		air.VisitedPLMNId = plmn.GetOctets()
+	}
+	if authInfo, err := request.GetAVP("3GPP-Requested-EUTRAN-Authentication-Info"); err == nil {
+		if n, err := authInfo.GetAVP("3GPP-Number-Of-Requested-Vectors"); err == nil {
+			air.NumberOfVectors = uint32(n.GetInt())
+		}
+		if resync, err := authInfo.GetAVP("3GPP-Re-Synchronization-Info"); err == nil {
+			air.ResynchronizationInfo = resync.GetOctets()
+		}
+	}
+	return &air, nil
+}
+
+// Builds the Authentication-Information-Answer with the vectors, which are only included if the result
+// is successful. The answer is validated against the dictionary
+func NewAIA(ci *config.PolicyConfigurationManager, request *diamcodec.DiameterMessage, resultCode int64, vectors []milenage.EUTRANVector) (*diamcodec.DiameterMessage, error) {
+	answer := newS6aAnswer(ci, request, resultCode)
+	if resultCode == diamcodec.DIAMETER_SUCCESS && len(vectors) > 0 {
+		authInfo, _ := diamcodec.NewAVP("3GPP-Authentication-Info", nil)
+		for i := range vectors {
+			vector, _ := diamcodec.NewAVP("3GPP-E-UTRAN-Vector", nil)
+			vector.Add("3GPP-Item-Number", i+1)
+			vector.Add("3GPP-RAND", vectors[i].RAND)
+			vector.Add("3GPP-XRES", vectors[i].XRES)
+			vector.Add("3GPP-AUTN", vectors[i].AUTN)
+			vector.Add("3GPP-KASME", vectors[i].KASME)
+			authInfo.AddAVP(*vector)
+		}
+		answer.AddAVP(authInfo)
+	}
+
+	if err := answer.Validate(); err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
+
+// Builds the Update-Location-Answer with the ULA-Flags and the subscription data, which may be nil. The
+// answer is validated against the dictionary
+func NewULA(ci *config.PolicyConfigurationManager, request *diamcodec.DiameterMessage, resultCode int64, flags uint32, subscriptionData *SubscriptionData) (*diamcodec.DiameterMessage, error) {
+	answer := newS6aAnswer(ci, request, resultCode)
+	if resultCode == diamcodec.DIAMETER_SUCCESS {
+		answer.Add("3GPP-ULA-Flags", flags)
+		if subscriptionData != nil {
+			answer.AddAVP(subscriptionData.toAVP())
+		}
+	}
+
+	if err := answer.Validate(); err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
+
+// Returns the E-UTRAN vectors in the Authentication-Information-Answer
+func GetEUTRANVectors(answer *diamcodec.DiameterMessage) []milenage.EUTRANVector {
+	authInfo, err := answer.GetAVP("3GPP-Authentication-Info")
+	if err != nil {
+		return nil
+	}
+
+	var vectors []milenage.EUTRANVector
+	for _, avp := range authInfo.GetAllAVP("3GPP-E-UTRAN-Vector") {
+		vector := milenage.EUTRANVector{}
+		for _, inner := range avp.Value.([]diamcodec.DiameterAVP) {
+			switch inner.Name {
+			case "3GPP-RAND":
+				vector.RAND = inner.GetOctets()
+			case "3GPP-XRES":
+				vector.XRES = inner.GetOctets()
+			case "3GPP-AUTN":
+				vector.AUTN = inner.GetOctets()
+			case "3GPP-KASME":
+				vector.KASME = inner.GetOctets()
+			}
+		}
+		vectors = append(vectors, vector)
+	}
+	return vectors
+}
+
+// Returns the subscription data in the Update-Location-Answer, or nil if not present
+func GetSubscriptionData(answer *diamcodec.DiameterMessage) *SubscriptionData {
+	avp, err := answer.GetAVP("3GPP-Subscription-Data")
+	if err != nil {
+		return nil
+	}
+
+	sd := SubscriptionData{}
+	for _, inner := range avp.Value.([]diamcodec.DiameterAVP) {
+		switch inner.Name {
+		case "3GPP-MSISDN":
+			sd.MSISDN = decodeTBCD(inner.GetOctets())
+		case "3GPP-Subscriber-Status":
+			sd.SubscriberStatus = int(inner.GetInt())
+		case "3GPP-Network-Access-Mode":
+			sd.NetworkAccessMode = int(inner.GetInt())
+		case "3GPP-AMBR":
+			if ul, err := inner.GetAVP("3GPP-Max-Requested-Bandwidth-UL"); err == nil {
+				sd.AMBRUplink = uint32(ul.GetInt())
+			}
+			if dl, err := inner.GetAVP("3GPP-Max-Requested-Bandwidth-DL"); err == nil {
+				sd.AMBRDownlink = uint32(dl.GetInt())
+			}
+		case "3GPP-APN-Configuration-Profile":
+			if contextId, err := inner.GetAVP("3GPP-Context-Identifier"); err == nil {
+				sd.DefaultContextIdentifier = uint32(contextId.GetInt())
+			}
+			for _, apnAVP := range inner.GetAllAVP("3GPP-APN-Configuration") {
+				apn := APNConfiguration{}
+				for _, apnInner := range apnAVP.Value.([]diamcodec.DiameterAVP) {
+					switch apnInner.Name {
+					case "3GPP-Context-Identifier":
+						apn.ContextIdentifier = uint32(apnInner.GetInt())
+					case "Service-Selection":
+						apn.ServiceSelection = apnInner.GetString()
+					case "3GPP-PDN-Type":
+						apn.PDNType = int(apnInner.GetInt())
+					}
+				}
+				sd.APNs = append(sd.APNs, apn)
+			}
+		}
+	}
+	return &sd
+}
+
+// Builds the Subscription-Data AVP
+func (sd *SubscriptionData) toAVP() *diamcodec.DiameterAVP {
+	avp, _ := diamcodec.NewAVP("3GPP-Subscription-Data", nil)
+	avp.Add("3GPP-Subscriber-Status", sd.SubscriberStatus)
+	if sd.MSISDN != "" {
+		avp.Add("3GPP-MSISDN", encodeTBCD(sd.MSISDN))
+	}
+	avp.Add("3GPP-Network-Access-Mode", sd.NetworkAccessMode)
+	if sd.AMBRUplink != 0 || sd.AMBRDownlink != 0 {
+		ambr, _ := diamcodec.NewAVP("3GPP-AMBR", nil)
+		ambr.Add("3GPP-Max-Requested-Bandwidth-UL", sd.AMBRUplink)
+		ambr.Add("3GPP-Max-Requested-Bandwidth-DL", sd.AMBRDownlink)
+		avp.AddAVP(*ambr)
+	}
+	if len(sd.APNs) > 0 {
+		profile, _ := diamcodec.NewAVP("3GPP-APN-Configuration-Profile", nil)
+		profile.Add("3GPP-Context-Identifier", sd.DefaultContextIdentifier)
+		profile.Add("3GPP-All-APN-Configurations-Included-Indicator", 0)
+		for _, apn := range sd.APNs {
+			apnAVP, _ := diamcodec.NewAVP("3GPP-APN-Configuration", nil)
+			apnAVP.Add("3GPP-Context-Identifier", apn.ContextIdentifier)
+			apnAVP.Add("3GPP-PDN-Type", apn.PDNType)
+			apnAVP.Add("Service-Selection", apn.ServiceSelection)
+			profile.AddAVP(*apnAVP)
+		}
+		avp.AddAVP(*profile)
+	}
+	return avp
+}
+
+// Builds an answer of the S6a application with the common AVPs. The S6a specific result codes are sent in
+// the Experimental-Result
+func newS6aAnswer(ci *config.PolicyConfigurationManager, request *diamcodec.DiameterMessage, resultCode int64) *diamcodec.DiameterMessage {
+	answer := diamcodec.NewDiameterAnswer(request, diamcodec.CopySessionId(), diamcodec.CopyAVPs("Vendor-Specific-Application-Id"))
+	switch resultCode {
+	case DIAMETER_AUTHENTICATION_DATA_UNAVAILABLE, DIAMETER_ERROR_USER_UNKNOWN, DIAMETER_ERROR_ROAMING_NOT_ALLOWED,
+		DIAMETER_ERROR_UNKNOWN_EPS_SUBSCRIPTION, DIAMETER_ERROR_RAT_NOT_ALLOWED:
+		answer.SetExperimentalResult(VENDOR_3GPP, int(resultCode))
+	default:
+		answer.SetResultCode(int(resultCode))
+	}
+	answer.Add("Auth-Session-State", "NO_STATE_MAINTAINED")
+	answer.AddOriginAVPs(ci)
+	return answer
+}
+
+// Encodes the digits as TBCD, with the nibbles swapped and padded with F
+func encodeTBCD(digits string) []byte {
+	if len(digits)%2 != 0 {
+		digits += "f"
+	}
+	b := make([]byte, len(digits)/2)
+	for i := range b {
+		b[i] = nibble(digits[2*i+1])<<4 | nibble(digits[2*i])
+	}
+	return b
+}
+
+// Returns the value of the hex digit
+func nibble(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return 0x0f
+	}
+}
+
+// Decodes the TBCD digits
+func decodeTBCD(b []byte) string {
+	var sb strings.Builder
+	for _, octet := range b {
+		for _, n := range []byte{octet & 0x0f, octet >> 4} {
+			if n == 0x0f {
+				return sb.String()
+			}
+			sb.WriteByte("0123456789*#abc"[n])
+		}
+	}
+	return sb.String()
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// Authentication data of a subscriber in a test HSS. Not safe for concurrent use
+type HSSSubscriber struct {
+	IMSI string
+	K    []byte
+	OPc  []byte
+	AMF  []byte
+
+	// Last sequence number used
+	SQN uint64
+}
+
+// Answers the Authentication-Information-Request for the subscriber, generating the requested vectors with
+// consecutive sequence numbers. If the request has resynchronization info, the sequence number is first
+// set to the one in the USIM
+func (s *HSSSubscriber) AnswerAIR(ci *config.PolicyConfigurationManager, request *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, error) {
+	air, err := ParseAIR(request)
+	if err != nil {
+		return nil, err
+	}
+	if air.UserName != s.IMSI {
+		return NewAIA(ci, request, DIAMETER_ERROR_USER_UNKNOWN, nil)
+	}
+
+	m, err := milenage.New(s.K, s.OPc)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(air.ResynchronizationInfo) > 0 {
+		if len(air.ResynchronizationInfo) != milenage.RAND_SIZE+milenage.AUTS_SIZE {
+			return NewAIA(ci, request, DIAMETER_AUTHENTICATION_DATA_UNAVAILABLE, nil)
+		}
+		sqn, err := m.ResynchronizeSQN(air.ResynchronizationInfo[0:milenage.RAND_SIZE], air.ResynchronizationInfo[milenage.RAND_SIZE:])
+		if err != nil {
+			config.GetLogger().Warnf("resynchronization of %s failed: %s", s.IMSI, err)
+			return NewAIA(ci, request, DIAMETER_AUTHENTICATION_DATA_UNAVAILABLE, nil)
+		}
+		s.SQN = milenage.SQNValue(sqn)
+	}
+
+	numberOfVectors := air.NumberOfVectors
+	if numberOfVectors == 0 {
+		numberOfVectors = 1
+	}
+	vectors := make([]milenage.EUTRANVector, 0, numberOfVectors)
+	for i := uint32(0); i < numberOfVectors; i++ {
+		s.SQN++
+		vector, err := m.GenerateEUTRANVector(milenage.SQNBytes(s.SQN), s.AMF, air.VisitedPLMNId)
+		if err != nil {
+			return nil, err
+		}
+		vectors = append(vectors, *vector)
+	}
+
+	return NewAIA(ci, request, diamcodec.DIAMETER_SUCCESS, vectors)
+}
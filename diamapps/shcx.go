@@ -0,0 +1,276 @@
+package diamapps
+
+import (
+	"encoding/xml"
+	"fmt"
+	"igor/config"
+	"igor/diamcodec"
+)
+
+// Helpers for the IMS Cx/Dx (3GPP TS 29.229) and Sh (3GPP TS 29.329) interfaces,
+// to build requests towards an HSS and to handle the User-Data XML documents
+
+const VENDOR_3GPP = 10415
+
+// Values of Server-Assignment-Type
+const (
+	SAT_NO_ASSIGNMENT          = 0
+	SAT_REGISTRATION           = 1
+	SAT_RE_REGISTRATION        = 2
+	SAT_UNREGISTERED_USER      = 3
+	SAT_TIMEOUT_DEREGISTRATION = 4
+	SAT_USER_DEREGISTRATION    = 5
+	SAT_ADMINISTRATIVE_DEREG   = 8
+	SAT_AUTHENTICATION_FAILURE = 9
+	SAT_AUTHENTICATION_TIMEOUT = 10
+	SAT_AAA_USER_DATA_REQUEST  = 12
+)
+
+// Values of Data-Reference
+const (
+	DR_REPOSITORY_DATA         = 0
+	DR_IMS_PUBLIC_IDENTITY     = 10
+	DR_IMS_USER_STATE          = 11
+	DR_SCSCF_NAME              = 12
+	DR_INITIAL_FILTER_CRITERIA = 13
+	DR_LOCATION_INFORMATION    = 14
+	DR_USER_STATE              = 15
+	DR_CHARGING_INFORMATION    = 16
+	DR_MSISDN                  = 17
+)
+
+// Builds a request of the Cx, Sh or S6a application with the common AVPs
+func newIMSRequest(ci *config.PolicyConfigurationManager, appName string, commandName string, destinationRealm string) (*diamcodec.DiameterMessage, error) {
+	request, err := diamcodec.NewDiameterRequest(appName, commandName)
+	if err != nil {
+		return nil, err
+	}
+
+	request.Add("Session-Id", diamcodec.NewSessionId(ci.DiameterServerConf().DiameterHost))
+
+	// Vendor-Specific-Application-Id
+	vsai, _ := diamcodec.NewAVP("Vendor-Specific-Application-Id", nil)
+	vendorId, _ := diamcodec.NewAVP("Vendor-Id", VENDOR_3GPP)
+	authAppId, _ := diamcodec.NewAVP("Auth-Application-Id", request.ApplicationId)
+	vsai.AddAVP(*vendorId).AddAVP(*authAppId)
+	request.AddAVP(vsai)
+
+	request.Add("Auth-Session-State", "NO_STATE_MAINTAINED")
+	request.AddOriginAVPs(ci)
+	request.Add("Destination-Realm", destinationRealm)
+
+	return request, nil
+}
+
+// Builds a Cx User-Authorization-Request
+func NewUAR(ci *config.PolicyConfigurationManager, destinationRealm string, privateIdentity string, publicIdentity string, visitedNetwork string) (*diamcodec.DiameterMessage, error) {
+	request, err := newIMSRequest(ci, "Cx", "User-Authorization", destinationRealm)
+	if err != nil {
+		return nil, err
+	}
+	request.Add("User-Name", privateIdentity)
+	request.Add("3GPP-Public-Identity", publicIdentity)
+	request.Add("3GPP-Visited-Network-Identifier", []byte(visitedNetwork))
+	return request, nil
+}
+
+// Builds a Cx Server-Assignment-Request
+func NewSAR(ci *config.PolicyConfigurationManager, destinationRealm string, privateIdentity string, publicIdentity string, serverName string, assignmentType int) (*diamcodec.DiameterMessage, error) {
+	request, err := newIMSRequest(ci, "Cx", "Server-Assignment", destinationRealm)
+	if err != nil {
+		return nil, err
+	}
+	if privateIdentity != "" {
+		request.Add("User-Name", privateIdentity)
+	}
+	request.Add("3GPP-Public-Identity", publicIdentity)
+	request.Add("3GPP-Server-Name", serverName)
+	request.Add("3GPP-Server-Assignment-Type", assignmentType)
+	request.Add("3GPP-User-Data-Already-Available", "USER_DATA_NOT_AVAILABLE")
+	return request, nil
+}
+
+// Builds a Cx Location-Info-Request
+func NewLIR(ci *config.PolicyConfigurationManager, destinationRealm string, publicIdentity string) (*diamcodec.DiameterMessage, error) {
+	request, err := newIMSRequest(ci, "Cx", "Location-Info", destinationRealm)
+	if err != nil {
+		return nil, err
+	}
+	request.Add("3GPP-Public-Identity", publicIdentity)
+	return request, nil
+}
+
+// Builds a Cx Multimedia-Auth-Request, asking for the specified number of authentication vectors
+// with the specified scheme (e.g. "Digest-AKAv1-MD5" or "SIP Digest")
+func NewMAR(ci *config.PolicyConfigurationManager, destinationRealm string, privateIdentity string, publicIdentity string, serverName string, scheme string, numberOfItems int) (*diamcodec.DiameterMessage, error) {
+	request, err := newIMSRequest(ci, "Cx", "Multimedia-Auth", destinationRealm)
+	if err != nil {
+		return nil, err
+	}
+	request.Add("User-Name", privateIdentity)
+	request.Add("3GPP-Public-Identity", publicIdentity)
+
+	authDataItem, _ := diamcodec.NewAVP("3GPP-SIP-Auth-Data-Item", nil)
+	authScheme, _ := diamcodec.NewAVP("3GPP-SIP-Authentication-Scheme", scheme)
+	authDataItem.AddAVP(*authScheme)
+	request.AddAVP(authDataItem)
+
+	request.Add("3GPP-SIP-Number-Auth-Items", numberOfItems)
+	request.Add("3GPP-Server-Name", serverName)
+	return request, nil
+}
+
+// Builds a Sh User-Data-Request for the specified public identity and data references
+func NewUDR(ci *config.PolicyConfigurationManager, destinationRealm string, publicIdentity string, dataReferences ...int) (*diamcodec.DiameterMessage, error) {
+	request, err := newIMSRequest(ci, "Sh", "User-Data", destinationRealm)
+	if err != nil {
+		return nil, err
+	}
+	request.AddAVP(newUserIdentity(publicIdentity))
+	for _, dataReference := range dataReferences {
+		request.Add("3GPP-Data-Reference", dataReference)
+	}
+	return request, nil
+}
+
+// Builds a Sh Profile-Update-Request with the specified Sh-Data document
+func NewPUR(ci *config.PolicyConfigurationManager, destinationRealm string, publicIdentity string, dataReference int, shData *ShData) (*diamcodec.DiameterMessage, error) {
+	request, err := newIMSRequest(ci, "Sh", "Profile-Update", destinationRealm)
+	if err != nil {
+		return nil, err
+	}
+	userData, err := shData.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	request.AddAVP(newUserIdentity(publicIdentity))
+	request.Add("3GPP-Data-Reference", dataReference)
+	request.Add("3GPP-Sh-User-Data", userData)
+	return request, nil
+}
+
+// Builds the User-Identity grouped AVP
+func newUserIdentity(publicIdentity string) *diamcodec.DiameterAVP {
+	userIdentity, _ := diamcodec.NewAVP("3GPP-User-Identity", nil)
+	publicIdentityAVP, _ := diamcodec.NewAVP("3GPP-Public-Identity", publicIdentity)
+	userIdentity.AddAVP(*publicIdentityAVP)
+	return userIdentity
+}
+
+// Returns the result code of an answer, which may be in the Result-Code AVP or, for
+// the IMS specific codes, in the Experimental-Result-Code inside Experimental-Result
+func GetIMSResultCode(answer *diamcodec.DiameterMessage) int64 {
+	if resultCode := answer.GetResultCode(); resultCode != 0 {
+		return resultCode
+	}
+	return answer.GetIntAVP("Experimental-Result.Experimental-Result-Code")
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// User-Data XML documents
+///////////////////////////////////////////////////////////////////////////////
+
+// Sh-Data document, as specified in 3GPP TS 29.328. Only the most common elements are
+// represented. ServiceData is kept as raw XML
+type ShData struct {
+	XMLName           xml.Name           `xml:"Sh-Data"`
+	PublicIdentifiers *PublicIdentifiers `xml:"PublicIdentifiers,omitempty"`
+	RepositoryData    []RepositoryData   `xml:"RepositoryData,omitempty"`
+	ShIMSData         *ShIMSData         `xml:"Sh-IMS-Data,omitempty"`
+}
+
+type PublicIdentifiers struct {
+	IMSPublicIdentity []string `xml:"IMSPublicIdentity,omitempty"`
+	MSISDN            []string `xml:"MSISDN,omitempty"`
+}
+
+type RepositoryData struct {
+	ServiceIndication string       `xml:"ServiceIndication"`
+	SequenceNumber    int          `xml:"SequenceNumber"`
+	ServiceData       *ServiceData `xml:"ServiceData,omitempty"`
+}
+
+type ServiceData struct {
+	Content string `xml:",innerxml"`
+}
+
+type ShIMSData struct {
+	SCSCFName    string `xml:"S-CSCFName,omitempty"`
+	IMSUserState *int   `xml:"IMSUserState,omitempty"`
+}
+
+// Parses a Sh-Data document
+func ParseShData(userData []byte) (*ShData, error) {
+	var shData ShData
+	if err := xml.Unmarshal(userData, &shData); err != nil {
+		return nil, fmt.Errorf("could not parse Sh-Data: %w", err)
+	}
+	return &shData, nil
+}
+
+// Generates the Sh-Data document
+func (sd *ShData) Marshal() ([]byte, error) {
+	userData, err := xml.Marshal(sd)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate Sh-Data: %w", err)
+	}
+	return append([]byte(xml.Header), userData...), nil
+}
+
+// Returns the Sh-Data in the Sh-User-Data AVP of the answer
+func GetShData(answer *diamcodec.DiameterMessage) (*ShData, error) {
+	avp, err := answer.GetAVP("3GPP-Sh-User-Data")
+	if err != nil {
+		return nil, err
+	}
+	return ParseShData(avp.GetOctets())
+}
+
+// IMSSubscription document sent in the Cx User-Data AVP, as specified in 3GPP TS 29.228.
+// The InitialFilterCriteria are kept as raw XML
+type IMSSubscription struct {
+	XMLName        xml.Name         `xml:"IMSSubscription"`
+	PrivateID      string           `xml:"PrivateID"`
+	ServiceProfile []ServiceProfile `xml:"ServiceProfile"`
+}
+
+type ServiceProfile struct {
+	PublicIdentity        []PublicIdentity        `xml:"PublicIdentity"`
+	InitialFilterCriteria []InitialFilterCriteria `xml:"InitialFilterCriteria,omitempty"`
+}
+
+type PublicIdentity struct {
+	BarringIndication *bool  `xml:"BarringIndication,omitempty"`
+	Identity          string `xml:"Identity"`
+}
+
+type InitialFilterCriteria struct {
+	Content string `xml:",innerxml"`
+}
+
+// Parses an IMSSubscription document
+func ParseIMSSubscription(userData []byte) (*IMSSubscription, error) {
+	var subscription IMSSubscription
+	if err := xml.Unmarshal(userData, &subscription); err != nil {
+		return nil, fmt.Errorf("could not parse IMSSubscription: %w", err)
+	}
+	return &subscription, nil
+}
+
+// Generates the IMSSubscription document
+func (is *IMSSubscription) Marshal() ([]byte, error) {
+	userData, err := xml.Marshal(is)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate IMSSubscription: %w", err)
+	}
+	return append([]byte(xml.Header), userData...), nil
+}
+
+// Returns the IMSSubscription in the User-Data AVP of a Server-Assignment-Answer
+func GetIMSSubscription(answer *diamcodec.DiameterMessage) (*IMSSubscription, error) {
+	avp, err := answer.GetAVP("3GPP-User-Data")
+	if err != nil {
+		return nil, err
+	}
+	return ParseIMSSubscription(avp.GetOctets())
+}
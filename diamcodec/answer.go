@@ -0,0 +1,109 @@
+package diamcodec
+
+// Helpers for building the answers in the handlers, copying from the request the AVPs that must be echoed
+// and setting the result.
+//
+//	answer := NewDiameterAnswer(request, CopyEchoedAVPs()).AddOriginAVPs(ci).SetSuccess()
+
+// Populates the answer from the request, when passed to NewDiameterAnswer
+type AnswerOption func(answer *DiameterMessage, request *DiameterMessage)
+
+// AVPs copied by CopyEchoedAVPs, if present in the request, besides the Session-Id and Proxy-Info
+var echoedAVPNames = []string{
+	"Auth-Application-Id",
+	"Acct-Application-Id",
+	"Vendor-Specific-Application-Id",
+	"Auth-Session-State",
+	"Accounting-Record-Type",
+	"Accounting-Record-Number",
+	"CC-Request-Type",
+	"CC-Request-Number",
+}
+
+// Copies the Session-Id of the request
+func CopySessionId() AnswerOption {
+	return CopyAVPs("Session-Id")
+}
+
+// Copies the Proxy-Info AVPs of the request, in the same order, as required in RFC 6733 section 6.7.3
+func CopyProxyInfo() AnswerOption {
+	return CopyAVPs("Proxy-Info")
+}
+
+// Copies all the instances of the specified AVPs of the request, if present
+func CopyAVPs(names ...string) AnswerOption {
+	return func(answer *DiameterMessage, request *DiameterMessage) {
+		for _, name := range names {
+			for _, avp := range request.GetAllAVP(name) {
+				answer.AddAVP(&avp)
+			}
+		}
+	}
+}
+
+// Copies the Session-Id, the Proxy-Info and the AVPs that the base and credit control applications require
+// to be echoed in the answer, such as the Auth-Application-Id, CC-Request-Type or Accounting-Record-Number
+func CopyEchoedAVPs() AnswerOption {
+	return func(answer *DiameterMessage, request *DiameterMessage) {
+		CopySessionId()(answer, request)
+		CopyAVPs(echoedAVPNames...)(answer, request)
+		CopyProxyInfo()(answer, request)
+	}
+}
+
+// Sets the Result-Code, replacing the existing one or the Experimental-Result, and the E bit if the
+// code is of a protocol error
+func (dm *DiameterMessage) SetResultCode(resultCode int) *DiameterMessage {
+	dm.DeleteAllAVP("Result-Code").DeleteAllAVP("Experimental-Result")
+	dm.IsError = resultCode >= 3000 && resultCode < 4000
+	return dm.Add("Result-Code", resultCode)
+}
+
+// Sets DIAMETER_SUCCESS as the Result-Code
+func (dm *DiameterMessage) SetSuccess() *DiameterMessage {
+	return dm.SetResultCode(DIAMETER_SUCCESS)
+}
+
+// Sets the Result-Code and, if not empty, the Error-Message
+func (dm *DiameterMessage) SetError(resultCode int, message string) *DiameterMessage {
+	dm.SetResultCode(resultCode).DeleteAllAVP("Error-Message")
+	if message != "" {
+		dm.Add("Error-Message", message)
+	}
+	return dm
+}
+
+// Sets the Experimental-Result with the result code of the vendor, instead of the Result-Code, as required
+// for the codes defined by the vendor specific applications, such as DIAMETER_ERROR_USER_UNKNOWN in S6a
+func (dm *DiameterMessage) SetExperimentalResult(vendorId uint32, resultCode int) *DiameterMessage {
+	dm.DeleteAllAVP("Result-Code").DeleteAllAVP("Experimental-Result")
+	dm.IsError = false
+
+	experimentalResult, err := NewAVPWithDict(dm.dict, "Experimental-Result", nil)
+	if err != nil {
+		return dm
+	}
+	experimentalResult.Add("Vendor-Id", vendorId)
+	experimentalResult.Add("Experimental-Result-Code", resultCode)
+	return dm.AddAVP(experimentalResult)
+}
+
+// Sets the error result of a vendor specific application, in the Experimental-Result with the Vendor-Id
+// of the Vendor-Specific-Application-Id of the answer, or in the Result-Code if there is none, and the
+// Error-Message if not empty
+func (dm *DiameterMessage) SetVendorError(resultCode int, message string) *DiameterMessage {
+	vsai, err := dm.GetAVP("Vendor-Specific-Application-Id")
+	if err != nil {
+		return dm.SetError(resultCode, message)
+	}
+	vendorId, err := vsai.GetAVP("Vendor-Id")
+	if err != nil {
+		return dm.SetError(resultCode, message)
+	}
+
+	dm.SetExperimentalResult(uint32(vendorId.GetUint()), resultCode).DeleteAllAVP("Error-Message")
+	if message != "" {
+		dm.Add("Error-Message", message)
+	}
+	return dm
+}
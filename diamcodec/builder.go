@@ -0,0 +1,215 @@
+package diamcodec
+
+import (
+	"encoding/json"
+	"fmt"
+	"igor/config"
+	"regexp"
+)
+
+// Helper for building diameter requests chaining the operations. The first error found is kept
+// and reported when the message is built, so that it does not need to be checked in every step.
+//
+//	request, err := NewDiameterRequestBuilder("Credit-Control", "Credit-Control").
+//		AddOriginAVPs(ci).
+//		SetSessionId("").
+//		Add("Destination-Realm", "igorserver").
+//		AddGroup("Subscription-Id", Item("Subscription-Id-Type", "END_USER_E164"), Item("Subscription-Id-Data", "34600000000")).
+//		Build()
+type DiameterRequestBuilder struct {
+	message *DiameterMessage
+	err     error
+}
+
+// Specification of an AVP to add to a group. The value of a grouped AVP is a []AVPItem
+type AVPItem struct {
+	Name  string
+	Value interface{}
+}
+
+// Returns the specification of an AVP, to be used in AddGroup
+func Item(name string, value interface{}) AVPItem {
+	return AVPItem{Name: name, Value: value}
+}
+
+// Returns the specification of a grouped AVP with the specified members, to be used in AddGroup
+func Group(name string, members ...AVPItem) AVPItem {
+	return AVPItem{Name: name, Value: members}
+}
+
+// Skeleton of the requests generated from templates
+type diameterRequestTemplate struct {
+	ApplicationName string
+	CommandName     string
+	AVPs            []DiameterAVP
+}
+
+// Matches the variables to replace in templates, as ${name}. If the variable is the full JSON string
+// (quotes included), it is replaced by the JSON value, so that numbers and booleans may be used
+var templateStringVariableRegex = regexp.MustCompile(`"\$\{([\w.-]+)\}"`)
+var templateVariableRegex = regexp.MustCompile(`\$\{([\w.-]+)\}`)
+
+// Starts building a diameter request for the specified application and command
+func NewDiameterRequestBuilder(appName string, commandName string) *DiameterRequestBuilder {
+	message, err := NewDiameterRequest(appName, commandName)
+	return &DiameterRequestBuilder{message: message, err: err}
+}
+
+// Starts building a diameter request from a JSON template, such as
+//
+//	{
+//		"ApplicationName": "Credit-Control",
+//		"CommandName": "Credit-Control",
+//		"AVPs": [
+//			{"Destination-Realm": "${realm}"},
+//			{"CC-Request-Number": "${requestNumber}"}
+//		]
+//	}
+//
+// where the ${name} variables are replaced by the values in the map, which are JSON encoded
+// if the variable is the full string, and formatted as text if embedded in a string
+func NewDiameterRequestBuilderFromTemplate(template []byte, variables map[string]interface{}) *DiameterRequestBuilder {
+	builder := DiameterRequestBuilder{message: &DiameterMessage{IsRequest: true}}
+
+	jsonTemplate, err := replaceTemplateVariables(template, variables)
+	if err != nil {
+		builder.err = err
+		return &builder
+	}
+
+	var skeleton diameterRequestTemplate
+	if err := json.Unmarshal(jsonTemplate, &skeleton); err != nil {
+		builder.err = fmt.Errorf("bad diameter request template: %w", err)
+		return &builder
+	}
+
+	builder.message, builder.err = NewDiameterRequest(skeleton.ApplicationName, skeleton.CommandName)
+	builder.message.AVPs = append(builder.message.AVPs, skeleton.AVPs...)
+	return &builder
+}
+
+// Adds the Origin-Host and Origin-Realm AVPs from the diameter server configuration
+func (b *DiameterRequestBuilder) AddOriginAVPs(ci *config.PolicyConfigurationManager) *DiameterRequestBuilder {
+	b.Add("Origin-Host", ci.DiameterServerConf().DiameterHost)
+	return b.Add("Origin-Realm", ci.DiameterServerConf().DiameterRealm)
+}
+
+// Adds the AVP with the specified name and value. Nil values are ignored
+func (b *DiameterRequestBuilder) Add(name string, value interface{}) *DiameterRequestBuilder {
+	if b.err != nil || value == nil {
+		return b
+	}
+
+	avp, err := newAVPFromItem(Item(name, value))
+	if err != nil {
+		b.err = err
+		return b
+	}
+	b.message.AddAVP(avp)
+	return b
+}
+
+// Adds a grouped AVP with the specified members, which may be themselves groups
+func (b *DiameterRequestBuilder) AddGroup(name string, members ...AVPItem) *DiameterRequestBuilder {
+	if b.err != nil {
+		return b
+	}
+
+	avp, err := newAVPFromItem(Group(name, members...))
+	if err != nil {
+		b.err = err
+		return b
+	}
+	b.message.AddAVP(avp)
+	return b
+}
+
+// Sets the Session-Id, which is placed as the first AVP, as recommended in RFC 6733. If empty, a new
+// one is generated using the Origin-Host, that must have been added before
+func (b *DiameterRequestBuilder) SetSessionId(sessionId string) *DiameterRequestBuilder {
+	if b.err != nil {
+		return b
+	}
+
+	if sessionId == "" {
+		originHost := b.message.GetStringAVP("Origin-Host")
+		if originHost == "" {
+			b.err = fmt.Errorf("Origin-Host is required to generate the Session-Id")
+			return b
+		}
+		sessionId = NewSessionId(originHost)
+	}
+
+	avp, err := NewAVP("Session-Id", sessionId)
+	if err != nil {
+		b.err = err
+		return b
+	}
+	b.message.DeleteAllAVP("Session-Id")
+	b.message.AVPs = append([]DiameterAVP{*avp}, b.message.AVPs...)
+	return b
+}
+
+// Returns the request built, or the first error found while doing it
+func (b *DiameterRequestBuilder) Build() (*DiameterMessage, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	return b.message, nil
+}
+
+// Creates the AVP, recursively for grouped ones
+func newAVPFromItem(item AVPItem) (*DiameterAVP, error) {
+	members, isGroup := item.Value.([]AVPItem)
+	if !isGroup {
+		return NewAVP(item.Name, item.Value)
+	}
+
+	avp, err := NewAVP(item.Name, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range members {
+		memberAVP, err := newAVPFromItem(member)
+		if err != nil {
+			return nil, fmt.Errorf("%s in %s: %w", member.Name, item.Name, err)
+		}
+		avp.AddAVP(*memberAVP)
+	}
+	return avp, nil
+}
+
+// Replaces the ${name} variables in the template. All the variables must be defined
+func replaceTemplateVariables(template []byte, variables map[string]interface{}) ([]byte, error) {
+	var err error
+
+	// Full string values are replaced by the JSON encoded value
+	replaced := templateStringVariableRegex.ReplaceAllFunc(template, func(match []byte) []byte {
+		name := string(templateStringVariableRegex.FindSubmatch(match)[1])
+		value, found := variables[name]
+		if !found {
+			err = fmt.Errorf("variable %s not defined", name)
+			return match
+		}
+		jValue, e := json.Marshal(value)
+		if e != nil {
+			err = fmt.Errorf("variable %s: %w", name, e)
+			return match
+		}
+		return jValue
+	})
+
+	// Variables embedded in strings are replaced by the text, escaped for JSON
+	replaced = templateVariableRegex.ReplaceAllFunc(replaced, func(match []byte) []byte {
+		name := string(templateVariableRegex.FindSubmatch(match)[1])
+		value, found := variables[name]
+		if !found {
+			err = fmt.Errorf("variable %s not defined", name)
+			return match
+		}
+		jValue, _ := json.Marshal(fmt.Sprint(value))
+		return jValue[1 : len(jValue)-1]
+	})
+
+	return replaced, err
+}
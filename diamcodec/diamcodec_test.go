@@ -3,8 +3,12 @@ package diamcodec
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"igor/config"
+	"igor/core"
+	"igor/diamdict"
+	"io"
 	"net"
 	"os"
 	"reflect"
@@ -165,7 +169,6 @@ func TestUnsignedInt32AVP(t *testing.T) {
 
 func TestUnsignedInt64AVP(t *testing.T) {
 
-	// Due to a limitaton of the implementation, it is inernally stored as a signed int64
 	var theInt int64 = 65535 * 65535 * 65535 * 16001
 
 	// Create avp
@@ -192,6 +195,48 @@ func TestUnsignedInt64AVP(t *testing.T) {
 	}
 }
 
+func TestUnsignedInt64FullRange(t *testing.T) {
+
+	// Above the int64 range
+	var theValue uint64 = 1<<63 + 12345
+
+	avp, err := NewAVP("franciscocardosogil-myUnsigned64", theValue)
+	if err != nil {
+		t.Fatalf("error creating UInt64 AVP %v", err)
+	}
+	if _, err := NewAVP("franciscocardosogil-myUnsigned64", -1); err == nil {
+		t.Errorf("negative Unsigned64 value accepted")
+	}
+
+	binaryAVP, _ := avp.MarshalBinary()
+	rebuiltAVP, _, _ := DiameterAVPFromBytes(binaryAVP)
+	if rebuiltAVP.GetUint() != theValue || rebuiltAVP.GetString() != "9223372036854788153" {
+		t.Errorf("Unsigned Integer64 AVP not properly decoded. Got %d", rebuiltAVP.GetUint())
+	}
+
+	// JSON and CBOR
+	jAVP, _ := json.Marshal(&rebuiltAVP)
+	if string(jAVP) != `{"franciscocardosogil-myUnsigned64":9223372036854788153}` {
+		t.Errorf("bad JSON %s", jAVP)
+	}
+	var jsonAVP DiameterAVP
+	if err := json.Unmarshal(jAVP, &jsonAVP); err != nil || jsonAVP.GetUint() != theValue {
+		t.Errorf("Unsigned Integer64 AVP not properly unmarshaled from JSON. Got %d %v", jsonAVP.GetUint(), err)
+	}
+	cAVP, _ := avp.MarshalCBOR()
+	var cborAVP DiameterAVP
+	if err := cborAVP.UnmarshalCBOR(cAVP); err != nil || cborAVP.GetUint() != theValue {
+		t.Errorf("Unsigned Integer64 AVP not properly unmarshaled from CBOR. Got %d %v", cborAVP.GetUint(), err)
+	}
+
+	// Message getters
+	message, _ := NewDiameterRequest("Base", "Accounting")
+	message.Add("Accounting-Input-Octets", theValue)
+	if message.GetInputOctets() != theValue || message.GetUintAVP("Accounting-Input-Octets") != theValue {
+		t.Errorf("bad input octets %d", message.GetInputOctets())
+	}
+}
+
 func TestFloat32AVP(t *testing.T) {
 
 	var theFloat float32 = 6.03e23
@@ -869,3 +914,515 @@ func TestDiameterMessageJSON(t *testing.T) {
 	// Uncoment this to see the result
 	// fmt.Println(jBytes.String())
 }
+
+func TestDiameterMessageCBOR(t *testing.T) {
+	jDiameterMessage := `
+	{
+		"IsRequest": true,
+		"CommandCode": 2000,
+		"ApplicationId": 1000,
+		"avps":[
+			{
+			  "franciscocardosogil-myTestAllGrouped": [
+  				{"franciscocardosogil-myOctetString": "0102030405060708090a0b"},
+  				{"franciscocardosogil-myInteger32": -99},
+  				{"franciscocardosogil-myUnsigned64": 99},
+  				{"franciscocardosogil-myFloat64": 99.9},
+  				{"franciscocardosogil-myTime": "1966-11-26T03:34:08 UTC"},
+  				{"franciscocardosogil-myIPv4Address": "4.5.6.7"},
+  				{"franciscocardosogil-myEnumerated": "two"}
+			  ]
+			},
+			{"Session-Id": "my-session-id"}
+		]
+	}
+	`
+
+	var diameterMessage DiameterMessage
+	if err := json.Unmarshal([]byte(jDiameterMessage), &diameterMessage); err != nil {
+		t.Fatalf("unmarshal error for diameter message: %s", err)
+	}
+	diameterMessage.Tidy()
+
+	cborBytes, err := core.Marshal(core.CONTENT_TYPE_CBOR, &diameterMessage)
+	if err != nil {
+		t.Fatalf("cbor marshal error %s", err)
+	}
+	jsonBytes, _ := core.Marshal(core.CONTENT_TYPE_JSON, &diameterMessage)
+	if len(cborBytes) >= len(jsonBytes) {
+		t.Errorf("cbor size %d not smaller than json size %d", len(cborBytes), len(jsonBytes))
+	}
+
+	var recoveredMessage DiameterMessage
+	if err := core.Unmarshal(core.CONTENT_TYPE_CBOR, cborBytes, &recoveredMessage); err != nil {
+		t.Fatalf("cbor unmarshal error %s", err)
+	}
+	if !recoveredMessage.IsRequest || recoveredMessage.CommandCode != 2000 || recoveredMessage.GetStringAVP("Session-Id") != "my-session-id" {
+		t.Errorf("bad recovered message %s", recoveredMessage)
+	}
+	if recoveredMessage.GetIntAVP("franciscocardosogil-myTestAllGrouped.franciscocardosogil-myInteger32") != -99 {
+		t.Errorf("bad recovered int %s", recoveredMessage)
+	}
+	if recoveredMessage.GetStringAVP("franciscocardosogil-myTestAllGrouped.franciscocardosogil-myEnumerated") != "two" {
+		t.Errorf("bad recovered enumerated %s", recoveredMessage)
+	}
+	if recoveredMessage.GetStringAVP("franciscocardosogil-myTestAllGrouped.franciscocardosogil-myIPv4Address") != "4.5.6.7" {
+		t.Errorf("bad recovered address %s", recoveredMessage)
+	}
+	recoveredGrouped, _ := recoveredMessage.GetAVP("franciscocardosogil-myTestAllGrouped")
+	originalGrouped, _ := diameterMessage.GetAVP("franciscocardosogil-myTestAllGrouped")
+	if recoveredGrouped.String() != originalGrouped.String() {
+		t.Errorf("recovered grouped AVP %s is different from %s", recoveredGrouped, originalGrouped)
+	}
+}
+
+func TestDiameterMessageBinary(t *testing.T) {
+	diameterMessage := benchmarkMessage()
+	diameterMessage.SetReceivedFrom("server.igor")
+
+	binaryBytes, err := core.Marshal(core.CONTENT_TYPE_BINARY, diameterMessage)
+	if err != nil {
+		t.Fatalf("binary marshal error %s", err)
+	}
+	cborBytes, _ := core.Marshal(core.CONTENT_TYPE_CBOR, diameterMessage)
+	if len(binaryBytes) >= len(cborBytes) {
+		t.Errorf("binary size %d not smaller than cbor size %d", len(binaryBytes), len(cborBytes))
+	}
+
+	var recoveredMessage DiameterMessage
+	if err := core.Unmarshal(core.CONTENT_TYPE_BINARY, binaryBytes, &recoveredMessage); err != nil {
+		t.Fatalf("binary unmarshal error %s", err)
+	}
+	if recoveredMessage.String() != diameterMessage.String() {
+		t.Errorf("recovered message %s is different from %s", &recoveredMessage, diameterMessage)
+	}
+	if recoveredMessage.ReceivedFrom() != "server.igor" {
+		t.Errorf("received from not recovered: <%s>", recoveredMessage.ReceivedFrom())
+	}
+
+	// Corrupted envelope and message
+	if err := core.Unmarshal(core.CONTENT_TYPE_BINARY, binaryBytes[1:], &recoveredMessage); !errors.Is(err, core.ErrMalformed) {
+		t.Errorf("bad magic not detected: %v", err)
+	}
+	if err := core.Unmarshal(core.CONTENT_TYPE_BINARY, binaryBytes[:len(binaryBytes)-1], &recoveredMessage); !errors.Is(err, core.ErrMalformed) {
+		t.Errorf("truncated message not detected: %v", err)
+	}
+
+	// Types without a wire format are not supported
+	if _, err := core.Marshal(core.CONTENT_TYPE_BINARY, map[string]string{"a": "b"}); !errors.Is(err, core.ErrUnsupportedContentType) {
+		t.Errorf("binary marshal of map did not fail: %v", err)
+	}
+}
+
+func TestDiameterRequestBuilder(t *testing.T) {
+
+	request, err := NewDiameterRequestBuilder("TestApplication", "TestRequest").
+		AddOriginAVPs(config.GetPolicyConfig()).
+		Add("Destination-Realm", "igorserver").
+		AddGroup("franciscocardosogil-myGroupedInGrouped",
+			Group("franciscocardosogil-myGrouped",
+				Item("franciscocardosogil-myInteger32", 1),
+				Item("franciscocardosogil-myString", "hello"))).
+		SetSessionId("").
+		Build()
+	if err != nil {
+		t.Fatalf("could not build request: %s", err)
+	}
+
+	if !request.IsRequest || request.CommandName != "TestRequest" {
+		t.Errorf("bad request header %v", request)
+	}
+	if request.AVPs[0].Name != "Session-Id" || !strings.HasPrefix(request.AVPs[0].GetString(), "client.igorclient;") {
+		t.Errorf("Session-Id not generated in first place: %v", request.AVPs[0])
+	}
+	if request.GetStringAVP("Origin-Realm") != "igorclient" {
+		t.Errorf("bad Origin-Realm %s", request.GetStringAVP("Origin-Realm"))
+	}
+	if v := request.GetStringAVP("franciscocardosogil-myGroupedInGrouped.franciscocardosogil-myGrouped.franciscocardosogil-myInteger32"); v != "1" {
+		t.Errorf("bad nested value %s", v)
+	}
+
+	// The first error is reported
+	_, err = NewDiameterRequestBuilder("TestApplication", "TestRequest").
+		Add("Unknown AVP", "value").
+		SetSessionId("my-session").
+		Build()
+	if err == nil {
+		t.Errorf("unknown AVP did not produce an error")
+	}
+
+	// Session-Id generation requires Origin-Host
+	if _, err = NewDiameterRequestBuilder("TestApplication", "TestRequest").SetSessionId("").Build(); err == nil {
+		t.Errorf("Session-Id generated without Origin-Host")
+	}
+}
+
+func TestDiameterRequestTemplate(t *testing.T) {
+
+	template := []byte(`{
+		"ApplicationName": "TestApplication",
+		"CommandName": "TestRequest",
+		"AVPs": [
+			{"Destination-Realm": "${realm}"},
+			{"User-Name": "user-${id}@${realm}"},
+			{"franciscocardosogil-myGrouped": [
+				{"franciscocardosogil-myInteger32": "${number}"}
+			]}
+		]
+	}`)
+
+	request, err := NewDiameterRequestBuilderFromTemplate(template, map[string]interface{}{"realm": "igorserver", "id": 7, "number": 99}).
+		SetSessionId("my-session").
+		Build()
+	if err != nil {
+		t.Fatalf("could not build request from template: %s", err)
+	}
+	if request.GetStringAVP("User-Name") != "user-7@igorserver" {
+		t.Errorf("bad User-Name %s", request.GetStringAVP("User-Name"))
+	}
+	if request.GetIntAVP("franciscocardosogil-myGrouped.franciscocardosogil-myInteger32") != 99 {
+		t.Errorf("bad grouped value %v", request)
+	}
+	if request.ApplicationId == 0 || request.CommandCode == 0 || request.GetStringAVP("Session-Id") != "my-session" {
+		t.Errorf("bad request %v", request)
+	}
+
+	if _, err = NewDiameterRequestBuilderFromTemplate(template, map[string]interface{}{"realm": "igorserver"}).Build(); err == nil {
+		t.Errorf("undefined variables did not produce an error")
+	}
+}
+
+func TestDiameterMessageValidation(t *testing.T) {
+
+	request, _ := NewDiameterRequestBuilder("TestApplication", "TestRequest").
+		AddOriginAVPs(config.GetPolicyConfig()).
+		SetSessionId("my-session").
+		Add("Destination-Realm", "igorserver").
+		Add("Destination-Host", "server.igorserver").
+		Add("Auth-Application-Id", 1000).
+		AddGroup("Subscription-Id", Item("Subscription-Id-Type", 0), Item("Subscription-Id-Data", "34600000000")).
+		Build()
+	if err := request.Validate(); err != nil {
+		t.Fatalf("valid request got error %s", err)
+	}
+
+	// Too many occurrences
+	request.Add("Destination-Host", "other.igorserver")
+	if err := request.Validate(); err == nil || !strings.Contains(err.Error(), "Destination-Host") {
+		t.Errorf("duplicated Destination-Host not detected: %v", err)
+	}
+	request.DeleteAllAVP("Destination-Host")
+	if err := request.Validate(); err == nil {
+		t.Errorf("missing Destination-Host not detected")
+	}
+	request.Add("Destination-Host", "server.igorserver")
+
+	// Not allowed AVP
+	request.Add("Class", "class")
+	if err := request.Validate(); err == nil {
+		t.Errorf("not allowed Class not detected")
+	}
+	request.DeleteAllAVP("Class")
+
+	// Inside groups
+	request.AddAVP(func() *DiameterAVP {
+		avp, _ := NewAVP("Subscription-Id", nil)
+		return avp.Add("Subscription-Id-Data", "34600000001")
+	}())
+	if err := request.Validate(); err == nil || !strings.Contains(err.Error(), "Subscription-Id-Type") {
+		t.Errorf("missing Subscription-Id-Type not detected: %v", err)
+	}
+}
+
+func TestCheckAgainstCommand(t *testing.T) {
+
+	request, _ := NewDiameterRequestBuilder("TestApplication", "TestRequest").
+		SetSessionId("my-session").
+		AddOriginAVPs(config.GetPolicyConfig()).
+		Add("Destination-Realm", "igorserver").
+		Add("Destination-Host", "server.igorserver").
+		Add("Auth-Application-Id", 1000).
+		Build()
+	if err := request.CheckAgainstCommand(); err != nil {
+		t.Fatalf("valid request got error %s", err)
+	}
+
+	var ruleError *RuleError
+
+	// Fixed AVP out of place
+	sessionId, _ := request.GetAVP("Session-Id")
+	request.DeleteAllAVP("Session-Id").AddAVP(&sessionId)
+	if err := request.Validate(); err != nil {
+		t.Errorf("position checked in validation: %s", err)
+	}
+	if err := request.CheckAgainstCommand(); !errors.As(err, &ruleError) || ruleError.ResultCode != DIAMETER_AVP_NOT_ALLOWED || ruleError.AVPName != "Session-Id" {
+		t.Errorf("misplaced Session-Id not detected: %v", err)
+	}
+	request.DeleteAllAVP("Session-Id")
+	request.AVPs = append([]DiameterAVP{sessionId}, request.AVPs...)
+
+	// Result codes
+	request.Add("Destination-Host", "other.igorserver")
+	if err := request.CheckAgainstCommand(); !errors.As(err, &ruleError) || ruleError.ResultCode != DIAMETER_AVP_OCCURS_TOO_MANY_TIMES {
+		t.Errorf("duplicated Destination-Host not detected: %v", err)
+	}
+	request.DeleteAllAVP("Destination-Host")
+	if err := request.CheckAgainstCommand(); !errors.As(err, &ruleError) || ruleError.ResultCode != DIAMETER_MISSING_AVP || ruleError.AVPName != "Destination-Host" {
+		t.Errorf("missing Destination-Host not detected: %v", err)
+	}
+	request.Add("Destination-Host", "server.igorserver")
+	request.Add("Class", "class")
+	if err := request.CheckAgainstCommand(); !errors.As(err, &ruleError) || ruleError.ResultCode != DIAMETER_AVP_NOT_ALLOWED || ruleError.AVPName != "Class" {
+		t.Errorf("not allowed Class not detected: %v", err)
+	}
+	request.DeleteAllAVP("Class")
+
+	request.CommandCode = 2999
+	if err := request.CheckAgainstCommand(); !errors.As(err, &ruleError) || ruleError.ResultCode != DIAMETER_COMMAND_UNSUPPORTED {
+		t.Errorf("unknown command not detected: %v", err)
+	}
+}
+
+func TestAnswerHelpers(t *testing.T) {
+
+	request, _ := NewDiameterRequestBuilder("Credit-Control", "Credit-Control").
+		SetSessionId("my-session").
+		AddOriginAVPs(config.GetPolicyConfig()).
+		Add("Destination-Realm", "igorserver").
+		Add("Auth-Application-Id", 4).
+		Add("CC-Request-Type", 1).
+		Add("CC-Request-Number", 0).
+		AddGroup("Proxy-Info", Item("Proxy-Host", "proxy1"), Item("Proxy-State", []byte{1})).
+		AddGroup("Proxy-Info", Item("Proxy-Host", "proxy2"), Item("Proxy-State", []byte{2})).
+		Build()
+
+	answer := NewDiameterAnswer(request, CopyEchoedAVPs())
+	if answer.AVPs[0].Name != "Session-Id" || answer.GetStringAVP("Session-Id") != "my-session" {
+		t.Errorf("bad Session-Id in answer %s", answer)
+	}
+	if answer.GetIntAVP("CC-Request-Type") != 1 || answer.GetIntAVP("Auth-Application-Id") != 4 {
+		t.Errorf("echoed AVPs not copied %s", answer)
+	}
+	if proxyInfos := answer.GetAllAVP("Proxy-Info"); len(proxyInfos) != 2 || proxyInfos[1].GetAllAVP("Proxy-Host")[0].GetString() != "proxy2" {
+		t.Errorf("bad Proxy-Info in answer %s", answer)
+	}
+	if _, err := answer.GetAVP("Destination-Realm"); err == nil {
+		t.Errorf("not echoed AVP copied")
+	}
+
+	answer.SetError(DIAMETER_TOO_BUSY, "busy")
+	if !answer.IsError || answer.GetIntAVP("Result-Code") != DIAMETER_TOO_BUSY || answer.GetStringAVP("Error-Message") != "busy" {
+		t.Errorf("bad error answer %s", answer)
+	}
+	answer.SetSuccess()
+	if answer.IsError || len(answer.GetAllAVP("Result-Code")) != 1 || answer.GetIntAVP("Result-Code") != DIAMETER_SUCCESS {
+		t.Errorf("bad success answer %s", answer)
+	}
+
+	// Vendor specific
+	request.AddAVP(func() *DiameterAVP {
+		avp, _ := NewAVP("Vendor-Specific-Application-Id", nil)
+		return avp.Add("Vendor-Id", 10415).Add("Auth-Application-Id", 16777251)
+	}())
+	answer = NewDiameterAnswer(request, CopyAVPs("Vendor-Specific-Application-Id")).SetVendorError(5001, "")
+	experimentalResult, err := answer.GetAVP("Experimental-Result")
+	if err != nil || len(answer.GetAllAVP("Result-Code")) != 0 {
+		t.Fatalf("Experimental-Result not set %s", answer)
+	}
+	if code, _ := experimentalResult.GetAVP("Experimental-Result-Code"); code.GetInt() != 5001 {
+		t.Errorf("bad Experimental-Result %s", answer)
+	}
+	if vendorId, _ := experimentalResult.GetAVP("Vendor-Id"); vendorId.GetInt() != 10415 {
+		t.Errorf("bad Experimental-Result vendor %s", answer)
+	}
+}
+
+func TestDiameterMessageStream(t *testing.T) {
+
+	var ci = config.GetPolicyConfig()
+
+	// Messages written one after the other must be read back in sequence
+	var buffer bytes.Buffer
+	for i := 0; i < 2; i++ {
+		request, _ := NewDiameterRequest("TestApplication", "TestRequest")
+		request.AddOriginAVPs(ci)
+		request.Add("Session-Id", fmt.Sprintf("session-%d", i))
+		request.Add("franciscocardosogil-myOctetString", []byte("0123456"))
+		if _, err := request.WriteTo(&buffer); err != nil {
+			t.Fatalf("could not write message: %s", err)
+		}
+	}
+	streamBytes := append([]byte(nil), buffer.Bytes()...)
+
+	for i := 0; i < 2; i++ {
+		message := DiameterMessage{}
+		if _, err := message.ReadFrom(&buffer); err != nil {
+			t.Fatalf("could not read message: %s", err)
+		}
+		if message.GetStringAVP("Session-Id") != fmt.Sprintf("session-%d", i) || message.CommandName != "TestRequest" {
+			t.Errorf("bad message read %s", message)
+		}
+	}
+
+	// Nothing else to read
+	message := DiameterMessage{}
+	if _, err := message.ReadFrom(&buffer); err != io.EOF {
+		t.Errorf("expected EOF but got %v", err)
+	}
+
+	// Truncated message
+	if _, err := message.ReadFrom(bytes.NewReader(streamBytes[0:30])); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected unexpected EOF but got %v", err)
+	}
+	if _, _, err := DiameterMessageFromBytes(streamBytes[0:30]); !errors.Is(err, core.ErrMalformed) {
+		t.Errorf("expected malformed error but got %v", err)
+	}
+}
+
+func TestLongAVP(t *testing.T) {
+
+	// The length uses the full 24 bits
+	value := bytes.Repeat([]byte{1}, 70000)
+	avp, _ := NewAVP("franciscocardosogil-myOctetString", value)
+	theBytes, err := avp.MarshalBinary()
+	if err != nil {
+		t.Fatalf("could not serialize AVP: %s", err)
+	}
+	if theBytes[5] != 0x01 || theBytes[6] != 0x11 || theBytes[7] != 0x7C {
+		t.Errorf("bad length in AVP header %v", theBytes[5:8])
+	}
+
+	recoveredAVP, n, err := DiameterAVPFromBytes(theBytes)
+	if err != nil || n != uint32(len(theBytes)) || !bytes.Equal(recoveredAVP.GetOctets(), value) {
+		t.Errorf("bad long AVP recovered with %d bytes and error %v", n, err)
+	}
+}
+
+// Message similar to a credit control request, for benchmarking
+func benchmarkMessage() *DiameterMessage {
+	var ci = config.GetPolicyConfig()
+
+	request, _ := NewDiameterRequest("TestApplication", "TestRequest")
+	request.Add("Session-Id", "server.igorserver;1234567890;1")
+	request.AddOriginAVPs(ci)
+	request.Add("Destination-Realm", "igorserver")
+	request.Add("Destination-Host", "server.igorserver")
+	request.Add("franciscocardosogil-myOctetString", []byte("0123456789"))
+	request.Add("franciscocardosogil-myUnsigned32", 8)
+	request.Add("franciscocardosogil-myAddress", "127.0.0.1")
+	request.Add("franciscocardosogil-myTime", time.Now())
+	groupedAVP, _ := NewAVP("franciscocardosogil-myGrouped", nil)
+	groupedAVP.Add("franciscocardosogil-myInteger32", 1)
+	groupedAVP.Add("franciscocardosogil-myString", "hello")
+	request.AddAVP(groupedAVP)
+	return request
+}
+
+func BenchmarkDiameterMessageDecode(b *testing.B) {
+	theBytes, _ := benchmarkMessage().MarshalBinary()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := DiameterMessageFromBytes(theBytes); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDiameterMessageReadFrom(b *testing.B) {
+	theBytes, _ := benchmarkMessage().MarshalBinary()
+	reader := bytes.NewReader(theBytes)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		reader.Reset(theBytes)
+		message := DiameterMessage{}
+		if _, err := message.ReadFrom(reader); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDiameterMessageWriteTo(b *testing.B) {
+	message := benchmarkMessage()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := message.WriteTo(io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Serialization and parsing of the requests sent to the http handlers, for each content type
+func BenchmarkDiameterMessageJSON(b *testing.B) {
+	benchmarkContentType(b, core.CONTENT_TYPE_JSON)
+}
+
+func BenchmarkDiameterMessageCBOR(b *testing.B) {
+	benchmarkContentType(b, core.CONTENT_TYPE_CBOR)
+}
+
+func BenchmarkDiameterMessageBinary(b *testing.B) {
+	benchmarkContentType(b, core.CONTENT_TYPE_BINARY)
+}
+
+func benchmarkContentType(b *testing.B, contentType string) {
+	message := benchmarkMessage()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		theBytes, err := core.Marshal(contentType, message)
+		if err != nil {
+			b.Fatal(err)
+		}
+		var recovered DiameterMessage
+		if err := core.Unmarshal(contentType, theBytes, &recovered); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDictionaryPerMessage(t *testing.T) {
+	jsonDict, _ := os.ReadFile("../resources/diameterDictionary.json")
+	dict := diamdict.NewDictionaryFromJSON(jsonDict)
+	dict.AddVendor(99999, "Embedder")
+	if err := dict.AddAVP(99999, diamdict.AVPDefinition{Code: 1, Name: "Color", Type: "UTF8String"}); err != nil {
+		t.Fatalf("could not add AVP: %s", err)
+	}
+
+	if _, err := NewAVP("Embedder-Color", "red"); err == nil {
+		t.Errorf("AVP not in the global dictionary was created")
+	}
+
+	request, err := NewDiameterRequestWithDict(dict, "TestApplication", "TestRequest")
+	if err != nil {
+		t.Fatalf("could not create request: %s", err)
+	}
+	request.Add("Embedder-Color", "red")
+	if request.GetStringAVP("Embedder-Color") != "red" {
+		t.Fatalf("AVP of the message dictionary was not added")
+	}
+	requestBytes, _ := request.MarshalBinary()
+
+	// Decoded with the global dictionary, the AVP is unknown
+	globalRequest, _, _ := DiameterMessageFromBytes(requestBytes)
+	if _, err := globalRequest.GetAVP("Embedder-Color"); err == nil {
+		t.Errorf("AVP not in the global dictionary was decoded")
+	}
+
+	decoded, _, err := DiameterMessageFromBytesWithDict(requestBytes, dict)
+	if err != nil {
+		t.Fatalf("could not decode request: %s", err)
+	}
+	if decoded.GetStringAVP("Embedder-Color") != "red" || decoded.Dict() != dict {
+		t.Errorf("AVP was not decoded with the message dictionary")
+	}
+
+	// The answer inherits the dictionary
+	answer := NewDiameterAnswer(&decoded)
+	answer.Add("Embedder-Color", "blue")
+	if answer.GetStringAVP("Embedder-Color") != "blue" {
+		t.Errorf("AVP of the request dictionary was not added to the answer")
+	}
+}
@@ -7,12 +7,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"igor/config"
+	"igor/core"
 	"igor/diamdict"
 	"io"
+	"math"
 	"net"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -29,12 +32,15 @@ type DiameterAVP struct {
 	Name        string
 
 	// Type mapping
-	// May be a []byte, string, int64, float64, net.IP, time.Time or []DiameterAVP
+	// May be a []byte, string, int64, uint64 (only for Unsigned64), float64, net.IP, time.Time or []DiameterAVP
 	// If set to any other type, an error will be reported
 	Value interface{}
 
 	// Dictionary item
 	DictItem diamdict.AVPDictItem
+
+	// Dictionary used to create the AVPs added to this one. If nil, the global one
+	dict *diamdict.DiameterDict
 }
 
 // AVP Header is
@@ -46,68 +52,80 @@ type DiameterAVP struct {
 
 // Returns the number of bytes read, including padding
 func (avp *DiameterAVP) ReadFrom(reader io.Reader) (n int64, err error) {
-	var lenHigh uint8
-	var lenLow uint16
-	var avpLen uint32 // Only 24 bytes are relevant. Does not take into account 4 byte padding
-	var padLen uint32 // Length of paddding for multiple of 4 bytes
-	var dataLen uint32
-	var flags uint8
-	var avpBytes []byte
 
-	var isVendorSpecific bool
+	// Read the header to get the length, and then the full AVP in a single buffer
+	var header [8]byte
+	if n, err := io.ReadFull(reader, header[:]); err != nil {
+		return int64(n), err
+	}
+	avpLen := int(header[5])<<16 | int(header[6])<<8 | int(header[7])
+	if avpLen < 8 {
+		return 8, fmt.Errorf("bad AVP length %d", avpLen)
+	}
+	avpBytes := make([]byte, avpLen+padLen(avpLen))
+	copy(avpBytes, header[:])
+	if n, err := io.ReadFull(reader, avpBytes[8:]); err != nil {
+		return int64(8 + n), err
+	}
 
-	currentIndex := int64(0)
+	bytesRead, err := avp.decode(avpBytes, avp.dictionary())
+	return int64(bytesRead), err
+}
 
-	// Get Header
-	if err := binary.Read(reader, binary.BigEndian, &avp.Code); err != nil {
-		return 0, err
-	}
-	currentIndex += 4
+// Reads a DiameterAVP from a buffer
+// The values of type OctetString and addresses point to the buffer, which must not be modified afterwards
+func DiameterAVPFromBytes(inputBytes []byte) (DiameterAVP, uint32, error) {
+	avp := DiameterAVP{}
+	n, err := avp.decode(inputBytes, config.GetDDict())
+	return avp, uint32(n), err
+}
 
-	// Get Flags
-	if err := binary.Read(reader, binary.BigEndian, &flags); err != nil {
-		return currentIndex, err
+// Returns the dictionary of the AVP, which is the global one if not set
+func (avp *DiameterAVP) dictionary() *diamdict.DiameterDict {
+	if avp.dict != nil {
+		return avp.dict
 	}
-	isVendorSpecific = flags&0x80 != 0
-	avp.IsMandatory = flags&0x40 != 0
-	currentIndex += 1
+	return config.GetDDict()
+}
 
-	// Get Len
-	if err := binary.Read(reader, binary.BigEndian, &lenHigh); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 1
-	if err := binary.Read(reader, binary.BigEndian, &lenLow); err != nil {
-		return currentIndex, err
+// Parses the AVP at the start of the buffer, slicing it instead of copying when possible
+// Returns the number of bytes consumed, including padding
+func (avp *DiameterAVP) decode(b []byte, dict *diamdict.DiameterDict) (int, error) {
+
+	if len(b) < 8 {
+		return 0, fmt.Errorf("AVP header truncated to %d bytes", len(b))
 	}
-	currentIndex += 2
+
+	// Get Header
+	avp.Code = binary.BigEndian.Uint32(b[0:4])
+	flags := b[4]
+	isVendorSpecific := flags&0x80 != 0
+	avp.IsMandatory = flags&0x40 != 0
 
 	// The Len field contains the full size of the AVP, but not considering the padding
 	// Pad until the total length is a multiple of 4
-	avpLen = uint32(lenHigh)*65535 + uint32(lenLow)
-	if avpLen%4 == 0 {
-		padLen = 0
-	} else {
-		padLen = 4 - (avpLen % 4)
-	}
+	avpLen := int(b[5])<<16 | int(b[6])<<8 | int(b[7])
+	totalLen := avpLen + padLen(avpLen)
 
-	// Get VendorId and data length
+	// Get VendorId
 	// The size of the data is the size of the AVP minus size of the the headers, which is
 	// different depending on whether the attribute is vendor specific or not.
-
+	headerLen := 8
 	if isVendorSpecific {
-		if err := binary.Read(reader, binary.BigEndian, &avp.VendorId); err != nil {
-			return currentIndex, err
-		}
-		currentIndex += 4
-		dataLen = avpLen - 12
-	} else {
-		dataLen = avpLen - 8
+		headerLen = 12
+	}
+	if avpLen < headerLen || totalLen > len(b) {
+		return 0, fmt.Errorf("bad AVP length %d for %d available bytes", avpLen, len(b))
 	}
+	if isVendorSpecific {
+		avp.VendorId = binary.BigEndian.Uint32(b[8:12])
+	}
+	data := b[headerLen:avpLen]
 
 	// Get the relevant info from the dictionary
 	// If not in the dictionary, will get some defaults
-	avp.DictItem, _ = config.GetDDict().GetFromCode(diamdict.AVPCode{VendorId: avp.VendorId, Code: avp.Code})
+	avp.dict = dict
+	avp.DictItem, _ = dict.GetFromCode(diamdict.AVPCode{VendorId: avp.VendorId, Code: avp.Code})
 	avp.Name = avp.DictItem.Name
 
 	// Parse according to type
@@ -115,187 +133,193 @@ func (avp *DiameterAVP) ReadFrom(reader io.Reader) (n int64, err error) {
 
 	// OctetString
 	case diamdict.None, diamdict.OctetString:
-		// Read including padding
-		avpBytes = make([]byte, int(dataLen+padLen))
-		_, err := io.ReadAtLeast(reader, avpBytes, int(dataLen+padLen))
-
-		// Use only dataLen bytes. The rest is padding
-		avp.Value = avpBytes[0:dataLen]
-
-		return currentIndex + int64(dataLen+padLen), err
+		avp.Value = data
 
 	// Int32
-	case diamdict.Integer32:
-		var value int32
-		err := binary.Read(reader, binary.BigEndian, &value)
-		avp.Value = int64(value)
-		return currentIndex + 4, err
+	case diamdict.Integer32, diamdict.Enumerated:
+		if len(data) != 4 {
+			return 0, fmt.Errorf("bad data length %d for %s", len(data), avp.Name)
+		}
+		avp.Value = int64(int32(binary.BigEndian.Uint32(data)))
 
 	// Int64
 	case diamdict.Integer64:
-		var value int64
-		err := binary.Read(reader, binary.BigEndian, &value)
-		avp.Value = int64(value)
-		return currentIndex + 8, err
+		if len(data) != 8 {
+			return 0, fmt.Errorf("bad data length %d for %s", len(data), avp.Name)
+		}
+		avp.Value = int64(binary.BigEndian.Uint64(data))
 
 	// UInt32
 	case diamdict.Unsigned32:
-		var value uint32
-		err := binary.Read(reader, binary.BigEndian, &value)
-		avp.Value = int64(value)
-		return currentIndex + 4, err
+		if len(data) != 4 {
+			return 0, fmt.Errorf("bad data length %d for %s", len(data), avp.Name)
+		}
+		avp.Value = int64(binary.BigEndian.Uint32(data))
 
 	// UInt64
-	// Stored internally as an int64. This is a limitation!
+	// Stored as an uint64, to keep the full range
 	case diamdict.Unsigned64:
-		var value uint64
-		err := binary.Read(reader, binary.BigEndian, &value)
-		avp.Value = int64(value)
-		return currentIndex + 8, err
+		if len(data) != 8 {
+			return 0, fmt.Errorf("bad data length %d for %s", len(data), avp.Name)
+		}
+		avp.Value = binary.BigEndian.Uint64(data)
 
 	// Float32
 	case diamdict.Float32:
-		var value float32
-		err := binary.Read(reader, binary.BigEndian, &value)
-		avp.Value = float64(value)
-		return currentIndex + 4, err
+		if len(data) != 4 {
+			return 0, fmt.Errorf("bad data length %d for %s", len(data), avp.Name)
+		}
+		avp.Value = float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
 
 	// Float64
 	case diamdict.Float64:
-		var value float64
-		err := binary.Read(reader, binary.BigEndian, &value)
-		avp.Value = value
-		return currentIndex + 8, err
+		if len(data) != 8 {
+			return 0, fmt.Errorf("bad data length %d for %s", len(data), avp.Name)
+		}
+		avp.Value = math.Float64frombits(binary.BigEndian.Uint64(data))
 
 	// Grouped
 	case diamdict.Grouped:
-		for currentIndex < int64(avpLen+padLen) {
-			nextAVP := DiameterAVP{}
-			bytesRead, err := nextAVP.ReadFrom(reader)
-			if err != nil {
-				return currentIndex + bytesRead, err
+		groupedValue := make([]DiameterAVP, countAVPs(data))
+		i := 0
+		for currentIndex := 0; currentIndex < len(data); i++ {
+			if i == len(groupedValue) {
+				groupedValue = append(groupedValue, DiameterAVP{})
 			}
-			if avp.Value == nil {
-				avp.Value = make([]DiameterAVP, 0)
+			bytesRead, err := groupedValue[i].decode(data[currentIndex:], dict)
+			if err != nil {
+				return 0, err
 			}
-			avp.Value = append(avp.Value.([]DiameterAVP), nextAVP)
 			currentIndex += bytesRead
 		}
-
-		return currentIndex, err
+		avp.Value = groupedValue[:i]
 
 	// Address
 	// Two bytes for address type, and 4 /16 bytes for address
 	case diamdict.Address:
-		var addrType uint16
-		var padding uint16
-		if err := binary.Read(reader, binary.BigEndian, &addrType); err != nil {
-			return currentIndex, err
+		if len(data) < 2 {
+			return 0, fmt.Errorf("bad data length %d for %s", len(data), avp.Name)
 		}
-		if addrType == 1 {
-			var ipv4Addr [4]byte
+		if binary.BigEndian.Uint16(data[0:2]) == 1 {
 			// IPv4
-			if err := binary.Read(reader, binary.BigEndian, &ipv4Addr); err != nil {
-				return currentIndex + 2, err
+			if len(data) != 6 {
+				return 0, fmt.Errorf("bad data length %d for %s", len(data), avp.Name)
 			}
-			avp.Value = net.IP(ipv4Addr[:])
-			// Drain 2 bytes
-			binary.Read(reader, binary.BigEndian, &padding)
-
-			return currentIndex + 8, nil
+			avp.Value = net.IP(data[2:6])
 		} else {
 			// IPv6
-			var ipv6Addr [16]byte
-			if err := binary.Read(reader, binary.BigEndian, &ipv6Addr); err != nil {
-				return currentIndex + 2, err
+			if len(data) != 18 {
+				return 0, fmt.Errorf("bad data length %d for %s", len(data), avp.Name)
 			}
-			avp.Value = net.IP(ipv6Addr[:])
-			// Drain 2 bytes
-			binary.Read(reader, binary.BigEndian, &padding)
-
-			return currentIndex + 20, nil
+			avp.Value = net.IP(data[2:18])
 		}
 
 	// Time
 	case diamdict.Time:
-		var value uint32
-		err := binary.Read(reader, binary.BigEndian, &value)
-		avp.Value = zeroTime.Add(time.Second * time.Duration(value))
-		return currentIndex + 4, err
+		if len(data) != 4 {
+			return 0, fmt.Errorf("bad data length %d for %s", len(data), avp.Name)
+		}
+		avp.Value = zeroTime.Add(time.Second * time.Duration(binary.BigEndian.Uint32(data)))
 
 	// UTF8 String
 	case diamdict.UTF8String, diamdict.DiamIdent, diamdict.DiameterURI, diamdict.IPFilterRule:
-		// Read including padding
-		avpBytes = make([]byte, int(dataLen+padLen))
-		_, err := io.ReadAtLeast(reader, avpBytes, int(dataLen+padLen))
-
-		// Use only dataLen bytes. The rest is padding
-		avp.Value = string(avpBytes[0:dataLen])
-
-		return currentIndex + int64(dataLen+padLen), err
-
-	case diamdict.Enumerated:
-		var value int32
-		err := binary.Read(reader, binary.BigEndian, &value)
-		avp.Value = int64(value)
-		return currentIndex + 4, err
+		avp.Value = string(data)
 
 	case diamdict.IPv4Address, diamdict.IPv6Address:
-		avpBytes = make([]byte, int(dataLen+padLen))
-		_, err := io.ReadAtLeast(reader, avpBytes, int(dataLen+padLen))
-		avp.Value = net.IP(avpBytes)
-		return currentIndex + int64(dataLen+padLen), err
+		avp.Value = net.IP(data)
 
 		// First byte is ignored
 		// Second byte is prefix size
 		// Rest is an IPv6 Address
 	case diamdict.IPv6Prefix:
-		var dummy byte
-		var prefixLen byte
-		var padding uint16
-		address := make([]byte, 16)
-		if err := binary.Read(reader, binary.BigEndian, &dummy); err != nil {
-			return currentIndex, err
-		}
-		if err := binary.Read(reader, binary.BigEndian, &prefixLen); err != nil {
-			return currentIndex + 1, err
-		}
-		if err := binary.Read(reader, binary.BigEndian, &address); err != nil {
-			return currentIndex + 2, err
+		if len(data) != 18 {
+			return 0, fmt.Errorf("bad data length %d for %s", len(data), avp.Name)
 		}
+		avp.Value = net.IP(data[2:18]).String() + "/" + strconv.Itoa(int(data[1]))
+
+	default:
+		return 0, fmt.Errorf("unknown type: %d", avp.DictItem.DiameterType)
+	}
 
-		// Drain 2 bytes
-		binary.Read(reader, binary.BigEndian, &padding)
+	return totalLen, nil
+}
 
-		avp.Value = net.IP(address).String() + "/" + fmt.Sprintf("%d", prefixLen)
+// Returns the number of AVPs in the buffer, used to size the slices in advance
+// Stops at the first AVP with a bad length, which will be reported when decoding
+func countAVPs(b []byte) int {
+	count := 0
+	for currentIndex := 0; currentIndex+8 <= len(b); count++ {
+		avpLen := int(b[currentIndex+5])<<16 | int(b[currentIndex+6])<<8 | int(b[currentIndex+7])
+		if avpLen < 8 {
+			break
+		}
+		currentIndex += avpLen + padLen(avpLen)
+	}
+	return count
+}
 
-		return currentIndex + 20, err
+// Returns the number of bytes to add for the length to be a multiple of 4
+func padLen(length int) int {
+	if length%4 == 0 {
+		return 0
 	}
+	return 4 - length%4
+}
 
-	return currentIndex, fmt.Errorf("unknown type: %d", avp.DictItem.DiameterType)
+// Buffers to serialize AVPs and messages before writing them, reused to avoid allocations
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 4096)
+		return &b
+	},
 }
 
-// Reads a DiameterAVP from a buffer
-func DiameterAVPFromBytes(inputBytes []byte) (DiameterAVP, uint32, error) {
-	r := bytes.NewReader(inputBytes)
+// Buffers bigger than this are not returned to the pool
+const maxPooledBufferSize = 65536
 
-	avp := DiameterAVP{}
-	n, err := avp.ReadFrom(r)
-	return avp, uint32(n), err
+func getBuffer() *[]byte {
+	return bufferPool.Get().(*[]byte)
+}
+
+func putBuffer(bp *[]byte) {
+	if cap(*bp) <= maxPooledBufferSize {
+		bufferPool.Put(bp)
+	}
+}
+
+func appendUint32(b []byte, value uint32) []byte {
+	return append(b, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+}
+
+func appendUint64(b []byte, value uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(value>>32)), uint32(value))
 }
 
 // Writes the AVP to the specified writer
 // Returns the number of bytes written including padding
 func (avp *DiameterAVP) WriteTo(buffer io.Writer) (int64, error) {
 
-	var bytesWritten = 0
-	var err error
+	// Serialize in a pooled buffer and write it in one go
+	bp := getBuffer()
+	defer putBuffer(bp)
 
-	// Write Code
-	if err = binary.Write(buffer, binary.BigEndian, avp.Code); err != nil {
-		return int64(bytesWritten), err
+	b, err := avp.appendTo((*bp)[:0])
+	*bp = b
+	if err != nil {
+		return 0, err
 	}
-	bytesWritten += 4
+
+	n, err := buffer.Write(b)
+	return int64(n), err
+}
+
+// Appends the serialized AVP, including padding, to the buffer
+func (avp *DiameterAVP) appendTo(b []byte) ([]byte, error) {
+
+	start := len(b)
+
+	// Write Code
+	b = appendUint32(b, avp.Code)
 
 	// Write Flags
 	var flags uint8
@@ -305,27 +329,14 @@ func (avp *DiameterAVP) WriteTo(buffer io.Writer) (int64, error) {
 	if avp.IsMandatory {
 		flags += 0x40
 	}
-	if err = binary.Write(buffer, binary.BigEndian, flags); err != nil {
-		return int64(bytesWritten), err
-	}
-	bytesWritten += 1
 
 	// Write Len (this is without padding)
 	avpLen := avp.DataLen()
-	if err = binary.Write(buffer, binary.BigEndian, uint8(avpLen/65535)); err != nil {
-		return int64(bytesWritten), err
-	}
-	if err = binary.Write(buffer, binary.BigEndian, uint16(avpLen%65535)); err != nil {
-		return int64(bytesWritten), err
-	}
-	bytesWritten += 3
+	b = append(b, flags, byte(avpLen>>16), byte(avpLen>>8), byte(avpLen))
 
 	// Write vendor Id
 	if avp.VendorId > 0 {
-		if err = binary.Write(buffer, binary.BigEndian, avp.VendorId); err != nil {
-			return int64(bytesWritten), err
-		}
-		bytesWritten += 4
+		b = appendUint32(b, avp.VendorId)
 	}
 
 	switch avp.DictItem.DiameterType {
@@ -333,219 +344,142 @@ func (avp *DiameterAVP) WriteTo(buffer io.Writer) (int64, error) {
 	case diamdict.None, diamdict.OctetString:
 		var octetsValue, ok = avp.Value.([]byte)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
+			return b, avp.marshalError()
 		}
-		if err = binary.Write(buffer, binary.BigEndian, octetsValue); err != nil {
-			return int64(bytesWritten), err
-		}
-		bytesWritten += len(octetsValue)
+		b = append(b, octetsValue...)
 
-	case diamdict.Integer32:
+	case diamdict.Integer32, diamdict.Enumerated:
 		var value, ok = avp.Value.(int64)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
+			return b, avp.marshalError()
 		}
-		if err = binary.Write(buffer, binary.BigEndian, int32(value)); err != nil {
-			return int64(bytesWritten), err
-		}
-		bytesWritten += 4
+		b = appendUint32(b, uint32(int32(value)))
 
 	case diamdict.Integer64:
 		var value, ok = avp.Value.(int64)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
-		}
-		if err = binary.Write(buffer, binary.BigEndian, int64(value)); err != nil {
-			return int64(bytesWritten), err
+			return b, avp.marshalError()
 		}
-		bytesWritten += 8
+		b = appendUint64(b, uint64(value))
 
 	case diamdict.Unsigned32:
 		var value, ok = avp.Value.(int64)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
-		}
-		if err = binary.Write(buffer, binary.BigEndian, uint32(value)); err != nil {
-			return int64(bytesWritten), err
+			return b, avp.marshalError()
 		}
-		bytesWritten += 4
+		b = appendUint32(b, uint32(value))
 
 	case diamdict.Unsigned64:
-		var value, ok = avp.Value.(int64)
+		var value, ok = avp.Value.(uint64)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
-		}
-		if err = binary.Write(buffer, binary.BigEndian, uint64(value)); err != nil {
-			return int64(bytesWritten), err
+			return b, avp.marshalError()
 		}
-		bytesWritten += 8
+		b = appendUint64(b, value)
 
 	case diamdict.Float32:
 		var value, ok = avp.Value.(float64)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
-		}
-		if err = binary.Write(buffer, binary.BigEndian, float32(value)); err != nil {
-			return int64(bytesWritten), err
+			return b, avp.marshalError()
 		}
-		bytesWritten += 4
+		b = appendUint32(b, math.Float32bits(float32(value)))
 
 	case diamdict.Float64:
 		var value, ok = avp.Value.(float64)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
+			return b, avp.marshalError()
 		}
-		if err = binary.Write(buffer, binary.BigEndian, float64(value)); err != nil {
-			return int64(bytesWritten), err
-		}
-		bytesWritten += 8
+		b = appendUint64(b, math.Float64bits(value))
 
 	case diamdict.Grouped:
 		var groupedValue, ok = avp.Value.([]DiameterAVP)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
+			return b, avp.marshalError()
 		}
-		for i, _ := range groupedValue {
-			n, err := groupedValue[i].WriteTo(buffer)
-			if err != nil {
-				return int64(bytesWritten) + n, err
+		for i := range groupedValue {
+			var err error
+			if b, err = groupedValue[i].appendTo(b); err != nil {
+				return b, err
 			}
-			bytesWritten += int(n)
 		}
 
 	case diamdict.Address:
 		var addressValue, ok = avp.Value.(net.IP)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
+			return b, avp.marshalError()
 		}
+		// Address Type and address
 		if addressValue.To4() != nil {
-			// Address Type
-			if err = binary.Write(buffer, binary.BigEndian, int16(1)); err != nil {
-				return int64(bytesWritten), err
-			}
-			if err = binary.Write(buffer, binary.BigEndian, addressValue.To4()); err != nil {
-				return int64(bytesWritten), err
-			}
-			bytesWritten += 6
+			b = append(append(b, 0, 1), addressValue.To4()...)
 		} else {
-			// Address Type
-			if err = binary.Write(buffer, binary.BigEndian, int16(2)); err != nil {
-				return int64(bytesWritten), err
-			}
-			if err = binary.Write(buffer, binary.BigEndian, addressValue.To16()); err != nil {
-				return int64(bytesWritten), err
-			}
-			bytesWritten += 18
+			b = append(append(b, 0, 2), addressValue.To16()...)
 		}
 
 	case diamdict.Time:
 		var timeValue, ok = avp.Value.(time.Time)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
+			return b, avp.marshalError()
 		}
-		if err = binary.Write(buffer, binary.BigEndian, uint32(timeValue.Sub(zeroTime).Seconds())); err != nil {
-			return int64(bytesWritten), err
-		}
-		bytesWritten += 4
+		b = appendUint32(b, uint32(timeValue.Sub(zeroTime).Seconds()))
 
 	case diamdict.UTF8String, diamdict.DiamIdent, diamdict.DiameterURI, diamdict.IPFilterRule:
 		var stringValue, ok = avp.Value.(string)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
-		}
-		if err = binary.Write(buffer, binary.BigEndian, []byte(stringValue)); err != nil {
-			return int64(bytesWritten), err
-		}
-		bytesWritten += len(stringValue)
-
-	case diamdict.Enumerated:
-		var value, ok = avp.Value.(int64)
-		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
-		}
-		if err = binary.Write(buffer, binary.BigEndian, int32(value)); err != nil {
-			return int64(bytesWritten), err
+			return b, avp.marshalError()
 		}
-		bytesWritten += 4
+		b = append(b, stringValue...)
 
 	case diamdict.IPv4Address:
 		var ipAddress, ok = avp.Value.(net.IP)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
+			return b, avp.marshalError()
 		}
-		if err = binary.Write(buffer, binary.BigEndian, ipAddress.To4()); err != nil {
-			return int64(bytesWritten), err
-		}
-		bytesWritten += 4
+		b = append(b, ipAddress.To4()...)
 
 	case diamdict.IPv6Address:
 		var ipAddress, ok = avp.Value.(net.IP)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
-		}
-		if err = binary.Write(buffer, binary.BigEndian, ipAddress.To16()); err != nil {
-			return int64(bytesWritten), err
+			return b, avp.marshalError()
 		}
-		bytesWritten += 16
+		b = append(b, ipAddress.To16()...)
 
 	case diamdict.IPv6Prefix:
 		var ipv6Prefix, ok = avp.Value.(string)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
+			return b, avp.marshalError()
 		}
 		addrPrefix := strings.Split(ipv6Prefix, "/")
-		if len(addrPrefix) == 2 {
-			prefix, err := strconv.ParseUint(addrPrefix[1], 10, 8) // base 10, 8 bits
-			ipv6 := net.ParseIP(addrPrefix[0])
-			if err == nil && ipv6 != nil {
-				// To ignore
-				if err = binary.Write(buffer, binary.BigEndian, byte(0)); err != nil {
-					return int64(bytesWritten), err
-				}
-				bytesWritten += 1
-				// Prefix
-				if err = binary.Write(buffer, binary.BigEndian, uint8(prefix)); err != nil {
-					return int64(bytesWritten), err
-				}
-				bytesWritten += 1
-				// Address
-				binary.Write(buffer, binary.BigEndian, ipv6.To16())
-				bytesWritten += 16
-			} else {
-				return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
-			}
-		} else {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
+		if len(addrPrefix) != 2 {
+			return b, avp.marshalError()
 		}
+		prefix, err := strconv.ParseUint(addrPrefix[1], 10, 8) // base 10, 8 bits
+		ipv6 := net.ParseIP(addrPrefix[0])
+		if err != nil || ipv6 == nil {
+			return b, avp.marshalError()
+		}
+		// First byte to ignore, prefix and address
+		b = append(append(b, 0, uint8(prefix)), ipv6.To16()...)
 	}
 
 	// Saninty check
-	if bytesWritten != avpLen {
-		panic(fmt.Sprintf("Bad AVP size. Bytes Written: %d, reported size: %d", bytesWritten, avpLen))
+	if len(b)-start != avpLen {
+		panic(fmt.Sprintf("Bad AVP size. Bytes Written: %d, reported size: %d", len(b)-start, avpLen))
 	}
 
 	// Padding
-	var padSize = 0
-	if avpLen%4 != 0 {
-		padSize = 4 - (avpLen % 4)
-		padBytes := make([]byte, padSize)
-		if err = binary.Write(buffer, binary.BigEndian, padBytes); err != nil {
-			return int64(bytesWritten), err
-		}
+	for i := padLen(avpLen); i > 0; i-- {
+		b = append(b, 0)
 	}
 
-	return int64(avpLen + padSize), nil
+	return b, nil
 }
 
 func (avp *DiameterAVP) MarshalBinary() (data []byte, err error) {
+	return avp.appendTo(make([]byte, 0, avp.Len()))
+}
 
-	// Will write the output here
-	var buffer = new(bytes.Buffer)
-	if _, err := avp.WriteTo(buffer); err != nil {
-		return buffer.Bytes(), err
-	}
-
-	return buffer.Bytes(), nil
+// Error to report when the value does not match the type of the AVP
+func (avp *DiameterAVP) marshalError() error {
+	return fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
 }
 
 // Returns the size of the AVP without padding
@@ -663,10 +597,14 @@ func (avp *DiameterAVP) GetString() string {
 		var octetsValue, _ = avp.Value.([]byte)
 		return fmt.Sprintf("%x", octetsValue)
 
-	case diamdict.Integer32, diamdict.Integer64, diamdict.Unsigned32, diamdict.Unsigned64:
+	case diamdict.Integer32, diamdict.Integer64, diamdict.Unsigned32:
 		var value, _ = avp.Value.(int64)
 		return fmt.Sprintf("%d", value)
 
+	case diamdict.Unsigned64:
+		var value, _ = avp.Value.(uint64)
+		return fmt.Sprintf("%d", value)
+
 	case diamdict.Float32, diamdict.Float64:
 		var value, _ = avp.Value.(float64)
 		return fmt.Sprintf("%f", value)
@@ -729,19 +667,39 @@ func (avp *DiameterAVP) GetString() string {
 	return ""
 }
 
-// Returns the value of the AVP as a number
+// Returns the value of the AVP as a number. Unsigned64 values above the int64 range are returned as negative;
+// use GetUint for them
 func (avp *DiameterAVP) GetInt() int64 {
 
 	switch avp.DictItem.DiameterType {
-	case diamdict.Integer32, diamdict.Integer64, diamdict.Unsigned32, diamdict.Unsigned64, diamdict.Enumerated:
+	case diamdict.Integer32, diamdict.Integer64, diamdict.Unsigned32, diamdict.Enumerated:
 
 		return avp.Value.(int64)
+	case diamdict.Unsigned64:
+
+		return int64(avp.Value.(uint64))
 	default:
 		config.GetLogger().Errorf("cannot convert value to int64 %T %v", avp.Value, avp.Value)
 		return 0
 	}
 }
 
+// Returns the value of the AVP as an unsigned number, keeping the full range of Unsigned64
+func (avp *DiameterAVP) GetUint() uint64 {
+
+	switch avp.DictItem.DiameterType {
+	case diamdict.Integer32, diamdict.Integer64, diamdict.Unsigned32, diamdict.Enumerated:
+
+		return uint64(avp.Value.(int64))
+	case diamdict.Unsigned64:
+
+		return avp.Value.(uint64)
+	default:
+		config.GetLogger().Errorf("cannot convert value to uint64 %T %v", avp.Value, avp.Value)
+		return 0
+	}
+}
+
 // Returns the value of the AVP as a float
 func (avp *DiameterAVP) GetFloat() float64 {
 
@@ -781,9 +739,14 @@ func (avp *DiameterAVP) GetIPAddress() net.IP {
 // Creates a new AVP
 // If the type of value is not compatible with the Diameter type in the dictionary, an error is returned
 func NewAVP(name string, value interface{}) (*DiameterAVP, error) {
-	var avp = DiameterAVP{}
+	return NewAVPWithDict(nil, name, value)
+}
+
+// Creates a new AVP using the specified dictionary, or the global one if nil
+func NewAVPWithDict(dict *diamdict.DiameterDict, name string, value interface{}) (*DiameterAVP, error) {
+	var avp = DiameterAVP{dict: dict}
 
-	avp.DictItem = config.GetDDict().AVPByName[name]
+	avp.DictItem, _ = avp.dictionary().GetFromName(name)
 	if avp.DictItem.DiameterType == diamdict.None {
 		return &avp, fmt.Errorf("%s not found in dictionary", name)
 	}
@@ -810,7 +773,7 @@ func NewAVP(name string, value interface{}) (*DiameterAVP, error) {
 			avp.Value = octetsValue
 		}
 
-	case diamdict.Integer32, diamdict.Integer64, diamdict.Unsigned32, diamdict.Unsigned64:
+	case diamdict.Integer32, diamdict.Integer64, diamdict.Unsigned32:
 		var value, error = toInt64(value)
 
 		if error != nil {
@@ -818,6 +781,14 @@ func NewAVP(name string, value interface{}) (*DiameterAVP, error) {
 		}
 		avp.Value = value
 
+	case diamdict.Unsigned64:
+		var value, error = toUint64(value)
+
+		if error != nil {
+			return &avp, fmt.Errorf("error creating diameter avp with type %d and value of type %T", avp.DictItem.DiameterType, value)
+		}
+		avp.Value = value
+
 	case diamdict.Float32, diamdict.Float64:
 		var value, error = toFloat64(value)
 		if error != nil {
@@ -965,11 +936,47 @@ func toInt64(value interface{}) (int64, error) {
 	case float64:
 		// Needed for unmarshaling JSON
 		return int64(v), nil
+	case json.Number:
+		// Unmarshaled JSON
+		if intValue, err := v.Int64(); err == nil {
+			return intValue, nil
+		}
+		floatValue, err := v.Float64()
+		return int64(floatValue), err
 	default:
 		return 0, fmt.Errorf("cannot convert %T to int64", value)
 	}
 }
 
+func toUint64(value interface{}) (uint64, error) {
+
+	switch v := value.(type) {
+	case uint:
+		return uint64(v), nil
+	case uint8:
+		return uint64(v), nil
+	case uint16:
+		return uint64(v), nil
+	case uint32:
+		return uint64(v), nil
+	case uint64:
+		return v, nil
+	case json.Number:
+		// Unmarshaled JSON
+		return strconv.ParseUint(string(v), 10, 64)
+	default:
+		// Signed values, that must not be negative
+		int64Value, err := toInt64(value)
+		if err != nil {
+			return 0, fmt.Errorf("cannot convert %T to uint64", value)
+		}
+		if int64Value < 0 {
+			return 0, fmt.Errorf("cannot convert negative value %d to uint64", int64Value)
+		}
+		return uint64(int64Value), nil
+	}
+}
+
 func toFloat64(value interface{}) (float64, error) {
 
 	switch v := value.(type) {
@@ -977,6 +984,9 @@ func toFloat64(value interface{}) (float64, error) {
 		return float64(v), nil
 	case float64:
 		return float64(v), nil
+	case json.Number:
+		// Unmarshaled JSON
+		return v.Float64()
 	default:
 		return 0, fmt.Errorf("cannot convert %T to float64", value)
 	}
@@ -1000,11 +1010,12 @@ func (avp *DiameterAVP) AddAVP(gavp DiameterAVP) *DiameterAVP {
 
 // Adds a new AVP to the Grouped AVP, specified using name and value. Does nothing if the current value is not grouped
 func (avp *DiameterAVP) Add(name string, value interface{}) *DiameterAVP {
-	avp, err := NewAVP(name, value)
+	newAVP, err := NewAVPWithDict(avp.dict, name, value)
 	if err != nil {
-		avp.AddAVP(*avp)
+		config.GetLogger().Errorf("avp could not be added %s: %v, %s", name, value, err)
+		return avp
 	}
-	return avp
+	return avp.AddAVP(*newAVP)
 }
 
 // Deletes all AVP with the specified name
@@ -1058,11 +1069,6 @@ func (avp *DiameterAVP) GetAllAVP(name string) []DiameterAVP {
 	return avpList
 }
 
-// Check that minoccurs and maxoccurs are as specified
-func (avp *DiameterAVP) Validate() error {
-	return nil
-}
-
 ///////////////////////////////////////////////////////////////
 // JSON Encoding
 ///////////////////////////////////////////////////////////////
@@ -1074,8 +1080,10 @@ func (avp *DiameterAVP) ToMap() map[string]interface{} {
 	switch avp.DictItem.DiameterType {
 	case diamdict.None, diamdict.OctetString, diamdict.UTF8String, diamdict.Enumerated, diamdict.DiamIdent, diamdict.DiameterURI, diamdict.Address, diamdict.IPv4Address, diamdict.IPv6Address, diamdict.IPv6Prefix, diamdict.Time, diamdict.IPFilterRule:
 		theMap[avp.Name] = avp.GetString()
-	case diamdict.Integer32, diamdict.Integer64, diamdict.Unsigned32, diamdict.Unsigned64:
+	case diamdict.Integer32, diamdict.Integer64, diamdict.Unsigned32:
 		theMap[avp.Name] = avp.GetInt()
+	case diamdict.Unsigned64:
+		theMap[avp.Name] = avp.GetUint()
 	case diamdict.Float32, diamdict.Float64:
 		theMap[avp.Name] = avp.GetFloat()
 	case diamdict.Grouped:
@@ -1130,13 +1138,33 @@ func FromMap(avpMap map[string]interface{}) (DiameterAVP, error) {
 	return DiameterAVP{}, fmt.Errorf("empty JSON representation of Diameter AVP")
 }
 
-// Get a DiameterAVP from JSON
+// Get a DiameterAVP from JSON. The numbers are decoded as json.Number, so that 64 bit values keep their precision
 func (avp *DiameterAVP) UnmarshalJSON(b []byte) error {
 
 	var err error
 
 	theMap := make(map[string]interface{})
-	if err = json.Unmarshal(b, &theMap); err != nil {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	if err = decoder.Decode(&theMap); err != nil {
+		return err
+	}
+
+	*avp, err = FromMap(theMap)
+	return err
+}
+
+// Encode as CBOR using the map representation
+func (avp *DiameterAVP) MarshalCBOR() ([]byte, error) {
+	return core.Marshal(core.CONTENT_TYPE_CBOR, avp.ToMap())
+}
+
+// Get a DiameterAVP from CBOR
+func (avp *DiameterAVP) UnmarshalCBOR(b []byte) error {
+	var err error
+
+	theMap := make(map[string]interface{})
+	if err = core.Unmarshal(core.CONTENT_TYPE_CBOR, b, &theMap); err != nil {
 		return err
 	}
 
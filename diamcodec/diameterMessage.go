@@ -1,11 +1,12 @@
 package diamcodec
 
 import (
-	"bytes"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"igor/config"
+	"igor/core"
+	"igor/diamdict"
 	"io"
 	"net"
 	"strings"
@@ -20,15 +21,28 @@ const (
 	DIAMETER_LIMITED_SUCCESS = 2002
 
 	// Protocol Errors
-	DIAMETER_UNKNOWN_PEER     = 3010
-	DIAMETER_REALM_NOT_SERVED = 3003
+	DIAMETER_UNKNOWN_PEER            = 3010
+	DIAMETER_INVALID_HDR_BITS        = 3008
+	DIAMETER_APPLICATION_UNSUPPORTED = 3007
+	DIAMETER_LOOP_DETECTED           = 3005
+	DIAMETER_TOO_BUSY                = 3004
+	DIAMETER_REALM_NOT_SERVED        = 3003
+	DIAMETER_UNABLE_TO_DELIVER       = 3002
+	DIAMETER_COMMAND_UNSUPPORTED     = 3001
 
 	// Transient Failures
 	DIAMETER_AUTHENTICATION_REJECTED = 4001
 
 	// Permanent failures
-	DIAMETER_UNKNOWN_SESSION_ID = 5002
-	DIAMETER_UNABLE_TO_COMPLY   = 5012
+	DIAMETER_AVP_UNSUPPORTED           = 5001
+	DIAMETER_UNKNOWN_SESSION_ID        = 5002
+	DIAMETER_AUTHORIZATION_REJECTED    = 5003
+	DIAMETER_MISSING_AVP               = 5005
+	DIAMETER_AVP_NOT_ALLOWED           = 5008
+	DIAMETER_AVP_OCCURS_TOO_MANY_TIMES = 5009
+	DIAMETER_UNSUPPORTED_VERSION       = 5011
+	DIAMETER_UNABLE_TO_COMPLY          = 5012
+	DIAMETER_INVALID_MESSAGE_LENGTH    = 5015
 )
 
 type DiameterMessage struct {
@@ -57,109 +71,128 @@ type DiameterMessage struct {
 	ApplicationName string
 
 	AVPs []DiameterAVP
+
+	// Dictionary used to decode the message and create the AVPs. If nil, the global one
+	dict *diamdict.DiameterDict
+
+	// Diameter-Host of the peer from which the request was received, if any
+	receivedFrom string
+}
+
+// Returns the dictionary of the message, which is the global one if not set
+func (m *DiameterMessage) Dict() *diamdict.DiameterDict {
+	if m.dict != nil {
+		return m.dict
+	}
+	return config.GetDDict()
+}
+
+// Sets the dictionary to use for decoding the message and adding AVPs to it. If nil, the global one is used
+func (m *DiameterMessage) SetDict(dict *diamdict.DiameterDict) *DiameterMessage {
+	m.dict = dict
+	return m
+}
+
+// Returns the Diameter-Host of the peer from which the message was received, or empty if locally generated
+func (m *DiameterMessage) ReceivedFrom() string {
+	return m.receivedFrom
 }
 
+// Sets the Diameter-Host of the peer from which the message was received
+func (m *DiameterMessage) SetReceivedFrom(diameterHost string) *DiameterMessage {
+	m.receivedFrom = diameterHost
+	return m
+}
+
+// Reads the header to get the length, and then the full message in a single buffer, which is
+// sliced to get the AVPs
 func (dm *DiameterMessage) ReadFrom(reader io.Reader) (n int64, err error) {
-	var version byte
-	var lenHigh uint8
-	var lenLow uint16
-	var messageLength uint32
-	var flags uint8
-	var commandCodeHigh uint8
-	var commandCodeLow uint16
-
-	currentIndex := int64(0)
-
-	// Get Version
-	if err := binary.Read(reader, binary.BigEndian, &version); err != nil {
-		return 0, err
+	var header [20]byte
+	if n, err := io.ReadFull(reader, header[:]); err != nil {
+		return int64(n), err
+	}
+	messageLength := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+	if messageLength < 20 {
+		return 20, fmt.Errorf("bad message length %d", messageLength)
 	}
-	currentIndex += 1
+	messageBytes := make([]byte, messageLength)
+	copy(messageBytes, header[:])
+	if n, err := io.ReadFull(reader, messageBytes[20:]); err != nil {
+		return int64(20 + n), err
+	}
+
+	return dm.decode(messageBytes)
+}
 
-	// Get Length
-	if err := binary.Read(reader, binary.BigEndian, &lenHigh); err != nil {
-		return currentIndex, err
+// Parses the message at the start of the buffer
+// Returns the number of bytes consumed
+func (dm *DiameterMessage) decode(b []byte) (int64, error) {
+
+	if len(b) < 20 {
+		return 0, fmt.Errorf("message header truncated to %d bytes", len(b))
 	}
-	currentIndex += 1
-	if err := binary.Read(reader, binary.BigEndian, &lenLow); err != nil {
-		return currentIndex, err
+
+	// Version is ignored
+	messageLength := int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+	if messageLength < 20 || messageLength > len(b) {
+		return 0, fmt.Errorf("length in header %d does not match the size of the message %d", messageLength, len(b))
 	}
-	currentIndex += 2
-	messageLength = uint32(lenHigh)*65535 + uint32(lenLow)
 
 	// Get flags
-	if err := binary.Read(reader, binary.BigEndian, &flags); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 1
+	flags := b[4]
 	dm.IsRequest = flags&128 != 0
 	dm.IsProxyable = flags&64 != 0
 	dm.IsError = flags&32 != 0
 	dm.IsRetransmission = flags&16 != 0
 
-	// Get CommandCode
-	if err := binary.Read(reader, binary.BigEndian, &commandCodeHigh); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 1
-	if err := binary.Read(reader, binary.BigEndian, &commandCodeLow); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 2
-	dm.CommandCode = uint32(commandCodeHigh)*65535 + uint32(commandCodeLow)
+	// Get CommandCode and ApplicationId
+	dm.CommandCode = uint32(b[5])<<16 | uint32(b[6])<<8 | uint32(b[7])
+	dm.ApplicationId = binary.BigEndian.Uint32(b[8:12])
 
-	// Get the applicationId
-	if err := binary.Read(reader, binary.BigEndian, &dm.ApplicationId); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 4
-
-	diameterApplication, ok := config.GetDDict().AppByCode[dm.ApplicationId]
+	dict := dm.Dict()
+	diameterApplication, ok := dict.GetApplication(dm.ApplicationId)
 	if ok {
 		dm.ApplicationName = diameterApplication.Name
 		dm.CommandName = diameterApplication.CommandByCode[dm.CommandCode].Name
 	}
 
-	// Get the E2EndId
-	if err := binary.Read(reader, binary.BigEndian, &dm.E2EId); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 4
-
-	// Get the HopByHopId
-	if err := binary.Read(reader, binary.BigEndian, &dm.HopByHopId); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 4
+	// Get the E2EndId and the HopByHopId
+	dm.E2EId = binary.BigEndian.Uint32(b[12:16])
+	dm.HopByHopId = binary.BigEndian.Uint32(b[16:20])
 
 	// Get the AVPs
-	dm.AVPs = make([]DiameterAVP, 0)
-	if currentIndex != 20 {
-		panic("assert failed. Bad header size in diameter message header")
-	}
-	// var currentIndex uint32 = 20 // The header is always 20 bytes
-	for currentIndex < int64(messageLength) {
-		nextAVP := DiameterAVP{}
-		bytesRead, err := nextAVP.ReadFrom(reader)
+	avpBytes := b[20:messageLength]
+	dm.AVPs = make([]DiameterAVP, countAVPs(avpBytes))
+	i := 0
+	for currentIndex := 0; currentIndex < len(avpBytes); i++ {
+		if i == len(dm.AVPs) {
+			dm.AVPs = append(dm.AVPs, DiameterAVP{})
+		}
+		bytesRead, err := dm.AVPs[i].decode(avpBytes[currentIndex:], dict)
 		if err != nil {
-			return currentIndex, err
+			dm.AVPs = dm.AVPs[:i]
+			return int64(20 + currentIndex), err
 		}
-		dm.AVPs = append(dm.AVPs, nextAVP)
 		currentIndex += bytesRead
 	}
-
-	if int64(messageLength) != currentIndex {
-		panic("assert failed. Bad header size in diameter message")
-	}
+	dm.AVPs = dm.AVPs[:i]
 
 	return int64(messageLength), nil
 }
 
+// Reads a DiameterMessage from a buffer
+// The values of type OctetString and addresses point to the buffer, which must not be modified afterwards
 func DiameterMessageFromBytes(inputBytes []byte) (DiameterMessage, uint32, error) {
-	reader := bytes.NewReader(inputBytes)
+	return DiameterMessageFromBytesWithDict(inputBytes, nil)
+}
 
-	diameterMessage := DiameterMessage{}
-	n, err := diameterMessage.ReadFrom(reader)
+// Reads a DiameterMessage from a buffer using the specified dictionary, or the global one if nil
+func DiameterMessageFromBytesWithDict(inputBytes []byte, dict *diamdict.DiameterDict) (DiameterMessage, uint32, error) {
+	diameterMessage := DiameterMessage{dict: dict}
+	n, err := diameterMessage.decode(inputBytes)
+	if err != nil {
+		err = fmt.Errorf("%w: %s", core.ErrMalformed, err)
+	}
 
 	return diameterMessage, uint32(n), err
 }
@@ -168,47 +201,50 @@ func DiameterMessageFromBytes(inputBytes []byte) (DiameterMessage, uint32, error
 func (m *DiameterMessage) Tidy() *DiameterMessage {
 
 	if m.ApplicationId == 0 && m.ApplicationName != "" {
-		m.ApplicationId = config.GetDDict().AppByName[m.ApplicationName].Code
+		app, _ := m.Dict().GetApplicationByName(m.ApplicationName)
+		m.ApplicationId = app.Code
 	}
 
 	if m.ApplicationId != 0 && m.ApplicationName == "" {
-		m.ApplicationName = config.GetDDict().AppByCode[m.ApplicationId].Name
+		app, _ := m.Dict().GetApplication(m.ApplicationId)
+		m.ApplicationName = app.Name
 	}
 
 	if m.CommandCode == 0 && m.CommandName != "" {
-		m.CommandCode = config.GetDDict().AppByCode[m.ApplicationId].CommandByName[m.CommandName].Code
+		app, _ := m.Dict().GetApplication(m.ApplicationId)
+		m.CommandCode = app.CommandByName[m.CommandName].Code
 	}
 
 	if m.CommandCode != 0 && m.CommandName == "" {
-		m.CommandName = config.GetDDict().AppByCode[m.ApplicationId].CommandByCode[m.CommandCode].Name
+		app, _ := m.Dict().GetApplication(m.ApplicationId)
+		m.CommandName = app.CommandByCode[m.CommandCode].Name
 	}
 
 	return m
 }
 
 // Writes the diameter message to the specified writer
+// The message is serialized in a pooled buffer and written in one go
 func (m *DiameterMessage) WriteTo(buffer io.Writer) (int64, error) {
 
-	currentIndex := int64(0)
-	var err error
+	bp := getBuffer()
+	defer putBuffer(bp)
 
-	// Write Version
-	if err = binary.Write(buffer, binary.BigEndian, byte(1)); err != nil {
-		return currentIndex, err
+	b, err := m.appendTo((*bp)[:0])
+	*bp = b
+	if err != nil {
+		return 0, err
 	}
-	currentIndex += 1
 
-	messageLen := m.Len()
+	n, err := buffer.Write(b)
+	return int64(n), err
+}
 
-	// Write Len
-	if err = binary.Write(buffer, binary.BigEndian, byte(messageLen/65535)); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 1
-	if err = binary.Write(buffer, binary.BigEndian, uint16(messageLen%65535)); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 2
+// Appends the serialized message to the buffer
+func (m *DiameterMessage) appendTo(b []byte) ([]byte, error) {
+
+	start := len(b)
+	messageLen := m.Len()
 
 	// Write flags
 	var flags byte
@@ -224,59 +260,64 @@ func (m *DiameterMessage) WriteTo(buffer io.Writer) (int64, error) {
 	if m.IsRetransmission {
 		flags += 16
 	}
-	if err = binary.Write(buffer, binary.BigEndian, flags); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 1
 
-	// Write command code
-	if err = binary.Write(buffer, binary.BigEndian, byte(m.CommandCode/65535)); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 1
-	if err = binary.Write(buffer, binary.BigEndian, uint16(m.CommandCode%65535)); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 2
+	// Write Version, Len, flags and command code
+	b = append(b, 1, byte(messageLen>>16), byte(messageLen>>8), byte(messageLen))
+	b = append(b, flags, byte(m.CommandCode>>16), byte(m.CommandCode>>8), byte(m.CommandCode))
 
 	// Write the rest of the fields
-	if err = binary.Write(buffer, binary.BigEndian, m.ApplicationId); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 4
-
-	if err = binary.Write(buffer, binary.BigEndian, m.E2EId); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 4
-
-	if err = binary.Write(buffer, binary.BigEndian, m.HopByHopId); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 4
+	b = appendUint32(b, m.ApplicationId)
+	b = appendUint32(b, m.E2EId)
+	b = appendUint32(b, m.HopByHopId)
 
 	// Write avps
 	for i := range m.AVPs {
 		// TODO: Need to enforce mandatory here
-		n, err := m.AVPs[i].WriteTo(buffer)
-		if err != nil {
-			return currentIndex, err
+		var err error
+		if b, err = m.AVPs[i].appendTo(b); err != nil {
+			return b, err
 		}
-		currentIndex += int64(n)
 	}
 
 	// Saninty check
-	if currentIndex != int64(messageLen) {
+	if len(b)-start != messageLen {
 		panic("assert failed. Bad message size")
 	}
 
-	return currentIndex, nil
+	return b, nil
 }
 
 func (dm *DiameterMessage) MarshalBinary() ([]byte, error) {
-	var buffer = new(bytes.Buffer)
-	_, err := dm.WriteTo(buffer)
-	return buffer.Bytes(), err
+	return dm.appendTo(make([]byte, 0, dm.Len()))
+}
+
+// Parses the message as in the wire. The values of type OctetString and addresses point to the buffer,
+// which must not be modified afterwards
+func (dm *DiameterMessage) UnmarshalBinary(b []byte) error {
+	n, err := dm.decode(b)
+	if err != nil {
+		return fmt.Errorf("%w: %s", core.ErrMalformed, err)
+	}
+	if int(n) != len(b) {
+		return fmt.Errorf("%w: %d trailing bytes", core.ErrMalformed, len(b)-int(n))
+	}
+	return nil
+}
+
+// Metadata sent in the envelope of the binary content type, which is not part of the diameter message
+const binaryMetadataReceivedFrom = "received-from"
+
+// Implementation of core.BinaryMetadataCarrier, to keep the peer from which the message was received
+// when forwarding between igor instances
+func (dm *DiameterMessage) BinaryMetadata() map[string]string {
+	if dm.receivedFrom == "" {
+		return nil
+	}
+	return map[string]string{binaryMetadataReceivedFrom: dm.receivedFrom}
+}
+
+func (dm *DiameterMessage) SetBinaryMetadata(metadata map[string]string) {
+	dm.receivedFrom = metadata[binaryMetadataReceivedFrom]
 }
 
 func (dm *DiameterMessage) Len() int {
@@ -307,7 +348,7 @@ func (m *DiameterMessage) Add(name string, value interface{}) *DiameterMessage {
 		return m
 	}
 
-	avp, error := NewAVP(name, value)
+	avp, error := NewAVPWithDict(m.dict, name, value)
 
 	if error != nil {
 		config.GetLogger().Errorf("avp could not be added %s: %v, %s", name, value, error)
@@ -416,6 +457,15 @@ func (m *DiameterMessage) GetIntAVP(avpName string) int64 {
 	return avp.GetInt()
 }
 
+// Same, for unsigned
+func (m *DiameterMessage) GetUintAVP(avpName string) uint64 {
+	avp, err := m.GetAVPFromPath(avpName)
+	if err != nil {
+		return 0
+	}
+	return avp.GetUint()
+}
+
 // Same, for float
 func (m *DiameterMessage) GetFloatAVP(avpName string) float64 {
 	avp, err := m.GetAVPFromPath(avpName)
@@ -443,6 +493,33 @@ func (m *DiameterMessage) GetDateAVP(avpName string) time.Time {
 	return avp.GetDate()
 }
 
+// Returns the value of Accounting-Input-Octets, which is already a 64 bit counter
+func (m *DiameterMessage) GetInputOctets() uint64 {
+	return m.GetUintAVP("Accounting-Input-Octets")
+}
+
+// Returns the value of Accounting-Output-Octets, which is already a 64 bit counter
+func (m *DiameterMessage) GetOutputOctets() uint64 {
+	return m.GetUintAVP("Accounting-Output-Octets")
+}
+
+// Adds the specified duration to the values of all the Time AVPs, including those inside grouped AVPs
+func (m *DiameterMessage) ShiftTimeAVPs(d time.Duration) *DiameterMessage {
+	shiftTimeAVPs(m.AVPs, d)
+	return m
+}
+
+func shiftTimeAVPs(avps []DiameterAVP, d time.Duration) {
+	for i := range avps {
+		switch v := avps[i].Value.(type) {
+		case time.Time:
+			avps[i].Value = v.Add(d)
+		case []DiameterAVP:
+			shiftTimeAVPs(v, d)
+		}
+	}
+}
+
 // Helper function to add Origin-Host and Origin-Realm attributes
 func (dm *DiameterMessage) AddOriginAVPs(ci *config.PolicyConfigurationManager) *DiameterMessage {
 	// Add mandatory parameters
@@ -455,11 +532,16 @@ func (dm *DiameterMessage) AddOriginAVPs(ci *config.PolicyConfigurationManager)
 // Message constructors
 ///////////////////////////////////////////////////////////////
 func NewDiameterRequest(appName string, commandName string) (*DiameterMessage, error) {
+	return NewDiameterRequestWithDict(nil, appName, commandName)
+}
+
+// Creates a request using the specified dictionary, or the global one if nil
+func NewDiameterRequestWithDict(dict *diamdict.DiameterDict, appName string, commandName string) (*DiameterMessage, error) {
 
-	diameterMessage := DiameterMessage{IsRequest: true}
+	diameterMessage := DiameterMessage{IsRequest: true, dict: dict}
 
 	// Find element in dictionary
-	appDict, ok := config.GetDDict().AppByName[appName]
+	appDict, ok := diameterMessage.Dict().GetApplicationByName(appName)
 	if !ok {
 		return &diameterMessage, fmt.Errorf("application %s not found", appName)
 	}
@@ -481,9 +563,10 @@ func NewDiameterRequest(appName string, commandName string) (*DiameterMessage, e
 	return &diameterMessage, nil
 }
 
-func NewDiameterAnswer(diameterRequest *DiameterMessage) *DiameterMessage {
+// Creates the answer to the request, populated from it as specified in the options, such as CopyEchoedAVPs()
+func NewDiameterAnswer(diameterRequest *DiameterMessage, options ...AnswerOption) *DiameterMessage {
 
-	diameterMessage := DiameterMessage{}
+	diameterMessage := DiameterMessage{dict: diameterRequest.dict}
 
 	diameterMessage.ApplicationId = diameterRequest.ApplicationId
 	diameterMessage.ApplicationName = diameterRequest.ApplicationName
@@ -493,6 +576,10 @@ func NewDiameterAnswer(diameterRequest *DiameterMessage) *DiameterMessage {
 	diameterMessage.E2EId = diameterRequest.E2EId
 	diameterMessage.HopByHopId = diameterRequest.HopByHopId
 
+	for _, option := range options {
+		option(&diameterMessage, diameterRequest)
+	}
+
 	return &diameterMessage
 }
 
@@ -503,6 +590,11 @@ func CopyDiameterMessage(diameterMessage *DiameterMessage) DiameterMessage {
 	return copy
 }
 
+// Returns the key-value pairs that identify the message in structured log entries
+func (dm *DiameterMessage) LogFields() []interface{} {
+	return []interface{}{"command", dm.CommandName, "session-id", dm.GetStringAVP("Session-Id")}
+}
+
 func (dm DiameterMessage) String() string {
 	b, error := json.Marshal(dm)
 	if error != nil {
@@ -511,3 +603,16 @@ func (dm DiameterMessage) String() string {
 		return string(b)
 	}
 }
+
+// Encode as CBOR with the same structure as in JSON, instead of as the binary diameter message,
+// which would be done by default because of the MarshalBinary method
+func (dm *DiameterMessage) MarshalCBOR() ([]byte, error) {
+	type plainDiameterMessage DiameterMessage
+	return core.Marshal(core.CONTENT_TYPE_CBOR, (*plainDiameterMessage)(dm))
+}
+
+// Get a DiameterMessage from CBOR
+func (dm *DiameterMessage) UnmarshalCBOR(b []byte) error {
+	type plainDiameterMessage DiameterMessage
+	return core.Unmarshal(core.CONTENT_TYPE_CBOR, b, (*plainDiameterMessage)(dm))
+}
@@ -1,7 +1,8 @@
 package diamcodec
 
 import (
-	"math/rand"
+	"fmt"
+	"igor/random"
 	"sync/atomic"
 	"time"
 )
@@ -12,24 +13,47 @@ import (
 var nextHopByHopId uint32
 var nextE2EId uint32
 
+// For Session-Id generation
+var sessionIdHigh uint32
+var nextSessionIdLow uint32
+
 func init() {
-	source := rand.NewSource(time.Now().UnixNano())
-	randgen := rand.New(source)
-	nextHopByHopId = randgen.Uint32()
+	ResetIds()
+}
+
+// Sets the initial values of the identifiers using the current random Source.
+// Tests using a seeded Source may invoke this function to get reproducible identifiers
+func ResetIds() {
+	atomic.StoreUint32(&nextHopByHopId, random.Uint32())
 
 	// implementations MAY set the high order 12 bits to
 	// contain the low order 12 bits of current time, and the low order
 	// 20 bits to a random value.
 	var nowSeconds = uint32(time.Now().Unix())
-	nextE2EId = (nowSeconds&4095)*41048576 + randgen.Uint32()&1048575
+	atomic.StoreUint32(&nextE2EId, (nowSeconds&4095)*41048576+random.Uint32()&1048575)
+
+	// The high part of the Session-Id is the start time, and the low part a counter
+	atomic.StoreUint32(&sessionIdHigh, nowSeconds)
+	atomic.StoreUint32(&nextSessionIdLow, random.Uint32())
 }
 
 func getHopByHopId() uint32 {
 	return atomic.AddUint32(&nextHopByHopId, 1)
 }
 
+// Returns a new Hop-by-Hop Identifier, to be used by relays and proxies when forwarding a request
+func NewHopByHopId() uint32 {
+	return getHopByHopId()
+}
+
 func getE2EId() uint32 {
 	return atomic.AddUint32(&nextE2EId, 1)
 }
 
+// Generates a new Session-Id, with the format <DiameterIdentity>;<high 32 bits>;<low 32 bits>
+// as recommended in the Diameter RFC
+func NewSessionId(diameterHost string) string {
+	return fmt.Sprintf("%s;%d;%d", diameterHost, atomic.LoadUint32(&sessionIdHigh), atomic.AddUint32(&nextSessionIdLow, 1))
+}
+
 //The response message has the same E2EId and HopByHop Id. Probably error in generating the diameter answer
@@ -0,0 +1,127 @@
+package diamcodec
+
+import (
+	"fmt"
+	"igor/diamdict"
+)
+
+// Validation of the messages against the dictionary. Each AVP of a message or grouped AVP must be
+// among the ones specified for the command or group, or the specification must include the "AVP"
+// wildcard, and the number of occurrences must be within the minOccurs and maxOccurs specified,
+// where a zero maxOccurs means no limit. CheckAgainstCommand additionally enforces the positions of
+// the fixed AVPs, as the ABNF of the command, and reports the Result-Code that corresponds to the violation
+
+// Violation of the rules of the dictionary, with the Result-Code to be sent in the answer and the name of
+// the offending AVP
+type RuleError struct {
+	ResultCode int
+	AVPName    string
+	Reason     string
+}
+
+func (e *RuleError) Error() string {
+	return e.Reason
+}
+
+func newRuleError(resultCode int, avpName string, format string, a ...interface{}) *RuleError {
+	return &RuleError{ResultCode: resultCode, AVPName: avpName, Reason: fmt.Sprintf(format, a...)}
+}
+
+// Checks that the AVPs of the message and those inside its grouped AVPs are as specified in the dictionary
+func (m *DiameterMessage) Validate() error {
+	command, err := m.Dict().GetCommand(m.ApplicationId, m.CommandCode)
+	if err != nil {
+		return err
+	}
+
+	rules := command.Response
+	kind := "answer"
+	if m.IsRequest {
+		rules = command.Request
+		kind = "request"
+	}
+	if err := validateAVPs(m.AVPs, rules, false); err != nil {
+		return fmt.Errorf("%s %s: %w", command.Name, kind, err)
+	}
+	return nil
+}
+
+// Checks the message against the rules of its command in the dictionary, including the positions of
+// the fixed AVPs, both in the message and in the grouped AVPs. The error returned, if any, is a *RuleError
+func (m *DiameterMessage) CheckAgainstCommand() error {
+	app, found := m.Dict().GetApplication(m.ApplicationId)
+	if !found {
+		return newRuleError(DIAMETER_APPLICATION_UNSUPPORTED, "", "application %d not in dictionary", m.ApplicationId)
+	}
+	command, found := app.CommandByCode[m.CommandCode]
+	if !found {
+		return newRuleError(DIAMETER_COMMAND_UNSUPPORTED, "", "command %d not in application %s", m.CommandCode, app.Name)
+	}
+
+	rules := command.Response
+	if m.IsRequest {
+		rules = command.Request
+	}
+	return validateAVPs(m.AVPs, rules, true)
+}
+
+// Checks that the AVPs inside the grouped AVP are as specified in the dictionary. Non grouped AVPs are always valid
+func (avp *DiameterAVP) Validate() error {
+	if avp.DictItem.DiameterType != diamdict.Grouped {
+		return nil
+	}
+	groupedValue, ok := avp.Value.([]DiameterAVP)
+	if !ok {
+		return fmt.Errorf("%s: value is not of type grouped", avp.Name)
+	}
+	if err := validateAVPs(groupedValue, avp.DictItem.Group, false); err != nil {
+		return fmt.Errorf("%s: %w", avp.Name, err)
+	}
+	return nil
+}
+
+// As Validate, checking also the positions of the fixed AVPs if so specified
+func (avp *DiameterAVP) validate(checkPositions bool) error {
+	if !checkPositions {
+		return avp.Validate()
+	}
+	if avp.DictItem.DiameterType != diamdict.Grouped {
+		return nil
+	}
+	groupedValue, ok := avp.Value.([]DiameterAVP)
+	if !ok {
+		return newRuleError(DIAMETER_UNABLE_TO_COMPLY, avp.Name, "%s: value is not of type grouped", avp.Name)
+	}
+	return validateAVPs(groupedValue, avp.DictItem.Group, true)
+}
+
+// Checks the AVPs against the specification, and the contents of the grouped ones
+func validateAVPs(avps []DiameterAVP, rules map[string]diamdict.GroupedProperties, checkPositions bool) error {
+	_, acceptsAny := rules["AVP"]
+
+	occurrences := make(map[string]int)
+	for i := range avps {
+		if _, found := rules[avps[i].Name]; !found && !acceptsAny {
+			return newRuleError(DIAMETER_AVP_NOT_ALLOWED, avps[i].Name, "%s not allowed", avps[i].Name)
+		}
+		if err := avps[i].validate(checkPositions); err != nil {
+			return err
+		}
+		occurrences[avps[i].Name]++
+	}
+
+	for name, properties := range rules {
+		if occurrences[name] < properties.MinOccurs {
+			return newRuleError(DIAMETER_MISSING_AVP, name, "%s must occur at least %d times", name, properties.MinOccurs)
+		}
+		if properties.MaxOccurs > 0 && occurrences[name] > properties.MaxOccurs {
+			return newRuleError(DIAMETER_AVP_OCCURS_TOO_MANY_TIMES, name, "%s must occur at most %d times", name, properties.MaxOccurs)
+		}
+		if checkPositions && properties.Position > 0 && occurrences[name] > 0 {
+			if properties.Position > len(avps) || avps[properties.Position-1].Name != name {
+				return newRuleError(DIAMETER_AVP_NOT_ALLOWED, name, "%s must be in position %d", name, properties.Position)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package diamdict
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Dictionary content shipped with igor, that may be added to the dictionaries of the instances that
+// need it, instead of having to be copied to the diameterDictionary.json of each one. Each bundle has
+// the same format as the dictionary file
+//
+//go:embed bundles/*.json
+var bundlesFS embed.FS
+
+// Returns the names of the available bundles, such as "3gpp"
+func BundleNames() []string {
+	entries, err := bundlesFS.ReadDir("bundles")
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, strings.TrimSuffix(entry.Name(), ".json"))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Merges the contents of the named bundle into the dictionary. The vendors, AVPs and commands already
+// defined in the dictionary, with the same code, are kept and the ones in the bundle ignored, so that
+// the local definitions take precedence
+func (dd *DiameterDict) AddBundle(bundleName string) error {
+	data, err := bundlesFS.ReadFile("bundles/" + bundleName + ".json")
+	if err != nil {
+		return fmt.Errorf("diameter dictionary bundle %s not found", bundleName)
+	}
+
+	var jDict jDiameterDict
+	if err := json.Unmarshal(data, &jDict); err != nil {
+		return fmt.Errorf("bad diameter dictionary bundle %s: %w", bundleName, err)
+	}
+
+	dd.mutex.Lock()
+	defer dd.mutex.Unlock()
+
+	for _, v := range jDict.Vendors {
+		if _, found := dd.VendorById[v.VendorId]; found {
+			continue
+		}
+		if _, found := dd.VendorByName[v.VendorName]; found {
+			return fmt.Errorf("vendor %s of bundle %s already defined with another id", v.VendorName, bundleName)
+		}
+		dd.VendorById[v.VendorId] = v.VendorName
+		dd.VendorByName[v.VendorName] = v.VendorId
+	}
+
+	for _, vendorAVPs := range jDict.Avps {
+		vendorId := vendorAVPs.VendorId
+		vendorName := dd.VendorById[vendorId]
+
+		for _, attr := range vendorAVPs.Attributes {
+			avpDictItem, err := attr.toAVPDictItem(vendorId, vendorName)
+			if err != nil {
+				return fmt.Errorf("bad diameter dictionary bundle %s: %w", bundleName, err)
+			}
+			if _, found := dd.AVPByCode[AVPCode{vendorId, attr.Code}]; found {
+				continue
+			}
+			if _, found := dd.AVPByName[avpDictItem.Name]; found {
+				continue
+			}
+			dd.AVPByCode[AVPCode{vendorId, attr.Code}] = avpDictItem
+			dd.AVPByName[avpDictItem.Name] = avpDictItem
+		}
+	}
+
+	for _, bundleApp := range jDict.Applications {
+		app, found := dd.AppByCode[bundleApp.Code]
+		if !found {
+			if _, found := dd.AppByName[bundleApp.Name]; found {
+				return fmt.Errorf("application %s of bundle %s already defined with another code", bundleApp.Name, bundleName)
+			}
+			dd.addApplication(bundleApp)
+			continue
+		}
+
+		// Add only the commands not yet defined. As in AddCommand, the application is rebuilt
+		commands := append([]DiameterCommand(nil), app.Commands...)
+		for _, command := range bundleApp.Commands {
+			if _, found := app.CommandByCode[command.Code]; found {
+				continue
+			}
+			if _, found := app.CommandByName[command.Name]; found {
+				continue
+			}
+			commands = append(commands, command)
+		}
+		app.Commands = commands
+		dd.addApplication(app)
+	}
+
+	return nil
+}
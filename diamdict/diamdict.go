@@ -8,6 +8,7 @@ Package diamdict impements helpers for reading and using the Diameter dictionary
 import (
 	"encoding/json"
 	"fmt"
+	"sync"
 )
 
 // One for each Diamter AVP Type
@@ -41,11 +42,15 @@ type AVPCode struct {
 	Code     uint32
 }
 
-// Attributes of a Grouped AVP
+// Attributes of an AVP inside a Grouped AVP or a command, as in the ABNF of the specifications
 type GroupedProperties struct {
 	Mandatory bool
 	MinOccurs int
 	MaxOccurs int
+
+	// If not zero, the AVP is fixed and must be in this position, starting at 1, as the
+	// < Session-Id > in the ABNF of most commands
+	Position int
 }
 
 // Diameter Dictionary elements
@@ -80,7 +85,11 @@ type DiameterApplication struct {
 }
 
 // Represents the full Diameter Dictionary
+// The dictionary may be extended at runtime with AddVendor, AddAVP, AddApplication and AddCommand. If so,
+// it must be read only with the Get methods, which are safe for concurrent use, and not using the maps
 type DiameterDict struct {
+	mutex sync.RWMutex
+
 	// Map of vendor id to vendor name
 	VendorById map[uint32]string
 
@@ -103,7 +112,9 @@ type DiameterDict struct {
 // Returns an empty dictionary item if the code is not found
 // The user may decide to go on with an UNKNOWN dictionary item when the error is returned
 func (dd *DiameterDict) GetFromCode(code AVPCode) (AVPDictItem, error) {
+	dd.mutex.RLock()
 	di := dd.AVPByCode[code]
+	dd.mutex.RUnlock()
 	if di.Name == "" {
 		di.Name = "UNKNOWN"
 		return di, fmt.Errorf("%v not found in dictionary", code)
@@ -114,7 +125,9 @@ func (dd *DiameterDict) GetFromCode(code AVPCode) (AVPDictItem, error) {
 // Returns an empty dictionary item if the code is not found
 // The user may decide to go on with an UNKNOWN dictionary item when the error is returned
 func (dd *DiameterDict) GetFromName(name string) (AVPDictItem, error) {
+	dd.mutex.RLock()
 	di, ok := dd.AVPByName[name]
+	dd.mutex.RUnlock()
 	if !ok {
 		di.Name = "UNKNOWN"
 		return di, fmt.Errorf("%s not found in dictionary", name)
@@ -124,13 +137,126 @@ func (dd *DiameterDict) GetFromName(name string) (AVPDictItem, error) {
 
 // Returns a DiameterCommand given the appid and command code
 func (dd *DiameterDict) GetCommand(appId uint32, commandCode uint32) (DiameterCommand, error) {
-	if command, ok := dd.AppByCode[appId].CommandByCode[commandCode]; !ok {
+	app, _ := dd.GetApplication(appId)
+	if command, ok := app.CommandByCode[commandCode]; !ok {
 		return DiameterCommand{}, fmt.Errorf("appId %d and command %d not found", appId, commandCode)
 	} else {
 		return command, nil
 	}
 }
 
+// Returns the application with the specified code
+func (dd *DiameterDict) GetApplication(appId uint32) (DiameterApplication, bool) {
+	dd.mutex.RLock()
+	defer dd.mutex.RUnlock()
+	app, ok := dd.AppByCode[appId]
+	return app, ok
+}
+
+// Returns the application with the specified name
+func (dd *DiameterDict) GetApplicationByName(appName string) (DiameterApplication, bool) {
+	dd.mutex.RLock()
+	defer dd.mutex.RUnlock()
+	app, ok := dd.AppByName[appName]
+	return app, ok
+}
+
+// Registers a new vendor
+func (dd *DiameterDict) AddVendor(vendorId uint32, vendorName string) error {
+	dd.mutex.Lock()
+	defer dd.mutex.Unlock()
+
+	if _, found := dd.VendorById[vendorId]; found {
+		return fmt.Errorf("vendor %d already defined", vendorId)
+	}
+	if _, found := dd.VendorByName[vendorName]; found {
+		return fmt.Errorf("vendor %s already defined", vendorName)
+	}
+	dd.VendorById[vendorId] = vendorName
+	dd.VendorByName[vendorName] = vendorId
+	return nil
+}
+
+// Registers a new AVP of the specified vendor, which must be already defined, or 0 for the base
+// AVPs. The name in the definition does not include the vendor prefix
+func (dd *DiameterDict) AddAVP(vendorId uint32, avp AVPDefinition) error {
+	dd.mutex.Lock()
+	defer dd.mutex.Unlock()
+
+	vendorName, found := dd.VendorById[vendorId]
+	if !found && vendorId != 0 {
+		return fmt.Errorf("vendor %d not defined", vendorId)
+	}
+	avpDictItem, err := jDiameterAVP(avp).toAVPDictItem(vendorId, vendorName)
+	if err != nil {
+		return err
+	}
+	if _, found := dd.AVPByCode[AVPCode{vendorId, avp.Code}]; found {
+		return fmt.Errorf("avp %d of vendor %d already defined", avp.Code, vendorId)
+	}
+	if _, found := dd.AVPByName[avpDictItem.Name]; found {
+		return fmt.Errorf("avp %s already defined", avpDictItem.Name)
+	}
+
+	dd.AVPByCode[AVPCode{vendorId, avp.Code}] = avpDictItem
+	dd.AVPByName[avpDictItem.Name] = avpDictItem
+	return nil
+}
+
+// Registers a new application, with the commands in the Commands field
+func (dd *DiameterDict) AddApplication(app DiameterApplication) error {
+	dd.mutex.Lock()
+	defer dd.mutex.Unlock()
+
+	if _, found := dd.AppByCode[app.Code]; found {
+		return fmt.Errorf("application %d already defined", app.Code)
+	}
+	if _, found := dd.AppByName[app.Name]; found {
+		return fmt.Errorf("application %s already defined", app.Name)
+	}
+
+	dd.addApplication(app)
+	return nil
+}
+
+// Registers a new command in the application with the specified name
+func (dd *DiameterDict) AddCommand(appName string, command DiameterCommand) error {
+	dd.mutex.Lock()
+	defer dd.mutex.Unlock()
+
+	app, found := dd.AppByName[appName]
+	if !found {
+		return fmt.Errorf("application %s not defined", appName)
+	}
+	if _, found := app.CommandByCode[command.Code]; found {
+		return fmt.Errorf("command %d already defined in application %s", command.Code, appName)
+	}
+	if _, found := app.CommandByName[command.Name]; found {
+		return fmt.Errorf("command %s already defined in application %s", command.Name, appName)
+	}
+
+	// The application is rebuilt, instead of modifying the maps of the commands, which may be
+	// in use by the readers of a copy of the application
+	app.Commands = append(append([]DiameterCommand(nil), app.Commands...), command)
+	dd.addApplication(app)
+	return nil
+}
+
+// Fills the maps of commands of the application and stores it
+func (dd *DiameterDict) addApplication(app DiameterApplication) {
+	app.CommandByName = make(map[string]DiameterCommand)
+	app.CommandByCode = make(map[uint32]DiameterCommand)
+	for _, command := range app.Commands {
+		// Fill the commands map for the application
+		app.CommandByCode[command.Code] = command
+		app.CommandByName[command.Name] = command
+	}
+
+	// Fill the Applications map
+	dd.AppByCode[app.Code] = app
+	dd.AppByName[app.Name] = app
+}
+
 // Returns a Diameter Dictionary object from its serialized representation
 func NewDictionaryFromJSON(data []byte) *DiameterDict {
 
@@ -160,7 +286,10 @@ func NewDictionaryFromJSON(data []byte) *DiameterDict {
 
 		// For a specific vendor
 		for _, attr := range vendorAVPs.Attributes {
-			avpDictItem := attr.toAVPDictItem(vendorId, vendorName)
+			avpDictItem, err := attr.toAVPDictItem(vendorId, vendorName)
+			if err != nil {
+				panic(err.Error())
+			}
 			dict.AVPByCode[AVPCode{vendorId, attr.Code}] = avpDictItem
 			dict.AVPByName[avpDictItem.Name] = avpDictItem
 		}
@@ -170,17 +299,7 @@ func NewDictionaryFromJSON(data []byte) *DiameterDict {
 	dict.AppByCode = make(map[uint32]DiameterApplication)
 	dict.AppByName = make(map[string]DiameterApplication)
 	for _, app := range jDict.Applications {
-		app.CommandByName = make(map[string]DiameterCommand)
-		app.CommandByCode = make(map[uint32]DiameterCommand)
-		for _, command := range app.Commands {
-			// Fill the commands map for the application
-			app.CommandByCode[command.Code] = command
-			app.CommandByName[command.Name] = command
-		}
-
-		// Fill the Applications map
-		dict.AppByCode[app.Code] = app
-		dict.AppByName[app.Name] = app
+		dict.addApplication(app)
 	}
 
 	return &dict
@@ -190,8 +309,9 @@ func NewDictionaryFromJSON(data []byte) *DiameterDict {
 The following types are helpers for unserializing the JSON Diameter Dictionary
 */
 
-// To Unmarshall Dictionary from Json
-type jDiameterAVP struct {
+// Definition of an AVP to add to the dictionary, with the same contents as in the JSON representation.
+// The Type is the name of the diameter type, such as "Unsigned32"
+type AVPDefinition struct {
 	Code       uint32
 	Name       string
 	Type       string
@@ -199,6 +319,9 @@ type jDiameterAVP struct {
 	Group      map[string]GroupedProperties
 }
 
+// To Unmarshall Dictionary from Json
+type jDiameterAVP AVPDefinition
+
 type jDiameterVendorAVPs struct {
 	VendorId   uint32
 	Attributes []jDiameterAVP
@@ -214,7 +337,7 @@ type jDiameterDict struct {
 	Applications []DiameterApplication
 }
 
-func (javp jDiameterAVP) toAVPDictItem(v uint32, vs string) AVPDictItem {
+func (javp jDiameterAVP) toAVPDictItem(v uint32, vs string) (AVPDictItem, error) {
 	var diameterType int
 	switch javp.Type {
 	case "None":
@@ -258,7 +381,7 @@ func (javp jDiameterAVP) toAVPDictItem(v uint32, vs string) AVPDictItem {
 	case "IPv6Prefix":
 		diameterType = IPv6Prefix
 	default:
-		panic(javp.Type + " is not a valid DiameterType")
+		return AVPDictItem{}, fmt.Errorf("%s is not a valid DiameterType", javp.Type)
 	}
 
 	var codes map[int]string
@@ -282,5 +405,5 @@ func (javp jDiameterAVP) toAVPDictItem(v uint32, vs string) AVPDictItem {
 		EnumValues:   javp.EnumValues,
 		EnumCodes:    codes,
 		Group:        javp.Group,
-	}
+	}, nil
 }
@@ -101,3 +101,89 @@ func TestUnknownDiameterAVP(t *testing.T) {
 		t.Errorf("Igor-Nothing name is not UNKNOWN")
 	}
 }
+
+func TestDiameterDictExtension(t *testing.T) {
+	jsonDict, _ := os.ReadFile("../resources/diameterDictionary.json")
+	diameterDict := NewDictionaryFromJSON(jsonDict)
+
+	if err := diameterDict.AddVendor(99999, "Embedder"); err != nil {
+		t.Fatalf("could not add vendor: %s", err)
+	}
+	if err := diameterDict.AddVendor(99999, "Other"); err == nil {
+		t.Errorf("duplicated vendor was added")
+	}
+
+	if err := diameterDict.AddAVP(99999, AVPDefinition{Code: 1, Name: "Color", Type: "Enumerated", EnumValues: map[string]int{"Red": 1}}); err != nil {
+		t.Fatalf("could not add AVP: %s", err)
+	}
+	avp, err := diameterDict.GetFromCode(AVPCode{99999, 1})
+	if err != nil || avp.Name != "Embedder-Color" || avp.DiameterType != Enumerated || avp.EnumCodes[1] != "Red" {
+		t.Errorf("bad added AVP %v", avp)
+	}
+	if err := diameterDict.AddAVP(88888, AVPDefinition{Code: 1, Name: "Color", Type: "Enumerated"}); err == nil {
+		t.Errorf("AVP of unknown vendor was added")
+	}
+	if err := diameterDict.AddAVP(99999, AVPDefinition{Code: 2, Name: "Shade", Type: "Colorful"}); err == nil {
+		t.Errorf("AVP of unknown type was added")
+	}
+	if err := diameterDict.AddAVP(0, AVPDefinition{Code: 1, Name: "Other-User-Name", Type: "UTF8String"}); err == nil {
+		t.Errorf("AVP with existing code was added")
+	}
+
+	request := map[string]GroupedProperties{"Embedder-Color": {MinOccurs: 1, MaxOccurs: 1}}
+	app := DiameterApplication{Name: "Embedded", Code: 99999, AppType: "auth", Commands: []DiameterCommand{{Name: "Paint", Code: 9000, Request: request}}}
+	if err := diameterDict.AddApplication(app); err != nil {
+		t.Fatalf("could not add application: %s", err)
+	}
+	if err := diameterDict.AddCommand("Embedded", DiameterCommand{Name: "Erase", Code: 9001}); err != nil {
+		t.Fatalf("could not add command: %s", err)
+	}
+	if command, err := diameterDict.GetCommand(99999, 9000); err != nil || command.Request["Embedder-Color"].MaxOccurs != 1 {
+		t.Errorf("bad added command %v", command)
+	}
+	if added, found := diameterDict.GetApplicationByName("Embedded"); !found || added.CommandByName["Erase"].Code != 9001 {
+		t.Errorf("bad added application %v", added)
+	}
+	if err := diameterDict.AddCommand("Embedded", DiameterCommand{Name: "Erase", Code: 9002}); err == nil {
+		t.Errorf("duplicated command was added")
+	}
+}
+
+func TestDiameterDictBundles(t *testing.T) {
+	jsonDict, _ := os.ReadFile("../resources/diameterDictionary.json")
+	diameterDict := NewDictionaryFromJSON(jsonDict)
+
+	if names := BundleNames(); len(names) == 0 || names[0] != "3gpp" {
+		t.Fatalf("bad bundle names %v", names)
+	}
+
+	if err := diameterDict.AddBundle("3gpp"); err != nil {
+		t.Fatalf("could not add bundle: %s", err)
+	}
+	if avp, err := diameterDict.GetFromName("3GPP-Reporting-Reason"); err != nil || avp.DiameterType != Enumerated || avp.EnumCodes[3] != "QUOTA_EXHAUSTED" {
+		t.Errorf("bad bundle AVP %v", avp)
+	}
+	if avp, err := diameterDict.GetFromCode(AVPCode{10415, 1401}); err != nil || avp.Name != "3GPP-Terminal-Information" {
+		t.Errorf("bad bundle AVP %v", avp)
+	}
+
+	// The existing definitions are kept
+	if avp, err := diameterDict.GetFromCode(AVPCode{10415, 1030}); err != nil || avp.Name != "3GPP-Rule-Failure-Code" {
+		t.Errorf("existing AVP was replaced %v", avp)
+	}
+	if _, err := diameterDict.GetCommand(16777251, 316); err != nil {
+		t.Errorf("existing command was removed")
+	}
+	if command, err := diameterDict.GetCommand(16777251, 317); err != nil || command.Name != "Cancel-Location" {
+		t.Errorf("bad bundle command %v", command)
+	}
+
+	// Adding again has no effect
+	if err := diameterDict.AddBundle("3gpp"); err != nil {
+		t.Errorf("could not add bundle twice: %s", err)
+	}
+
+	if err := diameterDict.AddBundle("nonexisting"); err == nil {
+		t.Errorf("unknown bundle was added")
+	}
+}
@@ -0,0 +1,378 @@
+package diameterclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"igor/config"
+	"igor/core"
+	"igor/diamcodec"
+	"igor/diampeer"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Client
+//
+// Originates diameter requests without the router and handlers, for programs such as load generators or test tools
+// for online charging systems.
+//
+// Connects to a set of peers, which perform the CER/CEA and DWR/DWA exchanges, and reconnects them when they go down.
+// The requests are sent to the engaged peers in round robin, unless they carry a Destination-Host that is one of
+// them. If a request is not answered in the timeout, or the peer is not available, it is sent to another peer, with
+// the T flag set, up to the configured number of retries. The requests received from the peers are answered by the
+// handler specified in the options or, if not specified, with DIAMETER_UNABLE_TO_COMPLY
+
+// Defaults for the Client options
+const (
+	DEFAULT_CLIENT_TIMEOUT_MILLIS   = 5000
+	DEFAULT_RECONNECT_MILLIS        = 5000
+	RECONNECT_CHECK_INTERVAL_MILLIS = 100
+)
+
+// Parameters of the Client. The zero values are replaced by the defaults
+type ClientOptions struct {
+	// Peers to connect to. If empty, those with the "active" connection policy in the configuration
+	Peers []config.DiameterPeer
+
+	// Time to wait for the answer from each peer
+	Timeout time.Duration
+
+	// Number of additional peers to try if the answer is not received
+	Retries int
+
+	// Time to wait before reconnecting to a peer that went down
+	ReconnectInterval time.Duration
+
+	// Handler for the requests received from the peers
+	Handler diampeer.MessageHandler
+}
+
+// Connection to a peer
+type clientPeer struct {
+	config config.DiameterPeer
+
+	// nil while waiting to reconnect
+	peer *diampeer.DiameterPeer
+
+	// True after the CER/CEA exchange
+	isEngaged bool
+
+	nextConnectionAttempt time.Time
+}
+
+type Client struct {
+	// Configuration instance, with the identity of the client and the dictionary
+	ci *config.PolicyConfigurationManager
+
+	instanceName string
+	options      ClientOptions
+
+	// Receives the PeerUpEvents and PeerDownEvents
+	controlChannel chan interface{}
+
+	// State of the peers, by Diameter-Host, and order for the round robin
+	sync.Mutex
+	peers       map[string]*clientPeer
+	peerNames   []string
+	nextPeer    int
+	closing     bool
+	engagedCond *sync.Cond
+
+	// To wait for the event loop to finish
+	wg sync.WaitGroup
+}
+
+// Creates the Client and starts connecting to the peers, using the identity in the configuration instance
+func NewClient(instanceName string, options ClientOptions) (*Client, error) {
+	ci := config.GetPolicyConfigInstance(instanceName)
+
+	if len(options.Peers) == 0 {
+		for _, peerConfig := range ci.PeersConf() {
+			if peerConfig.ConnectionPolicy == "active" {
+				options.Peers = append(options.Peers, peerConfig)
+			}
+		}
+	}
+	if len(options.Peers) == 0 {
+		return nil, errors.New("no diameter peers to connect to")
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DEFAULT_CLIENT_TIMEOUT_MILLIS * time.Millisecond
+	}
+	if options.ReconnectInterval <= 0 {
+		options.ReconnectInterval = DEFAULT_RECONNECT_MILLIS * time.Millisecond
+	}
+	if options.Handler == nil {
+		options.Handler = unableToComply
+	}
+
+	c := Client{
+		ci:             ci,
+		instanceName:   instanceName,
+		options:        options,
+		controlChannel: make(chan interface{}, len(options.Peers)),
+		peers:          make(map[string]*clientPeer),
+	}
+	c.engagedCond = sync.NewCond(&c.Mutex)
+
+	c.Lock()
+	for _, peerConfig := range options.Peers {
+		if _, found := c.peers[peerConfig.DiameterHost]; found {
+			c.Unlock()
+			return nil, fmt.Errorf("duplicated diameter peer %s", peerConfig.DiameterHost)
+		}
+		c.peers[peerConfig.DiameterHost] = &clientPeer{config: peerConfig}
+		c.peerNames = append(c.peerNames, peerConfig.DiameterHost)
+	}
+	sort.Strings(c.peerNames)
+	for _, clientPeer := range c.peers {
+		c.connect(clientPeer)
+	}
+	c.Unlock()
+
+	c.wg.Add(1)
+	go c.eventLoop()
+
+	return &c, nil
+}
+
+// Sends the request and waits for the answer. The Origin-Host and Origin-Realm are added if not present. Returns
+// an error wrapping core.ErrNoPeerAvailable if there is no engaged peer, core.ErrTimeout if not answered, or the
+// error of the context, if done before. The timeout is reduced if the deadline of the context would expire before
+func (c *Client) SendRequest(ctx context.Context, request *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, error) {
+	if _, err := request.GetAVP("Origin-Host"); err != nil {
+		request.AddOriginAVPs(c.ci)
+	}
+
+	var lastError error
+	var tried []string
+	for try := 0; try <= c.options.Retries; try++ {
+		if ctx.Err() != nil {
+			return nil, core.ContextError(ctx)
+		}
+		diameterHost, peer := c.selectPeer(request.GetStringAVP("Destination-Host"), tried)
+		if peer == nil {
+			break
+		}
+		tried = append(tried, diameterHost)
+
+		// The previous message may still be referenced by the peer
+		if try > 0 {
+			retransmission := *request
+			retransmission.IsRetransmission = true
+			request = &retransmission
+		}
+
+		timeout := time.Until(core.EarliestDeadline(ctx, time.Now().Add(c.options.Timeout)))
+		rc := make(chan interface{}, 1)
+		peer.DiameterExchange(request, timeout, rc)
+
+		// The response channel is buffered, so the exchange may finish after giving up
+		var response interface{}
+		select {
+		case response = <-rc:
+		case <-ctx.Done():
+			return nil, core.ContextError(ctx)
+		}
+
+		switch v := response.(type) {
+		case *diamcodec.DiameterMessage:
+			return v, nil
+		case error:
+			lastError = v
+			if !errors.Is(v, core.ErrTimeout) && !errors.Is(v, core.ErrNoPeerAvailable) {
+				return nil, v
+			}
+		}
+	}
+
+	if lastError == nil {
+		lastError = fmt.Errorf("no engaged diameter peer: %w", core.ErrNoPeerAvailable)
+	}
+	return nil, lastError
+}
+
+// Waits until at least one peer is engaged, or the context is done
+func (c *Client) WaitForPeers(ctx context.Context) error {
+	// Wake up the waiter when the context is done
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Lock()
+			c.engagedCond.Broadcast()
+			c.Unlock()
+		case <-stop:
+		}
+	}()
+
+	c.Lock()
+	defer c.Unlock()
+	for len(c.engagedPeers()) == 0 {
+		if ctx.Err() != nil {
+			return core.ContextError(ctx)
+		}
+		if c.closing {
+			return fmt.Errorf("diameter client closing: %w", core.ErrNoPeerAvailable)
+		}
+		c.engagedCond.Wait()
+	}
+	return nil
+}
+
+// Returns the names of the engaged peers
+func (c *Client) EngagedPeers() []string {
+	c.Lock()
+	defer c.Unlock()
+	return c.engagedPeers()
+}
+
+// Disconnects the peers, cancelling the outstanding requests, and waits for them to finish
+func (c *Client) Close() {
+	c.Lock()
+	c.closing = true
+	c.engagedCond.Broadcast()
+	for _, clientPeer := range c.peers {
+		if clientPeer.peer != nil {
+			clientPeer.peer.SetDown()
+		}
+	}
+	c.Unlock()
+
+	c.wg.Wait()
+}
+
+// Receives the events of the peers and reconnects the ones that went down, until closed and all the
+// peers are down
+func (c *Client) eventLoop() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(RECONNECT_CHECK_INTERVAL_MILLIS * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event := <-c.controlChannel:
+			c.handlePeerEvent(event)
+
+		case now := <-ticker.C:
+			c.Lock()
+			if !c.closing {
+				for _, clientPeer := range c.peers {
+					if clientPeer.peer == nil && now.After(clientPeer.nextConnectionAttempt) {
+						c.connect(clientPeer)
+					}
+				}
+			}
+			c.Unlock()
+		}
+
+		c.Lock()
+		finished := c.closing && len(c.connectedPeers()) == 0
+		c.Unlock()
+		if finished {
+			return
+		}
+	}
+}
+
+func (c *Client) handlePeerEvent(event interface{}) {
+	c.Lock()
+
+	switch v := event.(type) {
+	case diampeer.PeerUpEvent:
+		for _, clientPeer := range c.peers {
+			if clientPeer.peer == v.Sender {
+				config.GetLogger().Infof("diameter client peer %s engaged", v.DiameterHost)
+				clientPeer.isEngaged = true
+				c.engagedCond.Broadcast()
+			}
+		}
+
+	case diampeer.PeerDownEvent:
+		for _, clientPeer := range c.peers {
+			if clientPeer.peer == v.Sender {
+				if v.Error != nil {
+					config.GetLogger().Warnf("diameter client peer %s down: %s", clientPeer.config.DiameterHost, v.Error)
+				}
+				clientPeer.peer = nil
+				clientPeer.isEngaged = false
+				clientPeer.nextConnectionAttempt = time.Now().Add(c.options.ReconnectInterval)
+			}
+		}
+
+		// Takes some time, so the lock is released before
+		c.Unlock()
+		v.Sender.Close()
+		return
+	}
+	c.Unlock()
+}
+
+// Creates the active peer, which starts connecting. Must be called with the lock held
+func (c *Client) connect(clientPeer *clientPeer) {
+	clientPeer.peer = diampeer.NewActiveDiameterPeer(c.instanceName, c.controlChannel, clientPeer.config, c.options.Handler)
+	clientPeer.isEngaged = false
+}
+
+// Returns the engaged peer to send the request to, which is the one in the Destination-Host, if engaged, or the next
+// one in round robin, excluding those already tried. The peer is nil if there is none available
+func (c *Client) selectPeer(destinationHost string, tried []string) (string, *diampeer.DiameterPeer) {
+	c.Lock()
+	defer c.Unlock()
+
+	isTried := func(diameterHost string) bool {
+		for _, t := range tried {
+			if t == diameterHost {
+				return true
+			}
+		}
+		return false
+	}
+
+	if clientPeer, found := c.peers[destinationHost]; found && clientPeer.isEngaged && !isTried(destinationHost) {
+		return destinationHost, clientPeer.peer
+	}
+
+	for i := 0; i < len(c.peerNames); i++ {
+		diameterHost := c.peerNames[(c.nextPeer+i)%len(c.peerNames)]
+		if clientPeer := c.peers[diameterHost]; clientPeer.isEngaged && !isTried(diameterHost) {
+			c.nextPeer = (c.nextPeer + i + 1) % len(c.peerNames)
+			return diameterHost, clientPeer.peer
+		}
+	}
+	return "", nil
+}
+
+// Must be called with the lock held
+func (c *Client) engagedPeers() []string {
+	engaged := make([]string, 0)
+	for _, diameterHost := range c.peerNames {
+		if c.peers[diameterHost].isEngaged {
+			engaged = append(engaged, diameterHost)
+		}
+	}
+	return engaged
+}
+
+// Returns the peers not yet down. Must be called with the lock held
+func (c *Client) connectedPeers() []string {
+	connected := make([]string, 0)
+	for _, diameterHost := range c.peerNames {
+		if c.peers[diameterHost].peer != nil {
+			connected = append(connected, diameterHost)
+		}
+	}
+	return connected
+}
+
+// Default handler for the requests received from the peers
+func unableToComply(request *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, error) {
+	answer := diamcodec.NewDiameterAnswer(request)
+	answer.IsError = true
+	answer.Add("Result-Code", diamcodec.DIAMETER_UNABLE_TO_COMPLY)
+	return answer, nil
+}
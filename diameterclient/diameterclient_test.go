@@ -0,0 +1,111 @@
+package diameterclient
+
+import (
+	"context"
+	"errors"
+	"igor/config"
+	"igor/core"
+	"igor/diamcodec"
+	"igor/diampeer"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+
+	// Initialize the Config Objects
+	config.InitPolicyConfigInstance("resources/searchRules.json", "testServer", true)
+	config.InitPolicyConfigInstance("resources/searchRules.json", "testClient", false)
+
+	// Execute the tests and exit
+	os.Exit(m.Run())
+}
+
+// Echoes the User-Name, taking some time if so specified in the Command
+func echoHandler(request *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, error) {
+	answer := diamcodec.NewDiameterAnswer(request)
+	answer.AddOriginAVPs(config.GetPolicyConfig())
+	answer.Add("Result-Code", diamcodec.DIAMETER_SUCCESS)
+	answer.Add("User-Name", request.GetStringAVP("User-Name"))
+	if request.GetStringAVP("franciscocardosogil-Command") == "Slow" {
+		time.Sleep(300 * time.Millisecond)
+	}
+	return answer, nil
+}
+
+func TestClient(t *testing.T) {
+
+	// Diameter server
+	listener, err := net.Listen("tcp", "127.0.0.1:3871")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	serverControlChannel := make(chan interface{}, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			diampeer.NewPassiveDiameterPeer("testServer", serverControlChannel, conn, echoHandler)
+		}
+	}()
+	go func() {
+		for event := range serverControlChannel {
+			if down, ok := event.(diampeer.PeerDownEvent); ok {
+				down.Sender.Close()
+			}
+		}
+	}()
+
+	client, err := NewClient("testClient", ClientOptions{
+		Peers: []config.DiameterPeer{
+			{DiameterHost: "server.igorserver", IPAddress: "127.0.0.1", Port: 3871, ConnectionPolicy: "active", WatchdogIntervalMillis: 300000, OriginNetwork: "0.0.0.0/0"},
+			{DiameterHost: "unreachableserver.igorserver", IPAddress: "127.0.0.1", Port: 3872, ConnectionPolicy: "active", WatchdogIntervalMillis: 300000, OriginNetwork: "0.0.0.0/0"},
+		},
+		Timeout:           100 * time.Millisecond,
+		Retries:           1,
+		ReconnectInterval: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.WaitForPeers(ctx); err != nil {
+		t.Fatalf("peers not engaged: %s", err)
+	}
+	if engaged := client.EngagedPeers(); len(engaged) != 1 || engaged[0] != "server.igorserver" {
+		t.Fatalf("engaged peers are %v", engaged)
+	}
+
+	// Answered
+	request, _ := diamcodec.NewDiameterRequest("TestApplication", "TestRequest")
+	request.Add("User-Name", "user@igor")
+	answer, err := client.SendRequest(context.Background(), request)
+	if err != nil {
+		t.Fatalf("error sending request: %s", err)
+	}
+	if answer.GetStringAVP("User-Name") != "user@igor" {
+		t.Errorf("bad answer %s", answer)
+	}
+
+	// Timeout, with no other peer to fail over
+	request, _ = diamcodec.NewDiameterRequest("TestApplication", "TestRequest")
+	request.Add("franciscocardosogil-Command", "Slow")
+	if _, err := client.SendRequest(context.Background(), request); !errors.Is(err, core.ErrTimeout) {
+		t.Errorf("expected timeout but got %v", err)
+	}
+
+	// Cancelled
+	cancelledCtx, cancelRequest := context.WithCancel(context.Background())
+	cancelRequest()
+	if _, err := client.SendRequest(cancelledCtx, request); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected cancellation but got %v", err)
+	}
+}
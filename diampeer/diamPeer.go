@@ -3,15 +3,21 @@ package diampeer
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"igor/config"
+	"igor/core"
 	"igor/diamcodec"
 	"igor/instrumentation"
+	"igor/telemetry"
+	"igor/wiretrace"
 	"io"
 	"net"
 	"strings"
 	"sync"
 	"time"
+
+	"go.uber.org/zap"
 )
 
 const (
@@ -26,6 +32,13 @@ const (
 	EVENTLOOP_CAPACITY = 100
 )
 
+// Maximum time for writing a message to the peer, if not specified in the configuration.
+// If the peer does not read (zero window) the connection is torn down after this time
+const DEFAULT_WRITE_TIMEOUT_MILLIS = 10000
+
+// Maximum number of messages waiting to be written to the peer, if not specified in the configuration
+const DEFAULT_EGRESS_QUEUE_SIZE = 1000
+
 // Ouput Events (control channel)
 
 // Sent to the Router, via the output channel passed as parameter, to signal
@@ -73,6 +86,9 @@ type EgressDiameterMsg struct {
 
 	// Timeout to set
 	timeout time.Duration
+
+	// Context of the request, for the exemplars of the metrics. nil if not a request
+	ctx context.Context
 }
 
 // Message received from a Diameter Peer. May be a Request or an Answer
@@ -126,12 +142,37 @@ type WriteErrorMsg struct {
 type WatchdogMsg struct {
 }
 
+// Asks for the contents of the outstanding requests map, that is sent to the RChan
+type OutstandingRequestsQueryMsg struct {
+	RChan chan []OutstandingRequest
+}
+
+// Asks for the live data of the peer, that is sent to the RChan
+type PeerStatisticsQueryMsg struct {
+	RChan chan PeerStatistics
+}
+
 /////////////////////////////////////////////
 
 // Type for functions that handle the diameter requests received
-// If an error is returned, no diameter answer is sent. Implementers should always generate a diameter answer instead
+// If an error is returned, a DIAMETER_UNABLE_TO_COMPLY answer is sent, unless the error is ErrDiscardRequest.
+// Implementers should always generate a diameter answer instead
 type MessageHandler func(request *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, error)
 
+// Variant of MessageHandler that receives a context carrying the deadline of the request and the trace
+// metadata, which is cancelled when the requester gives up, so that long running handlers may be abandoned
+type ContextMessageHandler func(ctx context.Context, request *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, error)
+
+// Adapts a MessageHandler to be used where a ContextMessageHandler is expected
+func IgnoringContext(handler MessageHandler) ContextMessageHandler {
+	return func(ctx context.Context, request *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, error) {
+		return handler(request)
+	}
+}
+
+// To be returned, possibly wrapped, by the MessageHandler when the request is to be silently discarded
+var ErrDiscardRequest = errors.New("request discarded")
+
 // Context data for an in flight request
 type RequestContext struct {
 
@@ -143,6 +184,58 @@ type RequestContext struct {
 
 	// Timer
 	Timer *time.Timer
+
+	// When the request was sent, for measuring the latency
+	SentTime time.Time
+
+	// Context of the request, whose trace is attached to the duration metric. The request is
+	// cancelled when it is done
+	Ctx context.Context
+
+	// Closed when the request is answered or cancelled, to stop watching the context. May be nil
+	Done chan struct{}
+}
+
+// Closes the Done channel, if any
+func (rc RequestContext) release() {
+	if rc.Done != nil {
+		close(rc.Done)
+	}
+}
+
+// Description of a request sent to the peer and not yet answered
+type OutstandingRequest struct {
+	HopByHopId      uint32
+	ApplicationName string
+	CommandName     string
+	DestinationHost string
+	SentTime        time.Time
+}
+
+// Live data of the peer, for reporting purposes
+type PeerStatistics struct {
+	DiameterHost string
+	Status       string
+
+	// Time when the capabilities exchange finished and milliseconds elapsed since then. Zero if not engaged
+	EngagedSince time.Time
+	UptimeMillis int64
+
+	// Time of the last Device-Watchdog request sent and of the last successful answer received
+	LastDWRSent     time.Time
+	LastDWAReceived time.Time
+
+	// Number of requests sent and not yet answered
+	OutstandingRequests int
+
+	// Number of messages exchanged, including the base application ones
+	RequestsSent     uint64
+	RequestsReceived uint64
+	AnswersSent      uint64
+	AnswersReceived  uint64
+
+	// Applications advertised by the remote peer in the capabilities exchange
+	Applications []string
 }
 
 // This object abstracts the operations against a Diameter Peer
@@ -189,6 +282,10 @@ type DiameterPeer struct {
 	connReader *bufio.Reader
 	connWriter *bufio.Writer
 
+	// Messages to be written to the connection by the writeLoop, so that a peer that does not
+	// read does not block the event loop. Closed when the event loop finishes
+	egressQueue chan *diamcodec.DiameterMessage
+
 	// Canceller of TCP connection with Peer
 	cancel context.CancelFunc
 
@@ -197,7 +294,11 @@ type DiameterPeer struct {
 	requestsMap map[uint32]RequestContext
 
 	// Registered Handler for incoming messages
-	handler MessageHandler
+	handler ContextMessageHandler
+
+	// Parent of the contexts passed to the handler, cancelled when the event loop finishes
+	handlerContext context.Context
+	cancelHandlers context.CancelFunc
 
 	// Ticker for watchdog requests
 	watchdogTicker *time.Ticker
@@ -205,6 +306,16 @@ type DiameterPeer struct {
 	// Number of unanswered watchdog requests
 	outstandingDWA int
 
+	// For reporting the statistics of the peer
+	engagedSince     time.Time
+	lastDWRSent      time.Time
+	lastDWAReceived  time.Time
+	requestsSent     uint64
+	requestsReceived uint64
+	answersSent      uint64
+	answersReceived  uint64
+	applications     []string
+
 	// Wait group to be used on each goroutine launched, to make sure that
 	// the eventloop channel is not used after being closed
 	wg sync.WaitGroup
@@ -213,6 +324,11 @@ type DiameterPeer struct {
 // Creates a new DiameterPeer when we are expected to establish the connection with the other side
 // and initiate the CER/CEA handshake
 func NewActiveDiameterPeer(configInstanceName string, rc chan interface{}, peer config.DiameterPeer, handler MessageHandler) *DiameterPeer {
+	return NewActiveDiameterPeerWithContext(configInstanceName, rc, peer, IgnoringContext(handler))
+}
+
+// Same as NewActiveDiameterPeer, with a handler that receives the context of the request
+func NewActiveDiameterPeerWithContext(configInstanceName string, rc chan interface{}, peer config.DiameterPeer, handler ContextMessageHandler) *DiameterPeer {
 
 	// Create the Peer struct
 	dp := DiameterPeer{
@@ -223,8 +339,10 @@ func NewActiveDiameterPeer(configInstanceName string, rc chan interface{}, peer
 		requestsMap:          make(map[uint32]RequestContext),
 		handler:              handler,
 	}
+	dp.handlerContext, dp.cancelHandlers = context.WithCancel(context.Background())
+	dp.egressQueue = make(chan *diamcodec.DiameterMessage, dp.egressQueueSize())
 
-	config.GetLogger().Debugf("creating active diameter peer for %s", peer.DiameterHost)
+	dp.logger().Debugf("creating active diameter peer for %s", peer.DiameterHost)
 
 	dp.status = StatusConnecting
 
@@ -238,7 +356,7 @@ func NewActiveDiameterPeer(configInstanceName string, rc chan interface{}, peer
 	dp.wg.Add(1)
 
 	// This will eventually send a ConnectionEstablishedMsg or ConnectionErrorMsg
-	go dp.connect(timeout, peer.IPAddress, peer.Port)
+	go dp.connect(timeout, peer)
 
 	// Start the event loop
 	go dp.eventLoop()
@@ -248,6 +366,11 @@ func NewActiveDiameterPeer(configInstanceName string, rc chan interface{}, peer
 
 // Creates a new DiameterPeer when the connection has been alread accepted
 func NewPassiveDiameterPeer(configInstanceName string, rc chan interface{}, conn net.Conn, handler MessageHandler) *DiameterPeer {
+	return NewPassiveDiameterPeerWithContext(configInstanceName, rc, conn, IgnoringContext(handler))
+}
+
+// Same as NewPassiveDiameterPeer, with a handler that receives the context of the request
+func NewPassiveDiameterPeerWithContext(configInstanceName string, rc chan interface{}, conn net.Conn, handler ContextMessageHandler) *DiameterPeer {
 
 	// Create the Peer Struct
 	dp := DiameterPeer{
@@ -257,8 +380,10 @@ func NewPassiveDiameterPeer(configInstanceName string, rc chan interface{}, conn
 		connection:           conn,
 		requestsMap:          make(map[uint32]RequestContext),
 		handler:              handler}
+	dp.handlerContext, dp.cancelHandlers = context.WithCancel(context.Background())
+	dp.egressQueue = make(chan *diamcodec.DiameterMessage, dp.egressQueueSize())
 
-	config.GetLogger().Debugf("creating passive diameter peer for %s", conn.RemoteAddr().String())
+	dp.logger().Debugf("creating passive diameter peer for %s", conn.RemoteAddr().String())
 
 	dp.status = StatusConnected
 
@@ -266,7 +391,10 @@ func NewPassiveDiameterPeer(configInstanceName string, rc chan interface{}, conn
 	dp.connWriter = bufio.NewWriter(dp.connection)
 
 	dp.readLoopDoneChannel = make(chan bool, 1)
-	go dp.readLoop(dp.readLoopDoneChannel)
+	go dp.readLoop(dp.readLoopDoneChannel, dp.readIdleTimeout())
+
+	dp.wg.Add(1)
+	go dp.writeLoop(dp.writeTimeout())
 
 	go dp.eventLoop()
 
@@ -279,7 +407,7 @@ func NewPassiveDiameterPeer(configInstanceName string, rc chan interface{}, conn
 func (dp *DiameterPeer) SetDown() {
 	dp.eventLoopChannel <- PeerSetDownCommandMsg{}
 
-	config.GetLogger().Debugf("%s terminating", dp.PeerConfig.DiameterHost)
+	dp.logger().Debugf("%s terminating", dp.PeerConfig.DiameterHost)
 }
 
 // Closes the event loop channel
@@ -297,7 +425,7 @@ func (dp *DiameterPeer) Close() {
 
 	close(dp.eventLoopChannel)
 
-	config.GetLogger().Debugf("%s closed", dp.PeerConfig.DiameterHost)
+	dp.logger().Debugf("%s closed", dp.PeerConfig.DiameterHost)
 }
 
 // Event Loop
@@ -314,6 +442,12 @@ func (dp *DiameterPeer) eventLoop() {
 			dp.connection.Close()
 		}
 
+		// Terminate the writeLoop
+		close(dp.egressQueue)
+
+		// The answers of the handlers still running will not be sent
+		dp.cancelHandlers()
+
 	}()
 
 	// Initialize to something, in order to be able to select below.
@@ -336,7 +470,7 @@ func (dp *DiameterPeer) eventLoop() {
 			// Start the event loop and CER/CEA handshake
 			case ConnectionEstablishedMsg:
 
-				config.GetLogger().Debugf("connection established with %s", v.Connection.RemoteAddr().String)
+				dp.logger().Debugf("connection established with %s", v.Connection.RemoteAddr().String)
 
 				dp.connection = v.Connection
 				dp.connReader = bufio.NewReader(dp.connection)
@@ -344,12 +478,15 @@ func (dp *DiameterPeer) eventLoop() {
 
 				// Start the read loop
 				dp.readLoopDoneChannel = make(chan bool, 1)
-				go dp.readLoop(dp.readLoopDoneChannel)
+				go dp.readLoop(dp.readLoopDoneChannel, dp.readIdleTimeout())
+
+				dp.wg.Add(1)
+				go dp.writeLoop(dp.writeTimeout())
 
 				dp.status = StatusConnected
 
 				// Active Peer. We'll send the CER
-				cer, err := diamcodec.NewDiameterRequest("Base", "Capabilities-Exchange")
+				cer, err := diamcodec.NewDiameterRequestWithDict(dp.ci.DiameterDict(), "Base", "Capabilities-Exchange")
 				cer.AddOriginAVPs(dp.ci)
 				if err != nil {
 					panic("could not create a CER")
@@ -365,7 +502,7 @@ func (dp *DiameterPeer) eventLoop() {
 			// and the Router must recycle it
 			case ConnectionErrorMsg:
 
-				config.GetLogger().Errorf("connection error %s", v.Error)
+				dp.logger().Errorf("connection error %s", v.Error)
 				dp.status = StatusTerminated
 				dp.routerControlChannel <- PeerDownEvent{Sender: dp, Error: v.Error}
 				return
@@ -376,9 +513,9 @@ func (dp *DiameterPeer) eventLoop() {
 			case ReadEOFMsg:
 
 				if dp.status < StatusTerminating {
-					config.GetLogger().Debugf("connection terminated by remote peer %s", dp.connection.RemoteAddr().String())
+					dp.logger().Debugf("connection terminated by remote peer %s", dp.connection.RemoteAddr().String())
 				} else {
-					config.GetLogger().Errorf("connection terminated with remote peer %s", dp.connection.RemoteAddr().String())
+					dp.logger().Errorf("connection terminated with remote peer %s", dp.connection.RemoteAddr().String())
 				}
 
 				if dp.connection != nil {
@@ -386,6 +523,7 @@ func (dp *DiameterPeer) eventLoop() {
 				}
 
 				dp.status = StatusTerminated
+				dp.cancelRequests()
 
 				// Tell the router that we are down
 				dp.routerControlChannel <- PeerDownEvent{Sender: dp, Error: nil}
@@ -396,12 +534,10 @@ func (dp *DiameterPeer) eventLoop() {
 			// and the Router must recycle it
 			case ReadErrorMsg:
 
-				// TODO: Cancell all requests!
-
 				if dp.status < StatusTerminating {
-					config.GetLogger().Errorf("connection read error %v with remote peer %s", v.Error, dp.connection.RemoteAddr().String())
+					dp.logger().Errorf("connection read error %v with remote peer %s", v.Error, dp.connection.RemoteAddr().String())
 				} else {
-					config.GetLogger().Debugf("connection terminating with remote peer %s. Last error %v", dp.connection.RemoteAddr().String(), v.Error)
+					dp.logger().Debugf("connection terminating with remote peer %s. Last error %v", dp.connection.RemoteAddr().String(), v.Error)
 				}
 
 				if dp.connection != nil {
@@ -409,6 +545,7 @@ func (dp *DiameterPeer) eventLoop() {
 				}
 
 				dp.status = StatusTerminated
+				dp.cancelRequests()
 
 				// Tell the router we are down
 				dp.routerControlChannel <- PeerDownEvent{Sender: dp, Error: v.Error}
@@ -418,21 +555,23 @@ func (dp *DiameterPeer) eventLoop() {
 			// Same for writes
 			case WriteErrorMsg:
 
-				config.GetLogger().Errorf("write error %s with remote peer %s", v.Error, dp.connection.RemoteAddr().String)
+				dp.logger().Errorf("write error %s with remote peer %s", v.Error, dp.connection.RemoteAddr().String)
 
 				if dp.connection != nil {
 					dp.connection.Close()
 				}
 
 				dp.status = StatusTerminated
+				dp.cancelRequests()
 
 				// Tell the router we are down
-				dp.eventLoopChannel <- PeerDownEvent{Sender: dp, Error: v.Error}
+				dp.routerControlChannel <- PeerDownEvent{Sender: dp, Error: v.Error}
 
 				return
 
 			case PeerUpMsg:
 				dp.status = StatusEngaged
+				dp.engagedSince = time.Now()
 
 				// Tell the Router we are up
 				dp.routerControlChannel <- PeerUpEvent{Sender: dp, DiameterHost: v.diameterHost}
@@ -444,7 +583,7 @@ func (dp *DiameterPeer) eventLoop() {
 			// Initiate closing procedure
 			case PeerSetDownCommandMsg:
 
-				config.GetLogger().Debug("processing PeerSetDownCommandMsg")
+				dp.logger().Debug("processing PeerSetDownCommandMsg")
 
 				dp.status = StatusTerminated
 
@@ -462,23 +601,7 @@ func (dp *DiameterPeer) eventLoop() {
 				*/
 
 				// Cancellation of all outstanding requests
-				for hopId := range dp.requestsMap {
-					config.GetLogger().Debugf("cancelling request %d", hopId)
-					requestContext := dp.requestsMap[hopId]
-
-					// Cancel timer
-					if requestContext.Timer.Stop() {
-						// The after func has not been called
-						dp.wg.Done()
-					} else {
-						// Drain the channel
-						<-requestContext.Timer.C
-					}
-					// Send the error
-					requestContext.RChan <- fmt.Errorf("request cancelled due to Peer down")
-					close(requestContext.RChan)
-					delete(dp.requestsMap, hopId)
-				}
+				dp.cancelRequests()
 
 				// Tell the Router we are finished
 				dp.routerControlChannel <- PeerDownEvent{Sender: dp}
@@ -497,23 +620,23 @@ func (dp *DiameterPeer) eventLoop() {
 						break
 					}
 
-					config.GetLogger().Debugf("-> Sending Message %s\n", v.message)
-					_, err := v.message.WriteTo(dp.connection)
-					if err != nil {
-						// There was an error writing. Will close the connection
-						if dp.status < StatusTerminating {
-							dp.eventLoopChannel <- WriteErrorMsg{err}
-							dp.status = StatusTerminating
-						}
-
-						// Signal the error in the response channel for the input request
-						// Do all necessary things to cancell the request
+					// Queue for the writer. If there is an error writing, a WriteErrorMsg will be received
+					// and the outstanding requests cancelled
+					dp.logger().Debugw("-> sending message", append(v.message.LogFields(), "message", v.message)...)
+					queued := false
+					select {
+					case dp.egressQueue <- v.message:
+						queued = true
+						dp.trace(wiretrace.DIRECTION_OUT, v.message)
+						instrumentation.PushPeerEgressQueueDepth(dp.ci.InstanceName(), dp.PeerConfig.DiameterHost, len(dp.egressQueue))
+					default:
+						dp.logger().Errorw("message was not sent because the egress queue is full", v.message.LogFields()...)
+						instrumentation.PushPeerDiameterEgressQueueFull(dp.ci.InstanceName(), dp.PeerConfig.DiameterHost, v.message)
+					}
+					if !queued {
 						if v.message.IsRequest && v.RChan != nil {
-							v.RChan <- err
+							v.RChan <- fmt.Errorf("egress queue full: %w", core.ErrNoPeerAvailable)
 						}
-
-						// No statistics, because the Peer will die
-
 						break
 					}
 
@@ -521,34 +644,38 @@ func (dp *DiameterPeer) eventLoop() {
 					// If it was a Request, store in the outstanding request map
 					// RChan may be nil if it is a base application message
 					if v.message.IsRequest {
-						instrumentation.PushPeerDiameterRequestSent(dp.PeerConfig.DiameterHost, v.message)
+						instrumentation.PushPeerDiameterRequestSent(dp.ci.InstanceName(), dp.PeerConfig.DiameterHost, v.message)
+						dp.requestsSent++
 						if v.RChan != nil {
 							// Set timer
 							dp.wg.Add(1)
 							timer := time.AfterFunc(v.timeout, func() {
 								// This will be called if the timer expires
-								dp.eventLoopChannel <- CancelRequestMsg{HopByHopId: v.message.HopByHopId, Reason: fmt.Errorf("Timeout")}
+								dp.eventLoopChannel <- CancelRequestMsg{HopByHopId: v.message.HopByHopId, Reason: core.ErrTimeout}
 								defer dp.wg.Done()
 							})
 
-							dp.requestsMap[v.message.HopByHopId] = RequestContext{RChan: v.RChan, Timer: timer, Key: instrumentation.PeerDiameterMetricFromMessage(dp.PeerConfig.DiameterHost, v.message)}
+							dp.requestsMap[v.message.HopByHopId] = RequestContext{RChan: v.RChan, Timer: timer, Key: instrumentation.PeerDiameterMetricFromMessage(dp.ci.InstanceName(), dp.PeerConfig.DiameterHost, v.message), SentTime: time.Now(), Ctx: v.ctx, Done: dp.watchContext(v.ctx, v.message.HopByHopId)}
 						}
 					} else {
-						instrumentation.PushPeerDiameterAnswerSent(dp.PeerConfig.DiameterHost, v.message)
+						instrumentation.PushPeerDiameterAnswerSent(dp.ci.InstanceName(), dp.PeerConfig.DiameterHost, v.message)
+						dp.answersSent++
 					}
 
 				} else {
-					config.GetLogger().Errorf("%s %s message was not sent because status is %d", v.message.ApplicationName, v.message.CommandName, dp.status)
+					dp.logger().Errorw(fmt.Sprintf("message was not sent because status is %d", dp.status), v.message.LogFields()...)
 				}
 
 				// Received message from peer
 			case IngressDiameterMsg:
 
-				config.GetLogger().Debugf("<- Receiving Message %s\n", v.message)
+				dp.logger().Debugw("<- receiving message", append(v.message.LogFields(), "message", v.message)...)
+				dp.trace(wiretrace.DIRECTION_IN, v.message)
 
 				if v.message.IsRequest {
 
-					instrumentation.PushPeerDiameterRequestReceived(dp.PeerConfig.DiameterHost, v.message)
+					instrumentation.PushPeerDiameterRequestReceived(dp.ci.InstanceName(), dp.PeerConfig.DiameterHost, v.message)
+					dp.requestsReceived++
 
 					// Check if it is a Base application message (code for Base application is 0)
 					if v.message.ApplicationId == 0 {
@@ -580,31 +707,40 @@ func (dp *DiameterPeer) eventLoop() {
 							dp.status = StatusTerminating
 
 						default:
-							config.GetLogger().Warnf("command %d for base applicaton not found in dictionary", v.message.CommandCode)
+							dp.logger().Warnf("command %d for base applicaton not found in dictionary", v.message.CommandCode)
 						}
 
 					} else {
 						// Reveived a non base request. Invoke handler
+						v.message.SetReceivedFrom(dp.PeerConfig.DiameterHost)
 						// Make sure the eventLoopChannel is not closed until the response is received
 						dp.wg.Add(1)
 						go func() {
 							defer dp.wg.Done()
-							resp, err := dp.handler(v.message)
-							if err != nil {
-								config.GetLogger().Error(err)
+							start := time.Now()
+							ctx := telemetry.ExtractDiameter(dp.handlerContext, v.message, dp.ci.DiameterServerConf().TraceContextAVP)
+							ctx, span := telemetry.StartServerSpan(ctx, "diameter "+v.message.CommandName, telemetry.DiameterAttributes(v.message)...)
+							resp, err := dp.handler(ctx, v.message)
+							telemetry.EndSpan(span, err)
+							if errors.Is(err, ErrDiscardRequest) {
+								dp.logger().Debugf("discarding request: %s", err)
+							} else if err != nil {
+								dp.logger().Errorw(err.Error(), append(v.message.LogFields(), "errorClass", core.ErrorClass(err))...)
 								// Send an error UNABLE_TO_COMPLY
 								errorResp := diamcodec.NewDiameterAnswer(v.message)
 								errorResp.AddOriginAVPs(dp.ci)
 								errorResp.Add("Result-Code", diamcodec.DIAMETER_UNABLE_TO_COMPLY)
 								dp.eventLoopChannel <- EgressDiameterMsg{message: errorResp}
 							} else {
+								instrumentation.PushPeerDiameterHandlerDuration(ctx, dp.ci.InstanceName(), dp.PeerConfig.DiameterHost, v.message, time.Since(start))
 								dp.eventLoopChannel <- EgressDiameterMsg{message: resp}
 							}
 						}()
 					}
 				} else {
 					// Received an answer
-					instrumentation.PushPeerDiameterAnswerReceived(dp.PeerConfig.DiameterHost, v.message)
+					instrumentation.PushPeerDiameterAnswerReceived(dp.ci.InstanceName(), dp.PeerConfig.DiameterHost, v.message)
+					dp.answersReceived++
 
 					if v.message.ApplicationId == 0 {
 						// Base answer
@@ -614,14 +750,15 @@ func (dp *DiameterPeer) eventLoop() {
 							// Received capabilities exchange answer
 							originHostAVP, err := v.message.GetAVP("Origin-Host")
 							if err != nil {
-								config.GetLogger().Errorf("error getting Origin-Host %s", err)
+								dp.logger().Errorf("error getting Origin-Host %s", err)
 							} else if originHostAVP.GetString() != dp.PeerConfig.DiameterHost {
-								config.GetLogger().Errorf("error in CER. Got origin host %s instead of %s", originHostAVP.GetString(), dp.PeerConfig.DiameterHost)
+								dp.logger().Errorf("error in CER. Got origin host %s instead of %s", originHostAVP.GetString(), dp.PeerConfig.DiameterHost)
 							} else if v.message.GetResultCode() != diamcodec.DIAMETER_SUCCESS {
-								config.GetLogger().Errorf("error in CER. Got Result code %d", v.message.GetResultCode())
+								dp.logger().Errorf("error in CER. Got Result code %d", v.message.GetResultCode())
 							} else {
 								// All good.
 								doDisconnect = false
+								dp.applications = advertisedApplications(v.message)
 							}
 
 							if doDisconnect {
@@ -632,83 +769,108 @@ func (dp *DiameterPeer) eventLoop() {
 							}
 
 						case "Device-Watchdog":
-							config.GetLogger().Debug("received dwa")
+							dp.logger().Debug("received dwa")
 							if v.message.GetResultCode() != diamcodec.DIAMETER_SUCCESS {
-								config.GetLogger().Errorf("bad result code in answer to DWR: %d", v.message.GetResultCode())
+								dp.logger().Errorf("bad result code in answer to DWR: %d", v.message.GetResultCode())
 								dp.eventLoopChannel <- PeerSetDownCommandMsg{}
 								dp.status = StatusTerminating
 							} else {
 								dp.outstandingDWA--
+								dp.lastDWAReceived = time.Now()
 							}
 						default:
-							config.GetLogger().Warnf("command %d for base applicaton not found in dictionary", v.message.CommandCode)
+							dp.logger().Warnf("command %d for base applicaton not found in dictionary", v.message.CommandCode)
 						}
 					} else {
 						// Non base answer
 						if requestContext, ok := dp.requestsMap[v.message.HopByHopId]; !ok {
-							instrumentation.PushPeerDiameterAnswerStalled(dp.PeerConfig.DiameterHost, v.message)
-							config.GetLogger().Errorf("stalled diameter answer: '%v'", *v.message)
+							instrumentation.PushPeerDiameterAnswerStalled(dp.ci.InstanceName(), dp.PeerConfig.DiameterHost, v.message)
+							dp.logger().Errorw("stalled diameter answer", append(v.message.LogFields(), "message", v.message)...)
 						} else {
-							// Cancel timer
+							// Cancel timer. If the after func has already been called, it will send a
+							// CancelRequestMsg that will be ignored
 							if requestContext.Timer.Stop() {
-								// The after func has not been called
 								dp.wg.Done()
-							} else {
-								// Drain the channel
-								<-requestContext.Timer.C
 							}
+							instrumentation.PushPeerDiameterRequestDuration(requestContext.Ctx, requestContext.Key, time.Since(requestContext.SentTime))
 							// Send the response
 							requestContext.RChan <- v.message
 							close(requestContext.RChan)
+							requestContext.release()
 							delete(dp.requestsMap, v.message.HopByHopId)
 						}
 					}
 				}
 
 			case CancelRequestMsg:
-				config.GetLogger().Debugf("Cancelling HopByHopId: <%d>\n", v.HopByHopId)
+				dp.logger().Debugf("Cancelling HopByHopId: <%d>\n", v.HopByHopId)
 				requestContext, ok := dp.requestsMap[v.HopByHopId]
 				if !ok {
-					config.GetLogger().Errorf("attempt to cancel an non existing request with HopByHopId %d", v.HopByHopId)
+					dp.logger().Errorf("attempt to cancel an non existing request with HopByHopId %d", v.HopByHopId)
 				} else {
+					// Cancel timer, if the cancellation was not due to its expiration
+					if requestContext.Timer.Stop() {
+						dp.wg.Done()
+					}
 					// Send the response
 					requestContext.RChan <- v.Reason
 					// No more messages will be sent through this channel
 					close(requestContext.RChan)
+					requestContext.release()
 					// Delete the requestmap entry
 					delete(dp.requestsMap, v.HopByHopId)
 					// Update metric
-					instrumentation.PushPeerDiameterRequestTimeout(dp.PeerConfig.DiameterHost, requestContext.Key)
+					if errors.Is(v.Reason, core.ErrTimeout) {
+						instrumentation.PushPeerDiameterRequestTimeout(requestContext.Key)
+					}
+				}
+
+			case OutstandingRequestsQueryMsg:
+				requests := make([]OutstandingRequest, 0, len(dp.requestsMap))
+				for hopId, requestContext := range dp.requestsMap {
+					requests = append(requests, OutstandingRequest{
+						HopByHopId:      hopId,
+						ApplicationName: requestContext.Key.AP,
+						CommandName:     requestContext.Key.CM,
+						DestinationHost: requestContext.Key.DH,
+						SentTime:        requestContext.SentTime,
+					})
 				}
+				v.RChan <- requests
+
+			case PeerStatisticsQueryMsg:
+				v.RChan <- dp.statistics()
 
 			case WatchdogMsg:
 				maxOustandingDWA := 2
-				config.GetLogger().Debugf("dwr tick")
+				dp.logger().Debugf("dwr tick")
+				instrumentation.PushPeerEgressQueueDepth(dp.ci.InstanceName(), dp.PeerConfig.DiameterHost, len(dp.egressQueue))
 
 				// Here we do the checking of the DWA that are pending
 				if dp.outstandingDWA > maxOustandingDWA {
-					config.GetLogger().Errorf("too many unanswered DWR: %d", maxOustandingDWA)
+					dp.logger().Errorf("too many unanswered DWR: %d", maxOustandingDWA)
 					dp.eventLoopChannel <- PeerSetDownCommandMsg{}
 				}
 
 				// Create request
-				dwr, err := diamcodec.NewDiameterRequest("Base", "Device-Watchdog")
+				dwr, err := diamcodec.NewDiameterRequestWithDict(dp.ci.DiameterDict(), "Base", "Device-Watchdog")
 				dwr.AddOriginAVPs(dp.ci)
 				if err != nil {
 					panic("could not create a DWR")
 				}
 				dp.eventLoopChannel <- EgressDiameterMsg{message: dwr}
 				dp.outstandingDWA++
+				dp.lastDWRSent = time.Now()
 			}
 		}
 	}
 
 }
 
-// Establishes the connection with the peer
+// Establishes the connection with the peer, using TCP or SCTP as specified in its configuration
 // To be executed in a goroutine
 // Should not touch inner variables
-func (dp *DiameterPeer) connect(connTimeoutMillis int, ipAddress string, port int) {
+func (dp *DiameterPeer) connect(connTimeoutMillis int, peer config.DiameterPeer) {
 
 	// Create a cancellable deadline
 	context, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Duration(connTimeoutMillis)*time.Millisecond))
@@ -719,8 +881,15 @@ func (dp *DiameterPeer) connect(connTimeoutMillis int, ipAddress string, port in
 	}()
 
 	// Connect
-	var dialer net.Dialer
-	conn, err := dialer.DialContext(context, "tcp4", fmt.Sprintf("%s:%d", ipAddress, port))
+	var conn net.Conn
+	var err error
+	if peer.Transport == "sctp" {
+		addresses := append([]string{peer.IPAddress}, peer.SecondaryIPAddresses...)
+		conn, err = DialSCTP(context, dp.ci.DiameterServerConf().SCTPBindAddresses, addresses, peer.Port)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(context, "tcp4", fmt.Sprintf("%s:%d", peer.IPAddress, peer.Port))
+	}
 
 	if err != nil {
 		dp.eventLoopChannel <- ConnectionErrorMsg{err}
@@ -733,10 +902,16 @@ func (dp *DiameterPeer) connect(connTimeoutMillis int, ipAddress string, port in
 // Reader of peer messages
 // To be executed in a goroutine
 // Should not touch inner variables
-func (dp *DiameterPeer) readLoop(ch chan bool) {
+// If idleTimeout is not zero, the connection is terminated when nothing is received during that time
+func (dp *DiameterPeer) readLoop(ch chan bool, idleTimeout time.Duration) {
 	for {
+		if idleTimeout > 0 {
+			dp.connection.SetReadDeadline(time.Now().Add(idleTimeout))
+		}
+
 		// Read a Diameter message from the connection
 		dm := diamcodec.DiameterMessage{}
+		dm.SetDict(dp.ci.DiameterDict())
 		_, err := dm.ReadFrom(dp.connection)
 		if err != nil {
 			if err == io.EOF {
@@ -757,9 +932,115 @@ func (dp *DiameterPeer) readLoop(ch chan bool) {
 	close(ch)
 }
 
+// Writer of peer messages
+// To be executed in a goroutine
+// Should not touch inner variables
+// After a write error, the rest of messages are discarded until the egress queue is closed
+func (dp *DiameterPeer) writeLoop(writeTimeout time.Duration) {
+	defer dp.wg.Done()
+
+	failed := false
+	for message := range dp.egressQueue {
+		if failed {
+			continue
+		}
+		dp.connection.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err := message.WriteTo(dp.connection); err != nil {
+			failed = true
+			dp.eventLoopChannel <- WriteErrorMsg{err}
+		}
+	}
+}
+
+// Returns the maximum number of messages waiting to be written to the peer
+func (dp *DiameterPeer) egressQueueSize() int {
+	if queueSize := dp.ci.DiameterServerConf().PeerEgressQueueSize; queueSize > 0 {
+		return queueSize
+	}
+	return DEFAULT_EGRESS_QUEUE_SIZE
+}
+
+// Returns the maximum time for writing a message to the peer
+func (dp *DiameterPeer) writeTimeout() time.Duration {
+	if timeoutMillis := dp.ci.DiameterServerConf().PeerWriteTimeoutMillis; timeoutMillis > 0 {
+		return time.Duration(timeoutMillis) * time.Millisecond
+	}
+	return DEFAULT_WRITE_TIMEOUT_MILLIS * time.Millisecond
+}
+
+// Returns the maximum time without receiving anything from the peer, or zero if not limited
+func (dp *DiameterPeer) readIdleTimeout() time.Duration {
+	return time.Duration(dp.ci.DiameterServerConf().PeerReadIdleTimeoutMillis) * time.Millisecond
+}
+
+// Writes the message to the wire trace, if active. Must be called from the event loop, with the connection established
+func (dp *DiameterPeer) trace(direction string, message *diamcodec.DiameterMessage) {
+	if !wiretrace.IsActive() {
+		return
+	}
+	peer := dp.PeerConfig.DiameterHost
+	if peer == "" && direction == wiretrace.DIRECTION_IN {
+		// Passive peer before the capabilities exchange
+		peer = message.GetStringAVP("Origin-Host")
+	}
+	wiretrace.TraceDiameter(direction, peer, dp.connection.LocalAddr(), dp.connection.RemoteAddr(), message)
+}
+
+// Returns the logger of the subsystem, with the name of the peer as field of the entries
+func (dp *DiameterPeer) logger() *zap.SugaredLogger {
+	return config.GetSubsystemLogger(config.SUBSYSTEM_DIAMPEER).With("peer", dp.PeerConfig.DiameterHost)
+}
+
+// Sends an error to the requests waiting for an answer, which will not be received because
+// the peer is down
+func (dp *DiameterPeer) cancelRequests() {
+	for hopId, requestContext := range dp.requestsMap {
+		dp.logger().Debugf("cancelling request %d", hopId)
+
+		// Cancel timer. If the after func has already been called, it will send a
+		// CancelRequestMsg that will be ignored
+		if requestContext.Timer.Stop() {
+			dp.wg.Done()
+		}
+		// Send the error
+		requestContext.RChan <- fmt.Errorf("request cancelled due to Peer down: %w", core.ErrNoPeerAvailable)
+		close(requestContext.RChan)
+		requestContext.release()
+		delete(dp.requestsMap, hopId)
+	}
+}
+
+// Cancels the request with the specified HopByHopId when the context is done, unless the returned channel
+// is closed before. Returns nil if the context cannot be done
+func (dp *DiameterPeer) watchContext(ctx context.Context, hopByHopId uint32) chan struct{} {
+	if ctx == nil || ctx.Done() == nil {
+		return nil
+	}
+
+	done := make(chan struct{})
+	dp.wg.Add(1)
+	go func() {
+		defer dp.wg.Done()
+		select {
+		case <-ctx.Done():
+			select {
+			case dp.eventLoopChannel <- CancelRequestMsg{HopByHopId: hopByHopId, Reason: core.ContextError(ctx)}:
+			case <-done:
+			}
+		case <-done:
+		}
+	}()
+	return done
+}
+
 // Sends a Diameter request and gets the answer or error as a message to the specified channel.
 // The response channel is closed just after sending the reponse or error
 func (dp *DiameterPeer) DiameterExchange(dm *diamcodec.DiameterMessage, timeout time.Duration, rc chan interface{}) {
+	dp.DiameterExchangeWithContext(context.Background(), dm, timeout, rc)
+}
+
+// Same as DiameterExchange, with the context of the request, whose trace is attached to the duration metrics
+func (dp *DiameterPeer) DiameterExchangeWithContext(ctx context.Context, dm *diamcodec.DiameterMessage, timeout time.Duration, rc chan interface{}) {
 
 	if cap(rc) < 1 {
 		panic("using an unbuffered response channel")
@@ -775,7 +1056,7 @@ func (dp *DiameterPeer) DiameterExchange(dm *diamcodec.DiameterMessage, timeout
 		return
 	}
 	if dp.status != StatusEngaged {
-		rc <- fmt.Errorf("tried to send a diameter request in a non engaged DiameterPeer. Status is %d", dp.status)
+		rc <- fmt.Errorf("tried to send a diameter request in a non engaged DiameterPeer. Status is %d: %w", dp.status, core.ErrNoPeerAvailable)
 		return
 	}
 	if !(*dm).IsRequest {
@@ -784,7 +1065,132 @@ func (dp *DiameterPeer) DiameterExchange(dm *diamcodec.DiameterMessage, timeout
 	}
 
 	// Send myself the message
-	dp.eventLoopChannel <- EgressDiameterMsg{message: dm, RChan: rc, timeout: timeout}
+	dp.eventLoopChannel <- EgressDiameterMsg{message: dm, RChan: rc, timeout: timeout, ctx: ctx}
+}
+
+// Returns the requests sent to the peer and not yet answered. Fails if the event loop does not
+// answer in the specified time, which may happen if the peer is terminating
+func (dp *DiameterPeer) OutstandingRequests(timeout time.Duration) ([]OutstandingRequest, error) {
+
+	// Make sure the eventLoop channel is not closed until this finishes
+	dp.wg.Add(1)
+	defer dp.wg.Done()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	rc := make(chan []OutstandingRequest, 1)
+	select {
+	case dp.eventLoopChannel <- OutstandingRequestsQueryMsg{RChan: rc}:
+	case <-timer.C:
+		return nil, fmt.Errorf("outstanding requests of %s: %w", dp.PeerConfig.DiameterHost, core.ErrTimeout)
+	}
+
+	select {
+	case requests := <-rc:
+		return requests, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("outstanding requests of %s: %w", dp.PeerConfig.DiameterHost, core.ErrTimeout)
+	}
+}
+
+// Returns the live data of the peer. Fails if the event loop does not answer in the specified time,
+// which may happen if the peer is terminating
+func (dp *DiameterPeer) Statistics(timeout time.Duration) (PeerStatistics, error) {
+
+	// Make sure the eventLoop channel is not closed until this finishes
+	dp.wg.Add(1)
+	defer dp.wg.Done()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	rc := make(chan PeerStatistics, 1)
+	select {
+	case dp.eventLoopChannel <- PeerStatisticsQueryMsg{RChan: rc}:
+	case <-timer.C:
+		return PeerStatistics{}, fmt.Errorf("statistics of %s: %w", dp.PeerConfig.DiameterHost, core.ErrTimeout)
+	}
+
+	select {
+	case statistics := <-rc:
+		return statistics, nil
+	case <-timer.C:
+		return PeerStatistics{}, fmt.Errorf("statistics of %s: %w", dp.PeerConfig.DiameterHost, core.ErrTimeout)
+	}
+}
+
+// Builds the live data of the peer
+// This is executed in the eventLoop
+func (dp *DiameterPeer) statistics() PeerStatistics {
+	statistics := PeerStatistics{
+		DiameterHost:        dp.PeerConfig.DiameterHost,
+		Status:              statusName(dp.status),
+		LastDWRSent:         dp.lastDWRSent,
+		LastDWAReceived:     dp.lastDWAReceived,
+		OutstandingRequests: len(dp.requestsMap),
+		RequestsSent:        dp.requestsSent,
+		RequestsReceived:    dp.requestsReceived,
+		AnswersSent:         dp.answersSent,
+		AnswersReceived:     dp.answersReceived,
+		Applications:        dp.applications,
+	}
+	if dp.status == StatusEngaged {
+		statistics.EngagedSince = dp.engagedSince
+		statistics.UptimeMillis = time.Since(dp.engagedSince).Milliseconds()
+	}
+	return statistics
+}
+
+// Returns the name of the status, for reporting
+func statusName(status int) string {
+	switch status {
+	case StatusConnecting:
+		return "connecting"
+	case StatusConnected:
+		return "connected"
+	case StatusEngaged:
+		return "engaged"
+	case StatusTerminating:
+		return "terminating"
+	case StatusTerminated:
+		return "terminated"
+	default:
+		return fmt.Sprintf("unknown %d", status)
+	}
+}
+
+// Returns the names of the applications in the CER or CEA, including the ones inside
+// Vendor-Specific-Application-Id
+func advertisedApplications(message *diamcodec.DiameterMessage) []string {
+	var avps []diamcodec.DiameterAVP
+	for _, avpName := range []string{"Auth-Application-Id", "Acct-Application-Id"} {
+		avps = append(avps, message.GetAllAVP(avpName)...)
+	}
+	for _, vsa := range message.GetAllAVP("Vendor-Specific-Application-Id") {
+		for _, avpName := range []string{"Auth-Application-Id", "Acct-Application-Id"} {
+			avps = append(avps, vsa.GetAllAVP(avpName)...)
+		}
+	}
+
+	applications := make([]string, 0, len(avps))
+	for i := range avps {
+		name := avps[i].GetString()
+		if name == "" {
+			name = fmt.Sprintf("%d", avps[i].GetInt())
+		}
+		found := false
+		for _, application := range applications {
+			if application == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			applications = append(applications, name)
+		}
+	}
+	return applications
 }
 
 // Handle received CER message
@@ -813,6 +1219,7 @@ func (dp *DiameterPeer) handleCER(request *diamcodec.DiameterMessage) (string, e
 			if peerConfig, err := peersConf.FindPeer(originHost); err == nil {
 				// Grab the peer configuration
 				dp.PeerConfig = peerConfig
+				dp.applications = advertisedApplications(request)
 
 				cea := diamcodec.NewDiameterAnswer(request)
 				cea.AddOriginAVPs(dp.ci)
@@ -823,15 +1230,15 @@ func (dp *DiameterPeer) handleCER(request *diamcodec.DiameterMessage) (string, e
 				// All good returns here
 				return originHost, nil
 			} else {
-				config.GetLogger().Errorf("Origin-Host not found in configuration %s while handling CER", originHost)
+				dp.logger().Errorf("Origin-Host not found in configuration %s while handling CER", originHost)
 				sendErrorMessage = true
 			}
 		} else {
-			config.GetLogger().Errorf("invalid diameter peer %s with address %s while handling CER", originHost, remoteIPAddr.IP)
+			dp.logger().Errorf("invalid diameter peer %s with address %s while handling CER", originHost, remoteIPAddr.IP)
 			sendErrorMessage = true
 		}
 	} else {
-		config.GetLogger().Errorf("error getting Origin-Host %s while handling CER", err)
+		dp.logger().Errorf("error getting Origin-Host %s while handling CER", err)
 	}
 
 	if sendErrorMessage {
@@ -852,6 +1259,14 @@ func (dp *DiameterPeer) pushCEAttributes(cer *diamcodec.DiameterMessage) {
 	if serverConf.BindAddress != "0.0.0.0" {
 		cer.Add("Host-IP-Address", serverConf.BindAddress)
 	}
+	// A multi-homed SCTP endpoint advertises all its addresses
+	if dp.PeerConfig.Transport == "sctp" {
+		for _, address := range serverConf.SCTPBindAddresses {
+			if address != serverConf.BindAddress {
+				cer.Add("Host-IP-Address", address)
+			}
+		}
+	}
 	cer.Add("Vendor-Id", serverConf.VendorId)
 	cer.Add("Product-Name", "igor")
 	cer.Add("Firmware-Revision", serverConf.FirmwareRevision)
@@ -862,7 +1277,7 @@ func (dp *DiameterPeer) pushCEAttributes(cer *diamcodec.DiameterMessage) {
 	var relaySet = false
 	for _, rule := range routingRules {
 		if rule.ApplicationId != "*" {
-			if appDict, ok := config.GetDDict().AppByName[rule.ApplicationId]; ok {
+			if appDict, ok := dp.ci.DiameterDict().GetApplicationByName(rule.ApplicationId); ok {
 				if strings.Contains(appDict.AppType, "auth") {
 					cer.Add("Auth-Application-Id", appDict.Code)
 				} else if strings.Contains(appDict.AppType, "acct") {
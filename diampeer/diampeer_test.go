@@ -3,12 +3,17 @@ package diampeer
 // TODO: connection cannot be established with peer. DWA not neceived
 
 import (
+	"context"
+	"errors"
 	"igor/config"
 	"igor/diamcodec"
 	"igor/instrumentation"
+	"io"
 	"net"
 	"os"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -39,6 +44,7 @@ func TestMain(m *testing.M) {
 	config.InitPolicyConfigInstance("resources/searchRules.json", "testClientUnknownClient", false)
 	config.InitPolicyConfigInstance("resources/searchRules.json", "testClientUnknownServer", false)
 	config.InitPolicyConfigInstance("resources/searchRules.json", "testServerBadOriginNetwork", false)
+	config.InitPolicyConfigInstance("resources/searchRules.json", "testServerStuck", false)
 
 	// Execute the tests and exit
 	os.Exit(m.Run())
@@ -68,9 +74,15 @@ func TestDiameterPeerOK(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer listener.Close()
+	// The passive peer keeps the context received by the handler
+	var handlerContext atomic.Value
+	contextHandler := func(ctx context.Context, request *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, error) {
+		handlerContext.Store(ctx)
+		return MyMessageHandler(request)
+	}
 	go func() {
 		conn, _ := listener.Accept()
-		passivePeer = NewPassiveDiameterPeer("testServer", passiveControlChannel, conn, MyMessageHandler)
+		passivePeer = NewPassiveDiameterPeerWithContext("testServer", passiveControlChannel, conn, contextHandler)
 	}()
 
 	activePeer = NewActiveDiameterPeer("testClient", activeControlChannel, activePeerConfig, MyMessageHandler)
@@ -157,6 +169,36 @@ func TestDiameterPeerOK(t *testing.T) {
 
 	// t.Log(metrics)
 
+	// Check live data of the active peer
+	statistics, err := activePeer.Statistics(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statistics.Status != "engaged" || statistics.UptimeMillis < 1000 || statistics.LastDWAReceived.IsZero() || statistics.LastDWRSent.IsZero() {
+		t.Fatalf("bad peer status %v", statistics)
+	}
+	// Two requests, the CER and several DWR
+	if statistics.RequestsSent < 5 || statistics.AnswersReceived < 4 || statistics.OutstandingRequests != 0 {
+		t.Fatalf("bad peer counters %v", statistics)
+	}
+	if len(statistics.Applications) == 0 {
+		t.Fatalf("no applications advertised %v", statistics)
+	}
+
+	// The request is cancelled when its context is done, without waiting for the timeout
+	requestCtx, cancel := context.WithCancel(context.Background())
+	var rc3 = make(chan interface{}, 1)
+	activePeer.DiameterExchangeWithContext(requestCtx, request, 2*time.Second, rc3)
+	time.AfterFunc(20*time.Millisecond, cancel)
+	select {
+	case a3 := <-rc3:
+		if err, ok := a3.(error); !ok || !errors.Is(err, context.Canceled) {
+			t.Fatalf("should have got a cancellation and got %v", a3)
+		}
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("request not cancelled with its context")
+	}
+
 	// Disonnect peers
 	passivePeer.SetDown()
 	activePeer.SetDown()
@@ -173,6 +215,17 @@ func TestDiameterPeerOK(t *testing.T) {
 	// Received PeerDown, we can close
 	passivePeer.Close()
 	activePeer.Close()
+
+	// The context of the handlers is cancelled when the peer finishes
+	ctx, _ := handlerContext.Load().(context.Context)
+	if ctx == nil {
+		t.Fatal("handler did not receive a context")
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("handler context not cancelled when the peer finished")
+	}
 }
 
 func TestDiameterPeerBadServerName(t *testing.T) {
@@ -427,3 +480,106 @@ func TestRequestsCancellation(t *testing.T) {
 	activePeer.Close()
 	passivePeer.Close()
 }
+
+func TestStuckConnection(t *testing.T) {
+
+	// testServerStuck has 200 millis write timeout, 1000 millis read idle timeout and
+	// egress queue size of 2
+
+	instrumentation.MS.ResetMetrics()
+
+	// The remote peer sends DWRs and then does not read the answers. The first one is being
+	// written, the next two are queued and the last one is discarded
+	conn, remoteConn := net.Pipe()
+	defer remoteConn.Close()
+	controlChannel := make(chan interface{}, 100)
+	passivePeer := NewPassiveDiameterPeer("testServerStuck", controlChannel, conn, MyMessageHandler)
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		dwr, _ := diamcodec.NewDiameterRequest("Base", "Device-Watchdog")
+		dwr.AddOriginAVPs(config.GetPolicyConfig())
+		if _, err := dwr.WriteTo(remoteConn); err != nil {
+			t.Fatalf("could not write DWR %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case msg := <-controlChannel:
+		if down, ok := msg.(PeerDownEvent); !ok || !errors.Is(down.Error, os.ErrDeadlineExceeded) {
+			t.Errorf("expected PeerDownEvent with deadline exceeded but got %#v", msg)
+		}
+		if time.Since(start) > 800*time.Millisecond {
+			t.Error("write timeout not applied")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("peer not down with stuck writes")
+	}
+	passivePeer.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	if full := instrumentation.MS.DiameterQuery("DiameterEgressQueueFull", nil, []string{}); full[instrumentation.PeerDiameterMetricKey{}] != 1 {
+		t.Errorf("bad egress queue full metric %v", full)
+	}
+	if depths := instrumentation.MS.EgressQueueDepthQuery(); depths[""] != 2 {
+		t.Errorf("bad egress queue depth %v", depths)
+	}
+
+	// The remote peer does not send anything
+	conn, remoteConn = net.Pipe()
+	defer remoteConn.Close()
+	passivePeer = NewPassiveDiameterPeer("testServerStuck", controlChannel, conn, MyMessageHandler)
+
+	start = time.Now()
+	select {
+	case msg := <-controlChannel:
+		if down, ok := msg.(PeerDownEvent); !ok || !errors.Is(down.Error, os.ErrDeadlineExceeded) {
+			t.Errorf("expected PeerDownEvent with deadline exceeded but got %#v", msg)
+		}
+		if time.Since(start) < 900*time.Millisecond {
+			t.Error("peer down before the read idle timeout")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("peer not down with idle connection")
+	}
+	passivePeer.Close()
+}
+
+func TestSCTPTransport(t *testing.T) {
+
+	listener, err := ListenSCTP([]string{"127.0.0.1"}, 3870)
+	if errors.Is(err, syscall.EPROTONOSUPPORT) || errors.Is(err, syscall.ESOCKTNOSUPPORT) {
+		t.Skip("SCTP not supported in this host")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, err := DialSCTP(ctx, []string{"127.0.0.1"}, []string{"127.0.0.1"}, 3870)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The connection supports deadlines
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buffer); err != nil || string(buffer) != "hello" {
+		t.Errorf("bad echo %s %v", buffer, err)
+	}
+}
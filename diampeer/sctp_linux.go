@@ -0,0 +1,128 @@
+package diampeer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/ishidawataru/sctp"
+	"golang.org/x/sys/unix"
+)
+
+// SCTP transport (RFC 6733, section 2.1). The associations use one-to-one style sockets, that behave
+// as streams, so that they are handled by the runtime poller as regular connections and support
+// deadlines. The sockets are bound and connected with the sctp_bindx and sctp_connectx options,
+// so that both the local and the remote endpoints may have several addresses (multi-homing)
+
+// Interval for checking the cancellation while the association is being established
+const SCTP_CONNECT_POLL_MILLIS = 100
+
+// Establishes an SCTP association with the peer, which may have several addresses. If not empty,
+// the local addresses are bound. The association is aborted if the context finishes before it is up
+func DialSCTP(ctx context.Context, localAddresses []string, remoteAddresses []string, port int) (net.Conn, error) {
+	raddr, err := sctpAddr(remoteAddresses, port)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := sctpSocket(localAddresses, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := sctp.SCTPConnect(fd, raddr); err != nil && !errors.Is(err, syscall.EINPROGRESS) {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("sctp connect to %s: %w", raddr, err)
+	}
+
+	// Wait until the socket is writable, which means that the association is up or failed
+	for {
+		select {
+		case <-ctx.Done():
+			syscall.Close(fd)
+			return nil, fmt.Errorf("sctp connect to %s: %w", raddr, ctx.Err())
+		default:
+		}
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLOUT}}
+		n, err := unix.Poll(fds, SCTP_CONNECT_POLL_MILLIS)
+		if err != nil && !errors.Is(err, syscall.EINTR) {
+			syscall.Close(fd)
+			return nil, fmt.Errorf("sctp connect to %s: %w", raddr, err)
+		}
+		if n > 0 {
+			break
+		}
+	}
+	if soError, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ERROR); err != nil || soError != 0 {
+		syscall.Close(fd)
+		if err == nil {
+			err = syscall.Errno(soError)
+		}
+		return nil, fmt.Errorf("sctp connect to %s: %w", raddr, err)
+	}
+
+	file := os.NewFile(uintptr(fd), "sctp")
+	defer file.Close()
+	return net.FileConn(file)
+}
+
+// Listens for SCTP associations in the specified port of the addresses, or of all the local ones if
+// none is specified. The connections accepted are of type *net.TCPConn, with the primary address of
+// the peer as remote address
+func ListenSCTP(addresses []string, port int) (net.Listener, error) {
+	fd, err := sctpSocket(addresses, port)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("sctp listen: %w", err)
+	}
+
+	file := os.NewFile(uintptr(fd), "sctp")
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+// Creates a non blocking SCTP socket bound to the addresses and port, if specified
+func sctpSocket(addresses []string, port int) (int, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, syscall.IPPROTO_SCTP)
+	if err != nil {
+		return -1, fmt.Errorf("sctp socket: %w", err)
+	}
+
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("sctp socket: %w", err)
+	}
+
+	if len(addresses) > 0 || port != 0 {
+		laddr, err := sctpAddr(addresses, port)
+		if err != nil {
+			syscall.Close(fd)
+			return -1, err
+		}
+		if err := sctp.SCTPBind(fd, laddr, sctp.SCTP_BINDX_ADD_ADDR); err != nil {
+			syscall.Close(fd)
+			return -1, fmt.Errorf("sctp bind to %s: %w", laddr, err)
+		}
+	}
+
+	return fd, nil
+}
+
+// Builds the SCTP address with the IPv4 addresses, that may be specified as names
+func sctpAddr(addresses []string, port int) (*sctp.SCTPAddr, error) {
+	addr := sctp.SCTPAddr{Port: port}
+	for _, address := range addresses {
+		ipAddr, err := net.ResolveIPAddr("ip4", address)
+		if err != nil {
+			return nil, err
+		}
+		addr.IPAddrs = append(addr.IPAddrs, *ipAddr)
+	}
+	return &addr, nil
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package diampeer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+)
+
+var errSCTPUnsupported = fmt.Errorf("SCTP in %s: %w", runtime.GOOS, syscall.EPROTONOSUPPORT)
+
+func DialSCTP(ctx context.Context, localAddresses []string, remoteAddresses []string, port int) (net.Conn, error) {
+	return nil, errSCTPUnsupported
+}
+
+func ListenSCTP(addresses []string, port int) (net.Listener, error) {
+	return nil, errSCTPUnsupported
+}
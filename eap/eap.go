@@ -0,0 +1,117 @@
+package eap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"igor/radiuscodec"
+)
+
+// EAP codes (RFC 3748)
+const (
+	CODE_REQUEST  = 1
+	CODE_RESPONSE = 2
+	CODE_SUCCESS  = 3
+	CODE_FAILURE  = 4
+)
+
+// EAP types
+const (
+	TYPE_IDENTITY      = 1
+	TYPE_NOTIFICATION  = 2
+	TYPE_NAK           = 3
+	TYPE_MD5_CHALLENGE = 4
+	TYPE_TLS           = 13
+	TYPE_MSCHAPV2      = 26
+)
+
+// Maximum size of the value of an EAP-Message attribute. Longer EAP packets are split in several
+// attributes (RFC 3579, section 3.1)
+const MAX_EAP_MESSAGE_FRAGMENT = 253
+
+// EAP packet. Success and Failure packets have neither Type nor Data
+type EAPPacket struct {
+	Code       byte
+	Identifier byte
+	Type       byte
+	Data       []byte
+}
+
+// Parses the EAP packet
+func EAPPacketFromBytes(packetBytes []byte) (*EAPPacket, error) {
+	if len(packetBytes) < 4 {
+		return nil, fmt.Errorf("EAP packet too short: %d octets", len(packetBytes))
+	}
+	length := int(binary.BigEndian.Uint16(packetBytes[2:4]))
+	if length < 4 || length > len(packetBytes) {
+		return nil, fmt.Errorf("bad EAP packet length %d with %d octets", length, len(packetBytes))
+	}
+
+	packet := EAPPacket{Code: packetBytes[0], Identifier: packetBytes[1]}
+	switch packet.Code {
+	case CODE_REQUEST, CODE_RESPONSE:
+		if length < 5 {
+			return nil, fmt.Errorf("EAP request or response without type")
+		}
+		packet.Type = packetBytes[4]
+		packet.Data = append([]byte{}, packetBytes[5:length]...)
+	case CODE_SUCCESS, CODE_FAILURE:
+	default:
+		return nil, fmt.Errorf("unknown EAP code %d", packet.Code)
+	}
+
+	return &packet, nil
+}
+
+// Serializes the EAP packet
+func (p *EAPPacket) ToBytes() []byte {
+	length := 4
+	if p.Code == CODE_REQUEST || p.Code == CODE_RESPONSE {
+		length += 1 + len(p.Data)
+	}
+
+	packetBytes := make([]byte, 4, length)
+	packetBytes[0] = p.Code
+	packetBytes[1] = p.Identifier
+	binary.BigEndian.PutUint16(packetBytes[2:4], uint16(length))
+	if p.Code == CODE_REQUEST || p.Code == CODE_RESPONSE {
+		packetBytes = append(packetBytes, p.Type)
+		packetBytes = append(packetBytes, p.Data...)
+	}
+	return packetBytes
+}
+
+// Returns true if the radius packet carries an EAP-Message
+func IsEAP(rp *radiuscodec.RadiusPacket) bool {
+	return len(rp.GetAllAVP("EAP-Message")) > 0
+}
+
+// Reassembles the EAP packet from the EAP-Message attributes of the radius packet
+func EAPPacketFromRadius(rp *radiuscodec.RadiusPacket) (*EAPPacket, error) {
+	var packetBytes []byte
+	for _, avp := range rp.GetAllAVP("EAP-Message") {
+		packetBytes = append(packetBytes, avp.GetOctets()...)
+	}
+	if len(packetBytes) == 0 {
+		return nil, fmt.Errorf("no EAP-Message in radius packet")
+	}
+	return EAPPacketFromBytes(packetBytes)
+}
+
+// Adds the EAP packet to the radius packet, split in as many EAP-Message attributes as needed,
+// and the Message-Authenticator, which is mandatory in EAP
+func (p *EAPPacket) AddToRadius(rp *radiuscodec.RadiusPacket) *radiuscodec.RadiusPacket {
+	packetBytes := p.ToBytes()
+	for len(packetBytes) > 0 {
+		fragmentLen := len(packetBytes)
+		if fragmentLen > MAX_EAP_MESSAGE_FRAGMENT {
+			fragmentLen = MAX_EAP_MESSAGE_FRAGMENT
+		}
+		rp.Add("EAP-Message", packetBytes[:fragmentLen])
+		packetBytes = packetBytes[fragmentLen:]
+	}
+
+	// The value is calculated when the packet is serialized
+	rp.DeleteAllAVP("Message-Authenticator")
+	rp.Add("Message-Authenticator", make([]byte, 16))
+	return rp
+}
@@ -0,0 +1,187 @@
+package eap
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"igor/config"
+	"igor/core"
+	"igor/radiuscodec"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+
+	// Initialize the Config Object
+	config.InitPolicyConfigInstance("resources/searchRules.json", "testServer", true)
+
+	// Execute the tests and exit
+	os.Exit(m.Run())
+}
+
+var testPasswords = map[string]string{"User": "clientPass", "user@igor": "secretPassword"}
+
+func getTestPassword(userName string) (string, error) {
+	if password, found := testPasswords[userName]; found {
+		return password, nil
+	}
+	return "", errors.New("user not found")
+}
+
+// Builds an Access-Request with the EAP response and, if not nil, the State
+func eapRequest(response EAPPacket, state []byte) *radiuscodec.RadiusPacket {
+	request := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+	request.Add("User-Name", "user@igor")
+	if state != nil {
+		request.Add("State", state)
+	}
+	return response.AddToRadius(request)
+}
+
+// Returns the EAP request in the Access-Challenge and its State
+func parseChallenge(t *testing.T, response *radiuscodec.RadiusPacket) (*EAPPacket, []byte) {
+	t.Helper()
+	if response.Code != radiuscodec.ACCESS_CHALLENGE {
+		t.Fatalf("expected Access-Challenge but got code %d", response.Code)
+	}
+	eapPacket, err := EAPPacketFromRadius(response)
+	if err != nil {
+		t.Fatalf("bad EAP packet in challenge: %s", err)
+	}
+	state, err := response.GetAVP("State")
+	if err != nil {
+		t.Fatal("no State in challenge")
+	}
+	return eapPacket, state.GetOctets()
+}
+
+func TestFragmentation(t *testing.T) {
+	packet := EAPPacket{Code: CODE_REQUEST, Identifier: 7, Type: TYPE_TLS, Data: bytes.Repeat([]byte{0xAA}, 600)}
+	request := packet.AddToRadius(radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST))
+
+	fragments := request.GetAllAVP("EAP-Message")
+	if len(fragments) != 3 || len(fragments[0].GetOctets()) != MAX_EAP_MESSAGE_FRAGMENT {
+		t.Fatalf("bad fragmentation in %d attributes", len(fragments))
+	}
+
+	reassembled, err := EAPPacketFromRadius(request)
+	if err != nil {
+		t.Fatalf("could not reassemble: %s", err)
+	}
+	if reassembled.Identifier != 7 || reassembled.Type != TYPE_TLS || !bytes.Equal(reassembled.Data, packet.Data) {
+		t.Errorf("bad reassembled packet %v", reassembled)
+	}
+
+	if _, err := EAPPacketFromBytes([]byte{CODE_RESPONSE, 1, 0, 10, TYPE_IDENTITY}); err == nil {
+		t.Error("packet shorter than its length was parsed")
+	}
+}
+
+func TestEAPMD5(t *testing.T) {
+	server, _ := NewServer(getTestPassword, []byte{TYPE_MD5_CHALLENGE}, 0)
+
+	for _, password := range []string{"secretPassword", "badPassword"} {
+		response, err := server.HandleRequest(eapRequest(EAPPacket{Code: CODE_RESPONSE, Identifier: 1, Type: TYPE_IDENTITY, Data: []byte("user@igor")}, nil))
+		if err != nil {
+			t.Fatalf("identity response got error %s", err)
+		}
+		challenge, state := parseChallenge(t, response)
+		if challenge.Type != TYPE_MD5_CHALLENGE || challenge.Identifier != 2 || challenge.Data[0] != 16 {
+			t.Fatalf("bad MD5 challenge %v", challenge)
+		}
+
+		hasher := md5.New()
+		hasher.Write([]byte{challenge.Identifier})
+		hasher.Write([]byte(password))
+		hasher.Write(challenge.Data[1:17])
+		value := append([]byte{16}, hasher.Sum(nil)...)
+		response, err = server.HandleRequest(eapRequest(EAPPacket{Code: CODE_RESPONSE, Identifier: challenge.Identifier, Type: TYPE_MD5_CHALLENGE, Data: value}, state))
+		if err != nil {
+			t.Fatalf("challenge response got error %s", err)
+		}
+
+		result, _ := EAPPacketFromRadius(response)
+		if password == "secretPassword" {
+			if response.Code != radiuscodec.ACCESS_ACCEPT || result.Code != CODE_SUCCESS || response.GetStringAVP("User-Name") != "user@igor" {
+				t.Errorf("bad response to good password %s", response)
+			}
+		} else if response.Code != radiuscodec.ACCESS_REJECT || result.Code != CODE_FAILURE {
+			t.Errorf("bad response to bad password %s", response)
+		}
+	}
+
+	if server.Conversations() != 0 {
+		t.Errorf("finished conversations were not removed")
+	}
+
+	// Without Message-Authenticator the request is discarded
+	request := eapRequest(EAPPacket{Code: CODE_RESPONSE, Identifier: 1, Type: TYPE_IDENTITY, Data: []byte("user@igor")}, nil)
+	request.DeleteAllAVP("Message-Authenticator")
+	if _, err := server.HandleRequest(request); err == nil {
+		t.Error("request without Message-Authenticator was not discarded")
+	}
+
+	// Unknown State
+	response, _ := server.HandleRequest(eapRequest(EAPPacket{Code: CODE_RESPONSE, Identifier: 2, Type: TYPE_MD5_CHALLENGE, Data: make([]byte, 17)}, []byte("unknown")))
+	if response.Code != radiuscodec.ACCESS_REJECT {
+		t.Errorf("request with unknown State was not rejected")
+	}
+}
+
+func TestEAPMSCHAPv2(t *testing.T) {
+	server, _ := NewServer(getTestPassword, []byte{TYPE_MD5_CHALLENGE, TYPE_MSCHAPV2}, 0)
+	secret := "secret"
+
+	// The peer asks for MS-CHAPv2 instead of MD5
+	response, _ := server.HandleRequest(eapRequest(EAPPacket{Code: CODE_RESPONSE, Identifier: 1, Type: TYPE_IDENTITY, Data: []byte("User")}, nil))
+	challenge, state := parseChallenge(t, response)
+	response, _ = server.HandleRequest(eapRequest(EAPPacket{Code: CODE_RESPONSE, Identifier: challenge.Identifier, Type: TYPE_NAK, Data: []byte{TYPE_MSCHAPV2}}, state))
+	challenge, state = parseChallenge(t, response)
+	if challenge.Type != TYPE_MSCHAPV2 || challenge.Data[0] != MSCHAPV2_CHALLENGE || challenge.Data[4] != 16 {
+		t.Fatalf("bad MS-CHAPv2 challenge %v", challenge)
+	}
+	authenticatorChallenge := challenge.Data[5:21]
+
+	// Response as the peer
+	peerChallenge := []byte("0123456789ABCDEF")
+	passwordHash := core.NTPasswordHash("clientPass")
+	ntResponse := core.MSCHAPv2NTResponse(authenticatorChallenge, peerChallenge, "User", passwordHash)
+	expected, _ := core.VerifyMSCHAPv2(authenticatorChallenge, peerChallenge, ntResponse, "User", passwordHash)
+	value := append([]byte{mschapv2ResponseLen}, peerChallenge...)
+	value = append(value, make([]byte, 8)...)
+	value = append(value, ntResponse...)
+	value = append(value, 0)
+	value = append(value, []byte("DOMAIN\\User")...)
+	response, _ = server.HandleRequest(eapRequest(EAPPacket{Code: CODE_RESPONSE, Identifier: challenge.Identifier, Type: TYPE_MSCHAPV2, Data: mschapv2Packet(MSCHAPV2_RESPONSE, challenge.Data[1], value)}, state))
+	success, state := parseChallenge(t, response)
+	if success.Data[0] != MSCHAPV2_SUCCESS || !strings.HasPrefix(string(success.Data[4:]), expected.AuthenticatorResponse) {
+		t.Fatalf("bad MS-CHAPv2 success %s", success.Data[4:])
+	}
+
+	// Acknowledge the success
+	request := eapRequest(EAPPacket{Code: CODE_RESPONSE, Identifier: success.Identifier, Type: TYPE_MSCHAPV2, Data: []byte{MSCHAPV2_SUCCESS}}, state)
+	response, _ = server.HandleRequest(request)
+	if response.Code != radiuscodec.ACCESS_ACCEPT {
+		t.Fatalf("MS-CHAPv2 authentication not accepted %s", response)
+	}
+
+	// Serialize and check the Message-Authenticator and the keys, which are encrypted with the request authenticator
+	request.ToBytes(secret, 1)
+	response.Authenticator = request.Authenticator
+	responseBytes, err := response.ToBytes(secret, 1)
+	if err != nil {
+		t.Fatalf("could not serialize response %s", err)
+	}
+	if !radiuscodec.ValidateResponseMessageAuthenticator(responseBytes, request.Authenticator, secret) {
+		t.Error("bad Message-Authenticator in response")
+	}
+	copy(responseBytes[4:20], request.Authenticator[:])
+	decoded, _ := radiuscodec.RadiusPacketFromBytes(responseBytes, secret)
+	recvKey, _ := decoded.GetAVP("Microsoft-MPPE-Recv-Key")
+	sendKey, _ := decoded.GetAVP("Microsoft-MPPE-Send-Key")
+	if !bytes.Equal(recvKey.GetOctets()[:17], append([]byte{16}, expected.RecvKey...)) || !bytes.Equal(sendKey.GetOctets()[:17], append([]byte{16}, expected.SendKey...)) {
+		t.Errorf("bad MPPE keys %x %x", recvKey.GetOctets(), sendKey.GetOctets())
+	}
+}
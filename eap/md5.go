@@ -0,0 +1,47 @@
+package eap
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"fmt"
+	"igor/random"
+)
+
+// EAP-MD5 (RFC 3748, section 5.4). Does not generate keys, so it is not suitable for wireless access
+
+type md5Method struct {
+	challenge [16]byte
+
+	// Identifier of the request with the challenge
+	identifier byte
+}
+
+func (m *md5Method) start(c *conversation) []byte {
+	random.Read(m.challenge[:])
+	m.identifier = c.identifier
+	return append([]byte{byte(len(m.challenge))}, m.challenge[:]...)
+}
+
+func (m *md5Method) process(c *conversation, data []byte, getPassword PasswordFunc) ([]byte, int, error) {
+	if len(data) < 1 || int(data[0]) != md5.Size || len(data) < 1+md5.Size {
+		return nil, resultFailure, fmt.Errorf("bad EAP-MD5 response")
+	}
+
+	password, err := getPassword(c.identity)
+	if err != nil {
+		return nil, resultFailure, err
+	}
+
+	hasher := md5.New()
+	hasher.Write([]byte{m.identifier})
+	hasher.Write([]byte(password))
+	hasher.Write(m.challenge[:])
+	if subtle.ConstantTimeCompare(hasher.Sum(nil), data[1:1+md5.Size]) != 1 {
+		return nil, resultFailure, fmt.Errorf("bad EAP-MD5 password")
+	}
+	return nil, resultSuccess, nil
+}
+
+func (m *md5Method) keyMaterial() []byte {
+	return nil
+}
@@ -0,0 +1,104 @@
+package eap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"igor/core"
+	"igor/random"
+)
+
+// EAP-MSCHAPv2 (draft-kamath-pppext-eap-mschapv2). The MS-CHAPv2 algorithms are in core
+
+// MS-CHAPv2 opcodes
+const (
+	MSCHAPV2_CHALLENGE = 1
+	MSCHAPV2_RESPONSE  = 2
+	MSCHAPV2_SUCCESS   = 3
+	MSCHAPV2_FAILURE   = 4
+)
+
+// Name sent in the challenges
+const MSCHAPV2_SERVER_NAME = "igor"
+
+// Size of the Response field: peer challenge, reserved, NT-Response and flags
+const mschapv2ResponseLen = 16 + 8 + 24 + 1
+
+// Stages of the MS-CHAPv2 conversation
+const (
+	mschapv2ChallengeSent = iota
+	mschapv2SuccessSent
+	mschapv2FailureSent
+)
+
+type mschapv2Method struct {
+	stage                  int
+	msID                   byte
+	authenticatorChallenge [16]byte
+	msk                    []byte
+}
+
+func (m *mschapv2Method) start(c *conversation) []byte {
+	random.Read(m.authenticatorChallenge[:])
+	m.msID = c.identifier
+	m.stage = mschapv2ChallengeSent
+
+	value := append([]byte{16}, m.authenticatorChallenge[:]...)
+	return mschapv2Packet(MSCHAPV2_CHALLENGE, m.msID, append(value, []byte(MSCHAPV2_SERVER_NAME)...))
+}
+
+func (m *mschapv2Method) process(c *conversation, data []byte, getPassword PasswordFunc) ([]byte, int, error) {
+	if len(data) < 1 {
+		return nil, resultFailure, fmt.Errorf("empty MS-CHAPv2 packet")
+	}
+
+	switch {
+	case m.stage == mschapv2ChallengeSent && data[0] == MSCHAPV2_RESPONSE:
+		if len(data) < 5+mschapv2ResponseLen || data[4] != mschapv2ResponseLen {
+			return nil, resultFailure, fmt.Errorf("bad MS-CHAPv2 response")
+		}
+		response := data[5 : 5+mschapv2ResponseLen]
+		peerChallenge := response[0:16]
+		ntResponse := response[24:48]
+
+		password, err := getPassword(c.identity)
+		if err != nil {
+			return nil, resultFailure, err
+		}
+		result, ok := core.VerifyMSCHAPv2(m.authenticatorChallenge[:], peerChallenge, ntResponse, string(data[5+mschapv2ResponseLen:]), core.NTPasswordHash(password))
+		if !ok {
+			m.stage = mschapv2FailureSent
+			var newChallenge [16]byte
+			random.Read(newChallenge[:])
+			message := fmt.Sprintf("E=691 R=0 C=%X V=3 M=Authentication failed", newChallenge)
+			return mschapv2Packet(MSCHAPV2_FAILURE, m.msID, []byte(message)), resultContinue, nil
+		}
+
+		// The MSK holds the receive key of the server followed by the send key
+		m.stage = mschapv2SuccessSent
+		m.msk = append(result.RecvKey, result.SendKey...)
+		message := result.AuthenticatorResponse + " M=Authentication succeeded"
+		return mschapv2Packet(MSCHAPV2_SUCCESS, m.msID, []byte(message)), resultContinue, nil
+
+	case m.stage == mschapv2SuccessSent && data[0] == MSCHAPV2_SUCCESS:
+		return nil, resultSuccess, nil
+
+	case m.stage == mschapv2FailureSent && data[0] == MSCHAPV2_FAILURE:
+		return nil, resultFailure, fmt.Errorf("bad MS-CHAPv2 password")
+
+	default:
+		return nil, resultFailure, fmt.Errorf("unexpected MS-CHAPv2 opcode %d", data[0])
+	}
+}
+
+func (m *mschapv2Method) keyMaterial() []byte {
+	return m.msk
+}
+
+// Builds the MS-CHAPv2 packet, with the MS-Length covering from the opcode
+func mschapv2Packet(opCode byte, msID byte, value []byte) []byte {
+	packet := make([]byte, 4, 4+len(value))
+	packet[0] = opCode
+	packet[1] = msID
+	binary.BigEndian.PutUint16(packet[2:4], uint16(4+len(value)))
+	return append(packet, value...)
+}
@@ -0,0 +1,296 @@
+package eap
+
+import (
+	"fmt"
+	"igor/config"
+	"igor/radiuscodec"
+	"igor/random"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server side of the EAP conversations carried in radius Access-Requests (RFC 3579). Radius handlers
+// pass to HandleRequest the requests that carry EAP-Message attributes, and get the Access-Challenge,
+// Access-Accept or Access-Reject to send back. The state of each conversation is kept in memory,
+// keyed by the State attribute sent in the Access-Challenges
+
+// Default time to wait for the next request of a conversation
+const DEFAULT_CONVERSATION_TIMEOUT_SECONDS = 30
+
+// Returns the password of the user, or an error if the user is not found
+type PasswordFunc func(userName string) (string, error)
+
+// Results of processing a response with a method
+const (
+	resultContinue = iota
+	resultSuccess
+	resultFailure
+)
+
+// EAP authentication method. Each conversation uses its own instance, which keeps the state
+type method interface {
+	// Returns the data of the first request
+	start(c *conversation) []byte
+
+	// Processes the data of a response. If the result is resultContinue, returns the data of the next request
+	process(c *conversation, data []byte, getPassword PasswordFunc) ([]byte, int, error)
+
+	// Returns the MSK after success, or nil if the method does not generate keys
+	keyMaterial() []byte
+}
+
+// Creates an instance of the method, or returns nil if not supported
+func newMethod(eapType byte) method {
+	switch eapType {
+	case TYPE_MD5_CHALLENGE:
+		return &md5Method{}
+	case TYPE_MSCHAPV2:
+		return &mschapv2Method{}
+	default:
+		return nil
+	}
+}
+
+// State of an EAP conversation
+type conversation struct {
+	mutex sync.Mutex
+
+	// As reported in the Identity response
+	identity string
+
+	// Identifier of the last request sent
+	identifier byte
+
+	methodType byte
+	method     method
+
+	// The conversation is discarded after this time, in unix nanoseconds. Updated atomically
+	expiration int64
+}
+
+// Extends the life of the conversation
+func (c *conversation) touch(timeout time.Duration) {
+	atomic.StoreInt64(&c.expiration, time.Now().Add(timeout).UnixNano())
+}
+
+func (c *conversation) isExpired(now time.Time) bool {
+	return now.UnixNano() > atomic.LoadInt64(&c.expiration)
+}
+
+type Server struct {
+	getPassword PasswordFunc
+
+	// Methods to propose, in order of preference
+	methods []byte
+
+	timeout time.Duration
+
+	// Conversations in progress, by State
+	mutex         sync.Mutex
+	conversations map[string]*conversation
+	lastSweep     time.Time
+}
+
+// Creates an EAP server that proposes the specified methods in order of preference. The peer may
+// ask for another one of them with a Nak. If the timeout is zero, the default one is used
+func NewServer(getPassword PasswordFunc, methods []byte, timeout time.Duration) (*Server, error) {
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("no EAP methods specified")
+	}
+	for _, eapType := range methods {
+		if newMethod(eapType) == nil {
+			return nil, fmt.Errorf("EAP method %d not supported", eapType)
+		}
+	}
+	if timeout == 0 {
+		timeout = DEFAULT_CONVERSATION_TIMEOUT_SECONDS * time.Second
+	}
+
+	return &Server{
+		getPassword:   getPassword,
+		methods:       methods,
+		timeout:       timeout,
+		conversations: make(map[string]*conversation),
+		lastSweep:     time.Now(),
+	}, nil
+}
+
+// Processes the EAP-Message in the Access-Request and returns the radius response. An error is returned
+// if the request is to be silently discarded, as specified in RFC 3579
+func (s *Server) HandleRequest(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+	eapPacket, err := EAPPacketFromRadius(request)
+	if err != nil {
+		return nil, err
+	}
+	if eapPacket.Code != CODE_RESPONSE {
+		return nil, fmt.Errorf("received EAP packet with code %d", eapPacket.Code)
+	}
+	if _, err := request.GetAVP("Message-Authenticator"); err != nil {
+		return nil, fmt.Errorf("EAP-Message without Message-Authenticator")
+	}
+
+	// New conversation
+	stateAVP, err := request.GetAVP("State")
+	if err != nil {
+		if eapPacket.Type != TYPE_IDENTITY {
+			config.GetLogger().Debugf("EAP conversation not started with identity but type %d", eapPacket.Type)
+			return s.reject(request, eapPacket.Identifier), nil
+		}
+		c := &conversation{identity: string(eapPacket.Data), identifier: eapPacket.Identifier}
+		state := s.newConversation(c)
+		return s.startMethod(request, state, c, s.methods[0]), nil
+	}
+
+	// Ongoing conversation
+	state := string(stateAVP.GetOctets())
+	c := s.getConversation(state)
+	if c == nil {
+		config.GetLogger().Debugf("EAP conversation not found")
+		return s.reject(request, eapPacket.Identifier), nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if eapPacket.Identifier != c.identifier {
+		return nil, fmt.Errorf("EAP identifier %d does not match the request %d", eapPacket.Identifier, c.identifier)
+	}
+
+	switch eapPacket.Type {
+	case TYPE_NAK:
+		// The peer proposes other methods. Use the first one that we also support
+		for _, eapType := range eapPacket.Data {
+			for _, supportedType := range s.methods {
+				if eapType == supportedType && eapType != c.methodType {
+					return s.startMethod(request, state, c, eapType), nil
+				}
+			}
+		}
+		config.GetLogger().Debugf("EAP methods %v proposed by %s not supported", eapPacket.Data, c.identity)
+		s.deleteConversation(state)
+		return s.reject(request, eapPacket.Identifier), nil
+
+	case c.methodType:
+		data, result, err := c.method.process(c, eapPacket.Data, s.getPassword)
+		switch result {
+		case resultContinue:
+			return s.challenge(request, state, c, data), nil
+		case resultSuccess:
+			s.deleteConversation(state)
+			return s.accept(request, eapPacket.Identifier, c), nil
+		default:
+			config.GetLogger().Debugf("EAP authentication of %s failed: %v", c.identity, err)
+			s.deleteConversation(state)
+			return s.reject(request, eapPacket.Identifier), nil
+		}
+
+	default:
+		config.GetLogger().Debugf("unexpected EAP type %d from %s", eapPacket.Type, c.identity)
+		s.deleteConversation(state)
+		return s.reject(request, eapPacket.Identifier), nil
+	}
+}
+
+// Starts the specified method in the conversation and returns the Access-Challenge with its first request
+func (s *Server) startMethod(request *radiuscodec.RadiusPacket, state string, c *conversation, eapType byte) *radiuscodec.RadiusPacket {
+	c.methodType = eapType
+	c.method = newMethod(eapType)
+	c.identifier++
+	return s.accessChallenge(request, state, c, c.method.start(c))
+}
+
+// Returns the Access-Challenge with the next request of the method
+func (s *Server) challenge(request *radiuscodec.RadiusPacket, state string, c *conversation, data []byte) *radiuscodec.RadiusPacket {
+	c.identifier++
+	return s.accessChallenge(request, state, c, data)
+}
+
+// Builds the Access-Challenge with the EAP request, using the current identifier of the conversation
+func (s *Server) accessChallenge(request *radiuscodec.RadiusPacket, state string, c *conversation, data []byte) *radiuscodec.RadiusPacket {
+	c.touch(s.timeout)
+
+	response := radiuscodec.NewRadiusResponse(request, true)
+	response.Code = radiuscodec.ACCESS_CHALLENGE
+	response.Add("State", []byte(state))
+	eapRequest := EAPPacket{Code: CODE_REQUEST, Identifier: c.identifier, Type: c.methodType, Data: data}
+	return eapRequest.AddToRadius(response)
+}
+
+// Returns the Access-Accept with the EAP-Success and, if the method generated them, the MPPE keys
+func (s *Server) accept(request *radiuscodec.RadiusPacket, identifier byte, c *conversation) *radiuscodec.RadiusPacket {
+	response := radiuscodec.NewRadiusResponse(request, true)
+	response.Add("User-Name", c.identity)
+
+	// The MSK holds the receive key of the server followed by the send key (RFC 2548, RFC 3079)
+	if msk := c.method.keyMaterial(); len(msk) > 0 {
+		keyLen := len(msk) / 2
+		response.Add("Microsoft-MPPE-Recv-Key", append([]byte{byte(keyLen)}, msk[:keyLen]...))
+		response.Add("Microsoft-MPPE-Send-Key", append([]byte{byte(keyLen)}, msk[keyLen:]...))
+	}
+
+	eapSuccess := EAPPacket{Code: CODE_SUCCESS, Identifier: identifier}
+	return eapSuccess.AddToRadius(response)
+}
+
+// Returns the Access-Reject with the EAP-Failure
+func (s *Server) reject(request *radiuscodec.RadiusPacket, identifier byte) *radiuscodec.RadiusPacket {
+	response := radiuscodec.NewRadiusResponse(request, false)
+	eapFailure := EAPPacket{Code: CODE_FAILURE, Identifier: identifier}
+	return eapFailure.AddToRadius(response)
+}
+
+// Stores the conversation and returns the State to use for it. The expired conversations are
+// removed from time to time
+func (s *Server) newConversation(c *conversation) string {
+	var stateBytes [16]byte
+	random.Read(stateBytes[:])
+	state := string(stateBytes[:])
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) > s.timeout {
+		for st, existing := range s.conversations {
+			if existing.isExpired(now) {
+				delete(s.conversations, st)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	c.touch(s.timeout)
+	s.conversations[state] = c
+	return state
+}
+
+// Returns the conversation with the specified State, or nil if not found or expired
+func (s *Server) getConversation(state string) *conversation {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c, found := s.conversations[state]
+	if !found {
+		return nil
+	}
+
+	if c.isExpired(time.Now()) {
+		delete(s.conversations, state)
+		return nil
+	}
+	return c
+}
+
+func (s *Server) deleteConversation(state string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.conversations, state)
+}
+
+// Returns the number of conversations in progress
+func (s *Server) Conversations() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.conversations)
+}
@@ -0,0 +1,498 @@
+package grpchandler
+
+import (
+	"fmt"
+	"igor/diamcodec"
+	"igor/diamdict"
+	"igor/radiuscodec"
+	"igor/radiusdict"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The messages of the service, as defined in igor.proto, are serialized directly from and to the
+// diameter and radius objects, without intermediate generated types. The encoding is the protobuf
+// one, so that the handlers may be generated from igor.proto in any language
+
+// Field numbers of the Avp message
+const (
+	avpName        = 1
+	avpStringValue = 2
+	avpIntValue    = 3
+	avpUintValue   = 4
+	avpFloatValue  = 5
+	avpGroup       = 6
+)
+
+// Field numbers of the DiameterMessage message
+const (
+	dmIsRequest        = 1
+	dmIsProxyable      = 2
+	dmIsError          = 3
+	dmIsRetransmission = 4
+	dmCommandCode      = 5
+	dmApplicationId    = 6
+	dmE2EId            = 7
+	dmHopByHopId       = 8
+	dmCommandName      = 9
+	dmApplicationName  = 10
+	dmAVPs             = 11
+)
+
+// Field numbers of the RadiusPacket message
+const (
+	rpCode          = 1
+	rpIdentifier    = 2
+	rpAuthenticator = 3
+	rpAVPs          = 4
+)
+
+// Field numbers of the requests and answers, for both the structured and raw variants
+const (
+	envelopeMessage = 1
+	envelopeRaw     = 2
+)
+
+// DiameterRequest or DiameterAnswer
+type diameterEnvelope struct {
+	Message *diamcodec.DiameterMessage
+
+	// Whether the message is sent as the bytes in the wire
+	Raw bool
+}
+
+// RadiusRequest or RadiusResponse
+type radiusEnvelope struct {
+	Packet *radiuscodec.RadiusPacket
+
+	// Whether the packet is sent as the bytes in the wire
+	Raw bool
+}
+
+// gRPC codec for the messages of the service. Named as the default protobuf one, so that the
+// content type is that expected by the handlers
+type codec struct{}
+
+func (codec) Name() string {
+	return "proto"
+}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	switch e := v.(type) {
+	case *diameterEnvelope:
+		return e.marshal()
+	case *radiusEnvelope:
+		return e.marshal()
+	default:
+		return nil, fmt.Errorf("unsupported message type %T", v)
+	}
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	switch e := v.(type) {
+	case *diameterEnvelope:
+		return e.unmarshal(data)
+	case *radiusEnvelope:
+		return e.unmarshal(data)
+	default:
+		return fmt.Errorf("unsupported message type %T", v)
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Diameter
+///////////////////////////////////////////////////////////////////////////////
+
+func (e *diameterEnvelope) marshal() ([]byte, error) {
+	if e.Message == nil {
+		return nil, fmt.Errorf("no diameter message to marshal")
+	}
+	if e.Raw {
+		raw, err := e.Message.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		b := protowire.AppendTag(nil, envelopeRaw, protowire.BytesType)
+		return protowire.AppendBytes(b, raw), nil
+	}
+
+	b := protowire.AppendTag(nil, envelopeMessage, protowire.BytesType)
+	return protowire.AppendBytes(b, appendDiameterMessage(nil, e.Message)), nil
+}
+
+func (e *diameterEnvelope) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if typ != protowire.BytesType || (num != envelopeMessage && num != envelopeRaw) {
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+		if num == envelopeRaw {
+			message, _, err := diamcodec.DiameterMessageFromBytes(v)
+			if err != nil {
+				return 0, err
+			}
+			e.Message, e.Raw = &message, true
+			return n, nil
+		}
+		message, err := consumeDiameterMessage(v)
+		if err != nil {
+			return 0, err
+		}
+		e.Message, e.Raw = message, false
+		return n, nil
+	})
+}
+
+func appendDiameterMessage(b []byte, m *diamcodec.DiameterMessage) []byte {
+	b = appendBool(b, dmIsRequest, m.IsRequest)
+	b = appendBool(b, dmIsProxyable, m.IsProxyable)
+	b = appendBool(b, dmIsError, m.IsError)
+	b = appendBool(b, dmIsRetransmission, m.IsRetransmission)
+	b = appendUint(b, dmCommandCode, uint64(m.CommandCode))
+	b = appendUint(b, dmApplicationId, uint64(m.ApplicationId))
+	b = appendUint(b, dmE2EId, uint64(m.E2EId))
+	b = appendUint(b, dmHopByHopId, uint64(m.HopByHopId))
+	b = appendString(b, dmCommandName, m.CommandName)
+	b = appendString(b, dmApplicationName, m.ApplicationName)
+	for i := range m.AVPs {
+		b = protowire.AppendTag(b, dmAVPs, protowire.BytesType)
+		b = protowire.AppendBytes(b, appendDiameterAVP(nil, &m.AVPs[i]))
+	}
+	return b
+}
+
+func consumeDiameterMessage(b []byte) (*diamcodec.DiameterMessage, error) {
+	var m diamcodec.DiameterMessage
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case typ == protowire.VarintType && num >= dmIsRequest && num <= dmHopByHopId:
+			v, n := protowire.ConsumeVarint(b)
+			switch num {
+			case dmIsRequest:
+				m.IsRequest = v != 0
+			case dmIsProxyable:
+				m.IsProxyable = v != 0
+			case dmIsError:
+				m.IsError = v != 0
+			case dmIsRetransmission:
+				m.IsRetransmission = v != 0
+			case dmCommandCode:
+				m.CommandCode = uint32(v)
+			case dmApplicationId:
+				m.ApplicationId = uint32(v)
+			case dmE2EId:
+				m.E2EId = uint32(v)
+			case dmHopByHopId:
+				m.HopByHopId = uint32(v)
+			}
+			return n, nil
+
+		case typ == protowire.BytesType && (num == dmCommandName || num == dmApplicationName):
+			v, n := protowire.ConsumeString(b)
+			if num == dmCommandName {
+				m.CommandName = v
+			} else {
+				m.ApplicationName = v
+			}
+			return n, nil
+
+		case typ == protowire.BytesType && num == dmAVPs:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			avp, err := consumeDiameterAVP(v)
+			if err != nil {
+				return 0, err
+			}
+			m.AVPs = append(m.AVPs, *avp)
+			return n, nil
+
+		default:
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+	})
+	return &m, err
+}
+
+// The type of the value is taken from the dictionary, as in the JSON representation
+func appendDiameterAVP(b []byte, avp *diamcodec.DiameterAVP) []byte {
+	b = appendString(b, avpName, avp.Name)
+
+	switch avp.DictItem.DiameterType {
+	case diamdict.Integer32, diamdict.Integer64, diamdict.Unsigned32:
+		b = protowire.AppendTag(b, avpIntValue, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeZigZag(avp.GetInt()))
+	case diamdict.Unsigned64:
+		b = protowire.AppendTag(b, avpUintValue, protowire.VarintType)
+		b = protowire.AppendVarint(b, avp.GetUint())
+	case diamdict.Float32, diamdict.Float64:
+		b = protowire.AppendTag(b, avpFloatValue, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(avp.GetFloat()))
+	case diamdict.Grouped:
+		var group []byte
+		groupedAVPs, _ := avp.Value.([]diamcodec.DiameterAVP)
+		for i := range groupedAVPs {
+			group = protowire.AppendTag(group, 1, protowire.BytesType)
+			group = protowire.AppendBytes(group, appendDiameterAVP(nil, &groupedAVPs[i]))
+		}
+		b = protowire.AppendTag(b, avpGroup, protowire.BytesType)
+		b = protowire.AppendBytes(b, group)
+	default:
+		b = protowire.AppendTag(b, avpStringValue, protowire.BytesType)
+		b = protowire.AppendString(b, avp.GetString())
+	}
+	return b
+}
+
+func consumeDiameterAVP(b []byte) (*diamcodec.DiameterAVP, error) {
+	var name string
+	var value interface{}
+	var group []diamcodec.DiameterAVP
+	var isGroup bool
+
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == avpGroup && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			isGroup = true
+			return n, consumeFields(v, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+				if num != 1 || typ != protowire.BytesType {
+					return protowire.ConsumeFieldValue(num, typ, b), nil
+				}
+				v, n := protowire.ConsumeBytes(b)
+				if n < 0 {
+					return n, nil
+				}
+				avp, err := consumeDiameterAVP(v)
+				if err != nil {
+					return 0, err
+				}
+				group = append(group, *avp)
+				return n, nil
+			})
+		default:
+			var n int
+			name, value, n = consumeAVPField(name, value, num, typ, b)
+			return n, nil
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if isGroup {
+		avp, err := diamcodec.NewAVP(name, nil)
+		if err != nil {
+			return nil, err
+		}
+		for i := range group {
+			avp.AddAVP(group[i])
+		}
+		return avp, nil
+	}
+	return diamcodec.NewAVP(name, value)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Radius
+///////////////////////////////////////////////////////////////////////////////
+
+func (e *radiusEnvelope) marshal() ([]byte, error) {
+	if e.Packet == nil {
+		return nil, fmt.Errorf("no radius packet to marshal")
+	}
+	if e.Raw {
+		// Serialization regenerates the authenticator of some requests, so a copy is used
+		raw, err := e.Packet.Copy().ToBytes("", e.Packet.Identifier)
+		if err != nil {
+			return nil, err
+		}
+		b := protowire.AppendTag(nil, envelopeRaw, protowire.BytesType)
+		return protowire.AppendBytes(b, raw), nil
+	}
+
+	b := protowire.AppendTag(nil, envelopeMessage, protowire.BytesType)
+	return protowire.AppendBytes(b, appendRadiusPacket(nil, e.Packet)), nil
+}
+
+func (e *radiusEnvelope) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if typ != protowire.BytesType || (num != envelopeMessage && num != envelopeRaw) {
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+		if num == envelopeRaw {
+			packet, err := radiuscodec.RadiusPacketFromBytes(v, "")
+			if err != nil {
+				return 0, err
+			}
+			e.Packet, e.Raw = packet, true
+			return n, nil
+		}
+		packet, err := consumeRadiusPacket(v)
+		if err != nil {
+			return 0, err
+		}
+		e.Packet, e.Raw = packet, false
+		return n, nil
+	})
+}
+
+func appendRadiusPacket(b []byte, p *radiuscodec.RadiusPacket) []byte {
+	b = appendUint(b, rpCode, uint64(p.Code))
+	b = appendUint(b, rpIdentifier, uint64(p.Identifier))
+	b = protowire.AppendTag(b, rpAuthenticator, protowire.BytesType)
+	b = protowire.AppendBytes(b, p.Authenticator[:])
+	for i := range p.AVPs {
+		b = protowire.AppendTag(b, rpAVPs, protowire.BytesType)
+		b = protowire.AppendBytes(b, appendRadiusAVP(nil, &p.AVPs[i]))
+	}
+	return b
+}
+
+func consumeRadiusPacket(b []byte) (*radiuscodec.RadiusPacket, error) {
+	var p radiuscodec.RadiusPacket
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case typ == protowire.VarintType && (num == rpCode || num == rpIdentifier):
+			v, n := protowire.ConsumeVarint(b)
+			if num == rpCode {
+				p.Code = byte(v)
+			} else {
+				p.Identifier = byte(v)
+			}
+			return n, nil
+
+		case typ == protowire.BytesType && num == rpAuthenticator:
+			v, n := protowire.ConsumeBytes(b)
+			copy(p.Authenticator[:], v)
+			return n, nil
+
+		case typ == protowire.BytesType && num == rpAVPs:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			var name string
+			var value interface{}
+			if err := consumeFields(v, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+				var n int
+				name, value, n = consumeAVPField(name, value, num, typ, b)
+				return n, nil
+			}); err != nil {
+				return 0, err
+			}
+			avp, err := radiuscodec.NewAVP(name, value)
+			if err != nil {
+				return 0, err
+			}
+			p.AVPs = append(p.AVPs, *avp)
+			return n, nil
+
+		default:
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+	})
+	return &p, err
+}
+
+// The type of the value is taken from the dictionary, as in the JSON representation
+func appendRadiusAVP(b []byte, avp *radiuscodec.RadiusAVP) []byte {
+	b = appendString(b, avpName, avp.Name)
+
+	switch avp.DictItem.RadiusType {
+	case radiusdict.Integer, radiusdict.Integer64:
+		b = protowire.AppendTag(b, avpIntValue, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeZigZag(avp.GetInt()))
+	default:
+		b = protowire.AppendTag(b, avpStringValue, protowire.BytesType)
+		b = protowire.AppendString(b, avp.GetTaggedString())
+	}
+	return b
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Helpers
+///////////////////////////////////////////////////////////////////////////////
+
+// Iterates through the fields of the message, invoking the function for each one. The function
+// receives the bytes after the tag and returns the length of the value consumed, negative if error
+func consumeFields(b []byte, consumeField func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		n, err := consumeField(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// Consumes the name or the scalar value of an Avp, returning them updated
+func consumeAVPField(name string, value interface{}, num protowire.Number, typ protowire.Type, b []byte) (string, interface{}, int) {
+	switch {
+	case num == avpName && typ == protowire.BytesType:
+		v, n := protowire.ConsumeString(b)
+		return v, value, n
+	case num == avpStringValue && typ == protowire.BytesType:
+		v, n := protowire.ConsumeString(b)
+		return name, v, n
+	case num == avpIntValue && typ == protowire.VarintType:
+		v, n := protowire.ConsumeVarint(b)
+		return name, protowire.DecodeZigZag(v), n
+	case num == avpUintValue && typ == protowire.VarintType:
+		v, n := protowire.ConsumeVarint(b)
+		return name, v, n
+	case num == avpFloatValue && typ == protowire.Fixed64Type:
+		v, n := protowire.ConsumeFixed64(b)
+		return name, math.Float64frombits(v), n
+	default:
+		return name, value, protowire.ConsumeFieldValue(num, typ, b)
+	}
+}
+
+// Scalar fields with the default value are not written, as in proto3
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, 1)
+}
+
+func appendUint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
@@ -0,0 +1,208 @@
+package grpchandler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"igor/config"
+	"igor/core"
+	"igor/diamcodec"
+	"igor/httphandler"
+	"igor/instrumentation"
+	"igor/radiuscodec"
+	"igor/telemetry"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Schemes of the URLs of the gRPC handlers, such as grpc://localhost:9090, which may be used in the
+// configuration instead of the https URLs. With grpcs, TLS is used. The encoding=raw parameter,
+// as in grpc://localhost:9090?encoding=raw, specifies that the messages are sent as the bytes in the wire
+const (
+	GRPC_SCHEME  = "grpc"
+	GRPCS_SCHEME = "grpcs"
+)
+
+// Returns true if the URL of the handler specifies the gRPC transport
+func IsGrpcEndpoint(endpoint string) bool {
+	return strings.HasPrefix(endpoint, GRPC_SCHEME+"://") || strings.HasPrefix(endpoint, GRPCS_SCHEME+"://")
+}
+
+// Keeps the connections to the gRPC handlers, which are created when first used
+type GrpcClient struct {
+	// Credentials presented to the handlers
+	conf config.HttpHandlerClientConfig
+
+	// Configuration instance, to label the metrics
+	instanceName string
+
+	sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+// Creates a client for the gRPC handlers of the specified configuration instance, presenting the
+// credentials specified
+func NewGrpcClient(instanceName string, conf config.HttpHandlerClientConfig) *GrpcClient {
+	return &GrpcClient{conf: conf, instanceName: instanceName, conns: make(map[string]*grpc.ClientConn)}
+}
+
+// Closes the connections to the handlers
+func (c *GrpcClient) Close() {
+	c.Lock()
+	defer c.Unlock()
+	for target, conn := range c.conns {
+		conn.Close()
+		delete(c.conns, target)
+	}
+}
+
+// Sends the request to the handler and returns the answer. The request is abandoned when the context is done,
+// and its deadline and trace identifier are propagated to the handler. Errors returned are of type
+// *httphandler.HttpHandlerError, as in the http transport
+func (c *GrpcClient) DiameterRequest(ctx context.Context, endpoint string, diameterRequest *diamcodec.DiameterMessage) (answer *diamcodec.DiameterMessage, err error) {
+	ctx, span := telemetry.StartClientSpan(ctx, "grpc handler "+diameterRequest.CommandName, attribute.String("rpc.url", endpoint))
+	defer func() { telemetry.EndSpan(span, err) }()
+
+	conn, raw, err := c.getConn(endpoint)
+	if err != nil {
+		return nil, httphandler.NewHttpHandlerError(c.instanceName, endpoint, httphandler.SERIALIZATION_ERROR, false, err)
+	}
+
+	var response diameterEnvelope
+	if err := conn.Invoke(c.outgoingContext(ctx), HANDLE_DIAMETER_METHOD, &diameterEnvelope{Message: diameterRequest, Raw: raw}, &response, grpc.ForceCodec(codec{})); err != nil {
+		return nil, c.newHandlerError(ctx, endpoint, err)
+	}
+
+	instrumentation.PushHttpClientExchange(c.instanceName, endpoint, httphandler.SUCCESS, "")
+	return response.Message, nil
+}
+
+// Sends the request to the handler and returns the response, with the same semantics as DiameterRequest
+func (c *GrpcClient) RadiusRequest(ctx context.Context, endpoint string, radiusRequest *radiuscodec.RadiusPacket) (response *radiuscodec.RadiusPacket, err error) {
+	ctx, span := telemetry.StartClientSpan(ctx, fmt.Sprintf("grpc handler radius code %d", radiusRequest.Code), attribute.String("rpc.url", endpoint))
+	defer func() { telemetry.EndSpan(span, err) }()
+
+	conn, raw, err := c.getConn(endpoint)
+	if err != nil {
+		return nil, httphandler.NewHttpHandlerError(c.instanceName, endpoint, httphandler.SERIALIZATION_ERROR, false, err)
+	}
+
+	var answer radiusEnvelope
+	if err := conn.Invoke(c.outgoingContext(ctx), HANDLE_RADIUS_METHOD, &radiusEnvelope{Packet: radiusRequest, Raw: raw}, &answer, grpc.ForceCodec(codec{})); err != nil {
+		return nil, c.newHandlerError(ctx, endpoint, err)
+	}
+
+	// The raw packets do not keep the identifier and authenticator of the request
+	if raw {
+		answer.Packet.Identifier = radiusRequest.Identifier
+		answer.Packet.Authenticator = radiusRequest.Authenticator
+	}
+
+	instrumentation.PushHttpClientExchange(c.instanceName, endpoint, httphandler.SUCCESS, "")
+	return answer.Packet, nil
+}
+
+// Returns a radius handler function that sends the requests to the gRPC handlers specified, in order,
+// until one of them answers, with the specified timeout for all of them. Suitable to be set as the
+// handler in the radius router
+func (c *GrpcClient) RadiusHandler(endpoints []string, timeout time.Duration) func(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+	return func(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		var lastErr error = fmt.Errorf("no handler endpoints specified: %w", core.ErrRouteNotFound)
+		for _, endpoint := range endpoints {
+			response, err := c.RadiusRequest(ctx, endpoint, request)
+			if err == nil {
+				return response, nil
+			}
+			lastErr = err
+
+			var handlerErr *httphandler.HttpHandlerError
+			if !errors.As(err, &handlerErr) || !handlerErr.Transient || ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, lastErr
+	}
+}
+
+// Returns the connection for the endpoint, creating it if necessary, and whether the raw encoding is to be used
+func (c *GrpcClient) getConn(endpoint string) (*grpc.ClientConn, bool, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, false, fmt.Errorf("bad grpc handler url %s: %w", endpoint, err)
+	}
+	raw := u.Query().Get("encoding") == "raw"
+
+	c.Lock()
+	defer c.Unlock()
+
+	target := u.Scheme + "://" + u.Host
+	if conn, found := c.conns[target]; found {
+		return conn, raw, nil
+	}
+
+	transportCredentials := insecure.NewCredentials()
+	if u.Scheme == GRPCS_SCHEME {
+		tlsConfig, err := httphandler.ClientTLSConfig(c.conf)
+		if err != nil {
+			return nil, false, err
+		}
+		transportCredentials = credentials.NewTLS(tlsConfig)
+	}
+
+	// Does not block. The connection is established when first used
+	conn, err := grpc.Dial(u.Host, grpc.WithTransportCredentials(transportCredentials))
+	if err != nil {
+		return nil, false, fmt.Errorf("could not create grpc connection to %s: %w", endpoint, err)
+	}
+	c.conns[target] = conn
+	return conn, raw, nil
+}
+
+// Adds the credentials, the trace identifier and the trace context to the metadata
+func (c *GrpcClient) outgoingContext(ctx context.Context) context.Context {
+	kv := make([]string, 0, 8)
+	if c.conf.BearerToken != "" {
+		kv = append(kv, "authorization", "Bearer "+c.conf.BearerToken)
+	}
+	if c.conf.APIKey != "" {
+		kv = append(kv, apiKeyKey, c.conf.APIKey)
+	}
+	if traceId := core.TraceId(ctx); traceId != "" {
+		kv = append(kv, traceIdKey, traceId)
+	}
+	if traceparent := telemetry.Traceparent(ctx); traceparent != "" {
+		kv = append(kv, traceparentKey, traceparent)
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...)
+}
+
+// Builds the error for a failed invocation, classified as in the http transport. The handler is considered
+// unavailable, and the failure transient, if the connection could not be established or it is overloaded
+func (c *GrpcClient) newHandlerError(ctx context.Context, endpoint string, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return httphandler.NewHttpHandlerError(c.instanceName, endpoint, httphandler.NETWORK_ERROR, false, ctxErr)
+	}
+
+	st := status.Convert(err)
+	switch st.Code() {
+	case codes.Unavailable:
+		return httphandler.NewHttpHandlerError(c.instanceName, endpoint, httphandler.NETWORK_ERROR, true, err)
+	case codes.ResourceExhausted:
+		return httphandler.NewHttpHandlerError(c.instanceName, endpoint, httphandler.HTTP_RESPONSE_ERROR, true, err)
+	default:
+		return httphandler.NewHttpHandlerError(c.instanceName, endpoint, httphandler.HTTP_RESPONSE_ERROR, false, fmt.Errorf("returned status %s: %s", st.Code(), st.Message()))
+	}
+}
@@ -0,0 +1,230 @@
+package grpchandler
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"igor/config"
+	"igor/core"
+	"igor/diampeer"
+	"igor/httphandler"
+	"igor/instrumentation"
+	"igor/radiuscodec"
+	"igor/telemetry"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Names of the service and methods, as defined in igor.proto
+const (
+	SERVICE_NAME           = "igor.Handler"
+	HANDLE_DIAMETER_METHOD = "/igor.Handler/HandleDiameter"
+	HANDLE_RADIUS_METHOD   = "/igor.Handler/HandleRadius"
+)
+
+// Metadata keys for the propagation of the context and the credentials
+const (
+	traceIdKey     = "x-igor-trace-id"
+	traceparentKey = "traceparent"
+	apiKeyKey      = "x-api-key"
+)
+
+// Handler for the radius requests received through gRPC
+type RadiusHandler func(ctx context.Context, request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error)
+
+// Serves the gRPC Handler service, invoking the diameter or radius handler functions
+type GrpcHandler struct {
+	// Holds the configuration instance for this Handler
+	ci *config.HandlerConfigurationManager
+
+	diameterHandler diampeer.ContextMessageHandler
+	radiusHandler   RadiusHandler
+
+	server *grpc.Server
+}
+
+// The interface that the server must implement, as required by grpc
+type handlerService interface {
+	instanceName() string
+	handleDiameter(ctx context.Context, request *diameterEnvelope) (*diameterEnvelope, error)
+	handleRadius(ctx context.Context, request *radiusEnvelope) (*radiusEnvelope, error)
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: SERVICE_NAME,
+	HandlerType: (*handlerService)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "HandleDiameter",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				var request diameterEnvelope
+				if err := dec(&request); err != nil {
+					instrumentation.PushHttpHandlerExchange(srv.(handlerService).instanceName(), httphandler.UNSERIALIZATION_ERROR)
+					return nil, err
+				}
+				handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(handlerService).handleDiameter(ctx, req.(*diameterEnvelope))
+				}
+				return interceptor(ctx, &request, &grpc.UnaryServerInfo{Server: srv, FullMethod: HANDLE_DIAMETER_METHOD}, handler)
+			},
+		},
+		{
+			MethodName: "HandleRadius",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				var request radiusEnvelope
+				if err := dec(&request); err != nil {
+					instrumentation.PushHttpHandlerExchange(srv.(handlerService).instanceName(), httphandler.UNSERIALIZATION_ERROR)
+					return nil, err
+				}
+				handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(handlerService).handleRadius(ctx, req.(*radiusEnvelope))
+				}
+				return interceptor(ctx, &request, &grpc.UnaryServerInfo{Server: srv, FullMethod: HANDLE_RADIUS_METHOD}, handler)
+			},
+		},
+	},
+	Metadata: "igor.proto",
+}
+
+// Creates the gRPC handler and starts serving in the GrpcBindPort of the configuration. Any of the
+// handler functions may be nil, in which case the corresponding requests are answered with an
+// Unimplemented error. The requests are authenticated as those of the http handlers
+func NewGrpcHandler(instanceName string, diameterHandler diampeer.ContextMessageHandler, radiusHandler RadiusHandler) (*GrpcHandler, error) {
+	h := GrpcHandler{
+		ci:              config.GetHandlerConfigInstance(instanceName),
+		diameterHandler: diameterHandler,
+		radiusHandler:   radiusHandler,
+	}
+
+	hc := h.ci.HandlerConf()
+	if hc.GrpcBindPort == 0 {
+		return nil, fmt.Errorf("no grpc bind port configured")
+	}
+
+	options := []grpc.ServerOption{grpc.ForceServerCodec(codec{}), grpc.UnaryInterceptor(h.authenticate)}
+	if hc.CertFile != "" {
+		tlsConfig, err := httphandler.ServerTLSConfig(hc)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := tls.LoadX509KeyPair(hc.CertFile, hc.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", hc.BindAddress, hc.GrpcBindPort))
+	if err != nil {
+		return nil, fmt.Errorf("could not create grpc handler listener: %w", err)
+	}
+
+	h.server = grpc.NewServer(options...)
+	h.server.RegisterService(&serviceDesc, &h)
+
+	config.GetSubsystemLogger(config.SUBSYSTEM_HANDLERS).Infof("grpc handler listening in %s", listener.Addr())
+	go h.server.Serve(listener)
+
+	return &h, nil
+}
+
+// Stops serving, waiting for the requests in progress to finish
+func (h *GrpcHandler) Close() {
+	h.server.GracefulStop()
+}
+
+// Checks the client certificate and the bearer token or API key, if so configured
+func (h *GrpcHandler) authenticate(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var tlsState *tls.ConnectionState
+	if p, ok := peer.FromContext(ctx); ok {
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			tlsState = &tlsInfo.State
+		}
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	if err := httphandler.CheckCredentials(h.ci.HandlerConf(), tlsState, firstValue(md, "authorization"), firstValue(md, apiKeyKey)); err != nil {
+		config.GetSubsystemLogger(config.SUBSYSTEM_HANDLERS).Warnf("rejected grpc request: %s", err)
+		instrumentation.PushHttpHandlerExchange(h.instanceName(), httphandler.AUTHENTICATION_ERROR)
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	return handler(ctx, req)
+}
+
+func (h *GrpcHandler) handleDiameter(ctx context.Context, request *diameterEnvelope) (*diameterEnvelope, error) {
+	if h.diameterHandler == nil {
+		instrumentation.PushHttpHandlerExchange(h.instanceName(), httphandler.HANDLER_FUNCTION_ERROR)
+		return nil, status.Error(codes.Unimplemented, "no diameter handler")
+	}
+
+	start := time.Now()
+	ctx, span := telemetry.StartServerSpan(incomingContext(ctx), "handle "+request.Message.CommandName, telemetry.DiameterAttributes(request.Message)...)
+	answer, err := h.diameterHandler(ctx, request.Message)
+	telemetry.EndSpan(span, err)
+	if err != nil {
+		config.GetSubsystemLogger(config.SUBSYSTEM_HANDLERS).Errorw(fmt.Sprintf("error handling request %s", err), append(request.Message.LogFields(), "trace-id", core.TraceId(ctx))...)
+		h.pushExchange(ctx, httphandler.HANDLER_FUNCTION_ERROR, start)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	h.pushExchange(ctx, httphandler.SUCCESS, start)
+	return &diameterEnvelope{Message: answer, Raw: request.Raw}, nil
+}
+
+func (h *GrpcHandler) handleRadius(ctx context.Context, request *radiusEnvelope) (*radiusEnvelope, error) {
+	if h.radiusHandler == nil {
+		instrumentation.PushHttpHandlerExchange(h.instanceName(), httphandler.HANDLER_FUNCTION_ERROR)
+		return nil, status.Error(codes.Unimplemented, "no radius handler")
+	}
+
+	start := time.Now()
+	ctx, span := telemetry.StartServerSpan(incomingContext(ctx), fmt.Sprintf("handle radius code %d", request.Packet.Code), telemetry.RadiusAttributes(request.Packet)...)
+	response, err := h.radiusHandler(ctx, request.Packet)
+	telemetry.EndSpan(span, err)
+	if err != nil {
+		config.GetSubsystemLogger(config.SUBSYSTEM_HANDLERS).Errorw(fmt.Sprintf("error handling request %s", err), append(request.Packet.LogFields(), "trace-id", core.TraceId(ctx))...)
+		h.pushExchange(ctx, httphandler.HANDLER_FUNCTION_ERROR, start)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	h.pushExchange(ctx, httphandler.SUCCESS, start)
+	return &radiusEnvelope{Packet: response, Raw: request.Raw}, nil
+}
+
+// Adds to the context the trace identifier and trace context received in the metadata. The deadline
+// is already set by grpc
+func incomingContext(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if traceparent := firstValue(md, traceparentKey); traceparent != "" {
+		ctx = telemetry.ContextWithTraceparent(ctx, traceparent)
+	}
+	if traceId := firstValue(md, traceIdKey); traceId != "" {
+		ctx = core.WithTraceId(ctx, traceId)
+	}
+	return ctx
+}
+
+// Reports the result and the duration of the invocation, with the same metrics as the http handlers
+func (h *GrpcHandler) pushExchange(ctx context.Context, errorCode string, start time.Time) {
+	instrumentation.PushHttpHandlerExchange(h.instanceName(), errorCode)
+	instrumentation.PushHttpHandlerDuration(ctx, h.instanceName(), errorCode, time.Since(start))
+}
+
+// Name of the configuration instance, to label the metrics
+func (h *GrpcHandler) instanceName() string {
+	return h.ci.InstanceName()
+}
+
+func firstValue(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
@@ -0,0 +1,161 @@
+package grpchandler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"igor/config"
+	"igor/core"
+	"igor/diamcodec"
+	"igor/httphandler"
+	"igor/radiuscodec"
+	"os"
+	"testing"
+	"time"
+)
+
+var jDiameterMessage = `
+	{
+		"IsRequest": true,
+		"CommandCode": 2000,
+		"ApplicationId": 1000,
+		"avps":[
+			{"Session-Id": "my-session-id"},
+			{
+			  "franciscocardosogil-myTestAllGrouped": [
+  				{"franciscocardosogil-myOctetString": "0102030405060708090a0b"},
+  				{"franciscocardosogil-myInteger32": -99},
+  				{"franciscocardosogil-myInteger64": -99},
+  				{"franciscocardosogil-myUnsigned32": 99},
+  				{"franciscocardosogil-myUnsigned64": 18446744073709551615},
+  				{"franciscocardosogil-myFloat64": 99.9},
+  				{"franciscocardosogil-myAddress": "1.2.3.4"},
+  				{"franciscocardosogil-myTime": "1966-11-26T03:34:08 UTC"},
+  				{"franciscocardosogil-myString": "Hello, world!"},
+  				{"franciscocardosogil-myIPv6Address": "bebe:cafe::0"},
+  				{"franciscocardosogil-myEnumerated": "two"}
+			  ]
+			}
+		]
+	}
+	`
+
+func TestMain(m *testing.M) {
+
+	// Initialize the Config Objects
+	bootstrapFile := "resources/searchRules.json"
+	instanceName := "testServer"
+	config.InitHandlerConfigInstance(bootstrapFile, instanceName, true)
+	config.InitPolicyConfigInstance(bootstrapFile, instanceName, false)
+
+	// Execute the tests and exit
+	os.Exit(m.Run())
+}
+
+func TestGrpcHandler(t *testing.T) {
+
+	var request diamcodec.DiameterMessage
+	if err := json.Unmarshal([]byte(jDiameterMessage), &request); err != nil {
+		t.Fatalf("unmarshal error for diameter message: %s", err)
+	}
+
+	// Handlers that echo the request and report the trace identifier received
+	traceIdChan := make(chan string, 1)
+	diameterHandler := func(ctx context.Context, request *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, error) {
+		traceIdChan <- core.TraceId(ctx)
+		if request.GetStringAVP("Session-Id") == "fail" {
+			return nil, errors.New("failed on request")
+		}
+		answer := diamcodec.NewDiameterAnswer(request)
+		for _, avp := range request.AVPs {
+			answer.AddAVP(&avp)
+		}
+		return answer, nil
+	}
+	radiusHandler := func(ctx context.Context, request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+		response := radiuscodec.NewRadiusResponse(request, request.GetPasswordStringAVP("User-Password") == "secret-password")
+		response.Add("Class", request.GetStringAVP("User-Name"))
+		response.Add("Session-Timeout", 3600)
+		return response, nil
+	}
+
+	handler, err := NewGrpcHandler("testServer", diameterHandler, radiusHandler)
+	if err != nil {
+		t.Fatalf("could not create grpc handler: %s", err)
+	}
+	defer handler.Close()
+
+	client := NewGrpcClient("", config.HttpHandlerClientConfig{})
+	defer client.Close()
+
+	for _, endpoint := range []string{"grpc://127.0.0.1:8091", "grpc://127.0.0.1:8091?encoding=raw"} {
+
+		// Diameter
+		ctx, cancel := context.WithTimeout(core.WithTraceId(context.Background(), "my-trace-id"), 2*time.Second)
+		answer, err := client.DiameterRequest(ctx, endpoint, &request)
+		cancel()
+		if err != nil {
+			t.Fatalf("%s: diameter request failed: %s", endpoint, err)
+		}
+		if traceId := <-traceIdChan; traceId != "my-trace-id" {
+			t.Errorf("%s: bad trace id %q", endpoint, traceId)
+		}
+		if answer.IsRequest || answer.CommandCode != 2000 || answer.GetStringAVP("Session-Id") != "my-session-id" {
+			t.Errorf("%s: bad answer %s", endpoint, answer)
+		}
+		grouped, err := answer.GetAVP("franciscocardosogil-myTestAllGrouped")
+		if err != nil {
+			t.Fatalf("%s: grouped AVP not found in %s", endpoint, answer)
+		}
+		if v, _ := grouped.GetAVP("franciscocardosogil-myUnsigned64"); v.GetUint() != 18446744073709551615 {
+			t.Errorf("%s: bad unsigned64 %s", endpoint, v)
+		}
+		if v, _ := grouped.GetAVP("franciscocardosogil-myInteger64"); v.GetInt() != -99 {
+			t.Errorf("%s: bad integer64 %s", endpoint, v)
+		}
+		if v, _ := grouped.GetAVP("franciscocardosogil-myFloat64"); v.GetFloat() != 99.9 {
+			t.Errorf("%s: bad float64 %s", endpoint, v)
+		}
+		if v, _ := grouped.GetAVP("franciscocardosogil-myEnumerated"); v.GetString() != "two" {
+			t.Errorf("%s: bad enumerated %s", endpoint, v)
+		}
+		if v, _ := grouped.GetAVP("franciscocardosogil-myIPv6Address"); v.GetString() != "bebe:cafe::" {
+			t.Errorf("%s: bad address %s", endpoint, v)
+		}
+
+		// Radius
+		radiusRequest := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+		radiusRequest.Identifier = 7
+		radiusRequest.Add("User-Name", "user@igor")
+		radiusRequest.Add("User-Password", []byte("secret-password"))
+		response, err := client.RadiusHandler([]string{endpoint}, 2*time.Second)(radiusRequest)
+		if err != nil {
+			t.Fatalf("%s: radius request failed: %s", endpoint, err)
+		}
+		if response.Code != radiuscodec.ACCESS_ACCEPT || response.Identifier != 7 || response.Authenticator != radiusRequest.Authenticator {
+			t.Errorf("%s: bad radius response %s", endpoint, response)
+		}
+		if response.GetStringAVP("Class") != "user@igor" || response.GetIntAVP("Session-Timeout") != 3600 {
+			t.Errorf("%s: bad radius attributes %s", endpoint, response)
+		}
+	}
+
+	// Errors in the handler are not transient
+	failRequest := diamcodec.CopyDiameterMessage(&request)
+	failRequest.DeleteAllAVP("Session-Id")
+	failRequest.Add("Session-Id", "fail")
+	_, err = client.DiameterRequest(context.Background(), "grpc://127.0.0.1:8091", &failRequest)
+	<-traceIdChan
+	var handlerErr *httphandler.HttpHandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.Transient || !errors.Is(err, core.ErrHandlerFailure) {
+		t.Errorf("bad error for failed handler %v", err)
+	}
+
+	// Unavailable handlers are transient
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err = client.DiameterRequest(ctx, "grpc://127.0.0.1:8099", &request)
+	if !errors.As(err, &handlerErr) || !handlerErr.Transient {
+		t.Errorf("bad error for unavailable handler %v", err)
+	}
+}
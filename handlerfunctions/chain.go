@@ -0,0 +1,64 @@
+package handlerfunctions
+
+import (
+	"igor/diampeer"
+	"igor/radiusserver"
+)
+
+// Handlers may be composed of stages, such as logging, rate limiting, authentication and accounting, which are
+// registered as middlewares in a chain. Each middleware receives the next stage, and may modify the request
+// before invoking it, modify the answer afterwards, or answer by itself without invoking it
+
+// Wraps a diameter handler
+type DiameterMiddleware func(next diampeer.MessageHandler) diampeer.MessageHandler
+
+// Wraps a radius handler
+type RadiusMiddleware func(next radiusserver.RadiusPacketHandler) radiusserver.RadiusPacketHandler
+
+// Chain of middlewares for diameter handlers. The middlewares are executed in the order of registration
+type DiameterHandlerChain struct {
+	middlewares []DiameterMiddleware
+}
+
+// Creates a chain with the specified middlewares
+func NewDiameterHandlerChain(middlewares ...DiameterMiddleware) *DiameterHandlerChain {
+	return &DiameterHandlerChain{middlewares: append([]DiameterMiddleware{}, middlewares...)}
+}
+
+// Appends the middlewares to the chain
+func (c *DiameterHandlerChain) Use(middlewares ...DiameterMiddleware) *DiameterHandlerChain {
+	c.middlewares = append(c.middlewares, middlewares...)
+	return c
+}
+
+// Returns the handler that executes the middlewares and then the specified handler
+func (c *DiameterHandlerChain) Then(handler diampeer.MessageHandler) diampeer.MessageHandler {
+	for i := len(c.middlewares) - 1; i >= 0; i-- {
+		handler = c.middlewares[i](handler)
+	}
+	return handler
+}
+
+// Chain of middlewares for radius handlers. The middlewares are executed in the order of registration
+type RadiusHandlerChain struct {
+	middlewares []RadiusMiddleware
+}
+
+// Creates a chain with the specified middlewares
+func NewRadiusHandlerChain(middlewares ...RadiusMiddleware) *RadiusHandlerChain {
+	return &RadiusHandlerChain{middlewares: append([]RadiusMiddleware{}, middlewares...)}
+}
+
+// Appends the middlewares to the chain
+func (c *RadiusHandlerChain) Use(middlewares ...RadiusMiddleware) *RadiusHandlerChain {
+	c.middlewares = append(c.middlewares, middlewares...)
+	return c
+}
+
+// Returns the handler that executes the middlewares and then the specified handler
+func (c *RadiusHandlerChain) Then(handler radiusserver.RadiusPacketHandler) radiusserver.RadiusPacketHandler {
+	for i := len(c.middlewares) - 1; i >= 0; i-- {
+		handler = c.middlewares[i](handler)
+	}
+	return handler
+}
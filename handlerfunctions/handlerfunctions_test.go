@@ -0,0 +1,96 @@
+package handlerfunctions
+
+import (
+	"errors"
+	"igor/config"
+	"igor/core"
+	"igor/diamcodec"
+	"igor/diampeer"
+	"igor/radiuscodec"
+	"igor/radiusserver"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+
+	// Initialize the Config Objects
+	config.InitPolicyConfigInstance("resources/searchRules.json", "testServer", true)
+
+	// Execute the tests and exit
+	os.Exit(m.Run())
+}
+
+func TestDiameterHandlerChain(t *testing.T) {
+
+	// Each stage appends its name to the User-Name
+	stage := func(name string) DiameterMiddleware {
+		return func(next diampeer.MessageHandler) diampeer.MessageHandler {
+			return func(request *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, error) {
+				userName := request.GetStringAVP("User-Name")
+				request.DeleteAllAVP("User-Name").Add("User-Name", userName+name)
+				return next(request)
+			}
+		}
+	}
+	echo := func(request *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, error) {
+		answer := diamcodec.NewDiameterAnswer(request)
+		answer.Add("User-Name", request.GetStringAVP("User-Name"))
+		return answer, nil
+	}
+
+	handler := NewDiameterHandlerChain(stage("a")).Use(stage("b"), DiameterRateLimit(config.GetPolicyConfig(), 1)).Then(echo)
+
+	request, _ := diamcodec.NewDiameterRequest("TestApplication", "TestRequest")
+	request.Add("Session-Id", "rate-limit-session")
+	answer, err := handler(request)
+	if err != nil || answer.GetStringAVP("User-Name") != "ab" {
+		t.Errorf("bad answer %v, %v", answer, err)
+	}
+
+	// Short-circuited by the rate limiter
+	answer, err = handler(request)
+	if err != nil || answer.GetResultCode() != diamcodec.DIAMETER_TOO_BUSY {
+		t.Errorf("rate limit not enforced %v, %v", answer, err)
+	}
+	if answer.GetStringAVP("Session-Id") != "rate-limit-session" || answer.GetStringAVP("Error-Reporting-Host") != config.GetPolicyConfig().DiameterServerConf().DiameterHost {
+		t.Errorf("bad rate limit answer %v", answer)
+	}
+
+	// Panics are turned into errors
+	handler = NewDiameterHandlerChain(DiameterRecover()).Then(func(request *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, error) {
+		panic("bad handler")
+	})
+	if _, err := handler(request); !errors.Is(err, core.ErrHandlerFailure) {
+		t.Errorf("panic not recovered %v", err)
+	}
+}
+
+func TestRadiusHandlerChain(t *testing.T) {
+
+	// Short-circuits the Accounting-Requests
+	acctFilter := func(next radiusserver.RadiusPacketHandler) radiusserver.RadiusPacketHandler {
+		return func(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+			if request.Code == radiuscodec.ACCOUNTING_REQUEST {
+				return radiuscodec.NewRadiusResponse(request, true), nil
+			}
+			return next(request)
+		}
+	}
+	reject := func(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+		return radiuscodec.NewRadiusResponse(request, false), nil
+	}
+
+	handler := NewRadiusHandlerChain(RadiusLogging(), acctFilter).Use(RadiusRateLimit(2)).Then(reject)
+
+	if response, _ := handler(radiuscodec.NewRadiusRequest(radiuscodec.ACCOUNTING_REQUEST)); response.Code != radiuscodec.ACCOUNTING_RESPONSE {
+		t.Errorf("accounting request not short-circuited")
+	}
+	if response, _ := handler(radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)); response.Code != radiuscodec.ACCESS_REJECT {
+		t.Errorf("access request not handled")
+	}
+	handler(radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST))
+	if _, err := handler(radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)); !errors.Is(err, core.ErrRateLimited) {
+		t.Errorf("rate limit not enforced %v", err)
+	}
+}
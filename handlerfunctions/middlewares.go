@@ -0,0 +1,129 @@
+package handlerfunctions
+
+import (
+	"fmt"
+	"igor/config"
+	"igor/core"
+	"igor/diamcodec"
+	"igor/diampeer"
+	"igor/radiuscodec"
+	"igor/radiusserver"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Returns the logger of the subsystem
+func handlersLogger() *zap.SugaredLogger {
+	return config.GetSubsystemLogger(config.SUBSYSTEM_HANDLERS)
+}
+
+// Logs the requests and their answers, with the time taken to generate them, at debug level, and the errors
+func DiameterLogging() DiameterMiddleware {
+	return func(next diampeer.MessageHandler) diampeer.MessageHandler {
+		return func(request *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, error) {
+			start := time.Now()
+			answer, err := next(request)
+			if err != nil {
+				handlersLogger().Errorw(fmt.Sprintf("error handling request: %s", err), request.LogFields()...)
+			} else {
+				handlersLogger().Debugw(fmt.Sprintf("answered in %s", time.Since(start)), append(request.LogFields(), "answer", answer)...)
+			}
+			return answer, err
+		}
+	}
+}
+
+// Logs the requests and their responses, with the time taken to generate them, at debug level, and the errors
+func RadiusLogging() RadiusMiddleware {
+	return func(next radiusserver.RadiusPacketHandler) radiusserver.RadiusPacketHandler {
+		return func(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+			start := time.Now()
+			response, err := next(request)
+			if err != nil {
+				handlersLogger().Errorw(fmt.Sprintf("error handling radius request: %s", err), request.LogFields()...)
+			} else {
+				handlersLogger().Debugw(fmt.Sprintf("radius request answered in %s", time.Since(start)), append(request.LogFields(), "response", response)...)
+			}
+			return response, err
+		}
+	}
+}
+
+// Answers with DIAMETER_TOO_BUSY the requests above the specified rate per second. The Origin-Host of
+// the configuration instance is used as Error-Reporting-Host
+func DiameterRateLimit(ci *config.PolicyConfigurationManager, rate int) DiameterMiddleware {
+	limiter := newRateLimiter(rate)
+	return func(next diampeer.MessageHandler) diampeer.MessageHandler {
+		return func(request *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, error) {
+			if !limiter.allow() {
+				answer := diamcodec.NewDiameterAnswer(request)
+				answer.IsError = true
+				answer.Add("Session-Id", request.GetStringAVP("Session-Id"))
+				answer.AddOriginAVPs(ci)
+				answer.Add("Result-Code", diamcodec.DIAMETER_TOO_BUSY)
+				answer.Add("Error-Reporting-Host", ci.DiameterServerConf().DiameterHost)
+				return answer, nil
+			}
+			return next(request)
+		}
+	}
+}
+
+// Discards the requests above the specified rate per second, returning an error that wraps core.ErrRateLimited
+func RadiusRateLimit(rate int) RadiusMiddleware {
+	limiter := newRateLimiter(rate)
+	return func(next radiusserver.RadiusPacketHandler) radiusserver.RadiusPacketHandler {
+		return func(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+			if !limiter.allow() {
+				return nil, fmt.Errorf("radius request with code %d discarded: %w", request.Code, core.ErrRateLimited)
+			}
+			return next(request)
+		}
+	}
+}
+
+// Turns the panics of the next stages into errors wrapping core.ErrHandlerFailure
+func DiameterRecover() DiameterMiddleware {
+	return func(next diampeer.MessageHandler) diampeer.MessageHandler {
+		return func(request *diamcodec.DiameterMessage) (answer *diamcodec.DiameterMessage, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					answer, err = nil, fmt.Errorf("panic handling %s %s: %v: %w", request.ApplicationName, request.CommandName, r, core.ErrHandlerFailure)
+				}
+			}()
+			return next(request)
+		}
+	}
+}
+
+// Turns the panics of the next stages into errors wrapping core.ErrHandlerFailure
+func RadiusRecover() RadiusMiddleware {
+	return func(next radiusserver.RadiusPacketHandler) radiusserver.RadiusPacketHandler {
+		return func(request *radiuscodec.RadiusPacket) (response *radiuscodec.RadiusPacket, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					response, err = nil, fmt.Errorf("panic handling radius request with code %d: %v: %w", request.Code, r, core.ErrHandlerFailure)
+				}
+			}()
+			return next(request)
+		}
+	}
+}
+
+// Token bucket shared by the concurrent invocations of a middleware
+type rateLimiter struct {
+	sync.Mutex
+	bucket *core.TokenBucket
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{bucket: core.NewTokenBucket(rate, time.Now())}
+}
+
+func (rl *rateLimiter) allow() bool {
+	rl.Lock()
+	defer rl.Unlock()
+	return rl.bucket.Take(time.Now())
+}
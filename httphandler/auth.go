@@ -0,0 +1,171 @@
+package httphandler
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"igor/config"
+	"igor/instrumentation"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// Locations of the certificate and key of the handlers, if not specified in the configuration
+const (
+	DEFAULT_CERT_FILE = "/home/francisco/cert.pem"
+	DEFAULT_KEY_FILE  = "/home/francisco/key.pem"
+)
+
+// Header for the API keys
+const API_KEY_HEADER = "X-API-Key"
+
+// Returns the handler configuration. A function is used so that the latest configuration
+// is always taken into account
+type HandlerConfFunc func() config.HandlerConfig
+
+// Builds the TLS configuration of the handler. If a client CA file is configured, the client
+// certificates are verified against it. The certificates are requested but not required during
+// the handshake, so that the requests without a valid one are rejected and reported as any other
+// authentication failure
+func ServerTLSConfig(hc config.HandlerConfig) (*tls.Config, error) {
+	tlsConfig := tls.Config{}
+	if hc.ClientCAFile == "" {
+		return &tlsConfig, nil
+	}
+
+	pool, err := loadCertPool(hc.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return &tlsConfig, nil
+}
+
+// Wraps the handler so that it is only executed if the request is authenticated as specified in the
+// configuration. Otherwise, 401 is returned and the exchange is reported with AUTHENTICATION_ERROR,
+// in the metrics of the specified instance
+func withAuthentication(instanceName string, handlerConf HandlerConfFunc, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err := authenticate(handlerConf(), req); err != nil {
+			config.GetSubsystemLogger(config.SUBSYSTEM_HANDLERS).Warnf("rejected request from %s: %s", req.RemoteAddr, err)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			instrumentation.PushHttpHandlerExchange(instanceName, AUTHENTICATION_ERROR)
+			return
+		}
+		next(w, req)
+	}
+}
+
+// Checks that the request carries a verified client certificate, if mutual TLS is configured,
+// and one of the bearer tokens or API keys, if any is configured
+func authenticate(hc config.HandlerConfig, req *http.Request) error {
+	return CheckCredentials(hc, req.TLS, req.Header.Get("Authorization"), req.Header.Get(API_KEY_HEADER))
+}
+
+// Checks the credentials of a request, given the state of the TLS connection, if any, and the values
+// of the Authorization and API key headers, which may be empty
+func CheckCredentials(hc config.HandlerConfig, tlsState *tls.ConnectionState, authorization string, apiKey string) error {
+	if hc.ClientCAFile != "" && (tlsState == nil || len(tlsState.VerifiedChains) == 0) {
+		return errors.New("missing or invalid client certificate")
+	}
+
+	if len(hc.BearerTokens) == 0 && len(hc.APIKeys) == 0 {
+		return nil
+	}
+	if strings.HasPrefix(authorization, "Bearer ") {
+		if containsSecret(hc.BearerTokens, strings.TrimPrefix(authorization, "Bearer ")) {
+			return nil
+		}
+	}
+	if apiKey != "" && containsSecret(hc.APIKeys, apiKey) {
+		return nil
+	}
+	return errors.New("missing or unknown token")
+}
+
+// Looks for the value in the list, comparing in constant time
+func containsSecret(secrets []string, value string) bool {
+	found := false
+	for _, secret := range secrets {
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(value)) == 1 {
+			found = true
+		}
+	}
+	return found
+}
+
+// Creates the http2 client used by the routers to send requests to the handlers, presenting the
+// credentials specified in the configuration
+func NewHttp2Client(conf config.HttpHandlerClientConfig, timeout time.Duration) (http.Client, error) {
+	tlsConfig, err := ClientTLSConfig(conf)
+	if err != nil {
+		return http.Client{}, err
+	}
+
+	var transport http.RoundTripper = &http2.Transport{TLSClientConfig: tlsConfig}
+	if conf.BearerToken != "" || conf.APIKey != "" {
+		transport = credentialsTransport{conf: conf, next: transport}
+	}
+
+	return http.Client{Timeout: timeout, Transport: transport}, nil
+}
+
+// Builds the TLS configuration to connect to the handlers, with the client certificate, if specified.
+// If no CA is specified, the certificates of the handlers are not verified
+func ClientTLSConfig(conf config.HttpHandlerClientConfig) (*tls.Config, error) {
+	tlsConfig := tls.Config{InsecureSkipVerify: true}
+	if conf.CAFile != "" {
+		pool, err := loadCertPool(conf.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = tls.Config{RootCAs: pool}
+	}
+	if conf.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &tlsConfig, nil
+}
+
+// Adds the bearer token and API key to the requests
+type credentialsTransport struct {
+	conf config.HttpHandlerClientConfig
+	next http.RoundTripper
+}
+
+func (t credentialsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The request must not be modified
+	req = req.Clone(req.Context())
+	if t.conf.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+t.conf.BearerToken)
+	}
+	if t.conf.APIKey != "" {
+		req.Header.Set(API_KEY_HEADER, t.conf.APIKey)
+	}
+	return t.next.RoundTrip(req)
+}
+
+// Reads the PEM encoded certificates in the file
+func loadCertPool(fileName string) (*x509.CertPool, error) {
+	pemCerts, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemCerts) {
+		return nil, fmt.Errorf("no certificates found in %s", fileName)
+	}
+	return pool, nil
+}
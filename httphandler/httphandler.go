@@ -1,14 +1,17 @@
 package httphandler
 
 import (
-	"encoding/json"
 	"fmt"
 	"igor/config"
+	"igor/core"
 	"igor/diamcodec"
 	"igor/diampeer"
 	"igor/instrumentation"
+	"igor/scripthandler"
+	"igor/telemetry"
 	"io/ioutil"
 	"net/http"
+	"time"
 )
 
 type HttpHandler struct {
@@ -18,9 +21,25 @@ type HttpHandler struct {
 
 // Creates a new DiameterHandler object
 func NewHttpHandler(instanceName string, handler diampeer.MessageHandler) HttpHandler {
+	return NewHttpHandlerWithContext(instanceName, diampeer.IgnoringContext(handler))
+}
+
+// Creates a new DiameterHandler object whose handler receives a context with the deadline and trace identifier
+// sent by the router, which is cancelled if the router abandons the request
+func NewHttpHandlerWithContext(instanceName string, handler diampeer.ContextMessageHandler) HttpHandler {
 	h := HttpHandler{ci: config.GetHandlerConfigInstance(instanceName)}
 
-	http.HandleFunc("/diameterRequest", getDiameterRequestHandler(handler))
+	// The script, if configured, replaces the handler function
+	hc := h.ci.HandlerConf()
+	if hc.DiameterScript != "" {
+		scriptHandler, err := scripthandler.NewScriptHandler(&h.ci.CM, hc.DiameterScript, time.Duration(hc.ScriptReloadSeconds)*time.Second)
+		if err != nil {
+			panic(err)
+		}
+		handler = diampeer.IgnoringContext(scriptHandler.HandleDiameter)
+	}
+
+	http.HandleFunc("/diameterRequest", withAuthentication(h.ci.InstanceName(), h.ci.HandlerConf, getDiameterRequestHandler(h.ci.InstanceName(), handler)))
 
 	// TODO: Close gracefully
 	go h.Run()
@@ -31,19 +50,48 @@ func NewHttpHandler(instanceName string, handler diampeer.MessageHandler) HttpHa
 // in a goroutine.
 func (dh *HttpHandler) Run() {
 
-	logger := config.GetLogger()
+	logger := config.GetSubsystemLogger(config.SUBSYSTEM_HANDLERS)
+
+	hc := dh.ci.HandlerConf()
+	listener, err := NewListener(hc.BindAddress, hc.BindPort, hc.UnixSocketPath, hc.UnixSocketPermissions)
+	if err != nil {
+		logger.Errorf("could not create http handler listener: %s", err)
+		return
+	}
 
-	bindAddrPort := fmt.Sprintf("%s:%d", dh.ci.HandlerConf().BindAddress, dh.ci.HandlerConf().BindPort)
+	tlsConfig, err := ServerTLSConfig(hc)
+	if err != nil {
+		logger.Errorf("could not create http handler TLS configuration: %s", err)
+		listener.Close()
+		return
+	}
+	certFile, keyFile := hc.CertFile, hc.KeyFile
+	if certFile == "" {
+		certFile, keyFile = DEFAULT_CERT_FILE, DEFAULT_KEY_FILE
+	}
 
-	logger.Infof("listening in %s", bindAddrPort)
-	http.ListenAndServeTLS(bindAddrPort, "/home/francisco/cert.pem", "/home/francisco/key.pem", nil)
+	logger.Infof("listening in %s", listener.Addr())
+	server := http.Server{TLSConfig: tlsConfig}
+	server.ServeTLS(listener, certFile, keyFile)
 }
 
 // Given a Diameter Handler function, builds an http handler that unserializes, executes the handler and serializes the response
-func getDiameterRequestHandler(handlerFunc diampeer.MessageHandler) func(w http.ResponseWriter, req *http.Request) {
+// The request may be in JSON or CBOR, as specified in the Content-Type, and the answer is serialized in the same format
+// The context passed to the handler is cancelled when the client closes the request or its deadline expires
+// The exchanges are reported in the metrics of the specified instance
+func getDiameterRequestHandler(instanceName string, handlerFunc diampeer.ContextMessageHandler) func(w http.ResponseWriter, req *http.Request) {
 
 	h := func(w http.ResponseWriter, req *http.Request) {
-		logger := config.GetLogger()
+		logger := config.GetSubsystemLogger(config.SUBSYSTEM_HANDLERS)
+
+		// Reports the result and the duration of the invocation. The context is replaced by that of the span
+		// of the handler, once started
+		start := time.Now()
+		ctx := req.Context()
+		pushExchange := func(errorCode string) {
+			instrumentation.PushHttpHandlerExchange(instanceName, errorCode)
+			instrumentation.PushHttpHandlerDuration(ctx, instanceName, errorCode, time.Since(start))
+		}
 
 		// Get the Diameter Request
 		jRequest, err := ioutil.ReadAll(req.Body)
@@ -51,39 +99,52 @@ func getDiameterRequestHandler(handlerFunc diampeer.MessageHandler) func(w http.
 			logger.Error("error reading request %s", err)
 			w.Write([]byte(err.Error()))
 			w.WriteHeader(http.StatusInternalServerError)
-			instrumentation.PushHttpHandlerExchange(NETWORK_ERROR)
+			pushExchange(NETWORK_ERROR)
+			return
+		}
+		contentType, err := core.ParseContentType(req.Header.Get("Content-Type"))
+		if err != nil {
+			logger.Errorf("error in request content type %s", err)
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			w.Write([]byte(err.Error()))
+			pushExchange(UNSERIALIZATION_ERROR)
 			return
 		}
 		var request diamcodec.DiameterMessage
-		if err = json.Unmarshal(jRequest, &request); err != nil {
+		if err = core.Unmarshal(contentType, jRequest, &request); err != nil {
 			logger.Error("error unmarshalling request %s", err)
 			w.Write([]byte(err.Error()))
 			w.WriteHeader(http.StatusInternalServerError)
-			instrumentation.PushHttpHandlerExchange(UNSERIALIZATION_ERROR)
+			pushExchange(UNSERIALIZATION_ERROR)
 			return
 		}
 
 		// Generate the Diameter Answer, invoking the passed function
-		answer, err := handlerFunc(&request)
+		ctx, span := telemetry.StartServerSpan(telemetry.ExtractHTTP(ctx, req.Header), "handle "+request.CommandName, telemetry.DiameterAttributes(&request)...)
+		ctx, cancel := core.ContextFromHeaders(ctx, req.Header)
+		defer cancel()
+		answer, err := handlerFunc(ctx, &request)
+		telemetry.EndSpan(span, err)
 		if err != nil {
-			logger.Errorf("error handling request %s", err)
+			logger.Errorw(fmt.Sprintf("error handling request %s", err), append(request.LogFields(), "trace-id", core.TraceId(ctx))...)
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
-			instrumentation.PushHttpHandlerExchange(HANDLER_FUNCTION_ERROR)
+			pushExchange(HANDLER_FUNCTION_ERROR)
 			return
 		}
-		jAnswer, err := json.Marshal(answer)
+		jAnswer, err := core.Marshal(contentType, answer)
 		if err != nil {
 			logger.Errorf("error marshaling response %s", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
-			instrumentation.PushHttpHandlerExchange(SERIALIZATION_ERROR)
+			pushExchange(SERIALIZATION_ERROR)
 			return
 		}
+		w.Header().Set("Content-Type", contentType)
 		w.Write(jAnswer)
 		w.WriteHeader(http.StatusOK)
+		pushExchange(SUCCESS)
 	}
 
-	instrumentation.PushHttpHandlerExchange(SUCCESS)
 	return h
 }
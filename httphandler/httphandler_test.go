@@ -1,16 +1,32 @@
 package httphandler
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"igor/config"
+	"igor/core"
 	"igor/diamcodec"
+	"igor/diampeer"
 	"igor/handlerfunctions"
+	"igor/instrumentation"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -104,3 +120,298 @@ func TestBasicHandler(t *testing.T) {
 
 	fmt.Println(diameterAnswer)
 }
+
+func TestHandlerRetry(t *testing.T) {
+
+	var request diamcodec.DiameterMessage
+	if err := json.Unmarshal([]byte(jDiameterMessage), &request); err != nil {
+		t.Fatalf("unmarshal error for diameter message: %s", err)
+	}
+
+	// Handler that fails the first time with a transient error
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(jDiameterMessage))
+	}))
+	defer server.Close()
+
+	// Idempotent requests are retried
+	if _, err := HttpDiameterRequestWithRetry(*server.Client(), []string{server.URL}, &request, time.Now().Add(1*time.Second), true, core.CONTENT_TYPE_JSON); err != nil {
+		t.Fatalf("idempotent request failed: %s", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("expected 2 invocations but got %d", n)
+	}
+
+	// Non idempotent requests fail fast
+	atomic.StoreInt32(&calls, 0)
+	_, err := HttpDiameterRequestWithRetry(*server.Client(), []string{server.URL}, &request, time.Now().Add(1*time.Second), false, core.CONTENT_TYPE_JSON)
+	var handlerErr *HttpHandlerError
+	if !errors.As(err, &handlerErr) || !handlerErr.Transient {
+		t.Errorf("expected transient handler error but got %v", err)
+	}
+	if !errors.Is(err, core.ErrHandlerFailure) || errors.Is(err, core.ErrTimeout) {
+		t.Errorf("bad error class for %v", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("expected 1 invocation but got %d", n)
+	}
+}
+
+func TestCBORHandler(t *testing.T) {
+
+	var request diamcodec.DiameterMessage
+	if err := json.Unmarshal([]byte(jDiameterMessage), &request); err != nil {
+		t.Fatalf("unmarshal error for diameter message: %s", err)
+	}
+	request.Add("Session-Id", "my-session-id")
+
+	// Handler that echoes the Session-Id and reports the content type received
+	var receivedContentType string
+	echoHandler := func(ctx context.Context, request *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, error) {
+		answer := diamcodec.NewDiameterAnswer(request)
+		answer.Add("Session-Id", request.GetStringAVP("Session-Id"))
+		return answer, nil
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		receivedContentType = req.Header.Get("Content-Type")
+		getDiameterRequestHandler("", echoHandler)(w, req)
+	}))
+	defer server.Close()
+
+	for _, contentType := range []string{core.CONTENT_TYPE_CBOR, core.CONTENT_TYPE_BINARY, core.CONTENT_TYPE_JSON} {
+		answer, err := HttpDiameterRequest(*server.Client(), server.URL, &request, 1*time.Second, contentType)
+		if err != nil {
+			t.Fatalf("%s request failed: %s", contentType, err)
+		}
+		if receivedContentType != contentType {
+			t.Errorf("handler received %s instead of %s", receivedContentType, contentType)
+		}
+		if answer.GetStringAVP("Session-Id") != "my-session-id" {
+			t.Errorf("bad answer for %s: %s", contentType, answer)
+		}
+	}
+
+	// Unsupported content type
+	httpResp, err := server.Client().Post(server.URL, "application/xml", strings.NewReader("<xml/>"))
+	if err != nil {
+		t.Fatalf("error posting request %s", err)
+	}
+	httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("expected unsupported media type but got %d", httpResp.StatusCode)
+	}
+}
+
+func TestUnixSocketListener(t *testing.T) {
+
+	socketPath := filepath.Join(t.TempDir(), "handler.sock")
+	if _, err := NewListener("", 0, socketPath, "06x0"); err == nil {
+		t.Fatal("listener created with bad permissions")
+	}
+
+	listener, err := NewListener("", 0, socketPath, "0600")
+	if err != nil {
+		t.Fatalf("could not create unix socket listener %s", err)
+	}
+	fileInfo, err := os.Stat(socketPath)
+	if err != nil || fileInfo.Mode()&os.ModeSocket == 0 || fileInfo.Mode().Perm() != 0600 {
+		t.Fatalf("bad unix socket file %v %s", fileInfo, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/diameterRequest", getDiameterRequestHandler("", diampeer.IgnoringContext(handlerfunctions.EmptyHandler)))
+	server := http.Server{Handler: mux}
+	go server.Serve(listener)
+	defer server.Close()
+
+	client := http.Client{Timeout: 2 * time.Second, Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		},
+	}}
+	httpResp, err := client.Post("http://localhost/diameterRequest", core.CONTENT_TYPE_JSON, strings.NewReader(jDiameterMessage))
+	if err != nil {
+		t.Fatalf("error posting request through unix socket %s", err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		t.Errorf("got status code %d", httpResp.StatusCode)
+	}
+
+	// The socket may be reused after the server is closed
+	server.Close()
+	if listener, err := NewListener("", 0, socketPath, ""); err != nil {
+		t.Errorf("could not listen again on unix socket %s", err)
+	} else {
+		listener.Close()
+	}
+}
+
+func TestContextPropagation(t *testing.T) {
+
+	var request diamcodec.DiameterMessage
+	if err := json.Unmarshal([]byte(jDiameterMessage), &request); err != nil {
+		t.Fatalf("unmarshal error for diameter message: %s", err)
+	}
+
+	// Handler that reports the trace identifier and deadline received, and waits for the cancellation
+	// if the request so specifies
+	type received struct {
+		traceId     string
+		hasDeadline bool
+		cancelled   bool
+	}
+	receivedChan := make(chan received, 1)
+	handler := func(ctx context.Context, request *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, error) {
+		_, hasDeadline := ctx.Deadline()
+		r := received{traceId: core.TraceId(ctx), hasDeadline: hasDeadline}
+		if request.GetStringAVP("Session-Id") == "wait" {
+			select {
+			case <-ctx.Done():
+				r.cancelled = true
+			case <-time.After(2 * time.Second):
+			}
+		}
+		receivedChan <- r
+		return diamcodec.NewDiameterAnswer(request), nil
+	}
+	server := httptest.NewServer(http.HandlerFunc(getDiameterRequestHandler("", handler)))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(core.WithTraceId(context.Background(), "my-trace-id"), 1*time.Second)
+	defer cancel()
+	if _, err := HttpDiameterRequestWithContext(ctx, *server.Client(), server.URL, &request, core.CONTENT_TYPE_JSON); err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	if r := <-receivedChan; r.traceId != "my-trace-id" || !r.hasDeadline {
+		t.Errorf("bad context in handler: %+v", r)
+	}
+
+	// The handler is cancelled when the client gives up
+	request.Add("Session-Id", "wait")
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	_, err := HttpDiameterRequestWithContext(ctx, *server.Client(), server.URL, &request, core.CONTENT_TYPE_JSON)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected cancellation but got %v", err)
+	}
+	select {
+	case r := <-receivedChan:
+		if !r.cancelled {
+			t.Errorf("handler not cancelled")
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("handler did not finish")
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+
+	var request diamcodec.DiameterMessage
+	if err := json.Unmarshal([]byte(jDiameterMessage), &request); err != nil {
+		t.Fatalf("unmarshal error for diameter message: %s", err)
+	}
+
+	// Certificate of the clients, which is also its own CA
+	certFile, keyFile := writeClientCertificate(t)
+	hc := config.HandlerConfig{ClientCAFile: certFile, BearerTokens: []string{"my-token"}, APIKeys: []string{"my-key"}}
+	tlsConfig, err := ServerTLSConfig(hc)
+	if err != nil {
+		t.Fatalf("could not create TLS configuration: %s", err)
+	}
+
+	server := httptest.NewUnstartedServer(withAuthentication("", func() config.HandlerConfig { return hc },
+		getDiameterRequestHandler("", diampeer.IgnoringContext(handlerfunctions.EmptyHandler))))
+	server.TLS = tlsConfig
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	instrumentation.MS.ResetMetrics()
+
+	testCases := []struct {
+		name     string
+		conf     config.HttpHandlerClientConfig
+		accepted bool
+	}{
+		{"no credentials", config.HttpHandlerClientConfig{}, false},
+		{"no certificate", config.HttpHandlerClientConfig{BearerToken: "my-token"}, false},
+		{"no token", config.HttpHandlerClientConfig{CertFile: certFile, KeyFile: keyFile}, false},
+		{"bad token", config.HttpHandlerClientConfig{CertFile: certFile, KeyFile: keyFile, BearerToken: "bad-token"}, false},
+		{"bearer token", config.HttpHandlerClientConfig{CertFile: certFile, KeyFile: keyFile, BearerToken: "my-token"}, true},
+		{"api key", config.HttpHandlerClientConfig{CertFile: certFile, KeyFile: keyFile, APIKey: "my-key"}, true},
+	}
+	for _, tc := range testCases {
+		client, err := NewHttp2Client(tc.conf, 2*time.Second)
+		if err != nil {
+			t.Fatalf("%s: could not create client %s", tc.name, err)
+		}
+		_, err = HttpDiameterRequest(client, server.URL+"/diameterRequest", &request, 2*time.Second, core.CONTENT_TYPE_JSON)
+		if tc.accepted && err != nil {
+			t.Errorf("%s: request rejected %s", tc.name, err)
+		}
+		if !tc.accepted && err == nil {
+			t.Errorf("%s: request accepted", tc.name)
+		}
+	}
+
+	// The rejections are reported with their own error code
+	time.Sleep(100 * time.Millisecond)
+	hm := instrumentation.MS.HttpHandlerQuery("HttpHandlerExchanges", nil, []string{"ErrorCode"})
+	if hm[instrumentation.HttpHandlerMetricKey{ErrorCode: AUTHENTICATION_ERROR}] != 4 {
+		t.Errorf("bad authentication errors metric %v", hm)
+	}
+	if hm[instrumentation.HttpHandlerMetricKey{ErrorCode: SUCCESS}] != 2 {
+		t.Errorf("bad success metric %v", hm)
+	}
+
+	// The CA file must exist
+	if _, err := NewHttp2Client(config.HttpHandlerClientConfig{CAFile: filepath.Join(t.TempDir(), "missing.pem")}, time.Second); err == nil {
+		t.Error("client created with missing CA file")
+	}
+}
+
+// Generates a self signed certificate for client authentication and writes it and its key to
+// temporary files, returning their names
+func writeClientCertificate(t *testing.T) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "igor-router"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
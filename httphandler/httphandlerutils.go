@@ -2,12 +2,18 @@ package httphandler
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
+	"igor/core"
 	"igor/diamcodec"
 	"igor/instrumentation"
+	"igor/telemetry"
 	"io/ioutil"
 	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
@@ -16,46 +22,173 @@ const (
 	HTTP_RESPONSE_ERROR    = "552"
 	HANDLER_FUNCTION_ERROR = "553"
 	UNSERIALIZATION_ERROR  = "554"
+	AUTHENTICATION_ERROR   = "555"
+	CIRCUIT_OPEN_ERROR     = "556"
 
 	SUCCESS = "200"
 )
 
+// Pause between retries of idempotent requests
+const RETRY_PAUSE_MILLIS = 50
+
+// Error returned when the invocation of an http handler fails
+type HttpHandlerError struct {
+	// The URL of the handler
+	Endpoint string
+
+	// One of the error codes above
+	ErrorCode string
+
+	// True if the failure is due to a network problem or an unavailable handler,
+	// so that the request may be retried
+	Transient bool
+
+	// The underlying error
+	Err error
+}
+
+func (e *HttpHandlerError) Error() string {
+	return fmt.Sprintf("handler %s error %s", e.Endpoint, e.Err)
+}
+
+func (e *HttpHandlerError) Unwrap() error {
+	return e.Err
+}
+
+// Classifies the error as core.ErrHandlerFailure, or core.ErrTimeout if the answer
+// was not received in time
+func (e *HttpHandlerError) Is(target error) bool {
+	switch target {
+	case core.ErrHandlerFailure:
+		return true
+	case core.ErrTimeout:
+		return errors.Is(e.Err, context.DeadlineExceeded)
+	}
+	return false
+}
+
+// Helper to build the error and report the metric, labeled with the error code and class, in the specified
+// configuration instance, at the same time
+func NewHttpHandlerError(instanceName string, endpoint string, errorCode string, transient bool, err error) *HttpHandlerError {
+	handlerError := &HttpHandlerError{Endpoint: endpoint, ErrorCode: errorCode, Transient: transient, Err: err}
+	instrumentation.PushHttpClientExchange(instanceName, endpoint, errorCode, core.ErrorClass(handlerError))
+	return handlerError
+}
+
+// Sends the request to the handlers specified, in order, until an answer is received or the deadline expires.
+// Only idempotent requests are retried, and only if the failure is transient. Otherwise, the error,
+// of type *HttpHandlerError, is returned straight away. The request is serialized with the specified
+// content type (core.CONTENT_TYPE_JSON, core.CONTENT_TYPE_CBOR or core.CONTENT_TYPE_BINARY)
+func HttpDiameterRequestWithRetry(client http.Client, endpoints []string, diameterRequest *diamcodec.DiameterMessage, deadline time.Time, idempotent bool, contentType string) (*diamcodec.DiameterMessage, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	return HttpDiameterRequestWithRetryContext(ctx, client, endpoints, diameterRequest, idempotent, contentType)
+}
+
+// Same as HttpDiameterRequestWithRetry, but the requests are abandoned when the context is done. The context
+// should have a deadline, which is propagated to the handlers together with the trace identifier
+func HttpDiameterRequestWithRetryContext(ctx context.Context, client http.Client, endpoints []string, diameterRequest *diamcodec.DiameterMessage, idempotent bool, contentType string) (*diamcodec.DiameterMessage, error) {
+	return DiameterRequestWithRetry(ctx, endpoints, diameterRequest, idempotent, func(ctx context.Context, endpoint string, request *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, error) {
+		return HttpDiameterRequestWithContext(ctx, client, endpoint, request, contentType)
+	})
+}
+
+// Sends the request to a single handler. The errors returned should be of type *HttpHandlerError, so that
+// the transient ones may be retried
+type DiameterRequestFunc func(ctx context.Context, endpoint string, diameterRequest *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, error)
+
+// Sends the request to the handlers specified, in order, using the function passed, with the same retry
+// policy as HttpDiameterRequestWithRetry. Used for handlers with transports other than http
+func DiameterRequestWithRetry(ctx context.Context, endpoints []string, diameterRequest *diamcodec.DiameterMessage, idempotent bool, send DiameterRequestFunc) (*diamcodec.DiameterMessage, error) {
+
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no handler endpoints specified: %w", core.ErrRouteNotFound)
+	}
+
+	var lastErr error
+	for i := 0; ; i++ {
+		answer, err := send(ctx, endpoints[i%len(endpoints)], diameterRequest)
+		if err == nil {
+			return answer, nil
+		}
+		lastErr = err
+
+		var handlerErr *HttpHandlerError
+		if !idempotent || !errors.As(err, &handlerErr) || !handlerErr.Transient {
+			return nil, err
+		}
+
+		// Retry only if there is time left
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= RETRY_PAUSE_MILLIS*time.Millisecond {
+			return nil, lastErr
+		}
+		select {
+		case <-ctx.Done():
+			return nil, lastErr
+		case <-time.After(RETRY_PAUSE_MILLIS * time.Millisecond):
+		}
+	}
+}
+
 // Helper function to serialize, send request, get response and unserialize Diameter Request
-func HttpDiameterRequest(client http.Client, endpoint string, diameterRequest *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, error) {
+// The request is abandoned if the answer is not received before the specified timeout
+// The answer is unserialized according to its Content-Type, which is JSON if not specified or not supported
+// Errors returned are of type *HttpHandlerError
+func HttpDiameterRequest(client http.Client, endpoint string, diameterRequest *diamcodec.DiameterMessage, timeout time.Duration, contentType string) (*diamcodec.DiameterMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return HttpDiameterRequestWithContext(ctx, client, endpoint, diameterRequest, contentType)
+}
+
+// Same as HttpDiameterRequest, but the request is abandoned when the context is done. The trace identifier
+// and the time left until the deadline of the context, if any, are sent in the headers. The exchange is
+// reported in the metrics of the configuration instance in the context, if any
+func HttpDiameterRequestWithContext(ctx context.Context, client http.Client, endpoint string, diameterRequest *diamcodec.DiameterMessage, contentType string) (answer *diamcodec.DiameterMessage, err error) {
+	ctx, span := telemetry.StartClientSpan(ctx, "http handler "+diameterRequest.CommandName, attribute.String("http.url", endpoint))
+	defer func() { telemetry.EndSpan(span, err) }()
+
 	// Serialize the message
-	jsonRequest, err := json.Marshal(diameterRequest)
+	serializedRequest, err := core.Marshal(contentType, diameterRequest)
 	if err != nil {
-		instrumentation.PushHttpClientExchange(endpoint, SERIALIZATION_ERROR)
-		return nil, fmt.Errorf("unable to marshal message to json %s", err)
+		return nil, NewHttpHandlerError(core.InstanceName(ctx), endpoint, SERIALIZATION_ERROR, false, fmt.Errorf("unable to marshal message to %s %s", contentType, err))
 	}
 
 	// Send the request to the Handler
-	httpResp, err := client.Post(endpoint, "application/json", bytes.NewReader(jsonRequest))
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(serializedRequest))
 	if err != nil {
-		instrumentation.PushHttpClientExchange(endpoint, NETWORK_ERROR)
-		return nil, fmt.Errorf("handler %s error %s", endpoint, err)
+		return nil, NewHttpHandlerError(core.InstanceName(ctx), endpoint, SERIALIZATION_ERROR, false, fmt.Errorf("unable to create request %s", err))
+	}
+	httpReq.Header.Set("Content-Type", contentType)
+	core.SetContextHeaders(ctx, httpReq.Header)
+	telemetry.InjectHTTP(ctx, httpReq.Header)
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, NewHttpHandlerError(core.InstanceName(ctx), endpoint, NETWORK_ERROR, true, err)
 	}
 	defer httpResp.Body.Close()
 
 	if httpResp.StatusCode != 200 {
-		instrumentation.PushHttpClientExchange(endpoint, HTTP_RESPONSE_ERROR)
-		return nil, fmt.Errorf("handler %s returned status code %d", endpoint, httpResp.StatusCode)
+		// Unavailability of the handler is considered transient
+		transient := httpResp.StatusCode == http.StatusBadGateway || httpResp.StatusCode == http.StatusServiceUnavailable || httpResp.StatusCode == http.StatusGatewayTimeout
+		return nil, NewHttpHandlerError(core.InstanceName(ctx), endpoint, HTTP_RESPONSE_ERROR, transient, fmt.Errorf("returned status code %d", httpResp.StatusCode))
 	}
 
-	jsonAnswer, err := ioutil.ReadAll(httpResp.Body)
+	serializedAnswer, err := ioutil.ReadAll(httpResp.Body)
 	if err != nil {
-		instrumentation.PushHttpClientExchange(endpoint, NETWORK_ERROR)
-		return nil, fmt.Errorf("error reading response from %s %s", endpoint, err)
+		return nil, NewHttpHandlerError(core.InstanceName(ctx), endpoint, NETWORK_ERROR, true, fmt.Errorf("error reading response %s", err))
 	}
 
-	// Unserialize to Diameter Message
+	// Unserialize to Diameter Message. Handlers that do not set a supported Content-Type are assumed to answer in JSON
+	answerContentType, err := core.ParseContentType(httpResp.Header.Get("Content-Type"))
+	if err != nil {
+		answerContentType = core.CONTENT_TYPE_JSON
+	}
 	var diameterAnswer diamcodec.DiameterMessage
-	err = json.Unmarshal(jsonAnswer, &diameterAnswer)
+	err = core.Unmarshal(answerContentType, serializedAnswer, &diameterAnswer)
 	if err != nil {
-		instrumentation.PushHttpClientExchange(endpoint, UNSERIALIZATION_ERROR)
-		return nil, fmt.Errorf("error unmarshaling response from %s %s", endpoint, err)
+		return nil, NewHttpHandlerError(core.InstanceName(ctx), endpoint, UNSERIALIZATION_ERROR, false, fmt.Errorf("error unmarshaling response %s", err))
 	}
 
-	instrumentation.PushHttpClientExchange(endpoint, SUCCESS)
+	instrumentation.PushHttpClientExchange(core.InstanceName(ctx), endpoint, SUCCESS, "")
 	return &diameterAnswer, nil
 }
@@ -0,0 +1,44 @@
+package httphandler
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// Permissions of the unix sockets, if not specified in the configuration
+const DEFAULT_UNIX_SOCKET_PERMISSIONS = 0660
+
+// Creates the listener for an http server. If the unix socket path is specified, listens on it
+// instead of on the TCP address, so that the server is only reachable locally. The permissions
+// of the socket are specified as an octal string, such as "0660"
+func NewListener(bindAddress string, bindPort int, unixSocketPath string, unixSocketPermissions string) (net.Listener, error) {
+	if unixSocketPath == "" {
+		return net.Listen("tcp", fmt.Sprintf("%s:%d", bindAddress, bindPort))
+	}
+
+	var permissions os.FileMode = DEFAULT_UNIX_SOCKET_PERMISSIONS
+	if unixSocketPermissions != "" {
+		p, err := strconv.ParseUint(unixSocketPermissions, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad unix socket permissions %q: %w", unixSocketPermissions, err)
+		}
+		permissions = os.FileMode(p)
+	}
+
+	// Remove the socket left by a previous execution
+	if fileInfo, err := os.Stat(unixSocketPath); err == nil && fileInfo.Mode()&os.ModeSocket != 0 {
+		os.Remove(unixSocketPath)
+	}
+
+	listener, err := net.Listen("unix", unixSocketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(unixSocketPath, permissions); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
@@ -0,0 +1,57 @@
+package httphandler
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Roles for access to the http APIs. Each role includes the permissions of the previous ones
+type Role int
+
+const (
+	ROLE_NONE Role = iota
+	ROLE_READONLY
+	ROLE_OPERATOR
+	ROLE_ADMIN
+)
+
+// Returns the role corresponding to the name used in the configuration
+func ParseRole(name string) Role {
+	switch name {
+	case "read-only":
+		return ROLE_READONLY
+	case "operator":
+		return ROLE_OPERATOR
+	case "admin":
+		return ROLE_ADMIN
+	default:
+		return ROLE_NONE
+	}
+}
+
+// Returns the map of access token to role name. A function is used so that the latest configuration
+// is always taken into account
+type AccessTokensFunc func() map[string]string
+
+// Wraps the handler so that it is only executed if the request carries a bearer token
+// with a role equal or higher than the one specified. Otherwise, 401 is returned if the
+// token is missing or unknown, and 403 if the role is not enough
+func WithRole(required Role, accessTokens AccessTokensFunc, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		roleName, found := accessTokens()[token]
+		if token == "" || !found {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if ParseRole(roleName) < required {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		next(w, req)
+	}
+}
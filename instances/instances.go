@@ -0,0 +1,197 @@
+package instances
+
+import (
+	"context"
+	"fmt"
+	"igor/config"
+	radiusClient "igor/radiusclient"
+	"igor/radiusserver"
+	"igor/router"
+	"sort"
+	"sync"
+)
+
+// Several named policy instances may run in the same process. Each one has its own configuration, taken
+// from the objects in the directory with its name, its own diameter router with its peers, its own radius
+// router, client and servers, and its peers table is reported under its name. The instances must be
+// configured with different ports
+
+// A running policy instance
+type Instance struct {
+	Name string
+
+	// Configuration instance object
+	CI *config.PolicyConfigurationManager
+
+	// Nil if no diameter port is configured
+	DiameterRouter *router.DiameterRouter
+
+	// Routes the requests received by the radius servers, and those sent to the upstream radius servers
+	RadiusRouter *router.RadiusRouter
+
+	// Used to send the requests to the upstream radius servers
+	radiusClient *radiusClient.RadiusClient
+
+	// Stops the radius servers
+	cancel context.CancelFunc
+}
+
+// Starts and stops the policy instances. Safe for concurrent use
+type Manager struct {
+	sync.Mutex
+
+	// File or http URL with the configuration search rules of the instances
+	bootstrapFile string
+
+	// Running instances, by name
+	instances map[string]*Instance
+}
+
+// Creates a Manager for the instances whose configuration is found using the specified search rules
+func NewManager(bootstrapFile string) *Manager {
+	return &Manager{
+		bootstrapFile: bootstrapFile,
+		instances:     make(map[string]*Instance),
+	}
+}
+
+// Loads the configuration of the instance and starts its routers and servers. If this is the first configuration
+// instance of the process, it will be the default one, which sets the logger and the global dictionaries.
+// If the instance was started before, its configuration is reloaded
+func (m *Manager) StartInstance(name string) (*Instance, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, found := m.instances[name]; found {
+		return nil, fmt.Errorf("instance %s already running", name)
+	}
+
+	ci, err := m.policyConfig(name)
+	if err != nil {
+		return nil, err
+	}
+
+	instance, err := startInstance(name, ci)
+	if err != nil {
+		return nil, err
+	}
+	m.instances[name] = instance
+
+	config.GetLogger().Infof("instance <%s> started", name)
+	return instance, nil
+}
+
+// Stops the routers and servers of the instance, waiting for the diameter peers to be closed
+func (m *Manager) StopInstance(name string) error {
+	m.Lock()
+	instance, found := m.instances[name]
+	delete(m.instances, name)
+	m.Unlock()
+
+	if !found {
+		return fmt.Errorf("instance %s not running", name)
+	}
+	instance.stop()
+
+	config.GetLogger().Infof("instance <%s> stopped", name)
+	return nil
+}
+
+// Stops all the running instances
+func (m *Manager) StopAll() {
+	for _, name := range m.Instances() {
+		m.StopInstance(name)
+	}
+}
+
+// Returns the running instance with the specified name
+func (m *Manager) Instance(name string) (*Instance, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	instance, found := m.instances[name]
+	return instance, found
+}
+
+// Returns the names of the running instances, sorted
+func (m *Manager) Instances() []string {
+	m.Lock()
+	defer m.Unlock()
+
+	names := make([]string, 0, len(m.instances))
+	for name := range m.instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the configuration instance, initializing it or, if already initialized, reloading it
+func (m *Manager) policyConfig(name string) (ci *config.PolicyConfigurationManager, err error) {
+	if ci, found := config.FindPolicyConfigInstance(name); found {
+		if err := ci.Update(); err != nil {
+			return nil, fmt.Errorf("could not reload configuration of instance %s: %w", name, err)
+		}
+		return ci, nil
+	}
+
+	// The initialization panics if the configuration is wrong
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("could not load configuration of instance %s: %v", name, r)
+		}
+	}()
+	return config.InitPolicyConfigInstance(m.bootstrapFile, name, !config.HasPolicyConfig()), nil
+}
+
+// Creates the routers and servers of the instance. If any of them cannot be created, those already
+// created are stopped
+func startInstance(name string, ci *config.PolicyConfigurationManager) (instance *Instance, err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	instance = &Instance{Name: name, CI: ci, cancel: cancel}
+
+	// The radius servers panic if the socket cannot be created
+	defer func() {
+		if r := recover(); r != nil {
+			instance.stop()
+			instance, err = nil, fmt.Errorf("could not start instance %s: %v", name, r)
+		}
+	}()
+
+	if ci.DiameterServerConf().BindPort != 0 {
+		instance.DiameterRouter = router.NewRouter(name)
+	}
+
+	radiusConf := ci.RadiusServerConf()
+	instance.RadiusRouter = router.NewRadiusRouter(name)
+	if instance.radiusClient, err = radiusClient.NewRadiusClient(ci, radiusConf.BindAddress); err != nil {
+		instance.stop()
+		return nil, fmt.Errorf("could not create radius client of instance %s: %w", name, err)
+	}
+	instance.RadiusRouter.SetRadiusClient(instance.radiusClient)
+
+	for _, port := range []int{radiusConf.AuthPort, radiusConf.AcctPort, radiusConf.CoAPort} {
+		if port != 0 {
+			radiusserver.NewRadiusServerWithContext(ctx, ci, radiusConf.BindAddress, port, instance.RadiusRouter.HandleRadiusRequestWithContext)
+		}
+	}
+
+	return instance, nil
+}
+
+// Stops the radius servers and the routers
+func (instance *Instance) stop() {
+	instance.cancel()
+
+	if instance.RadiusRouter != nil {
+		instance.RadiusRouter.Close()
+		<-instance.RadiusRouter.RouterDoneChannel
+	}
+	if instance.radiusClient != nil {
+		instance.radiusClient.Close()
+	}
+	if instance.DiameterRouter != nil {
+		instance.DiameterRouter.Close()
+		<-instance.DiameterRouter.RouterDoneChannel
+	}
+}
@@ -0,0 +1,134 @@
+package instances
+
+import (
+	"igor/config"
+	"igor/instrumentation"
+	"igor/radiuscodec"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+
+	// Initialize the Config Objects
+	config.InitPolicyConfigInstance("resources/searchRules.json", "testServer", true)
+
+	// Execute the tests and exit
+	os.Exit(m.Run())
+}
+
+func TestInstances(t *testing.T) {
+	manager := NewManager("resources/searchRules.json")
+	defer manager.StopAll()
+
+	tenantA, err := manager.StartInstance("testTenantA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenantB, err := manager.StartInstance("testTenantB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.StartInstance("testTenantA"); err == nil {
+		t.Fatal("instance started twice")
+	}
+	if names := manager.Instances(); len(names) != 2 || names[0] != "testTenantA" || names[1] != "testTenantB" {
+		t.Fatalf("bad instances %v", names)
+	}
+
+	// Each instance handles the requests with its own handlers
+	tenantA.RadiusRouter.SetHandler(radiuscodec.ACCESS_REQUEST, func(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+		return radiuscodec.NewRadiusResponse(request, true), nil
+	})
+	tenantB.RadiusRouter.SetHandler(radiuscodec.ACCESS_REQUEST, func(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+		return radiuscodec.NewRadiusResponse(request, false), nil
+	})
+	if code := sendAccessRequest(t, "127.0.0.1:18160"); code != radiuscodec.ACCESS_ACCEPT {
+		t.Errorf("tenant A answered with code %d", code)
+	}
+	if code := sendAccessRequest(t, "127.0.0.1:18162"); code != radiuscodec.ACCESS_REJECT {
+		t.Errorf("tenant B answered with code %d", code)
+	}
+
+	// The peers tables are reported per instance
+	time.Sleep(500 * time.Millisecond)
+	peerTables := instrumentation.MS.PeersTableQuery()
+	if !isEngaged(peerTables["testTenantA"], "tenantb.igortenant") || !isEngaged(peerTables["testTenantB"], "tenanta.igortenant") {
+		t.Fatalf("tenants not connected %v", peerTables)
+	}
+
+	// After stopping, the ports are released and the peer is down
+	if err := manager.StopInstance("testTenantB"); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.StopInstance("testTenantB"); err == nil {
+		t.Fatal("instance stopped twice")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if isEngaged(instrumentation.MS.PeersTableQuery()["testTenantA"], "tenantb.igortenant") {
+		t.Error("peer of stopped instance still engaged")
+	}
+
+	// Restart, reusing the configuration
+	if _, err := manager.StartInstance("testTenantB"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1 * time.Second)
+	if !isEngaged(instrumentation.MS.PeersTableQuery()["testTenantA"], "tenantb.igortenant") {
+		t.Error("peer of restarted instance not engaged")
+	}
+}
+
+func TestBadInstance(t *testing.T) {
+	manager := NewManager("resources/searchRules.json")
+	if _, err := manager.StartInstance("testNonExisting"); err == nil {
+		t.Fatal("instance without configuration started")
+	}
+	if len(manager.Instances()) != 0 {
+		t.Fatal("failed instance registered")
+	}
+}
+
+// Sends an Access-Request and returns the code of the response
+func sendAccessRequest(t *testing.T, address string) byte {
+	t.Helper()
+
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	request := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+	request.Add("User-Name", "tenant@igor")
+	packet, err := request.ToBytes("secret", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(packet); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buffer := make([]byte, 4096)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := radiuscodec.RadiusPacketFromBytes(buffer[:n], "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.Code
+}
+
+func isEngaged(table instrumentation.DiameterPeersTable, diameterHost string) bool {
+	for _, entry := range table {
+		if entry.DiameterHost == diameterHost {
+			return entry.IsEngaged
+		}
+	}
+	return false
+}
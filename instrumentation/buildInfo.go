@@ -0,0 +1,43 @@
+package instrumentation
+
+import (
+	"os"
+	"runtime"
+	"runtime/debug"
+)
+
+// Version and commit of igor, to be set when building with
+// -ldflags "-X igor/instrumentation.Version=1.2.0 -X igor/instrumentation.Commit=abc123"
+var Version = "dev"
+var Commit = ""
+
+// Identification of the build, reported in the igor_build_info metric
+type BuildInfo struct {
+	Version   string
+	Commit    string
+	GoVersion string
+}
+
+// Returns the version and commit of the running binary. If the commit was not set when building, the
+// revision recorded by the go toolchain, if any, is used
+func GetBuildInfo() BuildInfo {
+	info := BuildInfo{Version: Version, Commit: Commit, GoVersion: runtime.Version()}
+	if info.Commit == "" {
+		if buildInfo, ok := debug.ReadBuildInfo(); ok {
+			for _, setting := range buildInfo.Settings {
+				if setting.Key == "vcs.revision" {
+					info.Commit = setting.Value
+				}
+			}
+		}
+	}
+	return info
+}
+
+// Name of the host, used to label the metrics so that those of different servers may be told apart
+func hostName() string {
+	if name, err := os.Hostname(); err == nil {
+		return name
+	}
+	return "unknown"
+}
@@ -0,0 +1,45 @@
+package instrumentation
+
+// Used as key for the CDR pipeline metrics
+type CDRMetricKey struct {
+	// Name of the configuration instance
+	Instance string
+	// Name of the stage or writer
+	Stage string
+}
+
+// CDR processed successfully by the stage
+type CDRProcessedEvent struct {
+	Key CDRMetricKey
+}
+
+func PushCDRProcessed(instanceName string, stage string) {
+	MS.InputChan <- CDRProcessedEvent{Key: CDRMetricKey{Instance: instanceName, Stage: stage}}
+}
+
+// CDR filtered out by the stage, for instance because it is duplicated
+type CDRDroppedEvent struct {
+	Key CDRMetricKey
+}
+
+func PushCDRDropped(instanceName string, stage string) {
+	MS.InputChan <- CDRDroppedEvent{Key: CDRMetricKey{Instance: instanceName, Stage: stage}}
+}
+
+// CDR discarded due to an error in the stage
+type CDRErrorEvent struct {
+	Key CDRMetricKey
+}
+
+func PushCDRError(instanceName string, stage string) {
+	MS.InputChan <- CDRErrorEvent{Key: CDRMetricKey{Instance: instanceName, Stage: stage}}
+}
+
+// CDR not accepted because the queue of the stage was full
+type CDRQueueFullEvent struct {
+	Key CDRMetricKey
+}
+
+func PushCDRQueueFull(instanceName string, stage string) {
+	MS.InputChan <- CDRQueueFullEvent{Key: CDRMetricKey{Instance: instanceName, Stage: stage}}
+}
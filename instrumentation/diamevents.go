@@ -1,6 +1,7 @@
 package instrumentation
 
 import (
+	"context"
 	"igor/diamcodec"
 	"time"
 )
@@ -8,26 +9,28 @@ import (
 // Used as key for diameter metrics, both in storage and as a way to specify queries,
 // where the fields with non zero values will be used for aggregation
 type PeerDiameterMetricKey struct {
-	Peer string
-	OH   string
-	OR   string
-	DH   string
-	DR   string
-	AP   string
-	CM   string
+	Instance string
+	Peer     string
+	OH       string
+	OR       string
+	DH       string
+	DR       string
+	AP       string
+	CM       string
 }
 
-// Generates a PeerDiameterMetric from a specified Diameter Message
-func PeerDiameterMetricFromMessage(peerName string, diameterMessage *diamcodec.DiameterMessage) PeerDiameterMetricKey {
+// Generates a PeerDiameterMetric from a specified Diameter Message, handled in the specified configuration instance
+func PeerDiameterMetricFromMessage(instanceName string, peerName string, diameterMessage *diamcodec.DiameterMessage) PeerDiameterMetricKey {
 
 	return PeerDiameterMetricKey{
-		Peer: peerName,
-		OH:   diameterMessage.GetStringAVP("Origin-Host"),
-		OR:   diameterMessage.GetStringAVP("Origin-Realm"),
-		DH:   diameterMessage.GetStringAVP("Destination-Host"),
-		DR:   diameterMessage.GetStringAVP("Destination-Realm"),
-		AP:   diameterMessage.ApplicationName,
-		CM:   diameterMessage.CommandName,
+		Instance: instanceName,
+		Peer:     peerName,
+		OH:       diameterMessage.GetStringAVP("Origin-Host"),
+		OR:       diameterMessage.GetStringAVP("Origin-Realm"),
+		DH:       diameterMessage.GetStringAVP("Destination-Host"),
+		DR:       diameterMessage.GetStringAVP("Destination-Realm"),
+		AP:       diameterMessage.ApplicationName,
+		CM:       diameterMessage.CommandName,
 	}
 }
 
@@ -45,6 +48,12 @@ Diameter Client
 Router
 	RouterRouteNotFound
 	RouterHandlerError
+	RouterPartnerRejected
+	RouterBudgetExhausted
+	RouterBulkheadRejected
+	RouterFailover
+	RouterDuplicateRequest
+	RouterOverloadShed
 */
 
 // Diameter Server
@@ -55,8 +64,8 @@ type PeerDiameterRequestReceivedEvent struct {
 }
 
 // Helper function to send a message to the instrumentation server when a diameter request is received
-func PushPeerDiameterRequestReceived(peerName string, diameterMessage *diamcodec.DiameterMessage) {
-	MS.InputChan <- PeerDiameterRequestReceivedEvent{Key: PeerDiameterMetricFromMessage(peerName, diameterMessage)}
+func PushPeerDiameterRequestReceived(instanceName string, peerName string, diameterMessage *diamcodec.DiameterMessage) {
+	MS.InputChan <- PeerDiameterRequestReceivedEvent{Key: PeerDiameterMetricFromMessage(instanceName, peerName, diameterMessage)}
 }
 
 // Message sent to instrumentation server when a diameter answer is sent in a Peer
@@ -65,8 +74,8 @@ type PeerDiameterAnswerSentEvent struct {
 }
 
 // Helper function to send a message to the instrumentation server when a diameter answer is sent
-func PushPeerDiameterAnswerSent(peerName string, diameterMessage *diamcodec.DiameterMessage) {
-	MS.InputChan <- PeerDiameterAnswerSentEvent{Key: PeerDiameterMetricFromMessage(peerName, diameterMessage)}
+func PushPeerDiameterAnswerSent(instanceName string, peerName string, diameterMessage *diamcodec.DiameterMessage) {
+	MS.InputChan <- PeerDiameterAnswerSentEvent{Key: PeerDiameterMetricFromMessage(instanceName, peerName, diameterMessage)}
 }
 
 // Diameter Client
@@ -77,8 +86,8 @@ type PeerDiameterRequestSentEvent struct {
 }
 
 // Helper function to send a message to the instrumentation server when a diameter request is sent to a Peer
-func PushPeerDiameterRequestSent(peerName string, diameterMessage *diamcodec.DiameterMessage) {
-	MS.InputChan <- PeerDiameterRequestSentEvent{Key: PeerDiameterMetricFromMessage(peerName, diameterMessage)}
+func PushPeerDiameterRequestSent(instanceName string, peerName string, diameterMessage *diamcodec.DiameterMessage) {
+	MS.InputChan <- PeerDiameterRequestSentEvent{Key: PeerDiameterMetricFromMessage(instanceName, peerName, diameterMessage)}
 }
 
 // Message sent to instrumentation server when a diameter answer is received from a Peer
@@ -87,8 +96,8 @@ type PeerDiameterAnswerReceivedEvent struct {
 }
 
 // Helper function to send a message to the instrumentation server when a diameter answer is received from a Peer
-func PushPeerDiameterAnswerReceived(peerName string, diameterMessage *diamcodec.DiameterMessage) {
-	MS.InputChan <- PeerDiameterAnswerReceivedEvent{Key: PeerDiameterMetricFromMessage(peerName, diameterMessage)}
+func PushPeerDiameterAnswerReceived(instanceName string, peerName string, diameterMessage *diamcodec.DiameterMessage) {
+	MS.InputChan <- PeerDiameterAnswerReceivedEvent{Key: PeerDiameterMetricFromMessage(instanceName, peerName, diameterMessage)}
 }
 
 // Message sent to instrumentation server when a diameter request timeout occurs
@@ -97,18 +106,80 @@ type PeerDiameterRequestTimeoutEvent struct {
 }
 
 // Helper function to send a message to the instrumentation server when a diameter request timeout occurs
-func PushPeerDiameterRequestTimeout(peerName string, key PeerDiameterMetricKey) {
+func PushPeerDiameterRequestTimeout(key PeerDiameterMetricKey) {
 	MS.InputChan <- PeerDiameterRequestTimeoutEvent{Key: key}
 }
 
+// Message sent to instrumentation server when the answer to a diameter request sent to a Peer is received
+type PeerDiameterRequestDurationEvent struct {
+	Key      PeerDiameterMetricKey
+	Duration time.Duration
+
+	// Identifier of the trace of the request, if sampled, to be attached as exemplar
+	TraceId string
+}
+
+// Helper function to send the time until the answer to a request sent to a Peer was received
+func PushPeerDiameterRequestDuration(ctx context.Context, key PeerDiameterMetricKey, duration time.Duration) {
+	MS.InputChan <- PeerDiameterRequestDurationEvent{Key: key, Duration: duration, TraceId: exemplarTraceId(ctx)}
+}
+
+// Message sent to instrumentation server when the answer to a diameter request received from a Peer is generated
+type PeerDiameterHandlerDurationEvent struct {
+	Key      PeerDiameterMetricKey
+	Duration time.Duration
+
+	// Identifier of the trace of the request, if sampled, to be attached as exemplar
+	TraceId string
+}
+
+// Helper function to send the time taken to generate the answer to a request received from a Peer
+func PushPeerDiameterHandlerDuration(ctx context.Context, instanceName string, peerName string, diameterMessage *diamcodec.DiameterMessage, duration time.Duration) {
+	MS.InputChan <- PeerDiameterHandlerDurationEvent{Key: PeerDiameterMetricFromMessage(instanceName, peerName, diameterMessage), Duration: duration, TraceId: exemplarTraceId(ctx)}
+}
+
 // Message sent to instrumentation server when a diameter request timeout occurs
 type PeerDiameterAnswerStalledEvent struct {
 	Key PeerDiameterMetricKey
 }
 
 // Helper function to send a message to the instrumentation server when a diameter request timeout occurs
-func PushPeerDiameterAnswerStalled(peerName string, diameterMessage *diamcodec.DiameterMessage) {
-	MS.InputChan <- PeerDiameterAnswerStalledEvent{Key: PeerDiameterMetricFromMessage(peerName, diameterMessage)}
+func PushPeerDiameterAnswerStalled(instanceName string, peerName string, diameterMessage *diamcodec.DiameterMessage) {
+	MS.InputChan <- PeerDiameterAnswerStalledEvent{Key: PeerDiameterMetricFromMessage(instanceName, peerName, diameterMessage)}
+}
+
+// Message sent to instrumentation server when a diameter message is discarded because the egress queue of the peer is full
+type PeerDiameterEgressQueueFullEvent struct {
+	Key PeerDiameterMetricKey
+}
+
+// Helper function to send a message to the instrumentation server when the egress queue of a peer is full
+func PushPeerDiameterEgressQueueFull(instanceName string, peerName string, diameterMessage *diamcodec.DiameterMessage) {
+	MS.InputChan <- PeerDiameterEgressQueueFullEvent{Key: PeerDiameterMetricFromMessage(instanceName, peerName, diameterMessage)}
+}
+
+// Message sent to instrumentation server with the number of messages waiting to be written to a peer
+type PeerEgressQueueDepthEvent struct {
+	Instance string
+	Peer     string
+	Depth    int
+}
+
+// Helper function to send a message to the instrumentation server with the depth of the egress queue of a peer
+func PushPeerEgressQueueDepth(instanceName string, peerName string, depth int) {
+	MS.InputChan <- PeerEgressQueueDepthEvent{Instance: instanceName, Peer: peerName, Depth: depth}
+}
+
+// Message sent to instrumentation server with the last measured skew of the clock of a peer
+type PeerClockSkewEvent struct {
+	Instance string
+	Peer     string
+	Skew     time.Duration
+}
+
+// Helper function to send a message to the instrumentation server with the skew of the clock of a peer
+func PushPeerClockSkew(instanceName string, peerName string, skew time.Duration) {
+	MS.InputChan <- PeerClockSkewEvent{Instance: instanceName, Peer: peerName, Skew: skew}
 }
 
 // Router
@@ -119,8 +190,8 @@ type RouterRouteNotFoundEvent struct {
 }
 
 // Helper function to send a message to the instrumentation server when a diameter request is discarded
-func PushRouterRouteNotFound(peerName string, diameterMessage *diamcodec.DiameterMessage) {
-	MS.InputChan <- RouterRouteNotFoundEvent{Key: PeerDiameterMetricFromMessage(peerName, diameterMessage)}
+func PushRouterRouteNotFound(instanceName string, peerName string, diameterMessage *diamcodec.DiameterMessage) {
+	MS.InputChan <- RouterRouteNotFoundEvent{Key: PeerDiameterMetricFromMessage(instanceName, peerName, diameterMessage)}
 }
 
 // Message sent to instrumentation server when no diameter peer available
@@ -129,8 +200,8 @@ type RouterNoAvailablePeerEvent struct {
 }
 
 // Helper function to send a message to the instrumentation server when a diameter request is discarded
-func PushRouterNoAvailablePeer(peerName string, diameterMessage *diamcodec.DiameterMessage) {
-	MS.InputChan <- RouterNoAvailablePeerEvent{Key: PeerDiameterMetricFromMessage(peerName, diameterMessage)}
+func PushRouterNoAvailablePeer(instanceName string, peerName string, diameterMessage *diamcodec.DiameterMessage) {
+	MS.InputChan <- RouterNoAvailablePeerEvent{Key: PeerDiameterMetricFromMessage(instanceName, peerName, diameterMessage)}
 }
 
 type RouterHandlerError struct {
@@ -138,8 +209,69 @@ type RouterHandlerError struct {
 }
 
 // Helper function to send a message to the instrumentation server when the handler produced an error
-func PushRouterHandlerError(peerName string, diameterMessage *diamcodec.DiameterMessage) {
-	MS.InputChan <- RouterHandlerError{Key: PeerDiameterMetricFromMessage(peerName, diameterMessage)}
+func PushRouterHandlerError(instanceName string, peerName string, diameterMessage *diamcodec.DiameterMessage) {
+	MS.InputChan <- RouterHandlerError{Key: PeerDiameterMetricFromMessage(instanceName, peerName, diameterMessage)}
+}
+
+// Message sent to instrumentation server when a diameter request is rejected due to the roaming partner overrides
+type RouterPartnerRejectedEvent struct {
+	Key PeerDiameterMetricKey
+}
+
+// Helper function to send a message to the instrumentation server when the request of a partner is rejected
+func PushRouterPartnerRejected(instanceName string, partnerName string, diameterMessage *diamcodec.DiameterMessage) {
+	MS.InputChan <- RouterPartnerRejectedEvent{Key: PeerDiameterMetricFromMessage(instanceName, partnerName, diameterMessage)}
+}
+
+// Message sent to instrumentation server when a diameter request is not routed because the requester will have given up
+type RouterBudgetExhaustedEvent struct {
+	Key PeerDiameterMetricKey
+}
+
+// Helper function to send a message to the instrumentation server when the time budget of a request is exhausted
+func PushRouterBudgetExhausted(instanceName string, peerName string, diameterMessage *diamcodec.DiameterMessage) {
+	MS.InputChan <- RouterBudgetExhaustedEvent{Key: PeerDiameterMetricFromMessage(instanceName, peerName, diameterMessage)}
+}
+
+// Message sent to instrumentation server when a diameter request is rejected because the bulkhead of the handler is full
+type RouterBulkheadRejectedEvent struct {
+	Key PeerDiameterMetricKey
+}
+
+// Helper function to send a message to the instrumentation server when the bulkhead of a handler rejects a request
+func PushRouterBulkheadRejected(instanceName string, handlerName string, diameterMessage *diamcodec.DiameterMessage) {
+	MS.InputChan <- RouterBulkheadRejectedEvent{Key: PeerDiameterMetricFromMessage(instanceName, handlerName, diameterMessage)}
+}
+
+// Message sent to instrumentation server when a retransmitted request is answered with the cached answer
+type RouterDuplicateRequestEvent struct {
+	Key PeerDiameterMetricKey
+}
+
+// Helper function to send a message to the instrumentation server when a duplicate request is detected
+func PushRouterDuplicateRequest(instanceName string, peerName string, diameterMessage *diamcodec.DiameterMessage) {
+	MS.InputChan <- RouterDuplicateRequestEvent{Key: PeerDiameterMetricFromMessage(instanceName, peerName, diameterMessage)}
+}
+
+// Message sent to instrumentation server when a diameter request is not sent to a peer, to honor the
+// reduction of traffic requested in its overload report
+type RouterOverloadShedEvent struct {
+	Key PeerDiameterMetricKey
+}
+
+// Helper function to send a message to the instrumentation server when a request is diverted from an overloaded peer
+func PushRouterOverloadShed(instanceName string, peerName string, diameterMessage *diamcodec.DiameterMessage) {
+	MS.InputChan <- RouterOverloadShedEvent{Key: PeerDiameterMetricFromMessage(instanceName, peerName, diameterMessage)}
+}
+
+// Message sent to instrumentation server when a diameter request not answered in time by a peer is retransmitted
+type RouterFailoverEvent struct {
+	Key PeerDiameterMetricKey
+}
+
+// Helper function to send a message to the instrumentation server when a request is retransmitted to another peer
+func PushRouterFailover(instanceName string, peerName string, diameterMessage *diamcodec.DiameterMessage) {
+	MS.InputChan <- RouterFailoverEvent{Key: PeerDiameterMetricFromMessage(instanceName, peerName, diameterMessage)}
 }
 
 // Instrumentation of Diameter Peers table
@@ -150,6 +282,16 @@ type DiameterPeersTableEntry struct {
 	IsEngaged        bool
 	LastStatusChange time.Time
 	LastError        error
+
+	// For active and lazy peers that are down, time of the next connection attempt
+	// and number of consecutive failures
+	NextConnectionAttempt time.Time
+	ConnectionFailures    int
+
+	// Percentage of the traffic to be diverted from the peer, as requested in its overload report,
+	// and time until which the reduction is in force. Zero if the peer is not overloaded
+	OverloadReductionPercent int
+	OverloadExpiration       time.Time
 }
 
 type DiameterPeersTable []DiameterPeersTableEntry
@@ -0,0 +1,454 @@
+package instrumentation
+
+import (
+	"fmt"
+	"time"
+)
+
+// Upper bounds of the buckets of the duration histograms, in seconds. The last bucket, not specified
+// here, holds the durations above the highest bound
+var DURATION_BUCKETS = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Percentiles reported when none is specified in the query
+var DEFAULT_PERCENTILES = []float64{50, 90, 99}
+
+// Histogram of durations, with the DURATION_BUCKETS
+type DurationHistogram struct {
+	// Number of durations in each bucket. Not cumulative
+	Counts []uint64
+
+	// Total number of durations and their sum
+	Count uint64
+	Sum   time.Duration
+}
+
+type PeerDiameterDurations map[PeerDiameterMetricKey]DurationHistogram
+type RadiusDurations map[RadiusMetricKey]DurationHistogram
+type HttpHandlerDurations map[HttpHandlerMetricKey]DurationHistogram
+type SessionQueryDurations map[SessionQueryMetricKey]DurationHistogram
+type SubscriberQueryDurations map[SubscriberQueryMetricKey]DurationHistogram
+
+// Adds the duration to the histogram, that is returned
+func (h DurationHistogram) observe(duration time.Duration) DurationHistogram {
+	if h.Counts == nil {
+		h.Counts = make([]uint64, len(DURATION_BUCKETS)+1)
+	}
+	seconds := duration.Seconds()
+	bucket := len(DURATION_BUCKETS)
+	for i, bound := range DURATION_BUCKETS {
+		if seconds <= bound {
+			bucket = i
+			break
+		}
+	}
+	h.Counts[bucket]++
+	h.Count++
+	h.Sum += duration
+	return h
+}
+
+// Returns a new histogram with the durations of both
+func (h DurationHistogram) add(other DurationHistogram) DurationHistogram {
+	out := DurationHistogram{
+		Counts: make([]uint64, len(DURATION_BUCKETS)+1),
+		Count:  h.Count + other.Count,
+		Sum:    h.Sum + other.Sum,
+	}
+	for i := range out.Counts {
+		if i < len(h.Counts) {
+			out.Counts[i] += h.Counts[i]
+		}
+		if i < len(other.Counts) {
+			out.Counts[i] += other.Counts[i]
+		}
+	}
+	return out
+}
+
+// Estimates the duration below which are the specified percent of the durations, interpolating
+// linearly inside the bucket. If it falls in the last bucket, the highest bound is returned
+func (h DurationHistogram) Percentile(percent float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+
+	rank := percent / 100 * float64(h.Count)
+	var accumulated uint64
+	for i, count := range h.Counts {
+		if count == 0 || float64(accumulated+count) < rank {
+			accumulated += count
+			continue
+		}
+		if i == len(DURATION_BUCKETS) {
+			break
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = DURATION_BUCKETS[i-1]
+		}
+		seconds := lower + (DURATION_BUCKETS[i]-lower)*(rank-float64(accumulated))/float64(count)
+		return time.Duration(seconds * float64(time.Second))
+	}
+	return time.Duration(DURATION_BUCKETS[len(DURATION_BUCKETS)-1] * float64(time.Second))
+}
+
+// Cumulative count of the durations below the bound, as in Prometheus
+type DurationBucket struct {
+	LeMillis float64
+	Count    uint64
+}
+
+// Representation of the histogram for the queries. The durations are in milliseconds and the
+// percentiles are named as "p" followed by the number, such as "p99"
+type DurationSummary struct {
+	Count         uint64
+	AverageMillis float64
+	Percentiles   map[string]float64
+	Buckets       []DurationBucket
+}
+
+// Builds the summary with the specified percentiles
+func (h DurationHistogram) Summary(percentiles []float64) DurationSummary {
+	summary := DurationSummary{
+		Count:       h.Count,
+		Percentiles: make(map[string]float64, len(percentiles)),
+		Buckets:     make([]DurationBucket, 0, len(DURATION_BUCKETS)),
+	}
+	if h.Count > 0 {
+		summary.AverageMillis = float64(h.Sum.Microseconds()) / 1000 / float64(h.Count)
+	}
+	for _, percent := range percentiles {
+		summary.Percentiles[fmt.Sprintf("p%g", percent)] = float64(h.Percentile(percent).Microseconds()) / 1000
+	}
+	var accumulated uint64
+	for i, bound := range DURATION_BUCKETS {
+		if i < len(h.Counts) {
+			accumulated += h.Counts[i]
+		}
+		summary.Buckets = append(summary.Buckets, DurationBucket{LeMillis: bound * 1000, Count: accumulated})
+	}
+	return summary
+}
+
+////////////////////////////////////////////////////////////
+// Diameter Durations
+////////////////////////////////////////////////////////////
+
+// Returns the histograms added by the labels specified. The rest of labels are zeroed
+func GetAggPeerDiameterDurations(durations PeerDiameterDurations, aggLabels []string) PeerDiameterDurations {
+	outDurations := make(PeerDiameterDurations)
+
+	for metricKey, h := range durations {
+		mk := PeerDiameterMetricKey{}
+		for _, key := range aggLabels {
+			switch key {
+			case "Instance":
+				mk.Instance = metricKey.Instance
+			case "Peer":
+				mk.Peer = metricKey.Peer
+			case "OH":
+				mk.OH = metricKey.OH
+			case "OR":
+				mk.OR = metricKey.OR
+			case "DH":
+				mk.DH = metricKey.DH
+			case "DR":
+				mk.DR = metricKey.DR
+			case "AP":
+				mk.AP = metricKey.AP
+			case "CM":
+				mk.CM = metricKey.CM
+			}
+		}
+		outDurations[mk] = outDurations[mk].add(h)
+	}
+
+	return outDurations
+}
+
+// Returns only the histograms whose labels have the values in the filter
+func GetFilteredPeerDiameterDurations(durations PeerDiameterDurations, filter map[string]string) PeerDiameterDurations {
+	outDurations := make(PeerDiameterDurations)
+
+	for metricKey, h := range durations {
+		match := true
+		for key, value := range filter {
+			switch key {
+			case "Instance":
+				match = match && metricKey.Instance == value
+			case "Peer":
+				match = match && metricKey.Peer == value
+			case "OH":
+				match = match && metricKey.OH == value
+			case "OR":
+				match = match && metricKey.OR == value
+			case "DH":
+				match = match && metricKey.DH == value
+			case "DR":
+				match = match && metricKey.DR == value
+			case "AP":
+				match = match && metricKey.AP == value
+			case "CM":
+				match = match && metricKey.CM == value
+			}
+		}
+		if match {
+			outDurations[metricKey] = h
+		}
+	}
+
+	return outDurations
+}
+
+// Gets filtered and aggregated histograms
+func GetPeerDiameterDurations(durations PeerDiameterDurations, filter map[string]string, aggLabels []string) PeerDiameterDurations {
+	return GetAggPeerDiameterDurations(GetFilteredPeerDiameterDurations(durations, filter), aggLabels)
+}
+
+////////////////////////////////////////////////////////////
+// Radius Durations
+////////////////////////////////////////////////////////////
+
+func GetAggRadiusDurations(durations RadiusDurations, aggLabels []string) RadiusDurations {
+	outDurations := make(RadiusDurations)
+
+	for metricKey, h := range durations {
+		mk := RadiusMetricKey{}
+		for _, key := range aggLabels {
+			switch key {
+			case "Instance":
+				mk.Instance = metricKey.Instance
+			case "Code":
+				mk.Code = metricKey.Code
+			case "Endpoint":
+				mk.Endpoint = metricKey.Endpoint
+			}
+		}
+		outDurations[mk] = outDurations[mk].add(h)
+	}
+
+	return outDurations
+}
+
+func GetFilteredRadiusDurations(durations RadiusDurations, filter map[string]string) RadiusDurations {
+	outDurations := make(RadiusDurations)
+
+	for metricKey, h := range durations {
+		match := true
+		for key, value := range filter {
+			switch key {
+			case "Instance":
+				match = match && metricKey.Instance == value
+			case "Code":
+				match = match && metricKey.Code == value
+			case "Endpoint":
+				match = match && metricKey.Endpoint == value
+			}
+		}
+		if match {
+			outDurations[metricKey] = h
+		}
+	}
+
+	return outDurations
+}
+
+func GetRadiusDurations(durations RadiusDurations, filter map[string]string, aggLabels []string) RadiusDurations {
+	return GetAggRadiusDurations(GetFilteredRadiusDurations(durations, filter), aggLabels)
+}
+
+////////////////////////////////////////////////////////////
+// Http Handler Durations
+////////////////////////////////////////////////////////////
+
+func GetAggHttpHandlerDurations(durations HttpHandlerDurations, aggLabels []string) HttpHandlerDurations {
+	outDurations := make(HttpHandlerDurations)
+
+	for metricKey, h := range durations {
+		mk := HttpHandlerMetricKey{}
+		for _, key := range aggLabels {
+			switch key {
+			case "Instance":
+				mk.Instance = metricKey.Instance
+			case "ErrorCode":
+				mk.ErrorCode = metricKey.ErrorCode
+			}
+		}
+		outDurations[mk] = outDurations[mk].add(h)
+	}
+
+	return outDurations
+}
+
+func GetFilteredHttpHandlerDurations(durations HttpHandlerDurations, filter map[string]string) HttpHandlerDurations {
+	outDurations := make(HttpHandlerDurations)
+
+	for metricKey, h := range durations {
+		match := true
+		for key, value := range filter {
+			switch key {
+			case "Instance":
+				match = match && metricKey.Instance == value
+			case "ErrorCode":
+				match = match && metricKey.ErrorCode == value
+			}
+		}
+		if match {
+			outDurations[metricKey] = h
+		}
+	}
+
+	return outDurations
+}
+
+func GetHttpHandlerDurations(durations HttpHandlerDurations, filter map[string]string, aggLabels []string) HttpHandlerDurations {
+	return GetAggHttpHandlerDurations(GetFilteredHttpHandlerDurations(durations, filter), aggLabels)
+}
+
+////////////////////////////////////////////////////////////
+// Session Query Durations
+////////////////////////////////////////////////////////////
+
+func GetAggSessionQueryDurations(durations SessionQueryDurations, aggLabels []string) SessionQueryDurations {
+	outDurations := make(SessionQueryDurations)
+
+	for metricKey, h := range durations {
+		mk := SessionQueryMetricKey{}
+		for _, key := range aggLabels {
+			switch key {
+			case "Instance":
+				mk.Instance = metricKey.Instance
+			case "Query":
+				mk.Query = metricKey.Query
+			}
+		}
+		outDurations[mk] = outDurations[mk].add(h)
+	}
+
+	return outDurations
+}
+
+func GetFilteredSessionQueryDurations(durations SessionQueryDurations, filter map[string]string) SessionQueryDurations {
+	outDurations := make(SessionQueryDurations)
+
+	for metricKey, h := range durations {
+		match := true
+		for key, value := range filter {
+			switch key {
+			case "Instance":
+				match = match && metricKey.Instance == value
+			case "Query":
+				match = match && metricKey.Query == value
+			}
+		}
+		if match {
+			outDurations[metricKey] = h
+		}
+	}
+
+	return outDurations
+}
+
+func GetSessionQueryDurations(durations SessionQueryDurations, filter map[string]string, aggLabels []string) SessionQueryDurations {
+	return GetAggSessionQueryDurations(GetFilteredSessionQueryDurations(durations, filter), aggLabels)
+}
+
+////////////////////////////////////////////////////////////
+// Subscriber Query Durations
+////////////////////////////////////////////////////////////
+
+func GetAggSubscriberQueryDurations(durations SubscriberQueryDurations, aggLabels []string) SubscriberQueryDurations {
+	outDurations := make(SubscriberQueryDurations)
+
+	for metricKey, h := range durations {
+		mk := SubscriberQueryMetricKey{}
+		for _, key := range aggLabels {
+			switch key {
+			case "Instance":
+				mk.Instance = metricKey.Instance
+			case "Result":
+				mk.Result = metricKey.Result
+			}
+		}
+		outDurations[mk] = outDurations[mk].add(h)
+	}
+
+	return outDurations
+}
+
+func GetFilteredSubscriberQueryDurations(durations SubscriberQueryDurations, filter map[string]string) SubscriberQueryDurations {
+	outDurations := make(SubscriberQueryDurations)
+
+	for metricKey, h := range durations {
+		match := true
+		for key, value := range filter {
+			switch key {
+			case "Instance":
+				match = match && metricKey.Instance == value
+			case "Result":
+				match = match && metricKey.Result == value
+			}
+		}
+		if match {
+			outDurations[metricKey] = h
+		}
+	}
+
+	return outDurations
+}
+
+func GetSubscriberQueryDurations(durations SubscriberQueryDurations, filter map[string]string, aggLabels []string) SubscriberQueryDurations {
+	return GetAggSubscriberQueryDurations(GetFilteredSubscriberQueryDurations(durations, filter), aggLabels)
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+
+// Wrapper to get diameter durations
+func (ms *MetricsServer) DiameterDurationQuery(name string, filter map[string]string, aggLabels []string) PeerDiameterDurations {
+	query := Query{Name: name, Filter: filter, AggLabels: aggLabels, RChan: make(chan interface{})}
+	ms.QueryChan <- query
+	if v, ok := (<-query.RChan).(PeerDiameterDurations); ok {
+		return v
+	}
+	return PeerDiameterDurations{}
+}
+
+// Wrapper to get radius durations
+func (ms *MetricsServer) RadiusDurationQuery(name string, filter map[string]string, aggLabels []string) RadiusDurations {
+	query := Query{Name: name, Filter: filter, AggLabels: aggLabels, RChan: make(chan interface{})}
+	ms.QueryChan <- query
+	if v, ok := (<-query.RChan).(RadiusDurations); ok {
+		return v
+	}
+	return RadiusDurations{}
+}
+
+// Wrapper to get http handler durations
+func (ms *MetricsServer) HttpHandlerDurationQuery(name string, filter map[string]string, aggLabels []string) HttpHandlerDurations {
+	query := Query{Name: name, Filter: filter, AggLabels: aggLabels, RChan: make(chan interface{})}
+	ms.QueryChan <- query
+	if v, ok := (<-query.RChan).(HttpHandlerDurations); ok {
+		return v
+	}
+	return HttpHandlerDurations{}
+}
+
+// Wrapper to get session query durations
+func (ms *MetricsServer) SessionQueryDurationQuery(name string, filter map[string]string, aggLabels []string) SessionQueryDurations {
+	query := Query{Name: name, Filter: filter, AggLabels: aggLabels, RChan: make(chan interface{})}
+	ms.QueryChan <- query
+	if v, ok := (<-query.RChan).(SessionQueryDurations); ok {
+		return v
+	}
+	return SessionQueryDurations{}
+}
+
+// Wrapper to get subscriber query durations
+func (ms *MetricsServer) SubscriberQueryDurationQuery(name string, filter map[string]string, aggLabels []string) SubscriberQueryDurations {
+	query := Query{Name: name, Filter: filter, AggLabels: aggLabels, RChan: make(chan interface{})}
+	ms.QueryChan <- query
+	if v, ok := (<-query.RChan).(SubscriberQueryDurations); ok {
+		return v
+	}
+	return SubscriberQueryDurations{}
+}
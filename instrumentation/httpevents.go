@@ -1,19 +1,29 @@
 package instrumentation
 
+import (
+	"context"
+	"time"
+)
+
 type HttpClientMetricKey struct {
+	Instance  string
 	Endpoint  string
 	ErrorCode string
+
+	// As returned by core.ErrorClass. Empty if successful
+	ErrorClass string
 }
 
 type HttpClientExchangeEvent struct {
 	Key HttpClientMetricKey
 }
 
-func PushHttpClientExchange(endpoint string, errorCode string) {
-	MS.InputChan <- HttpClientExchangeEvent{Key: HttpClientMetricKey{Endpoint: endpoint, ErrorCode: errorCode}}
+func PushHttpClientExchange(instanceName string, endpoint string, errorCode string, errorClass string) {
+	MS.InputChan <- HttpClientExchangeEvent{Key: HttpClientMetricKey{Instance: instanceName, Endpoint: endpoint, ErrorCode: errorCode, ErrorClass: errorClass}}
 }
 
 type HttpHandlerMetricKey struct {
+	Instance  string
 	ErrorCode string
 }
 
@@ -21,6 +31,19 @@ type HttpHandlerExchangeEvent struct {
 	Key HttpHandlerMetricKey
 }
 
-func PushHttpHandlerExchange(errorCode string) {
-	MS.InputChan <- HttpHandlerExchangeEvent{Key: HttpHandlerMetricKey{ErrorCode: errorCode}}
+func PushHttpHandlerExchange(instanceName string, errorCode string) {
+	MS.InputChan <- HttpHandlerExchangeEvent{Key: HttpHandlerMetricKey{Instance: instanceName, ErrorCode: errorCode}}
+}
+
+type HttpHandlerDurationEvent struct {
+	Key      HttpHandlerMetricKey
+	Duration time.Duration
+
+	// Identifier of the trace of the request, if sampled, to be attached as exemplar
+	TraceId string
+}
+
+// The context is that of the request, whose span, if sampled, is referenced as exemplar
+func PushHttpHandlerDuration(ctx context.Context, instanceName string, errorCode string, duration time.Duration) {
+	MS.InputChan <- HttpHandlerDurationEvent{Key: HttpHandlerMetricKey{Instance: instanceName, ErrorCode: errorCode}, Duration: duration, TraceId: exemplarTraceId(ctx)}
 }
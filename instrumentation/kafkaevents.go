@@ -0,0 +1,25 @@
+package instrumentation
+
+// Used as key for the Kafka producer metrics
+type KafkaMetricKey struct {
+	Instance string
+	Topic    string
+}
+
+// Message delivered to the Kafka brokers
+type KafkaMessageSentEvent struct {
+	Key KafkaMetricKey
+}
+
+func PushKafkaMessageSent(instanceName string, topic string) {
+	MS.InputChan <- KafkaMessageSentEvent{Key: KafkaMetricKey{Instance: instanceName, Topic: topic}}
+}
+
+// Message that could not be delivered to the Kafka brokers, or was not queued because the producer was busy
+type KafkaDeliveryFailureEvent struct {
+	Key KafkaMetricKey
+}
+
+func PushKafkaDeliveryFailure(instanceName string, topic string) {
+	MS.InputChan <- KafkaDeliveryFailureEvent{Key: KafkaMetricKey{Instance: instanceName, Topic: topic}}
+}
@@ -1,5 +1,11 @@
 package instrumentation
 
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
 // Buffer for the channel to receive the events
 const INPUT_QUEUE_SIZE = 100
 
@@ -15,6 +21,14 @@ type PeerDiameterMetrics map[PeerDiameterMetricKey]uint64
 type HttpClientMetrics map[HttpClientMetricKey]uint64
 type HttpHandlerMetrics map[HttpHandlerMetricKey]uint64
 type RadiusMetrics map[RadiusMetricKey]uint64
+type CDRMetrics map[CDRMetricKey]uint64
+type KafkaMetrics map[KafkaMetricKey]uint64
+
+// Key of the gauges reported by name, such as the peer or the radius client, in each instance
+type InstanceGaugeKey struct {
+	Instance string
+	Name     string
+}
 
 type Query struct {
 
@@ -44,22 +58,53 @@ type MetricsServer struct {
 	diameterAnswersReceived PeerDiameterMetrics
 	diameterRequestsTimeout PeerDiameterMetrics
 	diameterAnswersStalled  PeerDiameterMetrics
+	diameterEgressQueueFull PeerDiameterMetrics
 
 	// RadiusServer
 	radiusServerRequests  RadiusMetrics
 	radiusServerResponses RadiusMetrics
 	radiusServerDrops     RadiusMetrics
 
+	// Invalid packets received by the RadiusServer, by reason
+	radiusServerUnknownClients    RadiusMetrics
+	radiusServerBadAuthenticators RadiusMetrics
+	radiusServerMalformed         RadiusMetrics
+
+	// Packets not handled because the bulkhead was full
+	radiusServerBulkheadRejected RadiusMetrics
+
+	// Retransmissions answered with the cached response
+	radiusServerDuplicates RadiusMetrics
+
 	// RadiusClient
 	radiusClientRequests         RadiusMetrics
 	radiusClientResponses        RadiusMetrics
 	radiusClientTimeouts         RadiusMetrics
 	radiusClientResponsesStalled RadiusMetrics
 
+	// Sessions
+	radiusFramedIPConflicts RadiusMetrics
+
 	// Router
-	diameterRouteNotFound   PeerDiameterMetrics
-	diameterNoAvailablePeer PeerDiameterMetrics
-	diameterHandlerError    PeerDiameterMetrics
+	diameterRouteNotFound    PeerDiameterMetrics
+	diameterNoAvailablePeer  PeerDiameterMetrics
+	diameterHandlerError     PeerDiameterMetrics
+	diameterPartnerRejected  PeerDiameterMetrics
+	diameterBudgetExhausted  PeerDiameterMetrics
+	diameterBulkheadRejected PeerDiameterMetrics
+	diameterFailover         PeerDiameterMetrics
+	diameterDuplicates       PeerDiameterMetrics
+	diameterOverloadShed     PeerDiameterMetrics
+
+	// CDR Pipeline
+	cdrProcessed CDRMetrics
+	cdrDropped   CDRMetrics
+	cdrErrors    CDRMetrics
+	cdrQueueFull CDRMetrics
+
+	// Kafka producer
+	kafkaMessagesSent     KafkaMetrics
+	kafkaDeliveryFailures KafkaMetrics
 
 	// HttpClient
 	httpClientExchanges HttpClientMetrics
@@ -67,8 +112,45 @@ type MetricsServer struct {
 	// HttpHandler
 	httpHandlerExchanges HttpHandlerMetrics
 
+	// Durations of the requests sent to and received from diameter peers
+	diameterRequestDurations PeerDiameterDurations
+	diameterHandlerDurations PeerDiameterDurations
+
+	// Durations of the radius requests received and sent
+	radiusServerRequestDurations RadiusDurations
+	radiusClientRequestDurations RadiusDurations
+
+	// Durations of the http handler invocations
+	httpHandlerDurations HttpHandlerDurations
+
+	// Durations of the queries to the session store
+	sessionQueryDurations SessionQueryDurations
+
+	// Durations of the lookups of subscribers in the database, by result
+	subscriberQueryDurations SubscriberQueryDurations
+
+	// Prometheus histograms with the same durations, by query name
+	histogramVecs map[string]*prometheus.HistogramVec
+
 	// One PeerTable per instance
 	diameterPeersTables map[string]DiameterPeersTable
+
+	// Last reported depth of the egress queue, per peer
+	diameterEgressQueueDepths map[string]int
+
+	// Last measured skew of the clock, per peer and per radius client
+	diameterPeerClockSkews map[string]time.Duration
+	radiusClientClockSkews map[string]time.Duration
+
+	// Current state of the upstream radius servers, and transitions to each state
+	radiusServerStates       map[string]string
+	radiusServerStateChanges map[RadiusServerStateKey]uint64
+
+	// The same gauges, by instance. The ones above are kept with the last value reported by any instance
+	diameterEgressQueueDepthsByInstance map[InstanceGaugeKey]int
+	diameterPeerClockSkewsByInstance    map[InstanceGaugeKey]time.Duration
+	radiusClientClockSkewsByInstance    map[InstanceGaugeKey]time.Duration
+	radiusServerStatesByInstance        map[InstanceGaugeKey]string
 }
 
 ////////////////////////////////////////////////////////////
@@ -86,6 +168,8 @@ func GetAggPeerDiameterMetrics(peerDiameterMetrics PeerDiameterMetrics, aggLabel
 		mk := PeerDiameterMetricKey{}
 		for _, key := range aggLabels {
 			switch key {
+			case "Instance":
+				mk.Instance = metricKey.Instance
 			case "Peer":
 				mk.Peer = metricKey.Peer
 			case "OH":
@@ -131,6 +215,11 @@ func GetFilteredPeerDiameterMetrics(peerDiameterMetrics PeerDiameterMetrics, fil
 	outer:
 		for key := range filter {
 			switch key {
+			case "Instance":
+				if metricKey.Instance != filter["Instance"] {
+					match = false
+					break outer
+				}
 			case "Peer":
 				if metricKey.Peer != filter["Peer"] {
 					match = false
@@ -196,6 +285,8 @@ func GetAggRadiusMetrics(radiusMetrics RadiusMetrics, aggLabels []string) Radius
 		mk := RadiusMetricKey{}
 		for _, key := range aggLabels {
 			switch key {
+			case "Instance":
+				mk.Instance = metricKey.Instance
 			case "Code":
 				mk.Code = metricKey.Code
 			case "Endpoint":
@@ -229,6 +320,11 @@ func GetFilteredRadiusMetrics(radiusMetrics RadiusMetrics, filter map[string]str
 	outer:
 		for key := range filter {
 			switch key {
+			case "Instance":
+				if metricKey.Instance != filter["Instance"] {
+					match = false
+					break outer
+				}
 			case "Code":
 				if metricKey.Code != filter["Code"] {
 					match = false
@@ -268,10 +364,14 @@ func GetAggHttpClientMetrics(httpClientMetrics HttpClientMetrics, aggLabels []st
 		mk := HttpClientMetricKey{}
 		for _, key := range aggLabels {
 			switch key {
+			case "Instance":
+				mk.Instance = metricKey.Instance
 			case "Endpoint":
 				mk.Endpoint = metricKey.Endpoint
 			case "ErrorCode":
 				mk.ErrorCode = metricKey.ErrorCode
+			case "ErrorClass":
+				mk.ErrorClass = metricKey.ErrorClass
 			}
 		}
 		if m, found := outMetrics[mk]; found {
@@ -301,6 +401,11 @@ func GetFilteredHttpClientMetrics(httpClientMetrics HttpClientMetrics, filter ma
 	outer:
 		for key := range filter {
 			switch key {
+			case "Instance":
+				if metricKey.Instance != filter["Instance"] {
+					match = false
+					break outer
+				}
 			case "Endpoint":
 				if metricKey.Endpoint != filter["Endpoint"] {
 					match = false
@@ -311,6 +416,11 @@ func GetFilteredHttpClientMetrics(httpClientMetrics HttpClientMetrics, filter ma
 					match = false
 					break outer
 				}
+			case "ErrorClass":
+				if metricKey.ErrorClass != filter["ErrorClass"] {
+					match = false
+					break outer
+				}
 			}
 		}
 
@@ -340,6 +450,8 @@ func GetAggHttpHandlerMetrics(httpHandlerMetrics HttpHandlerMetrics, aggLabels [
 		mk := HttpHandlerMetricKey{}
 		for _, key := range aggLabels {
 			switch key {
+			case "Instance":
+				mk.Instance = metricKey.Instance
 			case "ErrorCode":
 				mk.ErrorCode = metricKey.ErrorCode
 			}
@@ -371,6 +483,11 @@ func GetFilteredHttpHandlerMetrics(httpHandlerMetrics HttpHandlerMetrics, filter
 	outer:
 		for key := range filter {
 			switch key {
+			case "Instance":
+				if metricKey.Instance != filter["Instance"] {
+					match = false
+					break outer
+				}
 			case "ErrorCode":
 				if metricKey.ErrorCode != filter["ErrorCode"] {
 					match = false
@@ -392,14 +509,167 @@ func GetHttpHandlerMetrics(httpHandlerMetrics HttpHandlerMetrics, filter map[str
 	return GetAggHttpHandlerMetrics(GetFilteredHttpHandlerMetrics(httpHandlerMetrics, filter), aggLabels)
 }
 
+////////////////////////////////////////////////////////////
+// CDR Metrics
+////////////////////////////////////////////////////////////
+
+func GetAggCDRMetrics(cdrMetrics CDRMetrics, aggLabels []string) CDRMetrics {
+	outMetrics := make(CDRMetrics)
+
+	// Iterate through the items in the metrics map, group & add by the value of the labels
+	for metricKey, v := range cdrMetrics {
+		// mk will contain the values of the labels that we are aggregating by, the others are zeroed (not initialized)
+		mk := CDRMetricKey{}
+		for _, key := range aggLabels {
+			switch key {
+			case "Instance":
+				mk.Instance = metricKey.Instance
+			case "Stage":
+				mk.Stage = metricKey.Stage
+			}
+		}
+		if m, found := outMetrics[mk]; found {
+			outMetrics[mk] = m + v
+		} else {
+			outMetrics[mk] = v
+		}
+	}
+
+	return outMetrics
+}
+
+func GetFilteredCDRMetrics(cdrMetrics CDRMetrics, filter map[string]string) CDRMetrics {
+
+	// If no filter specified, do nothing
+	if filter == nil {
+		return cdrMetrics
+	}
+
+	// We'll put the output here
+	outMetrics := make(CDRMetrics)
+
+	for metricKey := range cdrMetrics {
+
+		// Check all the items in the filter. If mismatch, get out of the loop
+		match := true
+	outer:
+		for key := range filter {
+			switch key {
+			case "Instance":
+				if metricKey.Instance != filter["Instance"] {
+					match = false
+					break outer
+				}
+			case "Stage":
+				if metricKey.Stage != filter["Stage"] {
+					match = false
+					break outer
+				}
+			}
+		}
+
+		// Filter match
+		if match {
+			outMetrics[metricKey] = cdrMetrics[metricKey]
+		}
+	}
+
+	return outMetrics
+}
+
+func GetCDRMetrics(cdrMetrics CDRMetrics, filter map[string]string, aggLabels []string) CDRMetrics {
+	return GetAggCDRMetrics(GetFilteredCDRMetrics(cdrMetrics, filter), aggLabels)
+}
+
+////////////////////////////////////////////////////////////
+// Kafka Metrics
+////////////////////////////////////////////////////////////
+
+func GetAggKafkaMetrics(kafkaMetrics KafkaMetrics, aggLabels []string) KafkaMetrics {
+	outMetrics := make(KafkaMetrics)
+
+	// Iterate through the items in the metrics map, group & add by the value of the labels
+	for metricKey, v := range kafkaMetrics {
+		// mk will contain the values of the labels that we are aggregating by, the others are zeroed (not initialized)
+		mk := KafkaMetricKey{}
+		for _, key := range aggLabels {
+			switch key {
+			case "Instance":
+				mk.Instance = metricKey.Instance
+			case "Topic":
+				mk.Topic = metricKey.Topic
+			}
+		}
+		if m, found := outMetrics[mk]; found {
+			outMetrics[mk] = m + v
+		} else {
+			outMetrics[mk] = v
+		}
+	}
+
+	return outMetrics
+}
+
+func GetFilteredKafkaMetrics(kafkaMetrics KafkaMetrics, filter map[string]string) KafkaMetrics {
+
+	// If no filter specified, do nothing
+	if filter == nil {
+		return kafkaMetrics
+	}
+
+	// We'll put the output here
+	outMetrics := make(KafkaMetrics)
+
+	for metricKey := range kafkaMetrics {
+
+		// Check all the items in the filter. If mismatch, get out of the loop
+		match := true
+	outer:
+		for key := range filter {
+			switch key {
+			case "Instance":
+				if metricKey.Instance != filter["Instance"] {
+					match = false
+					break outer
+				}
+			case "Topic":
+				if metricKey.Topic != filter["Topic"] {
+					match = false
+					break outer
+				}
+			}
+		}
+
+		// Filter match
+		if match {
+			outMetrics[metricKey] = kafkaMetrics[metricKey]
+		}
+	}
+
+	return outMetrics
+}
+
+func GetKafkaMetrics(kafkaMetrics KafkaMetrics, filter map[string]string, aggLabels []string) KafkaMetrics {
+	return GetAggKafkaMetrics(GetFilteredKafkaMetrics(kafkaMetrics, filter), aggLabels)
+}
+
 //////////////////////////////////////////////////////////////////////////////////
 
 func NewMetricsServer() *MetricsServer {
 	server := MetricsServer{InputChan: make(chan interface{}, INPUT_QUEUE_SIZE), QueryChan: make(chan Query, QUERY_QUEUE_SIZE)}
 
 	// Initialize Metrics
+	server.histogramVecs = newHistogramVecs()
 	server.resetMetrics()
 	server.diameterPeersTables = make(map[string]DiameterPeersTable, 1)
+	server.diameterEgressQueueDepths = make(map[string]int)
+	server.diameterPeerClockSkews = make(map[string]time.Duration)
+	server.radiusClientClockSkews = make(map[string]time.Duration)
+	server.radiusServerStates = make(map[string]string)
+	server.diameterEgressQueueDepthsByInstance = make(map[InstanceGaugeKey]int)
+	server.diameterPeerClockSkewsByInstance = make(map[InstanceGaugeKey]time.Duration)
+	server.radiusClientClockSkewsByInstance = make(map[InstanceGaugeKey]time.Duration)
+	server.radiusServerStatesByInstance = make(map[InstanceGaugeKey]string)
 
 	// Start receive loop
 	go server.metricServerLoop()
@@ -416,23 +686,59 @@ func (ms *MetricsServer) resetMetrics() {
 	ms.diameterAnswersReceived = make(PeerDiameterMetrics)
 	ms.diameterRequestsTimeout = make(PeerDiameterMetrics)
 	ms.diameterAnswersStalled = make(PeerDiameterMetrics)
+	ms.diameterEgressQueueFull = make(PeerDiameterMetrics)
 
 	ms.diameterRouteNotFound = make(PeerDiameterMetrics)
 	ms.diameterNoAvailablePeer = make(PeerDiameterMetrics)
 	ms.diameterHandlerError = make(PeerDiameterMetrics)
+	ms.diameterPartnerRejected = make(PeerDiameterMetrics)
+	ms.diameterBudgetExhausted = make(PeerDiameterMetrics)
+	ms.diameterBulkheadRejected = make(PeerDiameterMetrics)
+	ms.diameterFailover = make(PeerDiameterMetrics)
+	ms.diameterDuplicates = make(PeerDiameterMetrics)
+	ms.diameterOverloadShed = make(PeerDiameterMetrics)
 
 	ms.radiusServerRequests = make(RadiusMetrics)
 	ms.radiusServerResponses = make(RadiusMetrics)
 	ms.radiusServerDrops = make(RadiusMetrics)
 
+	ms.radiusServerUnknownClients = make(RadiusMetrics)
+	ms.radiusServerBadAuthenticators = make(RadiusMetrics)
+	ms.radiusServerMalformed = make(RadiusMetrics)
+	ms.radiusServerBulkheadRejected = make(RadiusMetrics)
+	ms.radiusServerDuplicates = make(RadiusMetrics)
+
 	ms.radiusClientRequests = make(RadiusMetrics)
 	ms.radiusClientResponses = make(RadiusMetrics)
 	ms.radiusClientTimeouts = make(RadiusMetrics)
 	ms.radiusClientResponsesStalled = make(RadiusMetrics)
 
+	ms.radiusFramedIPConflicts = make(RadiusMetrics)
+
+	ms.cdrProcessed = make(CDRMetrics)
+	ms.cdrDropped = make(CDRMetrics)
+	ms.cdrErrors = make(CDRMetrics)
+	ms.cdrQueueFull = make(CDRMetrics)
+
+	ms.kafkaMessagesSent = make(KafkaMetrics)
+	ms.kafkaDeliveryFailures = make(KafkaMetrics)
+
 	ms.httpClientExchanges = make(HttpClientMetrics)
 
 	ms.httpHandlerExchanges = make(HttpHandlerMetrics)
+
+	ms.diameterRequestDurations = make(PeerDiameterDurations)
+	ms.diameterHandlerDurations = make(PeerDiameterDurations)
+	ms.radiusServerRequestDurations = make(RadiusDurations)
+	ms.radiusClientRequestDurations = make(RadiusDurations)
+	ms.httpHandlerDurations = make(HttpHandlerDurations)
+	ms.sessionQueryDurations = make(SessionQueryDurations)
+	ms.subscriberQueryDurations = make(SubscriberQueryDurations)
+	for _, vec := range ms.histogramVecs {
+		vec.Reset()
+	}
+
+	ms.radiusServerStateChanges = make(map[RadiusServerStateKey]uint64)
 }
 
 // Wrapper to reset Diameter Metrics
@@ -464,6 +770,30 @@ func (ms *MetricsServer) RadiusQuery(name string, filter map[string]string, aggL
 	}
 }
 
+// Wrapper to get CDR Pipeline metrics
+func (ms *MetricsServer) CDRQuery(name string, filter map[string]string, aggLabels []string) CDRMetrics {
+	query := Query{Name: name, Filter: filter, AggLabels: aggLabels, RChan: make(chan interface{})}
+	ms.QueryChan <- query
+	v, ok := (<-query.RChan).(CDRMetrics)
+	if ok {
+		return v
+	} else {
+		return CDRMetrics{}
+	}
+}
+
+// Wrapper to get Kafka producer metrics
+func (ms *MetricsServer) KafkaQuery(name string, filter map[string]string, aggLabels []string) KafkaMetrics {
+	query := Query{Name: name, Filter: filter, AggLabels: aggLabels, RChan: make(chan interface{})}
+	ms.QueryChan <- query
+	v, ok := (<-query.RChan).(KafkaMetrics)
+	if ok {
+		return v
+	} else {
+		return KafkaMetrics{}
+	}
+}
+
 // Wrapper to get HttpClient metrics
 func (ms *MetricsServer) HttpClientQuery(name string, filter map[string]string, aggLabels []string) HttpClientMetrics {
 	query := Query{Name: name, Filter: filter, AggLabels: aggLabels, RChan: make(chan interface{})}
@@ -495,6 +825,97 @@ func (ms *MetricsServer) PeersTableQuery() map[string]DiameterPeersTable {
 	return (<-query.RChan).(map[string]DiameterPeersTable)
 }
 
+// Wrapper to get the depth of the egress queues of the diameter peers
+func (ms *MetricsServer) EgressQueueDepthQuery() map[string]int {
+	query := Query{Name: "DiameterEgressQueueDepths", RChan: make(chan interface{})}
+	ms.QueryChan <- query
+	return (<-query.RChan).(map[string]int)
+}
+
+// Wrapper to get the last measured skew of the clocks of the diameter peers
+func (ms *MetricsServer) PeerClockSkewQuery() map[string]time.Duration {
+	query := Query{Name: "DiameterPeerClockSkews", RChan: make(chan interface{})}
+	ms.QueryChan <- query
+	return (<-query.RChan).(map[string]time.Duration)
+}
+
+// Wrapper to get the last measured skew of the clocks of the radius clients
+func (ms *MetricsServer) RadiusClientClockSkewQuery() map[string]time.Duration {
+	query := Query{Name: "RadiusClientClockSkews", RChan: make(chan interface{})}
+	ms.QueryChan <- query
+	return (<-query.RChan).(map[string]time.Duration)
+}
+
+// Wrapper to get the current state of the upstream radius servers
+func (ms *MetricsServer) RadiusServerStatesQuery() map[string]string {
+	query := Query{Name: "RadiusServerStates", RChan: make(chan interface{})}
+	ms.QueryChan <- query
+	return (<-query.RChan).(map[string]string)
+}
+
+// Wrapper to get the number of transitions of the upstream radius servers to each state, added
+// for all the instances
+func (ms *MetricsServer) RadiusServerStateChangesQuery() map[RadiusServerStateKey]uint64 {
+	changes := make(map[RadiusServerStateKey]uint64)
+	for key, value := range ms.RadiusServerStateChangesByInstanceQuery() {
+		changes[RadiusServerStateKey{Server: key.Server, State: key.State}] += value
+	}
+	return changes
+}
+
+// Wrapper to get the depth of the egress queues of the diameter peers, per instance
+func (ms *MetricsServer) EgressQueueDepthByInstanceQuery() map[InstanceGaugeKey]int {
+	query := Query{Name: "DiameterEgressQueueDepthsByInstance", RChan: make(chan interface{})}
+	ms.QueryChan <- query
+	return (<-query.RChan).(map[InstanceGaugeKey]int)
+}
+
+// Wrapper to get the last measured skew of the clocks of the diameter peers, per instance
+func (ms *MetricsServer) PeerClockSkewByInstanceQuery() map[InstanceGaugeKey]time.Duration {
+	query := Query{Name: "DiameterPeerClockSkewsByInstance", RChan: make(chan interface{})}
+	ms.QueryChan <- query
+	return (<-query.RChan).(map[InstanceGaugeKey]time.Duration)
+}
+
+// Wrapper to get the last measured skew of the clocks of the radius clients, per instance
+func (ms *MetricsServer) RadiusClientClockSkewByInstanceQuery() map[InstanceGaugeKey]time.Duration {
+	query := Query{Name: "RadiusClientClockSkewsByInstance", RChan: make(chan interface{})}
+	ms.QueryChan <- query
+	return (<-query.RChan).(map[InstanceGaugeKey]time.Duration)
+}
+
+// Wrapper to get the current state of the upstream radius servers, per instance
+func (ms *MetricsServer) RadiusServerStatesByInstanceQuery() map[InstanceGaugeKey]string {
+	query := Query{Name: "RadiusServerStatesByInstance", RChan: make(chan interface{})}
+	ms.QueryChan <- query
+	return (<-query.RChan).(map[InstanceGaugeKey]string)
+}
+
+// Wrapper to get the number of transitions of the upstream radius servers to each state, per instance
+func (ms *MetricsServer) RadiusServerStateChangesByInstanceQuery() map[RadiusServerStateKey]uint64 {
+	query := Query{Name: "RadiusServerStateChanges", RChan: make(chan interface{})}
+	ms.QueryChan <- query
+	return (<-query.RChan).(map[RadiusServerStateKey]uint64)
+}
+
+// Returns a copy of the map of clock skews, to be sent out of the event loop
+func copySkews(skews map[string]time.Duration) map[string]time.Duration {
+	copied := make(map[string]time.Duration, len(skews))
+	for name, skew := range skews {
+		copied[name] = skew
+	}
+	return copied
+}
+
+// Returns a copy of the map of clock skews per instance, to be sent out of the event loop
+func copySkewsByInstance(skews map[InstanceGaugeKey]time.Duration) map[InstanceGaugeKey]time.Duration {
+	copied := make(map[InstanceGaugeKey]time.Duration, len(skews))
+	for key, skew := range skews {
+		copied[key] = skew
+	}
+	return copied
+}
+
 func (ms *MetricsServer) metricServerLoop() {
 
 	for {
@@ -515,7 +936,9 @@ func (ms *MetricsServer) metricServerLoop() {
 			case "DiameterRequestsTimeout":
 				query.RChan <- GetPeerDiameterMetrics(ms.diameterRequestsTimeout, query.Filter, query.AggLabels)
 			case "DiameterAnswersStalled":
-				query.RChan <- GetPeerDiameterMetrics(ms.diameterAnswersSent, query.Filter, query.AggLabels)
+				query.RChan <- GetPeerDiameterMetrics(ms.diameterAnswersStalled, query.Filter, query.AggLabels)
+			case "DiameterEgressQueueFull":
+				query.RChan <- GetPeerDiameterMetrics(ms.diameterEgressQueueFull, query.Filter, query.AggLabels)
 
 			case "DiameterRouteNotFound":
 				query.RChan <- GetPeerDiameterMetrics(ms.diameterRouteNotFound, query.Filter, query.AggLabels)
@@ -523,6 +946,18 @@ func (ms *MetricsServer) metricServerLoop() {
 				query.RChan <- GetPeerDiameterMetrics(ms.diameterNoAvailablePeer, query.Filter, query.AggLabels)
 			case "DiameterHandlerError":
 				query.RChan <- GetPeerDiameterMetrics(ms.diameterHandlerError, query.Filter, query.AggLabels)
+			case "DiameterPartnerRejected":
+				query.RChan <- GetPeerDiameterMetrics(ms.diameterPartnerRejected, query.Filter, query.AggLabels)
+			case "DiameterBudgetExhausted":
+				query.RChan <- GetPeerDiameterMetrics(ms.diameterBudgetExhausted, query.Filter, query.AggLabels)
+			case "DiameterBulkheadRejected":
+				query.RChan <- GetPeerDiameterMetrics(ms.diameterBulkheadRejected, query.Filter, query.AggLabels)
+			case "DiameterFailover":
+				query.RChan <- GetPeerDiameterMetrics(ms.diameterFailover, query.Filter, query.AggLabels)
+			case "DiameterDuplicates":
+				query.RChan <- GetPeerDiameterMetrics(ms.diameterDuplicates, query.Filter, query.AggLabels)
+			case "DiameterOverloadShed":
+				query.RChan <- GetPeerDiameterMetrics(ms.diameterOverloadShed, query.Filter, query.AggLabels)
 
 			case "RadiusServerRequests":
 				query.RChan <- GetRadiusMetrics(ms.radiusServerRequests, query.Filter, query.AggLabels)
@@ -530,6 +965,16 @@ func (ms *MetricsServer) metricServerLoop() {
 				query.RChan <- GetRadiusMetrics(ms.radiusServerResponses, query.Filter, query.AggLabels)
 			case "RadiusServerDrops":
 				query.RChan <- GetRadiusMetrics(ms.radiusServerDrops, query.Filter, query.AggLabels)
+			case "RadiusServerUnknownClients":
+				query.RChan <- GetRadiusMetrics(ms.radiusServerUnknownClients, query.Filter, query.AggLabels)
+			case "RadiusServerBadAuthenticators":
+				query.RChan <- GetRadiusMetrics(ms.radiusServerBadAuthenticators, query.Filter, query.AggLabels)
+			case "RadiusServerMalformed":
+				query.RChan <- GetRadiusMetrics(ms.radiusServerMalformed, query.Filter, query.AggLabels)
+			case "RadiusServerBulkheadRejected":
+				query.RChan <- GetRadiusMetrics(ms.radiusServerBulkheadRejected, query.Filter, query.AggLabels)
+			case "RadiusServerDuplicates":
+				query.RChan <- GetRadiusMetrics(ms.radiusServerDuplicates, query.Filter, query.AggLabels)
 
 			case "RadiusClientRequests":
 				query.RChan <- GetRadiusMetrics(ms.radiusClientRequests, query.Filter, query.AggLabels)
@@ -540,14 +985,84 @@ func (ms *MetricsServer) metricServerLoop() {
 			case "RadiusClientResponsesStalled":
 				query.RChan <- GetRadiusMetrics(ms.radiusClientResponsesStalled, query.Filter, query.AggLabels)
 
+			case "RadiusFramedIPConflicts":
+				query.RChan <- GetRadiusMetrics(ms.radiusFramedIPConflicts, query.Filter, query.AggLabels)
+
+			case "CDRProcessed":
+				query.RChan <- GetCDRMetrics(ms.cdrProcessed, query.Filter, query.AggLabels)
+			case "CDRDropped":
+				query.RChan <- GetCDRMetrics(ms.cdrDropped, query.Filter, query.AggLabels)
+			case "CDRErrors":
+				query.RChan <- GetCDRMetrics(ms.cdrErrors, query.Filter, query.AggLabels)
+			case "CDRQueueFull":
+				query.RChan <- GetCDRMetrics(ms.cdrQueueFull, query.Filter, query.AggLabels)
+
+			case "KafkaMessagesSent":
+				query.RChan <- GetKafkaMetrics(ms.kafkaMessagesSent, query.Filter, query.AggLabels)
+			case "KafkaDeliveryFailures":
+				query.RChan <- GetKafkaMetrics(ms.kafkaDeliveryFailures, query.Filter, query.AggLabels)
+
 			case "HttpClientExchanges":
 				query.RChan <- GetHttpClientMetrics(ms.httpClientExchanges, query.Filter, query.AggLabels)
 
 			case "HttpHandlerExchanges":
 				query.RChan <- GetHttpHandlerMetrics(ms.httpHandlerExchanges, query.Filter, query.AggLabels)
 
+			case "DiameterRequestDuration":
+				query.RChan <- GetPeerDiameterDurations(ms.diameterRequestDurations, query.Filter, query.AggLabels)
+			case "DiameterHandlerDuration":
+				query.RChan <- GetPeerDiameterDurations(ms.diameterHandlerDurations, query.Filter, query.AggLabels)
+			case "RadiusServerRequestDuration":
+				query.RChan <- GetRadiusDurations(ms.radiusServerRequestDurations, query.Filter, query.AggLabels)
+			case "RadiusClientRequestDuration":
+				query.RChan <- GetRadiusDurations(ms.radiusClientRequestDurations, query.Filter, query.AggLabels)
+			case "HttpHandlerDuration":
+				query.RChan <- GetHttpHandlerDurations(ms.httpHandlerDurations, query.Filter, query.AggLabels)
+			case "SessionQueryDuration":
+				query.RChan <- GetSessionQueryDurations(ms.sessionQueryDurations, query.Filter, query.AggLabels)
+			case "SubscriberQueryDuration":
+				query.RChan <- GetSubscriberQueryDurations(ms.subscriberQueryDurations, query.Filter, query.AggLabels)
+
 			case "DiameterPeersTables":
 				query.RChan <- ms.diameterPeersTables
+			case "DiameterEgressQueueDepths":
+				depths := make(map[string]int, len(ms.diameterEgressQueueDepths))
+				for peer, depth := range ms.diameterEgressQueueDepths {
+					depths[peer] = depth
+				}
+				query.RChan <- depths
+			case "DiameterPeerClockSkews":
+				query.RChan <- copySkews(ms.diameterPeerClockSkews)
+			case "RadiusClientClockSkews":
+				query.RChan <- copySkews(ms.radiusClientClockSkews)
+			case "RadiusServerStates":
+				states := make(map[string]string, len(ms.radiusServerStates))
+				for server, state := range ms.radiusServerStates {
+					states[server] = state
+				}
+				query.RChan <- states
+			case "DiameterEgressQueueDepthsByInstance":
+				depths := make(map[InstanceGaugeKey]int, len(ms.diameterEgressQueueDepthsByInstance))
+				for key, depth := range ms.diameterEgressQueueDepthsByInstance {
+					depths[key] = depth
+				}
+				query.RChan <- depths
+			case "DiameterPeerClockSkewsByInstance":
+				query.RChan <- copySkewsByInstance(ms.diameterPeerClockSkewsByInstance)
+			case "RadiusClientClockSkewsByInstance":
+				query.RChan <- copySkewsByInstance(ms.radiusClientClockSkewsByInstance)
+			case "RadiusServerStatesByInstance":
+				states := make(map[InstanceGaugeKey]string, len(ms.radiusServerStatesByInstance))
+				for key, state := range ms.radiusServerStatesByInstance {
+					states[key] = state
+				}
+				query.RChan <- states
+			case "RadiusServerStateChanges":
+				changes := make(map[RadiusServerStateKey]uint64, len(ms.radiusServerStateChanges))
+				for key, value := range ms.radiusServerStateChanges {
+					changes[key] = value
+				}
+				query.RChan <- changes
 			}
 
 			close(query.RChan)
@@ -605,6 +1120,12 @@ func (ms *MetricsServer) metricServerLoop() {
 				} else {
 					ms.diameterAnswersStalled[e.Key] = curr + 1
 				}
+			case PeerDiameterEgressQueueFullEvent:
+				if curr, ok := ms.diameterEgressQueueFull[e.Key]; !ok {
+					ms.diameterEgressQueueFull[e.Key] = 1
+				} else {
+					ms.diameterEgressQueueFull[e.Key] = curr + 1
+				}
 
 			case RadiusServerRequestEvent:
 				if curr, ok := ms.radiusServerRequests[e.Key]; !ok {
@@ -627,6 +1148,41 @@ func (ms *MetricsServer) metricServerLoop() {
 					ms.radiusServerDrops[e.Key] = curr + 1
 				}
 
+			case RadiusServerUnknownClientEvent:
+				if curr, ok := ms.radiusServerUnknownClients[e.Key]; !ok {
+					ms.radiusServerUnknownClients[e.Key] = 1
+				} else {
+					ms.radiusServerUnknownClients[e.Key] = curr + 1
+				}
+
+			case RadiusServerBadAuthenticatorEvent:
+				if curr, ok := ms.radiusServerBadAuthenticators[e.Key]; !ok {
+					ms.radiusServerBadAuthenticators[e.Key] = 1
+				} else {
+					ms.radiusServerBadAuthenticators[e.Key] = curr + 1
+				}
+
+			case RadiusServerMalformedEvent:
+				if curr, ok := ms.radiusServerMalformed[e.Key]; !ok {
+					ms.radiusServerMalformed[e.Key] = 1
+				} else {
+					ms.radiusServerMalformed[e.Key] = curr + 1
+				}
+
+			case RadiusServerBulkheadRejectedEvent:
+				if curr, ok := ms.radiusServerBulkheadRejected[e.Key]; !ok {
+					ms.radiusServerBulkheadRejected[e.Key] = 1
+				} else {
+					ms.radiusServerBulkheadRejected[e.Key] = curr + 1
+				}
+
+			case RadiusServerDuplicateEvent:
+				if curr, ok := ms.radiusServerDuplicates[e.Key]; !ok {
+					ms.radiusServerDuplicates[e.Key] = 1
+				} else {
+					ms.radiusServerDuplicates[e.Key] = curr + 1
+				}
+
 			case RadiusClientRequestEvent:
 				if curr, ok := ms.radiusClientRequests[e.Key]; !ok {
 					ms.radiusClientRequests[e.Key] = 1
@@ -655,6 +1211,13 @@ func (ms *MetricsServer) metricServerLoop() {
 					ms.radiusClientResponsesStalled[e.Key] = curr + 1
 				}
 
+			case RadiusFramedIPConflictEvent:
+				if curr, ok := ms.radiusFramedIPConflicts[e.Key]; !ok {
+					ms.radiusFramedIPConflicts[e.Key] = 1
+				} else {
+					ms.radiusFramedIPConflicts[e.Key] = curr + 1
+				}
+
 			// Router Events
 
 			case RouterRouteNotFoundEvent:
@@ -675,6 +1238,82 @@ func (ms *MetricsServer) metricServerLoop() {
 				} else {
 					ms.diameterHandlerError[e.Key] = curr + 1
 				}
+			case RouterPartnerRejectedEvent:
+				if curr, ok := ms.diameterPartnerRejected[e.Key]; !ok {
+					ms.diameterPartnerRejected[e.Key] = 1
+				} else {
+					ms.diameterPartnerRejected[e.Key] = curr + 1
+				}
+			case RouterBudgetExhaustedEvent:
+				if curr, ok := ms.diameterBudgetExhausted[e.Key]; !ok {
+					ms.diameterBudgetExhausted[e.Key] = 1
+				} else {
+					ms.diameterBudgetExhausted[e.Key] = curr + 1
+				}
+			case RouterBulkheadRejectedEvent:
+				if curr, ok := ms.diameterBulkheadRejected[e.Key]; !ok {
+					ms.diameterBulkheadRejected[e.Key] = 1
+				} else {
+					ms.diameterBulkheadRejected[e.Key] = curr + 1
+				}
+			case RouterDuplicateRequestEvent:
+				if curr, ok := ms.diameterDuplicates[e.Key]; !ok {
+					ms.diameterDuplicates[e.Key] = 1
+				} else {
+					ms.diameterDuplicates[e.Key] = curr + 1
+				}
+			case RouterOverloadShedEvent:
+				if curr, ok := ms.diameterOverloadShed[e.Key]; !ok {
+					ms.diameterOverloadShed[e.Key] = 1
+				} else {
+					ms.diameterOverloadShed[e.Key] = curr + 1
+				}
+			case RouterFailoverEvent:
+				if curr, ok := ms.diameterFailover[e.Key]; !ok {
+					ms.diameterFailover[e.Key] = 1
+				} else {
+					ms.diameterFailover[e.Key] = curr + 1
+				}
+
+			// CDR Pipeline Events
+			case CDRProcessedEvent:
+				if curr, ok := ms.cdrProcessed[e.Key]; !ok {
+					ms.cdrProcessed[e.Key] = 1
+				} else {
+					ms.cdrProcessed[e.Key] = curr + 1
+				}
+			case CDRDroppedEvent:
+				if curr, ok := ms.cdrDropped[e.Key]; !ok {
+					ms.cdrDropped[e.Key] = 1
+				} else {
+					ms.cdrDropped[e.Key] = curr + 1
+				}
+			case CDRErrorEvent:
+				if curr, ok := ms.cdrErrors[e.Key]; !ok {
+					ms.cdrErrors[e.Key] = 1
+				} else {
+					ms.cdrErrors[e.Key] = curr + 1
+				}
+			case CDRQueueFullEvent:
+				if curr, ok := ms.cdrQueueFull[e.Key]; !ok {
+					ms.cdrQueueFull[e.Key] = 1
+				} else {
+					ms.cdrQueueFull[e.Key] = curr + 1
+				}
+
+			// Kafka producer Events
+			case KafkaMessageSentEvent:
+				if curr, ok := ms.kafkaMessagesSent[e.Key]; !ok {
+					ms.kafkaMessagesSent[e.Key] = 1
+				} else {
+					ms.kafkaMessagesSent[e.Key] = curr + 1
+				}
+			case KafkaDeliveryFailureEvent:
+				if curr, ok := ms.kafkaDeliveryFailures[e.Key]; !ok {
+					ms.kafkaDeliveryFailures[e.Key] = 1
+				} else {
+					ms.kafkaDeliveryFailures[e.Key] = curr + 1
+				}
 
 			// HttpClient Events
 			case HttpClientExchangeEvent:
@@ -692,9 +1331,51 @@ func (ms *MetricsServer) metricServerLoop() {
 					ms.httpHandlerExchanges[e.Key] = curr + 1
 				}
 
+			// Durations
+			case PeerDiameterRequestDurationEvent:
+				ms.diameterRequestDurations[e.Key] = ms.diameterRequestDurations[e.Key].observe(e.Duration)
+				ms.observeHistogramVec("DiameterRequestDuration", e.Duration, e.TraceId, e.Key.Instance, e.Key.Peer, e.Key.AP, e.Key.CM)
+			case PeerDiameterHandlerDurationEvent:
+				ms.diameterHandlerDurations[e.Key] = ms.diameterHandlerDurations[e.Key].observe(e.Duration)
+				ms.observeHistogramVec("DiameterHandlerDuration", e.Duration, e.TraceId, e.Key.Instance, e.Key.Peer, e.Key.AP, e.Key.CM)
+			case RadiusServerRequestDurationEvent:
+				ms.radiusServerRequestDurations[e.Key] = ms.radiusServerRequestDurations[e.Key].observe(e.Duration)
+				ms.observeHistogramVec("RadiusServerRequestDuration", e.Duration, e.TraceId, e.Key.Instance, e.Key.Endpoint, radiusCodeLabel(e.Key.Code))
+			case RadiusClientRequestDurationEvent:
+				ms.radiusClientRequestDurations[e.Key] = ms.radiusClientRequestDurations[e.Key].observe(e.Duration)
+				ms.observeHistogramVec("RadiusClientRequestDuration", e.Duration, e.TraceId, e.Key.Instance, e.Key.Endpoint, radiusCodeLabel(e.Key.Code))
+			case HttpHandlerDurationEvent:
+				ms.httpHandlerDurations[e.Key] = ms.httpHandlerDurations[e.Key].observe(e.Duration)
+				ms.observeHistogramVec("HttpHandlerDuration", e.Duration, e.TraceId, e.Key.Instance, e.Key.ErrorCode)
+			case SessionQueryDurationEvent:
+				ms.sessionQueryDurations[e.Key] = ms.sessionQueryDurations[e.Key].observe(e.Duration)
+				ms.observeHistogramVec("SessionQueryDuration", e.Duration, e.TraceId, e.Key.Instance, e.Key.Query)
+			case SubscriberQueryDurationEvent:
+				ms.subscriberQueryDurations[e.Key] = ms.subscriberQueryDurations[e.Key].observe(e.Duration)
+				ms.observeHistogramVec("SubscriberQueryDuration", e.Duration, e.TraceId, e.Key.Instance, e.Key.Result)
+
 			// PeersTable
 			case DiameterPeersTableUpdatedEvent:
 				ms.diameterPeersTables[e.InstanceName] = e.Table
+
+			case PeerEgressQueueDepthEvent:
+				ms.diameterEgressQueueDepths[e.Peer] = e.Depth
+				ms.diameterEgressQueueDepthsByInstance[InstanceGaugeKey{Instance: e.Instance, Name: e.Peer}] = e.Depth
+
+			case PeerClockSkewEvent:
+				ms.diameterPeerClockSkews[e.Peer] = e.Skew
+				ms.diameterPeerClockSkewsByInstance[InstanceGaugeKey{Instance: e.Instance, Name: e.Peer}] = e.Skew
+
+			case RadiusClientClockSkewEvent:
+				ms.radiusClientClockSkews[e.Client] = e.Skew
+				ms.radiusClientClockSkewsByInstance[InstanceGaugeKey{Instance: e.Instance, Name: e.Client}] = e.Skew
+
+			case RadiusServerStateChangeEvent:
+				ms.radiusServerStates[e.Server] = e.To
+				ms.radiusServerStatesByInstance[InstanceGaugeKey{Instance: e.Instance, Name: e.Server}] = e.To
+				if e.From != "" {
+					ms.radiusServerStateChanges[RadiusServerStateKey{Instance: e.Instance, Server: e.Server, State: e.To}]++
+				}
 			}
 		}
 	}
@@ -1,11 +1,15 @@
 package instrumentation
 
 import (
+	"context"
 	"igor/config"
 	"igor/diamcodec"
 	"os"
 	"testing"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 // Initializer of the test suite.
@@ -31,15 +35,15 @@ func TestDiameterMetrics(t *testing.T) {
 	diameterAnswer.AddOriginAVPs(config.GetPolicyConfig())
 
 	// Generate some metrics
-	PushPeerDiameterRequestReceived("testPeer", diameterRequest)
-	PushPeerDiameterRequestSent("testPeer", diameterRequest)
-	PushPeerDiameterRequestTimeout("testPeer", PeerDiameterMetricFromMessage("testPeer", diameterRequest))
-	PushPeerDiameterAnswerReceived("testPeer", diameterAnswer)
-	PushPeerDiameterAnswerSent("testPeer", diameterAnswer)
-	PushPeerDiameterAnswerStalled("testPeer", diameterAnswer)
-	PushRouterRouteNotFound("testPeer", diameterRequest)
-	PushRouterHandlerError("testPeer", diameterRequest)
-	PushRouterNoAvailablePeer("testPeer", diameterRequest)
+	PushPeerDiameterRequestReceived("testClient", "testPeer", diameterRequest)
+	PushPeerDiameterRequestSent("testClient", "testPeer", diameterRequest)
+	PushPeerDiameterRequestTimeout(PeerDiameterMetricFromMessage("testClient", "testPeer", diameterRequest))
+	PushPeerDiameterAnswerReceived("testClient", "testPeer", diameterAnswer)
+	PushPeerDiameterAnswerSent("testClient", "testPeer", diameterAnswer)
+	PushPeerDiameterAnswerStalled("testClient", "testPeer", diameterAnswer)
+	PushRouterRouteNotFound("testClient", "testPeer", diameterRequest)
+	PushRouterHandlerError("testClient", "testPeer", diameterRequest)
+	PushRouterNoAvailablePeer("testClient", "testPeer", diameterRequest)
 
 	time.Sleep(100 * time.Millisecond)
 
@@ -110,11 +114,11 @@ func TestHttpClientMetrics(t *testing.T) {
 	MS.ResetMetrics()
 	time.Sleep(100 * time.Millisecond)
 
-	PushHttpClientExchange("https://localhost", "200")
-	PushHttpClientExchange("https://localhost", "200")
-	PushHttpHandlerExchange("500")
-	PushHttpHandlerExchange("300")
-	PushHttpHandlerExchange("300")
+	PushHttpClientExchange("testClient", "https://localhost", "200", "")
+	PushHttpClientExchange("testClient", "https://localhost", "200", "")
+	PushHttpHandlerExchange("testClient", "500")
+	PushHttpHandlerExchange("testClient", "300")
+	PushHttpHandlerExchange("testClient", "300")
 
 	time.Sleep(100 * time.Millisecond)
 
@@ -145,13 +149,13 @@ func TestRadiusMetrics(t *testing.T) {
 	MS.ResetMetrics()
 	time.Sleep(100 * time.Millisecond)
 
-	PushRadiusServerRequest("127.0.0.1:1812", "1")
-	PushRadiusServerResponse("127.0.0.1:1812", "2")
-	PushRadiusServerDrop("127.0.0.1:1812", "1")
-	PushRadiusClientRequest("127.0.0.1:1812", "1")
-	PushRadiusClientResponse("127.0.0.1:1812", "2")
-	PushRadiusClientTimeout("127.0.0.1:1812", "1")
-	PushRadiusClientResponseStalled("127.0.0.1:1812", "1")
+	PushRadiusServerRequest("testClient", "127.0.0.1:1812", "1")
+	PushRadiusServerResponse("testClient", "127.0.0.1:1812", "2")
+	PushRadiusServerDrop("testClient", "127.0.0.1:1812", "1")
+	PushRadiusClientRequest("testClient", "127.0.0.1:1812", "1")
+	PushRadiusClientResponse("testClient", "127.0.0.1:1812", "2")
+	PushRadiusClientTimeout("testClient", "127.0.0.1:1812", "1")
+	PushRadiusClientResponseStalled("testClient", "127.0.0.1:1812", "1")
 
 	time.Sleep(100 * time.Millisecond)
 	rm := MS.RadiusQuery("RadiusServerRequests", nil, []string{"Endpoint"})
@@ -199,3 +203,166 @@ func TestRadiusMetrics(t *testing.T) {
 	}
 
 }
+
+func TestRuntimeMetrics(t *testing.T) {
+
+	done := make(chan struct{})
+	defer close(done)
+	for i := 0; i < 3; i++ {
+		go func() { <-done }()
+	}
+
+	metrics := GetRuntimeMetrics()
+	if metrics.Goroutines < 4 {
+		t.Errorf("bad number of goroutines %d", metrics.Goroutines)
+	}
+	if metrics.SubsystemGoroutines["instrumentation"] < 3 {
+		t.Errorf("bad goroutines by subsystem %v", metrics.SubsystemGoroutines)
+	}
+	if metrics.HeapAlloc == 0 || metrics.Sys == 0 {
+		t.Errorf("bad memory metrics %v", metrics)
+	}
+	if metrics.OpenFDs == 0 {
+		t.Errorf("bad number of open file descriptors %d", metrics.OpenFDs)
+	}
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+
+	MS.ResetMetrics()
+	time.Sleep(100 * time.Millisecond)
+
+	diameterRequest, _ := diamcodec.NewDiameterRequest("TestApplication", "TestRequest")
+	diameterRequest.AddOriginAVPs(config.GetPolicyConfig())
+	PushPeerDiameterRequestReceived("testClient", "testPeer", diameterRequest)
+	PushRadiusServerRequest("testClient", "127.0.0.1", string(rune(1)))
+	PushPeerDiameterRequestDuration(context.Background(), PeerDiameterMetricFromMessage("testClient", "testPeer", diameterRequest), 20*time.Millisecond)
+	PushRadiusServerRequestDuration(context.Background(), "testClient", "127.0.0.1", string(rune(1)), 2*time.Millisecond)
+	PushPeerEgressQueueDepth("testClient", "testPeer", 3)
+	PushPeerEgressQueueDepth("otherInstance", "testPeer", 4)
+	time.Sleep(100 * time.Millisecond)
+
+	registry := prometheus.NewRegistry()
+	if err := MS.RegisterPrometheus(registry); err != nil {
+		t.Fatal(err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]*dto.MetricFamily)
+	for _, family := range families {
+		byName[family.GetName()] = family
+	}
+
+	if family, ok := byName["igor_diameter_requests_received_total"]; !ok {
+		t.Error("diameter requests received not found")
+	} else if family.GetType() != dto.MetricType_COUNTER || family.GetHelp() == "" || family.Metric[0].GetCounter().GetValue() != 1 {
+		t.Errorf("bad diameter requests received %v", family)
+	}
+	if family, ok := byName["igor_radius_server_requests_total"]; !ok {
+		t.Error("radius server requests not found")
+	} else if labels := family.Metric[0].GetLabel(); labels[0].GetValue() != "1" || labels[1].GetValue() != "127.0.0.1" {
+		t.Errorf("bad radius server requests labels %v", labels)
+	}
+	if family, ok := byName["igor_diameter_request_duration_seconds"]; !ok {
+		t.Error("diameter request latency not found")
+	} else if h := family.Metric[0].GetHistogram(); family.GetType() != dto.MetricType_HISTOGRAM || h.GetSampleCount() != 1 || h.GetBucket()[4].GetCumulativeCount() != 1 || h.GetBucket()[3].GetCumulativeCount() != 0 {
+		t.Errorf("bad diameter request latency %v", family)
+	}
+	if _, ok := byName["igor_radius_server_duration_seconds"]; !ok {
+		t.Error("radius server latency not found")
+	}
+
+	// The instance and the host are reported in all the metrics
+	for _, name := range []string{"igor_diameter_requests_received_total", "igor_radius_server_requests_total", "igor_diameter_request_duration_seconds"} {
+		if family, ok := byName[name]; !ok {
+			t.Errorf("%s not found", name)
+		} else if labels := labelValues(family.Metric[0]); labels["instance"] != "testClient" || labels["host"] == "" {
+			t.Errorf("bad instance and host labels in %s %v", name, labels)
+		}
+	}
+	if family, ok := byName["igor_diameter_egress_queue_depth"]; !ok || len(family.Metric) != 2 {
+		t.Errorf("egress queue depth not reported per instance %v", family)
+	}
+	if depth := MS.EgressQueueDepthQuery()["testPeer"]; depth != 4 {
+		t.Errorf("egress queue depth should be that last reported but got %d", depth)
+	}
+	if family, ok := byName["igor_build_info"]; !ok {
+		t.Error("build info not found")
+	} else if labels := labelValues(family.Metric[0]); family.Metric[0].GetGauge().GetValue() != 1 || labels["version"] != Version || labels["go_version"] == "" {
+		t.Errorf("bad build info %v", labels)
+	}
+
+	// The histograms are also reset
+	MS.ResetMetrics()
+	time.Sleep(100 * time.Millisecond)
+	families, _ = registry.Gather()
+	for _, family := range families {
+		if family.GetName() == "igor_diameter_request_duration_seconds" {
+			t.Error("diameter request latency not reset")
+		}
+	}
+}
+
+func TestDurationMetrics(t *testing.T) {
+
+	MS.ResetMetrics()
+	time.Sleep(100 * time.Millisecond)
+
+	// 90 in the 5 to 10 ms bucket and 10 in the 100 to 250 ms bucket
+	for i := 0; i < 90; i++ {
+		PushRadiusClientRequestDuration(context.Background(), "testClient", "127.0.0.1:1812", string(rune(1)), 7*time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		PushRadiusClientRequestDuration(context.Background(), "testClient", "127.0.0.2:1812", string(rune(1)), 200*time.Millisecond)
+	}
+	PushHttpHandlerDuration(context.Background(), "testClient", "", 3*time.Millisecond)
+	PushSessionQueryDuration(context.Background(), "testClient", "Get", 30*time.Second)
+	time.Sleep(100 * time.Millisecond)
+
+	// Aggregated by code
+	rd := MS.RadiusDurationQuery("RadiusClientRequestDuration", nil, []string{"Code"})
+	h, ok := rd[RadiusMetricKey{Code: string(rune(1))}]
+	if !ok || h.Count != 100 {
+		t.Fatalf("bad radius client durations %v", rd)
+	}
+	if p50 := h.Percentile(50); p50 < 5*time.Millisecond || p50 > 10*time.Millisecond {
+		t.Errorf("bad p50 %s", p50)
+	}
+	if p95 := h.Percentile(95); p95 < 100*time.Millisecond || p95 > 250*time.Millisecond {
+		t.Errorf("bad p95 %s", p95)
+	}
+	summary := h.Summary([]float64{50, 99.9})
+	if summary.Count != 100 || summary.AverageMillis != 26.3 || summary.Buckets[3].Count != 90 || summary.Buckets[7].Count != 100 {
+		t.Errorf("bad summary %v", summary)
+	}
+	if _, ok := summary.Percentiles["p99.9"]; !ok {
+		t.Errorf("percentile name not found in %v", summary.Percentiles)
+	}
+
+	// Filtered
+	rd = MS.RadiusDurationQuery("RadiusClientRequestDuration", map[string]string{"Endpoint": "127.0.0.2:1812"}, []string{"Endpoint"})
+	if h := rd[RadiusMetricKey{Endpoint: "127.0.0.2:1812"}]; h.Count != 10 || len(rd) != 1 {
+		t.Errorf("bad filtered radius client durations %v", rd)
+	}
+
+	if hd := MS.HttpHandlerDurationQuery("HttpHandlerDuration", nil, nil); hd[HttpHandlerMetricKey{}].Count != 1 {
+		t.Errorf("bad http handler durations %v", hd)
+	}
+
+	// Above the highest bound
+	sd := MS.SessionQueryDurationQuery("SessionQueryDuration", nil, []string{"Query"})
+	if h := sd[SessionQueryMetricKey{Query: "Get"}]; h.Count != 1 || h.Percentile(50) != 10*time.Second {
+		t.Errorf("bad session query durations %v", sd)
+	}
+}
+
+// Returns the labels of the Prometheus metric as a map
+func labelValues(metric *dto.Metric) map[string]string {
+	labels := make(map[string]string)
+	for _, label := range metric.GetLabel() {
+		labels[label.GetName()] = label.GetValue()
+	}
+	return labels
+}
@@ -0,0 +1,296 @@
+package instrumentation
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Exposition of the metrics in the Prometheus format. The counters are kept by the MetricsServer and translated
+// on each scrape, so that they are the same as those returned by the queries. The durations are observed by the
+// MetricsServer both in its histograms, for the queries, and in Prometheus histograms, that keep the exemplars
+
+// Prefix of the names of the metrics
+const PROMETHEUS_NAMESPACE = "igor"
+
+// All the metrics carry the name of the host as a constant label and, as the first variable label, the
+// name of the configuration instance. Prometheus renames the latter to exported_instance when scraping,
+// unless honor_labels is set, because it clashes with the label of the target
+var hostLabels = prometheus.Labels{"host": hostName()}
+
+// Labels of the metrics, that correspond to the fields of the keys
+var diameterLabels = []string{"instance", "peer", "origin_host", "origin_realm", "destination_host", "destination_realm", "application", "command"}
+var radiusLabels = []string{"instance", "endpoint", "code"}
+var cdrLabels = []string{"instance", "stage"}
+var kafkaLabels = []string{"instance", "topic"}
+var httpClientLabels = []string{"instance", "endpoint", "error_code", "error_class"}
+var httpHandlerLabels = []string{"instance", "error_code"}
+var sessionQueryLabels = []string{"instance", "query"}
+var subscriberQueryLabels = []string{"instance", "result"}
+
+// Aggregation labels to use in the queries, so that the keys are not aggregated
+var diameterAggLabels = []string{"Instance", "Peer", "OH", "OR", "DH", "DR", "AP", "CM"}
+var radiusAggLabels = []string{"Instance", "Endpoint", "Code"}
+var cdrAggLabels = []string{"Instance", "Stage"}
+var kafkaAggLabels = []string{"Instance", "Topic"}
+var httpClientAggLabels = []string{"Instance", "Endpoint", "ErrorCode", "ErrorClass"}
+var httpHandlerAggLabels = []string{"Instance", "ErrorCode"}
+var sessionQueryAggLabels = []string{"Instance", "Query"}
+var subscriberQueryAggLabels = []string{"Instance", "Result"}
+
+// Counter exposed to Prometheus. The query is the name of the metric in the MetricsServer
+type prometheusCounter struct {
+	query string
+	desc  *prometheus.Desc
+}
+
+func newPrometheusCounter(query string, name string, help string, labels []string) prometheusCounter {
+	return prometheusCounter{
+		query: query,
+		desc:  prometheus.NewDesc(prometheus.BuildFQName(PROMETHEUS_NAMESPACE, "", name+"_total"), help, labels, hostLabels),
+	}
+}
+
+var diameterCounters = []prometheusCounter{
+	newPrometheusCounter("DiameterRequestsReceived", "diameter_requests_received", "Diameter requests received from peers", diameterLabels),
+	newPrometheusCounter("DiameterAnswersSent", "diameter_answers_sent", "Diameter answers sent to peers", diameterLabels),
+	newPrometheusCounter("DiameterRequestsSent", "diameter_requests_sent", "Diameter requests sent to peers", diameterLabels),
+	newPrometheusCounter("DiameterAnswersReceived", "diameter_answers_received", "Diameter answers received from peers", diameterLabels),
+	newPrometheusCounter("DiameterRequestsTimeout", "diameter_requests_timeout", "Diameter requests sent to peers and not answered in time", diameterLabels),
+	newPrometheusCounter("DiameterAnswersStalled", "diameter_answers_stalled", "Diameter answers received for requests not waiting", diameterLabels),
+	newPrometheusCounter("DiameterEgressQueueFull", "diameter_egress_queue_full", "Diameter messages discarded because the egress queue of the peer was full", diameterLabels),
+	newPrometheusCounter("DiameterRouteNotFound", "diameter_route_not_found", "Diameter requests without a matching routing rule", diameterLabels),
+	newPrometheusCounter("DiameterNoAvailablePeer", "diameter_no_available_peer", "Diameter requests without an available peer to be routed to", diameterLabels),
+	newPrometheusCounter("DiameterHandlerError", "diameter_handler_error", "Diameter requests that got an error from the handler", diameterLabels),
+	newPrometheusCounter("DiameterPartnerRejected", "diameter_partner_rejected", "Diameter requests rejected by the roaming partner policy", diameterLabels),
+	newPrometheusCounter("DiameterBudgetExhausted", "diameter_budget_exhausted", "Diameter requests whose time budget was exhausted", diameterLabels),
+	newPrometheusCounter("DiameterBulkheadRejected", "diameter_bulkhead_rejected", "Diameter requests rejected because the bulkhead of the handler was full", diameterLabels),
+	newPrometheusCounter("DiameterFailover", "diameter_failover", "Diameter requests retransmitted to another peer after a timeout", diameterLabels),
+	newPrometheusCounter("DiameterDuplicates", "diameter_duplicates", "Diameter retransmitted requests answered with the cached answer", diameterLabels),
+	newPrometheusCounter("DiameterOverloadShed", "diameter_overload_shed", "Diameter requests not sent to a peer to honor its overload report", diameterLabels),
+}
+
+var radiusCounters = []prometheusCounter{
+	newPrometheusCounter("RadiusServerRequests", "radius_server_requests", "Radius requests received", radiusLabels),
+	newPrometheusCounter("RadiusServerResponses", "radius_server_responses", "Radius responses sent, by code of the request", radiusLabels),
+	newPrometheusCounter("RadiusServerDrops", "radius_server_drops", "Radius requests not answered", radiusLabels),
+	newPrometheusCounter("RadiusServerUnknownClients", "radius_server_unknown_clients", "Radius packets received from unknown clients", radiusLabels),
+	newPrometheusCounter("RadiusServerBadAuthenticators", "radius_server_bad_authenticators", "Radius packets received with a bad authenticator", radiusLabels),
+	newPrometheusCounter("RadiusServerMalformed", "radius_server_malformed", "Radius packets that could not be decoded", radiusLabels),
+	newPrometheusCounter("RadiusServerBulkheadRejected", "radius_server_bulkhead_rejected", "Radius requests rejected because the bulkhead was full", radiusLabels),
+	newPrometheusCounter("RadiusServerDuplicates", "radius_server_duplicates", "Radius retransmitted requests answered with the cached response", radiusLabels),
+	newPrometheusCounter("RadiusClientRequests", "radius_client_requests", "Radius requests sent to servers", radiusLabels),
+	newPrometheusCounter("RadiusClientResponses", "radius_client_responses", "Radius responses received from servers", radiusLabels),
+	newPrometheusCounter("RadiusClientTimeouts", "radius_client_timeouts", "Radius requests sent to servers and not answered in time", radiusLabels),
+	newPrometheusCounter("RadiusClientResponsesStalled", "radius_client_responses_stalled", "Radius responses received for requests not waiting", radiusLabels),
+	newPrometheusCounter("RadiusFramedIPConflicts", "radius_framed_ip_conflicts", "Radius sessions with a Framed-IP-Address already in use", radiusLabels),
+}
+
+var cdrCounters = []prometheusCounter{
+	newPrometheusCounter("CDRProcessed", "cdr_processed", "CDR processed by the stage", cdrLabels),
+	newPrometheusCounter("CDRDropped", "cdr_dropped", "CDR dropped by the stage", cdrLabels),
+	newPrometheusCounter("CDRErrors", "cdr_errors", "CDR that got an error in the stage", cdrLabels),
+	newPrometheusCounter("CDRQueueFull", "cdr_queue_full", "CDR rejected because the queue of the stage was full", cdrLabels),
+}
+
+var kafkaCounters = []prometheusCounter{
+	newPrometheusCounter("KafkaMessagesSent", "kafka_messages_sent", "Messages delivered to the Kafka brokers", kafkaLabels),
+	newPrometheusCounter("KafkaDeliveryFailures", "kafka_delivery_failures", "Messages that could not be delivered to the Kafka brokers", kafkaLabels),
+}
+
+var httpClientCounter = newPrometheusCounter("HttpClientExchanges", "http_client_exchanges", "Requests sent to http handlers", httpClientLabels)
+var httpHandlerCounter = newPrometheusCounter("HttpHandlerExchanges", "http_handler_exchanges", "Requests received from http clients", httpHandlerLabels)
+
+var egressQueueDepthDesc = prometheus.NewDesc(prometheus.BuildFQName(PROMETHEUS_NAMESPACE, "", "diameter_egress_queue_depth"),
+	"Last reported number of messages waiting to be written to the peer", []string{"instance", "peer"}, hostLabels)
+var peerClockSkewDesc = prometheus.NewDesc(prometheus.BuildFQName(PROMETHEUS_NAMESPACE, "", "diameter_peer_clock_skew_seconds"),
+	"Last measured skew of the clock of the peer", []string{"instance", "peer"}, hostLabels)
+var peerOverloadReductionDesc = prometheus.NewDesc(prometheus.BuildFQName(PROMETHEUS_NAMESPACE, "", "diameter_peer_overload_reduction_percent"),
+	"Percentage of the traffic diverted from the peer as requested in its overload report", []string{"instance", "peer"}, hostLabels)
+var radiusClientClockSkewDesc = prometheus.NewDesc(prometheus.BuildFQName(PROMETHEUS_NAMESPACE, "", "radius_client_clock_skew_seconds"),
+	"Last measured skew of the clock of the radius client", []string{"instance", "client"}, hostLabels)
+var radiusServerStateDesc = prometheus.NewDesc(prometheus.BuildFQName(PROMETHEUS_NAMESPACE, "", "radius_server_state"),
+	"1 for the current state of the upstream radius server (available, quarantine or recovering)", []string{"instance", "server", "state"}, hostLabels)
+var radiusServerStateChangesDesc = prometheus.NewDesc(prometheus.BuildFQName(PROMETHEUS_NAMESPACE, "", "radius_server_state_changes_total"),
+	"Transitions of the upstream radius server to the state", []string{"instance", "server", "state"}, hostLabels)
+
+// Always 1, with the version of igor as labels
+var buildInfoDesc = prometheus.NewDesc(prometheus.BuildFQName(PROMETHEUS_NAMESPACE, "", "build_info"),
+	"Version and commit of the running igor binary", []string{"version", "commit", "go_version"}, hostLabels)
+
+// Histogram exposed to Prometheus. The query is the name of the metric in the MetricsServer, that observes the
+// durations also in a HistogramVec with these options, so that the trace identifiers may be attached as exemplars
+type prometheusHistogram struct {
+	query  string
+	opts   prometheus.HistogramOpts
+	labels []string
+}
+
+func newPrometheusHistogram(query string, name string, help string, labels []string) prometheusHistogram {
+	return prometheusHistogram{
+		query: query,
+		opts: prometheus.HistogramOpts{
+			Namespace:   PROMETHEUS_NAMESPACE,
+			Name:        name + "_duration_seconds",
+			Help:        help,
+			ConstLabels: hostLabels,
+			Buckets:     DURATION_BUCKETS,
+		},
+		labels: labels,
+	}
+}
+
+// The diameter histograms are aggregated by peer, application and command
+var diameterHistogramLabels = []string{"instance", "peer", "application", "command"}
+
+var diameterHistograms = []prometheusHistogram{
+	newPrometheusHistogram("DiameterRequestDuration", "diameter_request", "Time until the answer to the diameter requests sent to peers is received", diameterHistogramLabels),
+	newPrometheusHistogram("DiameterHandlerDuration", "diameter_handler", "Time to generate the answer to the diameter requests received from peers", diameterHistogramLabels),
+}
+
+var radiusHistograms = []prometheusHistogram{
+	newPrometheusHistogram("RadiusServerRequestDuration", "radius_server", "Time to generate the response to the radius requests received", radiusLabels),
+	newPrometheusHistogram("RadiusClientRequestDuration", "radius_client", "Time until the response to the radius requests sent is received", radiusLabels),
+}
+
+var httpHandlerHistogram = newPrometheusHistogram("HttpHandlerDuration", "http_handler", "Time to process the requests received from http clients", httpHandlerLabels)
+var sessionQueryHistogram = newPrometheusHistogram("SessionQueryDuration", "session_query", "Time to execute the queries to the session store", sessionQueryLabels)
+var subscriberQueryHistogram = newPrometheusHistogram("SubscriberQueryDuration", "subscriber_query", "Time to look up the subscribers in the database, by result", subscriberQueryLabels)
+
+// Creates the HistogramVec of each of the histograms, by query name
+func newHistogramVecs() map[string]*prometheus.HistogramVec {
+	vecs := make(map[string]*prometheus.HistogramVec)
+	for _, histograms := range [][]prometheusHistogram{diameterHistograms, radiusHistograms, {httpHandlerHistogram, sessionQueryHistogram, subscriberQueryHistogram}} {
+		for _, histogram := range histograms {
+			vecs[histogram.query] = prometheus.NewHistogramVec(histogram.opts, histogram.labels)
+		}
+	}
+	return vecs
+}
+
+// Observes the duration in the HistogramVec of the query. If the trace identifier is not empty, it is
+// attached as exemplar, which is exported only in the OpenMetrics format
+func (ms *MetricsServer) observeHistogramVec(query string, duration time.Duration, traceId string, labelValues ...string) {
+	observer := ms.histogramVecs[query].WithLabelValues(labelValues...)
+	if exemplarObserver, ok := observer.(prometheus.ExemplarObserver); ok && traceId != "" {
+		exemplarObserver.ObserveWithExemplar(duration.Seconds(), prometheus.Labels{"trace_id": traceId})
+		return
+	}
+	observer.Observe(duration.Seconds())
+}
+
+// Returns the identifier of the trace of the span in the context, to be used as exemplar, or the empty
+// string if there is no span or it is not sampled
+func exemplarTraceId(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsSampled() {
+		return spanContext.TraceID().String()
+	}
+	return ""
+}
+
+// Translates the counters and gauges of the MetricsServer to Prometheus metrics
+type prometheusCollector struct {
+	ms *MetricsServer
+}
+
+func (pc prometheusCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, counters := range [][]prometheusCounter{diameterCounters, radiusCounters, cdrCounters, kafkaCounters, {httpClientCounter, httpHandlerCounter}} {
+		for _, counter := range counters {
+			ch <- counter.desc
+		}
+	}
+	for _, vec := range pc.ms.histogramVecs {
+		vec.Describe(ch)
+	}
+	ch <- egressQueueDepthDesc
+	ch <- peerClockSkewDesc
+	ch <- peerOverloadReductionDesc
+	ch <- radiusClientClockSkewDesc
+	ch <- radiusServerStateDesc
+	ch <- radiusServerStateChangesDesc
+	ch <- buildInfoDesc
+}
+
+func (pc prometheusCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, counter := range diameterCounters {
+		for key, value := range pc.ms.DiameterQuery(counter.query, nil, diameterAggLabels) {
+			ch <- prometheus.MustNewConstMetric(counter.desc, prometheus.CounterValue, float64(value), key.Instance, key.Peer, key.OH, key.OR, key.DH, key.DR, key.AP, key.CM)
+		}
+	}
+	for _, counter := range radiusCounters {
+		for key, value := range pc.ms.RadiusQuery(counter.query, nil, radiusAggLabels) {
+			ch <- prometheus.MustNewConstMetric(counter.desc, prometheus.CounterValue, float64(value), key.Instance, key.Endpoint, radiusCodeLabel(key.Code))
+		}
+	}
+	for _, counter := range cdrCounters {
+		for key, value := range pc.ms.CDRQuery(counter.query, nil, cdrAggLabels) {
+			ch <- prometheus.MustNewConstMetric(counter.desc, prometheus.CounterValue, float64(value), key.Instance, key.Stage)
+		}
+	}
+	for _, counter := range kafkaCounters {
+		for key, value := range pc.ms.KafkaQuery(counter.query, nil, kafkaAggLabels) {
+			ch <- prometheus.MustNewConstMetric(counter.desc, prometheus.CounterValue, float64(value), key.Instance, key.Topic)
+		}
+	}
+	for key, value := range pc.ms.HttpClientQuery(httpClientCounter.query, nil, httpClientAggLabels) {
+		ch <- prometheus.MustNewConstMetric(httpClientCounter.desc, prometheus.CounterValue, float64(value), key.Instance, key.Endpoint, key.ErrorCode, key.ErrorClass)
+	}
+	for key, value := range pc.ms.HttpHandlerQuery(httpHandlerCounter.query, nil, httpHandlerAggLabels) {
+		ch <- prometheus.MustNewConstMetric(httpHandlerCounter.desc, prometheus.CounterValue, float64(value), key.Instance, key.ErrorCode)
+	}
+
+	for _, vec := range pc.ms.histogramVecs {
+		vec.Collect(ch)
+	}
+
+	for key, depth := range pc.ms.EgressQueueDepthByInstanceQuery() {
+		ch <- prometheus.MustNewConstMetric(egressQueueDepthDesc, prometheus.GaugeValue, float64(depth), key.Instance, key.Name)
+	}
+	for key, skew := range pc.ms.PeerClockSkewByInstanceQuery() {
+		ch <- prometheus.MustNewConstMetric(peerClockSkewDesc, prometheus.GaugeValue, skew.Seconds(), key.Instance, key.Name)
+	}
+	// The same peer may appear more than once in the table of an instance
+	overloadReductions := make(map[InstanceGaugeKey]int)
+	for instanceName, peersTable := range pc.ms.PeersTableQuery() {
+		for _, entry := range peersTable {
+			key := InstanceGaugeKey{Instance: instanceName, Name: entry.DiameterHost}
+			if entry.OverloadReductionPercent >= overloadReductions[key] {
+				overloadReductions[key] = entry.OverloadReductionPercent
+			}
+		}
+	}
+	for key, reduction := range overloadReductions {
+		ch <- prometheus.MustNewConstMetric(peerOverloadReductionDesc, prometheus.GaugeValue, float64(reduction), key.Instance, key.Name)
+	}
+	for key, skew := range pc.ms.RadiusClientClockSkewByInstanceQuery() {
+		ch <- prometheus.MustNewConstMetric(radiusClientClockSkewDesc, prometheus.GaugeValue, skew.Seconds(), key.Instance, key.Name)
+	}
+	for key, state := range pc.ms.RadiusServerStatesByInstanceQuery() {
+		ch <- prometheus.MustNewConstMetric(radiusServerStateDesc, prometheus.GaugeValue, 1, key.Instance, key.Name, state)
+	}
+	for key, value := range pc.ms.RadiusServerStateChangesByInstanceQuery() {
+		ch <- prometheus.MustNewConstMetric(radiusServerStateChangesDesc, prometheus.CounterValue, float64(value), key.Instance, key.Server, key.State)
+	}
+
+	buildInfo := GetBuildInfo()
+	ch <- prometheus.MustNewConstMetric(buildInfoDesc, prometheus.GaugeValue, 1, buildInfo.Version, buildInfo.Commit, buildInfo.GoVersion)
+}
+
+// Registers the metrics of the server
+func (ms *MetricsServer) RegisterPrometheus(registerer prometheus.Registerer) error {
+	return registerer.Register(prometheusCollector{ms: ms})
+}
+
+// The radius codes are stored in the keys as the string with the single character of that code
+func radiusCodeLabel(code string) string {
+	if runes := []rune(code); len(runes) == 1 {
+		return strconv.Itoa(int(runes[0]))
+	}
+	return code
+}
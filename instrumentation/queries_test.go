@@ -141,3 +141,22 @@ func TestRadiusAggregations(t *testing.T) {
 		t.Errorf("aggregation should be 2 but got %d", outMetrics[RadiusMetricKey{}])
 	}
 }
+
+func TestInstanceAggregations(t *testing.T) {
+
+	key1 := RadiusMetricKey{Instance: "instance1", Endpoint: "127.0.0.1:1812", Code: "1"}
+	key2 := RadiusMetricKey{Instance: "instance2", Endpoint: "127.0.0.1:1812", Code: "1"}
+
+	myMetrics := RadiusMetrics{key1: 1, key2: 2}
+
+	// Not specifying the instance aggregates all of them
+	outMetrics := GetRadiusMetrics(myMetrics, nil, []string{"Code"})
+	if outMetrics[RadiusMetricKey{Code: "1"}] != 3 {
+		t.Errorf("aggregation should be 3 but got %d", outMetrics[RadiusMetricKey{Code: "1"}])
+	}
+
+	outMetrics = GetRadiusMetrics(myMetrics, map[string]string{"Instance": "instance2"}, []string{"Instance"})
+	if len(outMetrics) != 1 || outMetrics[RadiusMetricKey{Instance: "instance2"}] != 2 {
+		t.Errorf("bad filter by instance %v", outMetrics)
+	}
+}
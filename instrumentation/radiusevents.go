@@ -1,8 +1,15 @@
 package instrumentation
 
+import (
+	"context"
+	"time"
+)
+
 // Used as key for radius metrics, both in storage and as a way to specify queries,
 // where the fields with non zero values will be used for aggregation
 type RadiusMetricKey struct {
+	// Name of the configuration instance
+	Instance string
 	// ip address : port
 	Endpoint string
 	// Radius code
@@ -15,24 +22,93 @@ type RadiusServerRequestEvent struct {
 	Key RadiusMetricKey
 }
 
-func PushRadiusServerRequest(endpoint string, Code string) {
-	MS.InputChan <- RadiusServerRequestEvent{Key: RadiusMetricKey{Endpoint: endpoint, Code: Code}}
+func PushRadiusServerRequest(instanceName string, endpoint string, Code string) {
+	MS.InputChan <- RadiusServerRequestEvent{Key: RadiusMetricKey{Instance: instanceName, Endpoint: endpoint, Code: Code}}
 }
 
 type RadiusServerResponseEvent struct {
 	Key RadiusMetricKey
 }
 
-func PushRadiusServerResponse(endpoint string, Code string) {
-	MS.InputChan <- RadiusServerResponseEvent{Key: RadiusMetricKey{Endpoint: endpoint, Code: Code}}
+func PushRadiusServerResponse(instanceName string, endpoint string, Code string) {
+	MS.InputChan <- RadiusServerResponseEvent{Key: RadiusMetricKey{Instance: instanceName, Endpoint: endpoint, Code: Code}}
 }
 
 type RadiusServerDropEvent struct {
 	Key RadiusMetricKey
 }
 
-func PushRadiusServerDrop(endpoint string, Code string) {
-	MS.InputChan <- RadiusServerDropEvent{Key: RadiusMetricKey{Endpoint: endpoint, Code: Code}}
+func PushRadiusServerDrop(instanceName string, endpoint string, Code string) {
+	MS.InputChan <- RadiusServerDropEvent{Key: RadiusMetricKey{Instance: instanceName, Endpoint: endpoint, Code: Code}}
+}
+
+// Packets from clients not in the configuration
+type RadiusServerUnknownClientEvent struct {
+	Key RadiusMetricKey
+}
+
+func PushRadiusServerUnknownClient(instanceName string, endpoint string, Code string) {
+	MS.InputChan <- RadiusServerUnknownClientEvent{Key: RadiusMetricKey{Instance: instanceName, Endpoint: endpoint, Code: Code}}
+}
+
+// Packets with an authenticator not matching the secret
+type RadiusServerBadAuthenticatorEvent struct {
+	Key RadiusMetricKey
+}
+
+func PushRadiusServerBadAuthenticator(instanceName string, endpoint string, Code string) {
+	MS.InputChan <- RadiusServerBadAuthenticatorEvent{Key: RadiusMetricKey{Instance: instanceName, Endpoint: endpoint, Code: Code}}
+}
+
+// Packets that could not be decoded
+type RadiusServerMalformedEvent struct {
+	Key RadiusMetricKey
+}
+
+func PushRadiusServerMalformed(instanceName string, endpoint string, Code string) {
+	MS.InputChan <- RadiusServerMalformedEvent{Key: RadiusMetricKey{Instance: instanceName, Endpoint: endpoint, Code: Code}}
+}
+
+// Packets rejected because the bulkhead of the handler is full
+type RadiusServerBulkheadRejectedEvent struct {
+	Key RadiusMetricKey
+}
+
+func PushRadiusServerBulkheadRejected(instanceName string, endpoint string, Code string) {
+	MS.InputChan <- RadiusServerBulkheadRejectedEvent{Key: RadiusMetricKey{Instance: instanceName, Endpoint: endpoint, Code: Code}}
+}
+
+// Retransmitted requests answered with the cached response
+type RadiusServerDuplicateEvent struct {
+	Key RadiusMetricKey
+}
+
+func PushRadiusServerDuplicate(instanceName string, endpoint string, Code string) {
+	MS.InputChan <- RadiusServerDuplicateEvent{Key: RadiusMetricKey{Instance: instanceName, Endpoint: endpoint, Code: Code}}
+}
+
+// Last measured skew of the clock of a client
+type RadiusClientClockSkewEvent struct {
+	Instance string
+	Client   string
+	Skew     time.Duration
+}
+
+func PushRadiusClientClockSkew(instanceName string, client string, skew time.Duration) {
+	MS.InputChan <- RadiusClientClockSkewEvent{Instance: instanceName, Client: client, Skew: skew}
+}
+
+type RadiusServerRequestDurationEvent struct {
+	Key      RadiusMetricKey
+	Duration time.Duration
+
+	// Identifier of the trace of the request, if sampled, to be attached as exemplar
+	TraceId string
+}
+
+// The code is that of the request. The context is that of the request, whose span, if sampled, is referenced as exemplar
+func PushRadiusServerRequestDuration(ctx context.Context, instanceName string, endpoint string, Code string, duration time.Duration) {
+	MS.InputChan <- RadiusServerRequestDurationEvent{Key: RadiusMetricKey{Instance: instanceName, Endpoint: endpoint, Code: Code}, Duration: duration, TraceId: exemplarTraceId(ctx)}
 }
 
 // Radius Client
@@ -41,30 +117,76 @@ type RadiusClientRequestEvent struct {
 	Key RadiusMetricKey
 }
 
-func PushRadiusClientRequest(endpoint string, Code string) {
-	MS.InputChan <- RadiusClientRequestEvent{Key: RadiusMetricKey{Endpoint: endpoint, Code: Code}}
+func PushRadiusClientRequest(instanceName string, endpoint string, Code string) {
+	MS.InputChan <- RadiusClientRequestEvent{Key: RadiusMetricKey{Instance: instanceName, Endpoint: endpoint, Code: Code}}
 }
 
 type RadiusClientResponseEvent struct {
 	Key RadiusMetricKey
 }
 
-func PushRadiusClientResponse(endpoint string, Code string) {
-	MS.InputChan <- RadiusClientResponseEvent{Key: RadiusMetricKey{Endpoint: endpoint, Code: Code}}
+func PushRadiusClientResponse(instanceName string, endpoint string, Code string) {
+	MS.InputChan <- RadiusClientResponseEvent{Key: RadiusMetricKey{Instance: instanceName, Endpoint: endpoint, Code: Code}}
 }
 
 type RadiusClientTimeoutEvent struct {
 	Key RadiusMetricKey
 }
 
-func PushRadiusClientTimeout(endpoint string, Code string) {
-	MS.InputChan <- RadiusClientTimeoutEvent{Key: RadiusMetricKey{Endpoint: endpoint, Code: Code}}
+func PushRadiusClientTimeout(instanceName string, endpoint string, Code string) {
+	MS.InputChan <- RadiusClientTimeoutEvent{Key: RadiusMetricKey{Instance: instanceName, Endpoint: endpoint, Code: Code}}
 }
 
 type RadiusClientResponseStalledEvent struct {
 	Key RadiusMetricKey
 }
 
-func PushRadiusClientResponseStalled(endpoint string, Code string) {
-	MS.InputChan <- RadiusClientResponseStalledEvent{Key: RadiusMetricKey{Endpoint: endpoint, Code: Code}}
+func PushRadiusClientResponseStalled(instanceName string, endpoint string, Code string) {
+	MS.InputChan <- RadiusClientResponseStalledEvent{Key: RadiusMetricKey{Instance: instanceName, Endpoint: endpoint, Code: Code}}
+}
+
+type RadiusClientRequestDurationEvent struct {
+	Key      RadiusMetricKey
+	Duration time.Duration
+
+	// Identifier of the trace of the request, if sampled, to be attached as exemplar
+	TraceId string
+}
+
+// The code is that of the request
+func PushRadiusClientRequestDuration(ctx context.Context, instanceName string, endpoint string, Code string, duration time.Duration) {
+	MS.InputChan <- RadiusClientRequestDurationEvent{Key: RadiusMetricKey{Instance: instanceName, Endpoint: endpoint, Code: Code}, Duration: duration, TraceId: exemplarTraceId(ctx)}
+}
+
+// Sessions
+
+type RadiusFramedIPConflictEvent struct {
+	Key RadiusMetricKey
+}
+
+// The endpoint is the NAS reporting the new session with the duplicated address
+func PushRadiusFramedIPConflict(instanceName string, endpoint string) {
+	MS.InputChan <- RadiusFramedIPConflictEvent{Key: RadiusMetricKey{Instance: instanceName, Endpoint: endpoint}}
+}
+
+// Upstream radius servers
+
+// Key of the counters of transitions of the upstream radius servers, by the state entered
+type RadiusServerStateKey struct {
+	Instance string
+	Server   string
+	State    string
+}
+
+type RadiusServerStateChangeEvent struct {
+	Instance string
+	Server   string
+	From     string
+	To       string
+}
+
+// Reports the transition of the upstream radius server between the states of its health model. From
+// is empty when reporting the initial state
+func PushRadiusServerStateChange(instanceName string, server string, from string, to string) {
+	MS.InputChan <- RadiusServerStateChangeEvent{Instance: instanceName, Server: server, From: from, To: to}
 }
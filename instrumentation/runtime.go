@@ -0,0 +1,146 @@
+package instrumentation
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics of the process itself, so that no separate exporter is needed. They are not
+// collected from events, but calculated when queried
+
+// Name of the subsystem for the goroutines not created by igor code, such as the main one
+const RUNTIME_SUBSYSTEM = "runtime"
+
+type RuntimeMetrics struct {
+	Goroutines int
+
+	// Number of goroutines by the package of the function that created them, such as "diampeer"
+	SubsystemGoroutines map[string]int
+
+	// Memory, in bytes
+	HeapAlloc   uint64
+	HeapInuse   uint64
+	HeapObjects uint64
+	Sys         uint64
+
+	// Garbage collection
+	NumGC           uint32
+	GCPauseTotal    time.Duration
+	LastGCPause     time.Duration
+	GCCPUFraction   float64
+	LastGCTimestamp time.Time `json:",omitempty"`
+
+	// CPU time consumed by the process
+	UserCPUTime   time.Duration
+	SystemCPUTime time.Duration
+
+	// -1 if not available in this platform
+	OpenFDs int
+}
+
+// Returns the current process metrics
+func GetRuntimeMetrics() RuntimeMetrics {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	metrics := RuntimeMetrics{
+		Goroutines:          runtime.NumGoroutine(),
+		SubsystemGoroutines: subsystemGoroutines(),
+		HeapAlloc:           memStats.HeapAlloc,
+		HeapInuse:           memStats.HeapInuse,
+		HeapObjects:         memStats.HeapObjects,
+		Sys:                 memStats.Sys,
+		NumGC:               memStats.NumGC,
+		GCPauseTotal:        time.Duration(memStats.PauseTotalNs),
+		GCCPUFraction:       memStats.GCCPUFraction,
+		OpenFDs:             openFDs(),
+	}
+	if memStats.NumGC > 0 {
+		metrics.LastGCPause = time.Duration(memStats.PauseNs[(memStats.NumGC+255)%256])
+		metrics.LastGCTimestamp = time.Unix(0, int64(memStats.LastGC))
+	}
+	metrics.UserCPUTime, metrics.SystemCPUTime = cpuTimes()
+
+	return metrics
+}
+
+// The dump of the stacks stops the world, so the goroutines by subsystem are calculated at most
+// once in this interval
+const SUBSYSTEM_GOROUTINES_CACHE_SECONDS = 10
+
+var goroutinesCache struct {
+	sync.Mutex
+	counts    map[string]int
+	timestamp time.Time
+}
+
+// Returns the goroutines by subsystem, taken from the cache if not older than the interval
+func subsystemGoroutines() map[string]int {
+	goroutinesCache.Lock()
+	defer goroutinesCache.Unlock()
+
+	if goroutinesCache.counts == nil || time.Since(goroutinesCache.timestamp) > SUBSYSTEM_GOROUTINES_CACHE_SECONDS*time.Second {
+		goroutinesCache.counts = countSubsystemGoroutines()
+		goroutinesCache.timestamp = time.Now()
+	}
+
+	// A copy, since the caller may modify it
+	counts := make(map[string]int, len(goroutinesCache.counts))
+	for subsystem, n := range goroutinesCache.counts {
+		counts[subsystem] = n
+	}
+	return counts
+}
+
+// Counts the goroutines by the package of the function that created them, taken from the
+// "created by" line in the dump of the stacks. Only the igor packages are reported by name
+func countSubsystemGoroutines() map[string]int {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	counts := make(map[string]int)
+	for _, stack := range bytes.Split(buf, []byte("\n\n")) {
+		counts[goroutineSubsystem(stack)]++
+	}
+	return counts
+}
+
+// Returns the subsystem of the goroutine with the specified stack dump
+func goroutineSubsystem(stack []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(stack))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "created by igor/") {
+			continue
+		}
+		// Function is in the form igor/<package>.<function> or igor/<package>.(*<type>).<method>
+		pkg := strings.TrimPrefix(line, "created by igor/")
+		if i := strings.Index(pkg, "."); i > 0 {
+			pkg = pkg[:i]
+		}
+		return pkg
+	}
+	return RUNTIME_SUBSYSTEM
+}
+
+// Returns the number of open file descriptors of the process, or -1 if it could not be determined
+func openFDs() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	// The descriptor used to read the directory is included
+	return len(entries) - 1
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package instrumentation
+
+import (
+	"syscall"
+	"time"
+)
+
+// Returns the user and system CPU time consumed by the process, or zero if not available
+func cpuTimes() (time.Duration, time.Duration) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0, 0
+	}
+	return time.Duration(usage.Utime.Nano()), time.Duration(usage.Stime.Nano())
+}
@@ -0,0 +1,26 @@
+//go:build windows
+
+package instrumentation
+
+import (
+	"syscall"
+	"time"
+)
+
+// Returns the user and system CPU time consumed by the process, or zero if not available
+func cpuTimes() (time.Duration, time.Duration) {
+	handle, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return 0, 0
+	}
+	var creation, exit, kernel, user syscall.Filetime
+	if err := syscall.GetProcessTimes(handle, &creation, &exit, &kernel, &user); err != nil {
+		return 0, 0
+	}
+	return filetimeDuration(user), filetimeDuration(kernel)
+}
+
+// The times consumed are expressed in units of 100 nanoseconds
+func filetimeDuration(ft syscall.Filetime) time.Duration {
+	return time.Duration(int64(ft.HighDateTime)<<32|int64(ft.LowDateTime)) * 100
+}
@@ -0,0 +1,25 @@
+package instrumentation
+
+import (
+	"context"
+	"time"
+)
+
+type SessionQueryMetricKey struct {
+	// Name of the configuration instance
+	Instance string
+	// Name of the operation on the session store, such as "FindByIndex"
+	Query string
+}
+
+type SessionQueryDurationEvent struct {
+	Key      SessionQueryMetricKey
+	Duration time.Duration
+
+	// Identifier of the trace of the query, if sampled, to be attached as exemplar
+	TraceId string
+}
+
+func PushSessionQueryDuration(ctx context.Context, instanceName string, query string, duration time.Duration) {
+	MS.InputChan <- SessionQueryDurationEvent{Key: SessionQueryMetricKey{Instance: instanceName, Query: query}, Duration: duration, TraceId: exemplarTraceId(ctx)}
+}
@@ -0,0 +1,25 @@
+package instrumentation
+
+import (
+	"context"
+	"time"
+)
+
+type SubscriberQueryMetricKey struct {
+	// Name of the configuration instance
+	Instance string
+	// "cached", if answered from the cache, "found", "notFound" or "error"
+	Result string
+}
+
+type SubscriberQueryDurationEvent struct {
+	Key      SubscriberQueryMetricKey
+	Duration time.Duration
+
+	// Identifier of the trace of the query, if sampled, to be attached as exemplar
+	TraceId string
+}
+
+func PushSubscriberQueryDuration(ctx context.Context, instanceName string, result string, duration time.Duration) {
+	MS.InputChan <- SubscriberQueryDurationEvent{Key: SubscriberQueryMetricKey{Instance: instanceName, Result: result}, Duration: duration, TraceId: exemplarTraceId(ctx)}
+}
@@ -0,0 +1,159 @@
+package ippool
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Addresses or prefixes of a pool, numbered from zero, so that the pools are not expanded in memory
+type addressSpace interface {
+	// Number of addresses or prefixes
+	size() uint64
+
+	// Returns the address or prefix with the specified number
+	at(index uint64) string
+
+	// Returns the number of the address or prefix, or false if not in the space
+	indexOf(address string) (uint64, bool)
+}
+
+// Contiguous IPv4 addresses
+type ipv4Range struct {
+	start uint32
+	size  uint64
+}
+
+// IPv4 addresses, in one or more ranges
+type ipv4Space struct {
+	ranges []ipv4Range
+	total  uint64
+}
+
+// Builds the space from ranges such as "10.0.0.10-10.0.0.250" or CIDR blocks such as "10.0.1.0/24".
+// The network and broadcast addresses of the blocks are excluded, except for /31 and /32
+func newIPv4Space(specs []string) (*ipv4Space, error) {
+	var space ipv4Space
+	for _, spec := range specs {
+		var r ipv4Range
+		if strings.Contains(spec, "/") {
+			_, ipNet, err := net.ParseCIDR(spec)
+			if err != nil || ipNet.IP.To4() == nil {
+				return nil, fmt.Errorf("bad IPv4 block %q", spec)
+			}
+			ones, _ := ipNet.Mask.Size()
+			r = ipv4Range{start: binary.BigEndian.Uint32(ipNet.IP.To4()), size: 1 << (32 - ones)}
+			if ones < 31 {
+				r.start++
+				r.size -= 2
+			}
+		} else {
+			bounds := strings.Split(spec, "-")
+			if len(bounds) != 2 {
+				return nil, fmt.Errorf("bad IPv4 range %q", spec)
+			}
+			first, last := net.ParseIP(strings.TrimSpace(bounds[0])).To4(), net.ParseIP(strings.TrimSpace(bounds[1])).To4()
+			if first == nil || last == nil || binary.BigEndian.Uint32(first) > binary.BigEndian.Uint32(last) {
+				return nil, fmt.Errorf("bad IPv4 range %q", spec)
+			}
+			r = ipv4Range{start: binary.BigEndian.Uint32(first), size: uint64(binary.BigEndian.Uint32(last)-binary.BigEndian.Uint32(first)) + 1}
+		}
+		space.ranges = append(space.ranges, r)
+		space.total += r.size
+	}
+	if space.total == 0 {
+		return nil, fmt.Errorf("no addresses in ranges %v", specs)
+	}
+	return &space, nil
+}
+
+func (s *ipv4Space) size() uint64 {
+	return s.total
+}
+
+func (s *ipv4Space) at(index uint64) string {
+	for _, r := range s.ranges {
+		if index < r.size {
+			ip := make(net.IP, 4)
+			binary.BigEndian.PutUint32(ip, r.start+uint32(index))
+			return ip.String()
+		}
+		index -= r.size
+	}
+	return ""
+}
+
+func (s *ipv4Space) indexOf(address string) (uint64, bool) {
+	ip := net.ParseIP(address).To4()
+	if ip == nil {
+		return 0, false
+	}
+	value := binary.BigEndian.Uint32(ip)
+
+	var offset uint64
+	for _, r := range s.ranges {
+		if value >= r.start && uint64(value-r.start) < r.size {
+			return offset + uint64(value-r.start), true
+		}
+		offset += r.size
+	}
+	return 0, false
+}
+
+// Maximum number of bits of the index of the delegated prefixes
+const maxIPv6IndexBits = 32
+
+// IPv6 prefixes of the same length, carved out of a larger one
+type ipv6Space struct {
+	base            *big.Int
+	prefixLength    int
+	delegatedLength int
+}
+
+// Builds the space from the prefix, such as "2001:db8:100::/40", and the length of the delegated prefixes
+func newIPv6Space(prefix string, delegatedLength int) (*ipv6Space, error) {
+	_, ipNet, err := net.ParseCIDR(prefix)
+	if err != nil || ipNet.IP.To4() != nil {
+		return nil, fmt.Errorf("bad IPv6 prefix %q", prefix)
+	}
+	prefixLength, _ := ipNet.Mask.Size()
+	if delegatedLength < prefixLength || delegatedLength > 128 || delegatedLength-prefixLength > maxIPv6IndexBits {
+		return nil, fmt.Errorf("bad delegated prefix length %d for %s", delegatedLength, prefix)
+	}
+	return &ipv6Space{base: new(big.Int).SetBytes(ipNet.IP.To16()), prefixLength: prefixLength, delegatedLength: delegatedLength}, nil
+}
+
+func (s *ipv6Space) size() uint64 {
+	return 1 << (s.delegatedLength - s.prefixLength)
+}
+
+func (s *ipv6Space) at(index uint64) string {
+	value := new(big.Int).Lsh(new(big.Int).SetUint64(index), uint(128-s.delegatedLength))
+	value.Add(value, s.base)
+	ip := make(net.IP, 16)
+	value.FillBytes(ip)
+	return ip.String() + "/" + strconv.Itoa(s.delegatedLength)
+}
+
+func (s *ipv6Space) indexOf(address string) (uint64, bool) {
+	ip, ipNet, err := net.ParseCIDR(address)
+	if err != nil || ip.To4() != nil {
+		return 0, false
+	}
+	if length, _ := ipNet.Mask.Size(); length != s.delegatedLength || !ip.Equal(ipNet.IP) {
+		return 0, false
+	}
+
+	offset := new(big.Int).Sub(new(big.Int).SetBytes(ip.To16()), s.base)
+	if offset.Sign() < 0 {
+		return 0, false
+	}
+	offset.Rsh(offset, uint(128-s.delegatedLength))
+	if !offset.IsUint64() || offset.Uint64() >= s.size() {
+		return 0, false
+	}
+	return offset.Uint64(), true
+}
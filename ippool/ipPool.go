@@ -0,0 +1,532 @@
+package ippool
+
+import (
+	"errors"
+	"fmt"
+	"igor/config"
+	"igor/radiuscodec"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Allocation of the Framed-IP-Address or Delegated-IPv6-Prefix of the users from the pools specified
+// in the ipPools.json configuration object.
+//
+// The addresses are leased to the users when the Access-Accept is built, and the leases are renewed with
+// the accounting Start and Interim-Update packets and released with the Stop. A released address is
+// reserved for some time for the same user, identified by User-Name or MAC address, and given to other
+// users only when the pool is exhausted. The leases that are not renewed in time may be also reused.
+//
+// The leases may be persisted in a backend, such as the ones of the session store, so that they survive
+// a restart
+
+// Defaults for the values not specified in the configuration
+const (
+	DEFAULT_LEASE_SECONDS    = 3600
+	DEFAULT_STICKY_ATTRIBUTE = "User-Name"
+)
+
+// Attributes with the allocated addresses
+const (
+	FRAMED_IP_ATTRIBUTE        = "Framed-IP-Address"
+	DELEGATED_PREFIX_ATTRIBUTE = "Delegated-IPv6-Prefix"
+)
+
+var ErrPoolNotFound = errors.New("pool not found")
+var ErrPoolExhausted = errors.New("no addresses available in pool")
+var ErrLeaseNotFound = errors.New("lease not found")
+
+// Returned when the lease is in use by a session other than the one specified
+var ErrLeaseConflict = errors.New("lease in use by another session")
+
+// Assignment of an address to a user
+type Lease struct {
+	Pool string
+
+	// IPv4 address, or IPv6 prefix such as "2001:db8:100::/56"
+	Address string
+
+	// Value of the sticky attribute of the user, and Acct-Session-Id of the session, if known
+	StickyKey string
+	SessionId string
+
+	// Until when the lease is valid or, if released, reserved for the user
+	Expiration time.Time
+	Released   bool
+
+	LastUpdated time.Time
+}
+
+// External storage of the leases. Must be safe for concurrent use
+type LeaseBackend interface {
+	// Stores the lease, replacing the one with the same Pool and Address
+	SaveLease(lease Lease) error
+
+	// Returns all the leases stored
+	LoadLeases() ([]Lease, error)
+}
+
+// Usage of a pool
+type PoolUtilization struct {
+	Pool string
+	Size uint64
+
+	// Addresses leased, released but still reserved for their users, and not in use
+	Active   uint64
+	Reserved uint64
+	Free     uint64
+
+	// Percentage of active addresses
+	Utilization float64
+}
+
+// Released address, in the order of release
+type releasedEntry struct {
+	index      uint64
+	expiration time.Time
+}
+
+type ipPool struct {
+	name            string
+	space           addressSpace
+	attribute       string
+	stickyAttribute string
+	leaseTime       time.Duration
+	stickyTime      time.Duration
+
+	mutex sync.Mutex
+
+	// Leases, active or released, by number of address
+	leases map[uint64]*Lease
+
+	// Number of the address last leased to each user
+	sticky map[string]uint64
+
+	// Addresses from this one on have never been used
+	next uint64
+
+	// Released addresses, oldest first. Entries for addresses leased again are skipped
+	released []releasedEntry
+}
+
+// Allocates the addresses of all the pools. Safe for concurrent use
+type PoolManager struct {
+	pools map[string]*ipPool
+
+	backendMutex sync.RWMutex
+	backend      LeaseBackend
+}
+
+// Creates the manager with the specified configuration, typically the IPPoolsConf() of the
+// policy configuration instance
+func NewPoolManager(conf config.IPPoolsConfig) (*PoolManager, error) {
+	m := PoolManager{pools: make(map[string]*ipPool)}
+	for name, poolConf := range conf {
+		pool, err := newIPPool(name, poolConf)
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %w", name, err)
+		}
+		m.pools[name] = pool
+	}
+	return &m, nil
+}
+
+// Builds a pool without leases
+func newIPPool(name string, conf config.IPPoolConfig) (*ipPool, error) {
+	pool := ipPool{
+		name:            name,
+		stickyAttribute: conf.StickyAttribute,
+		leaseTime:       time.Duration(conf.LeaseSeconds) * time.Second,
+		stickyTime:      time.Duration(conf.StickySeconds) * time.Second,
+		leases:          make(map[uint64]*Lease),
+		sticky:          make(map[string]uint64),
+	}
+	if pool.stickyAttribute == "" {
+		pool.stickyAttribute = DEFAULT_STICKY_ATTRIBUTE
+	}
+	if pool.leaseTime <= 0 {
+		pool.leaseTime = DEFAULT_LEASE_SECONDS * time.Second
+	}
+
+	var err error
+	switch {
+	case len(conf.Ranges) > 0 && conf.DelegatedPrefix != "":
+		return nil, errors.New("both IPv4 ranges and delegated prefix specified")
+	case len(conf.Ranges) > 0:
+		pool.space, err = newIPv4Space(conf.Ranges)
+		pool.attribute = FRAMED_IP_ATTRIBUTE
+	case conf.DelegatedPrefix != "":
+		pool.space, err = newIPv6Space(conf.DelegatedPrefix, conf.DelegatedPrefixLength)
+		pool.attribute = DELEGATED_PREFIX_ATTRIBUTE
+	default:
+		return nil, errors.New("no IPv4 ranges or delegated prefix specified")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &pool, nil
+}
+
+// Sets the backend where the leases are persisted, and restores the leases stored in it. The leases
+// of addresses not in the configured pools are ignored. Returns the number of leases restored
+func (m *PoolManager) SetBackend(backend LeaseBackend) (int, error) {
+	leases, err := backend.LoadLeases()
+	if err != nil {
+		return 0, fmt.Errorf("could not load leases from backend: %w", err)
+	}
+
+	restored := 0
+	for _, lease := range leases {
+		if pool, found := m.pools[lease.Pool]; found && pool.restore(lease) {
+			restored++
+		}
+	}
+	for _, pool := range m.pools {
+		pool.mutex.Lock()
+		sort.SliceStable(pool.released, func(i, j int) bool { return pool.released[i].expiration.Before(pool.released[j].expiration) })
+		pool.mutex.Unlock()
+	}
+
+	m.backendMutex.Lock()
+	m.backend = backend
+	m.backendMutex.Unlock()
+
+	return restored, nil
+}
+
+// Leases an address of the pool to the user identified by the sticky key. The user gets the address it
+// had before if still reserved for it, or the same one if the session is the same. Otherwise, the
+// address released the earliest, or one never used
+func (m *PoolManager) Allocate(poolName string, stickyKey string, sessionId string) (Lease, error) {
+	pool, found := m.pools[poolName]
+	if !found {
+		return Lease{}, fmt.Errorf("%s: %w", poolName, ErrPoolNotFound)
+	}
+
+	// Persisted under the lock of the pool, so that the changes of a lease reach the backend in order
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	lease, err := pool.allocate(stickyKey, sessionId, time.Now())
+	if err != nil {
+		return lease, err
+	}
+	m.persist(lease)
+	return lease, nil
+}
+
+// Extends the lease of the address, which is reactivated if released, or created if the address is not
+// leased. The session, if specified, must be the one of the lease, if any
+func (m *PoolManager) Renew(address string, sessionId string) (Lease, error) {
+	pool, index, err := m.find(address)
+	if err != nil {
+		return Lease{}, err
+	}
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	lease, err := pool.renew(index, sessionId, time.Now())
+	if err != nil {
+		return lease, err
+	}
+	m.persist(lease)
+	return lease, nil
+}
+
+// Releases the lease of the address, which is then reserved for the same user. The session, if specified,
+// must be the one of the lease, if any, so that a late Stop does not release an address leased again
+func (m *PoolManager) Release(address string, sessionId string) error {
+	pool, index, err := m.find(address)
+	if err != nil {
+		return err
+	}
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	lease, err := pool.release(index, sessionId, time.Now())
+	if err != nil {
+		return err
+	}
+	m.persist(lease)
+	return nil
+}
+
+// Leases an address of the pool to the user of the Access-Request, and adds it to the response as
+// Framed-IP-Address or Delegated-IPv6-Prefix
+func (m *PoolManager) AssignAddress(poolName string, request *radiuscodec.RadiusPacket, response *radiuscodec.RadiusPacket) (Lease, error) {
+	pool, found := m.pools[poolName]
+	if !found {
+		return Lease{}, fmt.Errorf("%s: %w", poolName, ErrPoolNotFound)
+	}
+
+	lease, err := m.Allocate(poolName, request.GetStringAVP(pool.stickyAttribute), request.GetStringAVP("Acct-Session-Id"))
+	if err != nil {
+		return lease, err
+	}
+
+	avp, err := radiuscodec.NewAVP(pool.attribute, lease.Address)
+	if err != nil {
+		return lease, fmt.Errorf("could not build %s with %s: %w", pool.attribute, lease.Address, err)
+	}
+	response.AddAVP(avp)
+	return lease, nil
+}
+
+// Renews the leases of the addresses in accounting Start and Interim-Update packets, and releases them
+// with the Stop. The addresses not in any pool or not leased are ignored
+func (m *PoolManager) PushAccounting(packet *radiuscodec.RadiusPacket) error {
+	sessionId := packet.GetStringAVP("Acct-Session-Id")
+	statusType := packet.GetStringAVP("Acct-Status-Type")
+
+	for _, attribute := range []string{FRAMED_IP_ATTRIBUTE, DELEGATED_PREFIX_ATTRIBUTE} {
+		address := packet.GetStringAVP(attribute)
+		if address == "" {
+			continue
+		}
+
+		var err error
+		switch statusType {
+		case "Start", "Interim-Update":
+			_, err = m.Renew(address, sessionId)
+		case "Stop":
+			err = m.Release(address, sessionId)
+		}
+		if err != nil && !errors.Is(err, ErrLeaseNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the usage of the pools, sorted by name
+func (m *PoolManager) Utilization() []PoolUtilization {
+	names := make([]string, 0, len(m.pools))
+	for name := range m.pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	utilization := make([]PoolUtilization, 0, len(names))
+	now := time.Now()
+	for _, name := range names {
+		utilization = append(utilization, m.pools[name].utilization(now))
+	}
+	return utilization
+}
+
+// Returns the leases of the pool, active or released, sorted by address
+func (m *PoolManager) Leases(poolName string) ([]Lease, error) {
+	pool, found := m.pools[poolName]
+	if !found {
+		return nil, fmt.Errorf("%s: %w", poolName, ErrPoolNotFound)
+	}
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	indexes := make([]uint64, 0, len(pool.leases))
+	for index := range pool.leases {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+
+	leases := make([]Lease, 0, len(indexes))
+	for _, index := range indexes {
+		leases = append(leases, *pool.leases[index])
+	}
+	return leases, nil
+}
+
+// Returns the pool and number of the address
+func (m *PoolManager) find(address string) (*ipPool, uint64, error) {
+	for _, pool := range m.pools {
+		if index, found := pool.space.indexOf(address); found {
+			return pool, index, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("%s not in any pool: %w", address, ErrLeaseNotFound)
+}
+
+// Writes the lease to the backend, if set. Called with the mutex of the pool held, so that the changes
+// of a lease are written in the same order as they are applied
+func (m *PoolManager) persist(lease Lease) {
+	m.backendMutex.RLock()
+	backend := m.backend
+	m.backendMutex.RUnlock()
+
+	if backend == nil {
+		return
+	}
+	if err := backend.SaveLease(lease); err != nil {
+		config.GetLogger().Errorf("could not write lease of %s to backend: %s", lease.Address, err)
+	}
+}
+
+// Called with the mutex of the pool held
+func (p *ipPool) allocate(stickyKey string, sessionId string, now time.Time) (Lease, error) {
+	// The address reserved for the user, or already leased to the same session
+	if stickyKey != "" {
+		if index, found := p.sticky[stickyKey]; found {
+			lease := p.leases[index]
+			if lease.StickyKey == stickyKey && (lease.Released || now.After(lease.Expiration) || (sessionId != "" && lease.SessionId == sessionId)) {
+				return p.assign(index, stickyKey, sessionId, now), nil
+			}
+		}
+	}
+
+	// Released and no longer reserved
+	if index, found := p.popReleased(now, false); found {
+		return p.assign(index, stickyKey, sessionId, now), nil
+	}
+
+	// Never used
+	for ; p.next < p.space.size(); p.next++ {
+		if _, inUse := p.leases[p.next]; !inUse {
+			return p.assign(p.next, stickyKey, sessionId, now), nil
+		}
+	}
+
+	// Released and reserved for another user
+	if index, found := p.popReleased(now, true); found {
+		return p.assign(index, stickyKey, sessionId, now), nil
+	}
+
+	// Not renewed in time, the oldest first
+	var oldest *Lease
+	var oldestIndex uint64
+	for index, lease := range p.leases {
+		if !lease.Released && now.After(lease.Expiration) && (oldest == nil || lease.Expiration.Before(oldest.Expiration)) {
+			oldest, oldestIndex = lease, index
+		}
+	}
+	if oldest != nil {
+		return p.assign(oldestIndex, stickyKey, sessionId, now), nil
+	}
+
+	return Lease{}, fmt.Errorf("%s: %w", p.name, ErrPoolExhausted)
+}
+
+// Leases the address to the user
+func (p *ipPool) assign(index uint64, stickyKey string, sessionId string, now time.Time) Lease {
+	if previous, found := p.leases[index]; found && previous.StickyKey != stickyKey {
+		if stickyIndex, found := p.sticky[previous.StickyKey]; found && stickyIndex == index {
+			delete(p.sticky, previous.StickyKey)
+		}
+	}
+
+	lease := Lease{
+		Pool:        p.name,
+		Address:     p.space.at(index),
+		StickyKey:   stickyKey,
+		SessionId:   sessionId,
+		Expiration:  now.Add(p.leaseTime),
+		LastUpdated: now,
+	}
+	p.leases[index] = &lease
+	if stickyKey != "" {
+		p.sticky[stickyKey] = index
+	}
+	return lease
+}
+
+// Returns the number of the address released the earliest whose reservation has expired or, if forced,
+// even if still reserved
+func (p *ipPool) popReleased(now time.Time, force bool) (uint64, bool) {
+	for len(p.released) > 0 {
+		entry := p.released[0]
+
+		// Skip the addresses leased again since released
+		if lease, found := p.leases[entry.index]; !found || !lease.Released || !lease.Expiration.Equal(entry.expiration) {
+			p.released = p.released[1:]
+			continue
+		}
+		if !force && now.Before(entry.expiration) {
+			return 0, false
+		}
+		p.released = p.released[1:]
+		return entry.index, true
+	}
+	return 0, false
+}
+
+// Called with the mutex of the pool held
+func (p *ipPool) renew(index uint64, sessionId string, now time.Time) (Lease, error) {
+	// Assigned by other means, or leased before a restart without backend
+	lease, found := p.leases[index]
+	if !found {
+		return p.assign(index, "", sessionId, now), nil
+	}
+	if !lease.Released && sessionId != "" && lease.SessionId != "" && lease.SessionId != sessionId {
+		return Lease{}, fmt.Errorf("%s in session %s: %w", lease.Address, lease.SessionId, ErrLeaseConflict)
+	}
+
+	if sessionId != "" {
+		lease.SessionId = sessionId
+	}
+	lease.Released = false
+	lease.Expiration = now.Add(p.leaseTime)
+	lease.LastUpdated = now
+	return *lease, nil
+}
+
+// Called with the mutex of the pool held
+func (p *ipPool) release(index uint64, sessionId string, now time.Time) (Lease, error) {
+	lease, found := p.leases[index]
+	if !found || lease.Released {
+		return Lease{}, fmt.Errorf("%s: %w", p.space.at(index), ErrLeaseNotFound)
+	}
+	if sessionId != "" && lease.SessionId != "" && lease.SessionId != sessionId {
+		return Lease{}, fmt.Errorf("%s in session %s: %w", lease.Address, lease.SessionId, ErrLeaseConflict)
+	}
+
+	lease.Released = true
+	lease.Expiration = now.Add(p.stickyTime)
+	lease.LastUpdated = now
+	p.released = append(p.released, releasedEntry{index: index, expiration: lease.Expiration})
+	return *lease, nil
+}
+
+// Adds a lease read from the backend, unless the address is not in the pool or there is a newer lease.
+// The released entries must be sorted afterwards
+func (p *ipPool) restore(lease Lease) bool {
+	index, found := p.space.indexOf(lease.Address)
+	if !found {
+		return false
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if current, found := p.leases[index]; found && current.LastUpdated.After(lease.LastUpdated) {
+		return false
+	}
+	p.leases[index] = &lease
+	if lease.StickyKey != "" {
+		p.sticky[lease.StickyKey] = index
+	}
+	if lease.Released {
+		p.released = append(p.released, releasedEntry{index: index, expiration: lease.Expiration})
+	}
+	return true
+}
+
+func (p *ipPool) utilization(now time.Time) PoolUtilization {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	u := PoolUtilization{Pool: p.name, Size: p.space.size()}
+	for _, lease := range p.leases {
+		switch {
+		case !lease.Released && !now.After(lease.Expiration):
+			u.Active++
+		case lease.Released && now.Before(lease.Expiration):
+			u.Reserved++
+		}
+	}
+	u.Free = u.Size - u.Active - u.Reserved
+	u.Utilization = float64(u.Active) * 100 / float64(u.Size)
+	return u
+}
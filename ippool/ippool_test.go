@@ -0,0 +1,245 @@
+package ippool
+
+import (
+	"errors"
+	"igor/config"
+	"igor/radiuscodec"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+
+	// Initialize the Config Object
+	config.InitPolicyConfigInstance("resources/searchRules.json", "testServer", true)
+
+	// Execute the tests and exit
+	os.Exit(m.Run())
+}
+
+// Backend in memory
+type memoryBackend struct {
+	sync.Mutex
+	leases map[string]Lease
+
+	// Time to wait before storing the released leases
+	releaseDelay time.Duration
+}
+
+func (b *memoryBackend) SaveLease(lease Lease) error {
+	if lease.Released {
+		time.Sleep(b.releaseDelay)
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.leases[lease.Pool+"/"+lease.Address] = lease
+	return nil
+}
+
+func (b *memoryBackend) LoadLeases() ([]Lease, error) {
+	b.Lock()
+	defer b.Unlock()
+	leases := make([]Lease, 0, len(b.leases))
+	for _, lease := range b.leases {
+		leases = append(leases, lease)
+	}
+	return leases, nil
+}
+
+func TestAddressSpaces(t *testing.T) {
+
+	v4, err := newIPv4Space([]string{"10.0.0.0/30", "10.0.1.250-10.0.1.251"})
+	if err != nil {
+		t.Fatalf("could not parse ranges: %s", err)
+	}
+	if v4.size() != 4 || v4.at(0) != "10.0.0.1" || v4.at(1) != "10.0.0.2" || v4.at(3) != "10.0.1.251" {
+		t.Errorf("bad IPv4 space %v", v4)
+	}
+	if index, found := v4.indexOf("10.0.1.250"); !found || index != 2 {
+		t.Errorf("bad index %d", index)
+	}
+	if _, found := v4.indexOf("10.0.0.3"); found {
+		t.Error("broadcast address in space")
+	}
+
+	v6, err := newIPv6Space("2001:db8:100::/40", 56)
+	if err != nil {
+		t.Fatalf("could not parse prefix: %s", err)
+	}
+	if v6.size() != 65536 || v6.at(0) != "2001:db8:100::/56" || v6.at(257) != "2001:db8:101:100::/56" {
+		t.Errorf("bad IPv6 space %s %s", v6.at(0), v6.at(257))
+	}
+	if index, found := v6.indexOf("2001:db8:101:100::/56"); !found || index != 257 {
+		t.Errorf("bad index %d", index)
+	}
+	if _, found := v6.indexOf("2001:db8:101:100::/64"); found {
+		t.Error("prefix with bad length in space")
+	}
+
+	for _, ranges := range [][]string{{"10.0.0.5-10.0.0.1"}, {"10.0.0.0/33"}, {"2001:db8::/64"}} {
+		if _, err := newIPv4Space(ranges); err == nil {
+			t.Errorf("bad range %v accepted", ranges)
+		}
+	}
+	if _, err := newIPv6Space("2001:db8::/32", 128); err == nil {
+		t.Error("too many delegated prefixes accepted")
+	}
+}
+
+func TestAllocation(t *testing.T) {
+
+	m, err := NewPoolManager(config.IPPoolsConfig{
+		"small": {Ranges: []string{"10.0.0.1-10.0.0.3"}, StickySeconds: 3600},
+	})
+	if err != nil {
+		t.Fatalf("could not create pools: %s", err)
+	}
+
+	// Each user gets a different address
+	first, _ := m.Allocate("small", "user1", "session-1")
+	second, _ := m.Allocate("small", "user2", "session-2")
+	if first.Address != "10.0.0.1" || second.Address != "10.0.0.2" {
+		t.Fatalf("bad addresses %s %s", first.Address, second.Address)
+	}
+
+	// Retransmission of the same request
+	if lease, _ := m.Allocate("small", "user1", "session-1"); lease.Address != first.Address {
+		t.Errorf("different address for the same session %s", lease.Address)
+	}
+
+	// A late Stop of another session does not release the address
+	if err := m.Release(first.Address, "session-0"); !errors.Is(err, ErrLeaseConflict) {
+		t.Errorf("lease released by another session %v", err)
+	}
+
+	// The released address is reserved for the same user
+	if err := m.Release(first.Address, "session-1"); err != nil {
+		t.Fatalf("could not release: %s", err)
+	}
+	if lease, _ := m.Allocate("small", "user3", "session-3"); lease.Address != "10.0.0.3" {
+		t.Errorf("reserved address allocated %s", lease.Address)
+	}
+	if lease, _ := m.Allocate("small", "user1", "session-4"); lease.Address != first.Address {
+		t.Errorf("sticky address not allocated %s", lease.Address)
+	}
+
+	// Exhausted. The reserved address is given to other users only when needed
+	if _, err := m.Allocate("small", "user5", "session-5"); !errors.Is(err, ErrPoolExhausted) {
+		t.Errorf("allocation in exhausted pool %v", err)
+	}
+	m.Release(second.Address, "")
+	if lease, err := m.Allocate("small", "user5", "session-5"); err != nil || lease.Address != second.Address {
+		t.Errorf("reserved address not reused %v %v", lease, err)
+	}
+
+	u := m.Utilization()
+	if len(u) != 1 || u[0].Size != 3 || u[0].Active != 3 || u[0].Free != 0 || u[0].Utilization != 100 {
+		t.Errorf("bad utilization %v", u)
+	}
+
+	if _, err := m.Allocate("none", "user1", ""); !errors.Is(err, ErrPoolNotFound) {
+		t.Errorf("allocation from unknown pool %v", err)
+	}
+}
+
+func TestLeaseExpiration(t *testing.T) {
+
+	m, _ := NewPoolManager(config.IPPoolsConfig{"single": {Ranges: []string{"10.0.0.1/32"}}})
+	pool := m.pools["single"]
+
+	if _, err := pool.allocate("user1", "session-1", time.Now()); err != nil {
+		t.Fatalf("could not allocate: %s", err)
+	}
+
+	// Not renewed in time, and given to another user
+	later := time.Now().Add(2 * DEFAULT_LEASE_SECONDS * time.Second)
+	if _, err := pool.allocate("user2", "session-2", time.Now()); !errors.Is(err, ErrPoolExhausted) {
+		t.Errorf("active lease reused %v", err)
+	}
+	if lease, err := pool.allocate("user2", "session-2", later); err != nil || lease.StickyKey != "user2" {
+		t.Errorf("expired lease not reused %v %v", lease, err)
+	}
+	if _, found := pool.sticky["user1"]; found {
+		t.Error("sticky entry of the previous user not removed")
+	}
+}
+
+func TestRadiusIntegration(t *testing.T) {
+
+	m, _ := NewPoolManager(config.IPPoolsConfig{
+		"v4": {Ranges: []string{"10.0.0.0/24"}, StickyAttribute: "Calling-Station-Id"},
+		"v6": {DelegatedPrefix: "2001:db8:100::/40", DelegatedPrefixLength: 56},
+	})
+	backend := &memoryBackend{leases: make(map[string]Lease)}
+	if _, err := m.SetBackend(backend); err != nil {
+		t.Fatalf("could not set backend: %s", err)
+	}
+
+	request := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+	request.Add("User-Name", "user@igor")
+	request.Add("Calling-Station-Id", "00-11-22-33-44-55")
+	response := radiuscodec.NewRadiusResponse(request, true)
+	if _, err := m.AssignAddress("v4", request, response); err != nil {
+		t.Fatalf("could not assign address: %s", err)
+	}
+	if _, err := m.AssignAddress("v6", request, response); err != nil {
+		t.Fatalf("could not assign prefix: %s", err)
+	}
+	if response.GetStringAVP("Framed-IP-Address") != "10.0.0.1" || response.GetStringAVP("Delegated-IPv6-Prefix") != "2001:db8:100::/56" {
+		t.Fatalf("bad response %s", response)
+	}
+	if leases, _ := m.Leases("v4"); len(leases) != 1 || leases[0].StickyKey != "00-11-22-33-44-55" {
+		t.Errorf("bad leases %v", leases)
+	}
+
+	// The accounting completes the session
+	accounting := radiuscodec.NewRadiusRequest(radiuscodec.ACCOUNTING_REQUEST)
+	accounting.Add("Acct-Session-Id", "session-1")
+	accounting.Add("Acct-Status-Type", 1)
+	accounting.Add("Framed-IP-Address", "10.0.0.1")
+	accounting.Add("Delegated-IPv6-Prefix", "2001:db8:100::/56")
+	if err := m.PushAccounting(accounting); err != nil {
+		t.Fatalf("error pushing accounting: %s", err)
+	}
+	if leases, _ := m.Leases("v6"); len(leases) != 1 || leases[0].SessionId != "session-1" {
+		t.Errorf("lease not updated %v", leases)
+	}
+
+	// Restored in a new manager
+	m2, _ := NewPoolManager(config.IPPoolsConfig{"v4": {Ranges: []string{"10.0.0.0/24"}}})
+	if restored, err := m2.SetBackend(backend); err != nil || restored != 1 {
+		t.Fatalf("leases not restored %d %v", restored, err)
+	}
+	if lease, _ := m2.Allocate("v4", "other", "session-2"); lease.Address != "10.0.0.2" {
+		t.Errorf("restored address allocated %s", lease.Address)
+	}
+
+	// Addresses not leased are adopted
+	accounting = radiuscodec.NewRadiusRequest(radiuscodec.ACCOUNTING_REQUEST)
+	accounting.Add("Acct-Session-Id", "session-3")
+	accounting.Add("Acct-Status-Type", 3)
+	accounting.Add("Framed-IP-Address", "10.0.0.3")
+	if err := m2.PushAccounting(accounting); err != nil {
+		t.Fatalf("error pushing accounting: %s", err)
+	}
+	if lease, _ := m2.Allocate("v4", "another", "session-4"); lease.Address != "10.0.0.4" {
+		t.Errorf("adopted address allocated %s", lease.Address)
+	}
+
+	// A renewal while the release of the same address is being written is persisted after it
+	backend.releaseDelay = 100 * time.Millisecond
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		m.Release("10.0.0.1", "session-1")
+	}()
+	time.Sleep(20 * time.Millisecond)
+	m.Renew("10.0.0.1", "session-1")
+	wg.Wait()
+	if stored := backend.leases["v4/10.0.0.1"]; stored.Released {
+		t.Errorf("release persisted after renewal %v", stored)
+	}
+}
@@ -0,0 +1,120 @@
+package kafkaproducer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"igor/config"
+	"igor/instrumentation"
+	"igor/radiuscodec"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestMain(m *testing.M) {
+
+	// Initialize the Config Object
+	config.InitPolicyConfigInstance("resources/searchRules.json", "testServer", true)
+
+	// Execute the tests and exit
+	os.Exit(m.Run())
+}
+
+// Keeps the batches written in memory, or fails if err is set
+type memoryWriter struct {
+	sync.Mutex
+	batches [][]kafka.Message
+	err     error
+}
+
+func (mw *memoryWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	mw.Lock()
+	defer mw.Unlock()
+	if mw.err != nil {
+		return mw.err
+	}
+	mw.batches = append(mw.batches, msgs)
+	return nil
+}
+
+func (mw *memoryWriter) Close() error {
+	return nil
+}
+
+func TestKafkaConfig(t *testing.T) {
+	conf := config.GetPolicyConfig().KafkaConf()
+	if len(conf.Brokers) != 1 || conf.BatchSize != 10 || conf.Accounting.Key != "Acct-Session-Id" || conf.PeerEvents.Topic != "igor-peers" {
+		t.Errorf("bad kafka configuration %v", conf)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	writer := memoryWriter{}
+	producer := newProducer(config.GetPolicyConfig(), &writer)
+
+	// The batch size in the configuration is 10
+	for i := 0; i < 25; i++ {
+		request := radiuscodec.NewRadiusRequest(radiuscodec.ACCOUNTING_REQUEST)
+		request.Add("Acct-Session-Id", "session-1")
+		request.Add("User-Name", "user@igor")
+		producer.PublishAccounting(request)
+	}
+	producer.PublishPeerEvent("server.igorserver", false, errors.New("connection reset"))
+	producer.PublishValue("igor-auth", "user@igor", []byte("firstLogin"))
+	producer.Close()
+
+	var messages []kafka.Message
+	for _, batch := range writer.batches {
+		if len(batch) > 10 {
+			t.Errorf("batch of %d messages", len(batch))
+		}
+		messages = append(messages, batch...)
+	}
+	if len(messages) != 27 {
+		t.Fatalf("expected 27 messages but got %d", len(messages))
+	}
+
+	var record AccountingRecord
+	if err := json.Unmarshal(messages[0].Value, &record); err != nil || record.Code != radiuscodec.ACCOUNTING_REQUEST || record.Attributes["User-Name"][0] != "user@igor" {
+		t.Errorf("bad accounting record %s", messages[0].Value)
+	}
+	if messages[0].Topic != "igor-accounting" || string(messages[0].Key) != "session-1" {
+		t.Errorf("bad accounting message topic %s and key %s", messages[0].Topic, messages[0].Key)
+	}
+
+	var event PeerEvent
+	if err := json.Unmarshal(messages[25].Value, &event); err != nil || event.Type != PEER_DOWN || event.Error != "connection reset" {
+		t.Errorf("bad peer event %s", messages[25].Value)
+	}
+	if messages[25].Topic != "igor-peers" || string(messages[25].Key) != "server.igorserver" {
+		t.Errorf("bad peer event topic %s and key %s", messages[25].Topic, messages[25].Key)
+	}
+
+	// Published as is
+	if messages[26].Topic != "igor-auth" || string(messages[26].Key) != "user@igor" || string(messages[26].Value) != "firstLogin" {
+		t.Errorf("bad value message %v", messages[26])
+	}
+}
+
+func TestDeliveryFailure(t *testing.T) {
+	instrumentation.MS.ResetMetrics()
+
+	producer := newProducer(config.GetPolicyConfig(), &memoryWriter{err: errors.New("broker not available")})
+	request := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+	producer.PublishRadiusHandlerError(request, errors.New("handler error"))
+	producer.PublishRadiusHandlerError(request, errors.New("handler error"))
+	producer.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	failures := instrumentation.MS.KafkaQuery("KafkaDeliveryFailures", nil, []string{"Topic"})
+	if failures[instrumentation.KafkaMetricKey{Topic: "igor-errors"}] != 2 {
+		t.Errorf("bad delivery failures metric %v", failures)
+	}
+	if sent := instrumentation.MS.KafkaQuery("KafkaMessagesSent", nil, nil); len(sent) != 0 {
+		t.Errorf("bad messages sent metric %v", sent)
+	}
+}
@@ -0,0 +1,288 @@
+package kafkaproducer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"igor/config"
+	"igor/diamcodec"
+	"igor/instrumentation"
+	"igor/radiuscodec"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Publication of the accounting records, the changes in the status of the diameter peers and the errors
+// of the handlers to Kafka topics, as specified in the kafka.json configuration. The messages are queued
+// without blocking and sent in batches by a background goroutine. The ones that do not fit in the queue
+// or could not be delivered are discarded and counted in the KafkaDeliveryFailures metric
+
+// Defaults for the values not specified in the configuration
+const (
+	DEFAULT_BATCH_SIZE           = 100
+	DEFAULT_BATCH_TIMEOUT_MILLIS = 100
+	DEFAULT_QUEUE_SIZE           = 10000
+)
+
+// Timeout for delivering a batch to the brokers
+const SEND_TIMEOUT_SECONDS = 10
+
+// Types of peer events
+const (
+	PEER_UP   = "peerUp"
+	PEER_DOWN = "peerDown"
+)
+
+// Published for each radius or diameter accounting request
+type AccountingRecord struct {
+	Timestamp time.Time
+
+	// Radius code or diameter command
+	Code    byte   `json:",omitempty"`
+	Command string `json:",omitempty"`
+
+	Attributes map[string][]string
+}
+
+// Published when a diameter peer is engaged or disconnected
+type PeerEvent struct {
+	Type      string
+	Timestamp time.Time
+	Peer      string
+
+	// Cause of the disconnection, if any
+	Error string `json:",omitempty"`
+}
+
+// Published when the handler of a request returns an error
+type HandlerErrorEvent struct {
+	Timestamp time.Time
+
+	// "radius" or "diameter"
+	Protocol string
+
+	// Radius code or diameter command of the request
+	Code    byte   `json:",omitempty"`
+	Command string `json:",omitempty"`
+
+	Error string
+}
+
+// Sends the messages to the brokers. Implemented by kafka.Writer
+type messageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// Publishes the events to Kafka. Safe for concurrent use
+type Producer struct {
+	ci     *config.PolicyConfigurationManager
+	writer messageWriter
+
+	batchSize    int
+	batchTimeout time.Duration
+
+	queue chan kafka.Message
+
+	// To wait for the sender to finish
+	wg sync.WaitGroup
+}
+
+// Creates a Producer that sends to the brokers in the current Kafka configuration. The topics and
+// keys are taken from the configuration when each event is published
+func NewProducer(ci *config.PolicyConfigurationManager) (*Producer, error) {
+	conf := ci.KafkaConf()
+	if len(conf.Brokers) == 0 {
+		return nil, errors.New("no Kafka brokers configured")
+	}
+
+	batchSize := conf.BatchSize
+	if batchSize <= 0 {
+		batchSize = DEFAULT_BATCH_SIZE
+	}
+	writer := &kafka.Writer{
+		Addr:      kafka.TCP(conf.Brokers...),
+		Balancer:  &kafka.Hash{},
+		BatchSize: batchSize,
+		// The batches are formed by the producer. Do not wait for more messages
+		BatchTimeout: time.Millisecond,
+	}
+	return newProducer(ci, writer), nil
+}
+
+// Creates the producer with the specified writer and starts sending
+func newProducer(ci *config.PolicyConfigurationManager, writer messageWriter) *Producer {
+	conf := ci.KafkaConf()
+	p := Producer{
+		ci:           ci,
+		writer:       writer,
+		batchSize:    conf.BatchSize,
+		batchTimeout: time.Duration(conf.BatchTimeoutMillis) * time.Millisecond,
+	}
+	if p.batchSize <= 0 {
+		p.batchSize = DEFAULT_BATCH_SIZE
+	}
+	if p.batchTimeout <= 0 {
+		p.batchTimeout = DEFAULT_BATCH_TIMEOUT_MILLIS * time.Millisecond
+	}
+	queueSize := conf.QueueSize
+	if queueSize <= 0 {
+		queueSize = DEFAULT_QUEUE_SIZE
+	}
+	p.queue = make(chan kafka.Message, queueSize)
+
+	p.wg.Add(1)
+	go p.sendLoop()
+
+	return &p
+}
+
+// Stops publishing, after the queued messages are sent. Must not be called while the producer is still in use
+func (p *Producer) Close() error {
+	close(p.queue)
+	p.wg.Wait()
+	return p.writer.Close()
+}
+
+// Publishes the radius accounting request, if a topic for accounting is configured
+func (p *Producer) PublishAccounting(packet *radiuscodec.RadiusPacket) {
+	topicConf := p.ci.KafkaConf().Accounting
+	if topicConf.Topic == "" {
+		return
+	}
+
+	record := AccountingRecord{Timestamp: time.Now(), Code: packet.Code, Attributes: make(map[string][]string)}
+	for _, avp := range packet.AVPs {
+		record.Attributes[avp.Name] = append(record.Attributes[avp.Name], avp.GetString())
+	}
+	p.publish(topicConf.Topic, packet.GetStringAVP(topicConf.Key), record)
+}
+
+// Publishes the diameter accounting request, if a topic for accounting is configured
+func (p *Producer) PublishDiameterAccounting(message *diamcodec.DiameterMessage) {
+	topicConf := p.ci.KafkaConf().Accounting
+	if topicConf.Topic == "" {
+		return
+	}
+
+	record := AccountingRecord{Timestamp: time.Now(), Command: message.CommandName, Attributes: make(map[string][]string)}
+	for _, avp := range message.AVPs {
+		record.Attributes[avp.Name] = append(record.Attributes[avp.Name], avp.GetString())
+	}
+	p.publish(topicConf.Topic, message.GetStringAVP(topicConf.Key), record)
+}
+
+// Publishes the engagement or disconnection of the peer, if a topic for peer events is configured.
+// The error is the cause of the disconnection, and may be nil
+func (p *Producer) PublishPeerEvent(peerName string, up bool, err error) {
+	topicConf := p.ci.KafkaConf().PeerEvents
+	if topicConf.Topic == "" {
+		return
+	}
+
+	event := PeerEvent{Type: PEER_DOWN, Timestamp: time.Now(), Peer: peerName}
+	if up {
+		event.Type = PEER_UP
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	p.publish(topicConf.Topic, peerName, event)
+}
+
+// Publishes the error of the handler of the radius request, if a topic for handler errors is configured
+func (p *Producer) PublishRadiusHandlerError(request *radiuscodec.RadiusPacket, err error) {
+	topicConf := p.ci.KafkaConf().HandlerErrors
+	if topicConf.Topic == "" {
+		return
+	}
+
+	event := HandlerErrorEvent{Timestamp: time.Now(), Protocol: "radius", Code: request.Code, Error: err.Error()}
+	p.publish(topicConf.Topic, request.GetStringAVP(topicConf.Key), event)
+}
+
+// Publishes the error of the handler of the diameter request, if a topic for handler errors is configured
+func (p *Producer) PublishDiameterHandlerError(request *diamcodec.DiameterMessage, err error) {
+	topicConf := p.ci.KafkaConf().HandlerErrors
+	if topicConf.Topic == "" {
+		return
+	}
+
+	event := HandlerErrorEvent{Timestamp: time.Now(), Protocol: "diameter", Command: request.CommandName, Error: err.Error()}
+	p.publish(topicConf.Topic, request.GetStringAVP(topicConf.Key), event)
+}
+
+// Queues the value, which is sent as is, without blocking. The key may be empty
+func (p *Producer) PublishValue(topic string, key string, value []byte) {
+	message := kafka.Message{Topic: topic, Value: value}
+	if key != "" {
+		message.Key = []byte(key)
+	}
+
+	select {
+	case p.queue <- message:
+	default:
+		config.GetLogger().Warnf("kafka queue full. Message for topic %s discarded", topic)
+		instrumentation.PushKafkaDeliveryFailure(p.ci.InstanceName(), topic)
+	}
+}
+
+// Queues the value, serialized as JSON, without blocking
+func (p *Producer) publish(topic string, key string, value interface{}) {
+	jValue, err := json.Marshal(value)
+	if err != nil {
+		config.GetLogger().Errorf("could not serialize message for topic %s: %s", topic, err)
+		instrumentation.PushKafkaDeliveryFailure(p.ci.InstanceName(), topic)
+		return
+	}
+	p.PublishValue(topic, key, jValue)
+}
+
+// Sends the queued messages in batches, until the queue is closed. A batch is sent when it is full or
+// the batch timeout has elapsed since its first message was taken
+func (p *Producer) sendLoop() {
+	defer p.wg.Done()
+
+	for message := range p.queue {
+		batch := []kafka.Message{message}
+		timer := time.NewTimer(p.batchTimeout)
+	fill:
+		for len(batch) < p.batchSize {
+			select {
+			case next, ok := <-p.queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, next)
+			case <-timer.C:
+				break fill
+			}
+		}
+		timer.Stop()
+		p.send(batch)
+	}
+}
+
+// Writes the batch to the brokers and updates the metrics
+func (p *Producer) send(batch []kafka.Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), SEND_TIMEOUT_SECONDS*time.Second)
+	defer cancel()
+
+	err := p.writer.WriteMessages(ctx, batch...)
+	if err != nil {
+		config.GetLogger().Errorf("could not deliver %d kafka messages: %s", len(batch), err)
+	}
+
+	// If the error is not per message, all of them failed
+	var writeErrors kafka.WriteErrors
+	isWriteErrors := errors.As(err, &writeErrors) && len(writeErrors) == len(batch)
+	for i := range batch {
+		if err == nil || (isWriteErrors && writeErrors[i] == nil) {
+			instrumentation.PushKafkaMessageSent(p.ci.InstanceName(), batch[i].Topic)
+		} else {
+			instrumentation.PushKafkaDeliveryFailure(p.ci.InstanceName(), batch[i].Topic)
+		}
+	}
+}
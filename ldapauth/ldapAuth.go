@@ -0,0 +1,371 @@
+package ldapauth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"igor/config"
+	"igor/radiuscodec"
+	"igor/radiusdict"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Helper for radius handlers to authenticate the users against an LDAP directory, as specified in the
+// ldapAuth.json configuration object. The password is verified by binding with the credentials of
+// the user or, using a service account, by finding the entry of the user and comparing the password
+// attribute. The values of the attributes of the entry may be sent in the Access-Accept.
+//
+// The servers are tried in order, skipping those that failed recently, and the connections to each
+// of them are reused
+
+// Defaults for the values not specified in the configuration
+const (
+	DEFAULT_MAX_IDLE_CONNECTIONS = 4
+	DEFAULT_TIMEOUT_MILLIS       = 2000
+	DEFAULT_QUARANTINE_SECONDS   = 30
+	DEFAULT_PASSWORD_ATTRIBUTE   = "userPassword"
+)
+
+// Returned when the credentials are not valid or the user is not found
+var ErrAuthenticationFailed = errors.New("authentication failed")
+
+// Operations used on the LDAP connections. Implemented by *ldap.Conn
+type ldapConn interface {
+	Bind(username, password string) error
+	Compare(dn, attribute, value string) (bool, error)
+	Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close()
+}
+
+// Server with its idle connections
+type ldapServer struct {
+	url  string
+	idle chan ldapConn
+
+	mutex            sync.Mutex
+	quarantinedUntil time.Time
+}
+
+// Returns true if the server has not failed recently
+func (s *ldapServer) isAvailable(now time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return now.After(s.quarantinedUntil)
+}
+
+// Marks the server as failed, and closes the idle connections, which will probably fail too
+func (s *ldapServer) quarantine(duration time.Duration) {
+	s.mutex.Lock()
+	s.quarantinedUntil = time.Now().Add(duration)
+	s.mutex.Unlock()
+
+	for {
+		select {
+		case conn := <-s.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// Returns the connection to the pool, or closes it if the pool is full
+func (s *ldapServer) release(conn ldapConn) {
+	select {
+	case s.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+type LDAPAuthenticator struct {
+	conf config.LDAPAuthConfig
+
+	// Used to build the reply attributes
+	dict *radiusdict.RadiusDict
+
+	tlsConfig  *tls.Config
+	timeout    time.Duration
+	quarantine time.Duration
+
+	servers []*ldapServer
+
+	// Creates the connections. Replaced in the tests
+	dial func(url string) (ldapConn, error)
+}
+
+// Creates the authenticator with the specified configuration and radius dictionary, typically the
+// LDAPAuthConf() and RadiusDict() of the policy configuration instance
+func NewLDAPAuthenticator(conf config.LDAPAuthConfig, dict *radiusdict.RadiusDict) (*LDAPAuthenticator, error) {
+	if len(conf.Servers) == 0 {
+		return nil, errors.New("no LDAP servers specified")
+	}
+	switch conf.Mode {
+	case "bind":
+		if conf.BindDNTemplate == "" {
+			return nil, errors.New("no bind DN template specified")
+		}
+	case "search":
+		if conf.BaseDN == "" || conf.SearchFilter == "" {
+			return nil, errors.New("no base DN or search filter specified")
+		}
+	default:
+		return nil, fmt.Errorf("bad LDAP authentication mode %q", conf.Mode)
+	}
+
+	if conf.PasswordAttribute == "" {
+		conf.PasswordAttribute = DEFAULT_PASSWORD_ATTRIBUTE
+	}
+	if conf.MaxIdleConnections == 0 {
+		conf.MaxIdleConnections = DEFAULT_MAX_IDLE_CONNECTIONS
+	}
+	if conf.TimeoutMillis == 0 {
+		conf.TimeoutMillis = DEFAULT_TIMEOUT_MILLIS
+	}
+	if conf.QuarantineSeconds == 0 {
+		conf.QuarantineSeconds = DEFAULT_QUARANTINE_SECONDS
+	}
+
+	a := LDAPAuthenticator{
+		conf:       conf,
+		dict:       dict,
+		tlsConfig:  &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify},
+		timeout:    time.Duration(conf.TimeoutMillis) * time.Millisecond,
+		quarantine: time.Duration(conf.QuarantineSeconds) * time.Second,
+	}
+	if conf.CAFile != "" {
+		pemCerts, err := ioutil.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA file: %w", err)
+		}
+		a.tlsConfig.RootCAs = x509.NewCertPool()
+		if !a.tlsConfig.RootCAs.AppendCertsFromPEM(pemCerts) {
+			return nil, fmt.Errorf("no certificates found in %s", conf.CAFile)
+		}
+	}
+	for _, url := range conf.Servers {
+		a.servers = append(a.servers, &ldapServer{url: url, idle: make(chan ldapConn, conf.MaxIdleConnections)})
+	}
+	a.dial = a.dialServer
+
+	return &a, nil
+}
+
+// Closes the idle connections
+func (a *LDAPAuthenticator) Close() {
+	for _, server := range a.servers {
+		for len(server.idle) > 0 {
+			(<-server.idle).Close()
+		}
+	}
+}
+
+// Checks the credentials of the user and returns the attributes to send in the Access-Accept. If the
+// credentials are not valid, the error is ErrAuthenticationFailed
+func (a *LDAPAuthenticator) Authenticate(userName string, password string) ([]*radiuscodec.RadiusAVP, error) {
+
+	// An empty password would be an unauthenticated bind, which succeeds
+	if userName == "" || password == "" {
+		return nil, fmt.Errorf("empty user name or password: %w", ErrAuthenticationFailed)
+	}
+
+	// If all the servers are in quarantine, try them anyway
+	now := time.Now()
+	servers := make([]*ldapServer, 0, len(a.servers))
+	for _, server := range a.servers {
+		if server.isAvailable(now) {
+			servers = append(servers, server)
+		}
+	}
+	if len(servers) == 0 {
+		servers = a.servers
+	}
+
+	var lastErr error
+	for _, server := range servers {
+		var conn ldapConn
+		select {
+		case conn = <-server.idle:
+		default:
+			var err error
+			if conn, err = a.dial(server.url); err != nil {
+				lastErr = fmt.Errorf("could not connect to %s: %w", server.url, err)
+				server.quarantine(a.quarantine)
+				continue
+			}
+		}
+
+		entry, err := a.verify(conn, userName, password)
+		if ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+			lastErr = fmt.Errorf("LDAP server %s error: %w", server.url, err)
+			conn.Close()
+			server.quarantine(a.quarantine)
+			continue
+		}
+		server.release(conn)
+		if err != nil {
+			return nil, err
+		}
+		return a.replyAttributes(entry)
+	}
+
+	return nil, fmt.Errorf("no LDAP server available: %w", lastErr)
+}
+
+// Builds the Access-Accept or the Access-Reject for the User-Name and User-Password of the request.
+// May be used as a radiusserver.RadiusPacketHandler
+func (a *LDAPAuthenticator) HandleAccessRequest(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+	avps, err := a.Authenticate(request.GetStringAVP("User-Name"), request.GetPasswordStringAVP("User-Password"))
+	if errors.Is(err, ErrAuthenticationFailed) {
+		return radiuscodec.NewRadiusResponse(request, false), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	response := radiuscodec.NewRadiusResponse(request, true)
+	for _, avp := range avps {
+		response.AddAVP(avp)
+	}
+	return response, nil
+}
+
+// Checks the password using the connection, and returns the entry of the user with the reply attributes,
+// or nil if there are none to retrieve
+func (a *LDAPAuthenticator) verify(conn ldapConn, userName string, password string) (*ldap.Entry, error) {
+	attributes := make([]string, 0, len(a.conf.ReplyAttributes))
+	for ldapAttribute := range a.conf.ReplyAttributes {
+		attributes = append(attributes, ldapAttribute)
+	}
+
+	if a.conf.Mode == "bind" {
+		dn := strings.ReplaceAll(a.conf.BindDNTemplate, "${user}", escapeDNValue(userName))
+		if err := conn.Bind(dn, password); err != nil {
+			if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+				return nil, fmt.Errorf("%s: %w", userName, ErrAuthenticationFailed)
+			}
+			return nil, err
+		}
+		if len(attributes) == 0 {
+			return nil, nil
+		}
+		return a.searchOne(conn, dn, ldap.ScopeBaseObject, "(objectClass=*)", attributes, userName)
+	}
+
+	if err := conn.Bind(a.conf.ServiceDN, a.conf.ServicePassword); err != nil {
+		return nil, fmt.Errorf("could not bind with the service account: %w", err)
+	}
+	filter := strings.ReplaceAll(a.conf.SearchFilter, "${user}", ldap.EscapeFilter(userName))
+	entry, err := a.searchOne(conn, a.conf.BaseDN, ldap.ScopeWholeSubtree, filter, attributes, userName)
+	if err != nil {
+		return nil, err
+	}
+	matches, err := conn.Compare(entry.DN, a.conf.PasswordAttribute, password)
+	if err != nil {
+		return nil, err
+	}
+	if !matches {
+		return nil, fmt.Errorf("%s: %w", userName, ErrAuthenticationFailed)
+	}
+	return entry, nil
+}
+
+// Returns the single entry found, or ErrAuthenticationFailed if there is none or more than one
+func (a *LDAPAuthenticator) searchOne(conn ldapConn, baseDN string, scope int, filter string, attributes []string, userName string) (*ldap.Entry, error) {
+	request := ldap.NewSearchRequest(baseDN, scope, ldap.NeverDerefAliases, 2, a.conf.TimeoutMillis/1000, false, filter, attributes, nil)
+	result, err := conn.Search(request)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return nil, fmt.Errorf("%s not found: %w", userName, ErrAuthenticationFailed)
+		}
+		return nil, err
+	}
+	if len(result.Entries) != 1 {
+		return nil, fmt.Errorf("%d entries found for %s: %w", len(result.Entries), userName, ErrAuthenticationFailed)
+	}
+	return result.Entries[0], nil
+}
+
+// Builds the radius attributes with the values of the mapped LDAP attributes of the entry
+func (a *LDAPAuthenticator) replyAttributes(entry *ldap.Entry) ([]*radiuscodec.RadiusAVP, error) {
+	avps := make([]*radiuscodec.RadiusAVP, 0)
+	if entry == nil {
+		return avps, nil
+	}
+
+	// In a predictable order
+	ldapAttributes := make([]string, 0, len(a.conf.ReplyAttributes))
+	for ldapAttribute := range a.conf.ReplyAttributes {
+		ldapAttributes = append(ldapAttributes, ldapAttribute)
+	}
+	sort.Strings(ldapAttributes)
+
+	for _, ldapAttribute := range ldapAttributes {
+		radiusAttribute := a.conf.ReplyAttributes[ldapAttribute]
+		for _, value := range entry.GetAttributeValues(ldapAttribute) {
+			avp, err := newAVP(a.dict, radiusAttribute, value)
+			if err != nil {
+				return nil, fmt.Errorf("bad value of %s for %s: %w", ldapAttribute, radiusAttribute, err)
+			}
+			avps = append(avps, avp)
+		}
+	}
+	return avps, nil
+}
+
+// Opens a connection to the server, upgrading it to TLS if so configured
+func (a *LDAPAuthenticator) dialServer(url string) (ldapConn, error) {
+	conn, err := ldap.DialURL(url, ldap.DialWithDialer(&net.Dialer{Timeout: a.timeout}), ldap.DialWithTLSConfig(a.tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(a.timeout)
+	if a.conf.StartTLS && strings.HasPrefix(url, "ldap://") {
+		if err := conn.StartTLS(a.tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Builds the radius attribute from the LDAP value. Integer attributes may be specified by number or by
+// the name of the value in the dictionary
+func newAVP(dict *radiusdict.RadiusDict, name string, value string) (*radiuscodec.RadiusAVP, error) {
+	dictItem, _ := dict.GetFromName(name)
+	switch dictItem.RadiusType {
+	case radiusdict.Integer, radiusdict.Integer64:
+		if enumValue, found := dictItem.EnumValues[value]; found {
+			return radiuscodec.NewAVPWithDict(dict, name, enumValue)
+		}
+		return radiuscodec.NewAVPWithDict(dict, name, json.Number(value))
+	default:
+		return radiuscodec.NewAVPWithDict(dict, name, value)
+	}
+}
+
+// Escapes the special characters of a value in a DN, as specified in RFC 4514
+func escapeDNValue(value string) string {
+	var sb strings.Builder
+	for i, c := range value {
+		switch {
+		case strings.ContainsRune(`,+"\<>;=`, c), c == '#' && i == 0, c == ' ' && (i == 0 || i == len(value)-1):
+			sb.WriteRune('\\')
+			sb.WriteRune(c)
+		case c == 0:
+			sb.WriteString(`\00`)
+		default:
+			sb.WriteRune(c)
+		}
+	}
+	return sb.String()
+}
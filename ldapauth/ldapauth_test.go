@@ -0,0 +1,246 @@
+package ldapauth
+
+import (
+	"errors"
+	"igor/config"
+	"igor/radiuscodec"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+func TestMain(m *testing.M) {
+
+	// Initialize the Config Object
+	config.InitPolicyConfigInstance("resources/searchRules.json", "testServer", true)
+
+	// Execute the tests and exit
+	os.Exit(m.Run())
+}
+
+// In memory directory, with the entries by DN
+type fakeDirectory struct {
+	entries map[string]map[string][]string
+	down    bool
+	dialed  int
+}
+
+func newFakeDirectory() *fakeDirectory {
+	return &fakeDirectory{
+		entries: map[string]map[string][]string{
+			"cn=service,dc=igor": {"userPassword": {"servicepwd"}},
+			"uid=user,ou=people,dc=igor": {
+				"uid":            {"user"},
+				"userPassword":   {"secret"},
+				"sessionTimeout": {"3600"},
+				"serviceType":    {"Framed"},
+				"radiusClass":    {"gold", "silver"},
+			},
+		},
+	}
+}
+
+type fakeConn struct {
+	directory *fakeDirectory
+	closed    bool
+}
+
+func (c *fakeConn) networkError() error {
+	return ldap.NewError(ldap.ErrorNetwork, errors.New("connection reset"))
+}
+
+func (c *fakeConn) Bind(username, password string) error {
+	if c.directory.down {
+		return c.networkError()
+	}
+	if entry, found := c.directory.entries[username]; found && entry["userPassword"][0] == password {
+		return nil
+	}
+	return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+}
+
+func (c *fakeConn) Compare(dn, attribute, value string) (bool, error) {
+	if c.directory.down {
+		return false, c.networkError()
+	}
+	for _, v := range c.directory.entries[dn][attribute] {
+		if v == value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Only supports filters of the form (uid=<name>)
+func (c *fakeConn) Search(request *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if c.directory.down {
+		return nil, c.networkError()
+	}
+	result := ldap.SearchResult{}
+	for dn, attrs := range c.directory.entries {
+		if request.Scope == ldap.ScopeBaseObject && dn != request.BaseDN {
+			continue
+		}
+		if request.Scope == ldap.ScopeWholeSubtree && (len(attrs["uid"]) == 0 || "(uid="+attrs["uid"][0]+")" != request.Filter) {
+			continue
+		}
+		entry := ldap.Entry{DN: dn}
+		for _, name := range request.Attributes {
+			entry.Attributes = append(entry.Attributes, &ldap.EntryAttribute{Name: name, Values: attrs[name]})
+		}
+		result.Entries = append(result.Entries, &entry)
+	}
+	if len(result.Entries) == 0 && request.Scope == ldap.ScopeBaseObject {
+		return nil, ldap.NewError(ldap.LDAPResultNoSuchObject, errors.New("no such object"))
+	}
+	return &result, nil
+}
+
+func (c *fakeConn) Close() {
+	c.closed = true
+}
+
+// Creates an authenticator whose servers are the specified fake directories, by URL
+func newTestAuthenticator(t *testing.T, conf config.LDAPAuthConfig, directories map[string]*fakeDirectory) *LDAPAuthenticator {
+	a, err := NewLDAPAuthenticator(conf, config.GetPolicyConfig().RadiusDict())
+	if err != nil {
+		t.Fatalf("could not create authenticator: %s", err)
+	}
+	a.dial = func(url string) (ldapConn, error) {
+		directory := directories[url]
+		if directory.down {
+			return nil, errors.New("connection refused")
+		}
+		directory.dialed++
+		return &fakeConn{directory: directory}, nil
+	}
+	return a
+}
+
+var replyAttributes = map[string]string{
+	"sessionTimeout": "Session-Timeout",
+	"serviceType":    "Service-Type",
+	"radiusClass":    "Class",
+}
+
+func TestBindMode(t *testing.T) {
+
+	directory := newFakeDirectory()
+	a := newTestAuthenticator(t, config.LDAPAuthConfig{
+		Servers:         []string{"ldap://primary"},
+		Mode:            "bind",
+		BindDNTemplate:  "uid=${user},ou=people,dc=igor",
+		ReplyAttributes: replyAttributes,
+	}, map[string]*fakeDirectory{"ldap://primary": directory})
+	defer a.Close()
+
+	avps, err := a.Authenticate("user", "secret")
+	if err != nil {
+		t.Fatalf("authentication failed: %s", err)
+	}
+	var names []string
+	for _, avp := range avps {
+		names = append(names, avp.Name+"="+avp.GetString())
+	}
+	if strings.Join(names, ",") != "Class=gold,Class=silver,Service-Type=Framed,Session-Timeout=3600" {
+		t.Errorf("bad reply attributes %v", names)
+	}
+
+	if _, err := a.Authenticate("user", "bad"); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("bad password accepted %v", err)
+	}
+	if _, err := a.Authenticate("user", ""); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("empty password accepted %v", err)
+	}
+
+	// The connection is reused
+	if directory.dialed != 1 {
+		t.Errorf("connection dialed %d times", directory.dialed)
+	}
+}
+
+func TestSearchMode(t *testing.T) {
+
+	a := newTestAuthenticator(t, config.LDAPAuthConfig{
+		Servers:         []string{"ldap://primary"},
+		Mode:            "search",
+		ServiceDN:       "cn=service,dc=igor",
+		ServicePassword: "servicepwd",
+		BaseDN:          "dc=igor",
+		SearchFilter:    "(uid=${user})",
+		ReplyAttributes: replyAttributes,
+	}, map[string]*fakeDirectory{"ldap://primary": newFakeDirectory()})
+	defer a.Close()
+
+	request := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+	request.Add("User-Name", "user")
+	request.Add("User-Password", []byte("secret"))
+	response, err := a.HandleAccessRequest(request)
+	if err != nil {
+		t.Fatalf("error handling request: %s", err)
+	}
+	if response.Code != radiuscodec.ACCESS_ACCEPT || response.GetIntAVP("Session-Timeout") != 3600 || response.GetStringAVP("Service-Type") != "Framed" {
+		t.Errorf("bad response %s", response)
+	}
+
+	request = radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+	request.Add("User-Name", "unknown")
+	request.Add("User-Password", []byte("secret"))
+	if response, err := a.HandleAccessRequest(request); err != nil || response.Code != radiuscodec.ACCESS_REJECT {
+		t.Errorf("unknown user not rejected %v %v", response, err)
+	}
+
+	// The special characters in the user name are escaped
+	if _, err := a.Authenticate("*", "secret"); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("wildcard user name accepted %v", err)
+	}
+}
+
+func TestFailover(t *testing.T) {
+
+	primary := newFakeDirectory()
+	secondary := newFakeDirectory()
+	a := newTestAuthenticator(t, config.LDAPAuthConfig{
+		Servers:        []string{"ldap://primary", "ldap://secondary"},
+		Mode:           "bind",
+		BindDNTemplate: "uid=${user},ou=people,dc=igor",
+	}, map[string]*fakeDirectory{"ldap://primary": primary, "ldap://secondary": secondary})
+	defer a.Close()
+
+	if _, err := a.Authenticate("user", "secret"); err != nil || primary.dialed != 1 {
+		t.Fatalf("authentication in primary failed %s", err)
+	}
+
+	// The pooled connection fails, and the secondary is used
+	primary.down = true
+	if _, err := a.Authenticate("user", "secret"); err != nil || secondary.dialed != 1 {
+		t.Fatalf("authentication in secondary failed %s", err)
+	}
+
+	// The primary is in quarantine, and not tried even if recovered
+	primary.down = false
+	if _, err := a.Authenticate("user", "secret"); err != nil || primary.dialed != 1 {
+		t.Errorf("primary in quarantine was used %s", err)
+	}
+
+	// With all the servers failing, the error is not an authentication failure
+	primary.down = true
+	secondary.down = true
+	if _, err := a.Authenticate("user", "secret"); err == nil || errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("server error not reported %v", err)
+	}
+}
+
+func TestLDAPAuthConfig(t *testing.T) {
+	if _, err := NewLDAPAuthenticator(config.LDAPAuthConfig{Servers: []string{"ldap://primary"}, Mode: "anonymous"}, config.GetPolicyConfig().RadiusDict()); err == nil {
+		t.Error("bad mode accepted")
+	}
+	if _, err := NewLDAPAuthenticator(config.LDAPAuthConfig{Mode: "bind", BindDNTemplate: "uid=${user}"}, config.GetPolicyConfig().RadiusDict()); err == nil {
+		t.Error("empty server list accepted")
+	}
+	if escaped := escapeDNValue(" a,b=c#"); escaped != `\ a\,b\=c#` {
+		t.Errorf("bad escaped DN value %s", escaped)
+	}
+}
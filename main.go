@@ -1,21 +1,43 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"igor/config"
+	"igor/instances"
+	"igor/systemd"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
 func main() {
 
 	// Get the command line arguments
 	bootPtr := flag.String("boot", "resources/searchRules.json", "File or http URL with Configuration Search Rules")
-	instancePtr := flag.String("instance", "", "Name of instance")
+	instancePtr := flag.String("instance", "", "Name of instance. Several instances, separated by commas, may be run. The first one is the default")
 
 	flag.Parse()
 
-	// Initialize the Config Object
-	config.InitPolicyConfigInstance(*bootPtr, *instancePtr, true)
+	// Start the instances. The first one initializes the logger and the dictionaries
+	manager := instances.NewManager(*bootPtr)
+	for _, instanceName := range strings.Split(*instancePtr, ",") {
+		if _, err := manager.StartInstance(strings.TrimSpace(instanceName)); err != nil {
+			panic(err)
+		}
+	}
 
-	// Get logger
-	// logger := config.GetConfigInstance(*instancePtr).IgorLogger
+	// Tell systemd that we are ready, if started by it
+	systemd.Notify("READY=1")
+	systemd.StartWatchdog(context.Background())
+
+	// Run until terminated
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	<-ctx.Done()
+
+	systemd.Notify("STOPPING=1")
+	manager.StopAll()
+	config.GetLogger().Info("igor terminated")
 }
@@ -0,0 +1,234 @@
+package milenage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"igor/random"
+)
+
+// MILENAGE authentication and key generation functions (3GPP TS 35.206), and the generation of the
+// UMTS and EPS authentication vectors (3GPP TS 33.102 and 33.401), so that igor may act as a test HSS
+
+// Sizes of the parameters, in bytes
+const (
+	KEY_SIZE  = 16
+	RAND_SIZE = 16
+	SQN_SIZE  = 6
+	AMF_SIZE  = 2
+	AUTS_SIZE = 14
+)
+
+// Returned when the MAC-S in the AUTS sent by the USIM is not valid
+var ErrBadAUTS = errors.New("bad MAC-S in AUTS")
+
+// The MILENAGE functions for a subscriber, with key K and operator variant OPc
+type Milenage struct {
+	block cipher.Block
+	opc   []byte
+}
+
+// Creates the MILENAGE functions for the subscriber key and OPc
+func New(k []byte, opc []byte) (*Milenage, error) {
+	if len(k) != KEY_SIZE || len(opc) != KEY_SIZE {
+		return nil, fmt.Errorf("bad K or OPc size %d, %d", len(k), len(opc))
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	return &Milenage{block: block, opc: append([]byte(nil), opc...)}, nil
+}
+
+// Derives the OPc from the subscriber key and the operator variant OP
+func ComputeOPc(k []byte, op []byte) ([]byte, error) {
+	if len(k) != KEY_SIZE || len(op) != KEY_SIZE {
+		return nil, fmt.Errorf("bad K or OP size %d, %d", len(k), len(op))
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	opc := make([]byte, KEY_SIZE)
+	block.Encrypt(opc, op)
+	xor(opc, op)
+	return opc, nil
+}
+
+// Returns MAC-A (f1) and MAC-S (f1*)
+func (m *Milenage) F1(rand []byte, sqn []byte, amf []byte) (macA []byte, macS []byte) {
+	// IN1 = SQN || AMF || SQN || AMF
+	in1 := make([]byte, 0, KEY_SIZE)
+	in1 = append(append(append(append(in1, sqn...), amf...), sqn...), amf...)
+	xor(in1, m.opc)
+
+	temp := m.temp(rand)
+	out := rotate(in1, 8)
+	xor(out, temp)
+	m.block.Encrypt(out, out)
+	xor(out, m.opc)
+
+	return out[0:8], out[8:16]
+}
+
+// Returns RES (f2), CK (f3), IK (f4) and AK (f5)
+func (m *Milenage) F2345(rand []byte) (res []byte, ck []byte, ik []byte, ak []byte) {
+	temp := m.temp(rand)
+
+	out2 := m.out(temp, 0, 1)
+	return out2[8:16], m.out(temp, 4, 2), m.out(temp, 8, 4), out2[0:6]
+}
+
+// Returns AK for resynchronization (f5*)
+func (m *Milenage) F5Star(rand []byte) []byte {
+	return m.out(m.temp(rand), 12, 8)[0:6]
+}
+
+// TEMP = E[RAND xor OPc]K
+func (m *Milenage) temp(rand []byte) []byte {
+	temp := append([]byte(nil), rand...)
+	xor(temp, m.opc)
+	m.block.Encrypt(temp, temp)
+	return temp
+}
+
+// OUTn = E[rot(TEMP xor OPc, r) xor c]K xor OPc, with r in bytes and c the value of the last byte of the constant
+func (m *Milenage) out(temp []byte, r int, c byte) []byte {
+	in := append([]byte(nil), temp...)
+	xor(in, m.opc)
+	out := rotate(in, r)
+	out[KEY_SIZE-1] ^= c
+	m.block.Encrypt(out, out)
+	xor(out, m.opc)
+	return out
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// Authentication vector for UMTS
+type UTRANVector struct {
+	RAND []byte
+	XRES []byte
+	AUTN []byte
+	CK   []byte
+	IK   []byte
+}
+
+// Authentication vector for EPS. The KASME is bound to the serving network
+type EUTRANVector struct {
+	RAND  []byte
+	XRES  []byte
+	AUTN  []byte
+	KASME []byte
+}
+
+// Generates the UMTS authentication vector for the sequence number, with a random RAND
+func (m *Milenage) GenerateUTRANVector(sqn []byte, amf []byte) (*UTRANVector, error) {
+	rand := make([]byte, RAND_SIZE)
+	random.Read(rand)
+	return m.GenerateUTRANVectorWithRAND(rand, sqn, amf)
+}
+
+// Generates the UMTS authentication vector with the specified RAND
+func (m *Milenage) GenerateUTRANVectorWithRAND(rand []byte, sqn []byte, amf []byte) (*UTRANVector, error) {
+	if len(rand) != RAND_SIZE || len(sqn) != SQN_SIZE || len(amf) != AMF_SIZE {
+		return nil, fmt.Errorf("bad RAND, SQN or AMF size %d, %d, %d", len(rand), len(sqn), len(amf))
+	}
+
+	macA, _ := m.F1(rand, sqn, amf)
+	res, ck, ik, ak := m.F2345(rand)
+
+	// AUTN = SQN xor AK || AMF || MAC-A
+	autn := make([]byte, 0, 16)
+	autn = append(autn, sqn...)
+	xor(autn, ak)
+	autn = append(append(autn, amf...), macA...)
+
+	return &UTRANVector{RAND: rand, XRES: res, AUTN: autn, CK: ck, IK: ik}, nil
+}
+
+// Generates the EPS authentication vector for the sequence number and the serving network, which is the
+// PLMN identity as encoded in the Visited-PLMN-Id (3 bytes), with a random RAND
+func (m *Milenage) GenerateEUTRANVector(sqn []byte, amf []byte, plmnId []byte) (*EUTRANVector, error) {
+	rand := make([]byte, RAND_SIZE)
+	random.Read(rand)
+	return m.GenerateEUTRANVectorWithRAND(rand, sqn, amf, plmnId)
+}
+
+// Generates the EPS authentication vector with the specified RAND
+func (m *Milenage) GenerateEUTRANVectorWithRAND(rand []byte, sqn []byte, amf []byte, plmnId []byte) (*EUTRANVector, error) {
+	if len(plmnId) != 3 {
+		return nil, fmt.Errorf("bad PLMN identity size %d", len(plmnId))
+	}
+	uv, err := m.GenerateUTRANVectorWithRAND(rand, sqn, amf)
+	if err != nil {
+		return nil, err
+	}
+
+	// KASME = KDF(CK || IK, FC = 0x10, P0 = SN id, P1 = SQN xor AK), as in 3GPP TS 33.401 A.2
+	s := []byte{0x10}
+	s = append(append(s, plmnId...), 0x00, 0x03)
+	s = append(append(s, uv.AUTN[0:SQN_SIZE]...), 0x00, 0x06)
+	mac := hmac.New(sha256.New, append(append([]byte(nil), uv.CK...), uv.IK...))
+	mac.Write(s)
+
+	return &EUTRANVector{RAND: uv.RAND, XRES: uv.XRES, AUTN: uv.AUTN, KASME: mac.Sum(nil)}, nil
+}
+
+// Returns the sequence number in the USIM, extracted from the AUTS sent in a synchronization failure for the
+// specified RAND, after verifying the MAC-S
+func (m *Milenage) ResynchronizeSQN(rand []byte, auts []byte) ([]byte, error) {
+	if len(rand) != RAND_SIZE || len(auts) != AUTS_SIZE {
+		return nil, fmt.Errorf("bad RAND or AUTS size %d, %d", len(rand), len(auts))
+	}
+
+	// AUTS = SQNms xor AK* || MAC-S
+	sqn := append([]byte(nil), auts[0:SQN_SIZE]...)
+	xor(sqn, m.F5Star(rand))
+
+	// The AMF used for resynchronization is all zeros
+	_, macS := m.F1(rand, sqn, make([]byte, AMF_SIZE))
+	if subtle.ConstantTimeCompare(macS, auts[SQN_SIZE:]) != 1 {
+		return nil, ErrBadAUTS
+	}
+	return sqn, nil
+}
+
+// Encodes the sequence number as the 6 byte SQN
+func SQNBytes(sqn uint64) []byte {
+	b := make([]byte, SQN_SIZE)
+	for i := SQN_SIZE - 1; i >= 0; i-- {
+		b[i] = byte(sqn)
+		sqn >>= 8
+	}
+	return b
+}
+
+// Decodes the 6 byte SQN
+func SQNValue(sqn []byte) uint64 {
+	var value uint64
+	for _, b := range sqn {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+// Does a xor b in place, for the length of a
+func xor(a []byte, b []byte) {
+	for i := range a {
+		a[i] ^= b[i]
+	}
+}
+
+// Returns a copy of the 16 byte value cyclically rotated by r bytes towards the most significant one
+func rotate(in []byte, r int) []byte {
+	out := make([]byte, KEY_SIZE)
+	for i := range out {
+		out[i] = in[(i+r)%KEY_SIZE]
+	}
+	return out
+}
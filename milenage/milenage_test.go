@@ -0,0 +1,110 @@
+package milenage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// Test Set 1 of 3GPP TS 35.208
+var (
+	testK    = mustDecode("465b5ce8b199b49faa5f0a2ee238a6bc")
+	testRAND = mustDecode("23553cbe9637a89d218ae64dae47bf35")
+	testSQN  = mustDecode("ff9bb4d0b607")
+	testAMF  = mustDecode("b9b9")
+	testOP   = mustDecode("cdc202d5123e20f62b6d676ac72cb318")
+	testOPc  = mustDecode("cd63cb71954a9f4e48a5994e37a02baf")
+)
+
+func mustDecode(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestMilenageFunctions(t *testing.T) {
+	opc, err := ComputeOPc(testK, testOP)
+	if err != nil || !bytes.Equal(opc, testOPc) {
+		t.Fatalf("bad OPc %x %v", opc, err)
+	}
+
+	m, err := New(testK, testOPc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	macA, macS := m.F1(testRAND, testSQN, testAMF)
+	if hex.EncodeToString(macA) != "4a9ffac354dfafb3" || hex.EncodeToString(macS) != "01cfaf9ec4e871e9" {
+		t.Errorf("bad f1 %x or f1* %x", macA, macS)
+	}
+
+	res, ck, ik, ak := m.F2345(testRAND)
+	if hex.EncodeToString(res) != "a54211d5e3ba50bf" || hex.EncodeToString(ak) != "aa689c648370" {
+		t.Errorf("bad f2 %x or f5 %x", res, ak)
+	}
+	if hex.EncodeToString(ck) != "b40ba9a3c58b2a05bbf0d987b21bf8cb" || hex.EncodeToString(ik) != "f769bcd751044604127672711c6d3441" {
+		t.Errorf("bad f3 %x or f4 %x", ck, ik)
+	}
+	if akStar := m.F5Star(testRAND); hex.EncodeToString(akStar) != "451e8beca43b" {
+		t.Errorf("bad f5* %x", akStar)
+	}
+}
+
+func TestVectors(t *testing.T) {
+	m, _ := New(testK, testOPc)
+
+	uv, err := m.GenerateUTRANVectorWithRAND(testRAND, testSQN, testAMF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// SQN xor AK || AMF || MAC-A
+	if hex.EncodeToString(uv.AUTN) != "55f328b43577b9b94a9ffac354dfafb3" {
+		t.Errorf("bad AUTN %x", uv.AUTN)
+	}
+
+	plmnId := mustDecode("21f354")
+	ev, err := m.GenerateEUTRANVectorWithRAND(testRAND, testSQN, testAMF, plmnId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ev.KASME) != 32 || !bytes.Equal(ev.AUTN, uv.AUTN) || !bytes.Equal(ev.XRES, uv.XRES) {
+		t.Errorf("bad E-UTRAN vector %v", ev)
+	}
+	other, _ := m.GenerateEUTRANVectorWithRAND(testRAND, testSQN, testAMF, mustDecode("21f355"))
+	if bytes.Equal(ev.KASME, other.KASME) {
+		t.Errorf("KASME not bound to the serving network")
+	}
+
+	random, _ := m.GenerateEUTRANVector(testSQN, testAMF, plmnId)
+	if len(random.RAND) != RAND_SIZE || bytes.Equal(random.RAND, testRAND) {
+		t.Errorf("bad random RAND %x", random.RAND)
+	}
+
+	if _, err := m.GenerateEUTRANVectorWithRAND(testRAND, testSQN[1:], testAMF, plmnId); err == nil {
+		t.Errorf("short SQN accepted")
+	}
+}
+
+func TestResynchronization(t *testing.T) {
+	m, _ := New(testK, testOPc)
+
+	// AUTS generated by the USIM
+	sqnMS := SQNBytes(0x123456)
+	auts := append([]byte(nil), sqnMS...)
+	xor(auts, m.F5Star(testRAND))
+	_, macS := m.F1(testRAND, sqnMS, make([]byte, AMF_SIZE))
+	auts = append(auts, macS...)
+
+	sqn, err := m.ResynchronizeSQN(testRAND, auts)
+	if err != nil || SQNValue(sqn) != 0x123456 {
+		t.Errorf("bad resynchronized SQN %x %v", sqn, err)
+	}
+
+	auts[AUTS_SIZE-1] ^= 1
+	if _, err := m.ResynchronizeSQN(testRAND, auts); !errors.Is(err, ErrBadAUTS) {
+		t.Errorf("bad MAC-S accepted")
+	}
+}
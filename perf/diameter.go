@@ -0,0 +1,59 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"igor/config"
+	"igor/diamapps"
+	"igor/diamcodec"
+	"igor/diameterclient"
+)
+
+// Diameter peers to send the traffic to
+type DiameterTarget struct {
+	Client *diameterclient.Client
+
+	// Configuration instance, with the identity of the client
+	CI *config.PolicyConfigurationManager
+
+	DestinationRealm string
+
+	// The subscriber of each session is this prefix followed by the session number
+	UserPrefix string
+}
+
+// Returns the scenario that sends Credit-Control-Requests, which succeed if answered with DIAMETER_SUCCESS.
+// The requests are Initial, Update and Termination of successive sessions
+func (t DiameterTarget) CreditControlScenario(weight int) Scenario {
+	requestTypes := []int{diamapps.CC_INITIAL_REQUEST, diamapps.CC_UPDATE_REQUEST, diamapps.CC_TERMINATION_REQUEST}
+	originHost := t.CI.DiameterServerConf().DiameterHost
+
+	return Scenario{
+		Name:   "Credit-Control",
+		Weight: weight,
+		Send: func(ctx context.Context, n int) error {
+			session := n / len(requestTypes)
+			user := fmt.Sprintf("%s%d", t.UserPrefix, session)
+			ccr := diamapps.CreditControlRequest{
+				SessionId:        fmt.Sprintf("%s;igorperf;%d", originHost, session),
+				DestinationRealm: t.DestinationRealm,
+				RequestType:      requestTypes[n%len(requestTypes)],
+				RequestNumber:    uint32(n % len(requestTypes)),
+				UserName:         user,
+				SubscriptionIds:  []diamapps.SubscriptionId{{Type: diamapps.SUBSCRIPTION_ID_NAI, Data: user}},
+			}
+			request, err := ccr.ToDiameter(t.CI)
+			if err != nil {
+				return err
+			}
+			answer, err := t.Client.SendRequest(ctx, request)
+			if err != nil {
+				return err
+			}
+			if resultCode := answer.GetResultCode(); resultCode != diamcodec.DIAMETER_SUCCESS {
+				return fmt.Errorf("result code %d", resultCode)
+			}
+			return nil
+		},
+	}
+}
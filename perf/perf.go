@@ -0,0 +1,371 @@
+package perf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"igor/core"
+	"igor/random"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Generation of load against diameter peers and radius servers, to validate the capacity of igor and of its peers.
+//
+// The traffic is a mix of scenarios, each one sending a type of request, which are chosen randomly according to
+// their weights. The requests are generated at the specified rate, which grows linearly from zero during the
+// ramp-up. The generation is open loop: if the number of outstanding requests reaches the concurrency limit, the
+// requests are not sent and are counted as skipped, so that a slow target does not reduce the offered rate
+// silently. The latencies of the successful requests are summarized as percentiles
+
+// Defaults for the Options
+const (
+	DEFAULT_CONCURRENCY    = 100
+	DEFAULT_TIMEOUT_MILLIS = 5000
+)
+
+// Interval of the generation of requests
+const SCHEDULER_TICK_MILLIS = 1
+
+// Maximum number of different error descriptions in the report of each scenario. The rest are counted as "other"
+const MAX_ERROR_KINDS = 20
+
+// A type of request in the traffic mix
+type Scenario struct {
+	Name string
+
+	// Relative frequency in the mix
+	Weight int
+
+	// Sends the request with the specified sequence number, starting at zero for each scenario, and waits for
+	// the answer. Returns nil if it was answered successfully
+	Send func(ctx context.Context, n int) error
+}
+
+// Parameters of the generation. The zero values of Concurrency and Timeout are replaced by the defaults
+type Options struct {
+	// Requests per second after the ramp-up
+	Rate float64
+
+	// Time during which the rate grows linearly from zero. Included in the Duration
+	RampUp time.Duration
+
+	// Time during which the requests are generated
+	Duration time.Duration
+
+	// Maximum number of outstanding requests
+	Concurrency int
+
+	// Time to wait for each request to be answered
+	Timeout time.Duration
+}
+
+// Summary of the latencies of a set of requests
+type LatencyReport struct {
+	Min  time.Duration
+	Mean time.Duration
+	P50  time.Duration
+	P90  time.Duration
+	P95  time.Duration
+	P99  time.Duration
+	Max  time.Duration
+}
+
+// Results of a scenario
+type ScenarioReport struct {
+	Name      string
+	Sent      int
+	Succeeded int
+	Failed    int
+
+	// Number of failures by error description
+	Errors map[string]int `json:",omitempty"`
+
+	// Of the successful requests
+	Latency LatencyReport
+}
+
+// Results of a generation
+type Report struct {
+	Started time.Time
+	Elapsed time.Duration
+
+	// Specified in the Options
+	TargetRate  float64
+	Concurrency int
+
+	// Sent requests per second, including the ramp-up
+	AchievedRate float64
+
+	Sent      int
+	Succeeded int
+	Failed    int
+
+	// Not sent because the concurrency limit was reached
+	Skipped int
+
+	// Of the successful requests of all the scenarios
+	Latency LatencyReport
+
+	Scenarios []ScenarioReport
+}
+
+// Accumulated results of a scenario
+type scenarioStats struct {
+	sent      int
+	failed    int
+	errors    map[string]int
+	latencies []time.Duration
+}
+
+// Generates the traffic and returns the report when the duration expires, or the context is done, and the
+// outstanding requests are finished
+func Run(ctx context.Context, options Options, scenarios []Scenario) (Report, error) {
+	if options.Rate <= 0 {
+		return Report{}, errors.New("rate must be positive")
+	}
+	if options.RampUp > options.Duration {
+		return Report{}, errors.New("ramp-up must not be longer than the duration")
+	}
+	totalWeight := 0
+	for _, scenario := range scenarios {
+		if scenario.Weight < 0 {
+			return Report{}, fmt.Errorf("negative weight in scenario %s", scenario.Name)
+		}
+		totalWeight += scenario.Weight
+	}
+	if totalWeight == 0 {
+		return Report{}, errors.New("no scenarios with weight")
+	}
+	if options.Concurrency <= 0 {
+		options.Concurrency = DEFAULT_CONCURRENCY
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DEFAULT_TIMEOUT_MILLIS * time.Millisecond
+	}
+
+	stats := make([]scenarioStats, len(scenarios))
+	for i := range stats {
+		stats[i].errors = make(map[string]int)
+	}
+	var statsMutex sync.Mutex
+
+	// Slots for the outstanding requests
+	slots := make(chan struct{}, options.Concurrency)
+	var wg sync.WaitGroup
+
+	skipped := 0
+	generated := 0
+	started := time.Now()
+
+	ticker := time.NewTicker(SCHEDULER_TICK_MILLIS * time.Millisecond)
+	defer ticker.Stop()
+
+generation:
+	for {
+		select {
+		case <-ctx.Done():
+			break generation
+		case <-ticker.C:
+		}
+
+		elapsed := time.Since(started)
+		if elapsed >= options.Duration {
+			elapsed = options.Duration
+		}
+		for ; generated < scheduledRequests(elapsed, options.RampUp, options.Rate); generated++ {
+			s := pickScenario(scenarios, totalWeight)
+
+			select {
+			case slots <- struct{}{}:
+			default:
+				skipped++
+				continue
+			}
+
+			statsMutex.Lock()
+			n := stats[s].sent
+			stats[s].sent++
+			statsMutex.Unlock()
+
+			wg.Add(1)
+			go func(s int, n int) {
+				defer func() {
+					<-slots
+					wg.Done()
+				}()
+
+				requestCtx, cancel := context.WithTimeout(ctx, options.Timeout)
+				defer cancel()
+				start := time.Now()
+				err := scenarios[s].Send(requestCtx, n)
+				latency := time.Since(start)
+
+				statsMutex.Lock()
+				defer statsMutex.Unlock()
+				if err != nil {
+					stats[s].failed++
+					stats[s].addError(err)
+				} else {
+					stats[s].latencies = append(stats[s].latencies, latency)
+				}
+			}(s, n)
+		}
+
+		if elapsed >= options.Duration {
+			break
+		}
+	}
+
+	wg.Wait()
+
+	report := Report{
+		Started:     started,
+		Elapsed:     time.Since(started),
+		TargetRate:  options.Rate,
+		Concurrency: options.Concurrency,
+		Skipped:     skipped,
+		Scenarios:   make([]ScenarioReport, 0, len(scenarios)),
+	}
+	var allLatencies []time.Duration
+	for i, scenario := range scenarios {
+		scenarioReport := ScenarioReport{
+			Name:      scenario.Name,
+			Sent:      stats[i].sent,
+			Succeeded: len(stats[i].latencies),
+			Failed:    stats[i].failed,
+			Latency:   summarize(stats[i].latencies),
+		}
+		if len(stats[i].errors) > 0 {
+			scenarioReport.Errors = stats[i].errors
+		}
+		report.Scenarios = append(report.Scenarios, scenarioReport)
+		report.Sent += scenarioReport.Sent
+		report.Succeeded += scenarioReport.Succeeded
+		report.Failed += scenarioReport.Failed
+		allLatencies = append(allLatencies, stats[i].latencies...)
+	}
+	report.Latency = summarize(allLatencies)
+	if seconds := report.Elapsed.Seconds(); seconds > 0 {
+		report.AchievedRate = float64(report.Sent) / seconds
+	}
+
+	return report, nil
+}
+
+// Returns the number of requests that should have been generated after the elapsed time, with the rate growing
+// linearly during the ramp-up
+func scheduledRequests(elapsed time.Duration, rampUp time.Duration, rate float64) int {
+	t := elapsed.Seconds()
+	r := rampUp.Seconds()
+	if t < r {
+		return int(rate * t * t / (2 * r))
+	}
+	return int(rate*r/2 + rate*(t-r))
+}
+
+// Returns the index of a scenario chosen randomly according to the weights
+func pickScenario(scenarios []Scenario, totalWeight int) int {
+	value := random.Intn(totalWeight)
+	for i, scenario := range scenarios {
+		if value < scenario.Weight {
+			return i
+		}
+		value -= scenario.Weight
+	}
+	return len(scenarios) - 1
+}
+
+// Counts the error, using the generic igor errors as description where possible
+func (s *scenarioStats) addError(err error) {
+	var description string
+	switch {
+	case errors.Is(err, core.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		description = core.ErrTimeout.Error()
+	case errors.Is(err, core.ErrNoPeerAvailable):
+		description = core.ErrNoPeerAvailable.Error()
+	case errors.Is(err, context.Canceled):
+		description = "cancelled"
+	default:
+		description = err.Error()
+	}
+	if _, found := s.errors[description]; !found && len(s.errors) >= MAX_ERROR_KINDS {
+		description = "other"
+	}
+	s.errors[description]++
+}
+
+// Returns the summary of the latencies, which are sorted in place
+func summarize(latencies []time.Duration) LatencyReport {
+	if len(latencies) == 0 {
+		return LatencyReport{}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	var total time.Duration
+	for _, latency := range latencies {
+		total += latency
+	}
+	return LatencyReport{
+		Min:  latencies[0],
+		Mean: total / time.Duration(len(latencies)),
+		P50:  percentile(latencies, 50),
+		P90:  percentile(latencies, 90),
+		P95:  percentile(latencies, 95),
+		P99:  percentile(latencies, 99),
+		Max:  latencies[len(latencies)-1],
+	}
+}
+
+// Returns the percentile of the sorted latencies, using the nearest rank method
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Writes the report in human readable form
+func (r Report) WriteText(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "load generation (%s) during %s\n", r.Started.Format(time.RFC3339), r.Elapsed.Round(time.Millisecond)); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "rate %.1f/s (target %.1f/s), concurrency %d\n", r.AchievedRate, r.TargetRate, r.Concurrency); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "  %-20s %8s %8s %8s %10s %10s %10s %10s %10s\n", "scenario", "sent", "ok", "failed", "p50", "p90", "p95", "p99", "max"); err != nil {
+		return err
+	}
+	for _, s := range r.Scenarios {
+		if err := writeTextLine(w, s.Name, s.Sent, s.Succeeded, s.Failed, s.Latency); err != nil {
+			return err
+		}
+		for description, count := range s.Errors {
+			if _, err := fmt.Fprintf(w, "      %d x %s\n", count, description); err != nil {
+				return err
+			}
+		}
+	}
+	if err := writeTextLine(w, "total", r.Sent, r.Succeeded, r.Failed, r.Latency); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%d requests sent, %d failed, %d skipped\n", r.Sent, r.Failed, r.Skipped)
+	return err
+}
+
+func writeTextLine(w io.Writer, name string, sent int, succeeded int, failed int, l LatencyReport) error {
+	_, err := fmt.Fprintf(w, "  %-20s %8d %8d %8d %10s %10s %10s %10s %10s\n", name, sent, succeeded, failed,
+		l.P50.Round(time.Microsecond), l.P90.Round(time.Microsecond), l.P95.Round(time.Microsecond), l.P99.Round(time.Microsecond), l.Max.Round(time.Microsecond))
+	return err
+}
+
+// Writes the report as JSON
+func (r Report) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
@@ -0,0 +1,159 @@
+package perf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"igor/config"
+	"igor/core"
+	radiusClient "igor/radiusclient"
+	"igor/radiuscodec"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+
+	// Initialize the Config Objects
+	config.InitPolicyConfigInstance("resources/searchRules.json", "testServer", true)
+
+	// Execute the tests and exit
+	os.Exit(m.Run())
+}
+
+func TestRateAndMix(t *testing.T) {
+	scenarios := []Scenario{
+		{Name: "good", Weight: 3, Send: func(ctx context.Context, n int) error {
+			time.Sleep(time.Millisecond)
+			return nil
+		}},
+		{Name: "bad", Weight: 1, Send: func(ctx context.Context, n int) error {
+			return core.ErrTimeout
+		}},
+		{Name: "unused", Weight: 0, Send: func(ctx context.Context, n int) error {
+			return nil
+		}},
+	}
+
+	// 200 * 0.2 / 2 + 200 * 0.3 = 80
+	report, err := Run(context.Background(), Options{Rate: 200, RampUp: 200 * time.Millisecond, Duration: 500 * time.Millisecond}, scenarios)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Sent < 75 || report.Sent > 85 || report.Skipped != 0 {
+		t.Errorf("sent %d, skipped %d", report.Sent, report.Skipped)
+	}
+	if report.Scenarios[2].Sent != 0 || report.Scenarios[0].Sent < report.Scenarios[1].Sent {
+		t.Errorf("bad mix %v", report.Scenarios)
+	}
+	if report.Scenarios[1].Failed != report.Scenarios[1].Sent || report.Scenarios[1].Errors["timeout"] != report.Scenarios[1].Sent {
+		t.Errorf("bad errors %v", report.Scenarios[1])
+	}
+	if report.Latency.P50 < time.Millisecond || report.Latency.Max < report.Latency.P99 {
+		t.Errorf("bad latencies %v", report.Latency)
+	}
+
+	var buffer bytes.Buffer
+	if err := report.WriteJSON(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	var decoded Report
+	if err := json.Unmarshal(buffer.Bytes(), &decoded); err != nil || decoded.Sent != report.Sent {
+		t.Errorf("bad JSON report %s", buffer.String())
+	}
+
+	if _, err := Run(context.Background(), Options{Rate: 10, Duration: time.Second}, scenarios[2:]); err == nil {
+		t.Error("scenarios without weight accepted")
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	var outstanding, maxOutstanding int32
+	scenarios := []Scenario{
+		{Name: "slow", Weight: 1, Send: func(ctx context.Context, n int) error {
+			current := atomic.AddInt32(&outstanding, 1)
+			defer atomic.AddInt32(&outstanding, -1)
+			for {
+				previous := atomic.LoadInt32(&maxOutstanding)
+				if current <= previous || atomic.CompareAndSwapInt32(&maxOutstanding, previous, current) {
+					break
+				}
+			}
+			select {
+			case <-time.After(150 * time.Millisecond):
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}},
+	}
+
+	report, err := Run(context.Background(), Options{Rate: 100, Duration: 300 * time.Millisecond, Concurrency: 2, Timeout: 100 * time.Millisecond}, scenarios)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maxOutstanding > 2 || report.Skipped == 0 {
+		t.Errorf("max outstanding %d, skipped %d", maxOutstanding, report.Skipped)
+	}
+	if report.Failed != report.Sent || report.Scenarios[0].Errors["timeout"] != report.Sent {
+		t.Errorf("requests not timed out %v", report.Scenarios[0])
+	}
+}
+
+func TestPercentiles(t *testing.T) {
+	var latencies []time.Duration
+	for i := 100; i > 0; i-- {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	summary := summarize(latencies)
+	if summary.Min != time.Millisecond || summary.P50 != 50*time.Millisecond || summary.P99 != 99*time.Millisecond || summary.Max != 100*time.Millisecond {
+		t.Errorf("bad summary %v", summary)
+	}
+	if summary.Mean != 50500*time.Microsecond {
+		t.Errorf("bad mean %s", summary.Mean)
+	}
+}
+
+func TestRadiusScenarios(t *testing.T) {
+
+	// Radius server that accepts everything
+	conn, err := net.ListenPacket("udp", "127.0.0.1:18150")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buffer := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			request, err := radiuscodec.RadiusPacketFromBytes(buffer[:n], "secret")
+			if err != nil {
+				continue
+			}
+			response := radiuscodec.NewRadiusResponse(request, true)
+			responseBytes, _ := response.ToBytes("secret", request.Identifier)
+			conn.WriteTo(responseBytes, addr)
+		}
+	}()
+
+	client, err := radiusClient.NewClient(config.GetPolicyConfigInstance("testServer"), radiusClient.ClientOptions{Timeout: 500 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	target := RadiusTarget{Client: client, Endpoint: "127.0.0.1:18150", Secret: "secret", UserPrefix: "user", Password: "password"}
+	report, err := Run(context.Background(), Options{Rate: 100, Duration: 200 * time.Millisecond}, []Scenario{target.AccessRequestScenario(1), target.AccountingScenario(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Sent == 0 || report.Succeeded != report.Sent {
+		t.Errorf("bad report %v", report)
+	}
+}
@@ -0,0 +1,75 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	radiusClient "igor/radiusclient"
+	"igor/radiuscodec"
+)
+
+// Radius server to send the traffic to
+type RadiusTarget struct {
+	Client *radiusClient.Client
+
+	// IPAddress:Port of the authentication and accounting servers. If AccountingEndpoint is empty, the
+	// accounting requests are sent to Endpoint
+	Endpoint           string
+	AccountingEndpoint string
+	Secret             string
+
+	// The User-Name of each request is this prefix followed by the sequence number
+	UserPrefix string
+	Password   string
+}
+
+// Returns the scenario that sends Access-Requests with PAP, which succeed if answered with Access-Accept
+func (t RadiusTarget) AccessRequestScenario(weight int) Scenario {
+	return Scenario{
+		Name:   "Access-Request",
+		Weight: weight,
+		Send: func(ctx context.Context, n int) error {
+			request := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+			request.Add("User-Name", fmt.Sprintf("%s%d", t.UserPrefix, n))
+			request.Add("User-Password", []byte(t.Password))
+			request.Add("NAS-IP-Address", "127.0.0.1")
+			response, err := t.Client.Send(ctx, request, t.Endpoint, t.Secret)
+			if err != nil {
+				return err
+			}
+			if response.Code != radiuscodec.ACCESS_ACCEPT {
+				return fmt.Errorf("response code %d", response.Code)
+			}
+			return nil
+		},
+	}
+}
+
+// Returns the scenario that sends Accounting-Requests, which succeed if answered. The requests are Start,
+// Interim-Update and Stop of successive sessions
+func (t RadiusTarget) AccountingScenario(weight int) Scenario {
+	endpoint := t.AccountingEndpoint
+	if endpoint == "" {
+		endpoint = t.Endpoint
+	}
+	statusTypes := []string{"Start", "Interim-Update", "Stop"}
+	return Scenario{
+		Name:   "Accounting-Request",
+		Weight: weight,
+		Send: func(ctx context.Context, n int) error {
+			session := n / len(statusTypes)
+			request := radiuscodec.NewRadiusRequest(radiuscodec.ACCOUNTING_REQUEST)
+			request.Add("User-Name", fmt.Sprintf("%s%d", t.UserPrefix, session))
+			request.Add("Acct-Status-Type", statusTypes[n%len(statusTypes)])
+			request.Add("Acct-Session-Id", fmt.Sprintf("igorperf-%d", session))
+			request.Add("NAS-IP-Address", "127.0.0.1")
+			response, err := t.Client.Send(ctx, request, endpoint, t.Secret)
+			if err != nil {
+				return err
+			}
+			if response.Code != radiuscodec.ACCOUNTING_RESPONSE {
+				return fmt.Errorf("response code %d", response.Code)
+			}
+			return nil
+		},
+	}
+}
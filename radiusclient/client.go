@@ -0,0 +1,304 @@
+package radiusClient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"igor/config"
+	"igor/core"
+	"igor/radiuscodec"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Client
+//
+// Public API for using igor as a radius client library, without the router. The requests are sent to endpoints
+// specified as IPAddress:Port, using a pool of sockets as in the RadiusClient, either synchronously with Send or
+// asynchronously with SendAsync.
+//
+// Each request is retransmitted the configured number of times, with the same identifier and authenticator, when
+// the timeout expires. The status of each endpoint is tracked, and the endpoint is marked as down after a number
+// of requests in a row without response. The requests to an endpoint that is down fail immediately, until the
+// quarantine time expires or, if probing is configured, the endpoint answers a Status-Server request (RFC 5997)
+
+// Defaults for the Client options
+const (
+	DEFAULT_CLIENT_TIMEOUT_MILLIS    = 2000
+	DEFAULT_MAX_CONSECUTIVE_TIMEOUTS = 3
+	DEFAULT_QUARANTINE_SECONDS       = 60
+)
+
+// Parameters of the Client. The zero values are replaced by the defaults
+type ClientOptions struct {
+	// Address where the sockets are bound. If empty, all the addresses
+	BindIPAddress string
+
+	// Time to wait for the response to each transmission of a request
+	Timeout time.Duration
+
+	// Number of times the request is sent again if not answered in the timeout
+	Retransmissions int
+
+	// Requests in a row without response after which the endpoint is marked as down
+	MaxConsecutiveTimeouts int
+
+	// Time during which an endpoint marked as down is not used. Ignored if ProbeInterval is specified
+	QuarantineTime time.Duration
+
+	// If not zero, the endpoints marked as down are sent a Status-Server at this interval, and marked
+	// as up when answered
+	ProbeInterval time.Duration
+}
+
+// Status of an endpoint to which requests have been sent
+type ServerStatus struct {
+	Endpoint string
+
+	// True when the endpoint may receive requests
+	IsAvailable bool
+
+	// End of the quarantine, if not probing
+	UnavailableUntil time.Time
+
+	// For reporting purposes
+	LastStatusChange time.Time
+	LastError        string
+
+	// Requests in a row without response
+	ConsecutiveTimeouts int
+}
+
+// Response or error of a request sent with SendAsync
+type Result struct {
+	Response *radiuscodec.RadiusPacket
+	Err      error
+}
+
+// Status of an endpoint, with the secret to use for probing it
+type endpointState struct {
+	ServerStatus
+	secret string
+}
+
+type Client struct {
+	options ClientOptions
+
+	// Pool of sockets
+	rc *RadiusClient
+
+	// Status of the endpoints, by IPAddress:Port
+	sync.Mutex
+	endpoints map[string]*endpointState
+
+	// Closed to stop probing
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Creates a Client, taking the dictionary and the configuration of the pool of sockets from the specified
+// configuration instance
+func NewClient(ci *config.PolicyConfigurationManager, options ClientOptions) (*Client, error) {
+	if options.Timeout <= 0 {
+		options.Timeout = DEFAULT_CLIENT_TIMEOUT_MILLIS * time.Millisecond
+	}
+	if options.MaxConsecutiveTimeouts <= 0 {
+		options.MaxConsecutiveTimeouts = DEFAULT_MAX_CONSECUTIVE_TIMEOUTS
+	}
+	if options.QuarantineTime <= 0 {
+		options.QuarantineTime = DEFAULT_QUARANTINE_SECONDS * time.Second
+	}
+
+	rc, err := NewRadiusClient(ci, options.BindIPAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	c := Client{
+		options:   options,
+		rc:        rc,
+		endpoints: make(map[string]*endpointState),
+		done:      make(chan struct{}),
+	}
+
+	if options.ProbeInterval > 0 {
+		c.wg.Add(1)
+		go c.probeLoop()
+	}
+
+	return &c, nil
+}
+
+// Sends the request to the endpoint and waits for the response. Returns an error wrapping core.ErrNoPeerAvailable
+// if the endpoint is down, core.ErrTimeout if not answered after the retransmissions, or the error of the context
+// if done before. The timeout of each transmission is reduced if the deadline of the context would expire before
+func (c *Client) Send(ctx context.Context, packet *radiuscodec.RadiusPacket, endpoint string, secret string) (*radiuscodec.RadiusPacket, error) {
+	if !c.isAvailable(endpoint, secret) {
+		return nil, fmt.Errorf("radius server %s is down: %w", endpoint, core.ErrNoPeerAvailable)
+	}
+
+	timeout := time.Until(core.EarliestDeadline(ctx, time.Now().Add(c.options.Timeout)))
+	rchan := make(chan interface{}, 1)
+	c.rc.radiusExchange(ctx, endpoint, packet, timeout, c.options.Retransmissions, secret, rchan)
+
+	// The response channel is buffered, so the exchange may finish after giving up
+	var response interface{}
+	select {
+	case response = <-rchan:
+	case <-ctx.Done():
+		return nil, core.ContextError(ctx)
+	}
+
+	switch v := response.(type) {
+	case *radiuscodec.RadiusPacket:
+		c.reportResult(endpoint, nil)
+		return v, nil
+	case error:
+		c.reportResult(endpoint, v)
+		return nil, v
+	default:
+		return nil, fmt.Errorf("unexpected response type %T", response)
+	}
+}
+
+// Sends the request to the endpoint and returns a channel where the Result is written, and which is closed afterwards
+func (c *Client) SendAsync(ctx context.Context, packet *radiuscodec.RadiusPacket, endpoint string, secret string) <-chan Result {
+	results := make(chan Result, 1)
+	go func() {
+		response, err := c.Send(ctx, packet, endpoint, secret)
+		results <- Result{Response: response, Err: err}
+		close(results)
+	}()
+	return results
+}
+
+// Returns the status of the endpoints to which requests have been sent, sorted by endpoint
+func (c *Client) ServersStatus() []ServerStatus {
+	c.Lock()
+	defer c.Unlock()
+
+	status := make([]ServerStatus, 0, len(c.endpoints))
+	for _, state := range c.endpoints {
+		status = append(status, state.ServerStatus)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Endpoint < status[j].Endpoint })
+	return status
+}
+
+// Stops probing and closes the sockets, cancelling the outstanding requests
+func (c *Client) Close() {
+	close(c.done)
+	c.wg.Wait()
+	c.rc.Close()
+}
+
+// Checks whether the endpoint is up, creating its status if it did not exist. If not probing,
+// the endpoint is considered up again when the quarantine expires
+func (c *Client) isAvailable(endpoint string, secret string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	state, found := c.endpoints[endpoint]
+	if !found {
+		state = &endpointState{ServerStatus: ServerStatus{Endpoint: endpoint, IsAvailable: true, LastStatusChange: time.Now()}}
+		c.endpoints[endpoint] = state
+	}
+	state.secret = secret
+
+	if !state.IsAvailable && c.options.ProbeInterval == 0 && time.Now().After(state.UnavailableUntil) {
+		c.setAvailable(state)
+	}
+	return state.IsAvailable
+}
+
+// Updates the status of the endpoint with the result of a request. Only the timeouts count for marking the
+// endpoint as down
+func (c *Client) reportResult(endpoint string, err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	state, found := c.endpoints[endpoint]
+	if !found {
+		return
+	}
+
+	if err == nil {
+		state.ConsecutiveTimeouts = 0
+		if !state.IsAvailable {
+			c.setAvailable(state)
+		}
+		return
+	}
+
+	state.LastError = err.Error()
+	if !errors.Is(err, core.ErrTimeout) {
+		return
+	}
+	state.ConsecutiveTimeouts++
+	if state.IsAvailable && state.ConsecutiveTimeouts >= c.options.MaxConsecutiveTimeouts {
+		now := time.Now()
+		state.IsAvailable = false
+		state.UnavailableUntil = now.Add(c.options.QuarantineTime)
+		state.LastStatusChange = now
+		config.GetLogger().Warnf("radius server %s marked as down after %d timeouts", endpoint, state.ConsecutiveTimeouts)
+	}
+}
+
+// Marks the endpoint as up. Must be called with the lock held
+func (c *Client) setAvailable(state *endpointState) {
+	state.IsAvailable = true
+	state.ConsecutiveTimeouts = 0
+	state.UnavailableUntil = time.Time{}
+	state.LastStatusChange = time.Now()
+	config.GetLogger().Infof("radius server %s marked as up", state.Endpoint)
+}
+
+// Sends periodically a Status-Server to the endpoints that are down
+func (c *Client) probeLoop() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.options.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		c.Lock()
+		var down []endpointState
+		for _, state := range c.endpoints {
+			if !state.IsAvailable {
+				down = append(down, *state)
+			}
+		}
+		c.Unlock()
+
+		for _, state := range down {
+			c.wg.Add(1)
+			go func(endpoint string, secret string) {
+				defer c.wg.Done()
+				if err := c.probe(endpoint, secret); err != nil {
+					config.GetLogger().Debugf("radius server %s not answering Status-Server: %s", endpoint, err)
+					return
+				}
+				c.reportResult(endpoint, nil)
+			}(state.Endpoint, state.secret)
+		}
+	}
+}
+
+// Sends a Status-Server to the endpoint, without retransmissions
+func (c *Client) probe(endpoint string, secret string) error {
+	request := radiuscodec.NewRadiusRequest(radiuscodec.STATUS_SERVER)
+	request.Add("Message-Authenticator", make([]byte, 16))
+
+	rchan := make(chan interface{}, 1)
+	c.rc.radiusExchange(context.Background(), endpoint, request, c.options.Timeout, 0, secret, rchan)
+	if err, ok := (<-rchan).(error); ok {
+		return err
+	}
+	return nil
+}
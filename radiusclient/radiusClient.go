@@ -1,10 +1,303 @@
 package radiusClient
 
+import (
+	"context"
+	"fmt"
+	"igor/config"
+	"igor/core"
+	"igor/radiuscodec"
+	"sync"
+	"time"
+)
+
 // RadiusClient
 //
 // Presents functions for sending requests tu upstreams servers
 //
 // Maintains a set of RadiusClientSockets that own the UDP socket and actually send the requests and receive the answers
 //
-// If the origin endpoint does not yet exist, creates a RadiusClientSocket. If the origin endpoint is not specified,
-// uses one of the default RadiusClientSockets created initially
+// Each socket may have up to 256 requests outstanding for each destination endpoint, one per radius Identifier.
+// The requests are sent using the first socket with an Identifier available for the endpoint, and a new socket
+// is created when all of them are exhausted, up to the configured maximum. The sockets other than the first one
+// are closed after some time without outstanding requests
+
+// Maximum number of sockets, if not specified in the configuration
+const DEFAULT_MAX_CLIENT_SOCKETS = 16
+
+// Time after which a socket without outstanding requests is closed, unless it is the first one
+const CLIENT_SOCKET_IDLE_SECONDS = 60
+
+// Socket in the pool
+type pooledSocket struct {
+	socket *RadiusClientSocket
+
+	// Origin port, if it was specified, or zero
+	port int
+
+	// Requests sent and not yet answered, by destination endpoint
+	outstanding map[string]int
+
+	// Last time the socket was used, to close it when idle
+	lastUsed time.Time
+}
+
+// Returns the total number of outstanding requests
+func (ps *pooledSocket) outstandingRequests() int {
+	total := 0
+	for _, n := range ps.outstanding {
+		total += n
+	}
+	return total
+}
+
+type RadiusClient struct {
+	// Configuration instance
+	ci *config.PolicyConfigurationManager
+
+	// Address where the sockets are bound
+	bindIPAddress string
+
+	// Origin ports of the sockets are taken sequentially starting with this one. If zero, the ports
+	// are assigned by the operating system
+	basePort int
+
+	// Maximum number of sockets in the pool
+	maxSockets int
+
+	// Protects the pool of sockets
+	sync.Mutex
+	sockets []*pooledSocket
+	closing bool
+
+	// To receive the SocketDownEvents from the sockets
+	controlChannel chan interface{}
+
+	// To wait for the sockets to be closed
+	wg sync.WaitGroup
+}
+
+// Creates the RadiusClient and its first socket. The origin ports and the maximum number of sockets are taken from
+// ClientAnonymousBasePort and NumAnonymousClientPorts in the radius server configuration
+func NewRadiusClient(ci *config.PolicyConfigurationManager, bindIPAddress string) (*RadiusClient, error) {
+	serverConf := ci.RadiusServerConf()
+	maxSockets := serverConf.NumAnonymousClientPorts
+	if maxSockets <= 0 {
+		maxSockets = DEFAULT_MAX_CLIENT_SOCKETS
+	}
+
+	rc := RadiusClient{
+		ci:             ci,
+		bindIPAddress:  bindIPAddress,
+		basePort:       serverConf.ClientAnonymousBasePort,
+		maxSockets:     maxSockets,
+		controlChannel: make(chan interface{}, 1),
+	}
+
+	go rc.eventLoop()
+
+	rc.Lock()
+	defer rc.Unlock()
+	if _, err := rc.addSocket(); err != nil {
+		close(rc.controlChannel)
+		return nil, err
+	}
+
+	return &rc, nil
+}
+
+// Receives the events of the sockets that go down and closes them
+func (rc *RadiusClient) eventLoop() {
+	for m := range rc.controlChannel {
+		if v, ok := m.(SocketDownEvent); ok {
+			if v.Error != nil {
+				config.GetLogger().Warnf("radius client socket down: %s", v.Error)
+			}
+			rc.removeSocket(v.Sender)
+			go func() {
+				v.Sender.Close()
+				rc.wg.Done()
+			}()
+		}
+	}
+}
+
+// Sends a Radius request using a socket with an Identifier available for the endpoint, and gets the answer or error
+// as a message to the specified channel, which is closed afterwards
+func (rc *RadiusClient) RadiusExchange(endpoint string, rp *radiuscodec.RadiusPacket, timeout time.Duration, secret string, rchan chan interface{}) {
+	rc.radiusExchange(context.Background(), endpoint, rp, timeout, 0, secret, rchan)
+}
+
+// Same as RadiusExchange, with the context of the request, whose trace is attached to the duration metrics
+func (rc *RadiusClient) RadiusExchangeWithContext(ctx context.Context, endpoint string, rp *radiuscodec.RadiusPacket, timeout time.Duration, secret string, rchan chan interface{}) {
+	rc.radiusExchange(ctx, endpoint, rp, timeout, 0, secret, rchan)
+}
+
+// Same as RadiusExchangeWithContext, sending again the request the specified number of times if not answered in the timeout
+func (rc *RadiusClient) radiusExchange(ctx context.Context, endpoint string, rp *radiuscodec.RadiusPacket, timeout time.Duration, retransmissions int, secret string, rchan chan interface{}) {
+	if cap(rchan) < 1 {
+		panic("using an unbuffered response channel")
+	}
+
+	ps, err := rc.acquireSocket(endpoint)
+	if err != nil {
+		rchan <- err
+		close(rchan)
+		return
+	}
+
+	socketChannel := make(chan interface{}, 1)
+	ps.socket.radiusExchange(ctx, endpoint, rp, timeout, retransmissions, secret, socketChannel)
+
+	go func() {
+		response := <-socketChannel
+		rc.releaseSocket(ps, endpoint)
+		rchan <- response
+		close(rchan)
+	}()
+}
+
+// Returns the requests sent and not yet answered by all the sockets
+func (rc *RadiusClient) OutstandingRequests(timeout time.Duration) ([]OutstandingRequest, error) {
+	rc.Lock()
+	sockets := make([]*RadiusClientSocket, 0, len(rc.sockets))
+	for _, ps := range rc.sockets {
+		sockets = append(sockets, ps.socket)
+	}
+	rc.Unlock()
+
+	requests := make([]OutstandingRequest, 0)
+	for _, socket := range sockets {
+		socketRequests, err := socket.OutstandingRequests(timeout)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, socketRequests...)
+	}
+	return requests, nil
+}
+
+// Returns the number of sockets in the pool
+func (rc *RadiusClient) Sockets() int {
+	rc.Lock()
+	defer rc.Unlock()
+	return len(rc.sockets)
+}
+
+// Closes all the sockets, cancelling the outstanding requests, and waits for them to finish
+func (rc *RadiusClient) Close() {
+	rc.Lock()
+	rc.closing = true
+	sockets := rc.sockets
+	rc.sockets = nil
+	rc.Unlock()
+
+	for _, ps := range sockets {
+		ps.socket.SetDown()
+	}
+	rc.wg.Wait()
+	close(rc.controlChannel)
+}
+
+// Returns the first socket with an Identifier available for the endpoint, creating a new one if necessary,
+// and accounts for the request to be sent. Also closes the extra sockets that have been idle for some time
+func (rc *RadiusClient) acquireSocket(endpoint string) (*pooledSocket, error) {
+	rc.Lock()
+	defer rc.Unlock()
+
+	if rc.closing {
+		return nil, fmt.Errorf("radius client closing: %w", core.ErrNoPeerAvailable)
+	}
+
+	now := time.Now()
+	rc.closeIdleSockets(now)
+
+	var selected *pooledSocket
+	for _, ps := range rc.sockets {
+		if ps.outstanding[endpoint] < RADIUS_IDS_PER_SOCKET {
+			selected = ps
+			break
+		}
+	}
+	if selected == nil {
+		var err error
+		if selected, err = rc.addSocket(); err != nil {
+			return nil, fmt.Errorf("radius identifiers exhausted for %s: %s: %w", endpoint, err, core.ErrNoPeerAvailable)
+		}
+		config.GetLogger().Infof("radius identifiers exhausted for %s. Using %d sockets", endpoint, len(rc.sockets))
+	}
+
+	selected.outstanding[endpoint]++
+	selected.lastUsed = now
+	return selected, nil
+}
+
+// Accounts for the request answered or cancelled
+func (rc *RadiusClient) releaseSocket(ps *pooledSocket, endpoint string) {
+	rc.Lock()
+	defer rc.Unlock()
+
+	if ps.outstanding[endpoint]--; ps.outstanding[endpoint] <= 0 {
+		delete(ps.outstanding, endpoint)
+	}
+}
+
+// Creates a new socket in the pool, in the first origin port not in use, if specified. Must be called with the lock held
+func (rc *RadiusClient) addSocket() (*pooledSocket, error) {
+	if len(rc.sockets) >= rc.maxSockets {
+		return nil, fmt.Errorf("maximum number of sockets %d reached", rc.maxSockets)
+	}
+
+	ports := []int{0}
+	if rc.basePort != 0 {
+		ports = ports[:0]
+	nextPort:
+		for port := rc.basePort; port < rc.basePort+rc.maxSockets; port++ {
+			for _, ps := range rc.sockets {
+				if ps.port == port {
+					continue nextPort
+				}
+			}
+			ports = append(ports, port)
+		}
+	}
+
+	var lastErr error
+	for _, port := range ports {
+		socket, err := newRadiusClientSocket(rc.controlChannel, rc.ci, rc.bindIPAddress, port)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		rc.wg.Add(1)
+		ps := &pooledSocket{socket: socket, port: port, outstanding: make(map[string]int), lastUsed: time.Now()}
+		rc.sockets = append(rc.sockets, ps)
+		return ps, nil
+	}
+	return nil, lastErr
+}
+
+// Removes from the pool the socket that has gone down
+func (rc *RadiusClient) removeSocket(socket *RadiusClientSocket) {
+	rc.Lock()
+	defer rc.Unlock()
+
+	for i, ps := range rc.sockets {
+		if ps.socket == socket {
+			rc.sockets = append(rc.sockets[:i], rc.sockets[i+1:]...)
+			return
+		}
+	}
+}
+
+// Closes the sockets, other than the first one, without outstanding requests for some time. Must be called
+// with the lock held
+func (rc *RadiusClient) closeIdleSockets(now time.Time) {
+	for i := len(rc.sockets) - 1; i > 0; i-- {
+		ps := rc.sockets[i]
+		if ps.outstandingRequests() == 0 && now.Sub(ps.lastUsed) > CLIENT_SOCKET_IDLE_SECONDS*time.Second {
+			config.GetLogger().Debugf("closing idle radius client socket %s", ps.socket.socket.LocalAddr())
+			rc.sockets = append(rc.sockets[:i], rc.sockets[i+1:]...)
+			ps.socket.SetDown()
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package radiusClient
 
 import (
+	"context"
 	"fmt"
 	"igor/config"
+	"igor/core"
 	"igor/instrumentation"
 	"igor/radiuscodec"
+	"igor/wiretrace"
 	"io"
 	"net"
 	"sync"
@@ -15,6 +18,9 @@ const (
 	EVENTLOOP_CAPACITY = 100
 )
 
+// Number of radius identifiers available for the requests to each destination endpoint
+const RADIUS_IDS_PER_SOCKET = 256
+
 // Sent to the RadiusClient when the connection and the eventloop are terminated, due
 // to a request or an error
 // The RadiusClient can then invoke the Close() command
@@ -41,6 +47,9 @@ type RadiusResponseMsg struct {
 
 // Sent to the eventLoop in order to send the specified packet
 type RadiusRequestMsg struct {
+	// Context of the request, for the exemplars of the metrics
+	ctx context.Context
+
 	// Where to send the message to
 	endpoint string
 
@@ -53,6 +62,10 @@ type RadiusRequestMsg struct {
 	// Timeout
 	timeout time.Duration
 
+	// Number of times the packet is sent again, with the same identifier and authenticator, when
+	// the timeout expires
+	retransmissions int
+
 	// The secret shared with the endpoint
 	secret string
 }
@@ -65,14 +78,23 @@ type CancelRequestMsg struct {
 	// To identify the request
 	radiusId byte
 
-	// Will always be "timeout"
+	// "timeout", or the error of the context of the request
 	reason error
+
+	// If not nil, the request is cancelled only if it is still the one with this Done channel, since
+	// the identifier may have been reused
+	done chan struct{}
 }
 
 // Send to the event loop to finalize the object
 type CloseCommandMsg struct {
 }
 
+// Asks for the contents of the outstanding requests map, that is sent to the rchan
+type OutstandingRequestsQueryMsg struct {
+	rchan chan []OutstandingRequest
+}
+
 // Sent when the packet listener reports that the socket has
 // been closed
 type ReadEOFMsg struct {
@@ -88,6 +110,12 @@ type ReadErrorMsg struct {
 // Context data for an in flight request
 type RequestContext struct {
 
+	// Context of the request, for the exemplars of the metrics. The request is cancelled when it is done
+	ctx context.Context
+
+	// Closed when the request is answered or cancelled, to stop watching the context. May be nil
+	done chan struct{}
+
 	// Metric key. Need it because the message will not be available in a timeout
 	key instrumentation.RadiusMetricKey
 
@@ -103,6 +131,30 @@ type RequestContext struct {
 
 	// Authenticator
 	authenticator [16]byte
+
+	// When the request was sent, for measuring the latency
+	sentTime time.Time
+
+	// For retransmitting the request when the timer expires, if there are retransmissions left
+	packetBytes     []byte
+	remoteAddr      net.Addr
+	timeout         time.Duration
+	retransmissions int
+}
+
+// Closes the done channel, if any
+func (reqCtx RequestContext) release() {
+	if reqCtx.done != nil {
+		close(reqCtx.done)
+	}
+}
+
+// Description of a request sent and not yet answered
+type OutstandingRequest struct {
+	Endpoint string
+	RadiusId byte
+	Code     byte
+	SentTime time.Time
 }
 
 // RadiusClientSocket
@@ -145,11 +197,20 @@ type RadiusClientSocket struct {
 
 // Creation function
 func NewRadiusClientSocket(controlChannel chan interface{}, ci *config.PolicyConfigurationManager, bindIPAddress string, originPort int) *RadiusClientSocket {
+	rcs, err := newRadiusClientSocket(controlChannel, ci, bindIPAddress, originPort)
+	if err != nil {
+		panic(err.Error())
+	}
+	return rcs
+}
+
+// Creates the RadiusClientSocket, returning an error if the socket could not be bound
+func newRadiusClientSocket(controlChannel chan interface{}, ci *config.PolicyConfigurationManager, bindIPAddress string, originPort int) (*RadiusClientSocket, error) {
 
 	// Bind socket
 	socket, err := net.ListenPacket("udp", fmt.Sprintf("%s:%d", bindIPAddress, originPort))
 	if err != nil {
-		panic(fmt.Sprintf("could not bind client socket to %s:%d: %s", bindIPAddress, originPort, err))
+		return nil, fmt.Errorf("could not bind client socket to %s:%d: %s", bindIPAddress, originPort, err)
 	}
 
 	rcs := RadiusClientSocket{
@@ -165,7 +226,7 @@ func NewRadiusClientSocket(controlChannel chan interface{}, ci *config.PolicyCon
 	go rcs.eventLoop()
 	go rcs.readLoop(rcs.readLoopDoneChannel)
 
-	return &rcs
+	return &rcs, nil
 }
 
 // Starts the closing process
@@ -243,30 +304,32 @@ func (rcs *RadiusClientSocket) eventLoop() {
 			endpoint := v.remote.String()
 			radiusId := v.packetBytes[1]
 			if epReqMap, ok := rcs.requestsMap[endpoint]; !ok {
-				instrumentation.PushRadiusClientResponseStalled(endpoint, string(v.packetBytes[0]))
+				instrumentation.PushRadiusClientResponseStalled(rcs.ci.InstanceName(), endpoint, string(v.packetBytes[0]))
 				config.GetLogger().Debugf("unsolicited response from endpoint %s", endpoint)
 				continue
 			} else if reqCtx, ok := epReqMap[radiusId]; !ok {
-				instrumentation.PushRadiusClientResponseStalled(endpoint, string(v.packetBytes[0]))
+				instrumentation.PushRadiusClientResponseStalled(rcs.ci.InstanceName(), endpoint, string(v.packetBytes[0]))
 				config.GetLogger().Debugf("unsolicited response from endpoint %s", endpoint)
 				continue
 			} else {
 
 				// Check authenticator
-				if !radiuscodec.ValidateResponseAuthenticator(v.packetBytes, reqCtx.authenticator, reqCtx.secret) {
+				if !radiuscodec.ValidateResponse(v.packetBytes, reqCtx.authenticator, reqCtx.secret) {
 					config.GetLogger().Warnf("bad authenticator from %s", endpoint)
 					continue
 				}
 
 				// Decode the packet
-				radiusPacket, err := radiuscodec.RadiusPacketFromBytes(v.packetBytes, reqCtx.secret)
+				radiusPacket, err := radiuscodec.RadiusPacketFromBytesWithDict(v.packetBytes, reqCtx.secret, rcs.ci.RadiusDict())
 				if err != nil {
 					config.GetLogger().Errorf("error decoding packet from %s %s", endpoint, err)
 					continue
 				}
 				clientIPAddr := v.remote.IP.String()
-				instrumentation.PushRadiusClientResponse(clientIPAddr, string(radiusPacket.Code))
+				instrumentation.PushRadiusClientResponse(rcs.ci.InstanceName(), clientIPAddr, string(radiusPacket.Code))
+				instrumentation.PushRadiusClientRequestDuration(reqCtx.ctx, rcs.ci.InstanceName(), reqCtx.key.Endpoint, reqCtx.key.Code, time.Since(reqCtx.sentTime))
 				config.GetLogger().Debugf("<- Client received RadiusPacket %s\n", radiusPacket)
+				wiretrace.TraceRadius(wiretrace.DIRECTION_IN, rcs.socket.LocalAddr(), &v.remote, radiusPacket, v.packetBytes)
 
 				// Cancel timer
 				if reqCtx.timer.Stop() {
@@ -283,6 +346,7 @@ func (rcs *RadiusClientSocket) eventLoop() {
 				// Send the answer to the requester
 				reqCtx.rchan <- radiusPacket
 				close(reqCtx.rchan)
+				reqCtx.release()
 
 				// Remove from outstanding requests
 				delete(epReqMap, radiusId)
@@ -316,29 +380,44 @@ func (rcs *RadiusClientSocket) eventLoop() {
 				// Finalize
 				rcs.eventLoopChannel <- CloseCommandMsg{}
 			}
-
-			// For the timer to be created below
-			rcs.wg.Add(1)
+			wiretrace.TraceRadius(wiretrace.DIRECTION_OUT, rcs.socket.LocalAddr(), remoteAddr, v.packet, packetBytes)
 
 			// Set request map and start timer
 			rcs.requestsMap[v.endpoint][radiusId] = RequestContext{
+				ctx:  v.ctx,
+				done: rcs.watchContext(v.ctx, v.endpoint, radiusId),
 				key: instrumentation.RadiusMetricKey{
 					Endpoint: v.endpoint,
 					Code:     string(v.packet.Code),
 				},
-				rchan: v.rchan,
-				timer: time.AfterFunc(v.timeout, func() {
-					// This will be called if the timer expires
-					rcs.eventLoopChannel <- CancelRequestMsg{endpoint: v.endpoint, radiusId: radiusId, reason: fmt.Errorf("timeout")}
-					defer rcs.wg.Done()
-				}),
-				secret:        v.secret,
-				authenticator: v.packet.Authenticator,
+				rchan:           v.rchan,
+				timer:           rcs.startTimer(v.endpoint, radiusId, v.timeout),
+				secret:          v.secret,
+				authenticator:   v.packet.Authenticator,
+				sentTime:        time.Now(),
+				packetBytes:     packetBytes,
+				remoteAddr:      remoteAddr,
+				timeout:         v.timeout,
+				retransmissions: v.retransmissions,
 			}
 
-			instrumentation.PushRadiusClientRequest(v.endpoint, string(v.packet.Code))
+			instrumentation.PushRadiusClientRequest(rcs.ci.InstanceName(), v.endpoint, string(v.packet.Code))
 			config.GetLogger().Debugf("-> Client sent RadiusPacket %s\n", v.packet)
 
+		case OutstandingRequestsQueryMsg:
+			var requests []OutstandingRequest
+			for endpoint, epMap := range rcs.requestsMap {
+				for radiusId, reqCtx := range epMap {
+					requests = append(requests, OutstandingRequest{
+						Endpoint: endpoint,
+						RadiusId: radiusId,
+						Code:     reqCtx.key.Code[0],
+						SentTime: reqCtx.sentTime,
+					})
+				}
+			}
+			v.rchan <- requests
+
 		case CancelRequestMsg:
 
 			if epMap, found := rcs.requestsMap[v.endpoint]; !found {
@@ -347,16 +426,71 @@ func (rcs *RadiusClientSocket) eventLoop() {
 			} else if reqCtx, found := epMap[v.radiusId]; !found {
 				config.GetLogger().Debugf("tried to cancel not existing request %s:%d", v.endpoint, v.radiusId)
 				continue
+			} else if v.done != nil && v.done != reqCtx.done {
+				config.GetLogger().Debugf("tried to cancel already finished request %s:%d", v.endpoint, v.radiusId)
+				continue
+			} else if v.done != nil {
+				// The context of the request is done
+				if reqCtx.timer.Stop() {
+					rcs.wg.Done()
+				}
+				reqCtx.rchan <- v.reason
+				close(reqCtx.rchan)
+				reqCtx.release()
+				delete(rcs.requestsMap[v.endpoint], v.radiusId)
+			} else if reqCtx.retransmissions > 0 {
+				// Send again the same packet, so that the server may detect the duplicate
+				if _, err := rcs.socket.WriteTo(reqCtx.packetBytes, reqCtx.remoteAddr); err != nil {
+					config.GetLogger().Errorf("error writing packet: %s", err)
+				}
+				config.GetLogger().Debugf("-> Client retransmitted packet to %s with identifier %d", v.endpoint, v.radiusId)
+				reqCtx.retransmissions--
+				reqCtx.timer = rcs.startTimer(v.endpoint, v.radiusId, reqCtx.timeout)
+				epMap[v.radiusId] = reqCtx
 			} else {
-				reqCtx.rchan <- fmt.Errorf("timeout")
+				reqCtx.rchan <- core.ErrTimeout
 				close(reqCtx.rchan)
+				reqCtx.release()
 				delete(rcs.requestsMap[v.endpoint], v.radiusId)
-				instrumentation.PushRadiusClientTimeout(v.endpoint, reqCtx.key.Code)
+				instrumentation.PushRadiusClientTimeout(rcs.ci.InstanceName(), v.endpoint, reqCtx.key.Code)
 			}
 		}
 	}
 }
 
+// Starts the timer for the response to the request, which sends a CancelRequestMsg when expired
+func (rcs *RadiusClientSocket) startTimer(endpoint string, radiusId byte, timeout time.Duration) *time.Timer {
+	rcs.wg.Add(1)
+	return time.AfterFunc(timeout, func() {
+		// This will be called if the timer expires
+		rcs.eventLoopChannel <- CancelRequestMsg{endpoint: endpoint, radiusId: radiusId, reason: core.ErrTimeout}
+		defer rcs.wg.Done()
+	})
+}
+
+// Cancels the request with the specified endpoint and identifier when the context is done, unless the returned
+// channel is closed before. Returns nil if the context cannot be done
+func (rcs *RadiusClientSocket) watchContext(ctx context.Context, endpoint string, radiusId byte) chan struct{} {
+	if ctx == nil || ctx.Done() == nil {
+		return nil
+	}
+
+	done := make(chan struct{})
+	rcs.wg.Add(1)
+	go func() {
+		defer rcs.wg.Done()
+		select {
+		case <-ctx.Done():
+			select {
+			case rcs.eventLoopChannel <- CancelRequestMsg{endpoint: endpoint, radiusId: radiusId, reason: core.ContextError(ctx), done: done}:
+			case <-done:
+			}
+		case <-done:
+		}
+	}()
+	return done
+}
+
 // Loop for receiving answer messages
 func (rcs *RadiusClientSocket) readLoop(ch chan bool) {
 
@@ -395,6 +529,16 @@ func (rcs *RadiusClientSocket) readLoop(ch chan bool) {
 // Sends a Radius request and gets the answer or error as a message to the specified channel.
 // The response channel is closed just after sending the reponse or error
 func (rcs *RadiusClientSocket) RadiusExchange(endpoint string, rp *radiuscodec.RadiusPacket, timeout time.Duration, secret string, rc chan interface{}) {
+	rcs.radiusExchange(context.Background(), endpoint, rp, timeout, 0, secret, rc)
+}
+
+// Same as RadiusExchange, with the context of the request, whose trace is attached to the duration metrics
+func (rcs *RadiusClientSocket) RadiusExchangeWithContext(ctx context.Context, endpoint string, rp *radiuscodec.RadiusPacket, timeout time.Duration, secret string, rc chan interface{}) {
+	rcs.radiusExchange(ctx, endpoint, rp, timeout, 0, secret, rc)
+}
+
+// Same as RadiusExchangeWithContext, sending again the request the specified number of times if not answered in the timeout
+func (rcs *RadiusClientSocket) radiusExchange(ctx context.Context, endpoint string, rp *radiuscodec.RadiusPacket, timeout time.Duration, retransmissions int, secret string, rc chan interface{}) {
 	if cap(rc) < 1 {
 		panic("using an unbuffered response channel")
 	}
@@ -404,18 +548,46 @@ func (rcs *RadiusClientSocket) RadiusExchange(endpoint string, rp *radiuscodec.R
 	defer rcs.wg.Done()
 
 	code := rp.Code
-	if code != radiuscodec.ACCESS_REQUEST && code != radiuscodec.ACCOUNTING_REQUEST && code != radiuscodec.COA_REQUEST && code != radiuscodec.DISCONNECT_REQUEST {
+	if code != radiuscodec.ACCESS_REQUEST && code != radiuscodec.ACCOUNTING_REQUEST && code != radiuscodec.COA_REQUEST && code != radiuscodec.DISCONNECT_REQUEST && code != radiuscodec.STATUS_SERVER {
 		rc <- fmt.Errorf("code is not for request, but %d", code)
 		return
 	}
 
 	// Send myself the message
 	rcs.eventLoopChannel <- RadiusRequestMsg{
-		endpoint: endpoint,
-		packet:   rp,
-		timeout:  timeout,
-		secret:   secret,
-		rchan:    rc}
+		ctx:             ctx,
+		endpoint:        endpoint,
+		packet:          rp,
+		timeout:         timeout,
+		retransmissions: retransmissions,
+		secret:          secret,
+		rchan:           rc}
+}
+
+// Returns the requests sent and not yet answered. Fails if the event loop does not answer
+// in the specified time, which may happen if the socket is terminating
+func (rcs *RadiusClientSocket) OutstandingRequests(timeout time.Duration) ([]OutstandingRequest, error) {
+
+	// Make sure the eventLoop channel is not closed until this finishes
+	rcs.wg.Add(1)
+	defer rcs.wg.Done()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	rc := make(chan []OutstandingRequest, 1)
+	select {
+	case rcs.eventLoopChannel <- OutstandingRequestsQueryMsg{rchan: rc}:
+	case <-timer.C:
+		return nil, fmt.Errorf("outstanding radius requests: %w", core.ErrTimeout)
+	}
+
+	select {
+	case requests := <-rc:
+		return requests, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("outstanding radius requests: %w", core.ErrTimeout)
+	}
 }
 
 // Gets the next radiusid to use, or error if all are busy
@@ -436,9 +608,9 @@ func (rcs *RadiusClientSocket) getNextRadiusId(endpoint string) (byte, error) {
 		rcs.lastRadiusIdMap[endpoint] = 0
 	}
 
-	// Try to get a radius Id
+	// Try to get a radius Id. All of them, including the last one assigned, may be used
 	nextId := lastId
-	for i := 0; i < 255; i++ {
+	for i := 0; i < RADIUS_IDS_PER_SOCKET; i++ {
 		if nextId == 255 {
 			nextId = 0
 		} else {
@@ -471,6 +643,7 @@ func (rcs *RadiusClientSocket) cancelAll() {
 			// Send the error
 			requestContext.rchan <- fmt.Errorf("request cancelled due to Socket down")
 			close(requestContext.rchan)
+			requestContext.release()
 			delete(rcs.requestsMap[ep], rid)
 		}
 		delete(rcs.requestsMap, ep)
@@ -2,10 +2,16 @@ package radiusClient
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"igor/config"
+	"igor/core"
 	"igor/radiuscodec"
 	"igor/radiusserver"
+	"net"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -69,6 +75,20 @@ func TestRadiusClientSocket(t *testing.T) {
 		t.Fatalf("got %v", v)
 	}
 
+	// The request is cancelled when its context is done, without waiting for the timeout
+	requestCtx, cancel := context.WithCancel(context.Background())
+	rchan3 := make(chan interface{}, 1)
+	rcs.RadiusExchangeWithContext(requestCtx, "127.0.0.1:1812", request, 2*time.Second, "secret", rchan3)
+	time.AfterFunc(20*time.Millisecond, cancel)
+	select {
+	case response := <-rchan3:
+		if err, ok := response.(error); !ok || !errors.Is(err, context.Canceled) {
+			t.Fatalf("should have got a cancellation and got %v", response)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("request not cancelled with its context")
+	}
+
 	// Terminate the clientsocket
 	rcs.SetDown()
 
@@ -81,6 +101,139 @@ func TestRadiusClientSocket(t *testing.T) {
 	terminateServerSocket()
 }
 
+func TestRadiusClientPool(t *testing.T) {
+	pci := config.GetPolicyConfigInstance("testServer")
+
+	// Instantiate a radius server
+	ctx, terminateServerSocket := context.WithCancel(context.Background())
+	defer terminateServerSocket()
+	radiusserver.NewRadiusServer(ctx, pci, "127.0.0.1", 18130, echoHandler)
+	time.Sleep(100 * time.Millisecond)
+
+	rc, err := NewRadiusClient(pci, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("could not create radius client: %s", err)
+	}
+	defer rc.Close()
+
+	// More outstanding requests than radius identifiers in a socket. The server takes one second to answer
+	const nRequests = RADIUS_IDS_PER_SOCKET + 44
+	var wg sync.WaitGroup
+	var answered int32
+	for i := 0; i < nRequests; i++ {
+		// Pace the requests, so that the receive buffer of the server socket does not overflow
+		if i%50 == 49 {
+			time.Sleep(20 * time.Millisecond)
+		}
+		request := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+		request.Add("User-Name", fmt.Sprintf("user-%d", i))
+		request.Add("Session-Timeout", 1)
+
+		wg.Add(1)
+		rchan := make(chan interface{}, 1)
+		rc.RadiusExchange("127.0.0.1:18130", request, 3*time.Second, "secret", rchan)
+		go func() {
+			defer wg.Done()
+			if _, ok := (<-rchan).(*radiuscodec.RadiusPacket); ok {
+				atomic.AddInt32(&answered, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if answered != nRequests {
+		t.Errorf("%d requests answered out of %d", answered, nRequests)
+	}
+	if rc.Sockets() != 2 {
+		t.Errorf("%d sockets in the pool", rc.Sockets())
+	}
+}
+
+func TestClient(t *testing.T) {
+	// Server that answers only the retransmissions and the Status-Server, and never the requests for the silent user
+	serverSocket, err := net.ListenPacket("udp", "127.0.0.1:18140")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverSocket.Close()
+	var received int32
+	go func() {
+		seen := make(map[string]bool)
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := serverSocket.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&received, 1)
+			request, err := radiuscodec.RadiusPacketFromBytes(buf[:n], "secret")
+			if err != nil {
+				continue
+			}
+			if request.GetStringAVP("User-Name") == "silent" {
+				continue
+			}
+			if request.Code != radiuscodec.STATUS_SERVER && !seen[string(buf[:n])] {
+				seen[string(buf[:n])] = true
+				continue
+			}
+			response := radiuscodec.NewRadiusResponse(request, true)
+			if request.Code == radiuscodec.STATUS_SERVER {
+				response.Code = radiuscodec.ACCESS_ACCEPT
+			}
+			responseBytes, _ := response.ToBytes("secret", request.Identifier)
+			serverSocket.WriteTo(responseBytes, addr)
+		}
+	}()
+
+	client, err := NewClient(config.GetPolicyConfigInstance("testServer"), ClientOptions{
+		BindIPAddress:          "127.0.0.1",
+		Timeout:                200 * time.Millisecond,
+		Retransmissions:        1,
+		MaxConsecutiveTimeouts: 1,
+		ProbeInterval:          100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Answered after the retransmission
+	request := radiuscodec.NewRadiusRequest(radiuscodec.ACCOUNTING_REQUEST)
+	request.Add("User-Name", "myUserName")
+	if _, err := client.Send(context.Background(), request, "127.0.0.1:18140", "secret"); err != nil {
+		t.Fatalf("error sending request: %s", err)
+	}
+	if atomic.LoadInt32(&received) != 2 {
+		t.Errorf("%d packets received by the server", received)
+	}
+
+	// Cancelled by the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result := <-client.SendAsync(ctx, request, "127.0.0.1:18140", "secret")
+	if !errors.Is(result.Err, context.Canceled) {
+		t.Errorf("request not cancelled: %v", result.Err)
+	}
+
+	// Timeout marks the server as down, and the probe as up again
+	request = radiuscodec.NewRadiusRequest(radiuscodec.ACCOUNTING_REQUEST)
+	request.Add("User-Name", "silent")
+	if _, err := client.Send(context.Background(), request, "127.0.0.1:18140", "secret"); !errors.Is(err, core.ErrTimeout) {
+		t.Fatalf("expected timeout but got %v", err)
+	}
+	if status := client.ServersStatus(); len(status) != 1 || status[0].IsAvailable {
+		t.Fatalf("bad servers status %v", status)
+	}
+	if _, err := client.Send(context.Background(), request, "127.0.0.1:18140", "secret"); !errors.Is(err, core.ErrNoPeerAvailable) {
+		t.Errorf("request sent to server down: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if status := client.ServersStatus(); !status[0].IsAvailable {
+		t.Errorf("server not up after probe: %v", status)
+	}
+}
+
 // Simple handler that generates a success response with the same attributes as in the request
 func echoHandler(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
 
@@ -1,20 +1,21 @@
 package radiuscodec
 
 import (
-	"math/rand"
-	"time"
+	"igor/random"
 )
 
+// Generates a Request Authenticator
 func GetAuthenticator() [16]byte {
 	var authenticator [16]byte
-	rand.Seed(time.Now().UnixNano())
-	rand.Read(authenticator[:])
+	random.Read(authenticator[:])
 	return authenticator
 }
 
+// Generates a salt for encrypted attributes, as specified in RFC 2868.
+// The most significant bit must be set
 func GetSalt() []byte {
 	salt := make([]byte, 2)
-	rand.Seed(time.Now().UnixNano())
-	rand.Read(salt)
+	random.Read(salt)
+	salt[0] |= 0x80
 	return salt
 }
@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"igor/config"
+	"igor/core"
 	"igor/radiusdict"
 	"io"
 	"net"
@@ -29,6 +30,9 @@ type RadiusAVP struct {
 	Name     string
 	Tag      byte
 
+	// Only for the extended attributes, with code from 241 to 246
+	ExtendedType byte
+
 	// Type mapping
 	// May be a []byte, string, int64, float64, net.IP, time.Time or []DiameterAVP
 	// If set to any other type, an error will be reported
@@ -46,20 +50,50 @@ type RadiusAVP struct {
 //      code: 1 byte
 //      length: 1 byte - the length of the vendorId, code, length and value in the contents of the VSA
 //      value - may be prepended by a byte tag
+//      Alternatively, as written by other implementations, a sequence of sub-attributes of the vendor
+//        code: 1 byte
+//        length: 1 byte - the length of the code, length and value of the sub-attribute
+//        value
+//    If code is 241 to 244 (extended, RFC 6929)
+//      extended type: 1 byte
+//      value
+//    If code is 245 or 246 (long extended, RFC 6929)
+//      extended type: 1 byte
+//      flags: 1 byte - with the More bit set if the value continues in the next attribute
+//      value
 //    Else
 //      value
 
+// Flag of the long extended attributes signalling that the value continues in the next attribute
+const LONG_EXTENDED_MORE_FLAG = 0x80
+
+// Maximum size of the value in each fragment of a long extended attribute
+const maxLongExtendedFragmentLen = 251
+
+// Maximum size of the value in each of the attributes in which the values of the attributes marked
+// as "concat" in the dictionary are split
+const (
+	maxConcatFragmentLen       = 253
+	maxVendorConcatFragmentLen = 247
+)
+
 // Encrypted attributes are padded with null when written, and those bytes are not removed when read from the Reader
 // That means the contents will not match
 
-// Returns the number of bytes read
+// Returns the number of bytes read. If the attribute is a vendor specific one with several sub-attributes,
+// only the first one is returned
 func (avp *RadiusAVP) FromReader(reader io.Reader, authenticator [16]byte, secret string) (n int64, err error) {
+	return avp.fromReader(reader, authenticator, secret, config.GetRDict(), nil)
+}
+
+// Reads the AVP using the specified dictionary. The sub-attributes after the first one in a vendor specific
+// attribute, if any, are appended to contained, if not nil
+func (avp *RadiusAVP) fromReader(reader io.Reader, authenticator [16]byte, secret string, dict *radiusdict.RadiusDict, contained *[]RadiusAVP) (n int64, err error) {
 
 	var avpLen byte
 	var vendorCode byte = 0
 	var vendorLen byte = 0
-	var dataLen byte
-	var salt [2]byte
+	var dataLen int
 
 	currentIndex := int64(0)
 
@@ -97,22 +131,146 @@ func (avp *RadiusAVP) FromReader(reader io.Reader, authenticator [16]byte, secre
 
 		avp.Code = vendorCode
 
-		// SanityCheck
-		if !(vendorLen == avpLen-2) {
-			return currentIndex, fmt.Errorf("bad avp coding. Expected length of vendor specific attribute does not match")
+		// Otherwise, this is a sequence of sub-attributes, each one with its own length
+		if vendorLen != avpLen-2 {
+			n, err := avp.vendorSubAttributesFromReader(reader, avpLen, vendorLen, authenticator, secret, dict, contained)
+			return currentIndex + n, err
 		}
 
-		dataLen = vendorLen - 6 // Substracting 4 bytes for vendorId, 1 byte for vendorCode and 1 byte for vendorLen
+		dataLen = int(vendorLen) - 6 // Substracting 4 bytes for vendorId, 1 byte for vendorCode and 1 byte for vendorLen
+
+	} else if radiusdict.IsExtended(avp.Code) {
+		n, err := avp.extendedFromReader(reader, avpLen, authenticator, secret, dict)
+		return currentIndex + n, err
 
 	} else {
-		dataLen = avpLen - 2 // Substracting 1 byte for code and 1 byte for length
+		dataLen = int(avpLen) - 2 // Substracting 1 byte for code and 1 byte for length
 	}
 
 	// Get the relevant info from the dictionary
 	// If not in the dictionary, will get some defaults
-	avp.DictItem, _ = config.GetRDict().GetFromCode(radiusdict.AVPCode{VendorId: avp.VendorId, Code: avp.Code})
+	avp.DictItem, _ = dict.GetFromCode(radiusdict.AVPCode{VendorId: avp.VendorId, Code: avp.Code})
 	avp.Name = avp.DictItem.Name
 
+	n, err = avp.readData(reader, dataLen, authenticator, secret)
+	return currentIndex + n, err
+}
+
+// Reads the sub-attributes of a vendor specific attribute, after the code and length of the first one,
+// which is decoded in this AVP. The rest are appended to contained, if not nil
+func (avp *RadiusAVP) vendorSubAttributesFromReader(reader io.Reader, avpLen byte, vendorLen byte, authenticator [16]byte, secret string, dict *radiusdict.RadiusDict, contained *[]RadiusAVP) (int64, error) {
+
+	if avpLen < 8 {
+		return 0, fmt.Errorf("bad vendor specific attribute length %d", avpLen)
+	}
+	payload := make([]byte, int(avpLen)-8)
+	if n, err := io.ReadFull(reader, payload); err != nil {
+		return int64(n), err
+	}
+
+	subAVP := avp
+	code, subLen := avp.Code, int(vendorLen)
+	for {
+		// Code and length already consumed
+		if subLen < 3 || subLen-2 > len(payload) {
+			return int64(avpLen) - 8, fmt.Errorf("bad vendor specific sub-attribute length %d", subLen)
+		}
+
+		subAVP.Code = code
+		subAVP.VendorId = avp.VendorId
+		subAVP.DictItem, _ = dict.GetFromCode(radiusdict.AVPCode{VendorId: avp.VendorId, Code: code})
+		subAVP.Name = subAVP.DictItem.Name
+		if _, err := subAVP.readData(bytes.NewReader(payload[:subLen-2]), subLen-2, authenticator, secret); err != nil {
+			return int64(avpLen) - 8, err
+		}
+		if subAVP != avp && contained != nil {
+			*contained = append(*contained, *subAVP)
+		}
+
+		payload = payload[subLen-2:]
+		if len(payload) == 0 {
+			return int64(avpLen) - 8, nil
+		}
+		if len(payload) < 2 {
+			return int64(avpLen) - 8, fmt.Errorf("truncated vendor specific sub-attribute")
+		}
+		code, subLen = payload[0], int(payload[1])
+		payload = payload[2:]
+		subAVP = &RadiusAVP{}
+	}
+}
+
+// Reads the rest of an extended attribute, after the code and length. The value of the long extended
+// attributes with the More flag set continues in the next ones, which must have the same code and extended type
+func (avp *RadiusAVP) extendedFromReader(reader io.Reader, avpLen byte, authenticator [16]byte, secret string, dict *radiusdict.RadiusDict) (int64, error) {
+
+	currentIndex := int64(0)
+
+	// Get extended type
+	if err := binary.Read(reader, binary.BigEndian, &avp.ExtendedType); err != nil {
+		return currentIndex, err
+	}
+	currentIndex += 1
+
+	avp.DictItem, _ = dict.GetFromCode(radiusdict.AVPCode{Code: avp.Code, ExtendedType: avp.ExtendedType})
+	avp.Name = avp.DictItem.Name
+
+	if !radiusdict.IsLongExtended(avp.Code) {
+		n, err := avp.readData(reader, int(avpLen)-3, authenticator, secret) // Substracting code, length and extended type
+		return currentIndex + n, err
+	}
+
+	// Gather the value from all the fragments
+	var data []byte
+	for {
+		if avpLen < 4 {
+			return currentIndex, fmt.Errorf("bad long extended attribute length %d", avpLen)
+		}
+
+		// Get flags
+		var flags byte
+		if err := binary.Read(reader, binary.BigEndian, &flags); err != nil {
+			return currentIndex, err
+		}
+		currentIndex += 1
+
+		start := len(data)
+		data = append(data, make([]byte, int(avpLen)-4)...)
+		if n, err := io.ReadFull(reader, data[start:]); err != nil {
+			return currentIndex + int64(n), err
+		}
+		currentIndex += int64(avpLen) - 4
+
+		if flags&LONG_EXTENDED_MORE_FLAG == 0 {
+			break
+		}
+
+		// Get code, length and extended type of the next fragment
+		var header [3]byte
+		if n, err := io.ReadFull(reader, header[:]); err != nil {
+			return currentIndex + int64(n), err
+		}
+		currentIndex += 3
+		if header[0] != avp.Code || header[2] != avp.ExtendedType {
+			return currentIndex, fmt.Errorf("fragment of %s followed by a different attribute", avp.Name)
+		}
+		avpLen = header[1]
+	}
+
+	if _, err := avp.readData(bytes.NewReader(data), len(data), authenticator, secret); err != nil {
+		return currentIndex, err
+	}
+	return currentIndex, nil
+}
+
+// Reads the value of the AVP, including the tag and salt, if any, which takes dataLen bytes.
+// Returns the number of bytes read
+func (avp *RadiusAVP) readData(reader io.Reader, dataLen int, authenticator [16]byte, secret string) (n int64, err error) {
+
+	var salt [2]byte
+
+	currentIndex := int64(0)
+
 	// Extract tag if necessary
 	if avp.DictItem.Tagged {
 		if err := binary.Read(reader, binary.BigEndian, &avp.Tag); err != nil {
@@ -264,9 +422,20 @@ func RadiusAVPFromBytes(inputBytes []byte, authenticator [16]byte, secret string
 // Returns the number of bytes written including padding
 func (avp *RadiusAVP) ToWriter(buffer io.Writer, authenticator [16]byte, secret string) (int64, error) {
 
+	if avp.VendorId == 0 && radiusdict.IsExtended(avp.Code) {
+		return avp.extendedToWriter(buffer, authenticator, secret)
+	}
+	if avp.DictItem.Concat {
+		return avp.concatToWriter(buffer, authenticator, secret)
+	}
+
+	avpLen := avp.Len()
+	if avpLen > 255 {
+		return 0, fmt.Errorf("%s too long (%d bytes) and not splittable", avp.Name, avpLen)
+	}
+
 	var bytesWritten = 0
 	var err error
-	var salt [2]byte
 
 	// Write Code
 	var code byte
@@ -281,8 +450,7 @@ func (avp *RadiusAVP) ToWriter(buffer io.Writer, authenticator [16]byte, secret
 	bytesWritten += 1
 
 	// Write Length
-	avpLen := avp.Len()
-	if err = binary.Write(buffer, binary.BigEndian, avpLen); err != nil {
+	if err = binary.Write(buffer, binary.BigEndian, byte(avpLen)); err != nil {
 		return int64(bytesWritten), err
 	}
 	bytesWritten += 1
@@ -302,12 +470,126 @@ func (avp *RadiusAVP) ToWriter(buffer io.Writer, authenticator [16]byte, secret
 		bytesWritten += 1
 
 		// Write length. This is the length of the embedded AVP
-		if err = binary.Write(buffer, binary.BigEndian, avpLen-2); err != nil {
+		if err = binary.Write(buffer, binary.BigEndian, byte(avpLen-2)); err != nil {
 			return int64(bytesWritten), err
 		}
 		bytesWritten += 1
 	}
 
+	// Write tag, salt and value
+	n, err := avp.writeData(buffer, authenticator, secret)
+	bytesWritten += int(n)
+	if err != nil {
+		return int64(bytesWritten), err
+	}
+
+	// Saninty check
+	if bytesWritten != avpLen {
+		panic(fmt.Sprintf("Bad AVP size. Bytes Written: %d, reported size: %d", bytesWritten, avpLen))
+	}
+
+	return int64(bytesWritten), nil
+}
+
+// Writes the extended attribute. The value of the long extended ones is split in as many attributes as
+// needed, setting the More flag in all but the last one
+func (avp *RadiusAVP) extendedToWriter(buffer io.Writer, authenticator [16]byte, secret string) (int64, error) {
+
+	var data bytes.Buffer
+	if _, err := avp.writeData(&data, authenticator, secret); err != nil {
+		return 0, err
+	}
+
+	if !radiusdict.IsLongExtended(avp.Code) {
+		if data.Len() > 252 {
+			return 0, fmt.Errorf("value of %s too long for an extended attribute", avp.Name)
+		}
+		n, err := buffer.Write(append([]byte{avp.Code, byte(data.Len() + 3), avp.ExtendedType}, data.Bytes()...))
+		return int64(n), err
+	}
+
+	return writeFragments(buffer, data.Bytes(), maxLongExtendedFragmentLen, func(fragmentLen int, last bool) []byte {
+		var flags byte
+		if !last {
+			flags = LONG_EXTENDED_MORE_FLAG
+		}
+		return []byte{avp.Code, byte(fragmentLen + 4), avp.ExtendedType, flags}
+	})
+}
+
+// Writes the AVP whose value may be split in several consecutive attributes, which the receiver concatenates
+func (avp *RadiusAVP) concatToWriter(buffer io.Writer, authenticator [16]byte, secret string) (int64, error) {
+
+	var data bytes.Buffer
+	if _, err := avp.writeData(&data, authenticator, secret); err != nil {
+		return 0, err
+	}
+
+	if avp.VendorId == 0 {
+		return writeFragments(buffer, data.Bytes(), maxConcatFragmentLen, func(fragmentLen int, last bool) []byte {
+			return []byte{avp.Code, byte(fragmentLen + 2)}
+		})
+	}
+	return writeFragments(buffer, data.Bytes(), maxVendorConcatFragmentLen, func(fragmentLen int, last bool) []byte {
+		// The length of the embedded AVP is written as in ToWriter
+		header := []byte{26, byte(fragmentLen + 8), 0, 0, 0, 0, avp.Code, byte(fragmentLen + 6)}
+		binary.BigEndian.PutUint32(header[2:6], avp.VendorId)
+		return header
+	})
+}
+
+// Writes the vendor specific AVPs, all of the same vendor, in a single attribute, each one as a
+// sub-attribute with its own code and length
+func writeVendorSubAttributes(buffer io.Writer, avps []*RadiusAVP, authenticator [16]byte, secret string) (int64, error) {
+
+	var data bytes.Buffer
+	for _, avp := range avps {
+		data.Write([]byte{avp.Code, byte(avp.Len() - 6)})
+		if _, err := avp.writeData(&data, authenticator, secret); err != nil {
+			return 0, err
+		}
+	}
+
+	header := []byte{26, byte(data.Len() + 6), 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(header[2:6], avps[0].VendorId)
+	n, err := buffer.Write(append(header, data.Bytes()...))
+	return int64(n), err
+}
+
+// Writes the value in fragments of up to maxFragmentLen bytes, each one preceded by the specified header.
+// An empty value is written as a single empty fragment
+func writeFragments(buffer io.Writer, value []byte, maxFragmentLen int, header func(fragmentLen int, last bool) []byte) (int64, error) {
+	var bytesWritten int64
+	for {
+		fragmentLen := len(value)
+		if fragmentLen > maxFragmentLen {
+			fragmentLen = maxFragmentLen
+		}
+		last := fragmentLen == len(value)
+		n, err := buffer.Write(append(header(fragmentLen, last), value[:fragmentLen]...))
+		bytesWritten += int64(n)
+		if err != nil || last {
+			return bytesWritten, err
+		}
+		value = value[fragmentLen:]
+	}
+}
+
+// Returns the number of fragments in which a value of the specified size is split
+func fragmentCount(dataSize int, maxFragmentLen int) int {
+	if dataSize == 0 {
+		return 1
+	}
+	return (dataSize + maxFragmentLen - 1) / maxFragmentLen
+}
+
+// Writes the tag, salt and value of the AVP. Returns the number of bytes written
+func (avp *RadiusAVP) writeData(buffer io.Writer, authenticator [16]byte, secret string) (int64, error) {
+
+	var bytesWritten = 0
+	var err error
+	var salt [2]byte
+
 	// Write tag
 	if avp.DictItem.Tagged {
 		if err = binary.Write(buffer, binary.BigEndian, avp.Tag); err != nil {
@@ -318,6 +600,7 @@ func (avp *RadiusAVP) ToWriter(buffer io.Writer, authenticator [16]byte, secret
 
 	// Write salt
 	if avp.DictItem.Salted {
+		copy(salt[:], GetSalt())
 		if err = binary.Write(buffer, binary.BigEndian, salt); err != nil {
 			return int64(bytesWritten), err
 		}
@@ -459,14 +742,20 @@ func (avp *RadiusAVP) ToWriter(buffer io.Writer, authenticator [16]byte, secret
 		bytesWritten += 8
 	}
 
-	// Saninty check
-	if byte(bytesWritten) != avpLen {
-		panic(fmt.Sprintf("Bad AVP size. Bytes Written: %d, reported size: %d", bytesWritten, avpLen))
-	}
-
 	return int64(bytesWritten), nil
 }
 
+// Appends the value of the other AVP, which must be of the same type, string or octets
+func (avp *RadiusAVP) concat(other *RadiusAVP) {
+	switch value := avp.Value.(type) {
+	case []byte:
+		avp.Value = append(value, other.GetOctets()...)
+	case string:
+		otherValue, _ := other.Value.(string)
+		avp.Value = value + otherValue
+	}
+}
+
 // Returns a byte slice with the contents of the AVP
 func (avp *RadiusAVP) ToBytes(authenticator [16]byte, secret string) (data []byte, err error) {
 
@@ -479,8 +768,8 @@ func (avp *RadiusAVP) ToBytes(authenticator [16]byte, secret string) (data []byt
 	return buffer.Bytes(), nil
 }
 
-// Returns the size of the AVP
-func (avp *RadiusAVP) Len() byte {
+// Returns the size of the AVP. For the long extended attributes, this is the size of all the fragments
+func (avp *RadiusAVP) Len() int {
 	var dataSize = 0
 
 	switch avp.DictItem.RadiusType {
@@ -527,13 +816,23 @@ func (avp *RadiusAVP) Len() byte {
 		dataSize += 1
 	}
 
-	if avp.VendorId == 0 {
-		dataSize += 2
-	} else {
+	switch {
+	case avp.DictItem.Concat && avp.VendorId != 0:
+		dataSize += 8 * fragmentCount(dataSize, maxVendorConcatFragmentLen)
+	case avp.DictItem.Concat:
+		dataSize += 2 * fragmentCount(dataSize, maxConcatFragmentLen)
+	case avp.VendorId != 0:
 		dataSize += 8
+	case radiusdict.IsLongExtended(avp.Code):
+		// Code, length, extended type and flags in each fragment
+		dataSize += 4 * fragmentCount(dataSize, maxLongExtendedFragmentLen)
+	case radiusdict.IsExtended(avp.Code):
+		dataSize += 3
+	default:
+		dataSize += 2
 	}
 
-	return byte(dataSize)
+	return dataSize
 }
 
 /////////////////////////////////////////////
@@ -618,6 +917,23 @@ func (avp *RadiusAVP) GetInt() int64 {
 	}
 }
 
+// Returns the value of the AVP as an unsigned number, as it is on the wire. Integer attributes are 32 bit
+// unsigned, and Integer64 attributes keep the full 64 bit range
+func (avp *RadiusAVP) GetUint() uint64 {
+
+	switch avp.DictItem.RadiusType {
+	case radiusdict.Integer:
+
+		return uint64(uint32(avp.Value.(int64)))
+	case radiusdict.Integer64:
+
+		return uint64(avp.Value.(int64))
+	default:
+		config.GetLogger().Errorf("cannot convert value to uint64 %T %v", avp.Value, avp.Value)
+		return 0
+	}
+}
+
 // Returns the value of the AVP as date
 func (avp *RadiusAVP) GetDate() time.Time {
 
@@ -655,9 +971,17 @@ func (avp *RadiusAVP) SetTag(tag byte) *RadiusAVP {
 // Creates a new AVP with the specified name and value
 // Will return an error if the name is not found in the dictionary
 func NewAVP(name string, value interface{}) (*RadiusAVP, error) {
+	return NewAVPWithDict(nil, name, value)
+}
+
+// Creates a new AVP using the specified dictionary, or the global one if nil
+func NewAVPWithDict(dict *radiusdict.RadiusDict, name string, value interface{}) (*RadiusAVP, error) {
 	var avp = RadiusAVP{}
 
-	avp.DictItem = config.GetRDict().AVPByName[name]
+	if dict == nil {
+		dict = config.GetRDict()
+	}
+	avp.DictItem, _ = dict.GetFromName(name)
 	if avp.DictItem.RadiusType == radiusdict.None {
 		return &avp, fmt.Errorf("%s not found in dictionary", name)
 	}
@@ -665,6 +989,7 @@ func NewAVP(name string, value interface{}) (*RadiusAVP, error) {
 	avp.Name = name
 	avp.Code = avp.DictItem.Code
 	avp.VendorId = avp.DictItem.VendorId
+	avp.ExtendedType = avp.DictItem.ExtendedType
 
 	var stringValue, isString = value.(string)
 	if avp.DictItem.Tagged {
@@ -797,6 +1122,16 @@ func toInt64(value interface{}) (int64, error) {
 	case float64:
 		// Needed for unmarshaling JSON
 		return int64(v), nil
+	case json.Number:
+		// Unmarshaled JSON. Values above the int64 range are kept as their two's complement
+		if intValue, err := v.Int64(); err == nil {
+			return intValue, nil
+		}
+		if uintValue, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return int64(uintValue), nil
+		}
+		floatValue, err := v.Float64()
+		return int64(floatValue), err
 	default:
 		return 0, fmt.Errorf("cannot convert %T to int64", value)
 	}
@@ -945,7 +1280,7 @@ func (avp *RadiusAVP) ToMap() map[string]interface{} {
 	switch avp.DictItem.RadiusType {
 	case radiusdict.None, radiusdict.Octets, radiusdict.String, radiusdict.InterfaceId, radiusdict.Address, radiusdict.IPv6Address, radiusdict.IPv6Prefix, radiusdict.Time:
 		theMap[avp.Name] = avp.GetTaggedString()
-	case radiusdict.Integer:
+	case radiusdict.Integer, radiusdict.Integer64:
 		theMap[avp.Name] = avp.GetInt()
 	}
 	return theMap
@@ -973,12 +1308,32 @@ func FromMap(avpMap map[string]interface{}) (RadiusAVP, error) {
 	return RadiusAVP{}, fmt.Errorf("ureachable code")
 }
 
-// Get a RadiusAVP from JSON
+// Get a RadiusAVP from JSON. The numbers are decoded as json.Number, so that 64 bit values keep their precision
 func (avp *RadiusAVP) UnmarshalJSON(b []byte) error {
 	var err error
 
 	theMap := make(map[string]interface{})
-	if err = json.Unmarshal(b, &theMap); err != nil {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	if err = decoder.Decode(&theMap); err != nil {
+		return err
+	}
+
+	*avp, err = FromMap(theMap)
+	return err
+}
+
+// Encode as CBOR using the map representation
+func (avp *RadiusAVP) MarshalCBOR() ([]byte, error) {
+	return core.Marshal(core.CONTENT_TYPE_CBOR, avp.ToMap())
+}
+
+// Get a RadiusAVP from CBOR
+func (avp *RadiusAVP) UnmarshalCBOR(b []byte) error {
+	var err error
+
+	theMap := make(map[string]interface{})
+	if err = core.Unmarshal(core.CONTENT_TYPE_CBOR, b, &theMap); err != nil {
 		return err
 	}
 
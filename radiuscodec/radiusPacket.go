@@ -2,13 +2,17 @@ package radiuscodec
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/md5"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"igor/config"
+	"igor/core"
+	"igor/radiusdict"
 	"io"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -18,6 +22,8 @@ const (
 	ACCESS_ACCEPT  = 2
 	ACCESS_REJECT  = 3
 
+	ACCESS_CHALLENGE = 11
+
 	ACCOUNTING_REQUEST  = 4
 	ACCOUNTING_RESPONSE = 5
 
@@ -28,10 +34,28 @@ const (
 	COA_REQUEST = 43
 	COA_ACK     = 44
 	COA_NAK     = 45
+
+	// RFC 5997. Answered with Access-Accept
+	STATUS_SERVER = 12
+)
+
+// Values of the Error-Cause attribute sent in the Disconnect-NAK and CoA-NAK (RFC 5176)
+const (
+	ERROR_CAUSE_UNSUPPORTED_ATTRIBUTE         = 401
+	ERROR_CAUSE_MISSING_ATTRIBUTE             = 402
+	ERROR_CAUSE_INVALID_REQUEST               = 404
+	ERROR_CAUSE_UNSUPPORTED_SERVICE           = 405
+	ERROR_CAUSE_ADMINISTRATIVELY_PROHIBITED   = 501
+	ERROR_CAUSE_SESSION_CONTEXT_NOT_FOUND     = 503
+	ERROR_CAUSE_SESSION_CONTEXT_NOT_REMOVABLE = 504
+	ERROR_CAUSE_RESOURCES_UNAVAILABLE         = 506
 )
 
 var zero_authenticator = [16]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
 
+// Code of the Message-Authenticator attribute (RFC 3579), whose value is calculated when the packet is written
+const MESSAGE_AUTHENTICATOR_CODE = 80
+
 // code: 1 byte
 // identifier: 1 byte
 // length: 2: 2 byte
@@ -55,6 +79,38 @@ type RadiusPacket struct {
 
 	// The AVPs of the radius packet
 	AVPs []RadiusAVP
+
+	// Difference between the clock of the client and the local one, measured using the
+	// Event-Timestamp when the packet was received, if present
+	ClockSkew time.Duration `json:",omitempty"`
+
+	// Dictionary used to decode the packet and create the AVPs. If nil, the global one
+	dict *radiusdict.RadiusDict
+
+	// Whether the vendor specific AVPs of the same vendor are packed in a single attribute when written
+	packVSAs bool
+}
+
+// Returns the dictionary of the packet, which is the global one if not set
+func (rp *RadiusPacket) Dict() *radiusdict.RadiusDict {
+	if rp.dict != nil {
+		return rp.dict
+	}
+	return config.GetRDict()
+}
+
+// Sets the dictionary to use for decoding the packet and adding AVPs to it. If nil, the global one is used
+func (rp *RadiusPacket) SetDict(dict *radiusdict.RadiusDict) *RadiusPacket {
+	rp.dict = dict
+	return rp
+}
+
+// Sets whether the vendor specific AVPs of the same vendor are packed together, as sub-attributes of as
+// few attributes as possible, when the packet is written, as expected by some NAS. The packets received
+// with packed AVPs are marked as such, and so are the responses to them
+func (rp *RadiusPacket) SetVSAPacking(pack bool) *RadiusPacket {
+	rp.packVSAs = pack
+	return rp
 }
 
 // Reads the RadiusPacket from a Reader interface, such as a network connection
@@ -88,30 +144,65 @@ func (rp *RadiusPacket) FromReader(reader io.Reader, secret string) (n int64, er
 	}
 	currentIndex += 16
 
-	rp.AVPs = make([]RadiusAVP, 0)
+	// Reuse the slice of AVPs, if any, as in pooled packets
+	dict := rp.Dict()
+	if rp.AVPs == nil {
+		rp.AVPs = make([]RadiusAVP, 0)
+	} else {
+		rp.AVPs = rp.AVPs[:0]
+	}
+	rp.packVSAs = false
+	var containedAVPs []RadiusAVP
 	for currentIndex < int64(packetLen) {
 		nextAVP := RadiusAVP{}
-		bytesRead, err := nextAVP.FromReader(reader, rp.Authenticator, secret)
+		bytesRead, err := nextAVP.fromReader(reader, rp.Authenticator, secret, dict, &containedAVPs)
 		if err != nil {
 			return currentIndex, err
 		}
-		rp.AVPs = append(rp.AVPs, nextAVP)
 		currentIndex += bytesRead
+
+		rp.appendReadAVP(&nextAVP)
+		if len(containedAVPs) > 0 {
+			rp.packVSAs = true
+			for i := range containedAVPs {
+				rp.appendReadAVP(&containedAVPs[i])
+			}
+			containedAVPs = containedAVPs[:0]
+		}
 	}
 
 	if int64(packetLen) != currentIndex {
-		panic("assert failed. Bad header size in diameter message")
+		return currentIndex, fmt.Errorf("length in header %d does not match the size of the packet %d", packetLen, currentIndex)
 	}
 
 	return int64(packetLen), nil
 }
 
+// Adds the AVP read to the packet. The values split in consecutive attributes are concatenated
+func (rp *RadiusPacket) appendReadAVP(avp *RadiusAVP) {
+	if avp.DictItem.Concat && len(rp.AVPs) > 0 {
+		if lastAVP := &rp.AVPs[len(rp.AVPs)-1]; lastAVP.Code == avp.Code && lastAVP.VendorId == avp.VendorId {
+			lastAVP.concat(avp)
+			return
+		}
+	}
+	rp.AVPs = append(rp.AVPs, *avp)
+}
+
 // Builds a Radius Packet from a Byte slice
 func RadiusPacketFromBytes(inputBytes []byte, secret string) (*RadiusPacket, error) {
+	return RadiusPacketFromBytesWithDict(inputBytes, secret, nil)
+}
+
+// Builds a Radius Packet from a Byte slice using the specified dictionary, or the global one if nil
+func RadiusPacketFromBytesWithDict(inputBytes []byte, secret string, dict *radiusdict.RadiusDict) (*RadiusPacket, error) {
 	reader := bytes.NewReader(inputBytes)
 
-	radiusPacket := RadiusPacket{}
+	radiusPacket := RadiusPacket{dict: dict}
 	_, err := radiusPacket.FromReader(reader, secret)
+	if err != nil {
+		err = fmt.Errorf("%w: %s", core.ErrMalformed, err)
+	}
 
 	return &radiusPacket, err
 }
@@ -132,60 +223,87 @@ func RadiusPacketFromBytes(inputBytes []byte, secret string) (*RadiusPacket, err
 // id is ignored in responses, where the id from the request and stored in the avp will be used
 func (rp *RadiusPacket) ToWriter(outWriter io.Writer, secret string, id byte) (int64, error) {
 
-	currentIndex := int64(0)
-	var err error
+	// The packet is written in one go from a pooled buffer
+	writer := getBuffer()
+	defer putBuffer(writer)
+
+	if err := rp.serialize(writer, secret, id); err != nil {
+		return 0, err
+	}
+
+	n, err := outWriter.Write(writer.Bytes())
+	return int64(n), err
+}
+
+// Writes the packet, with the authenticators calculated, to the buffer
+func (rp *RadiusPacket) serialize(writer *bytes.Buffer, secret string, id byte) error {
 
 	// If not an ACCESS_REQUEST, the authenticator is calculated based on a hash
 	// of the full packet, so it cannot be written beforehand
-	// Using this buffer as a temporary scratch pad
-	var writer bytes.Buffer
+	// The buffer is used as a temporary scratch pad
+	start := writer.Len()
+	currentIndex := int64(0)
 
 	// Write code
-	if err = binary.Write(&writer, binary.BigEndian, rp.Code); err != nil {
-		return 0, err
-	}
+	writer.WriteByte(rp.Code)
 	currentIndex += 1
 
 	// Write identifier
 	var identifier byte
-	if rp.Code == ACCESS_REQUEST || rp.Code == ACCOUNTING_REQUEST || rp.Code == DISCONNECT_REQUEST || rp.Code == COA_REQUEST {
+	if rp.Code == ACCESS_REQUEST || rp.Code == ACCOUNTING_REQUEST || rp.Code == DISCONNECT_REQUEST || rp.Code == COA_REQUEST || rp.Code == STATUS_SERVER {
 		identifier = id
 	} else {
 		// The parameter is ignored. We use the one in the object
 		identifier = rp.Identifier
 	}
-	if err = binary.Write(&writer, binary.BigEndian, identifier); err != nil {
-		return 0, err
-	}
+	writer.WriteByte(identifier)
 	currentIndex += 1
 
 	// Write length
 	packetLen := rp.Len()
-	if err = binary.Write(&writer, binary.BigEndian, packetLen); err != nil {
-		return 0, err
-	}
+	writer.WriteByte(byte(packetLen >> 8))
+	writer.WriteByte(byte(packetLen))
 	currentIndex += 2
 
 	// Write authenticator
 	// If it is a response, authenticator will be set to the request authenticator,
 	// Otherwise, set to a new one or to zero
-	if rp.Code == ACCESS_REQUEST {
+	if hasRandomAuthenticator(rp.Code) {
 		rp.Authenticator = GetAuthenticator()
 	} else if rp.Code == ACCOUNTING_REQUEST || rp.Code == DISCONNECT_REQUEST || rp.Code == COA_REQUEST {
 		rp.Authenticator = zero_authenticator
 	} else {
 		// Do nothing. Authenticator will be set to the one in the request
 	}
-	if err = binary.Write(&writer, binary.BigEndian, rp.Authenticator); err != nil {
-		return 0, err
-	}
+	writer.Write(rp.Authenticator[:])
 	currentIndex += 16
 
-	// Write all the AVP
+	// Write all the AVP, taking note of the position of the Message-Authenticator value
+	messageAuthenticatorIndex := int64(0)
+	var written []bool
+	if rp.packVSAs {
+		written = make([]bool, len(rp.AVPs))
+	}
 	for i := range rp.AVPs {
-		n, err := rp.AVPs[i].ToWriter(&writer, rp.Authenticator, secret)
+		if rp.packVSAs {
+			if written[i] {
+				continue
+			}
+			if group := rp.vsaGroup(i, written); len(group) > 1 {
+				n, err := writeVendorSubAttributes(writer, group, rp.Authenticator, secret)
+				if err != nil {
+					return err
+				}
+				currentIndex += n
+				continue
+			}
+		}
+		if rp.AVPs[i].Code == MESSAGE_AUTHENTICATOR_CODE && rp.AVPs[i].VendorId == 0 {
+			messageAuthenticatorIndex = currentIndex + 2
+		}
+		n, err := rp.AVPs[i].ToWriter(writer, rp.Authenticator, secret)
 		if err != nil {
-			return 0, err
+			return err
 		}
 		currentIndex += int64(n)
 	}
@@ -194,73 +312,197 @@ func (rp *RadiusPacket) ToWriter(outWriter io.Writer, secret string, id byte) (i
 	if currentIndex != int64(packetLen) {
 		panic("assert failed. Bad message size")
 	}
+	packetBytes := writer.Bytes()[start:]
 
-	// Calculate final authenticator and write to stream
-	var writtenBytes int64
-	if rp.Code == ACCESS_REQUEST {
-		n, err := writer.WriteTo(outWriter)
-		if err != nil {
-			return n, err
+	// Message-Authenticator is the HMAC-MD5 of the packet with the value zeroed, calculated
+	// with the authenticator already written
+	if messageAuthenticatorIndex > 0 {
+		if int(messageAuthenticatorIndex)+16 > len(packetBytes) {
+			return fmt.Errorf("bad Message-Authenticator length")
 		}
-		writtenBytes = n
-	} else {
+		copy(packetBytes[messageAuthenticatorIndex:messageAuthenticatorIndex+16], zero_authenticator[:])
+		copy(packetBytes[messageAuthenticatorIndex:], messageAuthenticator(packetBytes, secret))
+	}
+
+	// Calculate final authenticator
+	if !hasRandomAuthenticator(rp.Code) {
 		// Authenticator is md5(code+identifier+(current authenticator in Authenticator field)+request_attributes+secret)
 		//                                      (zero or the authenticator in the request    )
-		hasher := md5.New()
-		hasher.Write(writer.Bytes())
-		hasher.Write([]byte(secret))
-		auth := hasher.Sum(nil)
-
-		// Write first bytes in the header
-		bytesToWrite := writer.Bytes()
-		n1, err := outWriter.Write(bytesToWrite[0:4])
-		if err != nil {
-			return int64(n1), err
-		}
-		// Write authenticator
-		n2, err := outWriter.Write(auth)
-		if err != nil {
-			return int64(n1 + n2), err
-		}
-		// Write AVPs
-		n3, err := outWriter.Write(bytesToWrite[20:])
-		if err != nil {
-			return int64(n1 + n2 + n3), err
+		// The secret is appended temporarily to the buffer
+		writer.WriteString(secret)
+		auth := md5.Sum(writer.Bytes()[start:])
+		writer.Truncate(start + int(packetLen))
+
+		// The requests keep the authenticator written, which is needed to validate the response
+		if rp.Code == ACCOUNTING_REQUEST || rp.Code == DISCONNECT_REQUEST || rp.Code == COA_REQUEST {
+			rp.Authenticator = auth
 		}
 
-		writtenBytes = int64(n1 + n2 + n3)
+		copy(writer.Bytes()[start+4:start+20], auth[:])
 	}
 
-	// Sanity check
-	if uint16(writtenBytes) != packetLen {
-		panic(fmt.Sprintf("written %d bytes instead of %d", writtenBytes, packetLen))
-	}
+	return nil
+}
 
-	return int64(packetLen), nil
+// The Access-Request and Status-Server carry a random authenticator, instead of a hash of the packet
+func hasRandomAuthenticator(code byte) bool {
+	return code == ACCESS_REQUEST || code == STATUS_SERVER
 }
 
-// Returns a byte slice with the contents of the AVP
+// Returns a byte slice with the contents of the packet
 func (rp *RadiusPacket) ToBytes(secret string, id byte) (data []byte, err error) {
 
-	// Will write the output here
-	var buffer = new(bytes.Buffer)
-	if _, err := rp.ToWriter(buffer, secret, id); err != nil {
-		return buffer.Bytes(), err
+	// Will write the output here, and then copy with the exact size
+	writer := getBuffer()
+	defer putBuffer(writer)
+
+	if err := rp.serialize(writer, secret, id); err != nil {
+		return nil, err
+	}
+
+	return append(make([]byte, 0, writer.Len()), writer.Bytes()...), nil
+}
+
+// Writes the packet to the address, as a single datagram
+func (rp *RadiusPacket) ToPacketConn(conn net.PacketConn, addr net.Addr, secret string, id byte) (int, error) {
+
+	writer := getBuffer()
+	defer putBuffer(writer)
+
+	if err := rp.serialize(writer, secret, id); err != nil {
+		return 0, err
 	}
 
-	return buffer.Bytes(), nil
+	return conn.WriteTo(writer.Bytes(), addr)
 }
 
 // Returns the size of the Radius packet
 func (dm *RadiusPacket) Len() uint16 {
-	var avpLen byte = 0
+	var avpLen uint16 = 0
+	var written []bool
+	if dm.packVSAs {
+		written = make([]bool, len(dm.AVPs))
+	}
 	for i := range dm.AVPs {
-		avpLen += dm.AVPs[i].Len()
+		if dm.packVSAs {
+			if written[i] {
+				continue
+			}
+			if group := dm.vsaGroup(i, written); len(group) > 1 {
+				// Header of the vendor specific attribute and code and length of each sub-attribute
+				avpLen += 6
+				for _, avp := range group {
+					avpLen += uint16(avp.Len() - 6)
+				}
+				continue
+			}
+		}
+		avpLen += uint16(dm.AVPs[i].Len())
 	}
 
 	return uint16(20 + avpLen)
 }
 
+// Returns the vendor specific AVPs to be packed in the same attribute as the one in position i, which is
+// the first of them, marking all of them as written. Only the AVPs that fit in a single attribute are packed
+func (rp *RadiusPacket) vsaGroup(i int, written []bool) []*RadiusAVP {
+	first := &rp.AVPs[i]
+	written[i] = true
+	group := []*RadiusAVP{first}
+	if !isPackable(first) {
+		return group
+	}
+
+	containerLen := first.Len()
+	for j := i + 1; j < len(rp.AVPs); j++ {
+		avp := &rp.AVPs[j]
+		if written[j] || avp.VendorId != first.VendorId || !isPackable(avp) || containerLen+avp.Len()-6 > 255 {
+			continue
+		}
+		written[j] = true
+		group = append(group, avp)
+		containerLen += avp.Len() - 6
+	}
+	return group
+}
+
+func isPackable(avp *RadiusAVP) bool {
+	return avp.VendorId != 0 && !avp.DictItem.Concat && avp.Len() <= 255
+}
+
+///////////////////////////////////////////////////////////////
+// Pooling
+///////////////////////////////////////////////////////////////
+
+// Buffers to serialize the packets, reused to avoid allocations
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return bytes.NewBuffer(make([]byte, 0, 4096))
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buffer *bytes.Buffer) {
+	buffer.Reset()
+	bufferPool.Put(buffer)
+}
+
+// Packets decoded with AcquireRadiusPacketFromBytes, reused with their slices of AVPs
+var packetPool = sync.Pool{
+	New: func() interface{} {
+		return &RadiusPacket{}
+	},
+}
+
+// Slices of AVPs bigger than this are not kept in the pooled packets
+const maxPooledAVPs = 256
+
+// Builds a Radius Packet from a Byte slice, reusing a packet from the pool. Release must be called
+// when the packet is no longer used, and it must be copied with Copy if a reference to it is to be
+// kept after that
+func AcquireRadiusPacketFromBytes(inputBytes []byte, secret string) (*RadiusPacket, error) {
+	return AcquireRadiusPacketFromBytesWithDict(inputBytes, secret, nil)
+}
+
+// As AcquireRadiusPacketFromBytes, using the specified dictionary, or the global one if nil
+func AcquireRadiusPacketFromBytesWithDict(inputBytes []byte, secret string, dict *radiusdict.RadiusDict) (*RadiusPacket, error) {
+	radiusPacket := packetPool.Get().(*RadiusPacket)
+	radiusPacket.dict = dict
+	_, err := radiusPacket.FromReader(bytes.NewReader(inputBytes), secret)
+	if err != nil {
+		err = fmt.Errorf("%w: %s", core.ErrMalformed, err)
+	}
+
+	return radiusPacket, err
+}
+
+// Returns the packet to the pool used by AcquireRadiusPacketFromBytes. Neither the packet nor its AVPs
+// may be used afterwards
+func (rp *RadiusPacket) Release() {
+	avps := rp.AVPs
+	if cap(avps) > maxPooledAVPs {
+		avps = nil
+	}
+
+	// Drop the references to the values, so that they can be collected
+	for i := range avps {
+		avps[i] = RadiusAVP{}
+	}
+
+	*rp = RadiusPacket{AVPs: avps[:0]}
+	packetPool.Put(rp)
+}
+
+// Returns a copy of the packet, not affected by Release. The values of the AVPs are shared
+func (rp *RadiusPacket) Copy() *RadiusPacket {
+	packetCopy := *rp
+	packetCopy.AVPs = append(make([]RadiusAVP, 0, len(rp.AVPs)), rp.AVPs...)
+	return &packetCopy
+}
+
 ///////////////////////////////////////////////////////////////
 // AVP manipulation
 ///////////////////////////////////////////////////////////////
@@ -279,7 +521,7 @@ func (rp *RadiusPacket) Add(name string, value interface{}) *RadiusPacket {
 		return rp
 	}
 
-	avp, error := NewAVP(name, value)
+	avp, error := NewAVPWithDict(rp.dict, name, value)
 
 	if error != nil {
 		config.GetLogger().Errorf("avp %s could not be added: %v, due to %s", name, value, error)
@@ -364,6 +606,15 @@ func (rp *RadiusPacket) GetIntAVP(avpName string) int64 {
 	return avp.GetInt()
 }
 
+// Same, for unsigned
+func (rp *RadiusPacket) GetUintAVP(avpName string) uint64 {
+	avp, err := rp.GetAVP(avpName)
+	if err != nil {
+		return 0
+	}
+	return avp.GetUint()
+}
+
 // Same for IPAddress
 func (rp *RadiusPacket) GetIPAddressAVP(avpName string) net.IP {
 	avp, err := rp.GetAVP(avpName)
@@ -382,6 +633,26 @@ func (rp *RadiusPacket) GetDateAVP(avpName string) time.Time {
 	return avp.GetDate()
 }
 
+// Returns the input octets as a 64 bit value, combining Acct-Input-Octets and Acct-Input-Gigawords
+func (rp *RadiusPacket) GetInputOctets() uint64 {
+	return core.CombineGigawords(rp.GetIntAVP("Acct-Input-Octets"), rp.GetIntAVP("Acct-Input-Gigawords"))
+}
+
+// Returns the output octets as a 64 bit value, combining Acct-Output-Octets and Acct-Output-Gigawords
+func (rp *RadiusPacket) GetOutputOctets() uint64 {
+	return core.CombineGigawords(rp.GetIntAVP("Acct-Output-Octets"), rp.GetIntAVP("Acct-Output-Gigawords"))
+}
+
+// Adds the specified duration to the values of all the Time attributes
+func (rp *RadiusPacket) ShiftTimeAVPs(d time.Duration) *RadiusPacket {
+	for i := range rp.AVPs {
+		if t, ok := rp.AVPs[i].Value.(time.Time); ok {
+			rp.AVPs[i].Value = t.Add(d)
+		}
+	}
+	return rp
+}
+
 ///////////////////////////////////////////////////////////////
 // Packet creation
 ///////////////////////////////////////////////////////////////
@@ -392,45 +663,212 @@ func NewRadiusRequest(code byte) *RadiusPacket {
 }
 
 // Creates a radius answer for the specified packet
-// id is the same as for the request
+// id is the same as for the request. The Status-Server (RFC 5997) is answered as an Access-Request
 func NewRadiusResponse(request *RadiusPacket, isSuccess bool) *RadiusPacket {
+	requestCode := request.Code
+	if requestCode == STATUS_SERVER {
+		requestCode = ACCESS_REQUEST
+	}
 	var code byte
 	if isSuccess {
-		code = request.Code + 1
+		code = requestCode + 1
 	} else {
-		code = request.Code + 2
+		code = requestCode + 2
 	}
-	return &RadiusPacket{Code: code, Identifier: request.Identifier, Authenticator: request.Authenticator}
+	return &RadiusPacket{Code: code, Identifier: request.Identifier, Authenticator: request.Authenticator, dict: request.dict, packVSAs: request.packVSAs}
 }
 
 ///////////////////////////////////////////////////////////////
 // Packet Validation
 ///////////////////////////////////////////////////////////////
 
+// Checks the authenticators of a request received: the Request Authenticator of the Accounting-Request,
+// Disconnect-Request and CoA-Request, and the Message-Authenticator, if present, of any request
+func ValidateRequest(packetBytes []byte, secret string) bool {
+	return ValidateRequestAuthenticator(packetBytes, secret) && ValidateRequestMessageAuthenticator(packetBytes, secret)
+}
+
+// Checks the Response Authenticator and the Message-Authenticator, if present, of a response
+func ValidateResponse(packetBytes []byte, requestAuthenticator [16]byte, secret string) bool {
+	return ValidateResponseAuthenticator(packetBytes, requestAuthenticator, secret) && ValidateResponseMessageAuthenticator(packetBytes, requestAuthenticator, secret)
+}
+
 // Checks the response authenticator
 func ValidateResponseAuthenticator(packetBytes []byte, requestAuthenticator [16]byte, secret string) bool {
+	if len(packetBytes) < 20 {
+		return false
+	}
+
+	auth := ComputeResponseAuthenticator(packetBytes, requestAuthenticator, secret)
+	return hmac.Equal(auth[:], packetBytes[4:20])
+}
+
+// Checks the authenticator of a request. Access-Requests and Status-Server carry a random authenticator that
+// cannot be validated, so true is always returned for them
+func ValidateRequestAuthenticator(packetBytes []byte, secret string) bool {
+
+	if len(packetBytes) < 20 || hasRandomAuthenticator(packetBytes[0]) {
+		return len(packetBytes) >= 20
+	}
+
+	return ValidateResponseAuthenticator(packetBytes, zero_authenticator, secret)
+}
 
+// Checks the Message-Authenticator attribute of a response, if present, which is calculated with the
+// authenticator of the request
+func ValidateResponseMessageAuthenticator(packetBytes []byte, requestAuthenticator [16]byte, secret string) bool {
+	return validateMessageAuthenticator(packetBytes, requestAuthenticator, secret)
+}
+
+// Checks the Message-Authenticator attribute of a request, if present, which is calculated with the
+// authenticator in the packet for Access-Requests and Status-Server, and with zeroes for the other requests
+func ValidateRequestMessageAuthenticator(packetBytes []byte, secret string) bool {
+	if len(packetBytes) < 20 {
+		return false
+	}
+
+	authenticator := zero_authenticator
+	if hasRandomAuthenticator(packetBytes[0]) {
+		copy(authenticator[:], packetBytes[4:20])
+	}
+	return validateMessageAuthenticator(packetBytes, authenticator, secret)
+}
+
+// Calculates the Response Authenticator, md5(Code+ID+Length+RequestAuth+Attributes+Secret). The value in the
+// authenticator field of the packet is ignored
+func ComputeResponseAuthenticator(packetBytes []byte, requestAuthenticator [16]byte, secret string) [16]byte {
 	hasher := md5.New()
 	hasher.Write(packetBytes[0:4])
 	hasher.Write(requestAuthenticator[:])
 	hasher.Write(packetBytes[20:])
 	hasher.Write([]byte(secret))
-	auth := hasher.Sum(nil)
 
-	// Compare by brute force, better than reflect
-	for i, b := range packetBytes[4:20] {
-		if auth[i] != b {
-			return false
+	var auth [16]byte
+	copy(auth[:], hasher.Sum(nil))
+	return auth
+}
+
+// Calculates the Request Authenticator of an Accounting-Request (RFC 2866), Disconnect-Request or CoA-Request
+// (RFC 5176), which is the md5 of the packet with the authenticator field zeroed and the secret. The
+// Access-Request and Status-Server carry a random authenticator, and an error is returned for them
+func ComputeRequestAuthenticator(packetBytes []byte, secret string) ([16]byte, error) {
+	if len(packetBytes) < 20 {
+		return zero_authenticator, fmt.Errorf("packet too short: %w", core.ErrMalformed)
+	}
+	if hasRandomAuthenticator(packetBytes[0]) {
+		return zero_authenticator, fmt.Errorf("packet with code %d has a random authenticator", packetBytes[0])
+	}
+	return ComputeResponseAuthenticator(packetBytes, zero_authenticator, secret), nil
+}
+
+// Writes in the serialized request the Message-Authenticator, if present, and then the Request Authenticator,
+// if it is an Accounting-Request, Disconnect-Request or CoA-Request. The Access-Requests and Status-Server
+// keep their random authenticator. To be used after the contents of an already serialized packet are modified
+func SignRequest(packetBytes []byte, secret string) error {
+	if len(packetBytes) < 20 {
+		return fmt.Errorf("packet too short: %w", core.ErrMalformed)
+	}
+
+	var authenticator [16]byte
+	if hasRandomAuthenticator(packetBytes[0]) {
+		copy(authenticator[:], packetBytes[4:20])
+	}
+	if err := writeMessageAuthenticator(packetBytes, authenticator, secret); err != nil {
+		return err
+	}
+
+	if !hasRandomAuthenticator(packetBytes[0]) {
+		auth, _ := ComputeRequestAuthenticator(packetBytes, secret)
+		copy(packetBytes[4:20], auth[:])
+	}
+	return nil
+}
+
+// Writes in the serialized response the Message-Authenticator, if present, and then the Response
+// Authenticator, calculated with the authenticator of the request
+func SignResponse(packetBytes []byte, requestAuthenticator [16]byte, secret string) error {
+	if len(packetBytes) < 20 {
+		return fmt.Errorf("packet too short: %w", core.ErrMalformed)
+	}
+
+	if err := writeMessageAuthenticator(packetBytes, requestAuthenticator, secret); err != nil {
+		return err
+	}
+
+	auth := ComputeResponseAuthenticator(packetBytes, requestAuthenticator, secret)
+	copy(packetBytes[4:20], auth[:])
+	return nil
+}
+
+// Calculates the value of the Message-Authenticator, if present, with the specified authenticator in the
+// authenticator field, which is left with that value
+func writeMessageAuthenticator(packetBytes []byte, authenticator [16]byte, secret string) error {
+	index, err := messageAuthenticatorIndex(packetBytes)
+	if err != nil || index < 0 {
+		return err
+	}
+
+	copy(packetBytes[4:20], authenticator[:])
+	copy(packetBytes[index:index+16], zero_authenticator[:])
+	copy(packetBytes[index:index+16], messageAuthenticator(packetBytes, secret))
+	return nil
+}
+
+// Returns the position of the value of the Message-Authenticator in the packet, or -1 if there is none
+func messageAuthenticatorIndex(packetBytes []byte) (int, error) {
+	for i := 20; i+2 <= len(packetBytes); i += int(packetBytes[i+1]) {
+		avpLen := int(packetBytes[i+1])
+		if avpLen < 2 || i+avpLen > len(packetBytes) {
+			return -1, fmt.Errorf("bad attribute length: %w", core.ErrMalformed)
+		}
+		if packetBytes[i] != MESSAGE_AUTHENTICATOR_CODE {
+			continue
+		}
+		if avpLen != 18 {
+			return -1, fmt.Errorf("bad Message-Authenticator length: %w", core.ErrMalformed)
 		}
+		return i + 2, nil
+	}
+	return -1, nil
+}
+
+// Looks for the Message-Authenticator and compares it with the value calculated on a copy of the
+// packet with the specified authenticator. Returns true if there is no Message-Authenticator
+func validateMessageAuthenticator(packetBytes []byte, authenticator [16]byte, secret string) bool {
+	if len(packetBytes) < 20 {
+		return false
 	}
 
-	return true
+	index, err := messageAuthenticatorIndex(packetBytes)
+	if err != nil {
+		return false
+	}
+	if index < 0 {
+		return true
+	}
+
+	packetCopy := append([]byte{}, packetBytes...)
+	copy(packetCopy[4:20], authenticator[:])
+	copy(packetCopy[index:index+16], zero_authenticator[:])
+	return hmac.Equal(packetBytes[index:index+16], messageAuthenticator(packetCopy, secret))
+}
+
+// Calculates the Message-Authenticator value of the packet, which must have the value zeroed
+func messageAuthenticator(packetBytes []byte, secret string) []byte {
+	mac := hmac.New(md5.New, []byte(secret))
+	mac.Write(packetBytes)
+	return mac.Sum(nil)
 }
 
 ///////////////////////////////////////////////////////////////
 // Serialization
 ///////////////////////////////////////////////////////////////
 
+// Returns the key-value pairs that identify the packet in structured log entries
+func (rp *RadiusPacket) LogFields() []interface{} {
+	return []interface{}{"code", rp.Code, "identifier", rp.Identifier, "session-id", rp.GetStringAVP("Acct-Session-Id")}
+}
+
 func (rp RadiusPacket) String() string {
 	b, error := json.Marshal(rp)
 	if error != nil {
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"igor/config"
+	"igor/radiusdict"
 	"net"
 	"os"
 	"reflect"
@@ -275,6 +276,31 @@ func TestVendorInteger64AVP(t *testing.T) {
 	}
 }
 
+func TestUnsignedAVPValues(t *testing.T) {
+
+	// Integer attributes are unsigned 32 bit on the wire
+	avp, _ := NewAVP("Acct-Input-Octets", uint32(3000000000))
+	binaryAVP, _ := avp.ToBytes(authenticator, secret)
+	rebuiltAVP, _, _ := RadiusAVPFromBytes(binaryAVP, authenticator, secret)
+	if rebuiltAVP.GetUint() != 3000000000 {
+		t.Errorf("bad unsigned value %d", rebuiltAVP.GetUint())
+	}
+
+	// Integer64 keeps the full range
+	var theValue uint64 = 1<<63 + 12345
+	avp, _ = NewAVP("Igor-Integer64Attribute", theValue)
+	binaryAVP, _ = avp.ToBytes(authenticator, secret)
+	rebuiltAVP, _, _ = RadiusAVPFromBytes(binaryAVP, authenticator, secret)
+	if rebuiltAVP.GetUint() != theValue {
+		t.Errorf("bad unsigned 64 bit value %d", rebuiltAVP.GetUint())
+	}
+	jAVP, _ := json.Marshal(&rebuiltAVP)
+	var jsonAVP RadiusAVP
+	if err := json.Unmarshal(jAVP, &jsonAVP); err != nil || jsonAVP.GetUint() != theValue {
+		t.Errorf("bad unsigned 64 bit value after JSON %s: %d %v", jAVP, jsonAVP.GetUint(), err)
+	}
+}
+
 func TestTaggedAVP(t *testing.T) {
 
 	theValue := "this is a tagged attribute!"
@@ -320,6 +346,12 @@ func TestSaltedAVP(t *testing.T) {
 	} else if rebuiltValue != theValue {
 		t.Errorf("value does not match. Got %s", rebuiltValue)
 	}
+
+	// Salt must be different each time
+	binaryAVP2, _ := avp.ToBytes(authenticator, secret)
+	if reflect.DeepEqual(binaryAVP, binaryAVP2) {
+		t.Errorf("same serialization for salted attribute")
+	}
 }
 
 func TestEncryptFunction(t *testing.T) {
@@ -403,3 +435,409 @@ func TestJSONAVP(t *testing.T) {
 	}
 
 }
+
+func TestMessageAuthenticator(t *testing.T) {
+
+	request := NewRadiusRequest(ACCESS_REQUEST)
+	request.Add("User-Name", "user@igor")
+	request.Add("Message-Authenticator", make([]byte, 16))
+	requestBytes, err := request.ToBytes("secret", 1)
+	if err != nil {
+		t.Fatalf("could not serialize request: %s", err)
+	}
+	if !ValidateRequestMessageAuthenticator(requestBytes, "secret") {
+		t.Error("bad Message-Authenticator in request")
+	}
+	if ValidateRequestMessageAuthenticator(requestBytes, "badsecret") {
+		t.Error("Message-Authenticator validated with bad secret")
+	}
+
+	// Tamper the User-Name
+	requestBytes[len(requestBytes)-20] ^= 0xFF
+	if ValidateRequestMessageAuthenticator(requestBytes, "secret") {
+		t.Error("Message-Authenticator validated with tampered packet")
+	}
+
+	response := NewRadiusResponse(request, true)
+	response.Add("Message-Authenticator", make([]byte, 16))
+	responseBytes, err := response.ToBytes("secret", 1)
+	if err != nil {
+		t.Fatalf("could not serialize response: %s", err)
+	}
+	if !ValidateResponseMessageAuthenticator(responseBytes, request.Authenticator, "secret") {
+		t.Error("bad Message-Authenticator in response")
+	}
+
+	// Status-Server has a random authenticator, as Access-Request
+	statusServer := NewRadiusRequest(STATUS_SERVER)
+	statusServer.Add("Message-Authenticator", make([]byte, 16))
+	statusServerBytes, err := statusServer.ToBytes("secret", 2)
+	if err != nil {
+		t.Fatalf("could not serialize Status-Server: %s", err)
+	}
+	if statusServerBytes[1] != 2 || statusServer.Authenticator == zero_authenticator || !ValidateRequestMessageAuthenticator(statusServerBytes, "secret") {
+		t.Error("bad Status-Server serialization")
+	}
+	if response := NewRadiusResponse(statusServer, true); response.Code != ACCESS_ACCEPT {
+		t.Errorf("Status-Server answered with code %d", response.Code)
+	}
+}
+
+func TestSignAndValidateAuthenticators(t *testing.T) {
+
+	request := NewRadiusRequest(COA_REQUEST)
+	request.Add("User-Name", "user@igor")
+	request.Add("Message-Authenticator", make([]byte, 16))
+	requestBytes, err := request.ToBytes("secret", 1)
+	if err != nil {
+		t.Fatalf("could not serialize request: %s", err)
+	}
+	if authenticator, err := ComputeRequestAuthenticator(requestBytes, "secret"); err != nil || !bytes.Equal(authenticator[:], requestBytes[4:20]) {
+		t.Errorf("bad computed Request Authenticator: %v", err)
+	}
+	if !ValidateRequest(requestBytes, "secret") {
+		t.Error("CoA request not validated")
+	}
+	if ValidateRequest(requestBytes, "badsecret") {
+		t.Error("CoA request validated with bad secret")
+	}
+
+	// Tamper the User-Name, and sign again
+	requestBytes[len(requestBytes)-20] ^= 0xFF
+	if ValidateRequest(requestBytes, "secret") {
+		t.Error("tampered CoA request validated")
+	}
+	if err := SignRequest(requestBytes, "secret"); err != nil {
+		t.Fatalf("could not sign request: %s", err)
+	}
+	if !ValidateRequest(requestBytes, "secret") {
+		t.Error("signed CoA request not validated")
+	}
+
+	// Access-Request has a random authenticator
+	accessRequestBytes, _ := NewRadiusRequest(ACCESS_REQUEST).ToBytes("secret", 2)
+	if _, err := ComputeRequestAuthenticator(accessRequestBytes, "secret"); err == nil {
+		t.Error("Request Authenticator computed for Access-Request")
+	}
+	if _, err := ComputeRequestAuthenticator(accessRequestBytes[:10], "secret"); err == nil {
+		t.Error("Request Authenticator computed for short packet")
+	}
+
+	var requestAuthenticator [16]byte
+	copy(requestAuthenticator[:], requestBytes[4:20])
+	response := NewRadiusResponse(request, true)
+	response.Add("Message-Authenticator", make([]byte, 16))
+	responseBytes, err := response.ToBytes("secret", 1)
+	if err != nil {
+		t.Fatalf("could not serialize response: %s", err)
+	}
+	responseBytes[len(responseBytes)-1] ^= 0xFF
+	if err := SignResponse(responseBytes, requestAuthenticator, "secret"); err != nil {
+		t.Fatalf("could not sign response: %s", err)
+	}
+	if !ValidateResponse(responseBytes, requestAuthenticator, "secret") {
+		t.Error("signed CoA response not validated")
+	}
+	if ValidateResponse(responseBytes, requestAuthenticator, "badsecret") {
+		t.Error("CoA response validated with bad secret")
+	}
+}
+
+func TestPacketPool(t *testing.T) {
+
+	request := NewRadiusRequest(ACCOUNTING_REQUEST)
+	request.Add("User-Name", "user@igor")
+	request.Add("Acct-Session-Id", "session-1")
+	packetBytes, err := request.ToBytes(secret, 1)
+	if err != nil {
+		t.Fatalf("could not serialize packet: %s", err)
+	}
+
+	packet, err := AcquireRadiusPacketFromBytes(packetBytes, secret)
+	if err != nil {
+		t.Fatalf("could not decode pooled packet: %s", err)
+	}
+	if packet.GetStringAVP("User-Name") != "user@igor" || packet.Identifier != 1 {
+		t.Errorf("bad pooled packet %s", packet)
+	}
+
+	// The copy is not affected by the release and reuse of the original packet
+	packetCopy := packet.Copy()
+	packet.Release()
+
+	other := NewRadiusRequest(ACCESS_REQUEST)
+	other.Add("User-Name", "other@igor")
+	otherBytes, _ := other.ToBytes(secret, 2)
+	for i := 0; i < 10; i++ {
+		p, _ := AcquireRadiusPacketFromBytes(otherBytes, secret)
+		if len(p.AVPs) != 1 || p.GetStringAVP("User-Name") != "other@igor" {
+			t.Errorf("bad reused packet %s", p)
+		}
+		p.Release()
+	}
+	if packetCopy.GetStringAVP("User-Name") != "user@igor" || packetCopy.GetStringAVP("Acct-Session-Id") != "session-1" {
+		t.Errorf("bad copied packet %s", packetCopy)
+	}
+}
+
+func TestLongRadiusPacket(t *testing.T) {
+
+	// The size of the attributes is bigger than 255 bytes
+	request := NewRadiusRequest(ACCOUNTING_REQUEST)
+	for i := 0; i < 3; i++ {
+		request.Add("Class", strings.Repeat(fmt.Sprintf("%d", i), 200))
+	}
+	packetBytes, err := request.ToBytes(secret, 1)
+	if err != nil || len(packetBytes) != 20+3*202 {
+		t.Fatalf("bad long packet serialization with %d bytes: %v", len(packetBytes), err)
+	}
+	if !ValidateRequestAuthenticator(packetBytes, secret) {
+		t.Errorf("bad authenticator in long packet")
+	}
+
+	recovered, err := RadiusPacketFromBytes(packetBytes, secret)
+	if err != nil || len(recovered.GetAllAVP("Class")) != 3 {
+		t.Errorf("bad long packet recovered %s: %v", recovered, err)
+	}
+}
+
+func TestExtendedAVP(t *testing.T) {
+
+	// Extended attribute
+	avp, err := NewAVP("Frag-Status", 3)
+	if err != nil {
+		t.Fatalf("error creating avp: %v", err)
+	}
+	binaryAVP, _ := avp.ToBytes(authenticator, secret)
+	if !bytes.Equal(binaryAVP, []byte{241, 7, 1, 0, 0, 0, 3}) {
+		t.Errorf("bad extended attribute serialization %v", binaryAVP)
+	}
+	rebuiltAVP, n, err := RadiusAVPFromBytes(binaryAVP, authenticator, secret)
+	if err != nil || n != 7 || rebuiltAVP.Name != "Frag-Status" || rebuiltAVP.GetString() != "More-Data-Request" {
+		t.Errorf("bad extended attribute unserialization %v: %v", rebuiltAVP, err)
+	}
+
+	// Long extended attribute, split in fragments of 251 bytes
+	theValue := strings.Repeat("<saml/>", 100)
+	avp, _ = NewAVP("SAML-Assertion", theValue)
+	if avp.Len() != 700+3*4 {
+		t.Errorf("bad long extended attribute size %d", avp.Len())
+	}
+	binaryAVP, _ = avp.ToBytes(authenticator, secret)
+	if len(binaryAVP) != avp.Len() {
+		t.Fatalf("long extended attribute size %d does not match the reported one %d", len(binaryAVP), avp.Len())
+	}
+	if !bytes.Equal(binaryAVP[0:4], []byte{245, 255, 1, LONG_EXTENDED_MORE_FLAG}) || !bytes.Equal(binaryAVP[255:259], []byte{245, 255, 1, LONG_EXTENDED_MORE_FLAG}) || !bytes.Equal(binaryAVP[510:514], []byte{245, 202, 1, 0}) {
+		t.Errorf("bad long extended attribute fragments")
+	}
+
+	request := NewRadiusRequest(ACCESS_REQUEST)
+	request.Add("User-Name", "user@igor")
+	request.AddAVP(avp)
+	request.Add("Frag-Status", 1)
+	packetBytes, err := request.ToBytes(secret, 1)
+	if err != nil {
+		t.Fatalf("could not serialize packet with long extended attribute: %s", err)
+	}
+	recovered, err := RadiusPacketFromBytes(packetBytes, secret)
+	if err != nil {
+		t.Fatalf("could not unserialize packet with long extended attribute: %s", err)
+	}
+	if len(recovered.AVPs) != 3 || recovered.GetStringAVP("SAML-Assertion") != theValue || recovered.GetStringAVP("Frag-Status") != "Fragmentation-Supported" {
+		t.Errorf("bad packet with long extended attribute recovered %s", recovered)
+	}
+
+	// A fragment followed by another attribute
+	badBytes := append(append([]byte{}, binaryAVP[0:255]...), 1, 3, 'a')
+	if _, _, err := RadiusAVPFromBytes(badBytes, authenticator, secret); err == nil {
+		t.Errorf("unterminated long extended attribute was decoded")
+	}
+
+	// Value too long for an extended attribute
+	avp, _ = NewAVP("Frag-Status", 1)
+	avp.DictItem.RadiusType = radiusdict.Octets
+	avp.Value = make([]byte, 253)
+	if _, err := avp.ToBytes(authenticator, secret); err == nil {
+		t.Errorf("too long extended attribute was serialized")
+	}
+}
+
+func TestConcatAVP(t *testing.T) {
+
+	// Split in several attributes when written, and concatenated when read
+	theValue := bytes.Repeat([]byte{0xAA}, 600)
+	avp, _ := NewAVP("EAP-Message", theValue)
+	if avp.Len() != 600+3*2 {
+		t.Errorf("bad concat attribute size %d", avp.Len())
+	}
+	binaryAVP, _ := avp.ToBytes(authenticator, secret)
+	if len(binaryAVP) != avp.Len() || !bytes.Equal(binaryAVP[0:2], []byte{79, 255}) || !bytes.Equal(binaryAVP[255:257], []byte{79, 255}) || !bytes.Equal(binaryAVP[510:512], []byte{79, 96}) {
+		t.Errorf("bad concat attribute fragments")
+	}
+
+	request := NewRadiusRequest(ACCESS_REQUEST)
+	request.Add("User-Name", "user@igor")
+	request.AddAVP(avp)
+	request.Add("Message-Authenticator", make([]byte, 16))
+	packetBytes, err := request.ToBytes(secret, 1)
+	if err != nil {
+		t.Fatalf("could not serialize packet with concat attribute: %s", err)
+	}
+	if !ValidateRequestMessageAuthenticator(packetBytes, secret) {
+		t.Errorf("bad message authenticator in packet with concat attribute")
+	}
+	recovered, err := RadiusPacketFromBytes(packetBytes, secret)
+	if err != nil {
+		t.Fatalf("could not unserialize packet with concat attribute: %s", err)
+	}
+	if len(recovered.GetAllAVP("EAP-Message")) != 1 || !bytes.Equal(recovered.GetAllAVP("EAP-Message")[0].GetOctets(), theValue) {
+		t.Errorf("bad packet with concat attribute recovered %s", recovered)
+	}
+
+	// Vendor specific
+	jsonDict, _ := os.ReadFile("../resources/radiusDictionary.json")
+	dict := radiusdict.NewDictionaryFromJSON(jsonDict)
+	dict.AddVendor(99999, "Embedder")
+	if err := dict.AddAVP(99999, radiusdict.AVPDefinition{Code: 1, Name: "Policy", Type: "String", Concat: true}); err != nil {
+		t.Fatalf("could not add AVP: %s", err)
+	}
+	policy := strings.Repeat("allow;", 100)
+	request = NewRadiusRequest(ACCESS_REQUEST).SetDict(dict)
+	request.Add("Embedder-Policy", policy)
+	packetBytes, err = request.ToBytes(secret, 1)
+	if err != nil || len(packetBytes) != 20+600+3*8 {
+		t.Fatalf("bad serialization of vendor concat attribute with %d bytes: %v", len(packetBytes), err)
+	}
+	recovered, err = RadiusPacketFromBytesWithDict(packetBytes, secret, dict)
+	if err != nil || recovered.GetStringAVP("Embedder-Policy") != policy {
+		t.Errorf("bad vendor concat attribute recovered %s: %v", recovered, err)
+	}
+
+	// Too long and not splittable
+	request = NewRadiusRequest(ACCOUNTING_REQUEST)
+	request.Add("Class", strings.Repeat("x", 300))
+	if _, err := request.ToBytes(secret, 1); err == nil {
+		t.Errorf("too long attribute was serialized")
+	}
+}
+
+func TestVendorSubAttributes(t *testing.T) {
+
+	// Standard encoding of a single sub-attribute, with the length of the sub-attribute only
+	singleBytes := append([]byte{26, 14, 0, 0, 0, 9, 1, 8}, []byte("a=b=c=")...)
+	avp, n, err := RadiusAVPFromBytes(singleBytes, authenticator, secret)
+	if err != nil || n != 14 || avp.Name != "Cisco-AVPair" || avp.GetString() != "a=b=c=" {
+		t.Errorf("bad single sub-attribute decoded %v: %v", avp, err)
+	}
+
+	// Several sub-attributes in the same attribute
+	request := NewRadiusRequest(ACCESS_REQUEST)
+	request.Add("User-Name", "user@igor")
+	request.Add("Igor-StringAttribute", "hello")
+	request.Add("Cisco-AVPair", "x=y")
+	request.Add("Igor-IntegerAttribute", 1)
+	request.Add("Igor-OctetsAttribute", []byte{1, 2, 3})
+	request.SetVSAPacking(true)
+
+	// User-Name, a single Igor attribute with 3 sub-attributes and Cisco-AVPair
+	expectedLen := 20 + 11 + (6 + 7 + 6 + 5) + 11
+	packetBytes, err := request.ToBytes(secret, 1)
+	if err != nil || len(packetBytes) != expectedLen || int(request.Len()) != expectedLen {
+		t.Fatalf("bad packed packet with %d bytes: %v", len(packetBytes), err)
+	}
+	if !bytes.Equal(packetBytes[31:39], []byte{26, 24, 0, 1, 0x5f, 0x91, 2, 7}) {
+		t.Errorf("bad packed vendor specific attribute %v", packetBytes[31:39])
+	}
+
+	recovered, err := RadiusPacketFromBytes(packetBytes, secret)
+	if err != nil {
+		t.Fatalf("could not unserialize packed packet: %s", err)
+	}
+	if len(recovered.AVPs) != 5 || recovered.GetStringAVP("Igor-StringAttribute") != "hello" || recovered.GetIntAVP("Igor-IntegerAttribute") != 1 || !bytes.Equal(recovered.GetAllAVP("Igor-OctetsAttribute")[0].GetOctets(), []byte{1, 2, 3}) || recovered.GetStringAVP("Cisco-AVPair") != "x=y" {
+		t.Errorf("bad packed packet recovered %s", recovered)
+	}
+
+	// The response to a packed request is also packed
+	response := NewRadiusResponse(recovered, true)
+	response.Add("Igor-StringAttribute", "one")
+	response.Add("Igor-StringAttribute", "two")
+	responseBytes, _ := response.ToBytes(secret, 1)
+	if len(responseBytes) != 20+6+5+5 {
+		t.Errorf("response was not packed")
+	}
+
+	// Bad sub-attribute length
+	badBytes := []byte{26, 12, 0, 0, 0, 9, 1, 3, 'a', 1, 9, 'b'}
+	if _, _, err := RadiusAVPFromBytes(badBytes, authenticator, secret); err == nil {
+		t.Errorf("bad sub-attribute length not detected")
+	}
+}
+
+func BenchmarkRadiusPacketToBytes(b *testing.B) {
+	request := NewRadiusRequest(ACCOUNTING_REQUEST)
+	request.Add("User-Name", "user@igor")
+	request.Add("Acct-Session-Id", "session-1")
+	request.Add("NAS-IP-Address", "127.0.0.1")
+	request.Add("Acct-Status-Type", 3)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := request.ToBytes(secret, 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAcquireRadiusPacket(b *testing.B) {
+	request := NewRadiusRequest(ACCOUNTING_REQUEST)
+	request.Add("User-Name", "user@igor")
+	request.Add("Acct-Session-Id", "session-1")
+	request.Add("NAS-IP-Address", "127.0.0.1")
+	request.Add("Acct-Status-Type", 3)
+	packetBytes, _ := request.ToBytes(secret, 1)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		packet, err := AcquireRadiusPacketFromBytes(packetBytes, secret)
+		if err != nil {
+			b.Fatal(err)
+		}
+		packet.Release()
+	}
+}
+
+func TestDictionaryPerPacket(t *testing.T) {
+	jsonDict, _ := os.ReadFile("../resources/radiusDictionary.json")
+	dict := radiusdict.NewDictionaryFromJSON(jsonDict)
+	dict.AddVendor(99999, "Embedder")
+	if err := dict.AddAVP(99999, radiusdict.AVPDefinition{Code: 1, Name: "Color", Type: "String"}); err != nil {
+		t.Fatalf("could not add AVP: %s", err)
+	}
+
+	request := NewRadiusRequest(ACCESS_REQUEST).SetDict(dict)
+	request.Add("Embedder-Color", "red")
+	if request.GetStringAVP("Embedder-Color") != "red" {
+		t.Fatalf("AVP of the packet dictionary was not added")
+	}
+	requestBytes, _ := request.ToBytes("secret", 1)
+
+	// Decoded with the global dictionary, the AVP is unknown
+	globalRequest, _ := RadiusPacketFromBytes(requestBytes, "secret")
+	if _, err := globalRequest.GetAVP("Embedder-Color"); err == nil {
+		t.Errorf("AVP not in the global dictionary was decoded")
+	}
+
+	decoded, err := RadiusPacketFromBytesWithDict(requestBytes, "secret", dict)
+	if err != nil {
+		t.Fatalf("could not decode request: %s", err)
+	}
+	if decoded.GetStringAVP("Embedder-Color") != "red" {
+		t.Errorf("AVP was not decoded with the packet dictionary")
+	}
+
+	response := NewRadiusResponse(decoded, true)
+	response.Add("Embedder-Color", "blue")
+	if response.GetStringAVP("Embedder-Color") != "blue" {
+		t.Errorf("AVP of the request dictionary was not added to the response")
+	}
+}
@@ -0,0 +1,82 @@
+package radiusdict
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Vendor specific attributes shipped with igor, that may be added to the dictionaries of the instances
+// that need them, instead of having to be copied to the radiusDictionary.json of each one. Each bundle
+// has the same format as the dictionary file
+//
+//go:embed bundles/*.json
+var bundlesFS embed.FS
+
+// Returns the names of the available bundles, such as "cisco" or "wfa"
+func BundleNames() []string {
+	entries, err := bundlesFS.ReadDir("bundles")
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, strings.TrimSuffix(entry.Name(), ".json"))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Merges the contents of the named bundle into the dictionary. The vendors and attributes already
+// defined in the dictionary, with the same code, are kept and the ones in the bundle ignored, so that
+// the local definitions take precedence
+func (rd *RadiusDict) AddBundle(bundleName string) error {
+	data, err := bundlesFS.ReadFile("bundles/" + bundleName + ".json")
+	if err != nil {
+		return fmt.Errorf("radius dictionary bundle %s not found", bundleName)
+	}
+
+	var jDict jRadiusDict
+	if err := json.Unmarshal(data, &jDict); err != nil {
+		return fmt.Errorf("bad radius dictionary bundle %s: %w", bundleName, err)
+	}
+
+	rd.mutex.Lock()
+	defer rd.mutex.Unlock()
+
+	for _, v := range jDict.Vendors {
+		if _, found := rd.VendorById[v.VendorId]; found {
+			continue
+		}
+		if _, found := rd.VendorByName[v.VendorName]; found {
+			return fmt.Errorf("vendor %s of bundle %s already defined with another id", v.VendorName, bundleName)
+		}
+		rd.VendorById[v.VendorId] = v.VendorName
+		rd.VendorByName[v.VendorName] = v.VendorId
+	}
+
+	for _, vendorAVPs := range jDict.Avps {
+		vendorId := vendorAVPs.VendorId
+		vendorName := rd.VendorById[vendorId]
+
+		for _, attr := range vendorAVPs.Attributes {
+			avpDictItem, err := attr.toAVPDictItem(vendorId, vendorName)
+			if err != nil {
+				return fmt.Errorf("bad radius dictionary bundle %s: %w", bundleName, err)
+			}
+			avpCode := AVPCode{VendorId: vendorId, Code: attr.Code, ExtendedType: attr.ExtendedType}
+			if _, found := rd.AVPByCode[avpCode]; found {
+				continue
+			}
+			if _, found := rd.AVPByName[avpDictItem.Name]; found {
+				continue
+			}
+			rd.AVPByCode[avpCode] = avpDictItem
+			rd.AVPByName[avpDictItem.Name] = avpDictItem
+		}
+	}
+
+	return nil
+}
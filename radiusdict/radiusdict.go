@@ -3,6 +3,7 @@ package radiusdict
 import (
 	"encoding/json"
 	"fmt"
+	"sync"
 )
 
 const (
@@ -18,27 +19,53 @@ const (
 	Integer64   = 9
 )
 
-// VendorId and code of AVP in a single attribute
+// Codes of the extended attributes (RFC 6929), which are identified by the code and the extended
+// type. The values of the long extended ones may span several attributes
+const (
+	EXTENDED_TYPE_1      = 241
+	EXTENDED_TYPE_4      = 244
+	LONG_EXTENDED_TYPE_1 = 245
+	LONG_EXTENDED_TYPE_2 = 246
+)
+
+// Returns true if the standard attribute code is that of an extended or long extended attribute
+func IsExtended(code byte) bool {
+	return code >= EXTENDED_TYPE_1 && code <= LONG_EXTENDED_TYPE_2
+}
+
+// Returns true if the standard attribute code is that of a long extended attribute
+func IsLongExtended(code byte) bool {
+	return code == LONG_EXTENDED_TYPE_1 || code == LONG_EXTENDED_TYPE_2
+}
+
+// VendorId and code of AVP in a single attribute. The ExtendedType is only used for the extended attributes
 type AVPCode struct {
-	VendorId uint32
-	Code     byte
+	VendorId     uint32
+	Code         byte
+	ExtendedType byte
 }
 
 // Diameter Dictionary elements
 type AVPDictItem struct {
-	VendorId   uint32
-	Code       byte
-	Name       string
-	RadiusType int            // One of the constants above
-	EnumValues map[string]int // non nil only in enum type
-	EnumCodes  map[int]string // non  nil only in enum type
-	Encrypted  bool
-	Tagged     bool
-	Salted     bool
+	VendorId     uint32
+	Code         byte
+	ExtendedType byte // non zero only in extended attributes
+	Name         string
+	RadiusType   int            // One of the constants above
+	EnumValues   map[string]int // non nil only in enum type
+	EnumCodes    map[int]string // non  nil only in enum type
+	Encrypted    bool
+	Tagged       bool
+	Salted       bool
+	Concat       bool // Values longer than an attribute are split in several consecutive ones
 }
 
 // Represents the full Radius Dictionary
+// The dictionary may be extended at runtime with AddVendor and AddAVP. If so, it must be read only
+// with the Get methods, which are safe for concurrent use, and not using the maps
 type RadiusDict struct {
+	mutex sync.RWMutex
+
 	// Map of vendor id to vendor name
 	VendorById map[uint32]string
 
@@ -55,7 +82,9 @@ type RadiusDict struct {
 // Returns an empty dictionary item if the code is not found
 // The user may decide to go on with an UNKNOWN dictionary item when the error is returned
 func (rd *RadiusDict) GetFromCode(code AVPCode) (AVPDictItem, error) {
+	rd.mutex.RLock()
 	di := rd.AVPByCode[code]
+	rd.mutex.RUnlock()
 	if di.Name == "" {
 		di.Name = "UNKNOWN"
 		return di, fmt.Errorf("%v not found in dictionary", code)
@@ -66,7 +95,9 @@ func (rd *RadiusDict) GetFromCode(code AVPCode) (AVPDictItem, error) {
 // Returns an empty dictionary item if the code is not found
 // The user may decide to go on with an UNKNOWN dictionary item when the error is returned
 func (rd *RadiusDict) GetFromName(name string) (AVPDictItem, error) {
+	rd.mutex.RLock()
 	di, ok := rd.AVPByName[name]
+	rd.mutex.RUnlock()
 	if !ok {
 		di.Name = "UNKNOWN"
 		return di, fmt.Errorf("%s not found in dictionary", name)
@@ -74,6 +105,49 @@ func (rd *RadiusDict) GetFromName(name string) (AVPDictItem, error) {
 	return di, nil
 }
 
+// Registers a new vendor
+func (rd *RadiusDict) AddVendor(vendorId uint32, vendorName string) error {
+	rd.mutex.Lock()
+	defer rd.mutex.Unlock()
+
+	if _, found := rd.VendorById[vendorId]; found {
+		return fmt.Errorf("vendor %d already defined", vendorId)
+	}
+	if _, found := rd.VendorByName[vendorName]; found {
+		return fmt.Errorf("vendor %s already defined", vendorName)
+	}
+	rd.VendorById[vendorId] = vendorName
+	rd.VendorByName[vendorName] = vendorId
+	return nil
+}
+
+// Registers a new AVP of the specified vendor, which must be already defined, or 0 for the standard
+// attributes. The name in the definition does not include the vendor prefix
+func (rd *RadiusDict) AddAVP(vendorId uint32, avp AVPDefinition) error {
+	rd.mutex.Lock()
+	defer rd.mutex.Unlock()
+
+	vendorName, found := rd.VendorById[vendorId]
+	if !found && vendorId != 0 {
+		return fmt.Errorf("vendor %d not defined", vendorId)
+	}
+	avpDictItem, err := jRadiusAVP(avp).toAVPDictItem(vendorId, vendorName)
+	if err != nil {
+		return err
+	}
+	avpCode := AVPCode{VendorId: vendorId, Code: avp.Code, ExtendedType: avp.ExtendedType}
+	if _, found := rd.AVPByCode[avpCode]; found {
+		return fmt.Errorf("avp %d.%d of vendor %d already defined", avp.Code, avp.ExtendedType, vendorId)
+	}
+	if _, found := rd.AVPByName[avpDictItem.Name]; found {
+		return fmt.Errorf("avp %s already defined", avpDictItem.Name)
+	}
+
+	rd.AVPByCode[avpCode] = avpDictItem
+	rd.AVPByName[avpDictItem.Name] = avpDictItem
+	return nil
+}
+
 // Returns a Diameter Dictionary object from its serialized representation
 func NewDictionaryFromJSON(data []byte) *RadiusDict {
 
@@ -103,8 +177,11 @@ func NewDictionaryFromJSON(data []byte) *RadiusDict {
 
 		// For a specific vendor
 		for _, attr := range vendorAVPs.Attributes {
-			avpDictItem := attr.toAVPDictItem(vendorId, vendorName)
-			dict.AVPByCode[AVPCode{vendorId, attr.Code}] = avpDictItem
+			avpDictItem, err := attr.toAVPDictItem(vendorId, vendorName)
+			if err != nil {
+				panic(err.Error())
+			}
+			dict.AVPByCode[AVPCode{VendorId: vendorId, Code: attr.Code, ExtendedType: attr.ExtendedType}] = avpDictItem
 			dict.AVPByName[avpDictItem.Name] = avpDictItem
 		}
 	}
@@ -116,17 +193,25 @@ func NewDictionaryFromJSON(data []byte) *RadiusDict {
 The following types are helpers for unserializing the JSON Radius Dictionary
 */
 
-// To Unmarshall Dictionary from Json
-type jRadiusAVP struct {
-	Code       byte
-	Name       string
-	Type       string
-	EnumValues map[string]int
-	Encrypted  bool
-	Tagged     bool
-	Salted     bool
+// Definition of an AVP to add to the dictionary, with the same contents as in the JSON representation.
+// The Type is the name of the radius type, such as "Integer". The extended attributes are defined with
+// a code from 241 to 246 and the ExtendedType, as in {"code": 241, "extendedType": 1, ...}. The values of
+// the attributes with Concat, such as EAP-Message, are split in several consecutive attributes if too long
+type AVPDefinition struct {
+	Code         byte
+	ExtendedType byte
+	Name         string
+	Type         string
+	EnumValues   map[string]int
+	Encrypted    bool
+	Tagged       bool
+	Salted       bool
+	Concat       bool
 }
 
+// To Unmarshall Dictionary from Json
+type jRadiusAVP AVPDefinition
+
 type jRadiusVendorAVPs struct {
 	VendorId   uint32
 	Attributes []jRadiusAVP
@@ -142,7 +227,7 @@ type jRadiusDict struct {
 }
 
 // Builds a cooked AVPDictItem from the raw Json representation
-func (javp jRadiusAVP) toAVPDictItem(v uint32, vs string) AVPDictItem {
+func (javp jRadiusAVP) toAVPDictItem(v uint32, vs string) (AVPDictItem, error) {
 
 	// Sanity check
 	var radiusType int
@@ -169,11 +254,23 @@ func (javp jRadiusAVP) toAVPDictItem(v uint32, vs string) AVPDictItem {
 		radiusType = Integer64
 
 	default:
-		panic(javp.Type + " is not a valid RadiusType")
+		return AVPDictItem{}, fmt.Errorf("%s is not a valid RadiusType", javp.Type)
 	}
 
 	if (javp.Encrypted || javp.Salted) && radiusType != Octets {
-		panic("encrypted not octets found in dictionary")
+		return AVPDictItem{}, fmt.Errorf("encrypted not octets found in dictionary")
+	}
+
+	isExtended := v == 0 && IsExtended(javp.Code)
+	if isExtended && javp.ExtendedType == 0 {
+		return AVPDictItem{}, fmt.Errorf("extended attribute %s without extended type", javp.Name)
+	}
+	if !isExtended && javp.ExtendedType != 0 {
+		return AVPDictItem{}, fmt.Errorf("extended type specified for %s, which is not an extended attribute", javp.Name)
+	}
+
+	if javp.Concat && (isExtended || (radiusType != Octets && radiusType != String) || javp.Tagged || javp.Encrypted || javp.Salted) {
+		return AVPDictItem{}, fmt.Errorf("concat specified for %s, which is not a plain string or octets attribute", javp.Name)
 	}
 
 	var codes map[int]string
@@ -190,14 +287,16 @@ func (javp jRadiusAVP) toAVPDictItem(v uint32, vs string) AVPDictItem {
 	}
 
 	return AVPDictItem{
-		VendorId:   v,
-		Code:       javp.Code,
-		Name:       namePrefix + javp.Name,
-		RadiusType: radiusType,
-		EnumValues: javp.EnumValues,
-		EnumCodes:  codes,
-		Encrypted:  javp.Encrypted,
-		Tagged:     javp.Tagged,
-		Salted:     javp.Salted,
-	}
+		VendorId:     v,
+		Code:         javp.Code,
+		ExtendedType: javp.ExtendedType,
+		Name:         namePrefix + javp.Name,
+		RadiusType:   radiusType,
+		EnumValues:   javp.EnumValues,
+		EnumCodes:    codes,
+		Encrypted:    javp.Encrypted,
+		Tagged:       javp.Tagged,
+		Salted:       javp.Salted,
+		Concat:       javp.Concat,
+	}, nil
 }
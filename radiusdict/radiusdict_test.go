@@ -12,7 +12,7 @@ func TestRadiusDict(t *testing.T) {
 	radiusDict := NewDictionaryFromJSON(jsonDict)
 
 	// Basic type
-	avp := radiusDict.AVPByCode[AVPCode{0, 1}]
+	avp := radiusDict.AVPByCode[AVPCode{0, 1, 0}]
 	if avp.Name != "User-Name" {
 		t.Errorf("Code {0, 1} Name was not User-Name")
 	}
@@ -33,7 +33,7 @@ func TestRadiusDict(t *testing.T) {
 	}
 
 	// Encrypted type
-	avp = radiusDict.AVPByCode[AVPCode{0, 2}]
+	avp = radiusDict.AVPByCode[AVPCode{0, 2, 0}]
 	if avp.Name != "User-Password" {
 		t.Errorf("Code {0, 2} Name was not User-Password")
 	}
@@ -63,7 +63,7 @@ func TestRadiusDict(t *testing.T) {
 	}
 
 	// VendorId
-	avp = radiusDict.AVPByCode[AVPCode{9, 1}]
+	avp = radiusDict.AVPByCode[AVPCode{9, 1, 0}]
 	if avp.Name != "Cisco-AVPair" {
 		t.Errorf("Code {9, 1} Name was not Cisco-AVPair but %s", avp.Name)
 	}
@@ -81,7 +81,7 @@ func TestRadiusDict(t *testing.T) {
 		}
 	}
 
-	avp, err = radiusDict.GetFromCode(AVPCode{90001, 10})
+	avp, err = radiusDict.GetFromCode(AVPCode{90001, 10, 0})
 	if err != nil {
 		t.Errorf("Igor code 10 not found")
 	} else {
@@ -107,3 +107,99 @@ func TestUnknownRadiusAVP(t *testing.T) {
 		t.Errorf("Igor-Nothing name is not UNKNOWN")
 	}
 }
+
+func TestRadiusDictExtension(t *testing.T) {
+	jsonDict, _ := os.ReadFile("../resources/radiusDictionary.json")
+	radiusDict := NewDictionaryFromJSON(jsonDict)
+
+	if err := radiusDict.AddVendor(99999, "Embedder"); err != nil {
+		t.Fatalf("could not add vendor: %s", err)
+	}
+	if err := radiusDict.AddAVP(99999, AVPDefinition{Code: 1, Name: "Secret", Type: "Octets", Salted: true}); err != nil {
+		t.Fatalf("could not add AVP: %s", err)
+	}
+	avp, err := radiusDict.GetFromName("Embedder-Secret")
+	if err != nil || avp.Code != 1 || avp.VendorId != 99999 || !avp.Salted {
+		t.Errorf("bad added AVP %v", avp)
+	}
+	if err := radiusDict.AddAVP(99999, AVPDefinition{Code: 2, Name: "Number", Type: "Integer", Encrypted: true}); err == nil {
+		t.Errorf("encrypted integer AVP was added")
+	}
+	if err := radiusDict.AddAVP(99999, AVPDefinition{Code: 1, Name: "Other", Type: "String"}); err == nil {
+		t.Errorf("AVP with existing code was added")
+	}
+}
+
+func TestExtendedRadiusAVP(t *testing.T) {
+	jsonDict, _ := os.ReadFile("../resources/radiusDictionary.json")
+	radiusDict := NewDictionaryFromJSON(jsonDict)
+
+	avp, err := radiusDict.GetFromCode(AVPCode{Code: 241, ExtendedType: 1})
+	if err != nil || avp.Name != "Frag-Status" || avp.ExtendedType != 1 {
+		t.Errorf("bad extended AVP %v: %v", avp, err)
+	}
+	if _, err := radiusDict.GetFromCode(AVPCode{Code: 241, ExtendedType: 99}); err == nil {
+		t.Errorf("unknown extended AVP was found")
+	}
+
+	if err := radiusDict.AddAVP(0, AVPDefinition{Code: 246, ExtendedType: 1, Name: "My-Long-Attribute", Type: "Octets"}); err != nil {
+		t.Errorf("could not add long extended AVP: %s", err)
+	}
+	if avp, _ := radiusDict.GetFromCode(AVPCode{Code: 246, ExtendedType: 1}); avp.Name != "My-Long-Attribute" {
+		t.Errorf("long extended AVP not found")
+	}
+	if err := radiusDict.AddAVP(0, AVPDefinition{Code: 242, Name: "No-Extended-Type", Type: "String"}); err == nil {
+		t.Errorf("extended AVP without extended type was added")
+	}
+	if err := radiusDict.AddAVP(0, AVPDefinition{Code: 200, ExtendedType: 1, Name: "Not-Extended", Type: "String"}); err == nil {
+		t.Errorf("non extended AVP with extended type was added")
+	}
+}
+
+func TestConcatRadiusAVP(t *testing.T) {
+	jsonDict, _ := os.ReadFile("../resources/radiusDictionary.json")
+	radiusDict := NewDictionaryFromJSON(jsonDict)
+
+	if avp, _ := radiusDict.GetFromName("EAP-Message"); !avp.Concat {
+		t.Errorf("EAP-Message is not concat")
+	}
+	if err := radiusDict.AddAVP(0, AVPDefinition{Code: 200, Name: "Concat-Integer", Type: "Integer", Concat: true}); err == nil {
+		t.Errorf("concat integer AVP was added")
+	}
+	if err := radiusDict.AddAVP(0, AVPDefinition{Code: 201, Name: "Concat-Secret", Type: "Octets", Encrypted: true, Concat: true}); err == nil {
+		t.Errorf("concat encrypted AVP was added")
+	}
+}
+
+func TestRadiusDictBundles(t *testing.T) {
+	jsonDict, _ := os.ReadFile("../resources/radiusDictionary.json")
+	radiusDict := NewDictionaryFromJSON(jsonDict)
+
+	if names := BundleNames(); len(names) != 5 {
+		t.Fatalf("bad bundle names %v", names)
+	}
+
+	for _, bundleName := range BundleNames() {
+		if err := radiusDict.AddBundle(bundleName); err != nil {
+			t.Fatalf("could not add bundle %s: %s", bundleName, err)
+		}
+	}
+	if avp, err := radiusDict.GetFromName("WFA-HotSpot2-AP-Version"); err != nil || avp.RadiusType != Integer {
+		t.Errorf("bad bundle attribute %v", avp)
+	}
+	if avp, err := radiusDict.GetFromCode(AVPCode{VendorId: 4874, Code: 65}); err != nil || avp.Name != "Unisphere-Service-Activate" || !avp.Tagged {
+		t.Errorf("bad bundle attribute %v", avp)
+	}
+	if avp, err := radiusDict.GetFromCode(AVPCode{VendorId: 2636, Code: 1}); err != nil || avp.Name != "Juniper-Local-User-Name" {
+		t.Errorf("bad bundle attribute %v", avp)
+	}
+
+	// The existing definitions are kept
+	if avp, err := radiusDict.GetFromCode(AVPCode{VendorId: 2011, Code: 1}); err != nil || avp.Name != "Huawei-Input-Committed-Burst-Size" {
+		t.Errorf("existing attribute was replaced %v", avp)
+	}
+
+	if err := radiusDict.AddBundle("nonexisting"); err == nil {
+		t.Errorf("unknown bundle was added")
+	}
+}
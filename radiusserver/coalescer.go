@@ -0,0 +1,92 @@
+package radiusserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"igor/radiuscodec"
+	"strings"
+	"sync"
+)
+
+// Coalescing of identical concurrent requests, such as the retransmissions of a NAS that arrive
+// before the answer to the original request has been generated. Only the first request with a given
+// fingerprint is passed to the handler. The rest wait for its answer
+
+// Outstanding execution of the handler for a fingerprint
+type coalescedCall struct {
+	// Closed when the handler returns
+	done chan struct{}
+
+	response *radiuscodec.RadiusPacket
+	err      error
+}
+
+// Keeps the requests being handled, by fingerprint
+type requestCoalescer struct {
+	sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+func newRequestCoalescer() *requestCoalescer {
+	return &requestCoalescer{calls: make(map[string]*coalescedCall)}
+}
+
+// Invokes the handler for the request, unless there is another one with the same fingerprint being
+// handled, in which case waits for that answer. The response returned has the Identifier and
+// Authenticator of the request passed as parameter. The boolean is true if the answer was shared.
+// The handler receives the context of the first request
+func (c *requestCoalescer) handle(ctx context.Context, fingerprint string, request *radiuscodec.RadiusPacket, handler RadiusPacketHandlerWithContext) (*radiuscodec.RadiusPacket, bool, error) {
+
+	c.Lock()
+	if call, found := c.calls[fingerprint]; found {
+		c.Unlock()
+		<-call.done
+		if call.err != nil {
+			return nil, true, call.err
+		}
+		return copyResponse(call.response, request), true, nil
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	c.calls[fingerprint] = call
+	c.Unlock()
+
+	call.response, call.err = handler(ctx, request)
+
+	c.Lock()
+	delete(c.calls, fingerprint)
+	c.Unlock()
+	close(call.done)
+
+	return call.response, false, call.err
+}
+
+// Returns a copy of the response for the specified request, with its own attributes
+func copyResponse(response *radiuscodec.RadiusPacket, request *radiuscodec.RadiusPacket) *radiuscodec.RadiusPacket {
+	copy := response.Copy()
+	copy.Identifier = request.Identifier
+	copy.Authenticator = request.Authenticator
+	return copy
+}
+
+// Builds the fingerprint of the request with the address of the client, the User-Password, which is
+// hashed, and the values of the specified attributes
+func getFingerprint(request *radiuscodec.RadiusPacket, clientAddr string, attributeNames []string) string {
+	var sb strings.Builder
+	sb.WriteByte(request.Code)
+	sb.WriteString(clientAddr)
+	if password := request.GetPasswordStringAVP("User-Password"); password != "" {
+		hash := sha256.Sum256([]byte(password))
+		sb.WriteString("/User-Password=")
+		sb.WriteString(hex.EncodeToString(hash[:]))
+	}
+	for _, attributeName := range attributeNames {
+		for _, avp := range request.GetAllAVP(attributeName) {
+			sb.WriteString("/")
+			sb.WriteString(attributeName)
+			sb.WriteString("=")
+			sb.WriteString(avp.GetString())
+		}
+	}
+	return sb.String()
+}
@@ -2,10 +2,20 @@ package radiusserver
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"igor/cdr"
 	"igor/config"
+	"igor/core"
+	"igor/instrumentation"
 	"igor/radiuscodec"
 	"net"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -71,7 +81,306 @@ func TestRadiusServer(t *testing.T) {
 	time.Sleep(1000 * time.Millisecond)
 }
 
+func TestInvalidPackets(t *testing.T) {
+
+	pci := config.GetPolicyConfigInstance("testServer")
+	serverConf := pci.RadiusServerConf()
+
+	ctx, terminateServerSockets := context.WithCancel(context.Background())
+	defer terminateServerSockets()
+	NewRadiusServer(ctx, pci, "127.0.0.1", serverConf.AuthPort, echoHandler)
+	NewRadiusServer(ctx, pci, "127.0.0.1", serverConf.AcctPort, echoHandler)
+	time.Sleep(100 * time.Millisecond)
+
+	// Access-Request from unknown client is rejected
+	unknownClientSocket, err := net.ListenPacket("udp", "127.0.0.2:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unknownClientSocket.Close()
+	request := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+	request.Add("User-Name", "myUserName")
+	requestBytes, _ := request.ToBytes("secret", 1)
+	authAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverConf.AuthPort))
+	unknownClientSocket.WriteTo(requestBytes, authAddr)
+
+	responseBuffer := make([]byte, 4096)
+	unknownClientSocket.SetReadDeadline(time.Now().Add(1 * time.Second))
+	if _, _, err := unknownClientSocket.ReadFrom(responseBuffer); err != nil {
+		t.Fatalf("no response to unknown client %s", err)
+	}
+	if responseBuffer[0] != radiuscodec.ACCESS_REJECT {
+		t.Errorf("unknown client got response with code %d", responseBuffer[0])
+	}
+
+	// Accounting-Request with bad authenticator is discarded
+	clientSocket, err := net.ListenPacket("udp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientSocket.Close()
+	request = radiuscodec.NewRadiusRequest(radiuscodec.ACCOUNTING_REQUEST)
+	request.Add("User-Name", "myUserName")
+	requestBytes, _ = request.ToBytes("badsecret", 2)
+	acctAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverConf.AcctPort))
+	clientSocket.WriteTo(requestBytes, acctAddr)
+
+	clientSocket.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, _, err := clientSocket.ReadFrom(responseBuffer); err == nil {
+		t.Errorf("response received for bad authenticator")
+	}
+
+	// Counters by reason
+	if m := instrumentation.MS.RadiusQuery("RadiusServerUnknownClients", nil, []string{}); m[instrumentation.RadiusMetricKey{}] != 1 {
+		t.Errorf("unknown clients counter was %d", m[instrumentation.RadiusMetricKey{}])
+	}
+	if m := instrumentation.MS.RadiusQuery("RadiusServerBadAuthenticators", nil, []string{}); m[instrumentation.RadiusMetricKey{}] != 1 {
+		t.Errorf("bad authenticators counter was %d", m[instrumentation.RadiusMetricKey{}])
+	}
+}
+
+func TestRadSecClientIdentification(t *testing.T) {
+
+	pci := config.GetPolicyConfigInstance("testServer")
+
+	// By Common Name
+	cert := x509.Certificate{Subject: pkix.Name{CommonName: "nas01.igor"}}
+	client, err := IdentifyRadSecClient(pci, tls.ConnectionState{PeerCertificates: []*x509.Certificate{&cert}})
+	if err != nil || client.Name != "nas-by-cn" {
+		t.Fatalf("bad client identification %v %s", client, err)
+	}
+	if !client.IsAllowed("auth") || client.IsAllowed("coa") {
+		t.Errorf("bad permissions for %s", client.Name)
+	}
+	request := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+	ApplyRadSecClientDefaults(client, request)
+	if request.GetStringAVP("NAS-Identifier") != "radsec-nas" {
+		t.Errorf("default attribute not added")
+	}
+
+	// By Subject Alternative Name
+	cert = x509.Certificate{Subject: pkix.Name{CommonName: "other"}, DNSNames: []string{"nas02.radsec.igor"}}
+	if client, err := IdentifyRadSecClient(pci, tls.ConnectionState{PeerCertificates: []*x509.Certificate{&cert}}); err != nil || client.Name != "nas-by-san" {
+		t.Errorf("bad client identification %v %s", client, err)
+	}
+
+	// Unknown
+	cert = x509.Certificate{Subject: pkix.Name{CommonName: "other"}}
+	if _, err := IdentifyRadSecClient(pci, tls.ConnectionState{PeerCertificates: []*x509.Certificate{&cert}}); err == nil {
+		t.Errorf("unknown certificate identified")
+	}
+	if _, err := IdentifyRadSecClient(pci, tls.ConnectionState{}); !errors.Is(err, ErrNoClientCertificate) {
+		t.Errorf("connection without certificate identified")
+	}
+}
+
+func TestCoalescing(t *testing.T) {
+
+	coalescer := newRequestCoalescer()
+	attributeNames := config.GetPolicyConfig().RadiusServerConf().CoalescingAttributes
+
+	// Handler that takes some time and counts the invocations
+	var invocations int32
+	slowHandler := func(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+		atomic.AddInt32(&invocations, 1)
+		time.Sleep(200 * time.Millisecond)
+		return echoHandler(request)
+	}
+
+	// Retransmissions of the same request, with different identifiers
+	var wg sync.WaitGroup
+	var sharedCount int32
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(identifier byte) {
+			defer wg.Done()
+			request := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+			request.Identifier = identifier
+			request.Add("User-Name", "myUserName")
+			request.Add("Calling-Station-Id", "myCallingStationId")
+			response, shared, err := coalescer.handle(context.Background(), getFingerprint(request, "127.0.0.1", attributeNames), request, IgnoringContext(slowHandler))
+			if err != nil {
+				t.Errorf("error handling request %s", err)
+				return
+			}
+			if response.Identifier != identifier {
+				t.Errorf("response identifier %d for request %d", response.Identifier, identifier)
+			}
+			if shared {
+				atomic.AddInt32(&sharedCount, 1)
+			}
+		}(byte(i))
+		time.Sleep(10 * time.Millisecond)
+	}
+	wg.Wait()
+
+	if invocations != 1 || sharedCount != 4 {
+		t.Errorf("handler invoked %d times with %d shared answers", invocations, sharedCount)
+	}
+
+	// Different fingerprint
+	request := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+	request.Add("User-Name", "otherUserName")
+	if _, shared, _ := coalescer.handle(context.Background(), getFingerprint(request, "127.0.0.1", attributeNames), request, IgnoringContext(slowHandler)); shared || invocations != 2 {
+		t.Errorf("request with different fingerprint was coalesced")
+	}
+
+	// Requests from different clients or with different passwords are not coalesced
+	request = radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+	request.Add("User-Name", "myUserName")
+	if getFingerprint(request, "127.0.0.1", attributeNames) == getFingerprint(request, "127.0.0.2", attributeNames) {
+		t.Errorf("same fingerprint for different clients")
+	}
+	withPassword := request.Copy().Add("User-Password", []byte("password"))
+	withOtherPassword := request.Copy().Add("User-Password", []byte("otherPassword"))
+	if getFingerprint(withPassword, "127.0.0.1", attributeNames) == getFingerprint(withOtherPassword, "127.0.0.1", attributeNames) {
+		t.Errorf("same fingerprint for different passwords")
+	}
+
+	// The shared responses do not share the attributes
+	response, _ := echoHandler(request)
+	copied := copyResponse(response, request)
+	copied.AVPs = copied.AVPs[:0]
+	copied.Add("User-Name", "changedUserName")
+	if response.GetStringAVP("User-Name") != "myUserName" {
+		t.Errorf("attributes shared with the copy of the response")
+	}
+}
+
+// Writer that blocks until the gate is closed
+type gatedWriter struct {
+	gate chan struct{}
+}
+
+func (gw gatedWriter) Write(c *cdr.CDR) error {
+	<-gw.gate
+	return nil
+}
+
+func (gw gatedWriter) Close() error {
+	return nil
+}
+
+func TestCDRPipeline(t *testing.T) {
+
+	gate := make(chan struct{})
+	cdr.RegisterWriter("radiusserver-gated", func(params map[string]string) (cdr.Writer, error) { return gatedWriter{gate: gate}, nil })
+	pipeline, err := cdr.NewPipeline("", config.CDRPipelineConfig{
+		Stages:  []config.CDRStageConfig{{Type: "decode", QueueSize: 1}},
+		Writers: []config.CDRStageConfig{{Type: "radiusserver-gated", QueueSize: 1}},
+	})
+	if err != nil {
+		t.Fatalf("could not create pipeline %s", err)
+	}
+	defer pipeline.Close()
+	defer close(gate)
+
+	rs := RadiusServer{ci: config.GetPolicyConfig(), handler: IgnoringContext(echoHandler), coalescer: newRequestCoalescer()}
+	rs.SetCDRPipeline(pipeline)
+
+	// Accounting requests are answered until the pipeline is full
+	var answered int
+	for answered = 0; answered < 10; answered++ {
+		request := radiuscodec.NewRadiusRequest(radiuscodec.ACCOUNTING_REQUEST)
+		request.Add("Acct-Session-Id", fmt.Sprintf("session-%d", answered))
+		if _, err := rs.handle(context.Background(), request, testClientAddr); err != nil {
+			if !errors.Is(err, cdr.ErrPipelineFull) {
+				t.Fatalf("expected pipeline full but got %s", err)
+			}
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if answered == 0 || answered == 10 {
+		t.Errorf("pipeline not filled after %d requests", answered)
+	}
+
+	// Other requests are not affected
+	request := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+	request.Add("User-Name", "myUserName")
+	if _, err := rs.handle(context.Background(), request, testClientAddr); err != nil {
+		t.Errorf("access request not answered with full pipeline %s", err)
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+
+	rs := RadiusServer{ci: config.GetPolicyConfig(), handler: IgnoringContext(echoHandler), coalescer: newRequestCoalescer()}
+	received := time.Now().Truncate(time.Second)
+
+	// Within tolerance. Not corrected
+	request := radiuscodec.NewRadiusRequest(radiuscodec.ACCOUNTING_REQUEST)
+	request.Add("Event-Timestamp", received.Add(-5*time.Second))
+	rs.checkClockSkew("127.0.0.1", request, received)
+	if request.ClockSkew != -5*time.Second || !request.GetDateAVP("Event-Timestamp").Equal(received.Add(-5*time.Second)) {
+		t.Errorf("skew %s, timestamp %s", request.ClockSkew, request.GetDateAVP("Event-Timestamp"))
+	}
+
+	// Clock of the client one hour ahead, with a delay. Corrected
+	request = radiuscodec.NewRadiusRequest(radiuscodec.ACCOUNTING_REQUEST)
+	request.Add("Event-Timestamp", received.Add(time.Hour-10*time.Second))
+	request.Add("Acct-Delay-Time", 10)
+	rs.checkClockSkew("127.0.0.1", request, received)
+	if request.ClockSkew != time.Hour {
+		t.Errorf("skew was %s", request.ClockSkew)
+	}
+	if !request.GetDateAVP("Event-Timestamp").Equal(received.Add(-10 * time.Second)) {
+		t.Errorf("timestamp not corrected %s", request.GetDateAVP("Event-Timestamp"))
+	}
+	time.Sleep(100 * time.Millisecond)
+	if skew := instrumentation.MS.RadiusClientClockSkewQuery()["127.0.0.1"]; skew != time.Hour {
+		t.Errorf("reported skew was %s", skew)
+	}
+}
+
 // Simple handler that generates a success response with the same attributes as in the request
+func TestDynAuth(t *testing.T) {
+
+	pci := config.GetPolicyConfigInstance("testServer")
+	serverConf := pci.RadiusServerConf()
+
+	ctx, terminateServerSocket := context.WithCancel(context.Background())
+	defer terminateServerSocket()
+	NewRadiusServer(ctx, pci, "127.0.0.1", serverConf.CoAPort, echoHandler)
+	time.Sleep(100 * time.Millisecond)
+
+	clientSocket, err := net.ListenPacket("udp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientSocket.Close()
+	coaAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverConf.CoAPort))
+	responseBuffer := make([]byte, 4096)
+
+	// CoA-Request is acknowledged
+	request := radiuscodec.NewRadiusRequest(radiuscodec.COA_REQUEST)
+	request.Add("User-Name", "myUserName")
+	requestBytes, _ := request.ToBytes("secret", 1)
+	clientSocket.WriteTo(requestBytes, coaAddr)
+	clientSocket.SetReadDeadline(time.Now().Add(1 * time.Second))
+	n, _, err := clientSocket.ReadFrom(responseBuffer)
+	if err != nil {
+		t.Fatalf("no response to CoA-Request %s", err)
+	}
+	if responseBuffer[0] != radiuscodec.COA_ACK || !radiuscodec.ValidateResponseAuthenticator(responseBuffer[:n], request.Authenticator, "secret") {
+		t.Errorf("bad response to CoA-Request with code %d", responseBuffer[0])
+	}
+
+	// Bad authenticator and Access-Request in the CoA port are discarded
+	badRequestBytes, _ := request.ToBytes("badsecret", 2)
+	accessRequestBytes, _ := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST).ToBytes("secret", 3)
+	for _, b := range [][]byte{badRequestBytes, accessRequestBytes} {
+		clientSocket.WriteTo(b, coaAddr)
+		clientSocket.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		if _, _, err := clientSocket.ReadFrom(responseBuffer); err == nil {
+			t.Errorf("response received for discarded request with code %d", b[0])
+		}
+	}
+}
+
+// Address of the client of the requests passed directly to the server
+var testClientAddr = &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1812}
+
 func echoHandler(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
 
 	response := radiuscodec.NewRadiusResponse(request, true)
@@ -81,3 +390,182 @@ func echoHandler(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket,
 
 	return response, nil
 }
+
+func TestBulkhead(t *testing.T) {
+
+	// Allows one request executing and another one waiting
+	config.InitPolicyConfigInstance("resources/searchRules.json", "testServerStuck", false)
+	rs := RadiusServer{
+		ci:        config.GetPolicyConfigInstance("testServerStuck"),
+		coalescer: newRequestCoalescer(),
+		handler: IgnoringContext(func(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+			time.Sleep(200 * time.Millisecond)
+			return radiuscodec.NewRadiusResponse(request, true), nil
+		}),
+	}
+
+	var wg sync.WaitGroup
+	var answered, rejected, timedOut int32
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request := radiuscodec.NewRadiusRequest(radiuscodec.ACCOUNTING_REQUEST)
+			_, err := rs.handle(context.Background(), request, testClientAddr)
+			switch {
+			case err == nil:
+				atomic.AddInt32(&answered, 1)
+			case errors.Is(err, core.ErrBulkheadFull):
+				atomic.AddInt32(&rejected, 1)
+			case errors.Is(err, core.ErrTimeout):
+				atomic.AddInt32(&timedOut, 1)
+			}
+		}()
+		time.Sleep(20 * time.Millisecond)
+	}
+	wg.Wait()
+
+	// The first one is answered, the second one waits and times out, and the third one is rejected
+	if answered != 1 || rejected != 1 || timedOut != 1 {
+		t.Errorf("answered %d, rejected %d and timed out %d", answered, rejected, timedOut)
+	}
+
+	// Another server does not share the concurrency limit
+	other := RadiusServer{
+		ci:        rs.ci,
+		coalescer: newRequestCoalescer(),
+		handler:   rs.handler,
+	}
+	answered = 0
+	for _, server := range []*RadiusServer{&rs, &other} {
+		wg.Add(1)
+		go func(server *RadiusServer) {
+			defer wg.Done()
+			if _, err := server.handle(context.Background(), radiuscodec.NewRadiusRequest(radiuscodec.ACCOUNTING_REQUEST), testClientAddr); err == nil {
+				atomic.AddInt32(&answered, 1)
+			}
+		}(server)
+	}
+	wg.Wait()
+	if answered != 2 {
+		t.Errorf("answered %d requests in different servers", answered)
+	}
+
+	// The handler is cancelled when the bulkhead times out
+	cancelled := make(chan struct{})
+	slow := RadiusServer{
+		ci:        rs.ci,
+		coalescer: newRequestCoalescer(),
+		handler: func(ctx context.Context, request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+			select {
+			case <-ctx.Done():
+				close(cancelled)
+				return nil, ctx.Err()
+			case <-time.After(2 * time.Second):
+				return radiuscodec.NewRadiusResponse(request, true), nil
+			}
+		},
+	}
+	if _, err := slow.handle(context.Background(), radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST), testClientAddr); !errors.Is(err, core.ErrTimeout) {
+		t.Errorf("expected timeout but got %v", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(500 * time.Millisecond):
+		t.Errorf("handler context not cancelled after the bulkhead timeout")
+	}
+}
+
+func TestDuplicateDetection(t *testing.T) {
+
+	var invocations int32
+	rs := RadiusServer{
+		ci:         config.GetPolicyConfig(),
+		coalescer:  newRequestCoalescer(),
+		duplicates: core.NewDuplicateCache(1*time.Second, 0),
+		handler: IgnoringContext(func(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+			atomic.AddInt32(&invocations, 1)
+			return echoHandler(request)
+		}),
+	}
+
+	nasAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:40000")
+	request := radiuscodec.NewRadiusRequest(radiuscodec.ACCOUNTING_REQUEST)
+	request.Identifier = 10
+	request.Add("Acct-Session-Id", "duplicated-session")
+
+	original, isDuplicate, err := rs.handleOnce(context.Background(), request, nasAddr)
+	if err != nil || isDuplicate {
+		t.Fatalf("original request %t, %v", isDuplicate, err)
+	}
+
+	// The retransmission gets the same response
+	response, isDuplicate, err := rs.handleOnce(context.Background(), request, nasAddr)
+	if err != nil || !isDuplicate || response != original || invocations != 1 {
+		t.Errorf("retransmission %t, %v, %d invocations", isDuplicate, err, invocations)
+	}
+
+	// Same Identifier from another port is not a duplicate
+	otherAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:40001")
+	if _, isDuplicate, _ := rs.handleOnce(context.Background(), request, otherAddr); isDuplicate || invocations != 2 {
+		t.Errorf("request from other port treated as duplicate")
+	}
+
+	// Another Identifier is not a duplicate
+	request.Identifier = 11
+	if _, isDuplicate, _ := rs.handleOnce(context.Background(), request, nasAddr); isDuplicate || invocations != 3 {
+		t.Errorf("request with other identifier treated as duplicate")
+	}
+}
+
+func TestStatusServer(t *testing.T) {
+
+	pci := config.GetPolicyConfigInstance("testServer")
+	serverConf := pci.RadiusServerConf()
+
+	failingHandler := func(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+		return nil, errors.New("handler invoked")
+	}
+	ctx, terminateServerSockets := context.WithCancel(context.Background())
+	defer terminateServerSockets()
+	NewRadiusServer(ctx, pci, "127.0.0.1", serverConf.AuthPort, failingHandler)
+	NewRadiusServer(ctx, pci, "127.0.0.1", serverConf.AcctPort, failingHandler)
+	time.Sleep(100 * time.Millisecond)
+
+	clientSocket, err := net.ListenPacket("udp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientSocket.Close()
+	responseBuffer := make([]byte, 4096)
+
+	// Answered in the authentication and accounting ports, with the configured attributes
+	for port, expectedCode := range map[int]byte{serverConf.AuthPort: radiuscodec.ACCESS_ACCEPT, serverConf.AcctPort: radiuscodec.ACCOUNTING_RESPONSE} {
+		request := radiuscodec.NewRadiusRequest(radiuscodec.STATUS_SERVER)
+		request.Add("Message-Authenticator", make([]byte, 16))
+		requestBytes, _ := request.ToBytes("secret", 1)
+		addr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", port))
+		clientSocket.WriteTo(requestBytes, addr)
+		clientSocket.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, _, err := clientSocket.ReadFrom(responseBuffer)
+		if err != nil {
+			t.Fatalf("no response to Status-Server in port %d: %s", port, err)
+		}
+		if !radiuscodec.ValidateResponseAuthenticator(responseBuffer[:n], request.Authenticator, "secret") || !radiuscodec.ValidateResponseMessageAuthenticator(responseBuffer[:n], request.Authenticator, "secret") {
+			t.Errorf("bad authenticator in response to Status-Server in port %d", port)
+		}
+		response, _ := radiuscodec.RadiusPacketFromBytes(responseBuffer[:n], "secret")
+		if response.Code != expectedCode || response.GetStringAVP("Reply-Message") != "igor up" {
+			t.Errorf("bad response to Status-Server in port %d: %v", port, response)
+		}
+	}
+
+	// Discarded without Message-Authenticator
+	requestBytes, _ := radiuscodec.NewRadiusRequest(radiuscodec.STATUS_SERVER).ToBytes("secret", 2)
+	authAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverConf.AuthPort))
+	clientSocket.WriteTo(requestBytes, authAddr)
+	clientSocket.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, _, err := clientSocket.ReadFrom(responseBuffer); err == nil {
+		t.Errorf("response received for Status-Server without Message-Authenticator")
+	}
+}
@@ -2,16 +2,45 @@ package radiusserver
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"igor/attrstats"
+	"igor/authevents"
+	"igor/cdr"
 	"igor/config"
+	"igor/core"
 	"igor/instrumentation"
+	"igor/kafkaproducer"
 	"igor/radiuscodec"
+	"igor/systemd"
+	"igor/telemetry"
+	"igor/wiretrace"
 	"net"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
 )
 
+// Name of the handler function in the bulkheads configuration
+const BULKHEAD_NAME = "radiusServer"
+
 // Type for functions that handle the radius requests received
+// The request is returned to the packet pool after the response is sent, so the handler must use
+// request.Copy() if it keeps a reference to it after returning
 type RadiusPacketHandler func(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error)
 
+// Variant of RadiusPacketHandler that receives a context carrying the trace metadata, which is cancelled
+// when the server gives up waiting for the response, so that long running handlers may be abandoned
+type RadiusPacketHandlerWithContext func(ctx context.Context, request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error)
+
+// Adapts a RadiusPacketHandler to be used where a RadiusPacketHandlerWithContext is expected
+func IgnoringContext(handler RadiusPacketHandler) RadiusPacketHandlerWithContext {
+	return func(ctx context.Context, request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+		return handler(request)
+	}
+}
+
 // Implements a radius server socket
 // Validates incoming messages, sends them to the router for processing and sends the responses
 type RadiusServer struct {
@@ -20,23 +49,79 @@ type RadiusServer struct {
 	ci *config.PolicyConfigurationManager
 
 	// Handler function
-	handler RadiusPacketHandler
+	handler RadiusPacketHandlerWithContext
 
 	// Context for cancellation
 	context context.Context
+
+	// For handling only once the identical concurrent requests
+	coalescer *requestCoalescer
+
+	// Limits the concurrency of the handler function of this server
+	bulkheads core.Bulkheads
+
+	// Responses sent, to answer the retransmissions of the requests. Nil if duplicate detection is disabled
+	duplicates *core.DuplicateCache
+
+	// "auth", "acct", "coa" or empty, depending on the port, to select the policy for invalid packets
+	listener string
+
+	// Handler for the invalid packets, if so specified in the policy. Stores a RadiusPacketHandler
+	honeypotHandler atomic.Value
+
+	// Where the accounting requests are submitted, if set. Stores a *cdr.Pipeline
+	cdrPipeline atomic.Value
+
+	// Notifies the authentication events, if set. Stores an *authevents.Notifier
+	authNotifier atomic.Value
+
+	// Counts the values of the attributes in the requests and responses, if set. Stores an *attrstats.Analyzer
+	attributeStats atomic.Value
+
+	// Publishes the accounting requests and the handler errors, if set. Stores a *kafkaproducer.Producer
+	kafkaProducer atomic.Value
+}
+
+// Returns the logger of the subsystem
+func logger() *zap.SugaredLogger {
+	return config.GetSubsystemLogger(config.SUBSYSTEM_RADIUSSERVER)
 }
 
 func NewRadiusServer(ctx context.Context, ci *config.PolicyConfigurationManager, bindIPAddress string, bindPort int, handler RadiusPacketHandler) *RadiusServer {
+	return NewRadiusServerWithContext(ctx, ci, bindIPAddress, bindPort, IgnoringContext(handler))
+}
+
+// Same as NewRadiusServer, with a handler that receives the context of the request
+func NewRadiusServerWithContext(ctx context.Context, ci *config.PolicyConfigurationManager, bindIPAddress string, bindPort int, handler RadiusPacketHandlerWithContext) *RadiusServer {
 
 	radiusServer := RadiusServer{
-		ci:      ci,
-		handler: handler,
-		context: ctx,
+		ci:        ci,
+		handler:   handler,
+		context:   ctx,
+		coalescer: newRequestCoalescer(),
 	}
 
-	socket, err := net.ListenPacket("udp", fmt.Sprintf("%s:%d", bindIPAddress, bindPort))
-	if err != nil {
-		panic(fmt.Sprintf("could not create listen socket in %s:%d : %s", bindIPAddress, bindPort, err))
+	serverConf := ci.RadiusServerConf()
+	if dd := serverConf.DuplicateDetection; dd.ExpirationMillis > 0 {
+		radiusServer.duplicates = core.NewDuplicateCache(time.Duration(dd.ExpirationMillis)*time.Millisecond, dd.MaxEntries)
+	}
+
+	switch bindPort {
+	case serverConf.AuthPort:
+		radiusServer.listener = "auth"
+	case serverConf.AcctPort:
+		radiusServer.listener = "acct"
+	case serverConf.CoAPort:
+		radiusServer.listener = "coa"
+	}
+
+	// Use the socket passed by systemd, if any
+	socket, found := systemd.UDPConn(bindPort)
+	if !found {
+		var err error
+		if socket, err = net.ListenPacket("udp", fmt.Sprintf("%s:%d", bindIPAddress, bindPort)); err != nil {
+			panic(fmt.Sprintf("could not create listen socket in %s:%d : %s", bindIPAddress, bindPort, err))
+		}
 	}
 
 	// Start receiving packets
@@ -65,7 +150,7 @@ func (rs *RadiusServer) eventLoop(socket net.PacketConn) {
 			// Check here if the error is due to the socket being closed
 			if rs.context.Err() != nil {
 				// The context was cancelled
-				config.GetLogger().Infof("finished radius server socket %s", socket.LocalAddr().String())
+				logger().Infof("finished radius server socket %s", socket.LocalAddr().String())
 				return
 			} else {
 				// Some other error
@@ -76,49 +161,316 @@ func (rs *RadiusServer) eventLoop(socket net.PacketConn) {
 		// Verify client and get secret
 		clientIPAddr := clientAddr.(*net.UDPAddr).IP.String()
 		radiusClient, found := rs.ci.RadiusClientsConf()[clientIPAddr]
+		policy := rs.ci.RadiusServerConf().InvalidPacketPolicies[rs.listener]
 
+		secret := radiusClient.Secret
 		if !found {
-			config.GetLogger().Debugf("message from unknown client %s", clientIPAddr)
-			continue
+			secret = policy.UnknownClientSecret
 		}
 
-		// Decode the packet
-		radiusPacket, err := radiuscodec.RadiusPacketFromBytes((reqBuf[:packetSize]), radiusClient.Secret)
+		// Decode the packet, reusing one from the pool, which is released when no longer needed
+		radiusPacket, err := radiuscodec.AcquireRadiusPacketFromBytesWithDict(reqBuf[:packetSize], secret, rs.ci.RadiusDict())
 		if err != nil {
-			config.GetLogger().Errorf("error decoding packet %s", err)
+			logger().Errorf("error decoding packet from %s: %s", clientIPAddr, err)
+			instrumentation.PushRadiusServerMalformed(rs.ci.InstanceName(), clientIPAddr, string(reqBuf[0]))
+			radiusPacket.Release()
+			continue
+		}
+
+		if !found {
+			logger().Debugf("message from unknown client %s", clientIPAddr)
+			instrumentation.PushRadiusServerUnknownClient(rs.ci.InstanceName(), clientIPAddr, string(radiusPacket.Code))
+			rs.handleInvalidPacket(socket, policy, radiusPacket, secret, clientAddr)
+			continue
+		}
+
+		// The Request Authenticator is checked in the Accounting, Disconnect and CoA requests, and the Message-Authenticator in all
+		if !radiuscodec.ValidateRequest(reqBuf[:packetSize], secret) {
+			logger().Debugf("bad authenticator from client %s", clientIPAddr)
+			instrumentation.PushRadiusServerBadAuthenticator(rs.ci.InstanceName(), clientIPAddr, string(radiusPacket.Code))
+			rs.handleInvalidPacket(socket, policy, radiusPacket, secret, clientAddr)
+			continue
+		}
+
+		if !rs.acceptsCode(radiusPacket.Code) {
+			logger().Debugf("discarding packet with code %d from client %s in %s listener", radiusPacket.Code, clientIPAddr, rs.listener)
+			instrumentation.PushRadiusServerDrop(rs.ci.InstanceName(), clientIPAddr, string(radiusPacket.Code))
+			radiusPacket.Release()
+			continue
 		}
 
-		instrumentation.PushRadiusServerRequest(clientIPAddr, string(radiusPacket.Code))
-		config.GetLogger().Debugf("<- Server received RadiusPacket %s\n", radiusPacket)
+		instrumentation.PushRadiusServerRequest(rs.ci.InstanceName(), clientIPAddr, string(radiusPacket.Code))
+		logger().Debugw("<- server received packet", append(radiusPacket.LogFields(), "client", clientIPAddr, "packet", radiusPacket)...)
+		wiretrace.TraceRadius(wiretrace.DIRECTION_IN, socket.LocalAddr(), clientAddr, radiusPacket, reqBuf[:packetSize])
+
+		if radiusPacket.Code == radiuscodec.STATUS_SERVER {
+			rs.answerStatusServer(socket, radiusPacket, secret, clientAddr)
+			continue
+		}
+
+		rs.checkClockSkew(clientIPAddr, radiusPacket, time.Now())
 
 		// Wait for response
 		go func(radiusPacket *radiuscodec.RadiusPacket, secret string, addr net.Addr) {
 
 			code := radiusPacket.Code
 
-			response, err := rs.handler(radiusPacket)
+			start := time.Now()
+			ctx, span := telemetry.StartServerSpan(telemetry.ExtractRadius(context.Background(), radiusPacket, rs.ci.RadiusServerConf().TraceContextAttribute), "radius request", telemetry.RadiusAttributes(radiusPacket)...)
+			response, isDuplicate, err := rs.handleOnce(ctx, radiusPacket, addr)
+			telemetry.EndSpan(span, err)
 
-			if err != nil {
-				config.GetLogger().Errorf("discarding packet for %s with code %d: %s", addr.String(), radiusPacket.Code, err)
-				instrumentation.PushRadiusServerDrop(clientIPAddr, string(radiusPacket.Code))
-				return
+			// If there was an error, the handler may still be running after the bulkhead timeout, so the
+			// packet is not returned to the pool. The duplicates are not passed to the handler
+			if err == nil || isDuplicate {
+				defer radiusPacket.Release()
+			}
+			if isDuplicate {
+				logger().Debugf("duplicate packet from %s with identifier %d", addr.String(), radiusPacket.Identifier)
+				instrumentation.PushRadiusServerDuplicate(rs.ci.InstanceName(), clientIPAddr, string(code))
 			}
 
-			respBuf, err := response.ToBytes(secret, radiusPacket.Identifier)
 			if err != nil {
-				config.GetLogger().Errorf("error serializing packet for %s with code %d: %s", addr.String(), code, err)
-				instrumentation.PushRadiusServerDrop(clientIPAddr, string(code))
+				logger().Errorw(fmt.Sprintf("discarding packet: %s", err), append(radiusPacket.LogFields(), "client", addr.String(), "errorClass", core.ErrorClass(err))...)
+				if errors.Is(err, core.ErrBulkheadFull) && !isDuplicate {
+					instrumentation.PushRadiusServerBulkheadRejected(rs.ci.InstanceName(), clientIPAddr, string(radiusPacket.Code))
+				}
+				instrumentation.PushRadiusServerDrop(rs.ci.InstanceName(), clientIPAddr, string(radiusPacket.Code))
 				return
 			}
-			if _, err = socket.WriteTo(respBuf, addr); err != nil {
-				config.GetLogger().Errorf("error sending packet to %s with code %d: %s", addr.String(), code, err)
-				instrumentation.PushRadiusServerDrop(clientIPAddr, string(code))
+
+			if _, err = response.ToPacketConn(socket, addr, secret, radiusPacket.Identifier); err != nil {
+				logger().Errorf("error sending packet to %s with code %d: %s", addr.String(), code, err)
+				instrumentation.PushRadiusServerDrop(rs.ci.InstanceName(), clientIPAddr, string(code))
 				return
 			}
 
-			instrumentation.PushRadiusServerResponse(clientIPAddr, string(code))
-			config.GetLogger().Debugf("-> Server sent RadiusPacket %s\n", response)
+			instrumentation.PushRadiusServerResponse(rs.ci.InstanceName(), clientIPAddr, string(code))
+			instrumentation.PushRadiusServerRequestDuration(ctx, rs.ci.InstanceName(), clientIPAddr, string(code), time.Since(start))
+			logger().Debugw("-> server sent packet", append(response.LogFields(), "client", addr.String(), "packet", response)...)
+			if wiretrace.IsActive() {
+				// Serialized again, since the response is written to the socket from a pooled buffer
+				if responseBytes, err := response.ToBytes(secret, radiusPacket.Identifier); err == nil {
+					wiretrace.TraceRadius(wiretrace.DIRECTION_OUT, socket.LocalAddr(), addr, response, responseBytes)
+				}
+			}
 
 		}(radiusPacket, radiusClient.Secret, clientAddr)
 	}
 }
+
+// The Disconnect-Request and CoA-Request are accepted only in the CoA port (RFC 5176), which does not accept
+// other requests. If the port is not one of the configured ones, all codes are accepted
+func (rs *RadiusServer) acceptsCode(code byte) bool {
+	isDynAuth := code == radiuscodec.DISCONNECT_REQUEST || code == radiuscodec.COA_REQUEST
+	switch rs.listener {
+	case "coa":
+		return isDynAuth
+	case "auth", "acct":
+		return !isDynAuth
+	default:
+		return true
+	}
+}
+
+// Answers the Status-Server (RFC 5997) without invoking the handler, with an Access-Accept or, in the accounting
+// listener, an Accounting-Response, including the attributes in the configuration. The requests without
+// Message-Authenticator are discarded. The request is released
+func (rs *RadiusServer) answerStatusServer(socket net.PacketConn, request *radiuscodec.RadiusPacket, secret string, addr net.Addr) {
+	defer request.Release()
+
+	clientIPAddr := addr.(*net.UDPAddr).IP.String()
+	if _, err := request.GetAVP("Message-Authenticator"); err != nil {
+		logger().Debugf("discarding Status-Server without Message-Authenticator from client %s", clientIPAddr)
+		instrumentation.PushRadiusServerDrop(rs.ci.InstanceName(), clientIPAddr, string(request.Code))
+		return
+	}
+
+	response := radiuscodec.NewRadiusResponse(request, true)
+	if rs.listener == "acct" {
+		response.Code = radiuscodec.ACCOUNTING_RESPONSE
+	}
+	for name, value := range rs.ci.RadiusServerConf().StatusServerAttributes {
+		response.Add(name, value)
+	}
+	response.Add("Message-Authenticator", make([]byte, 16))
+
+	if _, err := response.ToPacketConn(socket, addr, secret, request.Identifier); err != nil {
+		logger().Errorf("error sending packet to %s with code %d: %s", addr.String(), response.Code, err)
+		instrumentation.PushRadiusServerDrop(rs.ci.InstanceName(), clientIPAddr, string(request.Code))
+		return
+	}
+	instrumentation.PushRadiusServerResponse(rs.ci.InstanceName(), clientIPAddr, string(request.Code))
+	logger().Debugw("-> server sent packet", append(response.LogFields(), "client", addr.String(), "packet", response)...)
+	if wiretrace.IsActive() {
+		if responseBytes, err := response.ToBytes(secret, request.Identifier); err == nil {
+			wiretrace.TraceRadius(wiretrace.DIRECTION_OUT, socket.LocalAddr(), addr, response, responseBytes)
+		}
+	}
+}
+
+// Invokes the handler, unless the request is a retransmission of another one from the same address, with the
+// same Identifier and Authenticator, in which case the response to that one is returned. The boolean is true
+// if the request is a duplicate
+func (rs *RadiusServer) handleOnce(ctx context.Context, request *radiuscodec.RadiusPacket, addr net.Addr) (*radiuscodec.RadiusPacket, bool, error) {
+	if rs.duplicates == nil {
+		response, err := rs.handle(ctx, request, addr)
+		return response, false, err
+	}
+
+	key := fmt.Sprintf("%s/%d/%x", addr.String(), request.Identifier, request.Authenticator)
+	response, isDuplicate, err := rs.duplicates.Execute(key, true, func() (interface{}, error) {
+		return rs.handle(ctx, request, addr)
+	})
+	if err != nil {
+		return nil, isDuplicate, err
+	}
+	return response.(*radiuscodec.RadiusPacket), isDuplicate, nil
+}
+
+// Invokes the handler, coalescing the concurrent Access-Requests from the same client with the same
+// fingerprint if so specified in the configuration. The context passed to the handler is cancelled when this
+// function returns, which may be before the handler finishes if the bulkhead times out
+func (rs *RadiusServer) handle(ctx context.Context, request *radiuscodec.RadiusPacket, addr net.Addr) (response *radiuscodec.RadiusPacket, err error) {
+	serverConf := rs.ci.RadiusServerConf()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	trace := config.NewTraceBuffer(serverConf.Trace, "radius request with code %d and identifier %d", request.Code, request.Identifier)
+	defer func() { trace.Finish(err) }()
+
+	trace.Tracef("request %s", request)
+
+	// If the pipeline is full, the request is not answered, so that the NAS retries later
+	if pipeline, ok := rs.cdrPipeline.Load().(*cdr.Pipeline); ok && pipeline != nil && request.Code == radiuscodec.ACCOUNTING_REQUEST {
+		if err := pipeline.Submit(request); err != nil {
+			return nil, err
+		}
+		trace.Tracef("submitted to CDR pipeline")
+	}
+
+	producer, _ := rs.kafkaProducer.Load().(*kafkaproducer.Producer)
+	if producer != nil && request.Code == radiuscodec.ACCOUNTING_REQUEST {
+		producer.PublishAccounting(request)
+	}
+
+	bulkheadConf := rs.ci.BulkheadsConf()[BULKHEAD_NAME]
+	bulkhead := rs.bulkheads.Get(BULKHEAD_NAME, bulkheadConf.MaxConcurrency, bulkheadConf.QueueLength, time.Duration(bulkheadConf.TimeoutMillis)*time.Millisecond)
+
+	// The result is passed through the channel, since the handler may finish after the bulkhead timeout
+	responseChan := make(chan *radiuscodec.RadiusPacket, 1)
+	err = bulkhead.Execute(time.Time{}, func() error {
+		if request.Code != radiuscodec.ACCESS_REQUEST || len(serverConf.CoalescingAttributes) == 0 {
+			r, e := rs.handler(ctx, request)
+			responseChan <- r
+			return e
+		}
+		r, shared, e := rs.coalescer.handle(ctx, getFingerprint(request, addr.(*net.UDPAddr).IP.String(), serverConf.CoalescingAttributes), request, rs.handler)
+		if shared {
+			trace.Tracef("answer shared with a coalesced request")
+			logger().Debugf("coalesced request with identifier %d", request.Identifier)
+		}
+		responseChan <- r
+		return e
+	})
+	if err != nil {
+		if producer != nil && !errors.Is(err, core.ErrBulkheadFull) {
+			producer.PublishRadiusHandlerError(request, err)
+		}
+		return nil, err
+	}
+	response = <-responseChan
+
+	trace.Tracef("response %s", response)
+	if notifier, ok := rs.authNotifier.Load().(*authevents.Notifier); ok && notifier != nil {
+		notifier.Process(request, response)
+	}
+	if analyzer, ok := rs.attributeStats.Load().(*attrstats.Analyzer); ok && analyzer != nil {
+		analyzer.SampleRadius(request, response)
+	}
+	return response, nil
+}
+
+// Measures the skew of the clock of the client using the Event-Timestamp, if present, and stores it
+// in the packet. If the skew is above the tolerance and so configured, the Time attributes are corrected
+func (rs *RadiusServer) checkClockSkew(clientIPAddr string, request *radiuscodec.RadiusPacket, received time.Time) {
+	eventTimestamp, err := request.GetAVP("Event-Timestamp")
+	if err != nil {
+		return
+	}
+
+	delay := time.Duration(request.GetIntAVP("Acct-Delay-Time")) * time.Second
+	request.ClockSkew = core.ClockSkew(eventTimestamp.GetDate(), received, delay)
+	instrumentation.PushRadiusClientClockSkew(rs.ci.InstanceName(), clientIPAddr, request.ClockSkew)
+
+	skewConf := rs.ci.RadiusServerConf().ClockSkew
+	if correction := core.ClockSkewCorrection(request.ClockSkew, skewConf.ToleranceMillis, skewConf.Correct); correction != 0 {
+		logger().Debugf("correcting clock skew of %s for client %s", request.ClockSkew, clientIPAddr)
+		request.ShiftTimeAVPs(correction)
+	}
+}
+
+// Sets the pipeline for the accounting requests, which are submitted before invoking the handler
+func (rs *RadiusServer) SetCDRPipeline(pipeline *cdr.Pipeline) {
+	rs.cdrPipeline.Store(pipeline)
+}
+
+// Sets the notifier of the authentication events, which receives the Access-Requests and their responses
+func (rs *RadiusServer) SetAuthNotifier(notifier *authevents.Notifier) {
+	rs.authNotifier.Store(notifier)
+}
+
+// Sets the analyzer of the attribute values of the requests and their responses
+func (rs *RadiusServer) SetAttributeStats(analyzer *attrstats.Analyzer) {
+	rs.attributeStats.Store(analyzer)
+}
+
+// Sets the producer that publishes the accounting requests and the handler errors to Kafka
+func (rs *RadiusServer) SetKafkaProducer(producer *kafkaproducer.Producer) {
+	rs.kafkaProducer.Store(producer)
+}
+
+// Sets the handler for the invalid packets, for listeners with the "honeypot" policy
+func (rs *RadiusServer) SetHoneypotHandler(handler RadiusPacketHandler) {
+	rs.honeypotHandler.Store(handler)
+}
+
+// Treats a packet from an unknown client or with a bad authenticator as specified in the policy
+// The request is released when no longer needed
+func (rs *RadiusServer) handleInvalidPacket(socket net.PacketConn, policy config.InvalidPacketPolicy, request *radiuscodec.RadiusPacket, secret string, addr net.Addr) {
+
+	var handler RadiusPacketHandler
+	switch policy.Action {
+	case "reject":
+		if request.Code != radiuscodec.ACCESS_REQUEST {
+			request.Release()
+			return
+		}
+		handler = func(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+			return radiuscodec.NewRadiusResponse(request, false), nil
+		}
+	case "honeypot":
+		if h, ok := rs.honeypotHandler.Load().(RadiusPacketHandler); ok {
+			handler = h
+		} else {
+			request.Release()
+			return
+		}
+	default:
+		request.Release()
+		return
+	}
+
+	go func() {
+		defer request.Release()
+
+		response, err := handler(request)
+		if err != nil || response == nil {
+			return
+		}
+		if _, err = response.ToPacketConn(socket, addr, secret, request.Identifier); err != nil {
+			logger().Errorf("error sending packet to %s with code %d: %s", addr.String(), response.Code, err)
+		}
+	}()
+}
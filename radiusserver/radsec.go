@@ -0,0 +1,40 @@
+package radiusserver
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"igor/config"
+	"igor/radiuscodec"
+)
+
+// Identification of RadSec (RFC 6614) clients. Connections are mutually authenticated with TLS, and the
+// client is identified by the attributes of its certificate, as specified in radSecClients.json, instead
+// of by its source IP address
+
+// Secret to use in RadSec connections
+const RADSEC_SECRET = "radsec"
+
+// Returned when the client did not present a certificate
+var ErrNoClientCertificate = errors.New("no client certificate")
+
+// Returns the profile of the client of a RadSec connection, based on the leaf certificate presented
+func IdentifyRadSecClient(ci *config.PolicyConfigurationManager, state tls.ConnectionState) (config.RadSecClient, error) {
+	if len(state.PeerCertificates) == 0 {
+		return config.RadSecClient{}, ErrNoClientCertificate
+	}
+	cert := state.PeerCertificates[0]
+	if client, found := ci.RadSecClientsConf().FindRadSecClient(cert); found {
+		return client, nil
+	}
+	return config.RadSecClient{}, fmt.Errorf("no RadSec client for certificate with subject %s", cert.Subject)
+}
+
+// Adds to the request the default attributes of the client that are not already present
+func ApplyRadSecClientDefaults(client config.RadSecClient, request *radiuscodec.RadiusPacket) {
+	for name, value := range client.AttributeDefaults {
+		if _, err := request.GetAVP(name); err != nil {
+			request.Add(name, value)
+		}
+	}
+}
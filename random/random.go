@@ -0,0 +1,131 @@
+package random
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"math/rand"
+	"sync"
+)
+
+// Provider of the random values used by igor (Radius authenticators and salts,
+// Diameter identifiers, load balancing and jitter).
+// The default Source uses crypto/rand. Tests may replace it by a seeded one
+// using SetSource, so that the generated values are reproducible
+type Source interface {
+	// Fills the slice with random bytes
+	Read(b []byte) (int, error)
+
+	// Returns a random 32 bit value
+	Uint32() uint32
+
+	// Returns a random number in [0, n)
+	Intn(n int) int
+}
+
+// The Source in use
+var currentSource Source = NewCryptoSource()
+var sourceMutex sync.RWMutex
+
+// Replaces the Source used by the functions in this package
+func SetSource(source Source) {
+	sourceMutex.Lock()
+	defer sourceMutex.Unlock()
+	currentSource = source
+}
+
+// Returns the Source in use
+func GetSource() Source {
+	sourceMutex.RLock()
+	defer sourceMutex.RUnlock()
+	return currentSource
+}
+
+// Fills the slice with random bytes from the current Source
+func Read(b []byte) {
+	if _, err := GetSource().Read(b); err != nil {
+		panic("could not read random bytes: " + err.Error())
+	}
+}
+
+// Returns a random 32 bit value from the current Source
+func Uint32() uint32 {
+	return GetSource().Uint32()
+}
+
+// Returns a random number in [0, n) from the current Source
+func Intn(n int) int {
+	return GetSource().Intn(n)
+}
+
+// Randomizes the order of n elements using the current Source. swap exchanges the elements
+// with indexes i and j
+func Shuffle(n int, swap func(i, j int)) {
+	source := GetSource()
+	for i := n - 1; i > 0; i-- {
+		swap(i, source.Intn(i+1))
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// Source based on crypto/rand. Safe for concurrent use
+type CryptoSource struct{}
+
+func NewCryptoSource() CryptoSource {
+	return CryptoSource{}
+}
+
+func (s CryptoSource) Read(b []byte) (int, error) {
+	return crand.Read(b)
+}
+
+func (s CryptoSource) Uint32() uint32 {
+	var b [4]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		panic("could not read random bytes: " + err.Error())
+	}
+	return binary.BigEndian.Uint32(b[:])
+}
+
+func (s CryptoSource) Intn(n int) int {
+	if n <= 0 {
+		panic("invalid argument to Intn")
+	}
+	// Discard the values that would bias the result
+	max := ^uint32(0) - ^uint32(0)%uint32(n)
+	for {
+		if v := s.Uint32(); v < max {
+			return int(v % uint32(n))
+		}
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// Deterministic Source based on math/rand, to be used in tests. Safe for concurrent use
+type SeededSource struct {
+	mutex sync.Mutex
+	rnd   *rand.Rand
+}
+
+func NewSeededSource(seed int64) *SeededSource {
+	return &SeededSource{rnd: rand.New(rand.NewSource(seed))}
+}
+
+func (s *SeededSource) Read(b []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.rnd.Read(b)
+}
+
+func (s *SeededSource) Uint32() uint32 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.rnd.Uint32()
+}
+
+func (s *SeededSource) Intn(n int) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.rnd.Intn(n)
+}
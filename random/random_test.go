@@ -0,0 +1,44 @@
+package random
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSeededSource(t *testing.T) {
+
+	defer SetSource(NewCryptoSource())
+
+	generate := func() ([]byte, uint32, []int) {
+		SetSource(NewSeededSource(1))
+		b := make([]byte, 16)
+		Read(b)
+		items := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+		Shuffle(len(items), func(i, j int) { items[i], items[j] = items[j], items[i] })
+		return b, Uint32(), items
+	}
+
+	b1, u1, s1 := generate()
+	b2, u2, s2 := generate()
+	if !reflect.DeepEqual(b1, b2) || u1 != u2 || !reflect.DeepEqual(s1, s2) {
+		t.Errorf("seeded source is not deterministic")
+	}
+}
+
+func TestCryptoSource(t *testing.T) {
+
+	source := NewCryptoSource()
+	for i := 0; i < 1000; i++ {
+		if v := source.Intn(7); v < 0 || v >= 7 {
+			t.Fatalf("value out of range %d", v)
+		}
+	}
+
+	b1 := make([]byte, 16)
+	b2 := make([]byte, 16)
+	source.Read(b1)
+	source.Read(b2)
+	if reflect.DeepEqual(b1, b2) {
+		t.Errorf("same random bytes generated twice")
+	}
+}
@@ -0,0 +1,21 @@
+// Script for the tests of the scripthandler package
+
+function handleRequest(request, answer) {
+	var userName = igor.get(request, "User-Name");
+	if (userName === "error") {
+		throw new Error("user not allowed");
+	}
+
+	if (request.CommandName !== undefined) {
+		// Diameter
+		igor.add(answer, "Result-Code", 2001);
+		igor.add(answer, "Class", "diameter:" + userName);
+	} else {
+		// Radius
+		if (userName === "reject") {
+			answer.Code = 3;
+		}
+		igor.add(answer, "Class", "radius:" + userName);
+	}
+	return answer;
+}
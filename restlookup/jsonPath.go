@@ -0,0 +1,176 @@
+package restlookup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Helpers to extract values from the JSON documents returned by the lookups, using a subset of JSONPath:
+// the root "$", children by name ".name" or "['name']", array elements by index "[0]", counting from the
+// end if negative, and wildcards ".*" or "[*]" for all the children or elements.
+//
+//	$.subscriber.plans[0].name
+//	$['subscriber']['ip-address']
+//	$.services[*].id
+
+// Returned, wrapped, when the path does not match any value
+var ErrNoMatch = errors.New("no value matches the path")
+
+// Step of a parsed path. Either a name, an index or a wildcard
+type pathStep struct {
+	name     string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// Returns the values in the document that match the path, which may be none
+func Extract(document interface{}, path string) ([]interface{}, error) {
+	steps, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	current := []interface{}{document}
+	for _, step := range steps {
+		next := make([]interface{}, 0)
+		for _, value := range current {
+			next = append(next, step.apply(value)...)
+		}
+		current = next
+	}
+	return current, nil
+}
+
+// Returns the first value that matches the path, as a string. Objects and arrays are returned as JSON
+func ExtractString(document interface{}, path string) (string, error) {
+	values, err := Extract(document, path)
+	if err != nil {
+		return "", err
+	}
+	if len(values) == 0 {
+		return "", fmt.Errorf("%s: %w", path, ErrNoMatch)
+	}
+	return toString(values[0])
+}
+
+// Returns the first value that matches each one of the paths, as strings, with the same key. The
+// paths that do not match are not included. Used to extract all the values needed by a handler at once,
+// such as {"Class": "$.plan", "Framed-IP-Address": "$.ip"}
+func ExtractStrings(document interface{}, paths map[string]string) (map[string]string, error) {
+	values := make(map[string]string, len(paths))
+	for key, path := range paths {
+		value, err := ExtractString(document, path)
+		if errors.Is(err, ErrNoMatch) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// Returns the children of the value selected by the step
+func (s pathStep) apply(value interface{}) []interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if s.wildcard {
+			result := make([]interface{}, 0, len(v))
+			for _, child := range v {
+				result = append(result, child)
+			}
+			return result
+		}
+		if child, found := v[s.name]; found && !s.isIndex {
+			return []interface{}{child}
+		}
+	case []interface{}:
+		if s.wildcard {
+			return v
+		}
+		if s.isIndex {
+			index := s.index
+			if index < 0 {
+				index += len(v)
+			}
+			if index >= 0 && index < len(v) {
+				return []interface{}{v[index]}
+			}
+		}
+	}
+	return nil
+}
+
+// Parses the path into its steps
+func parsePath(path string) ([]pathStep, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("path %q does not start with $", path)
+	}
+
+	steps := make([]pathStep, 0)
+	rest := path[1:]
+	for len(rest) > 0 {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			name := rest[1 : end+1]
+			if name == "" {
+				return nil, fmt.Errorf("empty name in path %q", path)
+			}
+			steps = append(steps, pathStep{name: name, wildcard: name == "*"})
+			rest = rest[end+1:]
+
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed bracket in path %q", path)
+			}
+			selector := rest[1:end]
+			switch {
+			case selector == "*":
+				steps = append(steps, pathStep{wildcard: true})
+			case len(selector) >= 2 && (selector[0] == '\'' || selector[0] == '"') && selector[len(selector)-1] == selector[0]:
+				steps = append(steps, pathStep{name: selector[1 : len(selector)-1]})
+			default:
+				index, err := strconv.Atoi(selector)
+				if err != nil {
+					return nil, fmt.Errorf("bad selector %q in path %q", selector, path)
+				}
+				steps = append(steps, pathStep{index: index, isIndex: true})
+			}
+			rest = rest[end+1:]
+
+		default:
+			return nil, fmt.Errorf("unexpected character %q in path %q", rest[0], path)
+		}
+	}
+	return steps, nil
+}
+
+// Formats the value as a string
+func toString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	default:
+		serialized, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(serialized), nil
+	}
+}
@@ -0,0 +1,342 @@
+package restlookup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"igor/config"
+	"igor/core"
+	"igor/httphandler"
+	"igor/instrumentation"
+	"igor/random"
+	"igor/telemetry"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Client for the handlers that enrich the requests with data from external REST APIs, as specified in
+// the restLookup.json configuration object. The idempotent requests are retried, with a random pause,
+// and the endpoints (scheme and host) that fail repeatedly are not sent requests for some time, so that
+// the handlers do not wait for timeouts. The responses are JSON documents, from which values may be
+// extracted with the JSONPath helpers.
+//
+// The errors are of type *httphandler.HttpHandlerError, and the exchanges are reported in the
+// HttpClientExchanges metric, by endpoint and error code
+
+// Defaults for the values not specified in the configuration
+const (
+	DEFAULT_TIMEOUT_MILLIS            = 2000
+	DEFAULT_RETRY_MIN_MILLIS          = 50
+	DEFAULT_RETRY_MAX_MILLIS          = 1000
+	DEFAULT_BREAKER_FAILURE_THRESHOLD = 5
+	DEFAULT_BREAKER_OPEN_SECONDS      = 30
+)
+
+// Returned, wrapped, when the circuit breaker of the endpoint is open
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// Returned, wrapped, when the API answers with a 404 status code
+var ErrNotFound = errors.New("resource not found")
+
+// Tracks the consecutive failures of an endpoint
+type circuitBreaker struct {
+	mutex           sync.Mutex
+	failures        int
+	openUntil       time.Time
+	trialInProgress bool
+}
+
+// Returns true if a request may be sent. When the open time has elapsed, a single trial request
+// is allowed, whose result closes the breaker or opens it again
+func (b *circuitBreaker) allow(now time.Time, threshold int) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.failures < threshold {
+		return true
+	}
+	if now.Before(b.openUntil) || b.trialInProgress {
+		return false
+	}
+	b.trialInProgress = true
+	return true
+}
+
+// Records the result of a request
+func (b *circuitBreaker) record(success bool, threshold int, openDuration time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.trialInProgress = false
+	if success {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= threshold {
+		b.openUntil = time.Now().Add(openDuration)
+	}
+}
+
+// Entry in the cache of responses
+type cacheEntry struct {
+	document   interface{}
+	expiration time.Time
+}
+
+type RestLookup struct {
+	conf   config.RestLookupConfig
+	client http.Client
+
+	// Configuration instance, to label the metrics
+	instanceName string
+
+	timeout      time.Duration
+	retryMin     time.Duration
+	retryMax     time.Duration
+	threshold    int
+	openDuration time.Duration
+	cacheTTL     time.Duration
+
+	breakersMutex sync.Mutex
+	breakers      map[string]*circuitBreaker
+
+	cacheMutex      sync.Mutex
+	cache           map[string]cacheEntry
+	lastCachePurged time.Time
+}
+
+// Creates the client with the specified configuration, typically the RestLookupConf() of the
+// policy configuration instance with the specified name
+func NewRestLookup(instanceName string, conf config.RestLookupConfig) *RestLookup {
+	l := RestLookup{
+		conf:         conf,
+		instanceName: instanceName,
+		timeout:      time.Duration(firstPositive(conf.TimeoutMillis, DEFAULT_TIMEOUT_MILLIS)) * time.Millisecond,
+		retryMin:     time.Duration(firstPositive(conf.RetryMinMillis, DEFAULT_RETRY_MIN_MILLIS)) * time.Millisecond,
+		retryMax:     time.Duration(firstPositive(conf.RetryMaxMillis, DEFAULT_RETRY_MAX_MILLIS)) * time.Millisecond,
+		threshold:    firstPositive(conf.BreakerFailureThreshold, DEFAULT_BREAKER_FAILURE_THRESHOLD),
+		openDuration: time.Duration(firstPositive(conf.BreakerOpenSeconds, DEFAULT_BREAKER_OPEN_SECONDS)) * time.Second,
+		cacheTTL:     time.Duration(conf.CacheTTLSeconds) * time.Second,
+		breakers:     make(map[string]*circuitBreaker),
+		cache:        make(map[string]cacheEntry),
+	}
+	if l.retryMax < l.retryMin {
+		l.retryMax = l.retryMin
+	}
+	return &l
+}
+
+// Retrieves the JSON document at the URL, from the cache if there. The document returned may be shared
+// with other callers, and must not be modified
+func (l *RestLookup) Get(ctx context.Context, url string) (interface{}, error) {
+	if document, found := l.getCached(url, time.Now()); found {
+		return document, nil
+	}
+
+	document, err := l.send(ctx, http.MethodGet, url, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	l.setCached(url, document)
+	return document, nil
+}
+
+// Sends the body, serialized as JSON, and returns the JSON document in the response. The request is
+// retried only if idempotent
+func (l *RestLookup) Post(ctx context.Context, url string, body interface{}, idempotent bool) (interface{}, error) {
+	endpoint := endpointOf(url)
+	serializedBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, httphandler.NewHttpHandlerError(l.instanceName, endpoint, httphandler.SERIALIZATION_ERROR, false, fmt.Errorf("unable to marshal body %s", err))
+	}
+	return l.send(ctx, http.MethodPost, url, serializedBody, idempotent)
+}
+
+// Removes the response from the cache, so that the next Get sends the request
+func (l *RestLookup) Invalidate(url string) {
+	l.cacheMutex.Lock()
+	defer l.cacheMutex.Unlock()
+	delete(l.cache, url)
+}
+
+// Sends the request, retrying the transient failures of idempotent requests while the circuit breaker
+// of the endpoint allows it and there is time left in the context
+func (l *RestLookup) send(ctx context.Context, method string, url string, body []byte, idempotent bool) (interface{}, error) {
+	endpoint := endpointOf(url)
+	breaker := l.getBreaker(endpoint)
+
+	for attempt := 0; ; attempt++ {
+		if !breaker.allow(time.Now(), l.threshold) {
+			return nil, httphandler.NewHttpHandlerError(l.instanceName, endpoint, httphandler.CIRCUIT_OPEN_ERROR, false, ErrCircuitOpen)
+		}
+
+		document, err := l.sendOnce(ctx, method, url, endpoint, body)
+
+		// Only the failures of the endpoint, and not those due to the request, count for the breaker
+		var handlerErr *httphandler.HttpHandlerError
+		failed := errors.As(err, &handlerErr) && (handlerErr.Transient || handlerErr.ErrorCode == httphandler.UNSERIALIZATION_ERROR)
+		breaker.record(!failed, l.threshold, l.openDuration)
+
+		if err == nil {
+			return document, nil
+		}
+		if !idempotent || !failed || !handlerErr.Transient || attempt >= l.conf.MaxRetries {
+			return nil, err
+		}
+
+		// Retry only if there is time left
+		pause := l.retryPause(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= pause {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(pause):
+		}
+	}
+}
+
+// Sends a single request and unmarshals the response
+func (l *RestLookup) sendOnce(ctx context.Context, method string, url string, endpoint string, body []byte) (document interface{}, err error) {
+	ctx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+
+	ctx, span := telemetry.StartClientSpan(ctx, "rest lookup "+method, attribute.String("http.url", endpoint))
+	defer func() { telemetry.EndSpan(span, err) }()
+
+	httpReq, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, httphandler.NewHttpHandlerError(l.instanceName, endpoint, httphandler.SERIALIZATION_ERROR, false, fmt.Errorf("unable to create request %s", err))
+	}
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	httpReq.Header.Set("Accept", "application/json")
+	for name, value := range l.conf.Headers {
+		httpReq.Header.Set(name, value)
+	}
+	core.SetContextHeaders(ctx, httpReq.Header)
+	telemetry.InjectHTTP(ctx, httpReq.Header)
+
+	httpResp, err := l.client.Do(httpReq)
+	if err != nil {
+		return nil, httphandler.NewHttpHandlerError(l.instanceName, endpoint, httphandler.NETWORK_ERROR, true, err)
+	}
+	defer httpResp.Body.Close()
+
+	switch httpResp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, httphandler.NewHttpHandlerError(l.instanceName, endpoint, httphandler.HTTP_RESPONSE_ERROR, false, fmt.Errorf("%s: %w", url, ErrNotFound))
+	default:
+		transient := httpResp.StatusCode == http.StatusTooManyRequests || httpResp.StatusCode == http.StatusBadGateway ||
+			httpResp.StatusCode == http.StatusServiceUnavailable || httpResp.StatusCode == http.StatusGatewayTimeout
+		return nil, httphandler.NewHttpHandlerError(l.instanceName, endpoint, httphandler.HTTP_RESPONSE_ERROR, transient, fmt.Errorf("returned status code %d", httpResp.StatusCode))
+	}
+
+	serializedResponse, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, httphandler.NewHttpHandlerError(l.instanceName, endpoint, httphandler.NETWORK_ERROR, true, fmt.Errorf("error reading response %s", err))
+	}
+
+	// Numbers are kept as json.Number, so that they are not formatted as floats when extracted
+	decoder := json.NewDecoder(bytes.NewReader(serializedResponse))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return nil, httphandler.NewHttpHandlerError(l.instanceName, endpoint, httphandler.UNSERIALIZATION_ERROR, false, fmt.Errorf("error unmarshaling response %s", err))
+	}
+
+	instrumentation.PushHttpClientExchange(l.instanceName, endpoint, httphandler.SUCCESS, "")
+	return document, nil
+}
+
+// Returns the pause before the retry following the specified attempt, doubled with each attempt up to
+// the maximum, and then reduced by a random amount of up to a half
+func (l *RestLookup) retryPause(attempt int) time.Duration {
+	pause := l.retryMin
+	for i := 0; i < attempt && pause < l.retryMax; i++ {
+		pause *= 2
+	}
+	if pause > l.retryMax {
+		pause = l.retryMax
+	}
+	millis := int(pause / time.Millisecond)
+	return time.Duration(millis-random.Intn(millis/2+1)) * time.Millisecond
+}
+
+// Returns the circuit breaker of the endpoint, creating it if necessary
+func (l *RestLookup) getBreaker(endpoint string) *circuitBreaker {
+	l.breakersMutex.Lock()
+	defer l.breakersMutex.Unlock()
+
+	breaker, found := l.breakers[endpoint]
+	if !found {
+		breaker = &circuitBreaker{}
+		l.breakers[endpoint] = breaker
+	}
+	return breaker
+}
+
+// Returns the document in the cache, if not expired
+func (l *RestLookup) getCached(url string, now time.Time) (interface{}, bool) {
+	l.cacheMutex.Lock()
+	defer l.cacheMutex.Unlock()
+
+	entry, found := l.cache[url]
+	if !found || now.After(entry.expiration) {
+		return nil, false
+	}
+	return entry.document, true
+}
+
+// Stores the document in the cache, if caching is enabled. The expired entries are purged from
+// time to time
+func (l *RestLookup) setCached(url string, document interface{}) {
+	if l.cacheTTL <= 0 {
+		return
+	}
+
+	l.cacheMutex.Lock()
+	defer l.cacheMutex.Unlock()
+
+	now := time.Now()
+	l.cache[url] = cacheEntry{document: document, expiration: now.Add(l.cacheTTL)}
+
+	if now.Sub(l.lastCachePurged) > l.cacheTTL {
+		for k, entry := range l.cache {
+			if now.After(entry.expiration) {
+				delete(l.cache, k)
+			}
+		}
+		l.lastCachePurged = now
+	}
+}
+
+// Returns the scheme and host of the URL, which identify the endpoint for the circuit breakers
+// and the metrics
+func endpointOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// Returns the first of the values that is greater than zero, or the last one
+func firstPositive(values ...int) int {
+	for _, v := range values {
+		if v > 0 {
+			return v
+		}
+	}
+	return values[len(values)-1]
+}
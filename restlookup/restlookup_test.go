@@ -0,0 +1,170 @@
+package restlookup
+
+import (
+	"context"
+	"errors"
+	"igor/config"
+	"igor/httphandler"
+	"igor/instrumentation"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+
+	// Initialize the Config Object
+	config.InitPolicyConfigInstance("resources/searchRules.json", "testServer", true)
+
+	// Execute the tests and exit
+	os.Exit(m.Run())
+}
+
+func TestGet(t *testing.T) {
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if req.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch req.URL.Path {
+		case "/subscribers/user":
+			w.Write([]byte(`{"plan": {"name": "gold", "speed": 100}, "services": [{"id": "tv"}, {"id": "voip"}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	l := NewRestLookup("", config.RestLookupConfig{CacheTTLSeconds: 60, Headers: map[string]string{"Authorization": "Bearer token"}})
+
+	document, err := l.Get(context.Background(), server.URL+"/subscribers/user")
+	if err != nil {
+		t.Fatalf("lookup failed: %s", err)
+	}
+	values, err := ExtractStrings(document, map[string]string{"plan": "$.plan.name", "speed": "$['plan']['speed']", "lastService": "$.services[-1].id", "missing": "$.other"})
+	if err != nil {
+		t.Fatalf("could not extract values: %s", err)
+	}
+	if values["plan"] != "gold" || values["speed"] != "100" || values["lastService"] != "voip" || len(values) != 3 {
+		t.Errorf("bad extracted values %v", values)
+	}
+
+	// Cached
+	if _, err := l.Get(context.Background(), server.URL+"/subscribers/user"); err != nil || atomic.LoadInt32(&requests) != 1 {
+		t.Errorf("response not cached %v", err)
+	}
+	l.Invalidate(server.URL + "/subscribers/user")
+	if _, err := l.Get(context.Background(), server.URL+"/subscribers/user"); err != nil || atomic.LoadInt32(&requests) != 2 {
+		t.Errorf("invalidated response still cached %v", err)
+	}
+
+	if _, err := l.Get(context.Background(), server.URL+"/subscribers/unknown"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("not found not reported %v", err)
+	}
+
+	// Wait for the metrics to be processed
+	time.Sleep(100 * time.Millisecond)
+	exchanges := instrumentation.MS.HttpClientQuery("HttpClientExchanges", map[string]string{"Endpoint": server.URL}, []string{"ErrorCode"})
+	if exchanges[instrumentation.HttpClientMetricKey{ErrorCode: httphandler.SUCCESS}] != 2 || exchanges[instrumentation.HttpClientMetricKey{ErrorCode: httphandler.HTTP_RESPONSE_ERROR}] != 1 {
+		t.Errorf("bad exchange metrics %v", exchanges)
+	}
+}
+
+func TestRetries(t *testing.T) {
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Fails every other request
+		if atomic.AddInt32(&requests, 1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"result": "ok"}`))
+	}))
+	defer server.Close()
+
+	l := NewRestLookup("", config.RestLookupConfig{MaxRetries: 2, RetryMinMillis: 10})
+
+	document, err := l.Post(context.Background(), server.URL+"/check", map[string]string{"user": "user"}, true)
+	if err != nil {
+		t.Fatalf("idempotent request not retried: %s", err)
+	}
+	if result, _ := ExtractString(document, "$.result"); result != "ok" || atomic.LoadInt32(&requests) != 2 {
+		t.Errorf("bad result %s after %d requests", result, requests)
+	}
+
+	if _, err := l.Post(context.Background(), server.URL+"/check", map[string]string{"user": "user"}, false); err == nil || atomic.LoadInt32(&requests) != 3 {
+		t.Errorf("non idempotent request retried %v", err)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+
+	var failing int32 = 1
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	l := NewRestLookup("", config.RestLookupConfig{BreakerFailureThreshold: 3})
+	l.openDuration = 100 * time.Millisecond
+
+	for i := 0; i < 3; i++ {
+		if _, err := l.Get(context.Background(), server.URL); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("bad error %v", err)
+		}
+	}
+
+	// Open. The request is not sent
+	if _, err := l.Get(context.Background(), server.URL); !errors.Is(err, ErrCircuitOpen) || atomic.LoadInt32(&requests) != 3 {
+		t.Errorf("circuit breaker not open %v", err)
+	}
+
+	// After the open time, the trial request closes the breaker
+	time.Sleep(150 * time.Millisecond)
+	atomic.StoreInt32(&failing, 0)
+	if _, err := l.Get(context.Background(), server.URL); err != nil {
+		t.Errorf("trial request failed %v", err)
+	}
+	if _, err := l.Get(context.Background(), server.URL); err != nil || atomic.LoadInt32(&requests) != 5 {
+		t.Errorf("circuit breaker not closed %v", err)
+	}
+}
+
+func TestJSONPath(t *testing.T) {
+
+	document := map[string]interface{}{
+		"a": []interface{}{map[string]interface{}{"b": "first"}, map[string]interface{}{"b": "second"}},
+		"c": map[string]interface{}{"d.e": true},
+	}
+
+	if values, err := Extract(document, "$.a[*].b"); err != nil || len(values) != 2 || values[1] != "second" {
+		t.Errorf("bad wildcard values %v %v", values, err)
+	}
+	if value, err := ExtractString(document, `$.c["d.e"]`); err != nil || value != "true" {
+		t.Errorf("bad quoted name value %v %v", value, err)
+	}
+	if value, err := ExtractString(document, "$.a[0]"); err != nil || value != `{"b":"first"}` {
+		t.Errorf("bad object value %v %v", value, err)
+	}
+	if _, err := ExtractString(document, "$.a[2].b"); !errors.Is(err, ErrNoMatch) {
+		t.Errorf("out of range index matched %v", err)
+	}
+	for _, badPath := range []string{"a.b", "$.a[", "$.a[x]", "$..a"} {
+		if _, err := Extract(document, badPath); err == nil {
+			t.Errorf("bad path %s accepted", badPath)
+		}
+	}
+}
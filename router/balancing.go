@@ -0,0 +1,196 @@
+package router
+
+import (
+	"hash/fnv"
+	"igor/config"
+	"igor/radiuscodec"
+	"igor/random"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Selection of the peers of a diameter route and of the servers of a radius group. They are returned in
+// the order in which they are to be tried, as specified by the policy of the route or group.
+//
+// For diameter routes, the policies are
+//
+//   - "fixed": in the order declared
+//   - "random": shuffled
+//   - "weighted": the first one is selected by smooth weighted round robin among the available peers,
+//     followed by the rest in the order declared
+//   - "leastOutstanding": by increasing number of requests sent and not yet answered, and in the order
+//     declared in case of ties
+//
+// All these functions are executed in the event loop of the corresponding router
+
+// Returns the peers of the route in the order in which they are to be tried
+func (router *DiameterRouter) orderPeers(route config.DiameterRoutingRule) []string {
+	var peers []string
+	peers = append(peers, route.Peers...)
+
+	switch route.Policy {
+	case "random":
+		random.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+
+	case "weighted":
+		if selected := router.selectWeighted(route); selected > 0 {
+			chosen := peers[selected]
+			copy(peers[1:selected+1], peers[:selected])
+			peers[0] = chosen
+		}
+
+	case "leastOutstanding":
+		outstanding := make(map[string]int32, len(peers))
+		for _, peer := range peers {
+			outstanding[peer] = atomic.LoadInt32(router.outstandingCounter(peer))
+		}
+		sort.SliceStable(peers, func(i, j int) bool { return outstanding[peers[i]] < outstanding[peers[j]] })
+	}
+
+	return peers
+}
+
+// Returns the index of the next peer of the route, using the smooth weighted round robin algorithm,
+// or -1 if no peer is available. The state is shared by the routes with the same list of peers
+func (router *DiameterRouter) selectWeighted(route config.DiameterRoutingRule) int {
+	key := strings.Join(route.Peers, ",")
+	current, found := router.weightedRoundRobin[key]
+	if !found {
+		current = make(map[string]int)
+		router.weightedRoundRobin[key] = current
+	}
+
+	return smoothWeightedSelect(current, route.Peers, func(peer string) int {
+		if !router.isPeerAvailable(peer) {
+			return 0
+		}
+		if weight, found := route.Weights[peer]; found {
+			return weight
+		}
+		return 1
+	})
+}
+
+// Smooth weighted round robin: each candidate with positive weight adds it to its current value, the one
+// with the highest current value is selected, and the sum of the weights is subtracted from it. Returns
+// the index of the selected candidate, or -1 if none has positive weight
+func smoothWeightedSelect(current map[string]int, candidates []string, weight func(candidate string) int) int {
+	selected := -1
+	totalWeight := 0
+	for i, candidate := range candidates {
+		w := weight(candidate)
+		if w <= 0 {
+			continue
+		}
+		current[candidate] += w
+		totalWeight += w
+		if selected < 0 || current[candidate] > current[candidates[selected]] {
+			selected = i
+		}
+	}
+
+	if selected >= 0 {
+		current[candidates[selected]] -= totalWeight
+	}
+	return selected
+}
+
+// Returns the servers of the radius group to try for the request, in order. The available servers are
+// ordered as specified by the policy of the group
+//
+//   - "fixed": in the order declared
+//   - "random": shuffled
+//   - "round-robin": rotated, starting with a different one for each request
+//   - "weighted": the first one is selected by smooth weighted round robin, followed by the rest
+//   - "hash": rotated, starting with one selected by the hash of the values of the HashAttributes, so that
+//     the requests of the same session are sent to the same server while it is available
+//
+// If the policy has the "-withclear" suffix, the servers in quarantine are appended
+func (router *RadiusRouter) selectRadiusServers(group config.RadiusServerGroup, request *radiuscodec.RadiusPacket) []config.RadiusServer {
+	serversConf := router.ci.RadiusServersConf().Servers
+	policy, withClear := group.BalancingPolicy()
+
+	var names []string
+	for _, name := range group.Servers {
+		if _, found := serversConf[name]; found {
+			names = append(names, name)
+		}
+	}
+
+	// The hash is applied to all the servers, so that the choice is stable while they are available
+	if policy == "hash" && len(names) > 0 {
+		if values := hashValues(request, group.HashAttributes); values != "" {
+			hasher := fnv.New32a()
+			hasher.Write([]byte(values))
+			names = rotate(names, int(hasher.Sum32()%uint32(len(names))))
+		}
+	}
+
+	var available, quarantined []string
+	for _, name := range names {
+		if serverStatus := router.radiusServersTable[name]; serverStatus.IsAvailable && !time.Now().Before(serverStatus.CanaryUntil) {
+			available = append(available, name)
+		} else {
+			quarantined = append(quarantined, name)
+		}
+	}
+
+	switch policy {
+	case "random":
+		random.Shuffle(len(available), func(i, j int) { available[i], available[j] = available[j], available[i] })
+
+	case "round-robin":
+		if len(available) > 0 {
+			available = rotate(available, router.roundRobinCounters[group.Name]%len(available))
+			router.roundRobinCounters[group.Name]++
+		}
+
+	case "weighted":
+		current, found := router.weightedRoundRobin[group.Name]
+		if !found {
+			current = make(map[string]int)
+			router.weightedRoundRobin[group.Name] = current
+		}
+		selected := smoothWeightedSelect(current, available, func(name string) int {
+			if weight, found := group.Weights[name]; found {
+				return weight
+			}
+			return 1
+		})
+		if selected > 0 {
+			chosen := available[selected]
+			copy(available[1:selected+1], available[:selected])
+			available[0] = chosen
+		}
+	}
+
+	if withClear {
+		available = append(available, quarantined...)
+	}
+
+	servers := make([]config.RadiusServer, 0, len(available))
+	for _, name := range available {
+		servers = append(servers, serversConf[name])
+	}
+	return servers
+}
+
+// Returns the values of the attributes present in the request, separated by zeroes
+func hashValues(request *radiuscodec.RadiusPacket, attributes []string) string {
+	var values []string
+	for _, attribute := range attributes {
+		if value := request.GetStringAVP(attribute); value != "" {
+			values = append(values, value)
+		}
+	}
+	return strings.Join(values, "\x00")
+}
+
+// Returns a new slice with the items starting in the specified position
+func rotate(items []string, start int) []string {
+	rotated := make([]string, 0, len(items))
+	rotated = append(rotated, items[start:]...)
+	return append(rotated, items[:start]...)
+}
@@ -1,20 +1,26 @@
 package router
 
 import (
-	"crypto/tls"
+	"context"
+	"errors"
 	"fmt"
+	"igor/attrstats"
 	"igor/config"
+	"igor/core"
 	"igor/diamcodec"
 	"igor/diampeer"
+	"igor/grpchandler"
 	"igor/httphandler"
 	"igor/instrumentation"
-	"math/rand"
+	"igor/kafkaproducer"
+	"igor/random"
+	"igor/systemd"
 	"net"
 	"net/http"
 	"sync/atomic"
 	"time"
 
-	"golang.org/x/net/http2"
+	"go.uber.org/zap"
 )
 
 // The Diameter Peer table is a map of this kind of elements
@@ -31,6 +37,26 @@ type DiameterPeerWithStatus struct {
 	// For reporting purposes
 	LastStatusChange time.Time
 	LastError        error
+
+	// Number of connections lost or failed since the peer was last engaged, for calculating
+	// the time to wait before reconnecting
+	ConnectionFailures int
+
+	// Active and lazy peers are not reconnected before this time
+	NextConnectionAttempt time.Time
+}
+
+// Entry of the peers table with the live data reported by the peer, if it is up
+type DiameterPeerDetail struct {
+	instrumentation.DiameterPeersTableEntry
+
+	// Nil if the peer is not up or did not answer in time
+	Statistics *diampeer.PeerStatistics `json:",omitempty"`
+}
+
+// Returns the logger of the subsystem
+func routerLogger() *zap.SugaredLogger {
+	return config.GetSubsystemLogger(config.SUBSYSTEM_ROUTER)
 }
 
 // Represents a Diameter Message to be routed, either to a handler
@@ -44,6 +70,35 @@ type RoutableDiameterRequest struct {
 
 	// Timeout
 	Timeout time.Duration
+
+	// Time at which the requester will give up waiting for the answer. Calculated
+	// when the request is created as now + Timeout
+	Deadline time.Time
+
+	// If not empty, the request is sent to this peer, bypassing the routing rules
+	// and the roaming partner overrides
+	DestinationPeer string
+
+	// For accumulating debug events. May be nil
+	Trace *config.TraceBuffer
+
+	// Peers of the route that did not answer in time. Not empty when the request is being retransmitted
+	TriedPeers []string
+
+	// True if the OC-Supported-Features was added by this router, in which case the overload reports
+	// in the answer are not passed to the requester
+	AddedOverloadSupport bool
+
+	// Carries the trace metadata, and is cancelled when the requester gives up. May be nil
+	Context context.Context
+}
+
+// Returns the context of the request, or the background context if not set
+func (rdr RoutableDiameterRequest) ctx() context.Context {
+	if rdr.Context == nil {
+		return context.Background()
+	}
+	return rdr.Context
 }
 
 // The Router handles the lifecycle of peers and routes Diameter requests
@@ -63,6 +118,9 @@ type DiameterRouter struct {
 	// Accepter of incoming connections
 	listener net.Listener
 
+	// Accepter of incoming SCTP associations, if configured
+	sctpListener net.Listener
+
 	// Holds the Peers Table.
 	// One entry for each configured peer or for peers now not configured but still not received
 	// the PeerDown event
@@ -72,6 +130,19 @@ type DiameterRouter struct {
 	// need to be established or closed
 	peerTableTicker *time.Ticker
 
+	// Timer to check if there are peers to reconnect
+	reconnectTicker *time.Ticker
+
+	// Requests waiting for a lazy peer to be engaged, by Diameter-Host
+	lazyPendingRequests map[string][]RoutableDiameterRequest
+
+	// Number of requests sent to each peer and not yet answered, by Diameter-Host.
+	// The counters are updated atomically
+	outstandingRequests map[string]*int32
+
+	// State of the weighted round robin of each list of peers, used in the event loop
+	weightedRoundRobin map[string]map[string]int
+
 	// Passed to the DiameterPeers to receive back lifecycle events
 	peerControlChannel chan interface{}
 
@@ -86,6 +157,33 @@ type DiameterRouter struct {
 
 	// HTTP2 client
 	http2Client http.Client
+
+	// Set if the credentials for the http handlers could not be loaded, in which case they are not invoked
+	http2ClientErr error
+
+	// Client for the handlers with gRPC transport
+	grpcClient *grpchandler.GrpcClient
+
+	// Applies the roaming partner overrides
+	partnerPolicer *partnerPolicer
+
+	// Limits the concurrency of each http handler
+	bulkheads core.Bulkheads
+
+	// Answers sent to the requests received from peers, to answer their retransmissions. Nil if duplicate
+	// detection is disabled
+	duplicates *core.DuplicateCache
+
+	// Overload reports received from the peers
+	overload *overloadControl
+
+	// Counts the values of the attributes in the requests received and their answers, if set.
+	// Stores an *attrstats.Analyzer
+	attributeStats atomic.Value
+
+	// Publishes the peer events, the diameter accounting requests and the handler errors, if set.
+	// Stores a *kafkaproducer.Producer
+	kafkaProducer atomic.Value
 }
 
 // Creates and runs a Router
@@ -96,85 +194,142 @@ func NewRouter(instanceName string) *DiameterRouter {
 		ci:                   config.GetPolicyConfigInstance(instanceName),
 		diameterPeersTable:   make(map[string]DiameterPeerWithStatus),
 		peerTableTicker:      time.NewTicker(60 * time.Second),
+		reconnectTicker:      time.NewTicker(PEER_RECONNECT_CHECK_MILLIS * time.Millisecond),
+		lazyPendingRequests:  make(map[string][]RoutableDiameterRequest),
+		outstandingRequests:  make(map[string]*int32),
+		weightedRoundRobin:   make(map[string]map[string]int),
 		peerControlChannel:   make(chan interface{}, PEER_CONTROL_QUEUE_SIZE),
 		diameterRequestsChan: make(chan RoutableDiameterRequest, DIAMETER_REQUESTS_QUEUE_SIZE),
 		routerControlChannel: make(chan interface{}),
 		RouterDoneChannel:    make(chan struct{}),
+		partnerPolicer:       newPartnerPolicer(),
+		overload:             newOverloadControl(),
 	}
 
-	// Configure client for handlers
-	transportCfg := &http2.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // ignore expired SSL certificates
+	if dd := router.ci.DiameterServerConf().DuplicateDetection; dd.ExpirationMillis > 0 {
+		router.duplicates = core.NewDuplicateCache(time.Duration(dd.ExpirationMillis)*time.Millisecond, dd.MaxEntries)
 	}
 
-	// Create an http client with timeout and http2 transport
-	router.http2Client = http.Client{Timeout: HTTP_TIMEOUT_SECONDS * time.Second, Transport: transportCfg}
+	// Create an http client with timeout and http2 transport, presenting the configured credentials
+	// to the handlers. If they are not valid, the requests to the http handlers fail, as with gRPC
+	if client, err := httphandler.NewHttp2Client(router.ci.DiameterServerConf().HttpHandlerClient, HTTP_TIMEOUT_SECONDS*time.Second); err != nil {
+		config.GetLogger().Errorf("could not configure the credentials for the http handlers: %s", err)
+		router.http2ClientErr = fmt.Errorf("bad http handler client configuration: %w", err)
+	} else {
+		router.http2Client = client
+	}
+	router.grpcClient = grpchandler.NewGrpcClient(router.instanceName, router.ci.DiameterServerConf().HttpHandlerClient)
 
 	go router.eventLoop()
 
 	return &router
 }
 
+// Forces the disconnection of the specified peer, that will be reconnected later if active
+func (router *DiameterRouter) DisconnectPeer(diameterHost string) error {
+	rc := make(chan error, 1)
+	router.routerControlChannel <- PeerDisconnectCommand{DiameterHost: diameterHost, RChan: rc}
+	return <-rc
+}
+
+// Returns the requests sent to each peer and not yet answered, by Diameter-Host
+func (router *DiameterRouter) OutstandingRequests() map[string][]diampeer.OutstandingRequest {
+	rc := make(chan map[string][]diampeer.OutstandingRequest, 1)
+	router.routerControlChannel <- OutstandingRequestsQuery{RChan: rc}
+	return <-rc
+}
+
+// Returns the peers table, with the live data of the peers that are up
+func (router *DiameterRouter) PeersDetail() []DiameterPeerDetail {
+	rc := make(chan []DiameterPeerDetail, 1)
+	router.routerControlChannel <- PeersDetailQuery{RChan: rc}
+	return <-rc
+}
+
+// Returns the name of the configuration instance of the router
+func (router *DiameterRouter) InstanceName() string {
+	return router.instanceName
+}
+
 // Starts the closing process. It will set in StatusClosing stauts and wait for the peers to finish
 // before sending the Done message to the RouterDoneChannel
 func (router *DiameterRouter) Close() {
 	router.routerControlChannel <- RouterCloseCommand{}
 }
 
+// Accepts connections and creates passive peers for them, until the listener is closed
+// To be executed in a goroutine
+func (router *DiameterRouter) acceptLoop(listener net.Listener) {
+
+	logger := routerLogger()
+
+	logger.Infof("diameter server accepting connections in %s", listener.Addr())
+	for {
+		connection, err := listener.Accept()
+		if err != nil {
+			// Use atomic to avoid races
+			if atomic.LoadInt32(&router.status); router.status != StatusClosing {
+				logger.Info("error accepting connection", err)
+				panic(err)
+			}
+			// We are closing business. Finish acceptor loop
+			return
+		}
+
+		remoteAddr, _, _ := net.SplitHostPort(connection.RemoteAddr().String())
+		logger.Infof("accepted connection from %s", remoteAddr)
+
+		remoteIPAddr, _ := net.ResolveIPAddr("", remoteAddr)
+		peersConf := router.ci.PeersConf()
+		if !peersConf.ValidateIncomingAddress("", remoteIPAddr.IP) {
+			logger.Infof("invalid peer %s\n", remoteIPAddr)
+			connection.Close()
+			continue
+		}
+
+		// Create peer for the accepted connection and start it
+		// The addition to the peers table will be done later,
+		// after the PeerUp evventis received and checking that there is not a duplicate.
+		// Declares, as handler for the Peer, a function that injects here a message to be routed!
+		diampeer.NewPassiveDiameterPeerWithContext(
+			router.instanceName,
+			router.peerControlChannel,
+			connection,
+			// The handler injects me the message
+			router.routeIngressRequest,
+		)
+	}
+}
+
 // Actor model event loop
 func (router *DiameterRouter) eventLoop() {
 
-	logger := config.GetLogger()
+	logger := routerLogger()
 
-	// Server socket
-	listener, err := net.Listen("tcp4", fmt.Sprintf(":%d", router.ci.DiameterServerConf().BindPort))
-	if err != nil {
-		panic(err)
+	defer router.grpcClient.Close()
+
+	// Server socket. Use the one passed by systemd, if any
+	bindPort := router.ci.DiameterServerConf().BindPort
+	listener, found := systemd.TCPListener(bindPort)
+	if !found {
+		var err error
+		if listener, err = net.Listen("tcp4", fmt.Sprintf(":%d", bindPort)); err != nil {
+			panic(err)
+		}
 	}
 	// Assign to instance variable
 	router.listener = listener
+	go router.acceptLoop(listener)
 
-	// Accepter loop
-	go func() {
-		logger.Info("diameter server accepting connections")
-		for {
-			connection, err := router.listener.Accept()
-			if err != nil {
-				// Use atomic to avoid races
-				if atomic.LoadInt32(&router.status); router.status != StatusClosing {
-					logger.Info("error accepting connection", err)
-					panic(err)
-				}
-				// We are closing business. Finish acceptor loop
-				return
-			}
-
-			remoteAddr, _, _ := net.SplitHostPort(connection.RemoteAddr().String())
-			logger.Infof("accepted connection from %s", remoteAddr)
-
-			remoteIPAddr, _ := net.ResolveIPAddr("", remoteAddr)
-			peersConf := router.ci.PeersConf()
-			if !peersConf.ValidateIncomingAddress("", remoteIPAddr.IP) {
-				logger.Infof("invalid peer %s\n", remoteIPAddr)
-				connection.Close()
-				continue
-			}
-
-			// Create peer for the accepted connection and start it
-			// The addition to the peers table will be done later,
-			// after the PeerUp evventis received and checking that there is not a duplicate.
-			// Declares, as handler for the Peer, a function that injects here a message to be routed!
-			diampeer.NewPassiveDiameterPeer(
-				router.instanceName,
-				router.peerControlChannel,
-				connection,
-				// The handler injects me the message
-				func(request *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, error) {
-					return router.RouteDiameterRequest(request, 0)
-				},
-			)
+	// Optional SCTP server socket, in the same port
+	if sctpAddresses := router.ci.DiameterServerConf().SCTPBindAddresses; len(sctpAddresses) > 0 {
+		sctpListener, err := diampeer.ListenSCTP(sctpAddresses, bindPort)
+		if err != nil {
+			panic(err)
 		}
-	}()
+		router.sctpListener = sctpListener
+		go router.acceptLoop(sctpListener)
+	}
 
 	// First pass
 	router.updatePeersTable()
@@ -186,13 +341,59 @@ routerEventLoop:
 
 		// Handle peer lifecycle messages for this Router
 		case m := <-router.routerControlChannel:
-			switch m.(type) {
+			switch v := m.(type) {
+			case PeerDisconnectCommand:
+				// The peer will send the PeerDown event, and be reconnected later if active
+				if peerEntry, found := router.diameterPeersTable[v.DiameterHost]; found && peerEntry.IsUp {
+					logger.Infof("forcing disconnection of %s", v.DiameterHost)
+					peerEntry.Peer.SetDown()
+					v.RChan <- nil
+				} else {
+					v.RChan <- fmt.Errorf("peer %s is not connected: %w", v.DiameterHost, core.ErrNoPeerAvailable)
+				}
+
+			case OutstandingRequestsQuery:
+				// Done here, so that the peers are not closed while being queried
+				requests := make(map[string][]diampeer.OutstandingRequest)
+				for diameterHost, peerEntry := range router.diameterPeersTable {
+					if !peerEntry.IsUp {
+						continue
+					}
+					peerRequests, err := peerEntry.Peer.OutstandingRequests(OUTSTANDING_REQUESTS_QUERY_MILLIS * time.Millisecond)
+					if err != nil {
+						logger.Warnf("could not get outstanding requests: %s", err)
+						continue
+					}
+					requests[diameterHost] = peerRequests
+				}
+				v.RChan <- requests
+
+			case PeersDetailQuery:
+				// Done here, so that the peers are not closed while being queried
+				table := router.buildPeersStatusTable()
+				details := make([]DiameterPeerDetail, 0, len(table))
+				for _, entry := range table {
+					detail := DiameterPeerDetail{DiameterPeersTableEntry: entry}
+					if peerEntry := router.diameterPeersTable[entry.DiameterHost]; peerEntry.IsUp {
+						if statistics, err := peerEntry.Peer.Statistics(OUTSTANDING_REQUESTS_QUERY_MILLIS * time.Millisecond); err != nil {
+							logger.Warnf("could not get peer statistics: %s", err)
+						} else {
+							detail.Statistics = &statistics
+						}
+					}
+					details = append(details, detail)
+				}
+				v.RChan <- details
+
 			case RouterCloseCommand:
 				// Set the status
 				atomic.StoreInt32(&router.status, StatusClosing)
 
-				// Close the listener. The acceptor loop will exit
+				// Close the listeners. The acceptor loops will exit
 				router.listener.Close()
+				if router.sctpListener != nil {
+					router.sctpListener.Close()
+				}
 
 				// Close all peers that are up
 				// TODO: Check that it is no harm to send two SetDown()
@@ -218,6 +419,9 @@ routerEventLoop:
 		case <-router.peerTableTicker.C:
 			// Update peers
 
+		case <-router.reconnectTicker.C:
+			router.checkPeerConnections()
+
 		// Receive lifecycle messages from managed Peers
 		case m := <-router.peerControlChannel:
 			switch v := m.(type) {
@@ -239,16 +443,22 @@ routerEventLoop:
 							// Update the peers table
 							router.diameterPeersTable[v.DiameterHost] = DiameterPeerWithStatus{Peer: v.Sender, IsEngaged: true, IsUp: true, LastStatusChange: time.Now(), LastError: nil}
 							logger.Infof("new peer entry for %s", v.DiameterHost)
+							router.publishPeerEvent(v.DiameterHost, true, nil)
 						}
 					} else {
 						// It is the one reporting up. Only change state
 						peerEntry.IsEngaged = true
 						peerEntry.LastStatusChange = time.Now()
 						peerEntry.LastError = nil
+						peerEntry.ConnectionFailures = 0
 						router.diameterPeersTable[v.DiameterHost] = peerEntry
 						logger.Infof("updating peer entry for %s", v.DiameterHost)
+						router.publishPeerEvent(v.DiameterHost, true, nil)
 					}
 
+					// Send the requests that were waiting for the peer to be engaged
+					router.sendLazyPendingRequests(v.DiameterHost)
+
 					// If we are closing the shop, set peer down
 					if atomic.LoadInt32(&router.status) == StatusClosing {
 						v.Sender.SetDown()
@@ -277,7 +487,15 @@ routerEventLoop:
 						existingPeer.LastStatusChange = time.Now()
 						existingPeer.LastError = v.Error
 						existingPeer.Peer = nil
+						existingPeer.ConnectionFailures++
+						if peerConfig, found := router.ci.PeersConf()[originHost]; found && peerConfig.ConnectionPolicy != "passive" {
+							existingPeer.NextConnectionAttempt = time.Now().Add(router.reconnectDelay(peerConfig, existingPeer.ConnectionFailures))
+						}
 						router.diameterPeersTable[originHost] = existingPeer
+						router.publishPeerEvent(originHost, false, v.Error)
+
+						// The requests waiting for this peer will not be sent
+						router.failLazyPendingRequests(originHost)
 					}
 				}
 
@@ -308,41 +526,138 @@ routerEventLoop:
 
 			// Diameter Request message to be routed
 		case rdr := <-router.diameterRequestsChan:
+
+			// The requester has already given up
+			if rdr.ctx().Err() != nil {
+				rdr.Trace.Tracef("abandoned by the requester")
+				rdr.RChan <- core.ContextError(rdr.ctx())
+				close(rdr.RChan)
+				break
+			}
+
+			// Request for a specific peer
+			if rdr.DestinationPeer != "" {
+				budget := time.Until(rdr.Deadline)
+				if budget <= 0 {
+					instrumentation.PushRouterBudgetExhausted(router.instanceName, rdr.DestinationPeer, rdr.Message)
+					rdr.RChan <- fmt.Errorf("request not sent: time budget exhausted: %w", core.ErrTimeout)
+					close(rdr.RChan)
+					break messageHandler
+				}
+				if router.isPeerAvailable(rdr.DestinationPeer) {
+					if router.shedOverload(rdr.DestinationPeer, rdr) {
+						rdr.RChan <- router.newProtocolErrorAnswer(rdr.Message, diamcodec.DIAMETER_TOO_BUSY)
+						close(rdr.RChan)
+						break messageHandler
+					}
+					router.sendToPeer(rdr.DestinationPeer, rdr, budget)
+				} else if !router.connectLazyPeer(rdr.DestinationPeer, rdr) {
+					instrumentation.PushRouterNoAvailablePeer(router.instanceName, rdr.DestinationPeer, rdr.Message)
+					rdr.RChan <- fmt.Errorf("request not sent: peer %s not available: %w", rdr.DestinationPeer, core.ErrNoPeerAvailable)
+					close(rdr.RChan)
+				}
+				break messageHandler
+			}
+
+			// Apply roaming partner overrides, if the request comes from a partner. Retransmissions were
+			// already checked
+			if partner, found := router.ci.RoamingPartnersConf().FindRoamingPartner(
+				rdr.Message.GetStringAVP("Origin-Realm"),
+				rdr.Message.GetStringAVP("Origin-Host")); found && len(rdr.TriedPeers) == 0 {
+				rdr.Trace.Tracef("request from roaming partner %s", partner.Name)
+				if err := router.partnerPolicer.apply(partner, rdr.Message, time.Now()); err != nil {
+					instrumentation.PushRouterPartnerRejected(router.instanceName, partner.Name, rdr.Message)
+					rdr.RChan <- fmt.Errorf("request not sent: %w", err)
+					close(rdr.RChan)
+					break messageHandler
+				}
+			}
+
+			// Time remaining until the requester gives up. Upstream requests are sent with this timeout,
+			// since waiting longer would be useless
+			budget := time.Until(rdr.Deadline)
+			if budget <= 0 {
+				instrumentation.PushRouterBudgetExhausted(router.instanceName, "", rdr.Message)
+				rdr.RChan <- fmt.Errorf("request not sent: time budget exhausted: %w", core.ErrTimeout)
+				close(rdr.RChan)
+				break messageHandler
+			}
+
 			route, err := router.ci.RoutingRulesConf().FindDiameterRoute(
 				rdr.Message.GetStringAVP("Destination-Realm"),
 				rdr.Message.ApplicationName,
-				false)
+				false,
+				func(avpName string) (string, bool) {
+					avp, err := rdr.Message.GetAVPFromPath(avpName)
+					if err != nil {
+						return "", false
+					}
+					return avp.GetString(), true
+				})
 
+			rdr.Trace.Tracef("route %+v with budget %s", route, budget)
 			if err != nil {
-				instrumentation.PushRouterRouteNotFound("", rdr.Message)
-				rdr.RChan <- fmt.Errorf("request not sent: no route found")
+				instrumentation.PushRouterRouteNotFound(router.instanceName, "", rdr.Message)
+				router.handleUnroutable(rdr, fmt.Errorf("request not sent: %w", core.ErrRouteNotFound))
 				break messageHandler
 			}
 
 			if len(route.Peers) > 0 {
-				// Route to destination peer
-				// If policy is "random", shuffle the destination-hosts
-				var peers []string
-				peers = append(peers, route.Peers...)
-
-				if route.Policy == "random" {
-					rand.Seed(time.Now().UnixNano())
-					rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+				// Requests received from peers are prepared for forwarding as specified in the agent mode,
+				// but not again when retransmitted
+				agentMode := router.ci.DiameterServerConf().AgentMode
+				if agentMode != "" && rdr.Message.ReceivedFrom() != "" && len(rdr.TriedPeers) == 0 {
+					forwarded, resultCode := router.newForwardedRequest(rdr.Message, agentMode)
+					if resultCode != 0 {
+						rdr.Trace.Tracef("request may not be forwarded")
+						rdr.RChan <- router.newProtocolErrorAnswer(rdr.Message, resultCode)
+						close(rdr.RChan)
+						break messageHandler
+					}
+					rdr.Message = forwarded
 				}
 
+				// Route to destination peer, trying them in the order given by the policy
+				peers := untriedPeers(router.orderPeers(route), rdr.TriedPeers)
+
+				shed := false
 				for _, destinationHost := range peers {
-					targetPeer := router.diameterPeersTable[destinationHost]
-					if targetPeer.IsEngaged {
+					if router.isPeerAvailable(destinationHost) {
+						// Divert from the overloaded peer the percentage of traffic it requested
+						if router.shedOverload(destinationHost, rdr) {
+							shed = true
+							continue
+						}
 						// Route found. Send request asyncronously
-						go targetPeer.Peer.DiameterExchange(rdr.Message, rdr.Timeout, rdr.RChan)
+						rdr.Trace.Tracef("sending to peer %s", destinationHost)
+						router.sendToRoutePeer(destinationHost, rdr, budget, route)
+						break messageHandler
+					}
+				}
+
+				// Rejected as requested by the overloaded peers, instead of trying to connect to others
+				if shed {
+					rdr.RChan <- router.newProtocolErrorAnswer(rdr.Message, diamcodec.DIAMETER_TOO_BUSY)
+					close(rdr.RChan)
+					break messageHandler
+				}
+
+				// No engaged peer. Try to connect a lazy one, with the request waiting for it
+				for _, destinationHost := range peers {
+					if router.connectLazyPeer(destinationHost, rdr) {
+						rdr.Trace.Tracef("waiting for lazy peer %s", destinationHost)
 						break messageHandler
 					}
 				}
 
 				// If here, could not find a peer
-				instrumentation.PushRouterNoAvailablePeer("", rdr.Message)
-				rdr.RChan <- fmt.Errorf("resquest not sent: no engaged peer")
-				close(rdr.RChan)
+				if len(rdr.TriedPeers) > 0 {
+					rdr.RChan <- fmt.Errorf("request not answered by %v and no other peer available: %w", rdr.TriedPeers, core.ErrTimeout)
+					close(rdr.RChan)
+					break messageHandler
+				}
+				instrumentation.PushRouterNoAvailablePeer(router.instanceName, "", rdr.Message)
+				router.handleUnroutable(rdr, fmt.Errorf("request not sent: %w", core.ErrNoPeerAvailable))
 
 			} else if len(route.Handlers) > 0 {
 				// Handle locally
@@ -350,48 +665,73 @@ routerEventLoop:
 				// For handlers there is not such a thing as fixed policy
 				var destinationURLs []string
 				destinationURLs = append(destinationURLs, route.Handlers...)
-				rand.Seed(time.Now().UnixNano())
-				rand.Shuffle(len(destinationURLs), func(i, j int) { destinationURLs[i], destinationURLs[j] = destinationURLs[j], destinationURLs[i] })
+				random.Shuffle(len(destinationURLs), func(i, j int) { destinationURLs[i], destinationURLs[j] = destinationURLs[j], destinationURLs[i] })
+				rdr.Trace.Tracef("sending to handlers %v", destinationURLs)
 
 				// Send to the handler asynchronously
-				go func(respChan chan interface{}, diameterRequest *diamcodec.DiameterMessage) {
-
-					// Make sure the response channel is closed
-					defer close(respChan)
-
-					answer, err := httphandler.HttpDiameterRequest(router.http2Client, destinationURLs[0], diameterRequest)
-					if err != nil {
-						logger.Error(err.Error())
-						rdr.RChan <- err
-					} else {
-						// Add the Origin-Host and Origin-Realm, that are not set by the handler
-						// because it lacks that configuration
-						answer.AddOriginAVPs(router.ci)
-						rdr.RChan <- answer
-					}
-
-				}(rdr.RChan, rdr.Message)
+				go router.sendToHandlers(rdr, destinationURLs, route.IsIdempotent(rdr.Message.CommandName))
 
 			} else {
 				panic("bad route, without peers or handlers")
 			}
 		}
 	}
+	router.reconnectTicker.Stop()
 	logger.Infof("finished Peer manager %s ", router.instanceName)
 }
 
+// Sets the analyzer of the attribute values of the requests received from peers and their answers
+func (router *DiameterRouter) SetAttributeStats(analyzer *attrstats.Analyzer) {
+	router.attributeStats.Store(analyzer)
+}
+
+// Sets the producer that publishes to Kafka the changes in the status of the peers, the accounting
+// requests sent to the handlers and the errors of the handlers
+func (router *DiameterRouter) SetKafkaProducer(producer *kafkaproducer.Producer) {
+	router.kafkaProducer.Store(producer)
+}
+
+// Publishes the engagement or disconnection of the peer, if the Kafka producer is set
+func (router *DiameterRouter) publishPeerEvent(peerName string, up bool, err error) {
+	if producer, _ := router.kafkaProducer.Load().(*kafkaproducer.Producer); producer != nil {
+		producer.PublishPeerEvent(peerName, up, err)
+	}
+}
+
 // Sends a DiameterMessage and returns the answer
 func (router *DiameterRouter) RouteDiameterRequest(request *diamcodec.DiameterMessage, timeout time.Duration) (*diamcodec.DiameterMessage, error) {
+	return router.routeDiameterRequest(context.Background(), request, timeout, nil)
+}
+
+// Sends a DiameterMessage and returns the answer. The request is abandoned if the context is done before the answer
+// is received, in which case the requests to the http handlers are cancelled. The deadline is the earliest of that of the
+// context and the timeout
+func (router *DiameterRouter) RouteDiameterRequestWithContext(ctx context.Context, request *diamcodec.DiameterMessage, timeout time.Duration) (*diamcodec.DiameterMessage, error) {
+	return router.routeDiameterRequest(ctx, request, timeout, nil)
+}
+
+// Sends a DiameterMessage and returns the answer, accumulating the routing events in the trace
+func (router *DiameterRouter) routeDiameterRequest(ctx context.Context, request *diamcodec.DiameterMessage, timeout time.Duration, trace *config.TraceBuffer) (*diamcodec.DiameterMessage, error) {
 	responseChannel := make(chan interface{}, 1)
 
+	deadline := core.EarliestDeadline(ctx, time.Now().Add(timeout))
 	routableRequest := RoutableDiameterRequest{
-		Message: request,
-		RChan:   responseChannel,
-		Timeout: timeout,
+		Message:  request,
+		RChan:    responseChannel,
+		Timeout:  time.Until(deadline),
+		Deadline: deadline,
+		Trace:    trace,
+		Context:  ctx,
 	}
 	router.diameterRequestsChan <- routableRequest
 
-	r := <-routableRequest.RChan
+	// The response channel is buffered, so the answer may be written after giving up
+	var r interface{}
+	select {
+	case r = <-routableRequest.RChan:
+	case <-ctx.Done():
+		return &diamcodec.DiameterMessage{}, core.ContextError(ctx)
+	}
 	switch v := r.(type) {
 	case error:
 		return &diamcodec.DiameterMessage{}, v
@@ -405,9 +745,10 @@ func (router *DiameterRouter) RouteDiameterRequestAsync(request *diamcodec.Diame
 	responseChannel := make(chan interface{}, 1)
 
 	routableRequest := RoutableDiameterRequest{
-		Message: request,
-		RChan:   responseChannel,
-		Timeout: timeout,
+		Message:  request,
+		RChan:    responseChannel,
+		Timeout:  timeout,
+		Deadline: time.Now().Add(timeout),
 	}
 	router.diameterRequestsChan <- routableRequest
 
@@ -421,6 +762,118 @@ func (router *DiameterRouter) RouteDiameterRequestAsync(request *diamcodec.Diame
 	panic("got an answer that was not error or pointer to diameter message")
 }
 
+// Sends the request to the http handlers and writes the answer or error to the response channel,
+// which is closed afterwards
+func (router *DiameterRouter) sendToHandlers(rdr RoutableDiameterRequest, destinationURLs []string, idempotent bool) {
+
+	// Make sure the response channel is closed
+	defer close(rdr.RChan)
+
+	contentType, err := core.ContentTypeFor(router.ci.DiameterServerConf().HttpHandlerEncoding)
+	if err != nil {
+		routerLogger().Error(err.Error())
+		rdr.RChan <- err
+		return
+	}
+
+	// The bulkhead is that of the first handler, which is the one that receives the request
+	// unless there are failures
+	handlerName := destinationURLs[0]
+	bulkheadConf := router.ci.BulkheadsConf()[handlerName]
+	bulkheadTimeout := time.Duration(bulkheadConf.TimeoutMillis) * time.Millisecond
+	bulkhead := router.bulkheads.Get(handlerName, bulkheadConf.MaxConcurrency, bulkheadConf.QueueLength, bulkheadTimeout)
+
+	deadline := rdr.Deadline
+	if bulkheadTimeout > 0 && time.Now().Add(bulkheadTimeout).Before(deadline) {
+		deadline = time.Now().Add(bulkheadTimeout)
+	}
+
+	producer, _ := router.kafkaProducer.Load().(*kafkaproducer.Producer)
+	if producer != nil && rdr.Message.CommandName == "Accounting" {
+		producer.PublishDiameterAccounting(rdr.Message)
+	}
+
+	// The requests to the handlers are cancelled if the requester gives up
+	ctx, cancel := context.WithDeadline(rdr.ctx(), deadline)
+	defer cancel()
+
+	var answer *diamcodec.DiameterMessage
+	err = bulkhead.Execute(deadline, func() error {
+		var e error
+		answer, e = httphandler.DiameterRequestWithRetry(ctx, destinationURLs, rdr.Message, idempotent, router.sendToHandler(contentType))
+		return e
+	})
+	if errors.Is(err, core.ErrBulkheadFull) {
+		// Fail fast, so that the client may try elsewhere
+		routerLogger().Warnw(fmt.Sprintf("request to handler %s rejected: %s", handlerName, err), rdr.Message.LogFields()...)
+		instrumentation.PushRouterBulkheadRejected(router.instanceName, handlerName, rdr.Message)
+		rdr.Trace.Tracef("rejected by the bulkhead of %s", handlerName)
+		answer := diamcodec.NewDiameterAnswer(rdr.Message)
+		answer.IsError = true
+		answer.Add("Session-Id", rdr.Message.GetStringAVP("Session-Id"))
+		answer.AddOriginAVPs(router.ci)
+		answer.Add("Result-Code", diamcodec.DIAMETER_TOO_BUSY)
+		rdr.RChan <- answer
+	} else if err != nil {
+		routerLogger().Errorw(err.Error(), rdr.Message.LogFields()...)
+		if producer != nil {
+			producer.PublishDiameterHandlerError(rdr.Message, err)
+		}
+		rdr.RChan <- err
+	} else {
+		// Add the Origin-Host and Origin-Realm, that are not set by the handler
+		// because it lacks that configuration
+		answer.AddOriginAVPs(router.ci)
+		rdr.RChan <- answer
+	}
+}
+
+// Returns the function that sends the request to a handler, using the transport specified in its URL
+func (router *DiameterRouter) sendToHandler(contentType string) httphandler.DiameterRequestFunc {
+	return func(ctx context.Context, endpoint string, request *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, error) {
+		if grpchandler.IsGrpcEndpoint(endpoint) {
+			return router.grpcClient.DiameterRequest(ctx, endpoint, request)
+		}
+		if router.http2ClientErr != nil {
+			return nil, httphandler.NewHttpHandlerError(router.instanceName, endpoint, httphandler.SERIALIZATION_ERROR, false, router.http2ClientErr)
+		}
+		return httphandler.HttpDiameterRequestWithContext(core.WithInstanceName(ctx, router.instanceName), router.http2Client, endpoint, request, contentType)
+	}
+}
+
+// Treats a request for which there is no route or available peer, as specified in the
+// unroutable policy for the application. Executed in the event loop
+func (router *DiameterRouter) handleUnroutable(rdr RoutableDiameterRequest, cause error) {
+
+	policy := router.ci.UnroutablePoliciesConf().FindUnroutablePolicy(rdr.Message.ApplicationName)
+	rdr.Trace.Tracef("unroutable request with policy %+v", policy)
+
+	switch policy.Action {
+	case "answer":
+		rdr.RChan <- router.newProtocolErrorAnswer(rdr.Message, diamcodec.DIAMETER_UNABLE_TO_DELIVER)
+		close(rdr.RChan)
+
+	case "drop":
+		rdr.RChan <- fmt.Errorf("%w: %s", diampeer.ErrDiscardRequest, cause)
+		close(rdr.RChan)
+
+	case "handler":
+		go router.sendToHandlers(rdr, policy.Handlers, false)
+
+	default:
+		rdr.RChan <- cause
+		close(rdr.RChan)
+	}
+}
+
+// Returns the time budget for answering the requests received from diameter peers
+func (router *DiameterRouter) ingressTimeout() time.Duration {
+	if timeoutMillis := router.ci.DiameterServerConf().IngressTimeoutMillis; timeoutMillis > 0 {
+		return time.Duration(timeoutMillis) * time.Millisecond
+	}
+	return DEFAULT_INGRESS_TIMEOUT_MILLIS * time.Millisecond
+}
+
 // Takes the current map of DiameterPeers and generates a new one based on the current configuration
 func (router *DiameterRouter) updatePeersTable() {
 
@@ -449,12 +902,10 @@ func (router *DiameterRouter) updatePeersTable() {
 		_, found := router.diameterPeersTable[diameterPeersConf[dh].DiameterHost]
 		if !found {
 			if peerConfig.ConnectionPolicy == "active" {
-				diamPeer := diampeer.NewActiveDiameterPeer(router.instanceName, router.peerControlChannel, peerConfig, func(request *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, error) {
-					return router.RouteDiameterRequest(request, 0)
-				})
-				router.diameterPeersTable[peerConfig.DiameterHost] = DiameterPeerWithStatus{Peer: diamPeer, IsEngaged: false, IsUp: true, LastStatusChange: time.Now()}
+				router.connectPeer(peerConfig)
 			} else {
-				router.diameterPeersTable[peerConfig.DiameterHost] = DiameterPeerWithStatus{Peer: nil, IsEngaged: false, IsUp: true, LastStatusChange: time.Now()}
+				// Passive and lazy peers. Not up until a connection is established
+				router.diameterPeersTable[peerConfig.DiameterHost] = DiameterPeerWithStatus{Peer: nil, IsEngaged: false, IsUp: false, LastStatusChange: time.Now()}
 			}
 		}
 	}
@@ -482,15 +933,40 @@ func (router *DiameterRouter) buildPeersStatusTable() instrumentation.DiameterPe
 			connectionPolicy = peerConfig.ConnectionPolicy
 		}
 		instrumentationEntry := instrumentation.DiameterPeersTableEntry{
-			DiameterHost:     diameterHost,
-			IPAddress:        ipAddress,
-			ConnectionPolicy: connectionPolicy,
-			IsEngaged:        peerStatus.IsEngaged,
-			LastStatusChange: peerStatus.LastStatusChange,
-			LastError:        peerStatus.LastError,
+			DiameterHost:       diameterHost,
+			IPAddress:          ipAddress,
+			ConnectionPolicy:   connectionPolicy,
+			IsEngaged:          peerStatus.IsEngaged,
+			LastStatusChange:   peerStatus.LastStatusChange,
+			LastError:          peerStatus.LastError,
+			ConnectionFailures: peerStatus.ConnectionFailures,
+		}
+		if peerStatus.Peer == nil {
+			instrumentationEntry.NextConnectionAttempt = peerStatus.NextConnectionAttempt
 		}
+		instrumentationEntry.OverloadReductionPercent, instrumentationEntry.OverloadExpiration = router.overload.reduction(diameterHost, time.Now())
 		peerTable = append(peerTable, instrumentationEntry)
 	}
 
 	return peerTable
 }
+
+// Measures the skew of the clock of the origin of the request using the Event-Timestamp, if present.
+// If the skew is above the tolerance and so configured, the Time AVPs are corrected
+func (router *DiameterRouter) checkClockSkew(request *diamcodec.DiameterMessage, received time.Time) {
+	eventTimestamp, err := request.GetAVP("Event-Timestamp")
+	if err != nil {
+		return
+	}
+
+	originHost := request.GetStringAVP("Origin-Host")
+	delay := time.Duration(request.GetIntAVP("Acct-Delay-Time")) * time.Second
+	skew := core.ClockSkew(eventTimestamp.GetDate(), received, delay)
+	instrumentation.PushPeerClockSkew(router.instanceName, originHost, skew)
+
+	skewConf := router.ci.DiameterServerConf().ClockSkew
+	if correction := core.ClockSkewCorrection(skew, skewConf.ToleranceMillis, skewConf.Correct); correction != 0 {
+		routerLogger().Debugw(fmt.Sprintf("correcting clock skew of %s", skew), "peer", originHost)
+		request.ShiftTimeAVPs(correction)
+	}
+}
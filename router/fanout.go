@@ -0,0 +1,165 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"igor/core"
+	"igor/diamcodec"
+	"igor/radiuscodec"
+	"time"
+
+	radiusClient "igor/radiusclient"
+)
+
+// Fan-out of requests. The same request is sent to several destinations in parallel, and
+// the answers are returned as soon as the specified number of successful ones (the quorum)
+// have been received. With a quorum of 1, the first successful answer wins.
+//
+// The requests still outstanding when a decision is reached are cancelled, through the context
+// with which they are sent, so that the peer or socket stops waiting for their answers
+
+// Specification of a radius destination for fan-out requests
+type RadiusFanOutDestination struct {
+	// IPAddress:Port
+	Endpoint string
+
+	// Shared secret
+	Secret string
+}
+
+// Result of the exchange with one of the destinations of a fan-out
+type fanOutResult struct {
+	index    int
+	response interface{}
+}
+
+// Sends the request to each one of the n destinations using the specified function, which must
+// write exactly one answer or error to the channel passed. Returns the first quorum responses
+// for which isSuccess returns true, in the order in which they were received, or an error if the
+// quorum is not reached before the timeout or after all destinations have answered. The context
+// passed to the function is cancelled when this returns, and the pending answers are not waited for
+func fanOut(ctx context.Context, n int, quorum int, timeout time.Duration, send func(ctx context.Context, index int, rc chan interface{}), isSuccess func(response interface{}) bool) ([]interface{}, error) {
+
+	if quorum < 1 || quorum > n {
+		return nil, fmt.Errorf("bad quorum %d for %d destinations", quorum, n)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Buffered, so that the goroutines for the abandoned requests do not block
+	results := make(chan fanOutResult, n)
+	for i := 0; i < n; i++ {
+		go func(index int) {
+			rc := make(chan interface{}, 1)
+			send(ctx, index, rc)
+			select {
+			case response := <-rc:
+				results <- fanOutResult{index: index, response: response}
+			case <-ctx.Done():
+			}
+		}(i)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var successes []interface{}
+	var lastError error
+	for received := 0; received < n; received++ {
+		select {
+		case result := <-results:
+			if isSuccess(result.response) {
+				successes = append(successes, result.response)
+				if len(successes) == quorum {
+					return successes, nil
+				}
+			} else if err, ok := result.response.(error); ok {
+				lastError = err
+			} else {
+				lastError = fmt.Errorf("unsuccessful answer from destination %d", result.index)
+			}
+		case <-timer.C:
+			return nil, fmt.Errorf("quorum not reached: %d out of %d successful answers: %w", len(successes), quorum, core.ErrTimeout)
+		case <-ctx.Done():
+			return nil, fmt.Errorf("quorum not reached: %d out of %d successful answers: %w", len(successes), quorum, core.ContextError(ctx))
+		}
+	}
+
+	return nil, fmt.Errorf("quorum not reached: %d out of %d successful answers. Last error: %w", len(successes), quorum, lastError)
+}
+
+// Sends the Diameter request to all the specified peers in parallel and returns the first quorum
+// successful answers, that is, those with a Result-Code of the 2xxx class. The message is shared
+// by all the destinations and must not be modified until this function returns
+func (router *DiameterRouter) FanOutDiameterRequest(request *diamcodec.DiameterMessage, peers []string, quorum int, timeout time.Duration) ([]*diamcodec.DiameterMessage, error) {
+	return router.FanOutDiameterRequestWithContext(context.Background(), request, peers, quorum, timeout)
+}
+
+// Same as FanOutDiameterRequest, but the requests are cancelled when the context is done
+func (router *DiameterRouter) FanOutDiameterRequestWithContext(ctx context.Context, request *diamcodec.DiameterMessage, peers []string, quorum int, timeout time.Duration) ([]*diamcodec.DiameterMessage, error) {
+
+	deadline := core.EarliestDeadline(ctx, time.Now().Add(timeout))
+	send := func(ctx context.Context, index int, rc chan interface{}) {
+		router.diameterRequestsChan <- RoutableDiameterRequest{
+			Message:         request,
+			RChan:           rc,
+			Timeout:         timeout,
+			Deadline:        deadline,
+			DestinationPeer: peers[index],
+			Context:         ctx,
+		}
+	}
+	isSuccess := func(response interface{}) bool {
+		answer, ok := response.(*diamcodec.DiameterMessage)
+		return ok && answer.GetResultCode()/1000 == 2
+	}
+
+	responses, err := fanOut(ctx, len(peers), quorum, timeout, send, isSuccess)
+	if err != nil {
+		return nil, err
+	}
+
+	answers := make([]*diamcodec.DiameterMessage, 0, len(responses))
+	for _, response := range responses {
+		answers = append(answers, response.(*diamcodec.DiameterMessage))
+	}
+	return answers, nil
+}
+
+// Sends the Radius request to all the specified destinations in parallel, using the specified
+// client socket, and returns the first quorum responses. Any response, including an Access-Reject,
+// is considered successful. Only errors and timeouts are not
+func FanOutRadiusRequest(rcs *radiusClient.RadiusClientSocket, request *radiuscodec.RadiusPacket, destinations []RadiusFanOutDestination, quorum int, timeout time.Duration) ([]*radiuscodec.RadiusPacket, error) {
+	return FanOutRadiusRequestWithContext(context.Background(), rcs, request, destinations, quorum, timeout)
+}
+
+// Same as FanOutRadiusRequest, but the requests are cancelled when the context is done
+func FanOutRadiusRequestWithContext(ctx context.Context, rcs *radiusClient.RadiusClientSocket, request *radiuscodec.RadiusPacket, destinations []RadiusFanOutDestination, quorum int, timeout time.Duration) ([]*radiuscodec.RadiusPacket, error) {
+
+	// The exchanges may outlive this function, so each one gets its own copy of the request, which
+	// may be a pooled packet released when the handler returns
+	requests := make([]*radiuscodec.RadiusPacket, len(destinations))
+	for i := range requests {
+		requests[i] = request.Copy()
+	}
+
+	send := func(ctx context.Context, index int, rc chan interface{}) {
+		rcs.RadiusExchangeWithContext(ctx, destinations[index].Endpoint, requests[index], timeout, destinations[index].Secret, rc)
+	}
+	isSuccess := func(response interface{}) bool {
+		_, ok := response.(*radiuscodec.RadiusPacket)
+		return ok
+	}
+
+	responses, err := fanOut(ctx, len(destinations), quorum, timeout, send, isSuccess)
+	if err != nil {
+		return nil, err
+	}
+
+	packets := make([]*radiuscodec.RadiusPacket, 0, len(responses))
+	for _, response := range responses {
+		packets = append(packets, response.(*radiuscodec.RadiusPacket))
+	}
+	return packets, nil
+}
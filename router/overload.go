@@ -0,0 +1,196 @@
+package router
+
+import (
+	"igor/diamcodec"
+	"igor/instrumentation"
+	"igor/random"
+	"sync"
+	"time"
+)
+
+// Diameter Overload Indication Conveyance, as specified in RFC 7683, acting as reacting node. The requests
+// sent to peers advertise the loss abatement algorithm, and the host overload reports received in the answers
+// are used to reduce the traffic sent to the peers that generated them. Realm reports are ignored
+
+// The only abatement algorithm supported
+const OC_FEATURE_LOSS = 1
+
+// Validity of an overload report that does not specify the OC-Validity-Duration, and maximum value allowed
+const DEFAULT_OC_VALIDITY_SECONDS = 30
+const MAX_OC_VALIDITY_SECONDS = 86400
+
+// Overload state of a peer
+type overloadReport struct {
+	sequenceNumber   uint64
+	reductionPercent int
+	expires          time.Time
+}
+
+// Keeps the overload reports received from the peers. Thread safe, since the answers are received
+// outside of the event loop
+type overloadControl struct {
+	sync.Mutex
+
+	// By Diameter-Host
+	reports map[string]overloadReport
+
+	// True if a report has been received or has expired since the last call to takeChanged
+	changed bool
+}
+
+func newOverloadControl() *overloadControl {
+	return &overloadControl{reports: make(map[string]overloadReport)}
+}
+
+// Returns a copy of the request with the OC-Supported-Features AVP, or the same request if it already
+// has one. The boolean is true if the AVP was added
+func withOverloadSupport(request *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, bool) {
+	if _, err := request.GetAVP("OC-Supported-Features"); err == nil {
+		return request, false
+	}
+
+	supportedFeatures, err := diamcodec.NewAVPWithDict(request.Dict(), "OC-Supported-Features", nil)
+	if err != nil {
+		routerLogger().Errorf("could not build OC-Supported-Features: %s", err)
+		return request, false
+	}
+	supportedFeatures.Add("OC-Feature-Vector", OC_FEATURE_LOSS)
+
+	// The original request may be referenced elsewhere
+	advertised := *request
+	advertised.AVPs = append(make([]diamcodec.DiameterAVP, 0, len(request.AVPs)+1), request.AVPs...)
+	advertised.AddAVP(supportedFeatures)
+	return &advertised, true
+}
+
+// Updates the state of the peer with the host overload report in the answer, if any. A report with
+// zero reduction or validity ends the overload
+func (oc *overloadControl) update(diameterHost string, answer *diamcodec.DiameterMessage, now time.Time) {
+	olr, err := answer.GetAVP("OC-OLR")
+	if err != nil {
+		return
+	}
+	if reportType, err := olr.GetAVP("OC-Report-Type"); err != nil || reportType.GetInt() != 0 {
+		return
+	}
+	sequenceNumber, err := olr.GetAVP("OC-Sequence-Number")
+	if err != nil {
+		return
+	}
+
+	var reductionPercent int
+	if reduction, err := olr.GetAVP("OC-Reduction-Percentage"); err == nil {
+		reductionPercent = int(reduction.GetInt())
+	}
+	if reductionPercent > 100 {
+		reductionPercent = 100
+	}
+	validitySeconds := int64(DEFAULT_OC_VALIDITY_SECONDS)
+	if validity, err := olr.GetAVP("OC-Validity-Duration"); err == nil {
+		validitySeconds = validity.GetInt()
+	}
+	if validitySeconds > MAX_OC_VALIDITY_SECONDS {
+		validitySeconds = MAX_OC_VALIDITY_SECONDS
+	}
+
+	oc.Lock()
+	defer oc.Unlock()
+
+	// Reports older than the one in force are ignored
+	current, found := oc.reports[diameterHost]
+	if found && now.Before(current.expires) && sequenceNumber.GetUint() <= current.sequenceNumber {
+		return
+	}
+
+	if reductionPercent == 0 || validitySeconds == 0 {
+		if found {
+			routerLogger().Infof("overload of %s finished", diameterHost)
+			delete(oc.reports, diameterHost)
+			oc.changed = true
+		}
+		return
+	}
+
+	routerLogger().Infof("overload of %s with reduction of %d%% for %d seconds", diameterHost, reductionPercent, validitySeconds)
+	oc.reports[diameterHost] = overloadReport{
+		sequenceNumber:   sequenceNumber.GetUint(),
+		reductionPercent: reductionPercent,
+		expires:          now.Add(time.Duration(validitySeconds) * time.Second),
+	}
+	oc.changed = true
+}
+
+// Returns the percentage of traffic to be diverted from the peer, and the time until which the
+// reduction is in force. The percentage is zero if the peer is not overloaded
+func (oc *overloadControl) reduction(diameterHost string, now time.Time) (int, time.Time) {
+	oc.Lock()
+	defer oc.Unlock()
+
+	report, found := oc.reports[diameterHost]
+	if !found {
+		return 0, time.Time{}
+	}
+	if !now.Before(report.expires) {
+		delete(oc.reports, diameterHost)
+		oc.changed = true
+		return 0, time.Time{}
+	}
+	return report.reductionPercent, report.expires
+}
+
+// Returns true if the request must not be sent to the peer, to honor the reduction requested by it
+func (oc *overloadControl) shed(diameterHost string, now time.Time) bool {
+	reductionPercent, _ := oc.reduction(diameterHost, now)
+	return reductionPercent > 0 && random.Intn(100) < reductionPercent
+}
+
+// Returns true if the overload state of any peer has changed since the last invocation
+func (oc *overloadControl) takeChanged(now time.Time) bool {
+	oc.Lock()
+	defer oc.Unlock()
+
+	for diameterHost, report := range oc.reports {
+		if !now.Before(report.expires) {
+			delete(oc.reports, diameterHost)
+			oc.changed = true
+		}
+	}
+
+	changed := oc.changed
+	oc.changed = false
+	return changed
+}
+
+// Returns true if the request must not be sent to the peer, which is engaged, to honor its overload report
+func (router *DiameterRouter) shedOverload(diameterHost string, rdr RoutableDiameterRequest) bool {
+	if !router.ci.DiameterServerConf().OverloadControl || !router.overload.shed(diameterHost, time.Now()) {
+		return false
+	}
+	rdr.Trace.Tracef("not sent to overloaded peer %s", diameterHost)
+	instrumentation.PushRouterOverloadShed(router.instanceName, diameterHost, rdr.Message)
+	return true
+}
+
+// Adds the OC-Supported-Features to the request to be sent to a peer, if overload control is enabled
+func (router *DiameterRouter) advertiseOverloadControl(rdr RoutableDiameterRequest) RoutableDiameterRequest {
+	if !router.ci.DiameterServerConf().OverloadControl {
+		return rdr
+	}
+	var added bool
+	rdr.Message, added = withOverloadSupport(rdr.Message)
+	rdr.AddedOverloadSupport = rdr.AddedOverloadSupport || added
+	return rdr
+}
+
+// Takes note of the overload report in the answer received from the peer, which is removed if the
+// requester did not advertise support of overload control
+func (router *DiameterRouter) processOverloadReport(diameterHost string, rdr RoutableDiameterRequest, response interface{}) {
+	answer, isAnswer := response.(*diamcodec.DiameterMessage)
+	if !isAnswer || !router.ci.DiameterServerConf().OverloadControl {
+		return
+	}
+	router.overload.update(diameterHost, answer, time.Now())
+	if rdr.AddedOverloadSupport {
+		answer.DeleteAllAVP("OC-OLR").DeleteAllAVP("OC-Supported-Features")
+	}
+}
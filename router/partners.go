@@ -0,0 +1,46 @@
+package router
+
+import (
+	"fmt"
+	"igor/config"
+	"igor/core"
+	"igor/diamcodec"
+	"time"
+)
+
+// Applies the overrides defined for roaming partners to the diameter requests
+// received from them. Not thread safe: to be used only from the Router event loop
+type partnerPolicer struct {
+	// Token buckets for rate limiting, one per partner name
+	buckets map[string]*core.TokenBucket
+}
+
+func newPartnerPolicer() *partnerPolicer {
+	return &partnerPolicer{buckets: make(map[string]*core.TokenBucket)}
+}
+
+// Checks that the request is acceptable for the partner, and applies the attribute filters.
+// The request is modified in place.
+func (pp *partnerPolicer) apply(partner config.RoamingPartner, request *diamcodec.DiameterMessage, now time.Time) error {
+
+	if !partner.IsApplicationAllowed(request.ApplicationName) {
+		return fmt.Errorf("application %s not allowed for partner %s", request.ApplicationName, partner.Name)
+	}
+
+	if partner.RateLimit > 0 {
+		bucket, found := pp.buckets[partner.Name]
+		if !found || bucket.Rate() != partner.RateLimit {
+			bucket = core.NewTokenBucket(partner.RateLimit, now)
+			pp.buckets[partner.Name] = bucket
+		}
+		if !bucket.Take(now) {
+			return fmt.Errorf("rate limit exceeded for partner %s", partner.Name)
+		}
+	}
+
+	for _, avpName := range partner.RemoveAVPs {
+		request.DeleteAllAVP(avpName)
+	}
+
+	return nil
+}
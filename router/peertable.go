@@ -0,0 +1,307 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"igor/config"
+	"igor/core"
+	"igor/diamcodec"
+	"igor/diampeer"
+	"igor/instrumentation"
+	"igor/random"
+	"igor/telemetry"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Management of the connections with the peers, for deployments with many of them. Active peers are
+// connected at startup and lazy peers when the first request is routed to them. Both are reconnected
+// after a randomized wait that grows with the number of consecutive failures, so that the connections
+// to many peers are not retried at the same time. All these functions are executed in the event loop
+
+// Creates the active DiameterPeer, which will start connecting, and updates the peers table
+func (router *DiameterRouter) connectPeer(peerConfig config.DiameterPeer) {
+	peerEntry := router.diameterPeersTable[peerConfig.DiameterHost]
+	peerEntry.Peer = diampeer.NewActiveDiameterPeerWithContext(router.instanceName, router.peerControlChannel, peerConfig, router.routeIngressRequest)
+	peerEntry.IsEngaged = false
+	peerEntry.IsUp = true
+	peerEntry.LastStatusChange = time.Now()
+	router.diameterPeersTable[peerConfig.DiameterHost] = peerEntry
+}
+
+// Returns the time to wait before reconnecting to a peer after the specified number of consecutive
+// failures. The wait is doubled with each failure, up to the maximum, and then reduced by a random
+// amount of up to the jitter percent. The limits are taken from the peer configuration or, if not
+// specified there, from the diameter server configuration
+func (router *DiameterRouter) reconnectDelay(peerConfig config.DiameterPeer, failures int) time.Duration {
+	serverConf := router.ci.DiameterServerConf()
+
+	minMillis := firstPositive(peerConfig.ReconnectMinMillis, serverConf.PeerReconnectMinMillis, DEFAULT_PEER_RECONNECT_MIN_MILLIS)
+	maxMillis := firstPositive(peerConfig.ReconnectMaxMillis, serverConf.PeerReconnectMaxMillis, DEFAULT_PEER_RECONNECT_MAX_MILLIS)
+	if maxMillis < minMillis {
+		maxMillis = minMillis
+	}
+	jitterPercent := firstPositive(peerConfig.ReconnectJitterPercent, serverConf.PeerReconnectJitterPercent, DEFAULT_PEER_RECONNECT_JITTER_PERCENT)
+	if jitterPercent > 100 {
+		jitterPercent = 100
+	}
+
+	delayMillis := minMillis
+	for i := 1; i < failures && delayMillis < maxMillis; i++ {
+		delayMillis *= 2
+	}
+	if delayMillis > maxMillis {
+		delayMillis = maxMillis
+	}
+
+	return time.Duration(delayMillis-random.Intn(delayMillis*jitterPercent/100+1)) * time.Millisecond
+}
+
+// Returns the first of the values that is greater than zero, or the last one
+func firstPositive(values ...int) int {
+	for _, value := range values {
+		if value > 0 {
+			return value
+		}
+	}
+	return values[len(values)-1]
+}
+
+// Reconnects the active peers whose wait has expired, and cancels the requests waiting for lazy peers
+// whose time budget is exhausted
+func (router *DiameterRouter) checkPeerConnections() {
+
+	// Do nothing if we are closing
+	if atomic.LoadInt32(&router.status) == StatusClosing {
+		return
+	}
+
+	now := time.Now()
+	reconnected := false
+	diameterPeersConf := router.ci.PeersConf()
+	for diameterHost, peerEntry := range router.diameterPeersTable {
+		peerConfig, found := diameterPeersConf[diameterHost]
+		if !found || peerConfig.ConnectionPolicy != "active" {
+			continue
+		}
+		if peerEntry.Peer == nil && !peerEntry.IsUp && now.After(peerEntry.NextConnectionAttempt) {
+			routerLogger().Infof("reconnecting to %s after %d failures", diameterHost, peerEntry.ConnectionFailures)
+			router.connectPeer(peerConfig)
+			reconnected = true
+		}
+	}
+	if overloadChanged := router.overload.takeChanged(now); reconnected || overloadChanged {
+		instrumentation.PushDiameterPeersStatus(router.instanceName, router.buildPeersStatusTable())
+	}
+
+	for diameterHost, pending := range router.lazyPendingRequests {
+		waiting := pending[:0]
+		for _, rdr := range pending {
+			if now.Before(rdr.Deadline) {
+				waiting = append(waiting, rdr)
+				continue
+			}
+			instrumentation.PushRouterBudgetExhausted(router.instanceName, diameterHost, rdr.Message)
+			rdr.RChan <- fmt.Errorf("request not sent: time budget exhausted waiting for peer %s: %w", diameterHost, core.ErrTimeout)
+			close(rdr.RChan)
+		}
+		router.lazyPendingRequests[diameterHost] = waiting
+	}
+}
+
+// Returns true if the peer is engaged and has not reached its limit of outstanding requests
+func (router *DiameterRouter) isPeerAvailable(diameterHost string) bool {
+	if !router.diameterPeersTable[diameterHost].IsEngaged {
+		return false
+	}
+	peersConf := router.ci.PeersConf()
+	maxOutstanding := peersConf[diameterHost].MaxOutstandingRequests
+	return maxOutstanding <= 0 || atomic.LoadInt32(router.outstandingCounter(diameterHost)) < int32(maxOutstanding)
+}
+
+// Returns the counter of outstanding requests for the peer, creating it if necessary
+func (router *DiameterRouter) outstandingCounter(diameterHost string) *int32 {
+	counter, found := router.outstandingRequests[diameterHost]
+	if !found {
+		counter = new(int32)
+		router.outstandingRequests[diameterHost] = counter
+	}
+	return counter
+}
+
+// Sends the request to the engaged peer asynchronously. The answer or error is written to the
+// response channel, which is closed afterwards
+func (router *DiameterRouter) sendToPeer(diameterHost string, rdr RoutableDiameterRequest, budget time.Duration) {
+	rdr = router.advertiseOverloadControl(rdr)
+	peer := router.diameterPeersTable[diameterHost].Peer
+	counter := router.outstandingCounter(diameterHost)
+	atomic.AddInt32(counter, 1)
+
+	go func() {
+		defer atomic.AddInt32(counter, -1)
+
+		// Only one answer or error is sent to this channel
+		rc := make(chan interface{}, 1)
+		ctx, message, endSpan := router.startPeerSpan(diameterHost, rdr)
+		peer.DiameterExchangeWithContext(ctx, message, budget, rc)
+		response := <-rc
+		endSpan(response)
+		router.processOverloadReport(diameterHost, rdr, response)
+		rdr.RChan <- response
+		close(rdr.RChan)
+	}()
+}
+
+// Sends the request to a peer of the route. If the route allows more retransmissions, the try is given
+// only part of the budget and, if not answered in time, the request is sent back to the event loop with
+// the T flag set, to be retransmitted to another peer
+func (router *DiameterRouter) sendToRoutePeer(diameterHost string, rdr RoutableDiameterRequest, budget time.Duration, route config.DiameterRoutingRule) {
+	remainingTries := route.Retries - len(rdr.TriedPeers)
+	if remainingTries <= 0 {
+		router.sendToPeer(diameterHost, rdr, budget)
+		return
+	}
+	rdr = router.advertiseOverloadControl(rdr)
+
+	tryTimeout := budget / time.Duration(remainingTries+1)
+	if route.TryTimeoutMillis > 0 {
+		tryTimeout = time.Duration(route.TryTimeoutMillis) * time.Millisecond
+		if tryTimeout > budget {
+			tryTimeout = budget
+		}
+	}
+
+	peer := router.diameterPeersTable[diameterHost].Peer
+	counter := router.outstandingCounter(diameterHost)
+	atomic.AddInt32(counter, 1)
+
+	go func() {
+		defer atomic.AddInt32(counter, -1)
+
+		rc := make(chan interface{}, 1)
+		ctx, message, endSpan := router.startPeerSpan(diameterHost, rdr)
+		peer.DiameterExchangeWithContext(ctx, message, tryTimeout, rc)
+		response := <-rc
+		endSpan(response)
+
+		if err, isError := response.(error); isError && errors.Is(err, core.ErrTimeout) && time.Now().Before(rdr.Deadline) {
+			routerLogger().Debugw("retransmitting request not answered", append(rdr.Message.LogFields(), "peer", diameterHost)...)
+			instrumentation.PushRouterFailover(router.instanceName, diameterHost, rdr.Message)
+
+			// The original message may still be referenced by the peer
+			retransmission := *rdr.Message
+			retransmission.IsRetransmission = true
+			rdr.Message = &retransmission
+			rdr.TriedPeers = append(append([]string{}, rdr.TriedPeers...), diameterHost)
+			router.diameterRequestsChan <- rdr
+			return
+		}
+
+		router.processOverloadReport(diameterHost, rdr, response)
+		rdr.RChan <- response
+		close(rdr.RChan)
+	}()
+}
+
+// Starts the span for sending the request to the peer. Returns the context of the span, the request to send, with the
+// trace context if so configured, and the function to end the span with the answer or error received
+func (router *DiameterRouter) startPeerSpan(diameterHost string, rdr RoutableDiameterRequest) (context.Context, *diamcodec.DiameterMessage, func(response interface{})) {
+	ctx, span := telemetry.StartClientSpan(rdr.ctx(), "diameter send "+rdr.Message.CommandName, attribute.String("diameter.peer", diameterHost))
+	message := telemetry.InjectDiameter(ctx, rdr.Message, router.ci.DiameterServerConf().TraceContextAVP)
+
+	return ctx, message, func(response interface{}) {
+		err, _ := response.(error)
+		if answer, isAnswer := response.(*diamcodec.DiameterMessage); isAnswer {
+			span.SetAttributes(attribute.Int64("diameter.result_code", answer.GetResultCode()))
+		}
+		telemetry.EndSpan(span, err)
+	}
+}
+
+// Returns the peers not in the list of tried ones
+func untriedPeers(peers []string, triedPeers []string) []string {
+	if len(triedPeers) == 0 {
+		return peers
+	}
+
+	var untried []string
+	for _, peer := range peers {
+		tried := false
+		for _, triedPeer := range triedPeers {
+			if peer == triedPeer {
+				tried = true
+				break
+			}
+		}
+		if !tried {
+			untried = append(untried, peer)
+		}
+	}
+	return untried
+}
+
+// If the peer is lazy and not engaged, starts connecting to it, unless already connecting or waiting
+// to reconnect after a failure, and queues the request to be sent when the peer is engaged.
+// Returns false if the request was not queued
+func (router *DiameterRouter) connectLazyPeer(diameterHost string, rdr RoutableDiameterRequest) bool {
+
+	if atomic.LoadInt32(&router.status) == StatusClosing {
+		return false
+	}
+
+	peersConf := router.ci.PeersConf()
+	peerConfig, found := peersConf[diameterHost]
+	if !found || peerConfig.ConnectionPolicy != "lazy" {
+		return false
+	}
+
+	peerEntry := router.diameterPeersTable[diameterHost]
+	if peerEntry.IsEngaged {
+		// Engaged, but with too many outstanding requests
+		return false
+	}
+	if peerEntry.Peer == nil {
+		if time.Now().Before(peerEntry.NextConnectionAttempt) {
+			return false
+		}
+		routerLogger().Infof("connecting to lazy peer %s", diameterHost)
+		router.connectPeer(peerConfig)
+	}
+
+	router.lazyPendingRequests[diameterHost] = append(router.lazyPendingRequests[diameterHost], rdr)
+	return true
+}
+
+// Sends the requests that were waiting for the peer, if it is engaged
+func (router *DiameterRouter) sendLazyPendingRequests(diameterHost string) {
+	if !router.diameterPeersTable[diameterHost].IsEngaged {
+		return
+	}
+
+	pending := router.lazyPendingRequests[diameterHost]
+	delete(router.lazyPendingRequests, diameterHost)
+	for _, rdr := range pending {
+		budget := time.Until(rdr.Deadline)
+		if budget <= 0 {
+			instrumentation.PushRouterBudgetExhausted(router.instanceName, diameterHost, rdr.Message)
+			rdr.RChan <- fmt.Errorf("request not sent: time budget exhausted waiting for peer %s: %w", diameterHost, core.ErrTimeout)
+			close(rdr.RChan)
+			continue
+		}
+		router.sendToPeer(diameterHost, rdr, budget)
+	}
+}
+
+// Answers with an error the requests that were waiting for the peer, which could not be engaged
+func (router *DiameterRouter) failLazyPendingRequests(diameterHost string) {
+	pending := router.lazyPendingRequests[diameterHost]
+	delete(router.lazyPendingRequests, diameterHost)
+	for _, rdr := range pending {
+		instrumentation.PushRouterNoAvailablePeer(router.instanceName, diameterHost, rdr.Message)
+		rdr.RChan <- fmt.Errorf("request not sent: peer %s down: %w", diameterHost, core.ErrNoPeerAvailable)
+		close(rdr.RChan)
+	}
+}
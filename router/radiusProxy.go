@@ -0,0 +1,115 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"igor/config"
+	"igor/radiuscodec"
+	"igor/radiusdict"
+	"time"
+)
+
+// Proxying of the radius requests to upstream servers, as specified in the radiusProxy.json configuration
+// object. The filters of the rule add, delete, rename or rewrite the attributes of the request sent upstream
+// and of the response sent back to the client
+
+// Returns the first proxy rule for the NAS and the realm of the User-Name of the request
+func (router *RadiusRouter) findProxyRule(request *radiuscodec.RadiusPacket) (config.RadiusProxyRule, bool) {
+	rules := router.ci.RadiusProxyConf()
+	if len(rules) == 0 {
+		return config.RadiusProxyRule{}, false
+	}
+
+	realms := router.ci.RadiusRealmsConf()
+	realm := realms.ParseUserName(request.GetStringAVP("User-Name")).Realm
+	return rules.FindRadiusProxyRule(request.GetStringAVP("NAS-IP-Address"), request.GetStringAVP("NAS-Identifier"), realm)
+}
+
+// Sends a copy of the request, with the request filters applied, to the server group of the rule, and returns
+// the response, with the response filters applied, to be sent to the client
+func (router *RadiusRouter) proxyRadiusRequest(ctx context.Context, rule config.RadiusProxyRule, request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+
+	// The request belongs to the radius server, and the authenticator is overwritten when sent
+	proxiedRequest := request.Copy()
+	if err := applyRadiusFilters(rule.RequestFilters, proxiedRequest); err != nil {
+		return nil, fmt.Errorf("radius proxy rule %s request filter: %w", rule.Name, err)
+	}
+
+	timeout := time.Duration(rule.TimeoutMillis) * time.Millisecond
+	if timeout == 0 {
+		timeout = DEFAULT_RADIUS_PROXY_TIMEOUT_MILLIS * time.Millisecond
+	}
+	response, err := router.RouteRadiusRequestWithContext(ctx, proxiedRequest, rule.ServerGroup, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := applyRadiusFilters(rule.ResponseFilters, response); err != nil {
+		return nil, fmt.Errorf("radius proxy rule %s response filter: %w", rule.Name, err)
+	}
+
+	// The response is signed using the identifier and authenticator of the original request
+	response.Identifier = request.Identifier
+	response.Authenticator = request.Authenticator
+	return response, nil
+}
+
+// Applies the filters to the attributes of the packet, in order. The slice of attributes must not be shared
+func applyRadiusFilters(filters []config.RadiusAttributeFilter, packet *radiuscodec.RadiusPacket) error {
+	dict := packet.Dict()
+
+	for i := range filters {
+		filter := &filters[i]
+
+		if filter.Action == "add" {
+			avp, err := radiuscodec.NewAVPWithDict(dict, filter.Attribute, filter.Value)
+			if err != nil {
+				return err
+			}
+			packet.AddAVP(avp)
+			continue
+		}
+
+		avps := packet.AVPs[:0]
+		for _, avp := range packet.AVPs {
+			if avp.Name != filter.Attribute || !filter.Matches(avp.GetString()) {
+				avps = append(avps, avp)
+				continue
+			}
+
+			switch filter.Action {
+			case "delete":
+				continue
+
+			case "rename":
+				renamed, err := newFilteredAVP(dict, filter.Value, avp.Value, avp)
+				if err != nil {
+					return err
+				}
+				avp = *renamed
+
+			case "replace":
+				replaced, err := newFilteredAVP(dict, avp.Name, filter.Replace(avp.GetString()), avp)
+				if err != nil {
+					return err
+				}
+				avp = *replaced
+			}
+			avps = append(avps, avp)
+		}
+		packet.AVPs = avps
+	}
+	return nil
+}
+
+// Builds the attribute with the specified name and value, keeping the tag of the original one
+func newFilteredAVP(dict *radiusdict.RadiusDict, name string, value interface{}, original radiuscodec.RadiusAVP) (*radiuscodec.RadiusAVP, error) {
+	if dictItem, err := dict.GetFromName(name); err == nil && dictItem.Tagged {
+		// Tagged attributes are created from the text value with the tag appended
+		if _, isString := value.(string); !isString {
+			value = original.GetString()
+		}
+		value = fmt.Sprintf("%s:%d", value, original.Tag)
+	}
+	return radiuscodec.NewAVPWithDict(dict, name, value)
+}
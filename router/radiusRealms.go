@@ -0,0 +1,54 @@
+package router
+
+import (
+	"context"
+	"igor/config"
+	"igor/radiuscodec"
+	"time"
+)
+
+// Routing of the access and accounting requests by the realm of the User-Name, as specified in the
+// radiusRealms.json configuration object. The requests for realms with a server group are proxied, with the
+// realm optionally stripped or rewritten. The rest, including those for realms without server group, are
+// handled locally
+
+// Returns the configuration of the realm of the User-Name of the request, and the parsed User-Name
+func (router *RadiusRouter) findRealm(request *radiuscodec.RadiusPacket) (config.RadiusRealm, config.RadiusUserName, bool) {
+	if request.Code != radiuscodec.ACCESS_REQUEST && request.Code != radiuscodec.ACCOUNTING_REQUEST {
+		return config.RadiusRealm{}, config.RadiusUserName{}, false
+	}
+
+	realms := router.ci.RadiusRealmsConf()
+	if len(realms.Realms) == 0 {
+		return config.RadiusRealm{}, config.RadiusUserName{}, false
+	}
+
+	userName := realms.ParseUserName(request.GetStringAVP("User-Name"))
+	realm, found := realms.FindRealm(userName.Realm)
+	return realm, userName, found
+}
+
+// Sends a copy of the request, with the User-Name modified as specified for the realm, to its server group
+func (router *RadiusRouter) proxyRealmRequest(ctx context.Context, realm config.RadiusRealm, userName config.RadiusUserName, request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+
+	// The request belongs to the radius server, and the authenticator is overwritten when sent
+	proxiedRequest := request.Copy()
+	if userName.Realm != "" && (realm.StripRealm || realm.RewriteRealm != "") {
+		proxiedRequest.DeleteAllAVP("User-Name")
+		proxiedRequest.Add("User-Name", userName.WithRealm(realm.RewriteRealm))
+	}
+
+	timeout := time.Duration(realm.TimeoutMillis) * time.Millisecond
+	if timeout == 0 {
+		timeout = DEFAULT_RADIUS_PROXY_TIMEOUT_MILLIS * time.Millisecond
+	}
+	response, err := router.RouteRadiusRequestWithContext(ctx, proxiedRequest, realm.ServerGroup, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// The response is signed using the identifier and authenticator of the original request
+	response.Identifier = request.Identifier
+	response.Authenticator = request.Authenticator
+	return response, nil
+}
@@ -1,12 +1,27 @@
 package router
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"igor/config"
+	"igor/core"
+	"igor/grpchandler"
+	"igor/instrumentation"
 	"igor/radiuscodec"
+	"igor/sessionserver"
+	"igor/telemetry"
+	"net"
 	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	radiusClient "igor/radiusclient"
+
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/net/http2"
 )
 
@@ -21,7 +36,35 @@ import (
 // which are managed by the RadiusClientSocket
 //
 // The status of the radius servers is kept on a table. Radius Server are marked as "down" when the number of timeouts in a row
-// exceed the configured value
+// reaches the configured value
+//
+// The servers go through the states of a health model. An available server goes to quarantine after the configured
+// number of timeouts in a row, or by command of the administrator. When the quarantine ends, the server is recovering
+// if so configured, and receives canary requests, one at a time, until the configured number of them are answered,
+// after which it is available again. A timeout of a canary request puts the server back in quarantine. The
+// transitions are reported to the MetricsServer and kept for the admin API
+
+// The requests handled locally are dispatched by packet code to the registered handlers, so that the
+// Disconnect-Request and CoA-Request (RFC 5176) may be treated differently from the Access and Accounting
+// requests. The radius server is to be created with HandleRadiusRequest as its handler function
+
+// If a session store is set, the Access-Accept sent for a User-Name that already has the maximum number of
+// sessions configured in simultaneousUse.json is turned into an Access-Reject or, if so configured, the oldest
+// sessions are disconnected
+
+// Handler for the radius requests handled locally. An error means that the request is to be discarded
+type RadiusHandler func(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error)
+
+// Handler for the Disconnect-Request and CoA-Request. Returns whether the request was honoured and, if not,
+// the value of the Error-Cause to send in the NAK, or zero. The router builds the ACK or NAK
+type DynAuthHandler func(request *radiuscodec.RadiusPacket) (bool, int, error)
+
+// States of the radius servers
+const (
+	RADIUS_SERVER_AVAILABLE  = "available"
+	RADIUS_SERVER_QUARANTINE = "quarantine"
+	RADIUS_SERVER_RECOVERING = "recovering"
+)
 
 // Keeps the status of the Radius Server
 // Only declared servers have status
@@ -29,7 +72,10 @@ type RadiusServerWithStatus struct {
 	// Pointer to the corresponding DiameterPeer
 	ServerName string
 
-	// True when the Peer may admit requests
+	// One of the RADIUS_SERVER_XXX values
+	State string
+
+	// True when the Peer may admit requests, that is, when available or recovering
 	IsAvailable bool
 
 	// Quarantined time
@@ -38,6 +84,27 @@ type RadiusServerWithStatus struct {
 	// For reporting purposes
 	LastStatusChange time.Time
 	LastError        error
+
+	// Timeouts in a row. The server is put in quarantine when the ErrorLimit is reached
+	ConsecutiveTimeouts int
+
+	// Last Status-Server sent while in quarantine
+	LastProbe time.Time
+
+	// Canary requests answered while recovering
+	CanaryRequestsAnswered int
+
+	// While recovering, the server is not selected until this time, when a canary request is outstanding
+	CanaryUntil time.Time
+}
+
+// Change of state of a radius server
+type RadiusServerTransition struct {
+	ServerName string
+	From       string
+	To         string
+	Time       time.Time
+	Reason     string
 }
 
 // Represents a Radius Packet to be handled or proxyed
@@ -78,22 +145,57 @@ type RadiusRouter struct {
 	// Used to retreive Radius Requests
 	radiusRequestsChan chan RoutableRadiusRequest
 
-	// To signal that the Router has shut down
+	// To send commands to this Router
+	routerControlChannel chan interface{}
+
+	// Closed when the Router has shut down
 	RouterDoneChannel chan struct{}
 
+	// To send the Status-Server to the servers in quarantine
+	probeTicker *time.Ticker
+
 	// HTTP2 client
 	http2Client http.Client
+
+	// Client for the handlers with gRPC transport
+	grpcClient *grpchandler.GrpcClient
+
+	// Handlers for the requests handled locally, by packet code
+	handlersMutex sync.RWMutex
+	handlers      map[byte]RadiusHandler
+
+	// Sessions used to enforce the simultaneous use limit, and function to disconnect them. Set with SetSessionStore
+	sessionMutex sync.RWMutex
+	sessionStore *sessionserver.RadiusSessionStore
+	disconnect   sessionserver.DisconnectFunc
+
+	// Used to send the requests to the upstream radius servers. Either a *radiusClient.RadiusClient
+	// or a *radiusClient.RadiusClientSocket
+	clientMutex sync.RWMutex
+	client      radiusExchanger
+
+	// State of the load balancing policies of the server groups, used in the event loop
+	roundRobinCounters map[string]int
+	weightedRoundRobin map[string]map[string]int
+
+	// Last transitions of the radius servers, oldest first, used in the event loop
+	transitions []RadiusServerTransition
 }
 
 // Creates and runs a Router
 func NewRadiusRouter(instanceName string) *RadiusRouter {
 
 	router := RadiusRouter{
-		instanceName:       instanceName,
-		ci:                 config.GetPolicyConfigInstance(instanceName),
-		radiusServersTable: make(map[string]RadiusServerWithStatus),
-		radiusRequestsChan: make(chan RoutableRadiusRequest, RADIUS_REQUESTS_QUEUE_SIZE),
-		RouterDoneChannel:  make(chan struct{}),
+		instanceName:         instanceName,
+		ci:                   config.GetPolicyConfigInstance(instanceName),
+		radiusServersTable:   make(map[string]RadiusServerWithStatus),
+		radiusRequestsChan:   make(chan RoutableRadiusRequest, RADIUS_REQUESTS_QUEUE_SIZE),
+		routerControlChannel: make(chan interface{}),
+		RouterDoneChannel:    make(chan struct{}),
+		probeTicker:          time.NewTicker(RADIUS_PROBE_CHECK_MILLIS * time.Millisecond),
+		handlers:             make(map[byte]RadiusHandler),
+		roundRobinCounters:   make(map[string]int),
+		weightedRoundRobin:   make(map[string]map[string]int),
 	}
 
 	// Configure client for handlers
@@ -104,10 +206,524 @@ func NewRadiusRouter(instanceName string) *RadiusRouter {
 	// Create an http client with timeout and http2 transport
 	router.http2Client = http.Client{Timeout: HTTP_TIMEOUT_SECONDS * time.Second, Transport: transportCfg}
 
+	router.grpcClient = grpchandler.NewGrpcClient(router.instanceName, router.ci.RadiusServerConf().HttpHandlerClient)
+	router.setGrpcHandlers()
+
 	go router.eventLoop()
 
 	return &router
 }
 
+// Sets the handler for the requests with the specified code, replacing the existing one
+func (router *RadiusRouter) SetHandler(code byte, handler RadiusHandler) {
+	router.handlersMutex.Lock()
+	defer router.handlersMutex.Unlock()
+	router.handlers[code] = handler
+}
+
+// Sets the handlers for the codes whose handlers in the configuration have gRPC transport. The requests
+// are sent to them in order, skipping those with other transports, until one of them answers
+func (router *RadiusRouter) setGrpcHandlers() {
+	handlersConf := router.ci.RadiusHandlersConf()
+	for _, h := range []struct {
+		codes     []byte
+		endpoints []string
+	}{
+		{[]byte{radiuscodec.ACCESS_REQUEST}, handlersConf.AuthHandlers},
+		{[]byte{radiuscodec.ACCOUNTING_REQUEST}, handlersConf.AcctHandlers},
+		{[]byte{radiuscodec.DISCONNECT_REQUEST, radiuscodec.COA_REQUEST}, handlersConf.COAHandlers},
+	} {
+		var grpcEndpoints []string
+		for _, endpoint := range h.endpoints {
+			if grpchandler.IsGrpcEndpoint(endpoint) {
+				grpcEndpoints = append(grpcEndpoints, endpoint)
+			}
+		}
+		if len(grpcEndpoints) == 0 {
+			continue
+		}
+		for _, code := range h.codes {
+			router.SetHandler(code, router.grpcClient.RadiusHandler(grpcEndpoints, HTTP_TIMEOUT_SECONDS*time.Second))
+		}
+	}
+}
+
+// Sets the handler for the Disconnect-Request and CoA-Request
+func (router *RadiusRouter) SetDynAuthHandler(handler DynAuthHandler) {
+	dynAuthHandler := func(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+		honoured, errorCause, err := handler(request)
+		if err != nil {
+			return nil, err
+		}
+		return newDynAuthResponse(request, honoured, errorCause), nil
+	}
+	router.SetHandler(radiuscodec.DISCONNECT_REQUEST, dynAuthHandler)
+	router.SetHandler(radiuscodec.COA_REQUEST, dynAuthHandler)
+}
+
+// Handles the request with the handler registered for its code, unless a proxy rule applies to it, in which
+// case it is sent upstream. The Disconnect-Request and CoA-Request without handler are answered with a NAK,
+// and the other requests are discarded
+func (router *RadiusRouter) HandleRadiusRequest(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+	return router.HandleRadiusRequestWithContext(context.Background(), request)
+}
+
+// Same as HandleRadiusRequest, but the requests proxied upstream are abandoned when the context is done
+func (router *RadiusRouter) HandleRadiusRequestWithContext(ctx context.Context, request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+	response, err := router.dispatchRadiusRequest(ctx, request)
+	if err == nil && response != nil && response.Code == radiuscodec.ACCESS_ACCEPT {
+		return router.checkSimultaneousUse(request, response), nil
+	}
+	return response, err
+}
+
+// Sends the request upstream, if a proxy rule or realm applies to it, or to the handler registered for its code
+func (router *RadiusRouter) dispatchRadiusRequest(ctx context.Context, request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+	if rule, found := router.findProxyRule(request); found {
+		return router.proxyRadiusRequest(ctx, rule, request)
+	}
+	if realm, userName, found := router.findRealm(request); found && realm.ServerGroup != "" {
+		return router.proxyRealmRequest(ctx, realm, userName, request)
+	}
+
+	router.handlersMutex.RLock()
+	handler, found := router.handlers[request.Code]
+	router.handlersMutex.RUnlock()
+
+	if found {
+		return handler(request)
+	}
+	if request.Code == radiuscodec.DISCONNECT_REQUEST || request.Code == radiuscodec.COA_REQUEST {
+		return newDynAuthResponse(request, false, radiuscodec.ERROR_CAUSE_UNSUPPORTED_SERVICE), nil
+	}
+	return nil, fmt.Errorf("no handler for radius code %d: %w", request.Code, core.ErrRouteNotFound)
+}
+
+// Sets the session store used to enforce the simultaneous use limit on the Access-Requests, which must have
+// a User-Name index, and the sender of the Disconnect-Requests for the "disconnectOldest" action
+func (router *RadiusRouter) SetSessionStore(store *sessionserver.RadiusSessionStore, sender sessionserver.PacketSender) {
+	router.sessionMutex.Lock()
+	defer router.sessionMutex.Unlock()
+	router.sessionStore = store
+	router.disconnect = nil
+	if sender != nil {
+		router.disconnect = sessionserver.NewDisconnectFunc(router.ci, sender)
+	}
+}
+
+// Returns the response to send, which is an Access-Reject instead of the Access-Accept if the User-Name
+// has already the maximum number of sessions and the oldest ones could not be disconnected
+func (router *RadiusRouter) checkSimultaneousUse(request *radiuscodec.RadiusPacket, response *radiuscodec.RadiusPacket) *radiuscodec.RadiusPacket {
+	router.sessionMutex.RLock()
+	store, disconnect := router.sessionStore, router.disconnect
+	router.sessionMutex.RUnlock()
+	if store == nil {
+		return response
+	}
+
+	if err := sessionserver.CheckSimultaneousUse(store, router.ci.SimultaneousUseConf(), request.GetStringAVP("User-Name"), disconnect); err != nil {
+		routerLogger().Infof("rejecting access request: %s", err)
+		reject := radiuscodec.NewRadiusResponse(request, false)
+		reject.Add("Reply-Message", "simultaneous use limit exceeded")
+		return reject
+	}
+	return response
+}
+
+// Builds the ACK or the NAK, with the Error-Cause if not zero
+func newDynAuthResponse(request *radiuscodec.RadiusPacket, honoured bool, errorCause int) *radiuscodec.RadiusPacket {
+	response := radiuscodec.NewRadiusResponse(request, honoured)
+	if !honoured && errorCause != 0 {
+		response.Add("Error-Cause", errorCause)
+	}
+	return response
+}
+
+// Sends the requests to the upstream radius servers
+type radiusExchanger interface {
+	RadiusExchangeWithContext(ctx context.Context, endpoint string, rp *radiuscodec.RadiusPacket, timeout time.Duration, secret string, rc chan interface{})
+}
+
+// Sets the socket used to send the requests to the upstream radius servers
+func (router *RadiusRouter) SetRadiusClientSocket(rcs *radiusClient.RadiusClientSocket) {
+	router.clientMutex.Lock()
+	defer router.clientMutex.Unlock()
+	router.client = rcs
+}
+
+// Sets the pool of sockets used to send the requests to the upstream radius servers
+func (router *RadiusRouter) SetRadiusClient(rc *radiusClient.RadiusClient) {
+	router.clientMutex.Lock()
+	defer router.clientMutex.Unlock()
+	router.client = rc
+}
+
+// Sends the request to the radius server group or server with the specified name and returns the response.
+// The servers of the group are tried in the order given by its policy, each one with the specified timeout.
+// If no response is obtained, or after the configured number of timeouts, the request is sent to the
+// secondary group, if any
+func (router *RadiusRouter) RouteRadiusRequest(request *radiuscodec.RadiusPacket, destination string, timeout time.Duration) (*radiuscodec.RadiusPacket, error) {
+	return router.RouteRadiusRequestWithContext(context.Background(), request, destination, timeout)
+}
+
+// Same as RouteRadiusRequest, but no more servers are tried after the context is done, and the wait for the response
+// is abandoned. The timeout for each server is reduced if the deadline of the context would expire before
+func (router *RadiusRouter) RouteRadiusRequestWithContext(ctx context.Context, request *radiuscodec.RadiusPacket, destination string, timeout time.Duration) (*radiuscodec.RadiusPacket, error) {
+	router.clientMutex.RLock()
+	rcs := router.client
+	router.clientMutex.RUnlock()
+	if rcs == nil {
+		return nil, fmt.Errorf("no radius client socket to send the request to %s: %w", destination, core.ErrNoPeerAvailable)
+	}
+
+	lastError := fmt.Errorf("no radius server available for %s: %w", destination, core.ErrNoPeerAvailable)
+	visited := make(map[string]bool)
+	for destination != "" && !visited[destination] {
+		visited[destination] = true
+
+		serversConf := router.ci.RadiusServersConf()
+		group, found := serversConf.ServerGroups[destination]
+		if !found {
+			if _, found := serversConf.Servers[destination]; !found {
+				return nil, fmt.Errorf("radius server or group %s not found: %w", destination, core.ErrRouteNotFound)
+			}
+			group = config.RadiusServerGroup{Name: destination, Servers: []string{destination}, Policy: "fixed"}
+		}
+
+		rc := make(chan []config.RadiusServer, 1)
+		if !router.sendControl(RadiusServersSelectionQuery{Group: group, Request: request, Timeout: timeout, RChan: rc}) {
+			return nil, fmt.Errorf("radius router closed: %w", core.ErrNoPeerAvailable)
+		}
+		timeouts := 0
+		for _, server := range <-rc {
+			if ctx.Err() != nil {
+				return nil, core.ContextError(ctx)
+			}
+			response, err := router.sendToServer(ctx, rcs, server, request, time.Until(core.EarliestDeadline(ctx, time.Now().Add(timeout))))
+			if err == nil {
+				return response, nil
+			}
+			lastError = err
+			if errors.Is(err, core.ErrTimeout) {
+				timeouts++
+				if group.EscalateAfterTimeouts > 0 && timeouts >= group.EscalateAfterTimeouts {
+					break
+				}
+			}
+		}
+
+		if group.SecondaryGroup != "" {
+			routerLogger().Debugf("escalating radius request from %s to %s", group.Name, group.SecondaryGroup)
+		}
+		destination = group.SecondaryGroup
+	}
+
+	return nil, lastError
+}
+
+// Sends the request to the port of the server for its code, and reports the result to the event loop. If the
+// context is done before the response is received, the result is not reported
+func (router *RadiusRouter) sendToServer(ctx context.Context, rcs radiusExchanger, server config.RadiusServer, request *radiuscodec.RadiusPacket, timeout time.Duration) (_ *radiuscodec.RadiusPacket, err error) {
+	port := server.AuthPort
+	switch request.Code {
+	case radiuscodec.ACCOUNTING_REQUEST:
+		port = server.AcctPort
+	case radiuscodec.DISCONNECT_REQUEST, radiuscodec.COA_REQUEST:
+		port = server.COAPort
+	}
+
+	// The responses are matched using the address they come from, so the name must be resolved
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(server.IPAddress, strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("bad address of radius server %s: %w", server.Name, err)
+	}
+
+	ctx, span := telemetry.StartClientSpan(ctx, "radius send", attribute.String("radius.server", server.Name))
+	defer func() { telemetry.EndSpan(span, err) }()
+	request = telemetry.InjectRadius(ctx, request, router.ci.RadiusServerConf().TraceContextAttribute)
+
+	rc := make(chan interface{}, 1)
+	rcs.RadiusExchangeWithContext(ctx, addr.String(), request, timeout, server.Secret, rc)
+
+	// The response channel is buffered, so the exchange may finish after giving up
+	var response interface{}
+	select {
+	case response = <-rc:
+	case <-ctx.Done():
+		return nil, core.ContextError(ctx)
+	}
+
+	switch v := response.(type) {
+	case *radiuscodec.RadiusPacket:
+		router.sendControl(RadiusServerResultEvent{ServerName: server.Name})
+		return v, nil
+	case error:
+		router.sendControl(RadiusServerResultEvent{ServerName: server.Name, IsTimeout: errors.Is(v, core.ErrTimeout)})
+		return nil, v
+	default:
+		return nil, fmt.Errorf("unexpected response from radius server %s: %v", server.Name, v)
+	}
+}
+
+// Puts the radius server in quarantine for the specified time, or the one in its configuration if zero
+func (router *RadiusRouter) QuarantineServer(serverName string, duration time.Duration) error {
+	rc := make(chan error, 1)
+	if !router.sendControl(RadiusServerQuarantineCommand{ServerName: serverName, Duration: duration, RChan: rc}) {
+		return fmt.Errorf("radius router closed")
+	}
+	return <-rc
+}
+
+// Returns the status of the radius servers
+func (router *RadiusRouter) ServersTable() []RadiusServerWithStatus {
+	rc := make(chan []RadiusServerWithStatus, 1)
+	if !router.sendControl(RadiusServersTableQuery{RChan: rc}) {
+		return nil
+	}
+	return <-rc
+}
+
+// Returns the last transitions of the radius servers between states, oldest first
+func (router *RadiusRouter) ServerTransitions() []RadiusServerTransition {
+	rc := make(chan []RadiusServerTransition, 1)
+	if !router.sendControl(RadiusServerTransitionsQuery{RChan: rc}) {
+		return nil
+	}
+	return <-rc
+}
+
+// Stops the event loop and closes the RouterDoneChannel. Afterwards, the requests are not
+// routed to the upstream servers and the queries return empty results
+func (router *RadiusRouter) Close() {
+	router.sendControl(RouterCloseCommand{})
+}
+
+// Sends the message to the event loop. Returns false if the router has shut down
+func (router *RadiusRouter) sendControl(message interface{}) bool {
+	select {
+	case router.routerControlChannel <- message:
+		return true
+	case <-router.RouterDoneChannel:
+		return false
+	}
+}
+
 func (router *RadiusRouter) eventLoop() {
+
+	router.updateRadiusServersTable()
+
+	for {
+		select {
+		case <-router.probeTicker.C:
+			router.probeRadiusServers()
+
+		case m := <-router.routerControlChannel:
+			switch v := m.(type) {
+			case RouterCloseCommand:
+				atomic.StoreInt32(&router.status, StatusClosing)
+				router.probeTicker.Stop()
+				router.grpcClient.Close()
+				close(router.RouterDoneChannel)
+				return
+
+			case RadiusServerQuarantineCommand:
+				router.updateRadiusServersTable()
+				serverStatus, found := router.radiusServersTable[v.ServerName]
+				if !found {
+					v.RChan <- fmt.Errorf("radius server %s not configured", v.ServerName)
+					break
+				}
+				duration := v.Duration
+				if duration == 0 {
+					duration = time.Duration(router.ci.RadiusServersConf().Servers[v.ServerName].QuarantineTimeSeconds) * time.Second
+				}
+				serverStatus.UnavailableUntil = time.Now().Add(duration)
+				router.setServerState(&serverStatus, RADIUS_SERVER_QUARANTINE, fmt.Sprintf("administrator command until %s", serverStatus.UnavailableUntil))
+				router.radiusServersTable[v.ServerName] = serverStatus
+				v.RChan <- nil
+
+			case RadiusServersSelectionQuery:
+				router.updateRadiusServersTable()
+				v.RChan <- router.reserveCanary(router.selectRadiusServers(v.Group, v.Request), v.Timeout)
+
+			case RadiusServerResultEvent:
+				serverStatus, found := router.radiusServersTable[v.ServerName]
+				if !found {
+					break
+				}
+				serverStatus.CanaryUntil = time.Time{}
+				serverConf := router.ci.RadiusServersConf().Servers[v.ServerName]
+				if !v.IsTimeout {
+					serverStatus.ConsecutiveTimeouts = 0
+					if serverStatus.State == RADIUS_SERVER_RECOVERING {
+						serverStatus.CanaryRequestsAnswered++
+						if serverStatus.CanaryRequestsAnswered >= serverConf.CanaryRequests {
+							router.setServerState(&serverStatus, RADIUS_SERVER_AVAILABLE, fmt.Sprintf("%d canary requests answered", serverStatus.CanaryRequestsAnswered))
+						}
+					}
+					router.radiusServersTable[v.ServerName] = serverStatus
+					break
+				}
+				serverStatus.ConsecutiveTimeouts++
+				serverStatus.LastError = core.ErrTimeout
+				if serverStatus.State == RADIUS_SERVER_RECOVERING {
+					router.quarantine(&serverStatus, serverConf, "timeout of canary request")
+				} else if serverStatus.IsAvailable && serverConf.ErrorLimit > 0 && serverStatus.ConsecutiveTimeouts >= serverConf.ErrorLimit {
+					router.quarantine(&serverStatus, serverConf, fmt.Sprintf("%d timeouts", serverConf.ErrorLimit))
+				}
+				router.radiusServersTable[v.ServerName] = serverStatus
+
+			case RadiusServerProbeEvent:
+				serverStatus, found := router.radiusServersTable[v.ServerName]
+				if !found || serverStatus.State != RADIUS_SERVER_QUARANTINE || time.Now().Before(serverStatus.UnavailableUntil) {
+					break
+				}
+				router.endQuarantine(&serverStatus, "Status-Server answered")
+				router.radiusServersTable[v.ServerName] = serverStatus
+
+			case RadiusServerTransitionsQuery:
+				v.RChan <- append([]RadiusServerTransition(nil), router.transitions...)
+
+			case RadiusServersTableQuery:
+				router.updateRadiusServersTable()
+				table := make([]RadiusServerWithStatus, 0, len(router.radiusServersTable))
+				for _, serverStatus := range router.radiusServersTable {
+					table = append(table, serverStatus)
+				}
+				v.RChan <- table
+			}
+		}
+	}
+}
+
+// Adds the newly configured servers, removes the ones no longer configured and
+// finishes the expired quarantines of the servers that are not probed
+func (router *RadiusRouter) updateRadiusServersTable() {
+	servers := router.ci.RadiusServersConf().Servers
+	for serverName := range router.radiusServersTable {
+		if _, found := servers[serverName]; !found {
+			delete(router.radiusServersTable, serverName)
+		}
+	}
+
+	now := time.Now()
+	for serverName := range servers {
+		serverStatus, found := router.radiusServersTable[serverName]
+		if !found {
+			router.radiusServersTable[serverName] = RadiusServerWithStatus{ServerName: serverName, State: RADIUS_SERVER_AVAILABLE, IsAvailable: true, LastStatusChange: now}
+			instrumentation.PushRadiusServerStateChange(router.instanceName, serverName, "", RADIUS_SERVER_AVAILABLE)
+		} else if serverStatus.State == RADIUS_SERVER_QUARANTINE && servers[serverName].StatusServerIntervalSeconds == 0 && now.After(serverStatus.UnavailableUntil) {
+			router.endQuarantine(&serverStatus, "quarantine expired")
+			router.radiusServersTable[serverName] = serverStatus
+		}
+	}
+}
+
+// Puts the server in quarantine for the configured time or, if probed, until it answers the Status-Server
+func (router *RadiusRouter) quarantine(serverStatus *RadiusServerWithStatus, serverConf config.RadiusServer, reason string) {
+	serverStatus.ConsecutiveTimeouts = 0
+	if serverConf.StatusServerIntervalSeconds > 0 {
+		// Probing starts right away
+		serverStatus.UnavailableUntil = time.Now()
+		router.setServerState(serverStatus, RADIUS_SERVER_QUARANTINE, reason+", until answering Status-Server")
+	} else {
+		serverStatus.UnavailableUntil = time.Now().Add(time.Duration(serverConf.QuarantineTimeSeconds) * time.Second)
+		router.setServerState(serverStatus, RADIUS_SERVER_QUARANTINE, fmt.Sprintf("%s, until %s", reason, serverStatus.UnavailableUntil))
+	}
+}
+
+// The server is recovering if canary requests are configured, or available otherwise
+func (router *RadiusRouter) endQuarantine(serverStatus *RadiusServerWithStatus, reason string) {
+	if router.ci.RadiusServersConf().Servers[serverStatus.ServerName].CanaryRequests > 0 {
+		serverStatus.CanaryRequestsAnswered = 0
+		serverStatus.CanaryUntil = time.Time{}
+		router.setServerState(serverStatus, RADIUS_SERVER_RECOVERING, reason)
+	} else {
+		router.setServerState(serverStatus, RADIUS_SERVER_AVAILABLE, reason)
+	}
+}
+
+// Changes the state of the server, recording the transition and reporting it to the MetricsServer
+func (router *RadiusRouter) setServerState(serverStatus *RadiusServerWithStatus, state string, reason string) {
+	transition := RadiusServerTransition{ServerName: serverStatus.ServerName, From: serverStatus.State, To: state, Time: time.Now(), Reason: reason}
+
+	serverStatus.State = state
+	serverStatus.IsAvailable = state != RADIUS_SERVER_QUARANTINE
+	serverStatus.LastStatusChange = transition.Time
+
+	if state == RADIUS_SERVER_QUARANTINE {
+		routerLogger().Warnf("radius server %s from %s to %s: %s", transition.ServerName, transition.From, state, reason)
+	} else {
+		routerLogger().Infof("radius server %s from %s to %s: %s", transition.ServerName, transition.From, state, reason)
+	}
+	instrumentation.PushRadiusServerStateChange(router.instanceName, transition.ServerName, transition.From, state)
+
+	router.transitions = append(router.transitions, transition)
+	if len(router.transitions) > RADIUS_SERVER_TRANSITIONS_SIZE {
+		router.transitions = router.transitions[len(router.transitions)-RADIUS_SERVER_TRANSITIONS_SIZE:]
+	}
+}
+
+// Makes the first server of the list, if recovering, not selectable for other requests until the result of this
+// one is reported or the timeout expires, and removes the other recovering servers, so that only one canary
+// request is outstanding
+func (router *RadiusRouter) reserveCanary(servers []config.RadiusServer, timeout time.Duration) []config.RadiusServer {
+	selected := make([]config.RadiusServer, 0, len(servers))
+	for i, server := range servers {
+		serverStatus := router.radiusServersTable[server.Name]
+		if serverStatus.State == RADIUS_SERVER_RECOVERING {
+			if i > 0 {
+				continue
+			}
+			serverStatus.CanaryUntil = time.Now().Add(timeout)
+			router.radiusServersTable[server.Name] = serverStatus
+		}
+		selected = append(selected, server)
+	}
+	return selected
+}
+
+// Sends a Status-Server to the servers in quarantine that are probed, if the interval has elapsed since the last one
+func (router *RadiusRouter) probeRadiusServers() {
+	router.updateRadiusServersTable()
+
+	servers := router.ci.RadiusServersConf().Servers
+	now := time.Now()
+	for serverName, serverStatus := range router.radiusServersTable {
+		serverConf := servers[serverName]
+		interval := time.Duration(serverConf.StatusServerIntervalSeconds) * time.Second
+		if serverStatus.State != RADIUS_SERVER_QUARANTINE || interval == 0 || now.Before(serverStatus.UnavailableUntil) || now.Sub(serverStatus.LastProbe) < interval {
+			continue
+		}
+		serverStatus.LastProbe = now
+		router.radiusServersTable[serverName] = serverStatus
+		go router.probeRadiusServer(serverConf, interval)
+	}
+}
+
+// Sends a Status-Server to the authentication port of the server, waiting for the response at most the
+// specified time, and reports to the event loop if answered
+func (router *RadiusRouter) probeRadiusServer(server config.RadiusServer, timeout time.Duration) {
+	router.clientMutex.RLock()
+	rcs := router.client
+	router.clientMutex.RUnlock()
+	if rcs == nil {
+		return
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(server.IPAddress, strconv.Itoa(server.AuthPort)))
+	if err != nil {
+		routerLogger().Errorf("bad address of radius server %s: %s", server.Name, err)
+		return
+	}
+
+	request := radiuscodec.NewRadiusRequest(radiuscodec.STATUS_SERVER)
+	request.Add("Message-Authenticator", make([]byte, 16))
+	rc := make(chan interface{}, 1)
+	rcs.RadiusExchangeWithContext(context.Background(), addr.String(), request, timeout, server.Secret, rc)
+	if err, ok := (<-rc).(error); ok {
+		routerLogger().Debugf("radius server %s not answering Status-Server: %s", server.Name, err)
+		return
+	}
+	router.sendControl(RadiusServerProbeEvent{ServerName: server.Name})
 }
@@ -0,0 +1,50 @@
+package router
+
+import (
+	"igor/diamcodec"
+)
+
+// Treatment of the requests received from peers that are forwarded to other peers, when acting as relay or
+// proxy agent as specified in RFC 6733 section 6. The agent mode is set in the diameter server configuration
+
+// Returns true if the request has already gone through the node with the specified Diameter-Host, that is,
+// if it is in one of its Route-Record AVPs
+func isRoutingLoop(request *diamcodec.DiameterMessage, diameterHost string) bool {
+	for _, routeRecord := range request.GetAllAVP("Route-Record") {
+		if routeRecord.GetString() == diameterHost {
+			return true
+		}
+	}
+	return false
+}
+
+// Builds the copy of the request received from a peer to be forwarded to another one, with the Route-Record
+// of the peer appended and a new Hop-by-Hop Identifier and, if acting as proxy, the Origin-Host and
+// Origin-Realm of this node. Returns a Result-Code different from zero if the request may not be forwarded
+func (router *DiameterRouter) newForwardedRequest(request *diamcodec.DiameterMessage, agentMode string) (*diamcodec.DiameterMessage, int) {
+	if !request.IsProxyable {
+		return nil, diamcodec.DIAMETER_UNABLE_TO_DELIVER
+	}
+
+	// The original request may be referenced by a transform or handler
+	forwarded := *request
+	forwarded.AVPs = append(make([]diamcodec.DiameterAVP, 0, len(request.AVPs)+1), request.AVPs...)
+	forwarded.HopByHopId = diamcodec.NewHopByHopId()
+	forwarded.Add("Route-Record", request.ReceivedFrom())
+
+	if agentMode == "proxy" {
+		forwarded.DeleteAllAVP("Origin-Host").DeleteAllAVP("Origin-Realm").AddOriginAVPs(router.ci)
+	}
+	return &forwarded, 0
+}
+
+// Builds the answer for a request that could not be routed, with the E bit set
+func (router *DiameterRouter) newProtocolErrorAnswer(request *diamcodec.DiameterMessage, resultCode int) *diamcodec.DiameterMessage {
+	answer := diamcodec.NewDiameterAnswer(request)
+	answer.IsError = true
+	answer.Add("Session-Id", request.GetStringAVP("Session-Id"))
+	answer.AddOriginAVPs(router.ci)
+	answer.Add("Result-Code", resultCode)
+	answer.Add("Error-Reporting-Host", router.ci.DiameterServerConf().DiameterHost)
+	return answer
+}
@@ -1,5 +1,12 @@
 package router
 
+import (
+	"igor/config"
+	"igor/diampeer"
+	"igor/radiuscodec"
+	"time"
+)
+
 // Statuses of the Router
 const (
 	StatusOperational = int32(0)
@@ -21,6 +28,85 @@ const PEER_CONTROL_QUEUE_SIZE = 16
 // Timeout in seconds for http2 handlers
 const HTTP_TIMEOUT_SECONDS = 10
 
+// Default time budget for answering the requests received from diameter peers,
+// if not specified in the configuration
+const DEFAULT_INGRESS_TIMEOUT_MILLIS = 10000
+
+// Default timeout for each upstream server tried when proxying radius requests, if not
+// specified in the proxy rule
+const DEFAULT_RADIUS_PROXY_TIMEOUT_MILLIS = 5000
+
+// Default limits of the time to wait before reconnecting to an active or lazy peer, if not
+// specified in the configuration
+const DEFAULT_PEER_RECONNECT_MIN_MILLIS = 1000
+const DEFAULT_PEER_RECONNECT_MAX_MILLIS = 60000
+const DEFAULT_PEER_RECONNECT_JITTER_PERCENT = 50
+
+// Interval for checking whether there are peers to reconnect
+const PEER_RECONNECT_CHECK_MILLIS = 500
+
+// Interval for checking whether there are radius servers in quarantine to send a Status-Server
+const RADIUS_PROBE_CHECK_MILLIS = 1000
+
+// Number of transitions of the radius servers between states that are kept
+const RADIUS_SERVER_TRANSITIONS_SIZE = 100
+
 // Message to be sent for orderly shutdown of the Router
 type RouterCloseCommand struct {
 }
+
+// Time to wait for each peer to report its outstanding requests or its statistics
+const OUTSTANDING_REQUESTS_QUERY_MILLIS = 500
+
+// Message to be sent to force the disconnection of a diameter peer. The result is sent to the RChan
+type PeerDisconnectCommand struct {
+	DiameterHost string
+	RChan        chan error
+}
+
+// Message to be sent to get the outstanding requests of the peers that are up, by Diameter-Host
+type OutstandingRequestsQuery struct {
+	RChan chan map[string][]diampeer.OutstandingRequest
+}
+
+// Message to be sent to get the peers table with the live data of the peers that are up
+type PeersDetailQuery struct {
+	RChan chan []DiameterPeerDetail
+}
+
+// Message to be sent to put a radius server in quarantine. The result is sent to the RChan
+type RadiusServerQuarantineCommand struct {
+	ServerName string
+	Duration   time.Duration
+	RChan      chan error
+}
+
+// Message to be sent to get the status of the radius servers
+type RadiusServersTableQuery struct {
+	RChan chan []RadiusServerWithStatus
+}
+
+// Message to be sent to get the servers of a radius group to try for a request, in order. The Timeout
+// is the time to wait for the response of each server
+type RadiusServersSelectionQuery struct {
+	Group   config.RadiusServerGroup
+	Request *radiuscodec.RadiusPacket
+	Timeout time.Duration
+	RChan   chan []config.RadiusServer
+}
+
+// Message to be sent to get the last transitions of the radius servers between states
+type RadiusServerTransitionsQuery struct {
+	RChan chan []RadiusServerTransition
+}
+
+// Message to be sent to report the result of a request sent to a radius server
+type RadiusServerResultEvent struct {
+	ServerName string
+	IsTimeout  bool
+}
+
+// Message to be sent to report that a radius server in quarantine answered a Status-Server
+type RadiusServerProbeEvent struct {
+	ServerName string
+}
@@ -2,13 +2,22 @@ package router
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"igor/config"
+	"igor/core"
 	"igor/diamcodec"
 	"igor/handlerfunctions"
 	"igor/httphandler"
 	"igor/instrumentation"
+	radiusClient "igor/radiusclient"
+	"igor/radiuscodec"
+	"igor/radiusserver"
+	"igor/sessionserver"
 	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -21,6 +30,7 @@ func TestMain(m *testing.M) {
 	config.InitPolicyConfigInstance("resources/searchRules.json", "testSuperServer", false)
 	config.InitPolicyConfigInstance("resources/searchRules.json", "testClientUnknownClient", false)
 	config.InitPolicyConfigInstance("resources/searchRules.json", "testClientUnknownServer", false)
+	config.InitPolicyConfigInstance("resources/searchRules.json", "testLazyClient", false)
 	config.InitHandlerConfigInstance("resources/searchRules.json", "testServer", false)
 
 	// Execute the tests and exit
@@ -105,6 +115,20 @@ func TestBasicSetup(t *testing.T) {
 		t.Error("server.igorserver engaged in unknownserver peers table")
 	}
 
+	// Live data of the peers that are up
+	for _, detail := range clientRouter.PeersDetail() {
+		switch detail.DiameterHost {
+		case "server.igorserver":
+			if detail.Statistics == nil || detail.Statistics.Status != "engaged" || detail.Statistics.RequestsSent == 0 {
+				t.Errorf("bad live data for server.igorserver %v", detail.Statistics)
+			}
+		case "unreachableserver.igorserver":
+			if detail.Statistics != nil && detail.Statistics.Status == "engaged" {
+				t.Errorf("unreachableserver.igorserver reported as engaged")
+			}
+		}
+	}
+
 	// Close Routers
 	serverRouter.Close()
 	<-serverRouter.RouterDoneChannel
@@ -144,6 +168,17 @@ func TestRouteMessage(t *testing.T) {
 	request.AddOriginAVPs(config.GetPolicyConfig())
 	request.Add("Destination-Realm", "igorsuperserver")
 	request.Add("User-Name", "TestUserNameRequest")
+
+	// Request with exhausted time budget is not sent
+	if _, err := client.RouteDiameterRequest(request, 0); !errors.Is(err, core.ErrTimeout) {
+		t.Fatalf("request with zero timeout was routed or got unexpected error %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	bm := instrumentation.MS.DiameterQuery("DiameterBudgetExhausted", nil, []string{})
+	if bm[instrumentation.PeerDiameterMetricKey{}] != 1 {
+		t.Errorf("DiameterBudgetExhausted was not 1")
+	}
+
 	response, err := client.RouteDiameterRequest(request, time.Duration(1000*time.Millisecond))
 	if err != nil {
 		t.Fatalf("route message returned error %s", err)
@@ -160,6 +195,270 @@ func TestRouteMessage(t *testing.T) {
 	if hm[instrumentation.HttpHandlerMetricKey{}] != 1 {
 		t.Fatalf("Handler Exchanges was not 1")
 	}
+
+	// Fan-out to one engaged and one not engaged peer
+	peers := []string{"unreachableserver.igorserver", "server.igorserver"}
+	answers, err := client.FanOutDiameterRequest(request, peers, 1, 1000*time.Millisecond)
+	if err != nil {
+		t.Fatalf("fan-out returned error %s", err)
+	} else if len(answers) != 1 || answers[0].GetIntAVP("Result-Code") != diamcodec.DIAMETER_SUCCESS {
+		t.Fatalf("bad fan-out answers %v", answers)
+	}
+	if _, err := client.FanOutDiameterRequest(request, peers, 2, 1000*time.Millisecond); !errors.Is(err, core.ErrNoPeerAvailable) {
+		t.Fatalf("fan-out quorum reached with a not engaged peer or got unexpected error %v", err)
+	}
+
+	// Unroutable request in the server, answered with DIAMETER_UNABLE_TO_DELIVER
+	gxRequest, _ := diamcodec.NewDiameterRequest("Gx", "Credit-Control")
+	gxRequest.Add("Session-Id", "unroutable-session")
+	gxRequest.AddOriginAVPs(config.GetPolicyConfig())
+	gxRequest.Add("Destination-Realm", "unknownrealm")
+	response, err = client.RouteDiameterRequest(gxRequest, 1000*time.Millisecond)
+	if err != nil {
+		t.Fatalf("unroutable request returned error %s", err)
+	}
+	if response.GetResultCode() != diamcodec.DIAMETER_UNABLE_TO_DELIVER || !response.IsError || response.GetStringAVP("Error-Reporting-Host") != "server.igorserver" {
+		t.Errorf("bad answer to unroutable request %s", response)
+	}
+
+	// Unroutable request in the server, dropped
+	accRequest, _ := diamcodec.NewDiameterRequest("Accounting", "Accounting")
+	accRequest.AddOriginAVPs(config.GetPolicyConfig())
+	accRequest.Add("Destination-Realm", "unknownrealm")
+	if _, err := client.RouteDiameterRequest(accRequest, 300*time.Millisecond); !errors.Is(err, core.ErrTimeout) {
+		t.Errorf("dropped request got %v", err)
+	}
+
+	// Not answered in the try timeout, and the alternate peer is not engaged
+	failoverRequest, _ := diamcodec.NewDiameterRequest("Accounting", "Accounting")
+	failoverRequest.AddOriginAVPs(config.GetPolicyConfig())
+	failoverRequest.Add("Destination-Realm", "igorfailover")
+	start := time.Now()
+	if _, err := client.RouteDiameterRequest(failoverRequest, 2000*time.Millisecond); !errors.Is(err, core.ErrTimeout) {
+		t.Errorf("request without answer got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 1000*time.Millisecond {
+		t.Errorf("request was not retransmitted after the try timeout, but after %s", elapsed)
+	}
+	if failoverRequest.IsRetransmission {
+		t.Errorf("original request modified")
+	}
+	time.Sleep(100 * time.Millisecond)
+	fm := instrumentation.MS.DiameterQuery("DiameterFailover", nil, []string{"Peer"})
+	if fm[instrumentation.PeerDiameterMetricKey{Peer: "server.igorserver"}] != 1 {
+		t.Errorf("DiameterFailover was not 1 %v", fm)
+	}
+}
+
+// Uses the testServer Router and the handler started in TestRouteMessage
+func TestLazyConnection(t *testing.T) {
+
+	client := NewRouter("testLazyClient")
+	time.Sleep(200 * time.Millisecond)
+
+	// Not connected at startup
+	if findPeer("server.igorserver", instrumentation.MS.PeersTableQuery()["testLazyClient"]).IsEngaged {
+		t.Fatal("lazy peer engaged before routing any request")
+	}
+
+	// The first request waits for the connection
+	request, _ := diamcodec.NewDiameterRequest("TestApplication", "TestRequest")
+	request.AddOriginAVPs(config.GetPolicyConfigInstance("testLazyClient"))
+	request.Add("Destination-Realm", "igorserver")
+	request.Add("User-Name", "TestUserNameRequest")
+	response, err := client.RouteDiameterRequest(request, 2000*time.Millisecond)
+	if err != nil {
+		t.Fatalf("request to lazy peer returned error %s", err)
+	} else if response.GetIntAVP("Result-Code") != diamcodec.DIAMETER_SUCCESS {
+		t.Fatalf("Result-Code not succes %d", response.GetIntAVP("Result-Code"))
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !findPeer("server.igorserver", instrumentation.MS.PeersTableQuery()["testLazyClient"]).IsEngaged {
+		t.Error("lazy peer not engaged after routing a request")
+	}
+
+	// The connection to the unreachable peer fails, and is not retried until the wait expires
+	request.DeleteAllAVP("Destination-Realm")
+	request.Add("Destination-Realm", "unreachable")
+	if _, err := client.RouteDiameterRequest(request, 2000*time.Millisecond); !errors.Is(err, core.ErrNoPeerAvailable) {
+		t.Errorf("request to unreachable lazy peer got %v", err)
+	}
+	start := time.Now()
+	if _, err := client.RouteDiameterRequest(request, 2000*time.Millisecond); !errors.Is(err, core.ErrNoPeerAvailable) || time.Since(start) > 50*time.Millisecond {
+		t.Errorf("request to unreachable lazy peer during reconnection wait got %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	unreachablePeer := findPeer("unreachable.igorserver", instrumentation.MS.PeersTableQuery()["testLazyClient"])
+	if unreachablePeer.ConnectionFailures != 1 || !unreachablePeer.NextConnectionAttempt.After(start) {
+		t.Errorf("bad reconnection data in peers table %+v", unreachablePeer)
+	}
+
+	// The wait is randomized and limited. Server defaults are 200 to 1000 millis with 50% jitter,
+	// and the unreachable peer overrides them with 400 to 3000 millis with 25% jitter
+	peersConf := config.GetPolicyConfigInstance("testLazyClient").PeersConf()
+	for failures := 0; failures < 10; failures++ {
+		delay := client.reconnectDelay(peersConf["server.igorserver"], failures)
+		if delay > time.Second || (failures <= 1 && (delay < 100*time.Millisecond || delay > 200*time.Millisecond)) {
+			t.Errorf("bad reconnect delay %s after %d failures", delay, failures)
+		}
+		delay = client.reconnectDelay(peersConf["unreachable.igorserver"], failures)
+		if delay > 3*time.Second || (failures <= 1 && (delay < 300*time.Millisecond || delay > 400*time.Millisecond)) {
+			t.Errorf("bad reconnect delay %s for unreachable peer after %d failures", delay, failures)
+		}
+	}
+
+	// Operations on the connected peer
+	if requests, found := client.OutstandingRequests()["server.igorserver"]; !found || len(requests) != 0 {
+		t.Errorf("bad outstanding requests %v", requests)
+	}
+	if err := client.DisconnectPeer("unreachable.igorserver"); !errors.Is(err, core.ErrNoPeerAvailable) {
+		t.Errorf("disconnection of not connected peer got %v", err)
+	}
+	if err := client.DisconnectPeer("server.igorserver"); err != nil {
+		t.Errorf("disconnection of lazy peer got %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if findPeer("server.igorserver", instrumentation.MS.PeersTableQuery()["testLazyClient"]).IsEngaged {
+		t.Error("lazy peer engaged after being disconnected")
+	}
+
+	client.Close()
+	<-client.RouterDoneChannel
+}
+
+func TestFanOut(t *testing.T) {
+
+	isSuccess := func(response interface{}) bool { return response == "ok" }
+
+	// The first successful answer wins, without waiting for the slow destination, which is cancelled
+	start := time.Now()
+	cancelled := make(chan error, 1)
+	responses, err := fanOut(context.Background(), 3, 1, time.Second, func(ctx context.Context, index int, rc chan interface{}) {
+		switch index {
+		case 0:
+			rc <- errors.New("failed")
+		case 1:
+			go func() {
+				select {
+				case <-ctx.Done():
+					cancelled <- ctx.Err()
+				case <-time.After(500 * time.Millisecond):
+					rc <- "ok"
+				}
+			}()
+		case 2:
+			time.Sleep(50 * time.Millisecond)
+			rc <- "ok"
+		}
+	}, isSuccess)
+	if err != nil || len(responses) != 1 {
+		t.Fatalf("bad fan-out result %v %s", responses, err)
+	}
+	if time.Since(start) > 400*time.Millisecond {
+		t.Error("fan-out waited for the slow destination")
+	}
+	select {
+	case err := <-cancelled:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("slow destination got %s", err)
+		}
+	case <-time.After(400 * time.Millisecond):
+		t.Error("slow destination not cancelled")
+	}
+
+	// Quorum not reached before the timeout
+	if _, err := fanOut(context.Background(), 2, 2, 100*time.Millisecond, func(ctx context.Context, index int, rc chan interface{}) {
+		time.Sleep(time.Duration(index) * 300 * time.Millisecond)
+		rc <- "ok"
+	}, isSuccess); err == nil {
+		t.Error("quorum reached after timeout")
+	}
+
+	// Bad quorum
+	if _, err := fanOut(context.Background(), 2, 3, time.Second, func(ctx context.Context, index int, rc chan interface{}) { rc <- "ok" }, isSuccess); err == nil {
+		t.Error("quorum greater than number of destinations accepted")
+	}
+}
+
+func TestPartnerPolicer(t *testing.T) {
+	partner, found := config.GetPolicyConfigInstance("testServer").RoamingPartnersConf().FindRoamingPartner("partner1.com", "")
+	if !found {
+		t.Fatal("partner1.com not found")
+	}
+
+	policer := newPartnerPolicer()
+	now := time.Now()
+
+	// Application not allowed
+	request, _ := diamcodec.NewDiameterRequest("TestApplication", "TestRequest")
+	if err := policer.apply(partner, request, now); err == nil {
+		t.Error("request for not allowed application was accepted")
+	}
+
+	// Attributes removed
+	request, _ = diamcodec.NewDiameterRequest("Gx", "Credit-Control")
+	request.Add("Class", "00")
+	request.Add("User-Name", "user")
+	if err := policer.apply(partner, request, now); err != nil {
+		t.Fatalf("request rejected: %s", err)
+	}
+	if _, err := request.GetAVP("Class"); err == nil {
+		t.Error("Class attribute was not removed")
+	}
+	if request.GetStringAVP("User-Name") != "user" {
+		t.Error("User-Name attribute was removed")
+	}
+
+	// Rate limit. One token already used
+	for i := 0; i < partner.RateLimit-1; i++ {
+		if err := policer.apply(partner, request, now); err != nil {
+			t.Fatalf("request %d rejected: %s", i, err)
+		}
+	}
+	if err := policer.apply(partner, request, now); err == nil {
+		t.Error("rate limit not enforced")
+	}
+	if err := policer.apply(partner, request, now.Add(100*time.Millisecond)); err != nil {
+		t.Error("rate limit bucket not refilled")
+	}
+}
+
+func TestTransforms(t *testing.T) {
+
+	core.RegisterTransform("testAddClass", func(message *diamcodec.DiameterMessage) error {
+		message.Add("Class", "transformed")
+		return nil
+	})
+	core.RegisterTransform("testReject", func(message *diamcodec.DiameterMessage) error {
+		return errors.New("rejected")
+	})
+
+	request, _ := diamcodec.NewDiameterRequest("TestApplication", "TestRequest")
+	if err := applyTransforms([]string{"testAddClass"}, request); err != nil {
+		t.Fatalf("transform error %s", err)
+	}
+	if request.GetStringAVP("Class") != "transformed" {
+		t.Error("transform not applied")
+	}
+
+	if err := applyTransforms([]string{"testAddClass", "testReject"}, request); err == nil {
+		t.Error("transform error not reported")
+	}
+	if err := applyTransforms([]string{"nonExisting"}, request); err == nil {
+		t.Error("non registered transform accepted")
+	}
+	core.RegisterTransform("testRadius", func(packet *radiuscodec.RadiusPacket) error { return nil })
+	if err := applyTransforms([]string{"testRadius"}, request); err == nil {
+		t.Error("transform of another type accepted")
+	}
+
+	// Duplicated name
+	defer func() {
+		if recover() == nil {
+			t.Error("duplicated transform name accepted")
+		}
+	}()
+	core.RegisterTransform("testReject", func(message *diamcodec.DiameterMessage) error { return nil })
 }
 
 // Helper to navigate through peers
@@ -183,3 +482,653 @@ func PrettyPrintJSON(j []byte) string {
 
 	return jBytes.String()
 }
+
+func TestRadiusDispatch(t *testing.T) {
+	router := NewRadiusRouter("testServer")
+
+	// Without handlers, the Disconnect-Request gets a NAK and the Access-Request is discarded
+	disconnectRequest := radiuscodec.NewRadiusRequest(radiuscodec.DISCONNECT_REQUEST)
+	disconnectRequest.Add("User-Name", "myUserName")
+	response, err := router.HandleRadiusRequest(disconnectRequest)
+	if err != nil || response.Code != radiuscodec.DISCONNECT_NAK || response.GetIntAVP("Error-Cause") != radiuscodec.ERROR_CAUSE_UNSUPPORTED_SERVICE {
+		t.Errorf("bad response to Disconnect-Request without handler %v %v", response, err)
+	}
+	accessRequest := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+	if _, err := router.HandleRadiusRequest(accessRequest); !errors.Is(err, core.ErrRouteNotFound) {
+		t.Errorf("Access-Request without handler got %v", err)
+	}
+
+	// Dispatch by code
+	router.SetHandler(radiuscodec.ACCESS_REQUEST, func(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+		return radiuscodec.NewRadiusResponse(request, true), nil
+	})
+	router.SetDynAuthHandler(func(request *radiuscodec.RadiusPacket) (bool, int, error) {
+		if request.Code == radiuscodec.COA_REQUEST {
+			return true, 0, nil
+		}
+		return false, radiuscodec.ERROR_CAUSE_SESSION_CONTEXT_NOT_FOUND, nil
+	})
+	if response, _ := router.HandleRadiusRequest(accessRequest); response.Code != radiuscodec.ACCESS_ACCEPT {
+		t.Errorf("bad response to Access-Request with code %d", response.Code)
+	}
+	if response, _ := router.HandleRadiusRequest(radiuscodec.NewRadiusRequest(radiuscodec.COA_REQUEST)); response.Code != radiuscodec.COA_ACK || len(response.AVPs) != 0 {
+		t.Errorf("bad response to CoA-Request %v", response)
+	}
+	response, _ = router.HandleRadiusRequest(disconnectRequest)
+	if response.Code != radiuscodec.DISCONNECT_NAK || response.GetIntAVP("Error-Cause") != radiuscodec.ERROR_CAUSE_SESSION_CONTEXT_NOT_FOUND {
+		t.Errorf("bad response to Disconnect-Request %v", response)
+	}
+	if _, err := response.ToBytes("secret", 0); err != nil {
+		t.Errorf("could not serialize Disconnect-NAK %s", err)
+	}
+
+	// Simultaneous use. The limit for the single.com realm is one session
+	store := sessionserver.NewRadiusSessionStore("testServer", []string{sessionserver.USER_NAME_INDEX})
+	router.SetSessionStore(store, nil)
+	accessRequest.Add("User-Name", "user@single.com")
+	if response, _ := router.HandleRadiusRequest(accessRequest); response.Code != radiuscodec.ACCESS_ACCEPT {
+		t.Errorf("Access-Request without sessions got code %d", response.Code)
+	}
+	accountingRequest := radiuscodec.NewRadiusRequest(radiuscodec.ACCOUNTING_REQUEST)
+	accountingRequest.Add("Acct-Session-Id", "session-1")
+	accountingRequest.Add("Acct-Status-Type", 1)
+	accountingRequest.Add("User-Name", "user@single.com")
+	store.PushAccounting(accountingRequest)
+	if response, _ := router.HandleRadiusRequest(accessRequest); response.Code != radiuscodec.ACCESS_REJECT {
+		t.Errorf("Access-Request exceeding the simultaneous use limit got code %d", response.Code)
+	}
+}
+
+func TestPeerBalancing(t *testing.T) {
+	router := DiameterRouter{
+		ci:                  config.GetPolicyConfigInstance("testServer"),
+		diameterPeersTable:  map[string]DiameterPeerWithStatus{"a": {IsEngaged: true}, "b": {IsEngaged: true}, "c": {IsEngaged: false}},
+		outstandingRequests: make(map[string]*int32),
+		weightedRoundRobin:  make(map[string]map[string]int),
+	}
+
+	// Weighted round robin, skipping the peer not available
+	route := config.DiameterRoutingRule{Peers: []string{"a", "b", "c"}, Policy: "weighted", Weights: map[string]int{"a": 3, "c": 5}}
+	selections := make(map[string]int)
+	var sequence string
+	for i := 0; i < 8; i++ {
+		peers := router.orderPeers(route)
+		if len(peers) != 3 {
+			t.Fatalf("bad list of peers %v", peers)
+		}
+		selections[peers[0]]++
+		sequence += peers[0]
+	}
+	if selections["a"] != 6 || selections["b"] != 2 || sequence != "aabaaaba" {
+		t.Errorf("bad weighted selection %s", sequence)
+	}
+
+	// Least outstanding, keeping the declared order in case of ties
+	*router.outstandingCounter("a") = 5
+	*router.outstandingCounter("b") = 1
+	route = config.DiameterRoutingRule{Peers: []string{"a", "b", "c"}, Policy: "leastOutstanding"}
+	if peers := router.orderPeers(route); strings.Join(peers, ",") != "c,b,a" {
+		t.Errorf("bad least outstanding order %v", peers)
+	}
+}
+
+func TestRadiusServerBalancing(t *testing.T) {
+	router := RadiusRouter{
+		ci: config.GetPolicyConfigInstance("testServer"),
+		radiusServersTable: map[string]RadiusServerWithStatus{
+			"igor-superserver":    {IsAvailable: true},
+			"non-existing-server": {IsAvailable: true},
+			"unresponsive-server": {IsAvailable: false},
+		},
+		roundRobinCounters: make(map[string]int),
+		weightedRoundRobin: make(map[string]map[string]int),
+	}
+	request := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+	request.Add("User-Name", "myUserName")
+
+	names := func(servers []config.RadiusServer) string {
+		var n []string
+		for _, server := range servers {
+			n = append(n, server.Name)
+		}
+		return strings.Join(n, ",")
+	}
+
+	// Round robin, without the server in quarantine and the one not configured
+	group := config.RadiusServerGroup{Name: "rr", Servers: []string{"igor-superserver", "non-existing-server", "unresponsive-server", "undefined-server"}, Policy: "round-robin"}
+	if servers := names(router.selectRadiusServers(group, request)); servers != "igor-superserver,non-existing-server" {
+		t.Errorf("bad first round robin selection %s", servers)
+	}
+	if servers := names(router.selectRadiusServers(group, request)); servers != "non-existing-server,igor-superserver" {
+		t.Errorf("bad second round robin selection %s", servers)
+	}
+
+	// The servers in quarantine are tried last with "-withclear"
+	group.Policy = "fixed-withclear"
+	if servers := names(router.selectRadiusServers(group, request)); servers != "igor-superserver,non-existing-server,unresponsive-server" {
+		t.Errorf("bad selection with clear %s", servers)
+	}
+
+	// Weighted
+	group = config.RadiusServerGroup{Name: "w", Servers: []string{"igor-superserver", "non-existing-server"}, Policy: "weighted", Weights: map[string]int{"igor-superserver": 2}}
+	var sequence []string
+	for i := 0; i < 6; i++ {
+		sequence = append(sequence, router.selectRadiusServers(group, request)[0].Name)
+	}
+	if strings.Join(sequence, ",") != "igor-superserver,non-existing-server,igor-superserver,igor-superserver,non-existing-server,igor-superserver" {
+		t.Errorf("bad weighted sequence %v", sequence)
+	}
+
+	// Hash. The same session always goes to the same server
+	group = config.RadiusServerGroup{Name: "h", Servers: []string{"igor-superserver", "non-existing-server"}, Policy: "hash", HashAttributes: []string{"User-Name"}}
+	first := names(router.selectRadiusServers(group, request))
+	for i := 0; i < 5; i++ {
+		if servers := names(router.selectRadiusServers(group, request)); servers != first {
+			t.Errorf("hash selection changed from %s to %s", first, servers)
+		}
+	}
+}
+
+func TestRadiusRealms(t *testing.T) {
+	ci := config.GetPolicyConfigInstance("testServer")
+
+	// Play the role of the superserver, echoing the received User-Name
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	radiusserver.NewRadiusServer(ctx, ci, "127.0.0.1", 11812, func(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+		response := radiuscodec.NewRadiusResponse(request, true)
+		response.Add("Reply-Message", request.GetStringAVP("User-Name"))
+		return response, nil
+	})
+	time.Sleep(100 * time.Millisecond)
+
+	router := NewRadiusRouter("testServer")
+	cchan := make(chan interface{}, 1)
+	rcs := radiusClient.NewRadiusClientSocket(cchan, ci, "127.0.0.1", 18124)
+	router.SetRadiusClientSocket(rcs)
+	router.SetHandler(radiuscodec.ACCESS_REQUEST, func(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+		response := radiuscodec.NewRadiusResponse(request, false)
+		response.Add("Reply-Message", request.GetStringAVP("User-Name"))
+		return response, nil
+	})
+
+	testCases := []struct {
+		userName     string
+		code         byte
+		replyMessage string
+	}{
+		{"user@stripped.com", radiuscodec.ACCESS_ACCEPT, "user"},
+		{"user@Stripped.COM", radiuscodec.ACCESS_ACCEPT, "user"},
+		{"user@vpn.rewritten.com", radiuscodec.ACCESS_ACCEPT, "user@upstream.com"},
+		{"vpn.rewritten.com\\user", radiuscodec.ACCESS_ACCEPT, "upstream.com\\user"},
+		{"user@rewritten.com", radiuscodec.ACCESS_REJECT, "user@rewritten.com"},
+		{"user@local.com", radiuscodec.ACCESS_REJECT, "user@local.com"},
+		{"user@other.com", radiuscodec.ACCESS_REJECT, "user@other.com"},
+		{"user", radiuscodec.ACCESS_REJECT, "user"},
+	}
+	for _, tc := range testCases {
+		request := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+		request.Identifier = 78
+		request.Add("User-Name", tc.userName)
+
+		response, err := router.HandleRadiusRequest(request)
+		if err != nil {
+			t.Errorf("request for %s got error %s", tc.userName, err)
+			continue
+		}
+		if response.Code != tc.code || response.GetStringAVP("Reply-Message") != tc.replyMessage || response.Identifier != 78 {
+			t.Errorf("bad response for %s: %v", tc.userName, response)
+		}
+		if request.GetStringAVP("User-Name") != tc.userName {
+			t.Errorf("original request was modified %v", request)
+		}
+	}
+
+	rcs.SetDown()
+	<-cchan
+	rcs.Close()
+
+	// Leave the port free for the other tests
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestRadiusEscalation(t *testing.T) {
+	ci := config.GetPolicyConfigInstance("testServer")
+
+	// Play the role of the superserver
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	radiusserver.NewRadiusServer(ctx, ci, "127.0.0.1", 11812, func(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+		response := radiuscodec.NewRadiusResponse(request, true)
+		response.Add("Reply-Message", "from superserver")
+		return response, nil
+	})
+	time.Sleep(100 * time.Millisecond)
+
+	router := NewRadiusRouter("testServer")
+	cchan := make(chan interface{}, 1)
+	rcs := radiusClient.NewRadiusClientSocket(cchan, ci, "127.0.0.1", 18121)
+	router.SetRadiusClientSocket(rcs)
+
+	request := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+	request.Add("User-Name", "myUserName")
+
+	// The unresponsive server times out and the request is escalated to the secondary group
+	response, err := router.RouteRadiusRequest(request, "igor-escalation-group", 200*time.Millisecond)
+	if err != nil {
+		t.Fatalf("escalated request got error %s", err)
+	}
+	if response.Code != radiuscodec.ACCESS_ACCEPT || response.GetStringAVP("Reply-Message") != "from superserver" {
+		t.Errorf("bad response %v", response)
+	}
+	for _, server := range router.ServersTable() {
+		if server.ServerName == "unresponsive-server" && server.IsAvailable {
+			t.Errorf("unresponsive server not in quarantine")
+		}
+	}
+
+	// Now goes directly to the secondary group
+	start := time.Now()
+	if _, err := router.RouteRadiusRequest(request, "igor-escalation-group", 200*time.Millisecond); err != nil {
+		t.Errorf("second request got error %s", err)
+	}
+	if time.Since(start) > 150*time.Millisecond {
+		t.Errorf("server in quarantine was tried")
+	}
+
+	if _, err := router.RouteRadiusRequest(request, "undefined-group", time.Second); !errors.Is(err, core.ErrRouteNotFound) {
+		t.Errorf("undefined group got %v", err)
+	}
+
+	rcs.SetDown()
+	<-cchan
+	rcs.Close()
+}
+
+func TestRadiusServerHealth(t *testing.T) {
+	ci := config.GetPolicyConfigInstance("testServer")
+
+	router := NewRadiusRouter("testServer")
+	cchan := make(chan interface{}, 1)
+	rcs := radiusClient.NewRadiusClientSocket(cchan, ci, "127.0.0.1", 18123)
+	router.SetRadiusClientSocket(rcs)
+
+	// The server is not started yet, and goes to quarantine after the first timeout
+	request := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+	request.Add("User-Name", "myUserName")
+	if _, err := router.RouteRadiusRequest(request, "probed-server", 100*time.Millisecond); !errors.Is(err, core.ErrTimeout) {
+		t.Fatalf("expected timeout but got %v", err)
+	}
+	state := func() string {
+		for _, server := range router.ServersTable() {
+			if server.ServerName == "probed-server" {
+				return server.State
+			}
+		}
+		return ""
+	}
+	if state() != RADIUS_SERVER_QUARANTINE {
+		t.Fatal("probed server not in quarantine")
+	}
+
+	// Answers the Status-Server without handler
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	radiusserver.NewRadiusServer(ctx, ci, "127.0.0.1", 11814, func(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+		return radiuscodec.NewRadiusResponse(request, true), nil
+	})
+
+	// Out of quarantine well before the 60 seconds configured
+	for start := time.Now(); state() != RADIUS_SERVER_RECOVERING; time.Sleep(100 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("probed server still in quarantine")
+		}
+	}
+
+	// Available after the two canary requests
+	for i := 0; i < 2; i++ {
+		if _, err := router.RouteRadiusRequest(request, "probed-server", time.Second); err != nil {
+			t.Fatalf("canary request got error %s", err)
+		}
+	}
+	if state() != RADIUS_SERVER_AVAILABLE {
+		t.Errorf("probed server is %s after the canary requests", state())
+	}
+
+	var states []string
+	for _, transition := range router.ServerTransitions() {
+		if transition.ServerName == "probed-server" {
+			states = append(states, transition.To)
+		}
+	}
+	if strings.Join(states, ",") != "quarantine,recovering,available" {
+		t.Errorf("bad transitions %v", states)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if instrumentation.MS.RadiusServerStatesQuery()["probed-server"] != RADIUS_SERVER_AVAILABLE || instrumentation.MS.RadiusServerStateChangesQuery()[instrumentation.RadiusServerStateKey{Server: "probed-server", State: RADIUS_SERVER_RECOVERING}] != 1 {
+		t.Errorf("state changes not reported to the metrics server")
+	}
+
+	rcs.SetDown()
+	<-cchan
+	rcs.Close()
+}
+
+func TestRadiusCanaryReservation(t *testing.T) {
+	router := RadiusRouter{
+		ci: config.GetPolicyConfigInstance("testServer"),
+		radiusServersTable: map[string]RadiusServerWithStatus{
+			"igor-superserver":    {ServerName: "igor-superserver", State: RADIUS_SERVER_RECOVERING, IsAvailable: true},
+			"non-existing-server": {ServerName: "non-existing-server", State: RADIUS_SERVER_RECOVERING, IsAvailable: true},
+			"unresponsive-server": {ServerName: "unresponsive-server", State: RADIUS_SERVER_AVAILABLE, IsAvailable: true},
+		},
+		roundRobinCounters: make(map[string]int),
+		weightedRoundRobin: make(map[string]map[string]int),
+	}
+	group := config.RadiusServerGroup{Name: "canaries", Servers: []string{"igor-superserver", "non-existing-server", "unresponsive-server"}, Policy: "fixed"}
+	request := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+
+	// Only the first recovering server is tried
+	servers := router.reserveCanary(router.selectRadiusServers(group, request), time.Second)
+	if len(servers) != 2 || servers[0].Name != "igor-superserver" || servers[1].Name != "unresponsive-server" {
+		t.Fatalf("bad selection %v", servers)
+	}
+
+	// And is not selected again while the canary request is outstanding
+	servers = router.reserveCanary(router.selectRadiusServers(group, request), time.Second)
+	if len(servers) != 2 || servers[0].Name != "non-existing-server" {
+		t.Errorf("bad selection with outstanding canary %v", servers)
+	}
+}
+
+func TestRadiusProxy(t *testing.T) {
+	ci := config.GetPolicyConfigInstance("testServer")
+
+	// Play the role of the superserver, echoing the received attributes. Wait for the socket of the
+	// previous test to be closed
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	radiusserver.NewRadiusServer(ctx, ci, "127.0.0.1", 11812, func(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+		response := radiuscodec.NewRadiusResponse(request, true)
+		response.Add("Reply-Message", request.GetStringAVP("User-Name"))
+		response.Add("Class", "internal-"+request.GetStringAVP("NAS-Identifier"))
+		response.Add("Class", "external")
+		for _, class := range request.GetAllAVP("Class") {
+			response.Add("Class", "received-"+class.GetString())
+		}
+		return response, nil
+	})
+	time.Sleep(100 * time.Millisecond)
+
+	router := NewRadiusRouter("testServer")
+	cchan := make(chan interface{}, 1)
+	rcs := radiusClient.NewRadiusClientSocket(cchan, ci, "127.0.0.1", 18122)
+	router.SetRadiusClientSocket(rcs)
+	router.SetHandler(radiuscodec.ACCESS_REQUEST, func(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+		return radiuscodec.NewRadiusResponse(request, false), nil
+	})
+
+	request := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+	request.Identifier = 77
+	request.Add("User-Name", "user@proxied.com")
+	request.Add("Class", "from-nas")
+
+	response, err := router.HandleRadiusRequest(request)
+	if err != nil {
+		t.Fatalf("proxied request got error %s", err)
+	}
+	if response.Code != radiuscodec.ACCESS_ACCEPT || response.Identifier != 77 || response.Authenticator != request.Authenticator {
+		t.Errorf("bad proxied response %v", response)
+	}
+	if response.GetStringAVP("Filter-Id") != "user@upstream.com" {
+		t.Errorf("bad rewritten User-Name or renamed Reply-Message in %v", response)
+	}
+	if _, err := response.GetAVP("Reply-Message"); err == nil {
+		t.Errorf("Reply-Message was not renamed")
+	}
+	classes := response.GetAllAVP("Class")
+	if len(classes) != 1 || classes[0].GetString() != "external" {
+		t.Errorf("bad Class attributes in response %v", classes)
+	}
+
+	// The original request is not modified
+	if request.GetStringAVP("User-Name") != "user@proxied.com" || request.GetStringAVP("Class") != "from-nas" {
+		t.Errorf("original request was modified %v", request)
+	}
+
+	// Other realms are handled locally
+	request = radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+	request.Add("User-Name", "user@local.com")
+	if response, _ := router.HandleRadiusRequest(request); response.Code != radiuscodec.ACCESS_REJECT {
+		t.Errorf("request for local realm was proxied")
+	}
+
+	rcs.SetDown()
+	<-cchan
+	rcs.Close()
+
+	// Leave the port free for the other tests
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestRelay(t *testing.T) {
+	ci := config.GetPolicyConfigInstance("testServer")
+	router := DiameterRouter{ci: ci}
+	serverHost := ci.DiameterServerConf().DiameterHost
+
+	request, _ := diamcodec.NewDiameterRequest("Gx", "Credit-Control")
+	request.IsProxyable = true
+	request.Add("Origin-Host", "client.igorclient")
+	request.Add("Origin-Realm", "igorclient")
+	request.SetReceivedFrom("client.igorclient")
+
+	forwarded, resultCode := router.newForwardedRequest(request, "relay")
+	if resultCode != 0 {
+		t.Fatalf("request not forwarded with Result-Code %d", resultCode)
+	}
+	if forwarded.GetStringAVP("Route-Record") != "client.igorclient" || forwarded.HopByHopId == request.HopByHopId {
+		t.Errorf("bad forwarded request %v", forwarded)
+	}
+	if forwarded.GetStringAVP("Origin-Host") != "client.igorclient" {
+		t.Errorf("relay modified the Origin-Host")
+	}
+	if _, err := request.GetAVP("Route-Record"); err == nil {
+		t.Errorf("original request was modified")
+	}
+
+	// Loop detection
+	if !isRoutingLoop(forwarded, "client.igorclient") || isRoutingLoop(forwarded, serverHost) {
+		t.Errorf("bad loop detection")
+	}
+
+	// Proxy
+	proxied, _ := router.newForwardedRequest(request, "proxy")
+	if proxied.GetStringAVP("Origin-Host") != serverHost || len(proxied.GetAllAVP("Origin-Host")) != 1 {
+		t.Errorf("proxy did not replace the Origin-Host %v", proxied)
+	}
+
+	// Non proxiable requests
+	request.IsProxyable = false
+	if _, resultCode := router.newForwardedRequest(request, "relay"); resultCode != diamcodec.DIAMETER_UNABLE_TO_DELIVER {
+		t.Errorf("non proxiable request got Result-Code %d", resultCode)
+	}
+}
+
+func TestDiameterDuplicateDetection(t *testing.T) {
+	router := DiameterRouter{
+		ci:                   config.GetPolicyConfigInstance("testServer"),
+		diameterRequestsChan: make(chan RoutableDiameterRequest, 1),
+		duplicates:           core.NewDuplicateCache(1*time.Second, 0),
+	}
+
+	// Instead of the event loop, answer all the requests
+	var routed int32
+	go func() {
+		for rdr := range router.diameterRequestsChan {
+			atomic.AddInt32(&routed, 1)
+			answer := diamcodec.NewDiameterAnswer(rdr.Message)
+			answer.Add("Result-Code", diamcodec.DIAMETER_SUCCESS)
+			rdr.RChan <- answer
+		}
+	}()
+	defer close(router.diameterRequestsChan)
+
+	request, _ := diamcodec.NewDiameterRequest("TestApplication", "TestRequest")
+	request.Add("Origin-Host", "client.igorclient")
+	request.SetReceivedFrom("client.igorclient")
+	if _, err := router.routeIngressRequest(context.Background(), request); err != nil {
+		t.Fatalf("request not routed %s", err)
+	}
+
+	// Retransmission, with the T flag and another Hop-by-Hop Identifier
+	retransmission := *request
+	retransmission.IsRetransmission = true
+	retransmission.HopByHopId = request.HopByHopId + 1
+	answer, err := router.routeIngressRequest(context.Background(), &retransmission)
+	if err != nil || answer.HopByHopId != retransmission.HopByHopId || atomic.LoadInt32(&routed) != 1 {
+		t.Errorf("retransmission was routed again or got bad answer %v, %v", answer, err)
+	}
+
+	// Without the T flag, the request is routed
+	if _, err := router.routeIngressRequest(context.Background(), request); err != nil || atomic.LoadInt32(&routed) != 2 {
+		t.Errorf("request without T flag was not routed")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	dm := instrumentation.MS.DiameterQuery("DiameterDuplicates", nil, []string{"Peer"})
+	if dm[instrumentation.PeerDiameterMetricKey{Peer: "client.igorclient"}] != 1 {
+		t.Errorf("DiameterDuplicates was not 1 %v", dm)
+	}
+}
+
+func TestOverloadControl(t *testing.T) {
+	request, _ := diamcodec.NewDiameterRequest("TestApplication", "TestRequest")
+	advertised, added := withOverloadSupport(request)
+	if featureVector, err := advertised.GetAVPFromPath("OC-Supported-Features.OC-Feature-Vector"); !added || err != nil || featureVector.GetUint() != OC_FEATURE_LOSS {
+		t.Fatalf("OC-Supported-Features not added %v", advertised)
+	}
+	if len(request.GetAllAVP("OC-Supported-Features")) != 0 {
+		t.Error("original request was modified")
+	}
+	if _, added := withOverloadSupport(advertised); added {
+		t.Error("OC-Supported-Features added twice")
+	}
+
+	overloadReport := func(sequenceNumber int, reductionPercent int, validitySeconds int) *diamcodec.DiameterMessage {
+		answer := diamcodec.NewDiameterAnswer(request)
+		olr, _ := diamcodec.NewAVP("OC-OLR", nil)
+		olr.Add("OC-Sequence-Number", sequenceNumber)
+		olr.Add("OC-Report-Type", "HOST_REPORT")
+		olr.Add("OC-Reduction-Percentage", reductionPercent)
+		olr.Add("OC-Validity-Duration", validitySeconds)
+		return answer.AddAVP(olr)
+	}
+
+	oc := newOverloadControl()
+	now := time.Now()
+	oc.update("server.igorserver", overloadReport(10, 100, 5), now)
+	if reduction, expires := oc.reduction("server.igorserver", now); reduction != 100 || !expires.Equal(now.Add(5*time.Second)) {
+		t.Errorf("bad overload state %d, %s", reduction, expires)
+	}
+	if !oc.shed("server.igorserver", now) || oc.shed("superserver.igorsuperserver", now) {
+		t.Error("traffic not shed as reported")
+	}
+	if !oc.takeChanged(now) || oc.takeChanged(now) {
+		t.Error("change in overload state not reported once")
+	}
+
+	// Older reports are ignored
+	oc.update("server.igorserver", overloadReport(9, 50, 5), now)
+	if reduction, _ := oc.reduction("server.igorserver", now); reduction != 100 {
+		t.Errorf("older report was applied")
+	}
+
+	// The reduction expires
+	if reduction, _ := oc.reduction("server.igorserver", now.Add(6*time.Second)); reduction != 0 {
+		t.Errorf("overload did not expire")
+	}
+
+	// A report with zero validity ends the overload
+	oc.update("server.igorserver", overloadReport(11, 50, 5), now)
+	oc.update("server.igorserver", overloadReport(12, 50, 0), now)
+	if reduction, _ := oc.reduction("server.igorserver", now); reduction != 0 {
+		t.Errorf("overload not finished")
+	}
+}
+
+// Radius exchanger that never gets a response
+type silentExchanger struct{}
+
+func (silentExchanger) RadiusExchangeWithContext(ctx context.Context, endpoint string, rp *radiuscodec.RadiusPacket, timeout time.Duration, secret string, rc chan interface{}) {
+}
+
+func TestRouteWithContext(t *testing.T) {
+	router := DiameterRouter{
+		ci:                   config.GetPolicyConfigInstance("testServer"),
+		diameterRequestsChan: make(chan RoutableDiameterRequest, 1),
+	}
+
+	// Instead of the event loop, take note of the requests and do not answer them
+	rdrChan := make(chan RoutableDiameterRequest, 1)
+	go func() {
+		for rdr := range router.diameterRequestsChan {
+			rdrChan <- rdr
+		}
+	}()
+	defer close(router.diameterRequestsChan)
+
+	request, _ := diamcodec.NewDiameterRequest("TestApplication", "TestRequest")
+	ctx, cancel := context.WithTimeout(core.WithTraceId(context.Background(), "my-trace-id"), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := router.RouteDiameterRequestWithContext(ctx, request, 5*time.Second); !errors.Is(err, core.ErrTimeout) {
+		t.Errorf("expected timeout but got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("request not abandoned at the deadline of the context")
+	}
+	rdr := <-rdrChan
+	if deadline, _ := ctx.Deadline(); !rdr.Deadline.Equal(deadline) || core.TraceId(rdr.ctx()) != "my-trace-id" {
+		t.Errorf("context not propagated. Deadline %s, trace id %s", rdr.Deadline, core.TraceId(rdr.ctx()))
+	}
+
+	// The radius request is abandoned when the context is cancelled
+	radiusRouter := NewRadiusRouter("testServer")
+	radiusRouter.client = silentExchanger{}
+	radiusRequest := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start = time.Now()
+	if _, err := radiusRouter.RouteRadiusRequestWithContext(ctx, radiusRequest, "igor-escalation-group", 5*time.Second); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected cancellation but got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("radius request not abandoned when cancelled")
+	}
+}
+
+func TestBadHandlerCredentials(t *testing.T) {
+	router := DiameterRouter{
+		instanceName:   "testServer",
+		ci:             config.GetPolicyConfigInstance("testServer"),
+		http2ClientErr: errors.New("could not load client certificate"),
+	}
+
+	// The http handlers are not invoked without the configured credentials
+	request, _ := diamcodec.NewDiameterRequest("TestApplication", "TestRequest")
+	_, err := router.sendToHandler(core.CONTENT_TYPE_JSON)(context.Background(), "https://localhost:8080/diameterRequest", request)
+	var handlerError *httphandler.HttpHandlerError
+	if !errors.As(err, &handlerError) || handlerError.Transient {
+		t.Errorf("expected permanent handler error but got %v", err)
+	}
+
+	// The exchange is reported with the class of the error
+	exchanges := instrumentation.MS.HttpClientQuery("HttpClientExchanges", map[string]string{"Endpoint": "https://localhost:8080/diameterRequest", "ErrorCode": httphandler.SERIALIZATION_ERROR}, []string{"ErrorClass"})
+	if exchanges[instrumentation.HttpClientMetricKey{ErrorClass: "HandlerFailure"}] == 0 {
+		t.Errorf("exchange not reported with the error class %v", exchanges)
+	}
+}
@@ -0,0 +1,121 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"igor/attrstats"
+	"igor/config"
+	"igor/core"
+	"igor/diamcodec"
+	"igor/instrumentation"
+	"time"
+)
+
+// Custom message transformations, registered in core.RegisterTransform and selected in the ingress
+// and egress lists of the transforms.json configuration object
+
+// Modifies the message in place. If an error is returned, processing of the message is aborted
+type DiameterTransform = func(message *diamcodec.DiameterMessage) error
+
+// Applies the transformations with the specified names, in order
+func applyTransforms(names []string, message *diamcodec.DiameterMessage) error {
+	for _, name := range names {
+		registered, found := core.GetTransform(name)
+		if !found {
+			return fmt.Errorf("transform %s not registered", name)
+		}
+		transform, ok := registered.(DiameterTransform)
+		if !ok {
+			return fmt.Errorf("transform %s is not a diameter transform", name)
+		}
+		if err := transform(message); err != nil {
+			return fmt.Errorf("transform %s error: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Handler for the requests received from diameter peers. The answers are kept, if duplicate detection is
+// enabled, so that the retransmissions of the requests, with the T flag set and the same Origin-Host and
+// End-to-End Identifier, are sent the answer to the original request instead of being routed again
+func (router *DiameterRouter) routeIngressRequest(ctx context.Context, request *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, error) {
+	if router.duplicates == nil {
+		return router.handleIngressRequest(ctx, request)
+	}
+
+	key := fmt.Sprintf("%s/%d", request.GetStringAVP("Origin-Host"), request.E2EId)
+	cached, isDuplicate, err := router.duplicates.Execute(key, request.IsRetransmission, func() (interface{}, error) {
+		return router.handleIngressRequest(ctx, request)
+	})
+	answer, _ := cached.(*diamcodec.DiameterMessage)
+	if !isDuplicate || err != nil {
+		return answer, err
+	}
+
+	routerLogger().Debugw("duplicate request", append(request.LogFields(), "peer", request.GetStringAVP("Origin-Host"))...)
+	instrumentation.PushRouterDuplicateRequest(router.instanceName, request.ReceivedFrom(), request)
+
+	// The retransmission may have been received with another Hop-by-Hop Identifier, possibly from another peer
+	duplicateAnswer := *answer
+	duplicateAnswer.HopByHopId = request.HopByHopId
+	return &duplicateAnswer, nil
+}
+
+// Applies the ingress transformations to the request received from a peer and the egress transformations
+// to the answer. The context carries the server span started by the peer
+func (router *DiameterRouter) handleIngressRequest(ctx context.Context, request *diamcodec.DiameterMessage) (answer *diamcodec.DiameterMessage, err error) {
+	transformsConf := router.ci.TransformsConf()
+
+	trace := config.NewTraceBuffer(router.ci.DiameterServerConf().Trace, "%s %s from %s", request.ApplicationName, request.CommandName, request.GetStringAVP("Origin-Host"))
+	defer func() { trace.Finish(err) }()
+
+	router.checkClockSkew(request, time.Now())
+
+	serverConf := router.ci.DiameterServerConf()
+	if serverConf.AgentMode != "" && isRoutingLoop(request, serverConf.DiameterHost) {
+		trace.Tracef("routing loop detected")
+		return router.newProtocolErrorAnswer(request, diamcodec.DIAMETER_LOOP_DETECTED), nil
+	}
+
+	if err := applyTransforms(transformsConf.Ingress, request); err != nil {
+		return &diamcodec.DiameterMessage{}, err
+	}
+	trace.Tracef("request %s", request)
+
+	if serverConf.CommandValidation.Ingress {
+		if verr := request.CheckAgainstCommand(); verr != nil {
+			trace.Tracef("invalid request: %s", verr)
+			return router.newRuleErrorAnswer(request, verr), nil
+		}
+	}
+
+	answer, err = router.routeDiameterRequest(core.EnsureTraceId(ctx), request, router.ingressTimeout(), trace)
+	if err != nil {
+		return answer, err
+	}
+
+	// The Hop-by-Hop Identifier is replaced in the forwarded requests. When acting as proxy, the answers
+	// also hide the identity of the upstream peers
+	answer.HopByHopId = request.HopByHopId
+	if serverConf.AgentMode == "proxy" {
+		answer.DeleteAllAVP("Origin-Host").DeleteAllAVP("Origin-Realm").AddOriginAVPs(router.ci)
+	}
+
+	if err := applyTransforms(transformsConf.Egress, answer); err != nil {
+		return &diamcodec.DiameterMessage{}, err
+	}
+
+	if serverConf.CommandValidation.Egress {
+		if verr := answer.CheckAgainstCommand(); verr != nil {
+			routerLogger().Warnw("invalid answer: "+verr.Error(), request.LogFields()...)
+			// Not wrapped, so that the answer is sent with DIAMETER_UNABLE_TO_COMPLY
+			answer = router.newRuleErrorAnswer(request, fmt.Errorf("invalid answer: %s", verr))
+		}
+	}
+	trace.Tracef("answer %s", answer)
+
+	if analyzer, ok := router.attributeStats.Load().(*attrstats.Analyzer); ok && analyzer != nil {
+		analyzer.SampleDiameter(request, answer)
+	}
+	return answer, nil
+}
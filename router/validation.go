@@ -0,0 +1,34 @@
+package router
+
+import (
+	"errors"
+	"igor/diamcodec"
+)
+
+// Checks of the requests received from peers and their answers against the rules of their commands in the
+// dictionary, if enabled in the CommandValidation section of the diameter server configuration
+
+// Builds the answer for a request that does not comply with the rules of its command, with the Result-Code
+// that corresponds to the violation and, if the offending AVP is in the request, the Failed-AVP
+func (router *DiameterRouter) newRuleErrorAnswer(request *diamcodec.DiameterMessage, err error) *diamcodec.DiameterMessage {
+	resultCode := diamcodec.DIAMETER_UNABLE_TO_COMPLY
+	var ruleError *diamcodec.RuleError
+	if errors.As(err, &ruleError) {
+		resultCode = ruleError.ResultCode
+	}
+
+	answer := diamcodec.NewDiameterAnswer(request)
+	answer.IsError = resultCode >= 3000 && resultCode < 4000
+	answer.Add("Session-Id", request.GetStringAVP("Session-Id"))
+	answer.AddOriginAVPs(router.ci)
+	answer.Add("Result-Code", resultCode)
+	answer.Add("Error-Message", err.Error())
+	if ruleError != nil && ruleError.AVPName != "" {
+		if avp, e := request.GetAVP(ruleError.AVPName); e == nil {
+			if failedAVP, e := diamcodec.NewAVPWithDict(request.Dict(), "Failed-AVP", nil); e == nil {
+				answer.AddAVP(failedAVP.AddAVP(avp))
+			}
+		}
+	}
+	return answer
+}
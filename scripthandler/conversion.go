@@ -0,0 +1,31 @@
+package scripthandler
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/dop251/goja"
+)
+
+// Conversion of the messages to JavaScript objects and back, through their JSON representation
+
+// Builds the JavaScript object with the same structure as the JSON representation of the object
+func (r *scriptRuntime) toJSValue(object interface{}) (goja.Value, error) {
+	jsonBytes, err := json.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+	return r.parse(goja.Undefined(), r.vm.ToValue(string(jsonBytes)))
+}
+
+// Unmarshals the JavaScript value into the object, through its JSON representation
+func (r *scriptRuntime) fromJSValue(value goja.Value, object interface{}) error {
+	jsonValue, err := r.stringify(goja.Undefined(), value)
+	if err != nil {
+		return err
+	}
+	if goja.IsUndefined(jsonValue) {
+		return errors.New("value cannot be represented as JSON")
+	}
+	return json.Unmarshal([]byte(jsonValue.String()), object)
+}
@@ -0,0 +1,274 @@
+package scripthandler
+
+import (
+	"bytes"
+	"fmt"
+	"igor/config"
+	"igor/core"
+	"igor/diamcodec"
+	"igor/radiuscodec"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// Handlers written in JavaScript, so that the policies may be changed without recompiling igor.
+//
+// The script is a configuration object, typically a .js file retrieved using the search rules, that defines
+// the function handleRequest(request, answer). The request and a prefilled answer are passed as objects with
+// the same structure as their JSON representation, and the function returns the answer object, modified as
+// needed. To reject the request with an error, the function throws an exception. For diameter, the answer
+// carries the AVPs to be echoed, as added by diamcodec.CopyEchoedAVPs. For radius, it is an Access-Accept,
+// Accounting-Response, CoA-ACK or Disconnect-ACK, whose Code may be changed to generate a negative response.
+//
+// The script is checked for changes periodically, and reloaded if modified.
+//
+//	function handleRequest(request, answer) {
+//		igor.add(answer, "Class", "user:" + igor.get(request, "User-Name"));
+//		return answer;
+//	}
+
+// Default time between checks of changes in the script
+const DEFAULT_RELOAD_INTERVAL = 10 * time.Second
+
+// Name of the function that the scripts must define
+const handlerFunctionName = "handleRequest"
+
+// Helpers available to the scripts
+const prelude = `
+var igor = {
+	// Returns the value of the first attribute with the specified name, or undefined if not present
+	get: function(message, name) {
+		var avps = message.AVPs || [];
+		for (var i = 0; i < avps.length; i++) {
+			if (avps[i][name] !== undefined) {
+				return avps[i][name];
+			}
+		}
+		return undefined;
+	},
+
+	// Appends an attribute to the message
+	add: function(message, name, value) {
+		var avp = {};
+		avp[name] = value;
+		message.AVPs = message.AVPs || [];
+		message.AVPs.push(avp);
+		return message;
+	}
+};
+`
+
+// Version of the script. The JavaScript runtimes are not safe for concurrent use, so that a pool of
+// them is kept, with the script loaded
+type compiledScript struct {
+	source   []byte
+	runtimes sync.Pool
+}
+
+type ScriptHandler struct {
+	// To retrieve the script
+	cm         *config.ConfigurationManager
+	scriptName string
+
+	// Current version of the script
+	scriptMutex sync.RWMutex
+	script      *compiledScript
+
+	// Closed to stop the reloading
+	doneChan chan struct{}
+	doneOnce sync.Once
+}
+
+// Creates a handler that executes the script with the specified name, checking for changes with the
+// specified interval. If zero, DEFAULT_RELOAD_INTERVAL is used
+func NewScriptHandler(cm *config.ConfigurationManager, scriptName string, reloadInterval time.Duration) (*ScriptHandler, error) {
+	h := ScriptHandler{
+		cm:         cm,
+		scriptName: scriptName,
+		doneChan:   make(chan struct{}),
+	}
+	if err := h.Reload(); err != nil {
+		return nil, err
+	}
+
+	if reloadInterval <= 0 {
+		reloadInterval = DEFAULT_RELOAD_INTERVAL
+	}
+	go h.reloadLoop(reloadInterval)
+
+	return &h, nil
+}
+
+// Stops checking for changes in the script
+func (h *ScriptHandler) Close() {
+	h.doneOnce.Do(func() { close(h.doneChan) })
+}
+
+// Retrieves the script and, if it has changed, compiles it and replaces the current version
+func (h *ScriptHandler) Reload() error {
+	source, err := h.cm.GetConfigObjectAsText(h.scriptName, true)
+	if err != nil {
+		return fmt.Errorf("could not retrieve script %s: %w", h.scriptName, err)
+	}
+
+	h.scriptMutex.RLock()
+	current := h.script
+	h.scriptMutex.RUnlock()
+	if current != nil && bytes.Equal(current.source, source) {
+		return nil
+	}
+
+	script, err := compileScript(h.scriptName, source)
+	if err != nil {
+		return err
+	}
+
+	h.scriptMutex.Lock()
+	h.script = script
+	h.scriptMutex.Unlock()
+
+	if current != nil {
+		config.GetSubsystemLogger(config.SUBSYSTEM_HANDLERS).Infof("script %s reloaded", h.scriptName)
+	}
+	return nil
+}
+
+// Checks for changes in the script until closed
+func (h *ScriptHandler) reloadLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.doneChan:
+			return
+		case <-ticker.C:
+			if err := h.Reload(); err != nil {
+				config.GetSubsystemLogger(config.SUBSYSTEM_HANDLERS).Errorf("keeping previous version of script: %s", err)
+			}
+		}
+	}
+}
+
+// Handles a diameter request. May be used as a diampeer.MessageHandler
+func (h *ScriptHandler) HandleDiameter(request *diamcodec.DiameterMessage) (*diamcodec.DiameterMessage, error) {
+	answer := diamcodec.NewDiameterAnswer(request, diamcodec.CopyEchoedAVPs())
+
+	var result diamcodec.DiameterMessage
+	if err := h.execute(request, answer, &result); err != nil {
+		return nil, fmt.Errorf("handling %s %s: %w", request.ApplicationName, request.CommandName, err)
+	}
+	return &result, nil
+}
+
+// Handles a radius request. May be used as a radiusserver.RadiusPacketHandler
+func (h *ScriptHandler) HandleRadius(request *radiuscodec.RadiusPacket) (*radiuscodec.RadiusPacket, error) {
+	response := radiuscodec.NewRadiusResponse(request, true)
+
+	var result radiuscodec.RadiusPacket
+	if err := h.execute(request, response, &result); err != nil {
+		return nil, fmt.Errorf("handling radius request with code %d: %w", request.Code, err)
+	}
+	return &result, nil
+}
+
+// Invokes the handler function of the script with the request and answer, and unmarshals into result the
+// object returned. The errors wrap core.ErrHandlerFailure
+func (h *ScriptHandler) execute(request interface{}, answer interface{}, result interface{}) error {
+	h.scriptMutex.RLock()
+	script := h.script
+	h.scriptMutex.RUnlock()
+
+	runtime, err := script.getRuntime()
+	if err != nil {
+		return fmt.Errorf("script %s: %s: %w", h.scriptName, err, core.ErrHandlerFailure)
+	}
+	defer script.runtimes.Put(runtime)
+
+	requestObject, err := runtime.toJSValue(request)
+	if err != nil {
+		return fmt.Errorf("script %s: %s: %w", h.scriptName, err, core.ErrHandlerFailure)
+	}
+	answerObject, err := runtime.toJSValue(answer)
+	if err != nil {
+		return fmt.Errorf("script %s: %s: %w", h.scriptName, err, core.ErrHandlerFailure)
+	}
+
+	returned, err := runtime.handler(goja.Undefined(), requestObject, answerObject)
+	if err != nil {
+		if exception, ok := err.(*goja.Exception); ok {
+			return fmt.Errorf("script %s returned error %q: %w", h.scriptName, exception.Value().String(), core.ErrHandlerFailure)
+		}
+		return fmt.Errorf("script %s: %s: %w", h.scriptName, err, core.ErrHandlerFailure)
+	}
+
+	if goja.IsUndefined(returned) || goja.IsNull(returned) {
+		return fmt.Errorf("script %s returned no answer: %w", h.scriptName, core.ErrHandlerFailure)
+	}
+	if err := runtime.fromJSValue(returned, result); err != nil {
+		return fmt.Errorf("script %s: bad answer: %s: %w", h.scriptName, err, core.ErrHandlerFailure)
+	}
+	return nil
+}
+
+// JavaScript runtime with the script loaded
+type scriptRuntime struct {
+	vm *goja.Runtime
+
+	// The handleRequest function
+	handler goja.Callable
+
+	// JSON.parse and JSON.stringify, for the conversion of the messages
+	parse     goja.Callable
+	stringify goja.Callable
+}
+
+// Compiles the script, and checks that it defines the handler function
+func compileScript(scriptName string, source []byte) (*compiledScript, error) {
+	program, err := goja.Compile(scriptName, string(source), false)
+	if err != nil {
+		return nil, fmt.Errorf("could not compile script %s: %w", scriptName, err)
+	}
+
+	script := compiledScript{source: source}
+	script.runtimes.New = func() interface{} {
+		vm := goja.New()
+		if _, err := vm.RunString(prelude); err != nil {
+			return err
+		}
+		if _, err := vm.RunProgram(program); err != nil {
+			return err
+		}
+		handler, ok := goja.AssertFunction(vm.Get(handlerFunctionName))
+		if !ok {
+			return fmt.Errorf("function %s not defined", handlerFunctionName)
+		}
+		jsonObject := vm.Get("JSON").ToObject(vm)
+		parse, _ := goja.AssertFunction(jsonObject.Get("parse"))
+		stringify, _ := goja.AssertFunction(jsonObject.Get("stringify"))
+		return &scriptRuntime{vm: vm, handler: handler, parse: parse, stringify: stringify}
+	}
+
+	// Make sure that the script can be loaded
+	runtime, err := script.getRuntime()
+	if err != nil {
+		return nil, fmt.Errorf("could not load script %s: %w", scriptName, err)
+	}
+	script.runtimes.Put(runtime)
+
+	return &script, nil
+}
+
+// Returns a runtime from the pool, or the error creating it
+func (s *compiledScript) getRuntime() (*scriptRuntime, error) {
+	switch v := s.runtimes.Get().(type) {
+	case *scriptRuntime:
+		return v, nil
+	case error:
+		return nil, v
+	default:
+		return nil, fmt.Errorf("unexpected %T in the pool of JavaScript runtimes", v)
+	}
+}
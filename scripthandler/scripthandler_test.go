@@ -0,0 +1,117 @@
+package scripthandler
+
+import (
+	"errors"
+	"igor/config"
+	"igor/core"
+	"igor/diamcodec"
+	"igor/radiuscodec"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+
+	// Initialize the Config Object
+	config.InitPolicyConfigInstance("resources/searchRules.json", "testServer", true)
+
+	// Execute the tests and exit
+	os.Exit(m.Run())
+}
+
+func TestDiameterScript(t *testing.T) {
+
+	h, err := NewScriptHandler(&config.GetPolicyConfig().CM, "testScript.js", 0)
+	if err != nil {
+		t.Fatalf("could not create script handler: %s", err)
+	}
+	defer h.Close()
+
+	request, _ := diamcodec.NewDiameterRequest("TestApplication", "TestRequest")
+	request.Add("Session-Id", "session-1")
+	request.Add("User-Name", "user@igor")
+	answer, err := h.HandleDiameter(request)
+	if err != nil {
+		t.Fatalf("error handling request: %s", err)
+	}
+	if answer.IsRequest || answer.CommandName != "TestRequest" || answer.E2EId != request.E2EId || answer.HopByHopId != request.HopByHopId {
+		t.Errorf("bad answer header %s", answer)
+	}
+	if answer.GetResultCode() != diamcodec.DIAMETER_SUCCESS || answer.GetStringAVP("Class") != "diameter:user@igor" || answer.GetStringAVP("Session-Id") != "session-1" {
+		t.Errorf("bad answer %s", answer)
+	}
+
+	request.DeleteAllAVP("User-Name").Add("User-Name", "error")
+	if _, err := h.HandleDiameter(request); !errors.Is(err, core.ErrHandlerFailure) || !strings.Contains(err.Error(), "user not allowed") {
+		t.Errorf("script exception not reported %v", err)
+	}
+}
+
+func TestRadiusScript(t *testing.T) {
+
+	h, err := NewScriptHandler(&config.GetPolicyConfig().CM, "testScript.js", 0)
+	if err != nil {
+		t.Fatalf("could not create script handler: %s", err)
+	}
+	defer h.Close()
+
+	request := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+	request.Add("User-Name", "user@igor")
+	response, err := h.HandleRadius(request)
+	if err != nil {
+		t.Fatalf("error handling request: %s", err)
+	}
+	if response.Code != radiuscodec.ACCESS_ACCEPT || response.GetStringAVP("Class") != "radius:user@igor" {
+		t.Errorf("bad response %s", response)
+	}
+
+	request = radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+	request.Add("User-Name", "reject")
+	if response, err := h.HandleRadius(request); err != nil || response.Code != radiuscodec.ACCESS_REJECT {
+		t.Errorf("bad response %v, %v", response, err)
+	}
+}
+
+func TestScriptReload(t *testing.T) {
+
+	scriptFile := os.Getenv("IGOR_CONFIG_BASE") + "resources/testServer/reloadTest.js"
+	writeScript := func(class string) {
+		script := "function handleRequest(request, answer) {\n\treturn igor.add(answer, \"Class\", \"" + class + "\");\n}\n"
+		if err := os.WriteFile(scriptFile, []byte(script), 0644); err != nil {
+			t.Fatalf("could not write script: %s", err)
+		}
+	}
+	writeScript("first")
+	defer os.Remove(scriptFile)
+
+	h, err := NewScriptHandler(&config.GetPolicyConfig().CM, "reloadTest.js", 0)
+	if err != nil {
+		t.Fatalf("could not create script handler: %s", err)
+	}
+	defer h.Close()
+
+	request := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+	if response, err := h.HandleRadius(request); err != nil || response.GetStringAVP("Class") != "first" {
+		t.Errorf("bad response %v, %v", response, err)
+	}
+
+	writeScript("second")
+	if err := h.Reload(); err != nil {
+		t.Fatalf("could not reload script: %s", err)
+	}
+	if response, err := h.HandleRadius(request); err != nil || response.GetStringAVP("Class") != "second" {
+		t.Errorf("bad response after reload %v, %v", response, err)
+	}
+
+	// A bad script is rejected, and the previous version kept
+	if err := os.WriteFile(scriptFile, []byte("function handleRequest("), 0644); err != nil {
+		t.Fatalf("could not write script: %s", err)
+	}
+	if err := h.Reload(); err == nil {
+		t.Error("bad script loaded")
+	}
+	if response, err := h.HandleRadius(request); err != nil || response.GetStringAVP("Class") != "second" {
+		t.Errorf("previous version of script not kept %v, %v", response, err)
+	}
+}
@@ -0,0 +1,125 @@
+package sessionserver
+
+import (
+	"fmt"
+	"igor/config"
+	"sync"
+	"time"
+)
+
+// Persistence of the sessions in an external database, so that they survive a restart and may be
+// shared between instances. The store keeps working in memory, and the changes are written to the
+// backend either before PushAccounting returns (write-through) or by a background writer (write-behind).
+// The sessions in the backend are loaded into the store when the backend is set
+
+// Modes of writing to the backend
+const (
+	WRITE_THROUGH = "writeThrough"
+	WRITE_BEHIND  = "writeBehind"
+)
+
+// Default size of the queue of the write-behind mode
+const DEFAULT_BACKEND_QUEUE_SIZE = 1000
+
+// Timeout for the operations on the backends
+const BACKEND_TIMEOUT_MILLIS = 5000
+
+// External storage of the sessions. Must be safe for concurrent use
+type SessionBackend interface {
+	// Stores the session, replacing the one with the same Id unless it was updated later
+	Save(session RadiusSession) error
+
+	// Removes the session, unless it was updated after lastUpdated. Not an error if it does not exist
+	Delete(id string, lastUpdated time.Time) error
+
+	// Returns all the sessions stored
+	LoadAll() ([]RadiusSession, error)
+
+	Close() error
+}
+
+// Writes the changes of the store to the backend
+type backendWriter struct {
+	backend SessionBackend
+	mode    string
+
+	// Only for write-behind
+	queue chan SessionUpdate
+	wg    sync.WaitGroup
+}
+
+// Writes the update to the backend
+func (bw *backendWriter) write(update SessionUpdate) {
+	var err error
+	if update.Deleted {
+		err = bw.backend.Delete(update.Session.Id, update.Session.LastUpdated)
+	} else {
+		err = bw.backend.Save(update.Session)
+	}
+	if err != nil {
+		config.GetLogger().Errorf("could not write session %s to backend: %s", update.Session.Id, err)
+	}
+}
+
+// Writes the queued updates until the queue is closed
+func (bw *backendWriter) writeLoop() {
+	defer bw.wg.Done()
+	for update := range bw.queue {
+		bw.write(update)
+	}
+}
+
+// Sets the backend where the sessions are persisted, with the specified mode, and imports the sessions
+// stored in it, as in Import. In write-behind mode, PushAccounting blocks when the queue is full, so that
+// no change is lost. If the queue size is zero, the default one is used. Returns the number of sessions imported
+func (s *RadiusSessionStore) SetBackend(backend SessionBackend, mode string, queueSize int) (int, error) {
+	if mode != WRITE_THROUGH && mode != WRITE_BEHIND {
+		return 0, fmt.Errorf("bad session backend mode %q", mode)
+	}
+
+	sessions, err := backend.LoadAll()
+	if err != nil {
+		return 0, fmt.Errorf("could not load sessions from backend: %w", err)
+	}
+	imported := s.Import(SessionSnapshot{Timestamp: time.Now(), Sessions: sessions})
+
+	bw := backendWriter{backend: backend, mode: mode}
+	if mode == WRITE_BEHIND {
+		if queueSize <= 0 {
+			queueSize = DEFAULT_BACKEND_QUEUE_SIZE
+		}
+		bw.queue = make(chan SessionUpdate, queueSize)
+		bw.wg.Add(1)
+		go bw.writeLoop()
+	}
+	s.backend.Store(&bw)
+
+	return imported, nil
+}
+
+// Writes the pending changes and closes the backend. Must not be called while the store is still in use
+func (s *RadiusSessionStore) CloseBackend() error {
+	bw, _ := s.backend.Load().(*backendWriter)
+	if bw == nil {
+		return nil
+	}
+	if bw.queue != nil {
+		close(bw.queue)
+		bw.wg.Wait()
+	}
+	return bw.backend.Close()
+}
+
+// Writes the update to the backend, if set. Called with the lock of the store held, so that the
+// updates of a session reach the backend in the same order as they are applied
+func (s *RadiusSessionStore) persist(update SessionUpdate) {
+	bw, _ := s.backend.Load().(*backendWriter)
+	if bw == nil {
+		return
+	}
+	if bw.mode == WRITE_BEHIND {
+		bw.queue <- update
+	} else {
+		bw.write(update)
+	}
+}
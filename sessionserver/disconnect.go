@@ -0,0 +1,120 @@
+package sessionserver
+
+import (
+	"errors"
+	"fmt"
+	"igor/config"
+	"igor/radiuscodec"
+	"net"
+	"strconv"
+	"time"
+
+	radiusClient "igor/radiusclient"
+)
+
+// Default port for the Disconnect and CoA requests (RFC 5176)
+const DEFAULT_DISCONNECT_PORT = 3799
+
+// Returned when the NAS answers with a NAK
+var ErrDisconnectRejected = errors.New("disconnect rejected by NAS")
+
+// Function to send a radius packet to the specified endpoint and get the response
+type PacketSender func(endpoint string, packet *radiuscodec.RadiusPacket, secret string) (*radiuscodec.RadiusPacket, error)
+
+// Returns a PacketSender that uses the specified radius client socket
+func NewSocketPacketSender(rcs *radiusClient.RadiusClientSocket, timeout time.Duration) PacketSender {
+	return func(endpoint string, packet *radiuscodec.RadiusPacket, secret string) (*radiuscodec.RadiusPacket, error) {
+		rc := make(chan interface{}, 1)
+		rcs.RadiusExchange(endpoint, packet, timeout, secret, rc)
+		switch v := (<-rc).(type) {
+		case error:
+			return nil, v
+		case *radiuscodec.RadiusPacket:
+			return v, nil
+		default:
+			return nil, fmt.Errorf("unexpected response type %T", v)
+		}
+	}
+}
+
+// Builds the Disconnect-Request or CoA-Request for the session, using the template for the vendor
+// of the radius client whose address is the NAS-IP-Address of the session. Returns also the endpoint
+// and secret to use
+func BuildDisconnectRequest(ci *config.PolicyConfigurationManager, session RadiusSession) (*radiuscodec.RadiusPacket, string, string, error) {
+
+	nasIPAddress := session.Packet.GetStringAVP("NAS-IP-Address")
+	client, found := ci.RadiusClientsConf()[nasIPAddress]
+	if !found {
+		return nil, "", "", fmt.Errorf("no radius client for NAS-IP-Address %q of session %s", nasIPAddress, session.Id)
+	}
+
+	template, found := ci.DisconnectTemplatesConf().FindDisconnectTemplate(client.Vendor)
+	if !found {
+		return nil, "", "", fmt.Errorf("no disconnect template for vendor %q", client.Vendor)
+	}
+
+	var code byte
+	switch template.Code {
+	case "disconnect", "":
+		code = radiuscodec.DISCONNECT_REQUEST
+	case "coa":
+		code = radiuscodec.COA_REQUEST
+	default:
+		return nil, "", "", fmt.Errorf("bad code %q in disconnect template for vendor %q", template.Code, client.Vendor)
+	}
+
+	request := radiuscodec.NewRadiusRequest(code)
+	for _, attributeName := range template.Attributes {
+		avps := session.Packet.GetAllAVP(attributeName)
+		if len(avps) == 0 {
+			return nil, "", "", fmt.Errorf("attribute %s not found in session %s", attributeName, session.Id)
+		}
+		for i := range avps {
+			request.AddAVP(&avps[i])
+		}
+	}
+	for attributeName, value := range template.StaticAttributes {
+		avp, err := radiuscodec.NewAVP(attributeName, value)
+		if err != nil {
+			return nil, "", "", fmt.Errorf("could not add %s to disconnect request: %w", attributeName, err)
+		}
+		request.AddAVP(avp)
+	}
+
+	port := template.Port
+	if port == 0 {
+		port = DEFAULT_DISCONNECT_PORT
+	}
+
+	return request, net.JoinHostPort(nasIPAddress, strconv.Itoa(port)), client.Secret, nil
+}
+
+// Sends the Disconnect-Request or CoA-Request for the session, built as specified in the
+// template for the NAS, and checks that the answer is an ACK
+func Disconnect(ci *config.PolicyConfigurationManager, session RadiusSession, sender PacketSender) error {
+
+	request, endpoint, secret, err := BuildDisconnectRequest(ci, session)
+	if err != nil {
+		return err
+	}
+
+	response, err := sender(endpoint, request, secret)
+	if err != nil {
+		return fmt.Errorf("could not disconnect session %s: %w", session.Id, err)
+	}
+
+	switch response.Code {
+	case radiuscodec.DISCONECT_ACK, radiuscodec.COA_ACK:
+		config.GetLogger().Infof("disconnected session %s in %s", session.Id, endpoint)
+		return nil
+	default:
+		return fmt.Errorf("session %s, code %d: %w", session.Id, response.Code, ErrDisconnectRejected)
+	}
+}
+
+// Returns a DisconnectFunc that uses the templates and the specified sender
+func NewDisconnectFunc(ci *config.PolicyConfigurationManager, sender PacketSender) DisconnectFunc {
+	return func(session RadiusSession) error {
+		return Disconnect(ci, session, sender)
+	}
+}
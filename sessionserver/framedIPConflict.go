@@ -0,0 +1,132 @@
+package sessionserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"igor/config"
+	"igor/instrumentation"
+	"igor/radiuscodec"
+	"net/http"
+	"time"
+)
+
+// Index required in the session store for the Framed-IP-Address conflict detection
+const FRAMED_IP_INDEX = "Framed-IP-Address"
+
+// Timeout for the notification of conflicts
+const WEBHOOK_TIMEOUT_SECONDS = 5
+
+// Contents of the notification sent to the webhook
+type FramedIPConflict struct {
+	FramedIPAddress string
+	Timestamp       time.Time
+
+	// The session reported in the accounting packet
+	SessionId    string
+	UserName     string
+	NASIPAddress string
+
+	// The session previously using the address
+	ConflictingSessionId    string
+	ConflictingUserName     string
+	ConflictingNASIPAddress string
+}
+
+var webhookClient = http.Client{Timeout: WEBHOOK_TIMEOUT_SECONDS * time.Second}
+
+// Invoked for accounting Start and Interim-Update packets, before being pushed to the store,
+// which must have a Framed-IP-Address index. The store does it itself if enabled with
+// SetFramedIPConflictCheck. Looks for other active sessions with the same
+// Framed-IP-Address, and for each one found increments the conflicts metric, notifies the
+// webhook, if configured, and sends a Disconnect-Request, if so configured.
+// Returns the conflicting sessions
+func CheckFramedIPConflict(store *RadiusSessionStore, conf config.FramedIPConflictConfig, packet *radiuscodec.RadiusPacket, disconnect DisconnectFunc) []RadiusSession {
+
+	framedIPAddress := packet.GetStringAVP(FRAMED_IP_INDEX)
+	if framedIPAddress == "" {
+		return nil
+	}
+	sessionId := packet.GetStringAVP(SESSION_ID_ATTRIBUTE)
+
+	conflicts := make([]RadiusSession, 0)
+	for _, session := range store.FindByIndex(FRAMED_IP_INDEX, framedIPAddress) {
+		if session.Id == sessionId {
+			continue
+		}
+		conflicts = append(conflicts, session)
+
+		nasIPAddress := packet.GetStringAVP("NAS-IP-Address")
+		config.GetLogger().Warnf("Framed-IP-Address %s of session %s already in use by session %s", framedIPAddress, sessionId, session.Id)
+		instrumentation.PushRadiusFramedIPConflict(store.instanceName, nasIPAddress)
+
+		if conf.WebhookURL != "" {
+			go notifyConflict(conf.WebhookURL, FramedIPConflict{
+				FramedIPAddress:         framedIPAddress,
+				Timestamp:               time.Now(),
+				SessionId:               sessionId,
+				UserName:                packet.GetStringAVP("User-Name"),
+				NASIPAddress:            nasIPAddress,
+				ConflictingSessionId:    session.Id,
+				ConflictingUserName:     session.Packet.GetStringAVP("User-Name"),
+				ConflictingNASIPAddress: session.Packet.GetStringAVP("NAS-IP-Address"),
+			})
+		}
+
+		if conf.DisconnectOlder && disconnect != nil {
+			if err := disconnect(session); err != nil {
+				config.GetLogger().Errorf("could not disconnect session %s: %s", session.Id, err)
+			}
+		}
+	}
+
+	return conflicts
+}
+
+// Configuration instance with the actions to take and function to disconnect the older sessions
+type conflictChecker struct {
+	ci         *config.PolicyConfigurationManager
+	disconnect DisconnectFunc
+}
+
+// Enables the check of the Framed-IP-Address conflicts of the Start and Interim-Update packets pushed to the
+// store, which must have a Framed-IP-Address index, with the actions in the framedIPConflict.json of the
+// configuration instance. The sender is used for the Disconnect-Requests, and may be nil if not configured
+func (s *RadiusSessionStore) SetFramedIPConflictCheck(ci *config.PolicyConfigurationManager, sender PacketSender) {
+	checker := conflictChecker{ci: ci}
+	if sender != nil {
+		checker.disconnect = NewDisconnectFunc(ci, sender)
+	}
+	s.conflictChecker.Store(&checker)
+}
+
+// Looks for conflicts of the accounting packet, if enabled. Must be called without the lock held
+func (s *RadiusSessionStore) checkFramedIPConflict(packet *radiuscodec.RadiusPacket) {
+	checker, _ := s.conflictChecker.Load().(*conflictChecker)
+	if checker == nil {
+		return
+	}
+	switch packet.GetStringAVP("Acct-Status-Type") {
+	case "Start", "Interim-Update":
+		CheckFramedIPConflict(s, checker.ci.FramedIPConflictConf(), packet, checker.disconnect)
+	}
+}
+
+// Sends the conflict to the webhook
+func notifyConflict(url string, conflict FramedIPConflict) {
+	jConflict, err := json.Marshal(conflict)
+	if err != nil {
+		config.GetLogger().Errorf("could not serialize Framed-IP-Address conflict: %s", err)
+		return
+	}
+
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(jConflict))
+	if err != nil {
+		config.GetLogger().Errorf("could not notify Framed-IP-Address conflict to %s: %s", url, err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		config.GetLogger().Errorf("Framed-IP-Address conflict notification to %s returned status %d", url, resp.StatusCode)
+	}
+}
@@ -0,0 +1,99 @@
+package sessionserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"igor/ippool"
+	"time"
+)
+
+// Persistence of the leases of the IP pools in the same databases as the sessions, so that the
+// Redis and PostgreSQL backends may be also used as ippool.LeaseBackend
+
+// Name, after the key prefix, of the Redis hash with the leases. Being a hash, it is skipped when
+// loading the sessions
+const redisLeasesKey = "ippool/leases"
+
+// Suffix of the name of the PostgreSQL table with the leases
+const postgresLeasesTableSuffix = "_leases"
+
+func (b *RedisBackend) SaveLease(lease ippool.Lease) error {
+	jLease, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), BACKEND_TIMEOUT_MILLIS*time.Millisecond)
+	defer cancel()
+	return b.client.HSet(ctx, b.keyPrefix+redisLeasesKey, lease.Pool+"/"+lease.Address, jLease).Err()
+}
+
+func (b *RedisBackend) LoadLeases() ([]ippool.Lease, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), BACKEND_TIMEOUT_MILLIS*time.Millisecond)
+	defer cancel()
+
+	values, err := b.client.HGetAll(ctx, b.keyPrefix+redisLeasesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	leases := make([]ippool.Lease, 0, len(values))
+	for field, jLease := range values {
+		var lease ippool.Lease
+		if err := json.Unmarshal([]byte(jLease), &lease); err != nil {
+			return nil, fmt.Errorf("bad lease %s: %w", field, err)
+		}
+		leases = append(leases, lease)
+	}
+	return leases, nil
+}
+
+// A lease is only replaced by another one updated later, as the sessions
+func (b *PostgresBackend) SaveLease(lease ippool.Lease) error {
+	jLease, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), BACKEND_TIMEOUT_MILLIS*time.Millisecond)
+	defer cancel()
+	_, err = b.db.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO %[1]s (pool, address, last_updated, lease) VALUES ($1, $2, $3, $4) "+
+			"ON CONFLICT (pool, address) DO UPDATE SET last_updated = EXCLUDED.last_updated, lease = EXCLUDED.lease "+
+			"WHERE %[1]s.last_updated <= EXCLUDED.last_updated", b.tableName+postgresLeasesTableSuffix),
+		lease.Pool, lease.Address, lease.LastUpdated, string(jLease))
+	return err
+}
+
+// Creates the table of leases if it does not exist
+func (b *PostgresBackend) LoadLeases() ([]ippool.Lease, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), BACKEND_TIMEOUT_MILLIS*time.Millisecond)
+	defer cancel()
+
+	tableName := b.tableName + postgresLeasesTableSuffix
+	if _, err := b.db.ExecContext(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (pool TEXT NOT NULL, address TEXT NOT NULL, last_updated TIMESTAMPTZ NOT NULL, lease JSONB NOT NULL, PRIMARY KEY (pool, address))", tableName)); err != nil {
+		return nil, fmt.Errorf("could not create lease table: %w", err)
+	}
+
+	rows, err := b.db.QueryContext(ctx, fmt.Sprintf("SELECT address, lease FROM %s", tableName))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	leases := make([]ippool.Lease, 0)
+	for rows.Next() {
+		var address string
+		var jLease []byte
+		if err := rows.Scan(&address, &jLease); err != nil {
+			return nil, err
+		}
+		var lease ippool.Lease
+		if err := json.Unmarshal(jLease, &lease); err != nil {
+			return nil, fmt.Errorf("bad lease %s: %w", address, err)
+		}
+		leases = append(leases, lease)
+	}
+	return leases, rows.Err()
+}
@@ -0,0 +1,291 @@
+package sessionserver
+
+import (
+	"context"
+	"igor/instrumentation"
+	"igor/radiuscodec"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Attribute used as the key of the radius sessions
+const SESSION_ID_ATTRIBUTE = "Acct-Session-Id"
+
+// Index on the port of the NAS, made of the values of the two attributes
+const NAS_PORT_INDEX = "NAS-IP-Address/NAS-Port"
+
+// Separator of the attribute names in the composite indexes, and of their values
+const INDEX_SEPARATOR = "/"
+
+// A radius session, built from the accounting packets received
+type RadiusSession struct {
+	// The value of the Acct-Session-Id
+	Id string
+
+	// The last accounting packet received for the session
+	Packet *radiuscodec.RadiusPacket
+
+	// Reception of the Start (or first Interim) and last packet
+	StartTime   time.Time
+	LastUpdated time.Time
+
+	// Skew of the clock of the NAS measured in the last packet, if it had an Event-Timestamp
+	ClockSkew time.Duration
+
+	// Counters aggregated from the accounting packets
+	Usage SessionUsage
+}
+
+// Stores the active radius sessions, with indexes on the values of the specified attributes.
+// Safe for concurrent use
+type RadiusSessionStore struct {
+	sync.RWMutex
+
+	// Sessions by Id
+	sessions map[string]*RadiusSession
+
+	// Attribute name -> attribute value -> set of session Ids
+	indexes map[string]map[string]map[string]struct{}
+
+	// Sends the changes to the peer instance, if set. Stores a *Replicator
+	replicator atomic.Value
+
+	// Persists the sessions, if set. Stores a *backendWriter
+	backend atomic.Value
+
+	// Checks the Framed-IP-Address conflicts, if set. Stores a *conflictChecker
+	conflictChecker atomic.Value
+
+	// Configuration instance, to label the metrics
+	instanceName string
+}
+
+// Creates a store with indexes on the specified attribute names. An index may also be made of several
+// attributes separated by "/", such as NAS_PORT_INDEX, and is then queried with the values separated
+// in the same way. The metrics of the store are labeled with the name of the configuration instance
+func NewRadiusSessionStore(instanceName string, indexNames []string) *RadiusSessionStore {
+	store := RadiusSessionStore{
+		sessions:     make(map[string]*RadiusSession),
+		indexes:      make(map[string]map[string]map[string]struct{}),
+		instanceName: instanceName,
+	}
+	for _, indexName := range indexNames {
+		store.indexes[indexName] = make(map[string]map[string]struct{})
+	}
+	return &store
+}
+
+// Updates the store with the contents of an accounting packet. Start and Interim-Update
+// create or update the session, and Stop removes it. Returns the session as it was before the update,
+// or nil if it did not exist
+func (s *RadiusSessionStore) PushAccounting(packet *radiuscodec.RadiusPacket) *RadiusSession {
+	previous, _ := s.pushAccounting(packet)
+	return previous
+}
+
+// Same as PushAccounting, returning also the usage of the session including this packet. The change is
+// replicated and persisted before releasing the lock, so that the changes of a session are not reordered
+func (s *RadiusSessionStore) pushAccounting(packet *radiuscodec.RadiusPacket) (*RadiusSession, SessionUsage) {
+	id := packet.GetStringAVP(SESSION_ID_ATTRIBUTE)
+	if id == "" {
+		return nil, SessionUsage{}.Update(packet)
+	}
+
+	s.checkFramedIPConflict(packet)
+
+	s.Lock()
+	defer s.Unlock()
+
+	previous := s.sessions[id]
+	if previous != nil {
+		s.removeFromIndexes(previous)
+	}
+
+	var usage SessionUsage
+	if previous != nil {
+		usage = previous.Usage
+	}
+	usage = usage.Update(packet)
+
+	var update *SessionUpdate
+	switch packet.GetStringAVP("Acct-Status-Type") {
+	case "Start", "Interim-Update":
+		now := time.Now()
+		// The packet is copied, since it may be released to the pool when the handler returns
+		session := RadiusSession{Id: id, Packet: packet.Copy(), StartTime: now, LastUpdated: now, ClockSkew: packet.ClockSkew, Usage: usage}
+		if previous != nil {
+			session.StartTime = previous.StartTime
+		}
+		s.sessions[id] = &session
+		s.addToIndexes(&session)
+		update = &SessionUpdate{Session: session}
+
+	case "Stop":
+		delete(s.sessions, id)
+		if previous != nil {
+			update = &SessionUpdate{Session: RadiusSession{Id: id, Packet: packet.Copy(), LastUpdated: time.Now()}, Deleted: true}
+		}
+
+	default:
+		// Leave as it was
+		if previous != nil {
+			s.addToIndexes(previous)
+			usage = previous.Usage
+		}
+	}
+
+	if update != nil {
+		s.replicate(*update)
+		s.persist(*update)
+	}
+
+	return previous, usage
+}
+
+// Returns the session with the specified Id
+func (s *RadiusSessionStore) Get(id string) (RadiusSession, bool) {
+	return s.GetWithContext(context.Background(), id)
+}
+
+// Same as Get, with the context of the query, whose trace is attached to the duration metric
+func (s *RadiusSessionStore) GetWithContext(ctx context.Context, id string) (RadiusSession, bool) {
+	defer s.pushQueryDuration(ctx, "Get", time.Now())
+	s.RLock()
+	defer s.RUnlock()
+
+	if session, found := s.sessions[id]; found {
+		return *session, true
+	}
+	return RadiusSession{}, false
+}
+
+// Returns the sessions having the specified value for the indexed attribute, sorted by start time
+func (s *RadiusSessionStore) FindByIndex(indexName string, value string) []RadiusSession {
+	return s.FindByIndexWithContext(context.Background(), indexName, value)
+}
+
+// Same as FindByIndex, with the context of the query, whose trace is attached to the duration metric
+func (s *RadiusSessionStore) FindByIndexWithContext(ctx context.Context, indexName string, value string) []RadiusSession {
+	defer s.pushQueryDuration(ctx, "FindByIndex", time.Now())
+	s.RLock()
+	defer s.RUnlock()
+
+	sessions := make([]RadiusSession, 0)
+	for id := range s.indexes[indexName][value] {
+		sessions = append(sessions, *s.sessions[id])
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].StartTime.Before(sessions[j].StartTime) })
+
+	return sessions
+}
+
+// Returns the sum of the usage of the sessions having the specified value for the indexed attribute
+func (s *RadiusSessionStore) UsageByIndex(indexName string, value string) SessionUsage {
+	return s.UsageByIndexWithContext(context.Background(), indexName, value)
+}
+
+// Same as UsageByIndex, with the context of the query, whose trace is attached to the duration metric
+func (s *RadiusSessionStore) UsageByIndexWithContext(ctx context.Context, indexName string, value string) SessionUsage {
+	defer s.pushQueryDuration(ctx, "UsageByIndex", time.Now())
+	s.RLock()
+	defer s.RUnlock()
+
+	var usage SessionUsage
+	for id := range s.indexes[indexName][value] {
+		usage = usage.Add(s.sessions[id].Usage)
+	}
+	return usage
+}
+
+// Removes the sessions not updated during the specified time, which should be longer than the interval
+// between Interim-Updates, since the Stop for them was probably lost. Returns the number of sessions removed
+func (s *RadiusSessionStore) ExpireSessions(ttl time.Duration) int {
+	s.Lock()
+	defer s.Unlock()
+
+	limit := time.Now().Add(-ttl)
+	expired := 0
+	for id, session := range s.sessions {
+		if session.LastUpdated.Before(limit) {
+			s.removeFromIndexes(session)
+			delete(s.sessions, id)
+			// Not removed from the backend if another instance updated it later
+			s.persist(SessionUpdate{Session: RadiusSession{Id: id, LastUpdated: session.LastUpdated}, Deleted: true})
+			expired++
+		}
+	}
+	return expired
+}
+
+// Removes periodically the sessions not updated during the specified time, until the context is done
+func (s *RadiusSessionStore) RunExpiration(ctx context.Context, ttl time.Duration) {
+	ticker := time.NewTicker(ttl / 10)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.ExpireSessions(ttl)
+		}
+	}
+}
+
+// Reports the time taken by the query to the instrumentation server
+func (s *RadiusSessionStore) pushQueryDuration(ctx context.Context, query string, start time.Time) {
+	instrumentation.PushSessionQueryDuration(ctx, s.instanceName, query, time.Since(start))
+}
+
+// Returns the number of sessions in the store
+func (s *RadiusSessionStore) Len() int {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.sessions)
+}
+
+// Must be called with the lock held
+func (s *RadiusSessionStore) addToIndexes(session *RadiusSession) {
+	for indexName, index := range s.indexes {
+		value := indexValue(session.Packet, indexName)
+		if value == "" {
+			continue
+		}
+		if index[value] == nil {
+			index[value] = make(map[string]struct{})
+		}
+		index[value][session.Id] = struct{}{}
+	}
+}
+
+// Must be called with the lock held
+func (s *RadiusSessionStore) removeFromIndexes(session *RadiusSession) {
+	for indexName, index := range s.indexes {
+		value := indexValue(session.Packet, indexName)
+		delete(index[value], session.Id)
+		if len(index[value]) == 0 {
+			delete(index, value)
+		}
+	}
+}
+
+// Returns the value of the index for the packet, or the empty string if some of its attributes is missing
+func indexValue(packet *radiuscodec.RadiusPacket, indexName string) string {
+	if !strings.Contains(indexName, INDEX_SEPARATOR) {
+		return packet.GetStringAVP(indexName)
+	}
+
+	attributeNames := strings.Split(indexName, INDEX_SEPARATOR)
+	values := make([]string, 0, len(attributeNames))
+	for _, attributeName := range attributeNames {
+		value := packet.GetStringAVP(attributeName)
+		if value == "" {
+			return ""
+		}
+		values = append(values, value)
+	}
+	return strings.Join(values, INDEX_SEPARATOR)
+}
@@ -0,0 +1,128 @@
+package sessionserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Session backend in Redis. Each session is stored in JSON under its own key, made of the prefix and the Id.
+// As in PostgresBackend, a session is not replaced or removed if the one stored was updated later
+type RedisBackend struct {
+	client    *redis.Client
+	keyPrefix string
+
+	// Expiration of the keys, refreshed on each update. Zero for no expiration
+	ttl time.Duration
+}
+
+// Number of keys requested in each iteration when loading the sessions
+const redisScanCount = 1000
+
+// Number of attempts to write a session that is being modified concurrently
+const redisMaxRetries = 3
+
+// Creates a backend using the Redis server at the specified address. If the ttl is not zero, the sessions
+// not updated during that time are removed by Redis
+func NewRedisBackend(address string, password string, db int, keyPrefix string, ttl time.Duration) *RedisBackend {
+	return &RedisBackend{
+		client:    redis.NewClient(&redis.Options{Addr: address, Password: password, DB: db}),
+		keyPrefix: keyPrefix,
+		ttl:       ttl,
+	}
+}
+
+func (b *RedisBackend) Save(session RadiusSession) error {
+	jSession, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	return b.ifNotUpdatedAfter(session.Id, session.LastUpdated, func(ctx context.Context, pipe redis.Pipeliner, key string) {
+		pipe.Set(ctx, key, jSession, b.ttl)
+	})
+}
+
+func (b *RedisBackend) Delete(id string, lastUpdated time.Time) error {
+	return b.ifNotUpdatedAfter(id, lastUpdated, func(ctx context.Context, pipe redis.Pipeliner, key string) {
+		pipe.Del(ctx, key)
+	})
+}
+
+// Executes the write in a transaction that fails if the key of the session is modified concurrently,
+// unless the session stored was updated after lastUpdated. Retried if the transaction fails
+func (b *RedisBackend) ifNotUpdatedAfter(id string, lastUpdated time.Time, write func(ctx context.Context, pipe redis.Pipeliner, key string)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), BACKEND_TIMEOUT_MILLIS*time.Millisecond)
+	defer cancel()
+
+	key := b.keyPrefix + id
+	txf := func(tx *redis.Tx) error {
+		jStored, err := tx.Get(ctx, key).Bytes()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if err == nil {
+			var stored struct{ LastUpdated time.Time }
+			if json.Unmarshal(jStored, &stored) == nil && stored.LastUpdated.After(lastUpdated) {
+				return nil
+			}
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			write(ctx, pipe, key)
+			return nil
+		})
+		return err
+	}
+
+	for i := 0; i < redisMaxRetries; i++ {
+		if err := b.client.Watch(ctx, txf, key); err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return fmt.Errorf("session %s modified concurrently", id)
+}
+
+func (b *RedisBackend) LoadAll() ([]RadiusSession, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), BACKEND_TIMEOUT_MILLIS*time.Millisecond)
+	defer cancel()
+
+	sessions := make([]RadiusSession, 0)
+	var cursor uint64
+	for {
+		keys, nextCursor, err := b.client.Scan(ctx, cursor, b.keyPrefix+"*", redisScanCount).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(keys) > 0 {
+			values, err := b.client.MGet(ctx, keys...).Result()
+			if err != nil {
+				return nil, err
+			}
+			for i, value := range values {
+				// May have been deleted or expired after the scan
+				jSession, ok := value.(string)
+				if !ok {
+					continue
+				}
+				var session RadiusSession
+				if err := json.Unmarshal([]byte(jSession), &session); err != nil {
+					return nil, fmt.Errorf("bad session in %s: %w", keys[i], err)
+				}
+				sessions = append(sessions, session)
+			}
+		}
+
+		if nextCursor == 0 {
+			return sessions, nil
+		}
+		cursor = nextCursor
+	}
+}
+
+func (b *RedisBackend) Close() error {
+	return b.client.Close()
+}
@@ -0,0 +1,198 @@
+package sessionserver
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"igor/config"
+	"igor/core"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Replication of the session store to a peer instance, typically the standby one, so that it has the
+// sessions when it takes over. The changes are sent asynchronously, in batches, to the /sessions/replicate
+// endpoint of the admin server of the peer. The changes that do not fit in the queue are lost, and
+// the peer may be resynchronized with a snapshot
+
+// Defaults for the replicator
+const (
+	DEFAULT_REPLICATION_QUEUE_SIZE     = 1000
+	DEFAULT_REPLICATION_TIMEOUT_MILLIS = 2000
+	MAX_REPLICATION_BATCH              = 100
+)
+
+// Change in a session, sent to the peer instance
+type SessionUpdate struct {
+	Session RadiusSession
+
+	// True if the session was stopped. Only the Id and LastUpdated of the session are relevant then
+	Deleted bool
+}
+
+// Sends the updates of the session store to the peer instance
+type Replicator struct {
+	url   string
+	token string
+
+	// Format of the updates sent, core.CONTENT_TYPE_JSON or core.CONTENT_TYPE_CBOR
+	contentType string
+
+	client http.Client
+	queue  chan SessionUpdate
+
+	// To wait for the sender to finish
+	wg sync.WaitGroup
+}
+
+// Creates a replicator that sends the updates to the specified URL of the peer, with the access token
+// as bearer, if not empty. The encoding may be "json", "cbor" or empty, meaning json. If the queue size
+// is zero, the default one is used
+func NewReplicator(url string, token string, encoding string, queueSize int) (*Replicator, error) {
+	contentType, err := core.ContentTypeFor(encoding)
+	if err == nil && contentType == core.CONTENT_TYPE_BINARY {
+		err = fmt.Errorf("%s: %w", contentType, core.ErrUnsupportedContentType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bad session replication encoding: %w", err)
+	}
+
+	if queueSize <= 0 {
+		queueSize = DEFAULT_REPLICATION_QUEUE_SIZE
+	}
+
+	r := Replicator{
+		url:         url,
+		token:       token,
+		contentType: contentType,
+		client: http.Client{
+			Timeout:   DEFAULT_REPLICATION_TIMEOUT_MILLIS * time.Millisecond,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}, // the peers use self signed certificates
+		},
+		queue: make(chan SessionUpdate, queueSize),
+	}
+
+	r.wg.Add(1)
+	go r.sendLoop()
+
+	return &r, nil
+}
+
+// Stops sending, after the updates in the queue are sent. Must not be called while the store is still in use
+func (r *Replicator) Close() {
+	close(r.queue)
+	r.wg.Wait()
+}
+
+// Queues the update without blocking. Returns false if the queue is full
+func (r *Replicator) push(update SessionUpdate) bool {
+	select {
+	case r.queue <- update:
+		return true
+	default:
+		return false
+	}
+}
+
+// Sends the queued updates, grouping those available in the same request, until the queue is closed
+func (r *Replicator) sendLoop() {
+	defer r.wg.Done()
+
+	for update := range r.queue {
+		batch := []SessionUpdate{update}
+	fill:
+		for len(batch) < MAX_REPLICATION_BATCH {
+			select {
+			case next, ok := <-r.queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, next)
+			default:
+				break fill
+			}
+		}
+		r.send(batch)
+	}
+}
+
+// Posts the updates to the peer
+func (r *Replicator) send(batch []SessionUpdate) {
+	body, err := core.Marshal(r.contentType, batch)
+	if err != nil {
+		config.GetLogger().Errorf("could not serialize session updates: %s", err)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		config.GetLogger().Errorf("bad session replication URL %s: %s", r.url, err)
+		return
+	}
+	req.Header.Set("Content-Type", r.contentType)
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		config.GetLogger().Errorf("could not replicate %d session updates to %s: %s", len(batch), r.url, err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		config.GetLogger().Errorf("session replication to %s returned status %d", r.url, resp.StatusCode)
+	}
+}
+
+// Sets the replicator to send the changes in the sessions to
+func (s *RadiusSessionStore) SetReplicator(r *Replicator) {
+	s.replicator.Store(r)
+}
+
+// Sends the update to the replicator, if set
+func (s *RadiusSessionStore) replicate(update SessionUpdate) {
+	r, _ := s.replicator.Load().(*Replicator)
+	if r == nil {
+		return
+	}
+	if !r.push(update) {
+		config.GetLogger().Warnf("session replication queue full. Update of %s lost", update.Session.Id)
+	}
+}
+
+// Applies the updates received from the peer instance. As in Import, a session is replaced or deleted only
+// if the update is more recent. The updates are not replicated again. Returns the number of updates applied
+func (s *RadiusSessionStore) ApplyUpdates(updates []SessionUpdate) int {
+	s.Lock()
+	defer s.Unlock()
+
+	applied := 0
+	for i := range updates {
+		session := updates[i].Session
+		if session.Id == "" || (session.Packet == nil && !updates[i].Deleted) {
+			continue
+		}
+
+		previous, found := s.sessions[session.Id]
+		if !found && updates[i].Deleted {
+			continue
+		}
+		if found {
+			if !session.LastUpdated.After(previous.LastUpdated) {
+				continue
+			}
+			s.removeFromIndexes(previous)
+			delete(s.sessions, session.Id)
+		}
+
+		if !updates[i].Deleted {
+			s.sessions[session.Id] = &session
+			s.addToIndexes(&session)
+		}
+		applied++
+	}
+	return applied
+}
@@ -0,0 +1,636 @@
+package sessionserver
+
+import (
+	"encoding/json"
+	"errors"
+	"igor/cdr"
+	"igor/config"
+	"igor/core"
+	"igor/instrumentation"
+	"igor/ippool"
+	"igor/radiuscodec"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestMain(m *testing.M) {
+
+	// Initialize the Config Object
+	config.InitPolicyConfigInstance("resources/searchRules.json", "testServer", true)
+
+	// Execute the tests and exit
+	os.Exit(m.Run())
+}
+
+// Values of Acct-Status-Type
+var statusTypes = map[string]int{"Start": 1, "Stop": 2, "Interim-Update": 3}
+
+// Helper to build accounting packets
+func accountingRequest(statusType string, sessionId string, userName string) *radiuscodec.RadiusPacket {
+	packet := radiuscodec.NewRadiusRequest(radiuscodec.ACCOUNTING_REQUEST)
+	packet.Add("Acct-Status-Type", statusTypes[statusType])
+	packet.Add("Acct-Session-Id", sessionId)
+	packet.Add("User-Name", userName)
+	return packet
+}
+
+func TestSessionStore(t *testing.T) {
+
+	store := NewRadiusSessionStore("", []string{"User-Name"})
+
+	store.PushAccounting(accountingRequest("Start", "session-1", "user@igor"))
+	store.PushAccounting(accountingRequest("Start", "session-2", "user@igor"))
+	store.PushAccounting(accountingRequest("Interim-Update", "session-1", "user@igor"))
+	if store.Len() != 2 {
+		t.Errorf("expected 2 sessions but got %d", store.Len())
+	}
+	if sessions := store.FindByIndex("User-Name", "user@igor"); len(sessions) != 2 || sessions[0].Id != "session-1" {
+		t.Errorf("bad sessions by User-Name %v", sessions)
+	}
+
+	// Session stopped
+	if previous := store.PushAccounting(accountingRequest("Stop", "session-2", "user@igor")); previous == nil || previous.Id != "session-2" {
+		t.Errorf("previous session not returned")
+	}
+	if _, found := store.Get("session-2"); found {
+		t.Errorf("session found after stop")
+	}
+	if sessions := store.FindByIndex("User-Name", "user@igor"); len(sessions) != 1 {
+		t.Errorf("expected 1 session but got %d", len(sessions))
+	}
+}
+
+func TestSimultaneousUse(t *testing.T) {
+
+	conf := config.GetPolicyConfig().SimultaneousUseConf()
+	store := NewRadiusSessionStore("", []string{USER_NAME_INDEX})
+
+	store.PushAccounting(accountingRequest("Start", "session-1", "user@igor"))
+	time.Sleep(1 * time.Millisecond)
+	store.PushAccounting(accountingRequest("Start", "session-2", "user@igor"))
+	store.PushAccounting(accountingRequest("Start", "session-3", "user@single.com"))
+	store.PushAccounting(accountingRequest("Start", "session-4", "user@unlimited.com"))
+	store.PushAccounting(accountingRequest("Start", "session-5", "user@unlimited.com"))
+
+	// Default limit
+	if err := CheckSimultaneousUse(store, conf, "user@igor", nil); !errors.Is(err, ErrSimultaneousUseExceeded) {
+		t.Errorf("expected simultaneous use error but got %v", err)
+	}
+	if err := CheckSimultaneousUse(store, conf, "other@igor", nil); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+
+	// Realm overrides
+	if err := CheckSimultaneousUse(store, conf, "user@single.com", nil); !errors.Is(err, ErrSimultaneousUseExceeded) {
+		t.Errorf("expected simultaneous use error but got %v", err)
+	}
+	if err := CheckSimultaneousUse(store, conf, "user@unlimited.com", nil); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+
+	// Disconnect the oldest session
+	conf.Action = "disconnectOldest"
+	var disconnected []string
+	err := CheckSimultaneousUse(store, conf, "user@igor", func(session RadiusSession) error {
+		disconnected = append(disconnected, session.Id)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+	if len(disconnected) != 1 || disconnected[0] != "session-1" {
+		t.Errorf("bad disconnected sessions %v", disconnected)
+	}
+}
+
+func TestFramedIPConflict(t *testing.T) {
+
+	// Webhook receiving the notifications
+	conflictsChan := make(chan FramedIPConflict, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var conflict FramedIPConflict
+		json.NewDecoder(req.Body).Decode(&conflict)
+		conflictsChan <- conflict
+	}))
+	defer webhook.Close()
+
+	conf := config.FramedIPConflictConfig{DisconnectOlder: true, WebhookURL: webhook.URL}
+	store := NewRadiusSessionStore("", []string{FRAMED_IP_INDEX})
+	instrumentation.MS.ResetMetrics()
+
+	oldPacket := accountingRequest("Start", "session-1", "user1@igor")
+	oldPacket.Add("Framed-IP-Address", "10.0.0.1")
+	store.PushAccounting(oldPacket)
+
+	// Same session does not conflict with itself
+	if conflicts := CheckFramedIPConflict(store, conf, oldPacket, nil); len(conflicts) != 0 {
+		t.Errorf("unexpected conflicts %v", conflicts)
+	}
+
+	newPacket := accountingRequest("Start", "session-2", "user2@igor")
+	newPacket.Add("Framed-IP-Address", "10.0.0.1")
+	newPacket.Add("NAS-IP-Address", "127.0.0.1")
+	var disconnected []string
+	conflicts := CheckFramedIPConflict(store, conf, newPacket, func(session RadiusSession) error {
+		disconnected = append(disconnected, session.Id)
+		return nil
+	})
+	if len(conflicts) != 1 || len(disconnected) != 1 || disconnected[0] != "session-1" {
+		t.Errorf("bad conflicts %v or disconnected sessions %v", conflicts, disconnected)
+	}
+
+	select {
+	case conflict := <-conflictsChan:
+		if conflict.ConflictingSessionId != "session-1" || conflict.SessionId != "session-2" || conflict.FramedIPAddress != "10.0.0.1" {
+			t.Errorf("bad conflict notification %v", conflict)
+		}
+	case <-time.After(1 * time.Second):
+		t.Errorf("conflict not notified")
+	}
+
+	metrics := instrumentation.MS.RadiusQuery("RadiusFramedIPConflicts", nil, []string{"Endpoint"})
+	if metrics[instrumentation.RadiusMetricKey{Endpoint: "127.0.0.1"}] != 1 {
+		t.Errorf("bad conflicts metric %v", metrics)
+	}
+
+	// Checked by the store when pushing the accounting packets
+	store.SetFramedIPConflictCheck(config.GetPolicyConfig(), nil)
+	store.PushAccounting(newPacket)
+	time.Sleep(100 * time.Millisecond)
+	metrics = instrumentation.MS.RadiusQuery("RadiusFramedIPConflicts", nil, []string{"Endpoint"})
+	if metrics[instrumentation.RadiusMetricKey{Endpoint: "127.0.0.1"}] != 2 {
+		t.Errorf("conflict in pushed packet not detected %v", metrics)
+	}
+	store.PushAccounting(accountingRequest("Stop", "session-1", "user1@igor"))
+	store.PushAccounting(newPacket)
+	time.Sleep(100 * time.Millisecond)
+	metrics = instrumentation.MS.RadiusQuery("RadiusFramedIPConflicts", nil, []string{"Endpoint"})
+	if metrics[instrumentation.RadiusMetricKey{Endpoint: "127.0.0.1"}] != 2 {
+		t.Errorf("conflict detected after the older session stopped %v", metrics)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+
+	ci := config.GetPolicyConfig()
+
+	// The test radius client is configured with the huawei template, which uses CoA
+	packet := accountingRequest("Start", "session-1", "user@igor")
+	packet.Add("NAS-IP-Address", "127.0.0.1")
+	packet.Add("NAS-Port", 7)
+	packet.Add("Framed-IP-Address", "10.0.0.1")
+	session := RadiusSession{Id: "session-1", Packet: packet}
+
+	request, endpoint, secret, err := BuildDisconnectRequest(ci, session)
+	if err != nil {
+		t.Fatalf("could not build disconnect request %s", err)
+	}
+	if request.Code != radiuscodec.COA_REQUEST || endpoint != "127.0.0.1:3800" || secret != "secret" {
+		t.Errorf("bad disconnect request %d to %s with %s", request.Code, endpoint, secret)
+	}
+	if request.GetIntAVP("NAS-Port") != 7 || request.GetStringAVP("Framed-IP-Address") != "10.0.0.1" {
+		t.Errorf("attributes not copied from session %s", request)
+	}
+	if request.GetStringAVP("User-Name") != "" {
+		t.Errorf("attribute not in template was copied %s", request)
+	}
+
+	// Answered with ACK and NAK
+	var responseCode byte = radiuscodec.COA_ACK
+	sender := func(endpoint string, packet *radiuscodec.RadiusPacket, secret string) (*radiuscodec.RadiusPacket, error) {
+		response := radiuscodec.NewRadiusResponse(packet, true)
+		response.Code = responseCode
+		return response, nil
+	}
+	if err := Disconnect(ci, session, sender); err != nil {
+		t.Errorf("disconnect error %s", err)
+	}
+	responseCode = radiuscodec.COA_NAK
+	if err := Disconnect(ci, session, sender); !errors.Is(err, ErrDisconnectRejected) {
+		t.Errorf("expected disconnect rejected but got %v", err)
+	}
+
+	// Missing attribute in session
+	packet = accountingRequest("Start", "session-2", "user@igor")
+	packet.Add("NAS-IP-Address", "127.0.0.1")
+	if _, _, _, err := BuildDisconnectRequest(ci, RadiusSession{Id: "session-2", Packet: packet}); err == nil {
+		t.Errorf("disconnect request built with missing attribute")
+	}
+
+	// Unknown NAS
+	packet = accountingRequest("Start", "session-3", "user@igor")
+	packet.Add("NAS-IP-Address", "127.0.0.9")
+	if _, _, _, err := BuildDisconnectRequest(ci, RadiusSession{Id: "session-3", Packet: packet}); err == nil {
+		t.Errorf("disconnect request built for unknown NAS")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+
+	store := NewRadiusSessionStore("", []string{"User-Name"})
+	store.PushAccounting(accountingRequest("Start", "session-1", "user@igor"))
+	store.PushAccounting(accountingRequest("Start", "session-2", "other@igor"))
+
+	fileName := filepath.Join(t.TempDir(), "sessions.json")
+	if n, err := store.SaveSnapshotFile(fileName); err != nil || n != 2 {
+		t.Fatalf("could not save snapshot %d %v", n, err)
+	}
+
+	// Import in a new store. The indexes are rebuilt
+	newStore := NewRadiusSessionStore("", []string{"User-Name"})
+	if n, err := newStore.LoadSnapshotFile(fileName); err != nil || n != 2 {
+		t.Fatalf("could not load snapshot %d %v", n, err)
+	}
+	if sessions := newStore.FindByIndex("User-Name", "other@igor"); len(sessions) != 1 || sessions[0].Id != "session-2" {
+		t.Errorf("bad sessions by User-Name after import %v", sessions)
+	}
+	original, _ := store.Get("session-1")
+	imported, _ := newStore.Get("session-1")
+	if !imported.StartTime.Equal(original.StartTime) || imported.Packet.GetStringAVP("Acct-Status-Type") != "Start" {
+		t.Errorf("bad imported session %v", imported)
+	}
+
+	// Sessions updated later than the snapshot are kept
+	newStore.PushAccounting(accountingRequest("Interim-Update", "session-1", "changed@igor"))
+	if n, _ := newStore.LoadSnapshotFile(fileName); n != 0 {
+		t.Errorf("imported %d stale sessions", n)
+	}
+	if sessions := newStore.FindByIndex("User-Name", "changed@igor"); len(sessions) != 1 {
+		t.Errorf("updated session was overwritten")
+	}
+
+	if _, err := newStore.ReadSnapshot(strings.NewReader("not json"), core.CONTENT_TYPE_JSON); err == nil {
+		t.Errorf("bad snapshot imported")
+	}
+
+	// CBOR format
+	cborFileName := filepath.Join(t.TempDir(), "sessions.cbor")
+	if n, err := store.SaveSnapshotFile(cborFileName); err != nil || n != 2 {
+		t.Fatalf("could not save CBOR snapshot %d %v", n, err)
+	}
+	cborStore := NewRadiusSessionStore("", []string{"User-Name"})
+	if n, err := cborStore.LoadSnapshotFile(cborFileName); err != nil || n != 2 {
+		t.Fatalf("could not load CBOR snapshot %d %v", n, err)
+	}
+	if sessions := cborStore.FindByIndex("User-Name", "other@igor"); len(sessions) != 1 || sessions[0].Packet.GetStringAVP("Acct-Session-Id") != "session-2" {
+		t.Errorf("bad sessions by User-Name after CBOR import %v", sessions)
+	}
+}
+
+func TestSessionUsage(t *testing.T) {
+
+	store := NewRadiusSessionStore("", []string{"User-Name"})
+
+	start := accountingRequest("Start", "session-1", "user@igor")
+	store.PushAccounting(start)
+
+	// Input with Gigawords. Output without them, wrapping between interims
+	interim := accountingRequest("Interim-Update", "session-1", "user@igor")
+	interim.Add("Acct-Input-Octets", 100)
+	interim.Add("Acct-Input-Gigawords", 2)
+	interim.Add("Acct-Output-Octets", 4000000000)
+	interim.Add("Acct-Input-Packets", 10)
+	interim.Add("Acct-Session-Time", 60)
+	store.PushAccounting(interim)
+
+	// Same packet twice does not change the counters
+	store.PushAccounting(interim)
+
+	interim = accountingRequest("Interim-Update", "session-1", "user@igor")
+	interim.Add("Acct-Input-Octets", 200)
+	interim.Add("Acct-Input-Gigawords", 2)
+	interim.Add("Acct-Output-Octets", 1000)
+	interim.Add("Acct-Input-Packets", 20)
+	interim.Add("Acct-Session-Time", 120)
+	store.PushAccounting(interim)
+
+	session, _ := store.Get("session-1")
+	expected := SessionUsage{InputOctets: 2<<32 + 200, OutputOctets: 1<<32 + 1000, InputPackets: 20, SessionTime: 120}
+	if session.Usage != expected {
+		t.Errorf("usage was %+v", session.Usage)
+	}
+
+	store.PushAccounting(accountingRequest("Start", "session-2", "user@igor"))
+	interim = accountingRequest("Interim-Update", "session-2", "user@igor")
+	interim.Add("Acct-Input-Packets", 5)
+	store.PushAccounting(interim)
+	if usage := store.UsageByIndex("User-Name", "user@igor"); usage.InputPackets != 25 || usage.InputOctets != expected.InputOctets {
+		t.Errorf("usage by user was %+v", usage)
+	}
+
+	// The CDR stage includes the usage until the stop
+	stop := accountingRequest("Stop", "session-1", "user@igor")
+	stop.Add("Acct-Input-Octets", 300)
+	stop.Add("Acct-Input-Gigawords", 2)
+	stop.Add("Acct-Session-Time", 150)
+	c := cdr.CDR{Packet: stop}
+	if ok, err := store.UsageStage()(&c); !ok || err != nil {
+		t.Fatalf("usage stage failed %s", err)
+	}
+	if c.Attributes[CDR_SESSION_INPUT_OCTETS][0] != strconv.FormatUint(2<<32+300, 10) || c.Attributes[CDR_SESSION_OUTPUT_OCTETS][0] != strconv.FormatUint(1<<32+1000, 10) {
+		t.Errorf("bad usage in CDR %v", c.Attributes)
+	}
+	if _, found := store.Get("session-1"); found {
+		t.Errorf("session found after stop in CDR stage")
+	}
+}
+
+func TestSessionExpiration(t *testing.T) {
+
+	store := NewRadiusSessionStore("", []string{NAS_PORT_INDEX})
+
+	packet := accountingRequest("Start", "session-1", "user@igor")
+	packet.Add("NAS-IP-Address", "10.0.0.1")
+	packet.Add("NAS-Port", 7)
+	store.PushAccounting(packet)
+	store.PushAccounting(accountingRequest("Start", "session-2", "user@igor"))
+
+	// Composite index. Not indexed if some attribute is missing
+	if sessions := store.FindByIndex(NAS_PORT_INDEX, "10.0.0.1/7"); len(sessions) != 1 || sessions[0].Id != "session-1" {
+		t.Errorf("bad sessions by NAS port %v", sessions)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	store.PushAccounting(accountingRequest("Interim-Update", "session-2", "user@igor"))
+	if expired := store.ExpireSessions(25 * time.Millisecond); expired != 1 {
+		t.Errorf("expected 1 expired session but got %d", expired)
+	}
+	if _, found := store.Get("session-2"); !found || store.Len() != 1 {
+		t.Errorf("updated session was expired")
+	}
+	if sessions := store.FindByIndex(NAS_PORT_INDEX, "10.0.0.1/7"); len(sessions) != 0 {
+		t.Errorf("expired session still indexed")
+	}
+}
+
+func TestReplication(t *testing.T) {
+
+	// The peer instance
+	peerStore := NewRadiusSessionStore("", []string{USER_NAME_INDEX})
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer peerToken" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		var updates []SessionUpdate
+		if err := core.Unmarshal(req.Header.Get("Content-Type"), body, &updates); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		peerStore.ApplyUpdates(updates)
+	}))
+	defer peer.Close()
+
+	if _, err := NewReplicator(peer.URL, "peerToken", "binary", 0); err == nil {
+		t.Errorf("binary encoding accepted for replication")
+	}
+
+	store := NewRadiusSessionStore("", []string{USER_NAME_INDEX})
+	replicator, err := NewReplicator(peer.URL, "peerToken", "cbor", 0)
+	if err != nil {
+		t.Fatalf("could not create replicator %s", err)
+	}
+	store.SetReplicator(replicator)
+
+	store.PushAccounting(accountingRequest("Start", "session-1", "user@igor"))
+	store.PushAccounting(accountingRequest("Start", "session-2", "user@igor"))
+	store.PushAccounting(accountingRequest("Stop", "session-1", "user@igor"))
+	replicator.Close()
+
+	if sessions := peerStore.FindByIndex(USER_NAME_INDEX, "user@igor"); len(sessions) != 1 || sessions[0].Id != "session-2" {
+		t.Errorf("bad replicated sessions %v", sessions)
+	}
+
+	// Stale updates are ignored
+	session, _ := store.Get("session-2")
+	session.LastUpdated = session.LastUpdated.Add(-time.Second)
+	if n := peerStore.ApplyUpdates([]SessionUpdate{{Session: session, Deleted: true}}); n != 0 || peerStore.Len() != 1 {
+		t.Errorf("stale update applied")
+	}
+}
+
+// Backend that keeps the sessions in memory
+type memoryBackend struct {
+	sync.Mutex
+	sessions map[string]RadiusSession
+}
+
+func (b *memoryBackend) Save(session RadiusSession) error {
+	b.Lock()
+	defer b.Unlock()
+	if stored, found := b.sessions[session.Id]; !found || !stored.LastUpdated.After(session.LastUpdated) {
+		b.sessions[session.Id] = session
+	}
+	return nil
+}
+
+func (b *memoryBackend) Delete(id string, lastUpdated time.Time) error {
+	b.Lock()
+	defer b.Unlock()
+	if stored, found := b.sessions[id]; found && !stored.LastUpdated.After(lastUpdated) {
+		delete(b.sessions, id)
+	}
+	return nil
+}
+
+func (b *memoryBackend) LoadAll() ([]RadiusSession, error) {
+	b.Lock()
+	defer b.Unlock()
+	var sessions []RadiusSession
+	for _, session := range b.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+func (b *memoryBackend) Close() error {
+	return nil
+}
+
+func (b *memoryBackend) len() int {
+	b.Lock()
+	defer b.Unlock()
+	return len(b.sessions)
+}
+
+func TestSessionBackend(t *testing.T) {
+
+	backend := &memoryBackend{sessions: make(map[string]RadiusSession)}
+
+	for _, mode := range []string{WRITE_THROUGH, WRITE_BEHIND} {
+		store := NewRadiusSessionStore("", []string{USER_NAME_INDEX})
+		if _, err := store.SetBackend(backend, mode, 0); err != nil {
+			t.Fatalf("could not set backend in mode %s: %s", mode, err)
+		}
+		store.PushAccounting(accountingRequest("Start", "session-1", "user@igor"))
+		store.PushAccounting(accountingRequest("Start", "session-2", "user@igor"))
+		store.PushAccounting(accountingRequest("Stop", "session-2", "user@igor"))
+		store.CloseBackend()
+		if backend.len() != 1 {
+			t.Errorf("expected 1 session in backend in mode %s but got %d", mode, backend.len())
+		}
+	}
+
+	// The sessions are loaded on restart
+	store := NewRadiusSessionStore("", []string{USER_NAME_INDEX})
+	if n, err := store.SetBackend(backend, WRITE_THROUGH, 0); err != nil || n != 1 {
+		t.Fatalf("loaded %d sessions from backend with error %v", n, err)
+	}
+	if sessions := store.FindByIndex(USER_NAME_INDEX, "user@igor"); len(sessions) != 1 || sessions[0].Id != "session-1" {
+		t.Errorf("bad sessions loaded %v", sessions)
+	}
+
+	// Expired sessions are removed from the backend
+	time.Sleep(10 * time.Millisecond)
+	store.ExpireSessions(5 * time.Millisecond)
+	if backend.len() != 0 {
+		t.Errorf("expired session not removed from backend")
+	}
+
+	if _, err := store.SetBackend(backend, "badMode", 0); err == nil {
+		t.Errorf("bad mode accepted")
+	}
+}
+
+func TestRedisBackend(t *testing.T) {
+
+	server := miniredis.RunT(t)
+	backend := NewRedisBackend(server.Addr(), "", 0, "igor:session:", time.Hour)
+	defer backend.Close()
+
+	store := NewRadiusSessionStore("", []string{USER_NAME_INDEX})
+	store.SetBackend(backend, WRITE_THROUGH, 0)
+	store.PushAccounting(accountingRequest("Start", "session-1", "user@igor"))
+	store.PushAccounting(accountingRequest("Start", "session-2", "user@igor"))
+	store.PushAccounting(accountingRequest("Stop", "session-1", "user@igor"))
+
+	if !server.Exists("igor:session:session-2") || server.Exists("igor:session:session-1") || server.TTL("igor:session:session-2") != time.Hour {
+		t.Errorf("bad keys in redis %v", server.Keys())
+	}
+
+	sessions, err := backend.LoadAll()
+	if err != nil || len(sessions) != 1 || sessions[0].Packet.GetStringAVP("User-Name") != "user@igor" {
+		t.Errorf("bad sessions loaded from redis %v %v", sessions, err)
+	}
+
+	// Writes older than the session stored are ignored
+	stale := sessions[0]
+	stale.LastUpdated = stale.LastUpdated.Add(-time.Second)
+	stale.Usage.InputOctets = 1000
+	if err := backend.Save(stale); err != nil {
+		t.Errorf("could not save stale session %s", err)
+	}
+	if err := backend.Delete(stale.Id, stale.LastUpdated); err != nil {
+		t.Errorf("could not delete stale session %s", err)
+	}
+	if sessions, _ := backend.LoadAll(); len(sessions) != 1 || sessions[0].Usage.InputOctets != 0 {
+		t.Errorf("stale write applied in redis %v", sessions)
+	}
+}
+
+func TestPostgresBackend(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("could not create mock database %s", err)
+	}
+
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS sessions").WillReturnResult(sqlmock.NewResult(0, 0))
+	backend, err := newPostgresBackend(db, "sessions")
+	if err != nil {
+		t.Fatalf("could not create backend %s", err)
+	}
+
+	session := RadiusSession{Id: "session-1", Packet: accountingRequest("Start", "session-1", "user@igor"), LastUpdated: time.Now()}
+	mock.ExpectExec("INSERT INTO sessions .* ON CONFLICT \\(id\\) DO UPDATE .* WHERE sessions.last_updated <= EXCLUDED.last_updated").
+		WithArgs("session-1", sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	if err := backend.Save(session); err != nil {
+		t.Errorf("could not save session %s", err)
+	}
+
+	jSession, _ := json.Marshal(session)
+	mock.ExpectQuery("SELECT id, session FROM sessions").WillReturnRows(sqlmock.NewRows([]string{"id", "session"}).AddRow("session-1", jSession))
+	if sessions, err := backend.LoadAll(); err != nil || len(sessions) != 1 || sessions[0].Packet.GetStringAVP("User-Name") != "user@igor" {
+		t.Errorf("bad sessions loaded %v %v", sessions, err)
+	}
+
+	mock.ExpectExec("DELETE FROM sessions WHERE id = \\$1 AND last_updated <= \\$2").WithArgs("session-1", session.LastUpdated).WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := backend.Delete("session-1", session.LastUpdated); err != nil {
+		t.Errorf("could not delete session %s", err)
+	}
+
+	mock.ExpectClose()
+	backend.Close()
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := newPostgresBackend(db, "sessions; DROP TABLE x"); err == nil {
+		t.Errorf("bad table name accepted")
+	}
+}
+
+func TestLeaseBackends(t *testing.T) {
+
+	lease := ippool.Lease{Pool: "v6", Address: "2001:db8:100::/56", StickyKey: "user@igor", LastUpdated: time.Now()}
+
+	// Redis, with the sessions in the same prefix
+	server := miniredis.RunT(t)
+	redisBackend := NewRedisBackend(server.Addr(), "", 0, "igor:session:", 0)
+	defer redisBackend.Close()
+
+	store := NewRadiusSessionStore("", []string{USER_NAME_INDEX})
+	store.SetBackend(redisBackend, WRITE_THROUGH, 0)
+	store.PushAccounting(accountingRequest("Start", "session-1", "user@igor"))
+	if err := redisBackend.SaveLease(lease); err != nil {
+		t.Fatalf("could not save lease in redis %s", err)
+	}
+	if leases, err := redisBackend.LoadLeases(); err != nil || len(leases) != 1 || leases[0].StickyKey != "user@igor" {
+		t.Errorf("bad leases loaded from redis %v %v", leases, err)
+	}
+	if sessions, err := redisBackend.LoadAll(); err != nil || len(sessions) != 1 {
+		t.Errorf("leases loaded as sessions %v %v", sessions, err)
+	}
+
+	// PostgreSQL
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("could not create mock database %s", err)
+	}
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS sessions ").WillReturnResult(sqlmock.NewResult(0, 0))
+	postgresBackend, err := newPostgresBackend(db, "sessions")
+	if err != nil {
+		t.Fatalf("could not create backend %s", err)
+	}
+
+	mock.ExpectExec("INSERT INTO sessions_leases .* ON CONFLICT \\(pool, address\\) DO UPDATE .* WHERE sessions_leases.last_updated <= EXCLUDED.last_updated").
+		WithArgs("v6", "2001:db8:100::/56", sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	if err := postgresBackend.SaveLease(lease); err != nil {
+		t.Errorf("could not save lease %s", err)
+	}
+
+	jLease, _ := json.Marshal(lease)
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS sessions_leases").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT address, lease FROM sessions_leases").WillReturnRows(sqlmock.NewRows([]string{"address", "lease"}).AddRow(lease.Address, jLease))
+	if leases, err := postgresBackend.LoadLeases(); err != nil || len(leases) != 1 || leases[0].Address != lease.Address {
+		t.Errorf("bad leases loaded %v %v", leases, err)
+	}
+
+	mock.ExpectClose()
+	postgresBackend.Close()
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,47 @@
+package sessionserver
+
+import (
+	"errors"
+	"fmt"
+	"igor/config"
+)
+
+// Index required in the session store for the simultaneous use check
+const USER_NAME_INDEX = "User-Name"
+
+// Returned when the User-Name has already the maximum number of sessions
+var ErrSimultaneousUseExceeded = errors.New("simultaneous use limit exceeded")
+
+// Function to send the Disconnect-Request for the specified session
+type DisconnectFunc func(session RadiusSession) error
+
+// Checks whether a new session for the User-Name is allowed, given the sessions in the store,
+// which must have a User-Name index. If the limit is reached and the configured action is
+// "disconnectOldest", the oldest sessions are disconnected using the specified function and the
+// new session is allowed. Otherwise, ErrSimultaneousUseExceeded is returned. The radius router
+// invokes it for the Access-Accept responses if it has been given the store with SetSessionStore
+func CheckSimultaneousUse(store *RadiusSessionStore, conf config.SimultaneousUseConfig, userName string, disconnect DisconnectFunc) error {
+
+	maxSessions := conf.MaxSessionsFor(userName)
+	if maxSessions <= 0 {
+		return nil
+	}
+
+	sessions := store.FindByIndex(USER_NAME_INDEX, userName)
+	if len(sessions) < maxSessions {
+		return nil
+	}
+
+	if conf.Action != "disconnectOldest" || disconnect == nil {
+		return fmt.Errorf("%s has %d sessions: %w", userName, len(sessions), ErrSimultaneousUseExceeded)
+	}
+
+	// Make room for the new session. Sessions are sorted by start time
+	for _, session := range sessions[:len(sessions)-maxSessions+1] {
+		if err := disconnect(session); err != nil {
+			return fmt.Errorf("could not disconnect session %s of %s: %w", session.Id, userName, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package sessionserver
+
+import (
+	"fmt"
+	"igor/core"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Contents of a snapshot of the session store, used to migrate the sessions between instances
+// and to warm up a standby instance
+type SessionSnapshot struct {
+	Timestamp time.Time
+	Sessions  []RadiusSession
+}
+
+// Returns a copy of all the sessions in the store
+func (s *RadiusSessionStore) Snapshot() SessionSnapshot {
+	s.RLock()
+	defer s.RUnlock()
+
+	snapshot := SessionSnapshot{Timestamp: time.Now(), Sessions: make([]RadiusSession, 0, len(s.sessions))}
+	for _, session := range s.sessions {
+		snapshot.Sessions = append(snapshot.Sessions, *session)
+	}
+	return snapshot
+}
+
+// Adds the sessions in the snapshot to the store. An existing session with the same Id is replaced
+// only if the imported one was updated later. Returns the number of sessions imported
+func (s *RadiusSessionStore) Import(snapshot SessionSnapshot) int {
+	s.Lock()
+	defer s.Unlock()
+
+	imported := 0
+	for i := range snapshot.Sessions {
+		session := snapshot.Sessions[i]
+		if session.Id == "" || session.Packet == nil {
+			continue
+		}
+		if previous, found := s.sessions[session.Id]; found {
+			if !session.LastUpdated.After(previous.LastUpdated) {
+				continue
+			}
+			s.removeFromIndexes(previous)
+		}
+		s.sessions[session.Id] = &session
+		s.addToIndexes(&session)
+		imported++
+	}
+	return imported
+}
+
+// Writes the snapshot of the store in the specified format (core.CONTENT_TYPE_JSON or
+// core.CONTENT_TYPE_CBOR). Returns the number of sessions written
+func (s *RadiusSessionStore) WriteSnapshot(w io.Writer, contentType string) (int, error) {
+	snapshot := s.Snapshot()
+	b, err := core.Marshal(contentType, snapshot)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(b); err != nil {
+		return 0, err
+	}
+	return len(snapshot.Sessions), nil
+}
+
+// Reads a snapshot in the specified format and imports it. Returns the number of sessions imported
+func (s *RadiusSessionStore) ReadSnapshot(r io.Reader, contentType string) (int, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	var snapshot SessionSnapshot
+	if err := core.Unmarshal(contentType, b, &snapshot); err != nil {
+		return 0, fmt.Errorf("bad session snapshot: %w", err)
+	}
+	return s.Import(snapshot), nil
+}
+
+// Returns the format of the snapshot file, CBOR if the extension is .cbor, JSON otherwise
+func snapshotFileContentType(fileName string) string {
+	if filepath.Ext(fileName) == ".cbor" {
+		return core.CONTENT_TYPE_CBOR
+	}
+	return core.CONTENT_TYPE_JSON
+}
+
+// Writes the snapshot to the specified file, in CBOR if the extension is .cbor and in JSON otherwise.
+// The contents are written to a temporary file which is then renamed, so that the file is never left
+// half written
+func (s *RadiusSessionStore) SaveSnapshotFile(fileName string) (int, error) {
+	tmpFile, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	n, err := s.WriteSnapshot(tmpFile, snapshotFileContentType(fileName))
+	if cerr := tmpFile.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, os.Rename(tmpFile.Name(), fileName)
+}
+
+// Imports the snapshot in the specified file, in CBOR if the extension is .cbor and in JSON otherwise.
+// Returns the number of sessions imported
+func (s *RadiusSessionStore) LoadSnapshotFile(fileName string) (int, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return s.ReadSnapshot(file, snapshotFileContentType(fileName))
+}
@@ -0,0 +1,77 @@
+package sessionserver
+
+import (
+	"igor/cdr"
+	"igor/radiuscodec"
+	"strconv"
+)
+
+// Aggregation of the counters reported in the accounting packets of a session. The octets and packets
+// are cumulative since the start of the session, and reported as 32 bit values. For the octets, the
+// NAS may also report the number of times the counter has wrapped in the Gigawords attributes. If not,
+// the roll over is detected comparing with the previous value
+
+// Names of the attributes with the usage of the session added to the CDR by the usage stage
+const (
+	CDR_SESSION_INPUT_OCTETS   = cdr.SESSION_INPUT_OCTETS
+	CDR_SESSION_OUTPUT_OCTETS  = cdr.SESSION_OUTPUT_OCTETS
+	CDR_SESSION_INPUT_PACKETS  = cdr.SESSION_INPUT_PACKETS
+	CDR_SESSION_OUTPUT_PACKETS = cdr.SESSION_OUTPUT_PACKETS
+	CDR_SESSION_TIME           = cdr.SESSION_TIME
+)
+
+// Usage of a radius session
+type SessionUsage struct {
+	InputOctets   uint64
+	OutputOctets  uint64
+	InputPackets  uint64
+	OutputPackets uint64
+
+	// In seconds
+	SessionTime uint64
+}
+
+// Returns the usage updated with the counters in the accounting packet. Applying the same packet
+// twice does not change the result
+func (u SessionUsage) Update(packet *radiuscodec.RadiusPacket) SessionUsage {
+	return SessionUsage{
+		InputOctets:   cdr.UpdateCounter(u.InputOctets, packet, "Acct-Input-Octets", "Acct-Input-Gigawords"),
+		OutputOctets:  cdr.UpdateCounter(u.OutputOctets, packet, "Acct-Output-Octets", "Acct-Output-Gigawords"),
+		InputPackets:  cdr.UpdateCounter(u.InputPackets, packet, "Acct-Input-Packets", ""),
+		OutputPackets: cdr.UpdateCounter(u.OutputPackets, packet, "Acct-Output-Packets", ""),
+		SessionTime:   cdr.UpdateCounter(u.SessionTime, packet, "Acct-Session-Time", ""),
+	}
+}
+
+// Returns the sum of both usages
+func (u SessionUsage) Add(other SessionUsage) SessionUsage {
+	return SessionUsage{
+		InputOctets:   u.InputOctets + other.InputOctets,
+		OutputOctets:  u.OutputOctets + other.OutputOctets,
+		InputPackets:  u.InputPackets + other.InputPackets,
+		OutputPackets: u.OutputPackets + other.OutputPackets,
+		SessionTime:   u.SessionTime + other.SessionTime,
+	}
+}
+
+// Returns a CDR stage that updates the store with the accounting packet, instead of doing it in the
+// handler, and adds to the CDR the usage of the session. To be registered with cdr.RegisterStage
+func (s *RadiusSessionStore) UsageStage() cdr.Stage {
+	return func(c *cdr.CDR) (bool, error) {
+		// Diameter accounting is not tracked
+		if c.Packet == nil {
+			return true, nil
+		}
+		_, usage := s.pushAccounting(c.Packet)
+
+		if c.Attributes == nil {
+			c.Attributes = make(map[string][]string)
+		}
+		c.Attributes[CDR_SESSION_INPUT_OCTETS] = []string{strconv.FormatUint(usage.InputOctets, 10)}
+		c.Attributes[CDR_SESSION_OUTPUT_OCTETS] = []string{strconv.FormatUint(usage.OutputOctets, 10)}
+		c.Attributes[CDR_SESSION_INPUT_PACKETS] = []string{strconv.FormatUint(usage.InputPackets, 10)}
+		c.Attributes[CDR_SESSION_OUTPUT_PACKETS] = []string{strconv.FormatUint(usage.OutputPackets, 10)}
+		c.Attributes[CDR_SESSION_TIME] = []string{strconv.FormatUint(usage.SessionTime, 10)}
+		return true, nil
+	}
+}
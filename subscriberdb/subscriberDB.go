@@ -0,0 +1,226 @@
+package subscriberdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"igor/config"
+	"igor/instrumentation"
+	"sync"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+)
+
+// Helper for handlers to look up the profiles of the subscribers in a PostgreSQL or MySQL database, using
+// the query specified in the subscriberDB.json configuration object. The profiles may be cached, and the
+// durations of the lookups are reported in the SubscriberQueryDuration metric, by result
+
+// Timeout of the queries when not specified in the configuration
+const DEFAULT_QUERY_TIMEOUT_MILLIS = 1000
+
+// Returned when the query does not return any row
+var ErrSubscriberNotFound = errors.New("subscriber not found")
+
+// Profile of the subscriber, as column name to value. The columns with NULL values are not included
+type Subscriber map[string]string
+
+// Entry in the cache. A nil subscriber means that it was not found
+type cacheEntry struct {
+	subscriber Subscriber
+	expiration time.Time
+}
+
+type SubscriberDB struct {
+	db   *sql.DB
+	stmt *sql.Stmt
+
+	// Configuration instance, to label the metrics
+	instanceName string
+
+	queryTimeout    time.Duration
+	cacheTTL        time.Duration
+	notFoundTTL     time.Duration
+	cacheMutex      sync.Mutex
+	cache           map[string]cacheEntry
+	lastCachePurged time.Time
+}
+
+// Creates the lookup module with the specified configuration, typically the SubscriberDBConf() of
+// the policy configuration instance with the specified name
+func NewSubscriberDB(instanceName string, conf config.SubscriberDBConfig) (*SubscriberDB, error) {
+	switch conf.Driver {
+	case "postgres", "mysql":
+	default:
+		return nil, fmt.Errorf("bad subscriber database driver %q", conf.Driver)
+	}
+
+	db, err := sql.Open(conf.Driver, conf.DataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(conf.MaxOpenConnections)
+	if conf.MaxIdleConnections != 0 {
+		db.SetMaxIdleConns(conf.MaxIdleConnections)
+	}
+	db.SetConnMaxLifetime(time.Duration(conf.ConnMaxLifetimeSeconds) * time.Second)
+
+	s, err := newSubscriberDB(instanceName, db, conf)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Creates the lookup module on the database, preparing the query
+func newSubscriberDB(instanceName string, db *sql.DB, conf config.SubscriberDBConfig) (*SubscriberDB, error) {
+	if conf.Query == "" {
+		return nil, errors.New("no subscriber query specified")
+	}
+
+	s := SubscriberDB{
+		db:           db,
+		instanceName: instanceName,
+		queryTimeout: time.Duration(conf.QueryTimeoutMillis) * time.Millisecond,
+		cacheTTL:     time.Duration(conf.CacheTTLSeconds) * time.Second,
+		notFoundTTL:  time.Duration(conf.NotFoundCacheTTLSeconds) * time.Second,
+		cache:        make(map[string]cacheEntry),
+	}
+	if s.queryTimeout == 0 {
+		s.queryTimeout = DEFAULT_QUERY_TIMEOUT_MILLIS * time.Millisecond
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+	stmt, err := db.PrepareContext(ctx, conf.Query)
+	if err != nil {
+		return nil, fmt.Errorf("could not prepare subscriber query: %w", err)
+	}
+	s.stmt = stmt
+
+	return &s, nil
+}
+
+// Returns the profile of the subscriber with the specified key, from the cache if there. If not found,
+// the error is ErrSubscriberNotFound
+func (s *SubscriberDB) GetSubscriber(key string) (Subscriber, error) {
+	return s.GetSubscriberWithContext(context.Background(), key)
+}
+
+// Same as GetSubscriber, with the context of the lookup, which is used for the database query and
+// whose trace is attached to the duration metric
+func (s *SubscriberDB) GetSubscriberWithContext(ctx context.Context, key string) (Subscriber, error) {
+	start := time.Now()
+
+	if entry, found := s.getCached(key, start); found {
+		instrumentation.PushSubscriberQueryDuration(ctx, s.instanceName, "cached", time.Since(start))
+		if entry.subscriber == nil {
+			return nil, ErrSubscriberNotFound
+		}
+		return entry.subscriber, nil
+	}
+
+	subscriber, err := s.query(ctx, key)
+	switch {
+	case err == nil:
+		instrumentation.PushSubscriberQueryDuration(ctx, s.instanceName, "found", time.Since(start))
+		s.setCached(key, subscriber, s.cacheTTL)
+	case errors.Is(err, ErrSubscriberNotFound):
+		instrumentation.PushSubscriberQueryDuration(ctx, s.instanceName, "notFound", time.Since(start))
+		s.setCached(key, nil, s.notFoundTTL)
+	default:
+		instrumentation.PushSubscriberQueryDuration(ctx, s.instanceName, "error", time.Since(start))
+	}
+	return subscriber, err
+}
+
+// Removes the subscriber from the cache, so that the next lookup goes to the database
+func (s *SubscriberDB) Invalidate(key string) {
+	s.cacheMutex.Lock()
+	defer s.cacheMutex.Unlock()
+	delete(s.cache, key)
+}
+
+// Releases the prepared statement and the connections
+func (s *SubscriberDB) Close() error {
+	s.stmt.Close()
+	return s.db.Close()
+}
+
+// Executes the query and builds the profile with the first row
+func (s *SubscriberDB) query(ctx context.Context, key string) (Subscriber, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	rows, err := s.stmt.QueryContext(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("subscriber query error: %w", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("subscriber query error: %w", err)
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("subscriber query error: %w", err)
+		}
+		return nil, fmt.Errorf("%s: %w", key, ErrSubscriberNotFound)
+	}
+
+	values := make([]sql.NullString, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	if err := rows.Scan(pointers...); err != nil {
+		return nil, fmt.Errorf("subscriber query error: %w", err)
+	}
+
+	subscriber := make(Subscriber, len(columns))
+	for i, column := range columns {
+		if values[i].Valid {
+			subscriber[column] = values[i].String
+		}
+	}
+	return subscriber, nil
+}
+
+// Returns the entry in the cache, if not expired
+func (s *SubscriberDB) getCached(key string, now time.Time) (cacheEntry, bool) {
+	s.cacheMutex.Lock()
+	defer s.cacheMutex.Unlock()
+
+	entry, found := s.cache[key]
+	if !found || now.After(entry.expiration) {
+		return cacheEntry{}, false
+	}
+	return entry, true
+}
+
+// Stores the subscriber in the cache, if the ttl is not zero. The expired entries are purged from
+// time to time
+func (s *SubscriberDB) setCached(key string, subscriber Subscriber, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	s.cacheMutex.Lock()
+	defer s.cacheMutex.Unlock()
+
+	now := time.Now()
+	s.cache[key] = cacheEntry{subscriber: subscriber, expiration: now.Add(ttl)}
+
+	if now.Sub(s.lastCachePurged) > ttl {
+		for k, entry := range s.cache {
+			if now.After(entry.expiration) {
+				delete(s.cache, k)
+			}
+		}
+		s.lastCachePurged = now
+	}
+}
@@ -0,0 +1,97 @@
+package subscriberdb
+
+import (
+	"errors"
+	"igor/config"
+	"igor/instrumentation"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestMain(m *testing.M) {
+
+	// Initialize the Config Object
+	config.InitPolicyConfigInstance("resources/searchRules.json", "testServer", true)
+
+	// Execute the tests and exit
+	os.Exit(m.Run())
+}
+
+func TestGetSubscriber(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("could not create mock database %s", err)
+	}
+
+	conf := config.SubscriberDBConfig{
+		Query:                   "SELECT plan, ip_address FROM subscribers WHERE user_name = $1",
+		CacheTTLSeconds:         60,
+		NotFoundCacheTTLSeconds: 60,
+	}
+	prepared := mock.ExpectPrepare("SELECT plan, ip_address FROM subscribers WHERE user_name")
+	s, err := newSubscriberDB("", db, conf)
+	if err != nil {
+		t.Fatalf("could not create subscriber database %s", err)
+	}
+
+	prepared.ExpectQuery().WithArgs("user@igor").WillReturnRows(sqlmock.NewRows([]string{"plan", "ip_address"}).AddRow("premium", nil))
+	subscriber, err := s.GetSubscriber("user@igor")
+	if err != nil {
+		t.Fatalf("could not get subscriber %s", err)
+	}
+	if subscriber["plan"] != "premium" {
+		t.Errorf("bad subscriber %v", subscriber)
+	}
+	if _, found := subscriber["ip_address"]; found {
+		t.Errorf("NULL column in subscriber %v", subscriber)
+	}
+
+	// Cached, so that the database is not queried again
+	if subscriber, err := s.GetSubscriber("user@igor"); err != nil || subscriber["plan"] != "premium" {
+		t.Errorf("bad cached subscriber %v %v", subscriber, err)
+	}
+
+	prepared.ExpectQuery().WithArgs("unknown@igor").WillReturnRows(sqlmock.NewRows([]string{"plan", "ip_address"}))
+	if _, err := s.GetSubscriber("unknown@igor"); !errors.Is(err, ErrSubscriberNotFound) {
+		t.Errorf("unknown subscriber found %v", err)
+	}
+	if _, err := s.GetSubscriber("unknown@igor"); !errors.Is(err, ErrSubscriberNotFound) {
+		t.Errorf("unknown subscriber found in cache %v", err)
+	}
+
+	// Invalidated entries are queried again
+	s.Invalidate("user@igor")
+	prepared.ExpectQuery().WithArgs("user@igor").WillReturnError(errors.New("connection lost"))
+	if _, err := s.GetSubscriber("user@igor"); err == nil || errors.Is(err, ErrSubscriberNotFound) {
+		t.Errorf("database error not reported %v", err)
+	}
+
+	prepared.WillBeClosed()
+	mock.ExpectClose()
+	s.Close()
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	// Wait for the metrics to be processed
+	time.Sleep(100 * time.Millisecond)
+	durations := instrumentation.MS.SubscriberQueryDurationQuery("SubscriberQueryDuration", nil, []string{"Result"})
+	for result, count := range map[string]uint64{"found": 1, "cached": 2, "notFound": 1, "error": 1} {
+		if h := durations[instrumentation.SubscriberQueryMetricKey{Result: result}]; h.Count != count {
+			t.Errorf("bad %s count %d", result, h.Count)
+		}
+	}
+}
+
+func TestSubscriberDBConfig(t *testing.T) {
+	if _, err := NewSubscriberDB("", config.SubscriberDBConfig{Driver: "oracle"}); err == nil {
+		t.Error("bad driver accepted")
+	}
+	if _, err := newSubscriberDB("", nil, config.SubscriberDBConfig{}); err == nil {
+		t.Error("empty query accepted")
+	}
+}
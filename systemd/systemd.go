@@ -0,0 +1,157 @@
+package systemd
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Integration with systemd. The listening sockets may be created by systemd and passed to igor
+// (socket activation), and the readiness and watchdog keep-alives are notified to systemd.
+// If igor is not executed by systemd, the functions in this package do nothing
+
+// File descriptor of the first socket passed by systemd
+var listenFdsStart = 3
+
+var filesOnce sync.Once
+var filesMutex sync.Mutex
+
+// Sockets passed by systemd not yet used
+var inheritedFiles []*os.File
+
+// Takes the sockets passed by systemd, as specified in the LISTEN_PID and LISTEN_FDS environment
+// variables, which are unset afterwards
+func loadInheritedFiles() {
+	filesOnce.Do(func() {
+		defer func() {
+			os.Unsetenv("LISTEN_PID")
+			os.Unsetenv("LISTEN_FDS")
+			os.Unsetenv("LISTEN_FDNAMES")
+		}()
+
+		pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		if err != nil || pid != os.Getpid() {
+			return
+		}
+		nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || nfds <= 0 {
+			return
+		}
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		for i := 0; i < nfds; i++ {
+			name := "LISTEN_FD_" + strconv.Itoa(listenFdsStart+i)
+			if i < len(names) && names[i] != "" {
+				name = names[i]
+			}
+			inheritedFiles = append(inheritedFiles, os.NewFile(uintptr(listenFdsStart+i), name))
+		}
+	})
+}
+
+// Returns the TCP listener passed by systemd for the specified port, if any. Each socket
+// is returned only once
+func TCPListener(port int) (net.Listener, bool) {
+	loadInheritedFiles()
+
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
+
+	for i, file := range inheritedFiles {
+		listener, err := net.FileListener(file)
+		if err != nil {
+			continue
+		}
+		if addr, ok := listener.Addr().(*net.TCPAddr); ok && addr.Port == port {
+			// The listener uses a copy of the file descriptor
+			file.Close()
+			inheritedFiles = append(inheritedFiles[:i], inheritedFiles[i+1:]...)
+			return listener, true
+		}
+		listener.Close()
+	}
+	return nil, false
+}
+
+// Returns the UDP socket passed by systemd for the specified port, if any. Each socket
+// is returned only once
+func UDPConn(port int) (net.PacketConn, bool) {
+	loadInheritedFiles()
+
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
+
+	for i, file := range inheritedFiles {
+		conn, err := net.FilePacketConn(file)
+		if err != nil {
+			continue
+		}
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.Port == port {
+			// The connection uses a copy of the file descriptor
+			file.Close()
+			inheritedFiles = append(inheritedFiles[:i], inheritedFiles[i+1:]...)
+			return conn, true
+		}
+		conn.Close()
+	}
+	return nil, false
+}
+
+// Sends the state to systemd, such as "READY=1" or "WATCHDOG=1". Returns false if not
+// executed by systemd with notification support
+func Notify(state string) (bool, error) {
+	socketName := os.Getenv("NOTIFY_SOCKET")
+	if socketName == "" {
+		return false, nil
+	}
+
+	// A name starting with "@" is an abstract socket, handled by the net package
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketName, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Returns the interval in which systemd expects watchdog keep-alives, or zero if the
+// watchdog is not enabled for this process
+func WatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Sends the watchdog keep-alives to systemd, with half the expected interval, until the
+// context is done. Does nothing if the watchdog is not enabled
+func StartWatchdog(ctx context.Context) {
+	interval := WatchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				Notify("WATCHDOG=1")
+			}
+		}
+	}()
+}
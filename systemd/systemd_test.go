@@ -0,0 +1,117 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Passes the file to the package as if it was the only socket from systemd
+func inheritFile(file *os.File) {
+	filesOnce = sync.Once{}
+	inheritedFiles = nil
+	listenFdsStart = int(file.Fd())
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+}
+
+func TestInheritedSockets(t *testing.T) {
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpListener.Close()
+	tcpFile, err := tcpListener.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpPort := tcpListener.Addr().(*net.TCPAddr).Port
+
+	inheritFile(tcpFile)
+	if _, found := UDPConn(tcpPort); found {
+		t.Fatal("found UDP socket for TCP listener")
+	}
+	listener, found := TCPListener(tcpPort)
+	if !found {
+		t.Fatal("TCP listener not found")
+	}
+	defer listener.Close()
+	if _, found := TCPListener(tcpPort); found {
+		t.Fatal("TCP listener returned twice")
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Fatal("LISTEN_FDS not unset")
+	}
+
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	udpFile, err := udpConn.(*net.UDPConn).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpPort := udpConn.LocalAddr().(*net.UDPAddr).Port
+
+	inheritFile(udpFile)
+	if _, found := TCPListener(udpPort); found {
+		t.Fatal("found TCP listener for UDP socket")
+	}
+	conn, found := UDPConn(udpPort)
+	if !found {
+		t.Fatal("UDP socket not found")
+	}
+	defer conn.Close()
+}
+
+func TestNotify(t *testing.T) {
+
+	// Not executed by systemd
+	os.Unsetenv("NOTIFY_SOCKET")
+	if sent, err := Notify("READY=1"); sent || err != nil {
+		t.Fatal("notification sent without NOTIFY_SOCKET", err)
+	}
+
+	socketName := filepath.Join(t.TempDir(), "notify.sock")
+	notifySocket, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketName, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer notifySocket.Close()
+	os.Setenv("NOTIFY_SOCKET", socketName)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	if sent, err := Notify("READY=1"); !sent || err != nil {
+		t.Fatal("notification not sent", err)
+	}
+	buffer := make([]byte, 64)
+	notifySocket.SetReadDeadline(time.Now().Add(1 * time.Second))
+	n, err := notifySocket.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buffer[:n]) != "READY=1" {
+		t.Fatalf("received %q", buffer[:n])
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	os.Setenv("WATCHDOG_USEC", "2000000")
+	if interval := WatchdogInterval(); interval != 2*time.Second {
+		t.Fatalf("interval was %s", interval)
+	}
+
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if interval := WatchdogInterval(); interval != 0 {
+		t.Fatal("watchdog enabled for other process")
+	}
+}
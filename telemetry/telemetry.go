@@ -0,0 +1,175 @@
+package telemetry
+
+import (
+	"context"
+	"igor/core"
+	"igor/diamcodec"
+	"igor/radiuscodec"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OpenTelemetry instrumentation
+//
+// Spans are generated for the radius and diameter requests handled, the requests sent to diameter peers and radius
+// servers, and the requests sent to the http handlers. They are recorded only if the application registers a
+// TracerProvider with otel.SetTracerProvider. Otherwise, the spans are no-ops and this instrumentation has no effect
+//
+// The trace context is propagated to the http handlers in the W3C traceparent and tracestate headers and, if so specified
+// in the configuration, to other diameter and radius nodes in an AVP or attribute with the value of the traceparent, so that
+// deployments with several hops may be traced end to end
+
+// Name of the instrumentation library, used to get the tracer
+const INSTRUMENTATION_NAME = "igor"
+
+// Name of the W3C trace context header with the identifiers of the trace and parent span
+const TRACEPARENT = "traceparent"
+
+var propagator = propagation.TraceContext{}
+
+// Starts a span of the specified kind, child of the span in the context, if any. The returned context holds the span and,
+// if the span is valid, its trace identifier as core.TraceId, so that the handlers and logs refer to the same trace
+func StartSpan(ctx context.Context, name string, kind trace.SpanKind, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx, span := otel.Tracer(INSTRUMENTATION_NAME).Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(attrs...))
+	if spanContext := span.SpanContext(); spanContext.IsValid() {
+		ctx = core.WithTraceId(ctx, spanContext.TraceID().String())
+	}
+	return ctx, span
+}
+
+// Starts a span for a request received
+func StartServerSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return StartSpan(ctx, name, trace.SpanKindServer, attrs...)
+}
+
+// Starts a span for a request sent
+func StartClientSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return StartSpan(ctx, name, trace.SpanKindClient, attrs...)
+}
+
+// Ends the span, recording the error, if not nil
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Writes the trace context of the span in the context to the http headers
+func InjectHTTP(ctx context.Context, header http.Header) {
+	propagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// Returns a copy of the context with the remote span in the http headers, if any, as parent
+func ExtractHTTP(ctx context.Context, header http.Header) context.Context {
+	return propagator.Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// Carrier for the traceparent only, since the diameter and radius messages do not transport the tracestate
+type traceparentCarrier struct {
+	traceparent string
+}
+
+func (c *traceparentCarrier) Get(key string) string {
+	if key == TRACEPARENT {
+		return c.traceparent
+	}
+	return ""
+}
+
+func (c *traceparentCarrier) Set(key string, value string) {
+	if key == TRACEPARENT {
+		c.traceparent = value
+	}
+}
+
+func (c *traceparentCarrier) Keys() []string {
+	return []string{TRACEPARENT}
+}
+
+// Returns the value of the traceparent for the span in the context, or the empty string if there is no valid span
+func Traceparent(ctx context.Context) string {
+	var carrier traceparentCarrier
+	propagator.Inject(ctx, &carrier)
+	return carrier.traceparent
+}
+
+// Returns a copy of the context with the remote span in the traceparent as parent. The context is not modified if the
+// traceparent is not valid
+func ContextWithTraceparent(ctx context.Context, traceparent string) context.Context {
+	if traceparent == "" {
+		return ctx
+	}
+	return propagator.Extract(ctx, &traceparentCarrier{traceparent: traceparent})
+}
+
+// Returns a copy of the diameter request with the traceparent of the span in the context in the specified AVP, replacing
+// the existing one. The same request is returned if the AVP name is empty or there is no valid span
+func InjectDiameter(ctx context.Context, request *diamcodec.DiameterMessage, avpName string) *diamcodec.DiameterMessage {
+	if avpName == "" {
+		return request
+	}
+	traceparent := Traceparent(ctx)
+	if traceparent == "" {
+		return request
+	}
+
+	// The original request may be referenced elsewhere. DeleteAllAVP creates a new list of AVPs
+	injected := *request
+	injected.DeleteAllAVP(avpName).Add(avpName, traceparent)
+	return &injected
+}
+
+// Returns a copy of the context with the remote span in the specified AVP of the diameter request as parent
+func ExtractDiameter(ctx context.Context, request *diamcodec.DiameterMessage, avpName string) context.Context {
+	if avpName == "" {
+		return ctx
+	}
+	return ContextWithTraceparent(ctx, request.GetStringAVP(avpName))
+}
+
+// Returns a copy of the radius request with the traceparent of the span in the context in the specified attribute, replacing
+// the existing one. The same request is returned if the attribute name is empty or there is no valid span
+func InjectRadius(ctx context.Context, request *radiuscodec.RadiusPacket, attributeName string) *radiuscodec.RadiusPacket {
+	if attributeName == "" {
+		return request
+	}
+	traceparent := Traceparent(ctx)
+	if traceparent == "" {
+		return request
+	}
+
+	return request.Copy().DeleteAllAVP(attributeName).Add(attributeName, traceparent)
+}
+
+// Returns a copy of the context with the remote span in the specified attribute of the radius request as parent
+func ExtractRadius(ctx context.Context, request *radiuscodec.RadiusPacket, attributeName string) context.Context {
+	if attributeName == "" {
+		return ctx
+	}
+	return ContextWithTraceparent(ctx, request.GetStringAVP(attributeName))
+}
+
+// Returns the attributes of the span for a diameter request
+func DiameterAttributes(request *diamcodec.DiameterMessage) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("diameter.application", request.ApplicationName),
+		attribute.String("diameter.command", request.CommandName),
+		attribute.String("diameter.origin_host", request.GetStringAVP("Origin-Host")),
+		attribute.String("diameter.session_id", request.GetStringAVP("Session-Id")),
+	}
+}
+
+// Returns the attributes of the span for a radius request
+func RadiusAttributes(request *radiuscodec.RadiusPacket) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.Int("radius.code", int(request.Code)),
+		attribute.String("radius.user_name", request.GetStringAVP("User-Name")),
+	}
+}
@@ -0,0 +1,93 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"igor/config"
+	"igor/core"
+	"igor/diamcodec"
+	"igor/radiuscodec"
+	"net/http"
+	"os"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestMain(m *testing.M) {
+
+	// Initialize the Config Objects
+	config.InitPolicyConfigInstance("resources/searchRules.json", "testServer", true)
+
+	// Execute the tests and exit
+	os.Exit(m.Run())
+}
+
+func TestNoTracerProvider(t *testing.T) {
+	request, _ := diamcodec.NewDiameterRequest("TestApplication", "TestRequest")
+	ctx, span := StartClientSpan(context.Background(), "test")
+	defer span.End()
+
+	if InjectDiameter(ctx, request, "franciscocardosogil-TraceParent") != request {
+		t.Error("request modified without a valid span")
+	}
+	if core.TraceId(ctx) != "" {
+		t.Error("trace id set without a valid span")
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	// Diameter
+	request, _ := diamcodec.NewDiameterRequest("TestApplication", "TestRequest")
+	request.Add("franciscocardosogil-TraceParent", "00-00000000000000000000000000000001-0000000000000001-01")
+	clientCtx, clientSpan := StartClientSpan(context.Background(), "diameter send")
+	injected := InjectDiameter(clientCtx, request, "franciscocardosogil-TraceParent")
+	if len(request.GetAllAVP("franciscocardosogil-TraceParent")) != 1 || len(injected.GetAllAVP("franciscocardosogil-TraceParent")) != 1 {
+		t.Fatalf("bad injection in %s", injected)
+	}
+	serverCtx, serverSpan := StartServerSpan(ExtractDiameter(context.Background(), injected, "franciscocardosogil-TraceParent"), "diameter")
+	if serverSpan.SpanContext().TraceID() != clientSpan.SpanContext().TraceID() {
+		t.Errorf("trace not propagated in diameter AVP")
+	}
+	if core.TraceId(serverCtx) != clientSpan.SpanContext().TraceID().String() {
+		t.Errorf("bad trace id %s", core.TraceId(serverCtx))
+	}
+	EndSpan(serverSpan, errors.New("handler error"))
+	EndSpan(clientSpan, nil)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 || spans[0].Parent().SpanID() != clientSpan.SpanContext().SpanID() || spans[0].SpanKind() != trace.SpanKindServer {
+		t.Fatalf("bad spans recorded %v", spans)
+	}
+	if spans[0].Status().Code != codes.Error {
+		t.Errorf("error not recorded")
+	}
+
+	// Radius
+	packet := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+	clientCtx, clientSpan = StartClientSpan(context.Background(), "radius send")
+	defer clientSpan.End()
+	injectedPacket := InjectRadius(clientCtx, packet, "Igor-TraceParent")
+	if injectedPacket == packet || injectedPacket.GetStringAVP("Igor-TraceParent") != Traceparent(clientCtx) {
+		t.Fatalf("bad injection in %s", injectedPacket)
+	}
+	remote := trace.SpanContextFromContext(ExtractRadius(context.Background(), injectedPacket, "Igor-TraceParent"))
+	if !remote.IsRemote() || remote.SpanID() != clientSpan.SpanContext().SpanID() {
+		t.Errorf("trace not propagated in radius attribute")
+	}
+
+	// HTTP
+	header := make(http.Header)
+	InjectHTTP(clientCtx, header)
+	if header.Get(TRACEPARENT) == "" || trace.SpanContextFromContext(ExtractHTTP(context.Background(), header)).TraceID() != clientSpan.SpanContext().TraceID() {
+		t.Errorf("trace not propagated in http headers %v", header)
+	}
+}
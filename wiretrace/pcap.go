@@ -0,0 +1,148 @@
+package wiretrace
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Generation of pcap files (https://wiki.wireshark.org/Development/LibpcapFileFormat)
+//
+// The messages are encapsulated in synthetic IP packets, with UDP headers for radius and TCP headers for diameter,
+// using the addresses and ports of the sockets, so that Wireshark decodes them with the standard dissectors. The
+// diameter messages sent over SCTP are also written with TCP headers. The checksums of UDP and TCP are not calculated
+
+const (
+	PCAP_MAGIC = 0xa1b2c3d4
+
+	// Raw IPv4 or IPv6 packets, without link layer header
+	PCAP_LINKTYPE_RAW = 101
+
+	PCAP_SNAPLEN = 65535
+)
+
+const (
+	ipProtocolTCP = 6
+	ipProtocolUDP = 17
+)
+
+// Returns the header of the pcap file
+func pcapFileHeader() []byte {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], PCAP_MAGIC)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], PCAP_SNAPLEN)
+	binary.LittleEndian.PutUint32(header[20:], PCAP_LINKTYPE_RAW)
+	return header
+}
+
+// Returns the packet with the pcap record header, truncated to the snaplen
+func pcapRecord(timestamp time.Time, packet []byte) []byte {
+	capturedLen := len(packet)
+	if capturedLen > PCAP_SNAPLEN {
+		capturedLen = PCAP_SNAPLEN
+	}
+	record := make([]byte, 16, 16+capturedLen)
+	binary.LittleEndian.PutUint32(record[0:], uint32(timestamp.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(timestamp.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(capturedLen))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+	return append(record, packet[:capturedLen]...)
+}
+
+// Returns the IP packet with the UDP datagram
+func udpPacket(src net.Addr, dst net.Addr, payload []byte) []byte {
+	datagram := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(datagram[0:], uint16(addrPort(src)))
+	binary.BigEndian.PutUint16(datagram[2:], uint16(addrPort(dst)))
+	binary.BigEndian.PutUint16(datagram[4:], uint16(8+len(payload)))
+	return ipPacket(addrIP(src), addrIP(dst), ipProtocolUDP, append(datagram, payload...))
+}
+
+// Returns the IP packet with the TCP segment, with the PSH and ACK flags set
+func tcpPacket(src net.Addr, dst net.Addr, sequence uint32, payload []byte) []byte {
+	segment := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(segment[0:], uint16(addrPort(src)))
+	binary.BigEndian.PutUint16(segment[2:], uint16(addrPort(dst)))
+	binary.BigEndian.PutUint32(segment[4:], sequence)
+	segment[12] = 5 << 4
+	segment[13] = 0x18
+	binary.BigEndian.PutUint16(segment[14:], 65535)
+	return ipPacket(addrIP(src), addrIP(dst), ipProtocolTCP, append(segment, payload...))
+}
+
+// Returns the IPv4 packet or, if any of the addresses is not IPv4, the IPv6 packet
+func ipPacket(src net.IP, dst net.IP, protocol byte, payload []byte) []byte {
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		header := make([]byte, 20, 20+len(payload))
+		header[0] = 0x45
+		binary.BigEndian.PutUint16(header[2:], uint16(20+len(payload)))
+		header[8] = 64
+		header[9] = protocol
+		copy(header[12:], src4)
+		copy(header[16:], dst4)
+		binary.BigEndian.PutUint16(header[10:], ipChecksum(header))
+		return append(header, payload...)
+	}
+
+	header := make([]byte, 40, 40+len(payload))
+	header[0] = 0x60
+	binary.BigEndian.PutUint16(header[4:], uint16(len(payload)))
+	header[6] = protocol
+	header[7] = 64
+	copy(header[8:], src.To16())
+	copy(header[24:], dst.To16())
+	return append(header, payload...)
+}
+
+// Ones' complement checksum of the IPv4 header
+func ipChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// Returns the IP address of the socket address, or the unspecified one if not available
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	case nil:
+		return net.IPv4zero
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return net.IPv4zero
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip
+	}
+	return net.IPv4zero
+}
+
+// Returns the port of the socket address, or zero if not available
+func addrPort(addr net.Addr) int {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.Port
+	case *net.TCPAddr:
+		return a.Port
+	case nil:
+		return 0
+	}
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return 0
+	}
+	p, _ := strconv.Atoi(port)
+	return p
+}
@@ -0,0 +1,384 @@
+package wiretrace
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"igor/diamcodec"
+	"igor/radiuscodec"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Capture of the diameter and radius messages exchanged, for debugging production issues without enabling
+// debug logging.
+//
+// The messages sent and received by the diameter peers, the radius server and the radius client that match
+// the filter are written to a file, either as a line of JSON with the decoded message or as a packet in a
+// pcap file that may be opened with Wireshark. The file is rotated when it reaches the specified size,
+// keeping the specified number of rotated files.
+//
+// There is a single trace, started and stopped at runtime. When not active, the cost for the callers is a
+// check of an atomic flag
+
+// Formats of the trace files
+const (
+	FORMAT_JSON = "json"
+	FORMAT_PCAP = "pcap"
+)
+
+// Directions of the messages
+const (
+	DIRECTION_IN  = "in"
+	DIRECTION_OUT = "out"
+)
+
+// Protocols of the messages
+const (
+	PROTOCOL_DIAMETER = "diameter"
+	PROTOCOL_RADIUS   = "radius"
+)
+
+// Defaults for the rotation of the files
+const (
+	DEFAULT_ROTATE_BYTES = 10 * 1024 * 1024
+	DEFAULT_MAX_FILES    = 5
+)
+
+// Layout of the suffix of the rotated files
+const ROTATION_SUFFIX_LAYOUT = "20060102T150405.000"
+
+// Selects the messages to trace. The empty fields match all messages
+type Filter struct {
+	// Diameter-Host of the diameter peer, or IP address of the radius client or server
+	Peer string
+
+	// Name of the diameter command, such as "Credit-Control", or radius code, as a number or
+	// a name such as "Access-Request"
+	Command string
+
+	// Regular expression that the User-Name must match
+	UserName string
+}
+
+// Parameters of a trace
+type Options struct {
+	Filter
+
+	// "json" (the default) or "pcap"
+	Format string
+
+	// Name of the file where the messages are written
+	Path string
+
+	// Size at which the file is rotated, and number of rotated files to keep
+	RotateBytes int64
+	MaxFiles    int
+}
+
+// Current state of the trace
+type Status struct {
+	Active  bool
+	Options Options
+
+	// Number of messages written since the trace was started
+	Messages  uint64
+	StartTime time.Time
+}
+
+// Line in the JSON trace files
+type Entry struct {
+	Timestamp     time.Time
+	Direction     string
+	Protocol      string
+	Peer          string `json:",omitempty"`
+	LocalAddress  string
+	RemoteAddress string
+	Message       interface{}
+}
+
+// Names of the radius codes that may be used in the filter
+var radiusCodeNames = map[byte]string{
+	radiuscodec.ACCESS_REQUEST:      "Access-Request",
+	radiuscodec.ACCESS_ACCEPT:       "Access-Accept",
+	radiuscodec.ACCESS_REJECT:       "Access-Reject",
+	radiuscodec.ACCESS_CHALLENGE:    "Access-Challenge",
+	radiuscodec.ACCOUNTING_REQUEST:  "Accounting-Request",
+	radiuscodec.ACCOUNTING_RESPONSE: "Accounting-Response",
+	radiuscodec.DISCONNECT_REQUEST:  "Disconnect-Request",
+	radiuscodec.DISCONECT_ACK:       "Disconnect-ACK",
+	radiuscodec.DISCONNECT_NAK:      "Disconnect-NAK",
+	radiuscodec.COA_REQUEST:         "CoA-Request",
+	radiuscodec.COA_ACK:             "CoA-ACK",
+	radiuscodec.COA_NAK:             "CoA-NAK",
+}
+
+// Set to 1 while a trace is active, so that the callers do not need to take the lock
+var active int32
+
+var traceMutex sync.Mutex
+var currentTracer *tracer
+
+// Returns true if there is a trace active. The callers may use it to avoid preparing the
+// arguments of TraceDiameter or TraceRadius
+func IsActive() bool {
+	return atomic.LoadInt32(&active) == 1
+}
+
+// Starts a trace, replacing the one active, if any
+func Start(options Options) error {
+	t, err := newTracer(options)
+	if err != nil {
+		return err
+	}
+
+	traceMutex.Lock()
+	defer traceMutex.Unlock()
+	if currentTracer != nil {
+		currentTracer.close()
+	}
+	currentTracer = t
+	atomic.StoreInt32(&active, 1)
+	return nil
+}
+
+// Stops the active trace, if any, and returns its final status
+func Stop() (Status, error) {
+	traceMutex.Lock()
+	defer traceMutex.Unlock()
+	if currentTracer == nil {
+		return Status{}, nil
+	}
+	atomic.StoreInt32(&active, 0)
+	status := currentTracer.status()
+	status.Active = false
+	err := currentTracer.close()
+	currentTracer = nil
+	return status, err
+}
+
+// Returns the status of the trace
+func GetStatus() Status {
+	traceMutex.Lock()
+	defer traceMutex.Unlock()
+	if currentTracer == nil {
+		return Status{}
+	}
+	return currentTracer.status()
+}
+
+// Writes the diameter message to the trace, if active and the message matches the filter. The peer is the
+// Diameter-Host of the remote peer, and the addresses those of the connection
+func TraceDiameter(direction string, peer string, localAddr net.Addr, remoteAddr net.Addr, message *diamcodec.DiameterMessage) {
+	if !IsActive() {
+		return
+	}
+
+	traceMutex.Lock()
+	defer traceMutex.Unlock()
+	if currentTracer == nil || !currentTracer.matches(peer, message.CommandName, "", message.GetStringAVP("User-Name")) {
+		return
+	}
+	currentTracer.writeDiameter(direction, peer, localAddr, remoteAddr, message)
+}
+
+// Writes the radius packet to the trace, if active and the packet matches the filter. The packetBytes are
+// those sent or received in the socket, and are used only in the pcap format
+func TraceRadius(direction string, localAddr net.Addr, remoteAddr net.Addr, packet *radiuscodec.RadiusPacket, packetBytes []byte) {
+	if !IsActive() {
+		return
+	}
+
+	traceMutex.Lock()
+	defer traceMutex.Unlock()
+	peer := addrIP(remoteAddr).String()
+	if currentTracer == nil || !currentTracer.matches(peer, strconv.Itoa(int(packet.Code)), radiusCodeNames[packet.Code], packet.GetStringAVP("User-Name")) {
+		return
+	}
+	currentTracer.writeRadius(direction, peer, localAddr, remoteAddr, packet, packetBytes)
+}
+
+// Writes the messages of a trace to a file
+type tracer struct {
+	options       Options
+	userNameRegex *regexp.Regexp
+
+	file     *os.File
+	size     int64
+	messages uint64
+	started  time.Time
+
+	// Next sequence number in each direction of the TCP connections in the pcap files, so that
+	// Wireshark reassembles the diameter messages
+	tcpSequences map[string]uint32
+}
+
+// Validates the options, setting the defaults, and creates the file
+func newTracer(options Options) (*tracer, error) {
+	if options.Path == "" {
+		return nil, errors.New("trace file not specified")
+	}
+	switch options.Format {
+	case "":
+		options.Format = FORMAT_JSON
+	case FORMAT_JSON, FORMAT_PCAP:
+	default:
+		return nil, fmt.Errorf("bad trace format %q", options.Format)
+	}
+	if options.RotateBytes <= 0 {
+		options.RotateBytes = DEFAULT_ROTATE_BYTES
+	}
+	if options.MaxFiles <= 0 {
+		options.MaxFiles = DEFAULT_MAX_FILES
+	}
+
+	t := tracer{options: options, started: time.Now(), tcpSequences: make(map[string]uint32)}
+	if options.UserName != "" {
+		regex, err := regexp.Compile(options.UserName)
+		if err != nil {
+			return nil, fmt.Errorf("bad User-Name regular expression: %w", err)
+		}
+		t.userNameRegex = regex
+	}
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (t *tracer) status() Status {
+	return Status{Active: true, Options: t.options, Messages: t.messages, StartTime: t.started}
+}
+
+// Checks the filter. The command of radius packets may be specified by code or name
+func (t *tracer) matches(peer string, command string, commandName string, userName string) bool {
+	if t.options.Peer != "" && t.options.Peer != peer {
+		return false
+	}
+	if t.options.Command != "" && t.options.Command != command && t.options.Command != commandName {
+		return false
+	}
+	if t.userNameRegex != nil && !t.userNameRegex.MatchString(userName) {
+		return false
+	}
+	return true
+}
+
+func (t *tracer) writeDiameter(direction string, peer string, localAddr net.Addr, remoteAddr net.Addr, message *diamcodec.DiameterMessage) {
+	if t.options.Format == FORMAT_PCAP {
+		messageBytes, err := message.MarshalBinary()
+		if err != nil {
+			return
+		}
+		src, dst := localAddr, remoteAddr
+		if direction == DIRECTION_IN {
+			src, dst = remoteAddr, localAddr
+		}
+		flow := addrString(src) + ">" + addrString(dst)
+		sequence := t.tcpSequences[flow]
+		t.tcpSequences[flow] = sequence + uint32(len(messageBytes))
+		t.write(pcapRecord(time.Now(), tcpPacket(src, dst, sequence, messageBytes)))
+		return
+	}
+	t.writeEntry(Entry{Direction: direction, Protocol: PROTOCOL_DIAMETER, Peer: peer, LocalAddress: addrString(localAddr), RemoteAddress: addrString(remoteAddr), Message: message})
+}
+
+func (t *tracer) writeRadius(direction string, peer string, localAddr net.Addr, remoteAddr net.Addr, packet *radiuscodec.RadiusPacket, packetBytes []byte) {
+	if t.options.Format == FORMAT_PCAP {
+		src, dst := localAddr, remoteAddr
+		if direction == DIRECTION_IN {
+			src, dst = remoteAddr, localAddr
+		}
+		t.write(pcapRecord(time.Now(), udpPacket(src, dst, packetBytes)))
+		return
+	}
+	t.writeEntry(Entry{Direction: direction, Protocol: PROTOCOL_RADIUS, Peer: peer, LocalAddress: addrString(localAddr), RemoteAddress: addrString(remoteAddr), Message: packet})
+}
+
+func (t *tracer) writeEntry(entry Entry) {
+	entry.Timestamp = time.Now()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	t.write(append(line, '\n'))
+}
+
+// Writes the record, rotating the file if the size would exceed the limit. The errors are ignored, since
+// the trace must not interfere with the processing of the messages
+func (t *tracer) write(record []byte) {
+	if t.size+int64(len(record)) > t.options.RotateBytes {
+		if err := t.rotate(); err != nil {
+			return
+		}
+	}
+	n, _ := t.file.Write(record)
+	t.size += int64(n)
+	t.messages++
+}
+
+// Creates the file, truncating it if it exists, and writes the pcap header if in that format
+func (t *tracer) open() error {
+	file, err := os.Create(t.options.Path)
+	if err != nil {
+		return err
+	}
+	t.file = file
+	t.size = 0
+	if t.options.Format == FORMAT_PCAP {
+		n, err := file.Write(pcapFileHeader())
+		if err != nil {
+			file.Close()
+			return err
+		}
+		t.size = int64(n)
+	}
+	return nil
+}
+
+// Renames the current file with the timestamp suffix, removes the oldest rotated files and opens a new one
+func (t *tracer) rotate() error {
+	if err := t.file.Close(); err != nil {
+		return err
+	}
+	suffix := time.Now().Format(ROTATION_SUFFIX_LAYOUT)
+	rotatedPath := t.options.Path + "." + suffix
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotatedPath); os.IsNotExist(err) {
+			break
+		}
+		rotatedPath = fmt.Sprintf("%s.%s.%d", t.options.Path, suffix, i)
+	}
+	if err := os.Rename(t.options.Path, rotatedPath); err != nil {
+		return err
+	}
+
+	// The suffixes sort in chronological order
+	if rotated, err := filepath.Glob(t.options.Path + ".*"); err == nil && len(rotated) > t.options.MaxFiles {
+		sort.Strings(rotated)
+		for _, fileName := range rotated[:len(rotated)-t.options.MaxFiles] {
+			os.Remove(fileName)
+		}
+	}
+
+	return t.open()
+}
+
+func (t *tracer) close() error {
+	return t.file.Close()
+}
+
+// Returns the textual representation of the address, or the empty string if nil
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
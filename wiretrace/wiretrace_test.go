@@ -0,0 +1,113 @@
+package wiretrace
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"igor/config"
+	"igor/diamcodec"
+	"igor/radiuscodec"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+
+	// Initialize the Config Objects
+	config.InitPolicyConfigInstance("resources/searchRules.json", "testServer", true)
+
+	// Execute the tests and exit
+	os.Exit(m.Run())
+}
+
+var localAddr = &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3868}
+var remoteAddr = &net.TCPAddr{IP: net.ParseIP("127.0.0.2"), Port: 40000}
+
+func TestJSONTrace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.json")
+	if err := Start(Options{Path: path, Filter: Filter{Command: "Access-Request", UserName: "^user@"}}); err != nil {
+		t.Fatal(err)
+	}
+	if !IsActive() {
+		t.Fatal("trace not active")
+	}
+
+	// Only the first packet matches
+	packet := radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+	packet.Add("User-Name", "user@igor")
+	TraceRadius(DIRECTION_IN, localAddr, remoteAddr, packet, nil)
+	packet = radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST)
+	packet.Add("User-Name", "other@igor")
+	TraceRadius(DIRECTION_IN, localAddr, remoteAddr, packet, nil)
+	TraceRadius(DIRECTION_OUT, localAddr, remoteAddr, radiuscodec.NewRadiusRequest(radiuscodec.ACCOUNTING_REQUEST), nil)
+	request, _ := diamcodec.NewDiameterRequest("TestApplication", "TestRequest")
+	TraceDiameter(DIRECTION_OUT, "server.igor", localAddr, remoteAddr, request)
+
+	status, err := Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Messages != 1 || IsActive() {
+		t.Errorf("bad status %v", status)
+	}
+
+	file, _ := os.Open(path)
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	var lines []Entry
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, entry)
+	}
+	if len(lines) != 1 || lines[0].Peer != "127.0.0.2" || lines[0].Protocol != PROTOCOL_RADIUS || lines[0].Direction != DIRECTION_IN {
+		t.Errorf("bad trace entries %v", lines)
+	}
+
+	if err := Start(Options{Path: path, Filter: Filter{UserName: "("}}); err == nil {
+		t.Error("bad regular expression accepted")
+	}
+}
+
+func TestPcapTrace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.pcap")
+	if err := Start(Options{Path: path, Format: FORMAT_PCAP, RotateBytes: 200, MaxFiles: 1, Filter: Filter{Peer: "server.igor"}}); err != nil {
+		t.Fatal(err)
+	}
+	request, _ := diamcodec.NewDiameterRequest("TestApplication", "TestRequest")
+	request.Add("User-Name", "user@igor")
+	requestBytes, _ := request.MarshalBinary()
+	TraceDiameter(DIRECTION_OUT, "server.igor", localAddr, remoteAddr, request)
+	TraceDiameter(DIRECTION_OUT, "client.igor", localAddr, remoteAddr, request)
+	if _, err := Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, _ := os.ReadFile(path)
+	if len(contents) != 24+16+20+20+len(requestBytes) || binary.LittleEndian.Uint32(contents) != PCAP_MAGIC {
+		t.Fatalf("bad pcap file of size %d", len(contents))
+	}
+	ipHeader := contents[40:60]
+	if ipHeader[9] != ipProtocolTCP || !net.IP(ipHeader[12:16]).Equal(localAddr.IP) || ipChecksum(ipHeader) != 0 {
+		t.Errorf("bad ip header %v", ipHeader)
+	}
+	if binary.BigEndian.Uint16(contents[62:]) != 40000 {
+		t.Errorf("bad destination port")
+	}
+
+	// Rotation, keeping one file
+	if err := Start(Options{Path: path, Format: FORMAT_PCAP, RotateBytes: 200, MaxFiles: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		TraceRadius(DIRECTION_IN, localAddr, remoteAddr, radiuscodec.NewRadiusRequest(radiuscodec.ACCESS_REQUEST), make([]byte, 100))
+	}
+	Stop()
+	if rotated, _ := filepath.Glob(path + ".*"); len(rotated) != 1 {
+		t.Errorf("rotated files are %v", rotated)
+	}
+}